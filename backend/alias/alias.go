@@ -0,0 +1,50 @@
+// Package alias は、設定にある他のストレージのディレクトリに別名を付けます。
+//
+// s3:/team-backups/projects/2025/clientA のような長い指定を毎回書かずに
+// 済むよう、よく使う起点に名前を付けておくためのものです。
+//
+//	storages:
+//	  - name: projects
+//	    type: alias
+//	    remote: s3:/team-backups/projects
+//
+// と書けば、projects:/2025/clientA が s3:/team-backups/projects/2025/clientA を
+// 指します。crypt などの remote にも、別名をそのまま書けます。
+//
+// 中身は backend.Remote が返すものそのものです。指す先は、別名が実際に
+// 使われたときに初めて組み立てるので、使わない別名のために接続や認証が
+// 走ることはありません。
+package alias
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Type はこのバックエンドの種別名です。
+const Type = "alias"
+
+func init() {
+	backend.Register(backend.Descriptor{
+		Type:    Type,
+		Summary: "他のストレージのディレクトリに別名を付ける",
+		ConfigDoc: `  # - name: projects
+  #   type: alias
+  #   remote: s3:/team-backups/projects  # 指す先（設定にあるストレージ名:パス）
+`,
+		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
+			remote := params.Get("remote")
+			if remote == "" {
+				return nil, fmt.Errorf("alias %s: remote が設定されていません", name)
+			}
+			s, err := backend.Remote(ctx, remote)
+			if err != nil {
+				return nil, fmt.Errorf("alias %s: %w", name, err)
+			}
+			return s, nil
+		},
+	})
+}
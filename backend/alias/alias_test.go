@@ -0,0 +1,112 @@
+package alias_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/backend/alias"
+	"github.com/mt3hr/hbg/backend/crypt"
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/storage"
+)
+
+// newResolver は、メモリと、それを指す別名を並べた Resolver を作ります。
+func newResolver(t *testing.T, entries ...backend.Entry) *backend.Resolver {
+	t.Helper()
+	r, err := backend.NewResolver(append([]backend.Entry{{Name: "mem", Type: memory.Type}}, entries...))
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func get(t *testing.T, r *backend.Resolver, name string) storage.Storage {
+	t.Helper()
+	s, err := r.Get(context.Background(), name)
+	if err != nil {
+		t.Fatalf("Get(%s): %v", name, err)
+	}
+	return s
+}
+
+// 別名を通したパスが、指す先の起点の下を指すことを確認します。
+func TestReRoots(t *testing.T) {
+	ctx := context.Background()
+	r := newResolver(t, backend.Entry{Name: "projects", Type: alias.Type, Params: backend.Params{"remote": "mem:/team-backups/projects"}})
+
+	s := get(t, r, "projects")
+	if _, err := s.Put(ctx, "/2025/clientA/a.txt", strings.NewReader("a"), storage.ObjectMeta{Size: 1}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := get(t, r, "mem").Stat(ctx, "/team-backups/projects/2025/clientA/a.txt"); err != nil {
+		t.Errorf("起点の下に置かれていない: %v", err)
+	}
+
+	entries, err := storage.ListAll(ctx, s, "/2025/clientA")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != "/2025/clientA/a.txt" {
+		t.Errorf("一覧 = %v", entries)
+	}
+}
+
+// 別名は使われるまで、指す先を組み立てないことを確認します。
+func TestIsLazy(t *testing.T) {
+	r := newResolver(t,
+		backend.Entry{Name: "projects", Type: alias.Type, Params: backend.Params{"remote": "mem:/projects"}},
+		backend.Entry{Name: "other", Type: memory.Type},
+	)
+
+	get(t, r, "other")
+	if opened := r.OpenedNames(); len(opened) != 1 || opened[0] != "other" {
+		t.Errorf("組み立てられたもの = %v, want [other]", opened)
+	}
+	get(t, r, "projects")
+	if opened := strings.Join(r.OpenedNames(), " "); opened != "mem other projects" {
+		t.Errorf("組み立てられたもの = %s, want mem other projects", opened)
+	}
+}
+
+// 別名の上に crypt を重ねても、crypt の上に別名を付けても使えることを確認します。
+func TestChainsWithCrypt(t *testing.T) {
+	ctx := context.Background()
+	r := newResolver(t,
+		backend.Entry{Name: "vault", Type: alias.Type, Params: backend.Params{"remote": "mem:/vault"}},
+		backend.Entry{Name: "secure", Type: crypt.Type, Params: backend.Params{"remote": "vault:/secret", "password": "パスワード"}},
+		backend.Entry{Name: "docs", Type: alias.Type, Params: backend.Params{"remote": "secure:/docs"}},
+	)
+
+	docs := get(t, r, "docs")
+	if _, err := docs.Put(ctx, "/memo.txt", strings.NewReader("秘密"), storage.ObjectMeta{Size: int64(len("秘密"))}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	rc, _, err := get(t, r, "secure").Open(ctx, "/docs/memo.txt")
+	if err != nil {
+		t.Fatalf("crypt から Open: %v", err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(got) != "秘密" {
+		t.Errorf("crypt から読んだ内容 = %q, %v", got, err)
+	}
+
+	for p, content := range get(t, r, "mem").(*memory.Storage).Snapshot() {
+		if !strings.HasPrefix(p, "/vault/secret/") || strings.Contains(p, "memo") || strings.Contains(content, "秘密") {
+			t.Errorf("暗号化されずに置かれている: %s", p)
+		}
+	}
+}
+
+// 指す先を書き忘れたら、組み立てられないことを確認します。
+func TestRequiresRemote(t *testing.T) {
+	r := newResolver(t, backend.Entry{Name: "broken", Type: alias.Type})
+	if _, err := r.Get(context.Background(), "broken"); err == nil || !strings.Contains(err.Error(), "remote") {
+		t.Errorf("err = %v, remote が無いことを知らせるべき", err)
+	}
+}
@@ -0,0 +1,473 @@
+package azureblob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Blob Storage の窓口は REST で、hbg が使うのは一覧・取得・書き込み・
+// 削除・コピーの10ほどです。onedrive と同じく、必要なところだけ
+// 自前で組み立てます。
+//
+// 公式の SDK を使わないのは、azcore とその依存が大きく、取り込むと
+// ビルドの時間と依存の数がかなり増えるためです。署名も数十行で書けます。
+
+// apiVersion は要求に添える版です。この版の形で応答が返ります。
+const apiVersion = "2021-12-02"
+
+// metaHeaderPrefix は利用者定義の項目を表す見出しの接頭辞です。
+const metaHeaderPrefix = "x-ms-meta-"
+
+// blobClient は1つの入れ物とのやりとりです。
+type blobClient struct {
+	http      *http.Client
+	cred      *credential
+	container string
+}
+
+// --- 接続先の組み立て ---
+
+// url は入れ物の中の name を指す接続先を返します。name が空なら入れ物そのものです。
+func (c *blobClient) url(name string, query url.Values) string {
+	u := c.cred.endpoint + "/" + url.PathEscape(c.container)
+	if name != "" {
+		u += "/" + escapeName(name)
+	}
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	for k, v := range c.cred.sas {
+		q[k] = v
+	}
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	return u
+}
+
+// escapeName は名前を接続先に埋め込める形にします。"/" は区切りのまま残します。
+func escapeName(name string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// --- 署名 ---
+
+// sign は要求に日時と版を添え、口座の鍵があれば署名します。
+//
+// 署名は、要求の主な見出しと x-ms- で始まる見出し、接続先のパスと
+// 問い合わせを決まった形に並べたものの HMAC-SHA256 です。
+// SAS で認証するときは、接続先に SAS が含まれているので署名しません。
+func (c *blobClient) sign(req *http.Request) {
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", apiVersion)
+	if c.cred.key == nil {
+		return
+	}
+
+	mac := hmac.New(sha256.New, c.cred.key)
+	mac.Write([]byte(stringToSign(c.cred.account, req)))
+	req.Header.Set("Authorization",
+		"SharedKey "+c.cred.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// stringToSign は署名する文字列を組み立てます。
+func stringToSign(account string, req *http.Request) string {
+	length := ""
+	if req.ContentLength > 0 {
+		// 版 2015-02-21 からは、長さが 0 のときは空にする決まり。
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	h := req.Header.Get
+	lines := []string{
+		req.Method,
+		h("Content-Encoding"),
+		h("Content-Language"),
+		length,
+		h("Content-MD5"),
+		h("Content-Type"),
+		// 日時は x-ms-date で送るので、Date は空にする。
+		"",
+		h("If-Modified-Since"),
+		h("If-Match"),
+		h("If-None-Match"),
+		h("If-Unmodified-Since"),
+		h("Range"),
+	}
+
+	var b strings.Builder
+	b.WriteString(strings.Join(lines, "\n"))
+	b.WriteString("\n")
+
+	var names []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			names = append(names, lower)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		b.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	b.WriteString("/" + account + req.URL.EscapedPath())
+	q := req.URL.Query()
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b string) int { return strings.Compare(strings.ToLower(a), strings.ToLower(b)) })
+	for _, k := range keys {
+		values := slices.Sorted(slices.Values(q[k]))
+		b.WriteString("\n" + strings.ToLower(k) + ":" + strings.Join(values, ","))
+	}
+	return b.String()
+}
+
+// --- 要求の送信 ---
+
+// request は1つの要求を送ります。応答は呼び出し側が閉じてください。
+func (c *blobClient) request(
+	ctx context.Context,
+	method, rawURL string,
+	body io.Reader,
+	contentLength int64,
+	headers map[string]string,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = contentLength
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	c.sign(req)
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := statusError(method, res); err != nil {
+		drain(res)
+		return nil, err
+	}
+	return res, nil
+}
+
+// drain は応答を読み捨てて閉じます。接続を使い回せるようにするためです。
+func drain(res *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	_ = res.Body.Close()
+}
+
+// statusError は成功でない状態コードをエラーにします。
+func statusError(method string, res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return nil
+	}
+
+	e := &blobError{
+		Method:     method,
+		Status:     res.StatusCode,
+		Code:       res.Header.Get("x-ms-error-code"),
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+	// HEAD には中身がないので、理由は見出しにしか入っていない。
+	var payload struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(&payload); err == nil {
+		if e.Code == "" {
+			e.Code = payload.Code
+		}
+		e.Message = strings.TrimSpace(strings.SplitN(payload.Message, "\n", 2)[0])
+	}
+	return e
+}
+
+// parseRetryAfter は待つよう指示された時間を読み取ります。
+func parseRetryAfter(raw string) time.Duration {
+	if raw == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(raw); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(raw); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// blobError は Blob Storage が返した失敗です。
+type blobError struct {
+	Method     string
+	Status     int
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *blobError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s: %d %s (%s)", e.Method, e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: %d %s", e.Method, e.Status, http.StatusText(e.Status))
+}
+
+// --- 一覧 ---
+
+// listResult は一覧の1ページです。
+type listResult struct {
+	Blobs struct {
+		Blob       []listedBlob `xml:"Blob"`
+		BlobPrefix []struct {
+			Name string `xml:"Name"`
+		} `xml:"BlobPrefix"`
+	} `xml:"Blobs"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// listedBlob は一覧に含まれる1件です。
+//
+// S3 と違って、一覧に利用者定義の項目も含めてもらえます。
+// 更新時刻を知るために1件ずつ問い合わせる必要はありません。
+type listedBlob struct {
+	Name       string `xml:"Name"`
+	Properties struct {
+		LastModified  string `xml:"Last-Modified"`
+		ContentLength int64  `xml:"Content-Length"`
+		ContentMD5    string `xml:"Content-MD5"`
+	} `xml:"Properties"`
+	Metadata metadata `xml:"Metadata"`
+}
+
+// metadata は利用者定義の項目です。名前は小文字に揃えます。
+type metadata map[string]string
+
+// UnmarshalXML は <Metadata><mtime>...</mtime></Metadata> の形を読みます。
+func (m *metadata) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	*m = metadata{}
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			var v string
+			if err := d.DecodeElement(&v, &t); err != nil {
+				return err
+			}
+			(*m)[strings.ToLower(t.Name.Local)] = v
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// list は prefix で始まるものを1ページぶん返します。
+// delimiter を指定すると、その先をひとまとめにします。
+func (c *blobClient) list(ctx context.Context, prefix, delimiter, marker string, maxResults int) (*listResult, error) {
+	q := url.Values{
+		"restype":    {"container"},
+		"comp":       {"list"},
+		"include":    {"metadata"},
+		"maxresults": {strconv.Itoa(maxResults)},
+	}
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+	if delimiter != "" {
+		q.Set("delimiter", delimiter)
+	}
+	if marker != "" {
+		q.Set("marker", marker)
+	}
+
+	res, err := c.request(ctx, http.MethodGet, c.url("", q), nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer drain(res)
+
+	var page listResult
+	if err := xml.NewDecoder(res.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("一覧の応答を解釈できません: %w", err)
+	}
+	return &page, nil
+}
+
+// --- 1件の読み書き ---
+
+// properties は1件のメタデータです。
+type properties struct {
+	size       int64
+	lastMod    time.Time
+	contentMD5 string
+	meta       metadata
+	copyStatus string
+	copyDesc   string
+}
+
+func propertiesFrom(h http.Header) *properties {
+	p := &properties{
+		contentMD5: h.Get("Content-MD5"),
+		meta:       metadata{},
+		copyStatus: h.Get("x-ms-copy-status"),
+		copyDesc:   h.Get("x-ms-copy-status-description"),
+	}
+	p.size, _ = strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	p.lastMod, _ = http.ParseTime(h.Get("Last-Modified"))
+	for name, values := range h {
+		if key, ok := strings.CutPrefix(strings.ToLower(name), metaHeaderPrefix); ok && len(values) > 0 {
+			p.meta[key] = values[0]
+		}
+	}
+	return p
+}
+
+// getProperties は1件のメタデータを問い合わせます。
+func (c *blobClient) getProperties(ctx context.Context, name string) (*properties, error) {
+	res, err := c.request(ctx, http.MethodHead, c.url(name, nil), nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	drain(res)
+	return propertiesFrom(res.Header), nil
+}
+
+// get は内容を読み出します。rangeSpec が空でなければ、その範囲だけです。
+func (c *blobClient) get(ctx context.Context, name, rangeSpec string) (io.ReadCloser, *properties, error) {
+	var headers map[string]string
+	if rangeSpec != "" {
+		headers = map[string]string{"x-ms-range": rangeSpec}
+	}
+	res, err := c.request(ctx, http.MethodGet, c.url(name, nil), nil, 0, headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := propertiesFrom(res.Header)
+	if rangeSpec != "" {
+		// 範囲を読んだときの Content-MD5 は、その範囲のものではない。
+		p.contentMD5 = ""
+	}
+	return res.Body, p, nil
+}
+
+// putBlob は1回の要求で書き込みます。
+func (c *blobClient) putBlob(ctx context.Context, name string, data []byte, headers map[string]string) error {
+	h := map[string]string{"x-ms-blob-type": "BlockBlob"}
+	for k, v := range headers {
+		h[k] = v
+	}
+	res, err := c.request(ctx, http.MethodPut, c.url(name, nil), bytes.NewReader(data), int64(len(data)), h)
+	if err != nil {
+		return err
+	}
+	drain(res)
+	return nil
+}
+
+// putBlock はブロックを1つ送ります。送っただけでは見えません。
+func (c *blobClient) putBlock(ctx context.Context, name, blockID string, data []byte) error {
+	q := url.Values{"comp": {"block"}, "blockid": {blockID}}
+	res, err := c.request(ctx, http.MethodPut, c.url(name, q), bytes.NewReader(data), int64(len(data)), nil)
+	if err != nil {
+		return err
+	}
+	drain(res)
+	return nil
+}
+
+// putBlockList は送ったブロックを並べて1つにします。ここで初めて見えるようになります。
+func (c *blobClient) putBlockList(ctx context.Context, name string, blockIDs []string, headers map[string]string) error {
+	var body bytes.Buffer
+	body.WriteString(xml.Header + "<BlockList>")
+	for _, id := range blockIDs {
+		body.WriteString("<Latest>" + id + "</Latest>")
+	}
+	body.WriteString("</BlockList>")
+
+	h := map[string]string{"Content-Type": "application/xml"}
+	for k, v := range headers {
+		h[k] = v
+	}
+	q := url.Values{"comp": {"blocklist"}}
+	res, err := c.request(ctx, http.MethodPut, c.url(name, q), &body, int64(body.Len()), h)
+	if err != nil {
+		return err
+	}
+	drain(res)
+	return nil
+}
+
+// delete は1件を削除します。
+func (c *blobClient) delete(ctx context.Context, name string) error {
+	res, err := c.request(ctx, http.MethodDelete, c.url(name, nil), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	drain(res)
+	return nil
+}
+
+// copyPollInterval はコピーの終わりを確かめる間隔の上限です。
+const copyPollInterval = 2 * time.Second
+
+// copy は src を dst にコピーします。
+//
+// 同じ口座の中のコピーはふつうすぐに終わりますが、大きなものは
+// 「進行中」で返ることがあります。その場合は終わるまで待ちます。
+func (c *blobClient) copy(ctx context.Context, src, dst string) error {
+	res, err := c.request(ctx, http.MethodPut, c.url(dst, nil), nil, 0,
+		map[string]string{"x-ms-copy-source": c.url(src, nil)})
+	if err != nil {
+		return err
+	}
+	drain(res)
+
+	status, desc := res.Header.Get("x-ms-copy-status"), ""
+	wait := 100 * time.Millisecond
+	for status == "pending" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait = min(wait*2, copyPollInterval)
+
+		p, err := c.getProperties(ctx, dst)
+		if err != nil {
+			return err
+		}
+		status, desc = p.copyStatus, p.copyDesc
+	}
+	if status != "" && status != "success" {
+		return fmt.Errorf("コピーが終わりませんでした（%s: %s）", status, desc)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package azureblob
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 保管の階層（アクセス層）。
+const (
+	TierHot     = "Hot"
+	TierCool    = "Cool"
+	TierCold    = "Cold"
+	TierArchive = "Archive"
+)
+
+// Azurite（手元で動く Azure Storage の模造品）の決まった口座と鍵です。
+// 接続文字列に UseDevelopmentStorage=true と書いたときに使います。
+const (
+	devAccount  = "devstoreaccount1"
+	devKey      = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	devEndpoint = "http://127.0.0.1:10000/" + devAccount
+)
+
+// Config は Azure Blob Storage の設定です。
+//
+// 認証は、口座の鍵（account と key）、SAS（sas_token）、接続文字列
+// （connection_string）のいずれか1つで行います。
+type Config struct {
+	// Name は設定ファイルで付けた名前です。
+	Name string
+
+	// Account はストレージアカウントの名前です。
+	Account string
+	// Key はストレージアカウントの鍵（base64）です。
+	Key string
+	// SASToken は共有アクセス署名です。先頭の "?" はあってもなくても構いません。
+	SASToken string
+	// ConnectionString は Azure のポータルで表示される接続文字列です。
+	ConnectionString string
+	// Endpoint は接続先です。省略すると https://<account>.blob.core.windows.net です。
+	// Azurite では http://127.0.0.1:10000/devstoreaccount1 のように口座の名前まで含めます。
+	Endpoint string
+
+	// Container は入れ物（コンテナー）の名前です。
+	Container string
+	// AccessTier は書き込むときのアクセス層です。省略するとアカウントの既定です。
+	AccessTier string
+	// DirectoryMarkers が偽なら、空のディレクトリを表す印を書きません。
+	DirectoryMarkers *bool
+
+	// UploadBlockSizeMiB はブロックに分けて送るときの1つぶんの大きさです。0 なら既定値です。
+	UploadBlockSizeMiB int64
+	// UploadConcurrency はブロックを同時に送る数です。0 なら既定値です。
+	UploadConcurrency int
+
+	// Root を指定すると、その下を起点として扱います。
+	Root string
+
+	// httpOverride は試験のために通信の相手を差し替えるためのものです。
+	httpOverride *http.Client
+}
+
+func (c Config) directoryMarkers() bool {
+	if c.DirectoryMarkers == nil {
+		return true
+	}
+	return *c.DirectoryMarkers
+}
+
+// validate は接続を試みる前に設定の不足を知らせます。
+func (c Config) validate() error {
+	if c.Container == "" {
+		return errors.New("入れ物（container）が指定されていません")
+	}
+	switch c.AccessTier {
+	case "", TierHot, TierCool, TierCold, TierArchive:
+	default:
+		return fmt.Errorf("access_tier には %s のいずれかを指定してください（%q が指定されました）",
+			strings.Join([]string{TierHot, TierCool, TierCold, TierArchive}, ", "), c.AccessTier)
+	}
+	_, err := c.credential()
+	return err
+}
+
+// credential は要求に付ける認証と接続先です。
+type credential struct {
+	account  string
+	endpoint string
+	// key があれば要求ごとに署名します。
+	key []byte
+	// sas があれば要求ごとに添えます。
+	sas url.Values
+}
+
+// credential は設定から認証と接続先を決めます。
+func (c Config) credential() (*credential, error) {
+	if c.ConnectionString != "" {
+		if c.Account != "" || c.Key != "" || c.SASToken != "" {
+			return nil, errors.New("connection_string と account・key・sas_token は同時に指定できません")
+		}
+		cs, err := parseConnectionString(c.ConnectionString)
+		if err != nil {
+			return nil, err
+		}
+		if c.Endpoint != "" {
+			cs.Endpoint = c.Endpoint
+		}
+		return cs.credential()
+	}
+	if c.Key != "" && c.SASToken != "" {
+		return nil, errors.New("key と sas_token はどちらか一方だけを指定してください")
+	}
+
+	cred := &credential{account: c.Account, endpoint: strings.TrimSuffix(c.Endpoint, "/")}
+	if cred.endpoint == "" {
+		if c.Account == "" {
+			return nil, errors.New("account か endpoint のどちらかが必要です")
+		}
+		cred.endpoint = "https://" + c.Account + ".blob.core.windows.net"
+	}
+
+	switch {
+	case c.Key != "":
+		if c.Account == "" {
+			return nil, errors.New("key で認証するには account が必要です")
+		}
+		key, err := base64.StdEncoding.DecodeString(c.Key)
+		if err != nil {
+			return nil, errors.New("key を解釈できません。ポータルに表示される base64 の鍵をそのまま指定してください")
+		}
+		cred.key = key
+	case c.SASToken != "":
+		sas, err := url.ParseQuery(strings.TrimPrefix(c.SASToken, "?"))
+		if err != nil || sas.Get("sig") == "" {
+			return nil, errors.New("sas_token を解釈できません。sig を含む SAS を指定してください")
+		}
+		cred.sas = sas
+	default:
+		return nil, errors.New("key・sas_token・connection_string のいずれかで認証してください")
+	}
+	return cred, nil
+}
+
+// parseConnectionString は接続文字列を読み、それに相当する設定を返します。
+//
+//	DefaultEndpointsProtocol=https;AccountName=...;AccountKey=...;EndpointSuffix=core.windows.net
+//	BlobEndpoint=https://...;SharedAccessSignature=sv=...
+//	UseDevelopmentStorage=true
+func parseConnectionString(s string) (Config, error) {
+	fields := map[string]string{}
+	for part := range strings.SplitSeq(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			return Config{}, errors.New("connection_string を解釈できません。key=value を ; で区切った形で指定してください")
+		}
+		fields[strings.ToLower(k)] = v
+	}
+
+	if strings.EqualFold(fields["usedevelopmentstorage"], "true") {
+		return Config{Account: devAccount, Key: devKey, Endpoint: devEndpoint}, nil
+	}
+
+	cfg := Config{
+		Account:  fields["accountname"],
+		Key:      fields["accountkey"],
+		SASToken: fields["sharedaccesssignature"],
+		Endpoint: fields["blobendpoint"],
+	}
+	if cfg.Endpoint == "" && cfg.Account != "" {
+		protocol, suffix := fields["defaultendpointsprotocol"], fields["endpointsuffix"]
+		if protocol == "" {
+			protocol = "https"
+		}
+		if suffix == "" {
+			suffix = "core.windows.net"
+		}
+		cfg.Endpoint = protocol + "://" + cfg.Account + ".blob." + suffix
+	}
+	if cfg.Key != "" && cfg.SASToken != "" {
+		// 両方あれば、口座の鍵のほうが何でもできる。
+		cfg.SASToken = ""
+	}
+	return cfg, nil
+}
@@ -0,0 +1,131 @@
+package azureblob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Blob Storage の失敗は、HTTP の状態コードと x-ms-error-code の2段で表されます。
+//
+//	403 → 認証や権限の問題（署名の誤り・SAS の期限切れを含む）
+//	404 → 存在しない
+//	409 → 状態が合わない（アーカイブ層にあって読めない、など）
+//	503 ServerBusy → 要求が多すぎる（Retry-After を添えることがある）
+//	5xx → 一時的な障害
+//
+// HEAD の応答には中身がないので、code は見出しからも読みます。
+
+// wrapErr は Blob Storage のエラーを storage のエラーに変換します。
+func (s *Storage) wrapErr(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	v := classify(err)
+	if v.sentinel != nil && !errors.Is(err, v.sentinel) {
+		// 元のエラーも失わないよう、両方を包む。
+		err = fmt.Errorf("%w (%w)", v.sentinel, err)
+	}
+
+	return &storage.OpError{
+		Op:         op,
+		Storage:    s.name,
+		Path:       path,
+		Class:      v.class,
+		RetryAfter: v.retryAfter,
+		Err:        err,
+	}
+}
+
+// verdict は失敗の見立てです。
+type verdict struct {
+	// sentinel は対応する番兵エラーです。該当するものがなければ nil です。
+	sentinel error
+	class    storage.Class
+	// retryAfter はサーバーから指示された待ち時間です。
+	retryAfter time.Duration
+}
+
+// classify はエラーの見立てを求めます。
+func classify(err error) verdict {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return verdict{class: storage.ClassCanceled}
+	case errors.Is(err, storage.ErrNotFound):
+		return verdict{sentinel: storage.ErrNotFound, class: storage.ClassPermanent}
+	case errors.Is(err, storage.ErrNotEmpty), errors.Is(err, storage.ErrNotDir),
+		errors.Is(err, storage.ErrIsDir), errors.Is(err, storage.ErrUnsupported):
+		return verdict{class: storage.ClassPermanent}
+	}
+
+	var blobErr *blobError
+	if errors.As(err, &blobErr) {
+		v := classifyStatus(blobErr.Status, blobErr.Code)
+		v.retryAfter = blobErr.RetryAfter
+		return v
+	}
+
+	// 接続そのものが切れた場合。繋ぎ直せば通ることがある。
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return verdict{class: storage.ClassRetryable}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return verdict{class: storage.ClassRetryable}
+	}
+
+	return verdict{class: storage.ClassUnknown}
+}
+
+// classifyStatus は状態コードと code から判断します。
+func classifyStatus(status int, code string) verdict {
+	// code のほうが具体的なので先に見る。
+	switch code {
+	case "BlobNotFound", "ContainerNotFound", "ResourceNotFound":
+		return verdict{sentinel: storage.ErrNotFound, class: storage.ClassPermanent}
+	case "AuthenticationFailed", "AuthorizationFailure", "AuthorizationPermissionMismatch",
+		"AuthorizationResourceTypeMismatch", "AuthorizationSourceIPMismatch", "InsufficientAccountPermissions",
+		"AccountIsDisabled":
+		return verdict{class: storage.ClassAuth}
+	case "ServerBusy":
+		return verdict{class: storage.ClassRateLimit}
+	case "InternalError", "OperationTimedOut":
+		return verdict{class: storage.ClassRetryable}
+	case "BlobArchived", "BlobBeingRehydrated", "RequestBodyTooLarge", "InvalidBlockList",
+		"InvalidBlobOrBlock", "BlockCountExceedsLimit", "InvalidResourceName", "OutOfRangeInput":
+		return verdict{class: storage.ClassPermanent}
+	}
+
+	switch status {
+	case http.StatusNotFound:
+		return verdict{sentinel: storage.ErrNotFound, class: storage.ClassPermanent}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return verdict{class: storage.ClassAuth}
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return verdict{class: storage.ClassRateLimit}
+	case http.StatusRequestTimeout:
+		return verdict{class: storage.ClassRetryable}
+	}
+
+	switch {
+	case status >= 500 && status <= 599:
+		return verdict{class: storage.ClassRetryable}
+	case status >= 400 && status <= 499:
+		return verdict{class: storage.ClassPermanent}
+	}
+	return verdict{class: storage.ClassUnknown}
+}
+
+// isNotFound はエラーが「存在しない」を表すかを返します。
+func isNotFound(err error) bool {
+	v := classify(err)
+	return v.sentinel != nil && errors.Is(v.sentinel, storage.ErrNotFound)
+}
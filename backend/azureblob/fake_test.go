@@ -0,0 +1,631 @@
+package azureblob
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 偽の Blob Storage サーバーです。
+//
+// Azurite と同じく、接続先のパスに口座の名前を含める形
+// （/devstoreaccount1/入れ物/名前）で受けます。docker も実際の口座も
+// なしに、ディレクトリの見せかけ・ブロックに分けた送信・利用者定義の
+// 項目・エラーの分類までを試験できるようにするためのものです。
+//
+// s3 の偽物と違って、署名も確かめます。署名は SDK ではなく自前で
+// 作っているので、受け取った要求から同じ署名が作れることを確かめないと、
+// 送る途中で見出しやパスが変わっても気付けないためです。
+
+const testContainer = "test-container"
+
+// fakeBlob は偽サーバー上の1件です。
+type fakeBlob struct {
+	data        []byte
+	meta        map[string]string
+	lastMod     time.Time
+	contentType string
+	// contentMD5 は Content-MD5（base64）です。空なら持っていません。
+	contentMD5 string
+}
+
+// fakeAzure は Blob Storage の REST のごく一部を再現します。
+type fakeAzure struct {
+	mu    sync.Mutex
+	blobs map[string]*fakeBlob
+	// blocks は並べる前のブロックです。名前ごと、ブロックの名前ごとに持ちます。
+	blocks map[string]map[string][]byte
+
+	// pageSize は一覧が1回に返す件数の上限です。
+	// 小さくしてあるので、続きの取得を必ず通ります。
+	pageSize int
+	// pendingCopies は、コピーを何回「進行中」と答えてから終えるかです。
+	pendingCopies int
+
+	failures map[string]*fakeFailure
+	calls    map[string]int
+}
+
+type fakeFailure struct {
+	remaining int
+	status    int
+	code      string
+}
+
+func newFakeAzure() *fakeAzure {
+	return &fakeAzure{
+		blobs:    map[string]*fakeBlob{},
+		blocks:   map[string]map[string][]byte{},
+		pageSize: 3,
+		failures: map[string]*fakeFailure{},
+		calls:    map[string]int{},
+	}
+}
+
+// start は偽サーバーを立ち上げ、そこへ向いたストレージを返します。
+func (f *fakeAzure) start(t *testing.T, mutate ...func(*Config)) *Storage {
+	t.Helper()
+
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	cfg := Config{
+		Name:         "偽azure",
+		Account:      devAccount,
+		Key:          devKey,
+		Endpoint:     srv.URL + "/" + devAccount,
+		Container:    testContainer,
+		httpOverride: srv.Client(),
+	}
+	for _, m := range mutate {
+		m(&cfg)
+	}
+
+	s, err := New(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("ストレージを作れません: %v", err)
+	}
+	return s
+}
+
+func (f *fakeAzure) failNext(op string, n, status int, code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[op] = &fakeFailure{remaining: n, status: status, code: code}
+}
+
+func (f *fakeAzure) callCount(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// blob は入っている1件を返します。
+func (f *fakeAzure) blob(name string) (*fakeBlob, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.blobs[name]
+	return b, ok
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	account, container, name := splitRequestPath(r.URL.Path)
+	if account != devAccount {
+		writeAzureError(w, http.StatusBadRequest, "InvalidUri", "口座がありません: "+account)
+		return
+	}
+	if !authorized(r) {
+		writeAzureError(w, http.StatusForbidden, "AuthenticationFailed", "署名が合いません")
+		return
+	}
+	if container != testContainer {
+		writeAzureError(w, http.StatusNotFound, "ContainerNotFound", "入れ物がありません: "+container)
+		return
+	}
+
+	op := operationName(r, name)
+
+	f.mu.Lock()
+	f.calls[op]++
+	if fail, ok := f.failures[op]; ok && fail.remaining > 0 {
+		fail.remaining--
+		status, code := fail.status, fail.code
+		f.mu.Unlock()
+		w.Header().Set("Retry-After", "7")
+		writeAzureError(w, status, code, "わざと失敗させています")
+		return
+	}
+	f.mu.Unlock()
+
+	switch op {
+	case "list":
+		f.listBlobs(w, r)
+	case "put_block":
+		f.putBlock(w, r, name)
+	case "put_block_list":
+		f.putBlockList(w, r, name)
+	case "copy":
+		f.copyBlob(w, r, name)
+	case "put":
+		f.putBlob(w, r, name)
+	case "get":
+		f.getBlob(w, r, name)
+	case "head":
+		f.headBlob(w, name)
+	case "delete":
+		f.deleteBlob(w, name)
+	default:
+		writeAzureError(w, http.StatusBadRequest, "UnsupportedHttpVerb", "扱えない要求です: "+op)
+	}
+}
+
+// splitRequestPath は要求のパスから口座・入れ物・名前を取り出します。
+func splitRequestPath(p string) (account, container, name string) {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+// authorized は、SAS が付いているか、受け取った要求から同じ署名が作れるかを返します。
+func authorized(r *http.Request) bool {
+	if r.URL.Query().Get("sig") != "" {
+		return true
+	}
+	if r.Header.Get("x-ms-version") == "" || r.Header.Get("x-ms-date") == "" {
+		return false
+	}
+	account, signature, ok := strings.Cut(strings.TrimPrefix(r.Header.Get("Authorization"), "SharedKey "), ":")
+	if !ok || account != devAccount {
+		return false
+	}
+	key, _ := base64.StdEncoding.DecodeString(devKey)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign(account, r)))
+	return signature == base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// operationName は要求の種類を見分けます。
+func operationName(r *http.Request, name string) string {
+	q := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		if name == "" && q.Get("comp") == "list" {
+			return "list"
+		}
+		return "get"
+	case http.MethodHead:
+		return "head"
+	case http.MethodPut:
+		switch {
+		case q.Get("comp") == "block":
+			return "put_block"
+		case q.Get("comp") == "blocklist":
+			return "put_block_list"
+		case r.Header.Get("x-ms-copy-source") != "":
+			return "copy"
+		}
+		return "put"
+	case http.MethodDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// --- 応答の組み立て ---
+
+func writeAzureError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+// --- 一覧 ---
+
+type enumerationResults struct {
+	XMLName    xml.Name `xml:"EnumerationResults"`
+	Prefix     string   `xml:"Prefix"`
+	Marker     string   `xml:"Marker"`
+	MaxResults int      `xml:"MaxResults"`
+	Delimiter  string   `xml:"Delimiter,omitempty"`
+	Blobs      struct {
+		Items []any
+	} `xml:"Blobs"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+type xmlBlob struct {
+	XMLName    xml.Name `xml:"Blob"`
+	Name       string   `xml:"Name"`
+	Properties struct {
+		LastModified  string `xml:"Last-Modified"`
+		ContentLength int64  `xml:"Content-Length"`
+		ContentType   string `xml:"Content-Type"`
+		ContentMD5    string `xml:"Content-MD5"`
+		BlobType      string `xml:"BlobType"`
+	} `xml:"Properties"`
+	Metadata xmlMetadata `xml:"Metadata"`
+}
+
+type xmlMetadata map[string]string
+
+func (m xmlMetadata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := e.EncodeElement(m[k], xml.StartElement{Name: xml.Name{Local: k}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+type xmlBlobPrefix struct {
+	XMLName xml.Name `xml:"BlobPrefix"`
+	Name    string   `xml:"Name"`
+}
+
+func (f *fakeAzure) listBlobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	marker := q.Get("marker")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	names := make([]string, 0, len(f.blobs))
+	for k := range f.blobs {
+		if strings.HasPrefix(k, prefix) {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	// 区切り文字が指定されていれば、その先をひとまとめにする。
+	type item struct {
+		name     string
+		isPrefix bool
+	}
+	items := []item{}
+	seen := map[string]bool{}
+	for _, k := range names {
+		rest := strings.TrimPrefix(k, prefix)
+		if delimiter != "" {
+			if idx := strings.Index(rest, delimiter); idx >= 0 {
+				group := prefix + rest[:idx+len(delimiter)]
+				if !seen[group] {
+					seen[group] = true
+					items = append(items, item{name: group, isPrefix: true})
+				}
+				continue
+			}
+		}
+		items = append(items, item{name: k})
+	}
+
+	// 続きの印を位置として使う。
+	start := 0
+	if marker != "" {
+		if n, err := strconv.Atoi(marker); err == nil {
+			start = n
+		}
+	}
+	pageSize := f.pageSize
+	if raw := q.Get("maxresults"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 && n < pageSize {
+			pageSize = n
+		}
+	}
+	end := min(start+pageSize, len(items))
+
+	res := enumerationResults{Prefix: prefix, Marker: marker, MaxResults: pageSize, Delimiter: delimiter}
+	for _, it := range items[start:end] {
+		if it.isPrefix {
+			res.Blobs.Items = append(res.Blobs.Items, xmlBlobPrefix{Name: it.name})
+			continue
+		}
+		b := f.blobs[it.name]
+		x := xmlBlob{Name: it.name}
+		x.Properties.LastModified = b.lastMod.Format(http.TimeFormat)
+		x.Properties.ContentLength = int64(len(b.data))
+		x.Properties.ContentType = b.contentType
+		x.Properties.ContentMD5 = b.contentMD5
+		x.Properties.BlobType = "BlockBlob"
+		if q.Get("include") == "metadata" {
+			x.Metadata = b.meta
+		}
+		res.Blobs.Items = append(res.Blobs.Items, x)
+	}
+	if end < len(items) {
+		res.NextMarker = strconv.Itoa(end)
+	}
+
+	writeXML(w, res)
+}
+
+// --- 1件の読み書き ---
+
+// userMeta は要求から利用者定義の項目を取り出します。
+func userMeta(r *http.Request) map[string]string {
+	meta := map[string]string{}
+	for name, values := range r.Header {
+		if key, ok := strings.CutPrefix(strings.ToLower(name), metaHeaderPrefix); ok && len(values) > 0 {
+			meta[key] = values[0]
+		}
+	}
+	return meta
+}
+
+// newBlob は要求の見出しから1件を作ります。
+func newBlob(r *http.Request, data []byte) *fakeBlob {
+	return &fakeBlob{
+		data:        data,
+		meta:        userMeta(r),
+		lastMod:     time.Now().UTC(),
+		contentType: r.Header.Get("x-ms-blob-content-type"),
+		contentMD5:  r.Header.Get("x-ms-blob-content-md5"),
+	}
+}
+
+func (f *fakeAzure) putBlob(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+		writeAzureError(w, http.StatusBadRequest, "MissingRequiredHeader", "x-ms-blob-type がありません")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeAzureError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+		return
+	}
+
+	b := newBlob(r, data)
+	if b.contentMD5 == "" {
+		// 1回で送ったものは、実物も MD5 を求めて持っておく。
+		sum := md5.Sum(data)
+		b.contentMD5 = base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	f.mu.Lock()
+	f.blobs[name] = b
+	delete(f.blocks, name)
+	f.mu.Unlock()
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeAzure) putBlock(w http.ResponseWriter, r *http.Request, name string) {
+	id := r.URL.Query().Get("blockid")
+	if id == "" {
+		writeAzureError(w, http.StatusBadRequest, "InvalidQueryParameterValue", "blockid がありません")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeAzureError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.blocks[name] == nil {
+		f.blocks[name] = map[string][]byte{}
+	}
+	for other := range f.blocks[name] {
+		if len(other) != len(id) {
+			writeAzureError(w, http.StatusBadRequest, "InvalidBlobOrBlock", "ブロックの名前の長さが揃っていません")
+			return
+		}
+	}
+	f.blocks[name][id] = data
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeAzure) putBlockList(w http.ResponseWriter, r *http.Request, name string) {
+	var req struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAzureError(w, http.StatusBadRequest, "InvalidXmlDocument", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data := []byte{}
+	for _, id := range req.Latest {
+		block, ok := f.blocks[name][id]
+		if !ok {
+			writeAzureError(w, http.StatusBadRequest, "InvalidBlockList", "送られていないブロックがあります: "+id)
+			return
+		}
+		data = append(data, block...)
+	}
+	// 実物と同じく、ブロックに分けたものの MD5 は求めない。
+	// 添えられたものだけを持つ。
+	f.blobs[name] = newBlob(r, data)
+	delete(f.blocks, name)
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeAzure) getBlob(w http.ResponseWriter, r *http.Request, name string) {
+	f.mu.Lock()
+	b, ok := f.blobs[name]
+	var data []byte
+	if ok {
+		data = append([]byte(nil), b.data...)
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		writeAzureError(w, http.StatusNotFound, "BlobNotFound", "ありません: "+name)
+		return
+	}
+
+	status := http.StatusOK
+	if spec := r.Header.Get("x-ms-range"); spec != "" {
+		var err error
+		data, err = applyRange(data, spec)
+		if err != nil {
+			writeAzureError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", err.Error())
+			return
+		}
+		status = http.StatusPartialContent
+	}
+
+	writeBlobHeaders(w, b, len(data))
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+func (f *fakeAzure) headBlob(w http.ResponseWriter, name string) {
+	f.mu.Lock()
+	b, ok := f.blobs[name]
+	pending := false
+	if ok && f.pendingCopies > 0 {
+		f.pendingCopies--
+		pending = true
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		// HEAD の応答に中身はない。理由は見出しだけで伝わる。
+		w.Header().Set("x-ms-error-code", "BlobNotFound")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeBlobHeaders(w, b, len(b.data))
+	if pending {
+		w.Header().Set("x-ms-copy-status", "pending")
+	} else {
+		w.Header().Set("x-ms-copy-status", "success")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeBlobHeaders(w http.ResponseWriter, b *fakeBlob, length int) {
+	w.Header().Set("Content-Length", strconv.Itoa(length))
+	w.Header().Set("Last-Modified", b.lastMod.Format(http.TimeFormat))
+	w.Header().Set("x-ms-blob-type", "BlockBlob")
+	if b.contentMD5 != "" {
+		w.Header().Set("Content-MD5", b.contentMD5)
+	}
+	if b.contentType != "" {
+		w.Header().Set("Content-Type", b.contentType)
+	}
+	for k, v := range b.meta {
+		w.Header().Set(metaHeaderPrefix+k, v)
+	}
+}
+
+func (f *fakeAzure) deleteBlob(w http.ResponseWriter, name string) {
+	f.mu.Lock()
+	_, ok := f.blobs[name]
+	delete(f.blobs, name)
+	f.mu.Unlock()
+
+	// 実物は、無いものを消そうとすると 404 を返す。
+	if !ok {
+		writeAzureError(w, http.StatusNotFound, "BlobNotFound", "ありません: "+name)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (f *fakeAzure) copyBlob(w http.ResponseWriter, r *http.Request, name string) {
+	source, err := url.Parse(r.Header.Get("x-ms-copy-source"))
+	if err != nil {
+		writeAzureError(w, http.StatusBadRequest, "InvalidHeaderValue", err.Error())
+		return
+	}
+	_, _, srcName := splitRequestPath(source.Path)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	src, ok := f.blobs[srcName]
+	if !ok {
+		writeAzureError(w, http.StatusNotFound, "CannotVerifyCopySource", "コピー元がありません: "+srcName)
+		return
+	}
+
+	copied := *src
+	copied.data = append([]byte(nil), src.data...)
+	copied.meta = map[string]string{}
+	for k, v := range src.meta {
+		copied.meta[k] = v
+	}
+	copied.lastMod = time.Now().UTC()
+	f.blobs[name] = &copied
+
+	status := "success"
+	if f.pendingCopies > 0 {
+		status = "pending"
+	}
+	w.Header().Set("x-ms-copy-status", status)
+	w.Header().Set("x-ms-copy-id", fmt.Sprintf("copy-%d", f.calls["copy"]))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// applyRange は "bytes=n-m" 形式の指定を適用します。
+func applyRange(data []byte, spec string) ([]byte, error) {
+	spec = strings.TrimPrefix(spec, "bytes=")
+	lo, hi, found := strings.Cut(spec, "-")
+
+	start, err := strconv.ParseInt(lo, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("読み出し位置を解釈できません: %q", spec)
+	}
+	if start > int64(len(data)) {
+		return nil, fmt.Errorf("読み出し位置が末尾を超えています: %d", start)
+	}
+	data = data[start:]
+
+	if found && hi != "" {
+		end, err := strconv.ParseInt(hi, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("読み出し範囲を解釈できません: %q", spec)
+		}
+		if n := end - start + 1; n < int64(len(data)) {
+			data = data[:n]
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,75 @@
+package azureblob
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/storage"
+)
+
+func init() {
+	backend.Register(backend.Descriptor{
+		Type:    Type,
+		Summary: "Azure Blob Storage",
+		ConfigDoc: `  # - name: azure
+  #   type: azureblob
+  #   account: ストレージアカウントの名前
+  #   key: ${AZURE_STORAGE_KEY}  # 口座の鍵。sas_token・connection_string と選ぶ
+  #   sas_token: ${AZURE_STORAGE_SAS}
+  #   connection_string: ${AZURE_STORAGE_CONNECTION_STRING}  # Azurite なら UseDevelopmentStorage=true
+  #   endpoint: 接続先（省略すると https://<account>.blob.core.windows.net）
+  #   container: 入れ物（コンテナー）の名前
+  #   access_tier: Hot  # Hot / Cool / Cold / Archive（省略するとアカウントの既定）
+  #   directory_markers: true
+  #   upload_block_size_mib: 8
+  #   upload_concurrency: 4
+  #   root: 起点にする接頭辞
+`,
+		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
+			blockSize, err := intParam(params, "upload_block_size_mib")
+			if err != nil {
+				return nil, fmt.Errorf("azureblob %s: %w", name, err)
+			}
+			concurrency, err := intParam(params, "upload_concurrency")
+			if err != nil {
+				return nil, fmt.Errorf("azureblob %s: %w", name, err)
+			}
+
+			cfg := Config{
+				Name:               name,
+				Account:            params.Get("account"),
+				Key:                params.Get("key"),
+				SASToken:           params.Get("sas_token"),
+				ConnectionString:   params.Get("connection_string"),
+				Endpoint:           params.Get("endpoint"),
+				Container:          params.Get("container"),
+				AccessTier:         params.Get("access_tier"),
+				UploadBlockSizeMiB: int64(blockSize),
+				UploadConcurrency:  concurrency,
+				Root:               params.Get("root"),
+			}
+			if raw := params.Get("directory_markers"); raw != "" {
+				markers := raw == "true"
+				cfg.DirectoryMarkers = &markers
+			}
+
+			return New(ctx, cfg)
+		},
+	})
+}
+
+// intParam は数として指定された設定を読みます。
+func intParam(params backend.Params, key string) (int, error) {
+	raw := params.Get(key)
+	if raw == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s には数を指定してください（%q が指定されました）", key, raw)
+	}
+	return n, nil
+}
@@ -0,0 +1,542 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// B2 の窓口（native API）は JSON を POST する形で、hbg が使うのは
+// 一覧・書き込み・分割送信・削除・隠す・コピーの十数個です。onedrive や
+// azureblob と同じく、必要なところだけ自前で組み立てます。
+//
+// 最初に b2_authorize_account で認可を受けると、以降の要求を送る先
+// （apiUrl・downloadUrl）とトークンが返ります。トークンは24時間で
+// 切れるので、切れたら認可を取り直して1回だけ送り直します。
+
+// apiPrefix は窓口の版を含むパスです。
+const apiPrefix = "/b2api/v2/"
+
+// authorization は b2_authorize_account の応答です。
+type authorization struct {
+	AccountID   string `json:"accountId"`
+	Token       string `json:"authorizationToken"`
+	APIURL      string `json:"apiUrl"`
+	DownloadURL string `json:"downloadUrl"`
+	// AbsoluteMinimumPartSize は分けて送るときの1つぶんの最小の大きさです。
+	// 最後の1つだけは、これより小さくて構いません。
+	AbsoluteMinimumPartSize int64 `json:"absoluteMinimumPartSize"`
+	// Allowed はキーに許された範囲です。入れ物を限ったキーなら、その ID と名前が入ります。
+	Allowed struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"allowed"`
+}
+
+// apiClient は1つの入れ物とのやりとりです。
+type apiClient struct {
+	http     *http.Client
+	endpoint string
+	keyID    string
+	key      string
+	bucket   string
+
+	mu   sync.Mutex
+	auth *authorization
+	// bucketID は入れ物の ID です。名前から一度だけ調べます。
+	bucketID string
+}
+
+// --- 認可 ---
+
+// session は有効な認可を返します。まだなければ認可を受けます。
+//
+// 同時に呼ばれても認可を受けるのは1回だけです。待っているあいだ、
+// 他の呼び出しは止まります。
+func (c *apiClient) session(ctx context.Context) (*authorization, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auth != nil {
+		return c.auth, nil
+	}
+
+	a, err := c.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c.bucketID == "" {
+		id, err := c.findBucket(ctx, a)
+		if err != nil {
+			return nil, err
+		}
+		c.bucketID = id
+	}
+	c.auth = a
+	return a, nil
+}
+
+// invalidate は切れた認可を捨てます。次の session で取り直します。
+func (c *apiClient) invalidate(stale *authorization) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auth == stale {
+		c.auth = nil
+	}
+}
+
+// authorize は鍵を示して認可を受けます。
+func (c *apiClient) authorize(ctx context.Context) (*authorization, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+apiPrefix+"b2_authorize_account", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.keyID, c.key)
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer drain(res)
+	if err := statusError(res); err != nil {
+		return nil, err
+	}
+
+	var a authorization
+	if err := json.NewDecoder(res.Body).Decode(&a); err != nil {
+		return nil, fmt.Errorf("認可の応答を解釈できません: %w", err)
+	}
+	return &a, nil
+}
+
+// findBucket は入れ物の名前から ID を調べます。
+func (c *apiClient) findBucket(ctx context.Context, a *authorization) (string, error) {
+	switch {
+	case a.Allowed.BucketName == c.bucket && a.Allowed.BucketID != "":
+		return a.Allowed.BucketID, nil
+	case a.Allowed.BucketID != "":
+		return "", fmt.Errorf("このキーで使えるのは入れ物 %q だけです（%q が指定されました）",
+			a.Allowed.BucketName, c.bucket)
+	}
+
+	in := map[string]string{"accountId": a.AccountID, "bucketName": c.bucket}
+	var out struct {
+		Buckets []struct {
+			BucketID string `json:"bucketId"`
+		} `json:"buckets"`
+	}
+	if err := c.post(ctx, a.APIURL+apiPrefix+"b2_list_buckets", a.Token, in, &out); err != nil {
+		return "", err
+	}
+	if len(out.Buckets) == 0 {
+		return "", fmt.Errorf("%w: 入れ物 %q がありません", storage.ErrNotFound, c.bucket)
+	}
+	return out.Buckets[0].BucketID, nil
+}
+
+// withSession は認可を用意して fn を呼びます。
+// 認可が切れていれば、取り直して1回だけ呼び直します。
+func (c *apiClient) withSession(ctx context.Context, fn func(a *authorization) error) error {
+	for attempt := 0; ; attempt++ {
+		a, err := c.session(ctx)
+		if err != nil {
+			return err
+		}
+		err = fn(a)
+		if attempt == 0 && isExpiredToken(err) {
+			c.invalidate(a)
+			continue
+		}
+		return err
+	}
+}
+
+// --- 要求の送信 ---
+
+// call は窓口 name を呼びます。
+func (c *apiClient) call(ctx context.Context, name string, in, out any) error {
+	return c.withSession(ctx, func(a *authorization) error {
+		return c.post(ctx, a.APIURL+apiPrefix+name, a.Token, in, out)
+	})
+}
+
+// post は JSON を送り、応答を out に読みます。out が nil なら読み捨てます。
+func (c *apiClient) post(ctx context.Context, rawURL, token string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	res, err := c.send(ctx, http.MethodPost, rawURL, token, bytes.NewReader(body), int64(len(body)), nil)
+	if err != nil {
+		return err
+	}
+	defer drain(res)
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("応答を解釈できません: %w", err)
+	}
+	return nil
+}
+
+// send は1つの要求を送ります。応答は呼び出し側が閉じてください。
+func (c *apiClient) send(
+	ctx context.Context,
+	method, rawURL, token string,
+	body io.Reader,
+	contentLength int64,
+	headers map[string]string,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = contentLength
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Authorization", token)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := statusError(res); err != nil {
+		drain(res)
+		return nil, err
+	}
+	return res, nil
+}
+
+// drain は応答を読み捨てて閉じます。接続を使い回せるようにするためです。
+func drain(res *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	_ = res.Body.Close()
+}
+
+// statusError は成功でない状態コードをエラーにします。
+func statusError(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return nil
+	}
+
+	e := &apiError{
+		Status:     res.StatusCode,
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+	// HEAD には中身がないので、状態コードしか分からない。
+	_ = json.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(e)
+	e.Status = res.StatusCode
+	return e
+}
+
+// apiError は B2 が返した失敗です。
+type apiError struct {
+	Status     int           `json:"status"`
+	Code       string        `json:"code"`
+	Message    string        `json:"message"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *apiError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%d %s (%s)", e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+}
+
+// isExpiredToken は、トークンが切れた（取り直せば通る）ことを表すかを返します。
+func isExpiredToken(err error) bool {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code == "expired_auth_token" || apiErr.Code == "bad_auth_token"
+}
+
+// escapeName は名前を見出しや接続先に入れられる形にします。
+//
+// B2 は英数字と "-._~" 以外をすべて % で表すよう求めます。"/" は
+// そのままで構いません。url.PathEscape は "+" や "=" を残すので使いません。
+func escapeName(name string) string {
+	s := url.QueryEscape(name)
+	s = strings.ReplaceAll(s, "+", "%20")
+	return strings.ReplaceAll(s, "%2F", "/")
+}
+
+// --- 一覧 ---
+
+// file は B2 上の1つの版です。
+type file struct {
+	FileID   string `json:"fileId"`
+	FileName string `json:"fileName"`
+	// Action は版の種類です。"upload"（ふつうの版）、"hide"（隠す印）、
+	// "start"（仕上がっていない分割送信）、"folder"（区切りでまとめたもの）があります。
+	Action        string            `json:"action"`
+	ContentLength int64             `json:"contentLength"`
+	ContentSha1   string            `json:"contentSha1"`
+	ContentType   string            `json:"contentType"`
+	FileInfo      map[string]string `json:"fileInfo"`
+	// UploadTimestamp は書き込まれた時刻（1970年からのミリ秒）です。
+	UploadTimestamp int64 `json:"uploadTimestamp"`
+}
+
+// listResult は一覧の1ページです。
+type listResult struct {
+	Files        []file `json:"files"`
+	NextFileName string `json:"nextFileName"`
+	// NextFileID は版の一覧のときだけ返ります。
+	NextFileID string `json:"nextFileId"`
+}
+
+// listRequest は一覧の問い合わせです。
+type listRequest struct {
+	BucketID      string `json:"bucketId"`
+	Prefix        string `json:"prefix,omitempty"`
+	Delimiter     string `json:"delimiter,omitempty"`
+	StartFileName string `json:"startFileName,omitempty"`
+	StartFileID   string `json:"startFileId,omitempty"`
+	MaxFileCount  int    `json:"maxFileCount"`
+}
+
+// listFileNames は、名前ごとに最新の版だけを1ページぶん返します。隠したものは含みません。
+func (c *apiClient) listFileNames(ctx context.Context, prefix, delimiter, start string, max int) (*listResult, error) {
+	return c.list(ctx, "b2_list_file_names", listRequest{
+		Prefix:        prefix,
+		Delimiter:     delimiter,
+		StartFileName: start,
+		MaxFileCount:  max,
+	})
+}
+
+// listFileVersions は、すべての版を名前の順、同じ名前なら新しい順に1ページぶん返します。
+func (c *apiClient) listFileVersions(ctx context.Context, prefix, delimiter, startName, startID string, max int) (*listResult, error) {
+	return c.list(ctx, "b2_list_file_versions", listRequest{
+		Prefix:        prefix,
+		Delimiter:     delimiter,
+		StartFileName: startName,
+		StartFileID:   startID,
+		MaxFileCount:  max,
+	})
+}
+
+func (c *apiClient) list(ctx context.Context, name string, in listRequest) (*listResult, error) {
+	if _, err := c.session(ctx); err != nil {
+		return nil, err
+	}
+	in.BucketID = c.bucketID
+
+	var out listResult
+	if err := c.call(ctx, name, in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// --- 書き込み ---
+
+// uploadURL は書き込みを送る先です。
+//
+// 送り先は1つの書き込みが終わるまで他の書き込みに使えません。
+// 取り直すのにも要求が1つ要るので、使い終わったものは urlPool に戻して使い回します。
+type uploadURL struct {
+	URL   string `json:"uploadUrl"`
+	Token string `json:"authorizationToken"`
+}
+
+// urlPool は使い回せる送り先です。
+type urlPool struct {
+	mu   sync.Mutex
+	free []*uploadURL
+}
+
+// get は空いている送り先を返します。なければ nil です。
+func (p *urlPool) get() *uploadURL {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.free) == 0 {
+		return nil
+	}
+	u := p.free[len(p.free)-1]
+	p.free = p.free[:len(p.free)-1]
+	return u
+}
+
+// put は使い終わった送り先を戻します。失敗した送り先は戻さないでください。
+func (p *urlPool) put(u *uploadURL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.free = append(p.free, u)
+}
+
+// getUploadURL は1回で送るときの送り先をもらいます。
+func (c *apiClient) getUploadURL(ctx context.Context) (*uploadURL, error) {
+	if _, err := c.session(ctx); err != nil {
+		return nil, err
+	}
+	var out uploadURL
+	err := c.call(ctx, "b2_get_upload_url", map[string]string{"bucketId": c.bucketID}, &out)
+	return &out, err
+}
+
+// getUploadPartURL は分けて送るときの送り先をもらいます。
+func (c *apiClient) getUploadPartURL(ctx context.Context, fileID string) (*uploadURL, error) {
+	var out uploadURL
+	err := c.call(ctx, "b2_get_upload_part_url", map[string]string{"fileId": fileID}, &out)
+	return &out, err
+}
+
+// infoHeaderPrefix は利用者定義の項目を表す見出しの接頭辞です。
+const infoHeaderPrefix = "X-Bz-Info-"
+
+// uploadFile は1回の要求で書き込みます。
+//
+// sha1 は内容の SHA1（16進）です。B2 は受け取った内容と照らし合わせ、
+// 食い違えば書き込みません。
+func (c *apiClient) uploadFile(ctx context.Context, u *uploadURL, name string, data []byte, sha1, contentType string, info map[string]string) (*file, error) {
+	h := map[string]string{
+		"X-Bz-File-Name":    escapeName(name),
+		"Content-Type":      contentType,
+		"X-Bz-Content-Sha1": sha1,
+	}
+	for k, v := range info {
+		h[infoHeaderPrefix+k] = escapeName(v)
+	}
+
+	res, err := c.send(ctx, http.MethodPost, u.URL, u.Token, bytes.NewReader(data), int64(len(data)), h)
+	if err != nil {
+		return nil, err
+	}
+	defer drain(res)
+
+	var out file
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("書き込みの応答を解釈できません: %w", err)
+	}
+	return &out, nil
+}
+
+// startLargeFile は分けて送る書き込みを始めます。仕上げるまで見えません。
+func (c *apiClient) startLargeFile(ctx context.Context, name, contentType string, info map[string]string) (*file, error) {
+	if _, err := c.session(ctx); err != nil {
+		return nil, err
+	}
+	in := map[string]any{
+		"bucketId":    c.bucketID,
+		"fileName":    name,
+		"contentType": contentType,
+	}
+	if len(info) > 0 {
+		in["fileInfo"] = info
+	}
+	var out file
+	if err := c.call(ctx, "b2_start_large_file", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// uploadPart は n 番目（1から数える）の部分を送ります。
+func (c *apiClient) uploadPart(ctx context.Context, u *uploadURL, n int, data []byte, sha1 string) error {
+	res, err := c.send(ctx, http.MethodPost, u.URL, u.Token, bytes.NewReader(data), int64(len(data)), map[string]string{
+		"X-Bz-Part-Number":  strconv.Itoa(n),
+		"X-Bz-Content-Sha1": sha1,
+	})
+	if err != nil {
+		return err
+	}
+	drain(res)
+	return nil
+}
+
+// finishLargeFile は送った部分を並べて1つにします。ここで初めて見えるようになります。
+func (c *apiClient) finishLargeFile(ctx context.Context, fileID string, partSha1s []string) (*file, error) {
+	in := map[string]any{"fileId": fileID, "partSha1Array": partSha1s}
+	var out file
+	if err := c.call(ctx, "b2_finish_large_file", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// cancelLargeFile は仕上げずにやめ、送った部分を捨てます。
+func (c *apiClient) cancelLargeFile(ctx context.Context, fileID string) error {
+	return c.call(ctx, "b2_cancel_large_file", map[string]string{"fileId": fileID}, nil)
+}
+
+// --- 削除とコピー ---
+
+// deleteFileVersion は1つの版を消します。
+func (c *apiClient) deleteFileVersion(ctx context.Context, name, fileID string) error {
+	return c.call(ctx, "b2_delete_file_version", map[string]string{"fileName": name, "fileId": fileID}, nil)
+}
+
+// hideFile は名前に「隠す」印を付けます。以前の版は残ります。
+func (c *apiClient) hideFile(ctx context.Context, name string) error {
+	if _, err := c.session(ctx); err != nil {
+		return err
+	}
+	return c.call(ctx, "b2_hide_file", map[string]string{"bucketId": c.bucketID, "fileName": name}, nil)
+}
+
+// copyFile は版 srcID を name に写します。利用者定義の項目も写ります。
+func (c *apiClient) copyFile(ctx context.Context, srcID, name string) (*file, error) {
+	in := map[string]string{
+		"sourceFileId":      srcID,
+		"fileName":          name,
+		"metadataDirective": "COPY",
+	}
+	var out file
+	if err := c.call(ctx, "b2_copy_file", in, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// --- 読み出し ---
+
+// downloadByID は版を指定して内容を読みます。rangeSpec が空でなければ、その範囲だけです。
+func (c *apiClient) downloadByID(ctx context.Context, fileID, rangeSpec string) (io.ReadCloser, error) {
+	return c.download(ctx, func(a *authorization) string {
+		return a.DownloadURL + apiPrefix + "b2_download_file_by_id?fileId=" + url.QueryEscape(fileID)
+	}, rangeSpec)
+}
+
+// downloadByName は名前の最新の版を読みます。
+func (c *apiClient) downloadByName(ctx context.Context, name, rangeSpec string) (io.ReadCloser, error) {
+	return c.download(ctx, func(a *authorization) string {
+		return a.DownloadURL + "/file/" + url.PathEscape(c.bucket) + "/" + escapeName(name)
+	}, rangeSpec)
+}
+
+func (c *apiClient) download(ctx context.Context, target func(a *authorization) string, rangeSpec string) (io.ReadCloser, error) {
+	var headers map[string]string
+	if rangeSpec != "" {
+		headers = map[string]string{"Range": rangeSpec}
+	}
+
+	var body io.ReadCloser
+	err := c.withSession(ctx, func(a *authorization) error {
+		res, err := c.send(ctx, http.MethodGet, target(a), a.Token, nil, 0, headers)
+		if err != nil {
+			return err
+		}
+		body = res.Body
+		return nil
+	})
+	return body, err
+}
@@ -0,0 +1,729 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+	"github.com/mt3hr/hbg/storage/storagetest"
+)
+
+// 適合性テストを偽サーバーに対して実行します。
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Harness{
+		NewStorage: func(t *testing.T) (storage.Storage, string) {
+			f := newFakeB2()
+			s := f.start(t)
+
+			root := "/試験"
+			if err := s.Mkdir(context.Background(), root); err != nil {
+				t.Fatalf("試験用のディレクトリを作れません: %v", err)
+			}
+			return s, root
+		},
+		LargeDirCount: 120,
+	})
+}
+
+func newTestStorage(t *testing.T, mutate ...func(*Config)) (context.Context, *fakeB2, *Storage) {
+	t.Helper()
+	f := newFakeB2()
+	return context.Background(), f, f.start(t, mutate...)
+}
+
+func put(t *testing.T, ctx context.Context, s *Storage, p, content string) *storage.FileInfo {
+	t.Helper()
+	fi, err := s.Put(ctx, p, strings.NewReader(content), storage.ObjectMeta{
+		Size: int64(len(content)),
+	})
+	if err != nil {
+		t.Fatalf("Put(%s): %v", p, err)
+	}
+	return fi
+}
+
+func readAll(t *testing.T, ctx context.Context, s *Storage, p string) string {
+	t.Helper()
+	rc, _, err := s.Open(ctx, p)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", p, err)
+	}
+	defer rc.Close()
+
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll(%s): %v", p, err)
+	}
+	return string(b)
+}
+
+func listNames(t *testing.T, ctx context.Context, s *Storage, dir string) map[string]bool {
+	t.Helper()
+	entries := map[string]bool{}
+	if err := s.List(ctx, dir, func(fi storage.FileInfo) error {
+		entries[fi.Name] = fi.IsDir
+		return nil
+	}); err != nil {
+		t.Fatalf("List(%s): %v", dir, err)
+	}
+	return entries
+}
+
+// 名前の中の "/" が階層として見え、印を書かなくても済むことを確かめます。
+func TestDirectoriesAreVirtual(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+
+	put(t, ctx, s, "/写真/2024/a.jpg", "A")
+	put(t, ctx, s, "/写真/2023/c.jpg", "C")
+	put(t, ctx, s, "/直下.txt", "D")
+
+	f.mu.Lock()
+	count := len(f.versions)
+	f.mu.Unlock()
+	if count != 3 {
+		t.Errorf("入っている版の数 = %d, want 3", count)
+	}
+
+	entries := listNames(t, ctx, s, "/")
+	if isDir, ok := entries["写真"]; !ok || !isDir {
+		t.Error("写真 がディレクトリとして見えていない")
+	}
+	if isDir, ok := entries["直下.txt"]; !ok || isDir {
+		t.Error("直下.txt がファイルとして見えていない")
+	}
+	if len(entries) != 2 {
+		t.Errorf("ルートの一覧 = %v, 2件であるべき", entries)
+	}
+
+	fi, err := s.Stat(ctx, "/写真/2024")
+	if err != nil || !fi.IsDir {
+		t.Errorf("Stat(/写真/2024) = %+v, %v", fi, err)
+	}
+	if _, err := s.Stat(ctx, "/写真/2022"); !storage.IsNotFound(err) {
+		t.Errorf("Stat(/写真/2022) = %v, want ErrNotFound", err)
+	}
+}
+
+// 空のディレクトリが、管理画面と同じ .bzEmpty で表されることを確かめます。
+func TestEmptyDirMarker(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+
+	if err := s.Mkdir(ctx, "/空"); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if len(f.versionsOf("空/.bzEmpty")) != 1 {
+		t.Fatal("印が書かれていない")
+	}
+
+	if entries := listNames(t, ctx, s, "/空"); len(entries) != 0 {
+		t.Errorf("印が中身として見えている: %v", entries)
+	}
+	if entries := listNames(t, ctx, s, "/"); !entries["空"] {
+		t.Errorf("空のディレクトリが見えない: %v", entries)
+	}
+
+	if err := s.Remove(ctx, "/空"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if len(f.versionsOf("空/.bzEmpty")) != 0 {
+		t.Error("印が残っている")
+	}
+}
+
+// 元のファイルの更新時刻が、Stat でも一覧でも見えることを確かめます。
+func TestModTimeSurvivesRoundTrip(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+
+	mtime := time.Date(2020, 5, 6, 7, 8, 9, 987654321, time.UTC)
+	if _, err := s.Put(ctx, "/時刻.txt", strings.NewReader("x"), storage.ObjectMeta{Size: 1, ModTime: mtime}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// rclone などと同じ項目に、ミリ秒で入っていること。
+	if got := f.versionsOf("時刻.txt")[0].info[modTimeInfo]; got != "1588748889987" {
+		t.Errorf("%s = %q", modTimeInfo, got)
+	}
+
+	want := mtime.Truncate(time.Millisecond)
+	fi, err := s.Stat(ctx, "/時刻.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if !fi.ModTime.Equal(want) {
+		t.Errorf("Stat の更新時刻 = %v, want %v", fi.ModTime, want)
+	}
+	if err := s.List(ctx, "/", func(fi storage.FileInfo) error {
+		if !fi.ModTime.Equal(want) {
+			t.Errorf("一覧の更新時刻 = %v, want %v", fi.ModTime, want)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+}
+
+// 1回で送ったものは、B2 が計算した SHA1 が Hash で取れることを確かめます。
+func TestHash(t *testing.T) {
+	ctx, _, s := newTestStorage(t)
+	fi := put(t, ctx, s, "/h.txt", "ハッシュ")
+
+	if fi.Hashes[storage.SHA1] != sha1Hex([]byte("ハッシュ")) {
+		t.Errorf("Put が返した SHA1 = %q", fi.Hashes[storage.SHA1])
+	}
+	got, err := s.Hash(ctx, "/h.txt", storage.SHA1)
+	if err != nil || got != sha1Hex([]byte("ハッシュ")) {
+		t.Errorf("Hash = %q, %v", got, err)
+	}
+	if _, err := s.Hash(ctx, "/h.txt", storage.MD5); !errors.Is(err, storage.ErrUnsupported) {
+		t.Errorf("MD5 = %v, want ErrUnsupported", err)
+	}
+}
+
+// 転送元の SHA1 が分かっていれば一緒に送り、食い違えば書き込まれないことを確かめます。
+func TestPutSendsSHA1ForVerification(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+
+	_, err := s.Put(ctx, "/壊れ.txt", strings.NewReader("中身"), storage.ObjectMeta{
+		Size:   int64(len("中身")),
+		Hashes: map[storage.HashType]string{storage.SHA1: sha1Hex([]byte("別物"))},
+	})
+	if err == nil {
+		t.Fatal("SHA1 が食い違うのに書き込めてしまった")
+	}
+	if class := storage.ClassOf(err); class != storage.ClassPermanent {
+		t.Errorf("失敗の種類 = %v, want permanent", class)
+	}
+	if len(f.versionsOf("壊れ.txt")) != 0 {
+		t.Error("食い違ったものが書き込まれている")
+	}
+}
+
+// 分割の大きさを超えるものが分けて送られ、同時に送っても正しく並ぶことを確かめます。
+func TestLargeFileUpload(t *testing.T) {
+	ctx, f, s := newTestStorage(t, func(c *Config) {
+		c.UploadChunkSizeMiB = 1
+		c.UploadConcurrency = 2
+	})
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 5*1024*1024/32) // 2.5MiB
+	want := sha1Hex(content)
+	fi, err := s.Put(ctx, "/大/known.bin", bytes.NewReader(content), storage.ObjectMeta{
+		Size:   int64(len(content)),
+		Hashes: map[storage.HashType]string{storage.SHA1: want},
+	})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if fi.Size != int64(len(content)) {
+		t.Errorf("大きさ = %d, want %d", fi.Size, len(content))
+	}
+	if got := f.callCount("upload_part"); got != 3 {
+		t.Errorf("部分を送った回数 = %d, want 3", got)
+	}
+	if f.callCount("upload") != 0 || f.callCount("finish_large_file") != 1 {
+		t.Errorf("1回で送った回数 = %d, 仕上げた回数 = %d", f.callCount("upload"), f.callCount("finish_large_file"))
+	}
+	if got := readAll(t, ctx, s, "/大/known.bin"); got != string(content) {
+		t.Error("読み戻した内容が違う")
+	}
+
+	// 転送元の SHA1 は large_file_sha1 として残り、Hash で取れる。
+	if got, err := s.Hash(ctx, "/大/known.bin", storage.SHA1); err != nil || got != want {
+		t.Errorf("Hash = %q, %v, want %q", got, err, want)
+	}
+
+	// 転送元の SHA1 が分からなければ残せないので、取れないと伝える。
+	if _, err := s.Put(ctx, "/大/unknown.bin", bytes.NewReader(content), storage.ObjectMeta{
+		Size: int64(len(content)),
+	}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := s.Hash(ctx, "/大/unknown.bin", storage.SHA1); !errors.Is(err, storage.ErrUnsupported) {
+		t.Errorf("Hash = %v, want ErrUnsupported", err)
+	}
+}
+
+// 分けて送った内容が転送元の SHA1 と食い違えば、仕上げずに捨てることを確かめます。
+func TestLargeFileSHA1Mismatch(t *testing.T) {
+	ctx, f, s := newTestStorage(t, func(c *Config) { c.UploadChunkSizeMiB = 1 })
+
+	content := bytes.Repeat([]byte("x"), 1024*1024+10)
+	_, err := s.Put(ctx, "/大.bin", bytes.NewReader(content), storage.ObjectMeta{
+		Size:   int64(len(content)),
+		Hashes: map[storage.HashType]string{storage.SHA1: sha1Hex([]byte("別物"))},
+	})
+	if err == nil {
+		t.Fatal("SHA1 が食い違うのに書き込めてしまった")
+	}
+	if f.callCount("finish_large_file") != 0 || f.callCount("cancel_large_file") != 1 {
+		t.Errorf("仕上げた回数 = %d, 捨てた回数 = %d", f.callCount("finish_large_file"), f.callCount("cancel_large_file"))
+	}
+	if len(f.versionsOf("大.bin")) != 0 {
+		t.Error("仕上がっていない分割送信が残っている")
+	}
+}
+
+// 部分を送るのに失敗したら、送った部分を捨てることを確かめます。
+func TestLargeFileCanceledOnFailure(t *testing.T) {
+	ctx, f, s := newTestStorage(t, func(c *Config) { c.UploadChunkSizeMiB = 1 })
+	f.failNext("upload_part", 10, 400, "bad_request")
+
+	content := bytes.Repeat([]byte("x"), 3*1024*1024)
+	if _, err := s.Put(ctx, "/大.bin", bytes.NewReader(content), storage.ObjectMeta{Size: int64(len(content))}); err == nil {
+		t.Fatal("失敗したのに書き込めたことになっている")
+	}
+	if got := f.callCount("cancel_large_file"); got != 1 {
+		t.Errorf("捨てた回数 = %d, want 1", got)
+	}
+	if len(f.versionsOf("大.bin")) != 0 {
+		t.Error("仕上がっていない分割送信が残っている")
+	}
+}
+
+// 分割の大きさが B2 の最小より小さければ、送り始める前に断ることを確かめます。
+func TestLargeFileChunkTooSmall(t *testing.T) {
+	ctx, f, s := newTestStorage(t, func(c *Config) { c.UploadChunkSizeMiB = 1 })
+	f.minPartSize = 5 * 1024 * 1024
+
+	content := bytes.Repeat([]byte("x"), 2*1024*1024)
+	_, err := s.Put(ctx, "/大.bin", bytes.NewReader(content), storage.ObjectMeta{Size: int64(len(content))})
+	if err == nil || !strings.Contains(err.Error(), "upload_chunk_size_mib") {
+		t.Errorf("Put = %v, 分割の大きさを直すよう伝えるべき", err)
+	}
+	if f.callCount("start_large_file") != 0 {
+		t.Error("送り始めてしまった")
+	}
+}
+
+// 送り先を使い回し、混んでいると言われたら取り直して送り直すことを確かめます。
+func TestUploadURL(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+
+	put(t, ctx, s, "/1.txt", "1")
+	put(t, ctx, s, "/2.txt", "2")
+	if got := f.callCount("get_upload_url"); got != 1 {
+		t.Errorf("送り先を取った回数 = %d, want 1（使い回すはず）", got)
+	}
+
+	f.failNext("upload", 1, 503, "service_unavailable")
+	put(t, ctx, s, "/3.txt", "3")
+	if got := f.callCount("get_upload_url"); got != 2 {
+		t.Errorf("送り先を取った回数 = %d, want 2（失敗したものは捨てるはず）", got)
+	}
+	if got := readAll(t, ctx, s, "/3.txt"); got != "3" {
+		t.Errorf("内容 = %q", got)
+	}
+}
+
+// トークンが切れたら認可を取り直し、要求を送り直すことを確かめます。
+func TestExpiredTokenIsRenewed(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+	put(t, ctx, s, "/a.txt", "a")
+
+	f.expireToken()
+	if got := readAll(t, ctx, s, "/a.txt"); got != "a" {
+		t.Errorf("内容 = %q", got)
+	}
+	if got := f.callCount("authorize_account"); got != 2 {
+		t.Errorf("認可を受けた回数 = %d, want 2", got)
+	}
+	// 入れ物の ID は変わらないので、調べ直さない。
+	if got := f.callCount("list_buckets"); got != 1 {
+		t.Errorf("入れ物を調べた回数 = %d, want 1", got)
+	}
+}
+
+// 入れ物を限ったキーなら、入れ物を調べずに済み、別の入れ物は断ることを確かめます。
+func TestRestrictedKey(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+	f.restrictedTo = testBucket
+	put(t, ctx, s, "/a.txt", "a")
+	if got := f.callCount("list_buckets"); got != 0 {
+		t.Errorf("入れ物を調べた回数 = %d, want 0", got)
+	}
+
+	other := f.start(t, func(c *Config) { c.Bucket = "other-bucket" })
+	if _, err := other.Stat(ctx, "/a.txt"); err == nil || !strings.Contains(err.Error(), testBucket) {
+		t.Errorf("Stat = %v, 使える入れ物を伝えるべき", err)
+	}
+}
+
+// 既定では、その名前の版をすべて消すことを確かめます。
+// 最新の版だけを消すと、1つ前の版が表に出てきてしまいます。
+func TestRemoveDeletesAllVersions(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+	put(t, ctx, s, "/a.txt", "古い")
+	put(t, ctx, s, "/a.txt", "新しい")
+	if len(f.versionsOf("a.txt")) != 2 {
+		t.Fatal("版が2つできていない")
+	}
+
+	if err := s.Remove(ctx, "/a.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if n := len(f.versionsOf("a.txt")); n != 0 {
+		t.Errorf("残った版 = %d, want 0", n)
+	}
+	if _, err := s.Stat(ctx, "/a.txt"); !storage.IsNotFound(err) {
+		t.Errorf("Stat = %v, want ErrNotFound", err)
+	}
+}
+
+// hide_on_delete なら隠すだけで、以前の版を残すことを確かめます。
+func TestHideOnDelete(t *testing.T) {
+	ctx, f, s := newTestStorage(t, func(c *Config) { c.HideOnDelete = true })
+	put(t, ctx, s, "/a.txt", "a")
+	put(t, ctx, s, "/d/b.txt", "b")
+
+	if err := s.Remove(ctx, "/a.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := s.Stat(ctx, "/a.txt"); !storage.IsNotFound(err) {
+		t.Errorf("Stat = %v, want ErrNotFound", err)
+	}
+	versions := f.versionsOf("a.txt")
+	if len(versions) != 2 || versions[0].action != "hide" || versions[1].action != "upload" {
+		t.Errorf("版 = %+v, 隠す印と元の版が残るべき", versions)
+	}
+
+	if err := s.Purge(ctx, "/d"); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	if entries := listNames(t, ctx, s, "/"); len(entries) != 0 {
+		t.Errorf("隠したものが見えている: %v", entries)
+	}
+	if f.callCount("delete_file_version") != 0 {
+		t.Error("版を消してしまった")
+	}
+}
+
+// versions を指定すると、以前の版が時刻つきの名前で並び、読めることを確かめます。
+func TestVersions(t *testing.T) {
+	ctx, f, s := newTestStorage(t, func(c *Config) { c.HideOnDelete = true })
+	put(t, ctx, s, "/a.txt", "一")
+	put(t, ctx, s, "/a.txt", "二")
+	put(t, ctx, s, "/b.txt", "b")
+	if err := s.Remove(ctx, "/b.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	v := f.start(t, func(c *Config) { c.Versions = true; c.HideOnDelete = false })
+
+	old := "a-v2024-03-01-091500-123.txt"
+	hidden := "b-v2024-03-01-091502-125.txt"
+	entries := listNames(t, ctx, v, "/")
+	for _, name := range []string{"a.txt", old, hidden} {
+		if _, ok := entries[name]; !ok {
+			t.Errorf("%s が並んでいない: %v", name, entries)
+		}
+	}
+	if len(entries) != 3 {
+		t.Errorf("一覧 = %v, 3件であるべき", entries)
+	}
+
+	if got := readAll(t, ctx, v, "/"+old); got != "一" {
+		t.Errorf("以前の版の内容 = %q", got)
+	}
+	if got := readAll(t, ctx, v, "/a.txt"); got != "二" {
+		t.Errorf("最新の版の内容 = %q", got)
+	}
+	rc, err := v.OpenRange(ctx, "/"+hidden, 0, 1)
+	if err != nil {
+		t.Fatalf("OpenRange: %v", err)
+	}
+	b, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(b) != "b" {
+		t.Errorf("隠したものの以前の版 = %q", b)
+	}
+
+	var recursive []string
+	if err := v.ListRecursive(ctx, "/", func(fi storage.FileInfo) error {
+		recursive = append(recursive, fi.Name)
+		return nil
+	}); err != nil {
+		t.Fatalf("ListRecursive: %v", err)
+	}
+	if len(recursive) != 3 {
+		t.Errorf("ListRecursive = %v, 3件であるべき", recursive)
+	}
+
+	if _, err := v.Put(ctx, "/c.txt", strings.NewReader("c"), storage.ObjectMeta{Size: 1}); !errors.Is(err, storage.ErrUnsupported) {
+		t.Errorf("Put = %v, want ErrUnsupported", err)
+	}
+	if err := v.Remove(ctx, "/a.txt"); !errors.Is(err, storage.ErrUnsupported) {
+		t.Errorf("Remove = %v, want ErrUnsupported", err)
+	}
+}
+
+// 版を表す名前の作り方と読み方を確かめます。
+func TestVersionName(t *testing.T) {
+	at := time.Date(2024, 3, 1, 9, 15, 0, 7*int(time.Millisecond), time.UTC)
+	tests := map[string]string{
+		"a.txt":          "a-v2024-03-01-091500-007.txt",
+		"d/archive.tgz":  "d/archive-v2024-03-01-091500-007.tgz",
+		"d.x/拡張子なし":      "d.x/拡張子なし-v2024-03-01-091500-007",
+		"a.tar.gz":       "a.tar-v2024-03-01-091500-007.gz",
+		"d/a-v1.txt":     "d/a-v1-v2024-03-01-091500-007.txt",
+		"d/a-v2024-x.md": "d/a-v2024-x-v2024-03-01-091500-007.md",
+	}
+	for name, want := range tests {
+		got := versionName(name, at)
+		if got != want {
+			t.Errorf("versionName(%q) = %q, want %q", name, got, want)
+			continue
+		}
+		back, bt, ok := parseVersion(got)
+		if !ok || back != name || !bt.Equal(at) {
+			t.Errorf("parseVersion(%q) = %q, %v, %v", got, back, bt, ok)
+		}
+	}
+
+	if _, _, ok := parseVersion("a.txt"); ok {
+		t.Error("ふつうの名前を版として読んだ")
+	}
+}
+
+func TestOpenRange(t *testing.T) {
+	ctx, _, s := newTestStorage(t)
+	put(t, ctx, s, "/r.txt", "0123456789")
+
+	for _, tt := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, 3, "012"},
+		{5, -1, "56789"},
+		{8, 10, "89"},
+	} {
+		rc, err := s.OpenRange(ctx, "/r.txt", tt.offset, tt.length)
+		if err != nil {
+			t.Fatalf("OpenRange(%d, %d): %v", tt.offset, tt.length, err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(b) != tt.want {
+			t.Errorf("OpenRange(%d, %d) = %q, want %q", tt.offset, tt.length, b, tt.want)
+		}
+	}
+
+	if _, err := s.OpenRange(ctx, "/無い.txt", 0, 1); !storage.IsNotFound(err) {
+		t.Errorf("無いもの = %v, want ErrNotFound", err)
+	}
+}
+
+// サーバー側のコピーで、更新時刻とハッシュが写ることを確かめます。
+func TestServerSideCopyAndMove(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+
+	mtime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	if _, err := s.Put(ctx, "/元.txt", strings.NewReader("中身"), storage.ObjectMeta{Size: 6, ModTime: mtime}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	fi, err := s.ServerSideCopy(ctx, "/元.txt", "/写し/先.txt")
+	if err != nil {
+		t.Fatalf("ServerSideCopy: %v", err)
+	}
+	if !fi.ModTime.Equal(mtime) || fi.Hashes[storage.SHA1] != sha1Hex([]byte("中身")) {
+		t.Errorf("写した先 = %+v", fi)
+	}
+	if got := readAll(t, ctx, s, "/写し/先.txt"); got != "中身" {
+		t.Errorf("写した内容 = %q", got)
+	}
+
+	if err := s.Move(ctx, "/元.txt", "/移動.txt"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if _, err := s.Stat(ctx, "/元.txt"); !storage.IsNotFound(err) {
+		t.Errorf("移動元が残っている: %v", err)
+	}
+	if got := f.callCount("copy_file"); got != 2 {
+		t.Errorf("コピーの回数 = %d, want 2", got)
+	}
+	if f.callCount("upload") != 1 {
+		t.Error("中身を送り直している")
+	}
+}
+
+func TestRemoveRefusesNonEmptyDir(t *testing.T) {
+	ctx, _, s := newTestStorage(t)
+	put(t, ctx, s, "/d/a.txt", "a")
+	put(t, ctx, s, "/d/e/b.txt", "b")
+
+	if err := s.Remove(ctx, "/d"); !errors.Is(err, storage.ErrNotEmpty) {
+		t.Errorf("Remove(/d) = %v, want ErrNotEmpty", err)
+	}
+	if err := s.Purge(ctx, "/d"); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	if _, err := s.Stat(ctx, "/d"); !storage.IsNotFound(err) {
+		t.Errorf("消えていない: %v", err)
+	}
+	if err := s.Purge(ctx, "/d"); !storage.IsNotFound(err) {
+		t.Errorf("無いものの Purge = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRootIsApplied(t *testing.T) {
+	ctx, f, s := newTestStorage(t, func(c *Config) { c.Root = "/起点/下" })
+	put(t, ctx, s, "/a.txt", "a")
+
+	if len(f.versionsOf("起点/下/a.txt")) != 1 {
+		t.Error("起点の下に書かれていない")
+	}
+	if entries := listNames(t, ctx, s, "/"); !(len(entries) == 1 && !entries["a.txt"]) {
+		t.Errorf("一覧 = %v", entries)
+	}
+}
+
+// 配下をまとめて並べるとき、ディレクトリの数によらずページ単位で問い合わせることを確かめます。
+func TestListRecursiveIgnoresDirCount(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+	for i := range 10 {
+		put(t, ctx, s, "/木/"+string(rune('0'+i))+"/中/f.txt", "x")
+	}
+	before := f.callCount("list_file_names")
+
+	tree, err := storage.ListTree(ctx, s, "/木")
+	if err != nil {
+		t.Fatalf("ListTree: %v", err)
+	}
+	// 10件を3件ずつ返すので4回。
+	if n := f.callCount("list_file_names") - before; n != 4 {
+		t.Errorf("一覧の問い合わせ = %d回, want 4", n)
+	}
+	if entries, ok := tree.Dir("/木/3/中"); !ok || len(entries) != 1 {
+		t.Errorf("/木/3/中 の中身 = %v, %v", entries, ok)
+	}
+}
+
+// エラーの分類を確かめます。
+func TestClassifyStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string
+		want   storage.Class
+	}{
+		{404, "not_found", storage.ClassPermanent},
+		{400, "file_not_present", storage.ClassPermanent},
+		{401, "unauthorized", storage.ClassAuth},
+		{401, "bad_auth_token", storage.ClassAuth},
+		{401, "access_denied", storage.ClassAuth},
+		// 上限に達したものは、待っても当分は直らない。
+		{403, "storage_cap_exceeded", storage.ClassPermanent},
+		{403, "download_cap_exceeded", storage.ClassPermanent},
+		{429, "too_many_requests", storage.ClassRateLimit},
+		{503, "service_unavailable", storage.ClassRetryable},
+		{500, "internal_error", storage.ClassRetryable},
+		{408, "request_timeout", storage.ClassRetryable},
+		{400, "bad_request", storage.ClassPermanent},
+		{416, "range_not_satisfiable", storage.ClassPermanent},
+	}
+	for _, tt := range tests {
+		if got := classifyStatus(tt.status, tt.code); got.class != tt.want {
+			t.Errorf("classifyStatus(%d, %q) = %v, want %v", tt.status, tt.code, got.class, tt.want)
+		}
+	}
+
+	if v := classifyStatus(400, "file_not_present"); !errors.Is(v.sentinel, storage.ErrNotFound) {
+		t.Error("file_not_present が ErrNotFound にならない")
+	}
+}
+
+// 流量制限のときの待ち時間の指示が伝わることを確かめます。
+func TestRetryAfterIsHonored(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+	put(t, ctx, s, "/混む.txt", "x")
+	f.failNext("download_file_by_id", 1, 429, "too_many_requests")
+
+	_, _, err := s.Open(ctx, "/混む.txt")
+	if class := storage.ClassOf(err); class != storage.ClassRateLimit {
+		t.Errorf("失敗の種類 = %v, want rate_limit", class)
+	}
+	var opErr *storage.OpError
+	if !errors.As(err, &opErr) || opErr.RetryAfter != 7*time.Second {
+		t.Errorf("待ち時間が伝わっていない: %v", err)
+	}
+}
+
+// 鍵が違えば、認証の問題として伝わることを確かめます。
+func TestBadKey(t *testing.T) {
+	ctx, f, _ := newTestStorage(t)
+	s := f.start(t, func(c *Config) { c.ApplicationKey = "違う" })
+
+	_, err := s.Stat(ctx, "/a.txt")
+	if class := storage.ClassOf(err); class != storage.ClassAuth {
+		t.Errorf("失敗の種類 = %v, want auth (%v)", class, err)
+	}
+}
+
+// 設定の誤りは接続を試みる前に知らせることを確かめます。
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"入れ物がない", Config{KeyID: "k", ApplicationKey: "a"}, "bucket"},
+		{"鍵がない", Config{Bucket: "b", KeyID: "k"}, "application_key"},
+		{"負の分割", Config{Bucket: "b", KeyID: "k", ApplicationKey: "a", UploadChunkSizeMiB: -1}, "upload_chunk_size_mib"},
+		{"版と隠す", Config{Bucket: "b", KeyID: "k", ApplicationKey: "a", Versions: true, HideOnDelete: true}, "hide_on_delete"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if err == nil {
+				t.Fatal("誤りなのに通ってしまった")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("どこが悪いのか分からない: %v", err)
+			}
+		})
+	}
+}
+
+// B2 が求める形で名前が % で表されることを確かめます。
+func TestEscapeName(t *testing.T) {
+	tests := map[string]string{
+		"a/b.txt":         "a/b.txt",
+		"空白 と+記号&=.txt":   "%E7%A9%BA%E7%99%BD%20%E3%81%A8%2B%E8%A8%98%E5%8F%B7%26%3D.txt",
+		"~tilde-_.":       "~tilde-_.",
+		"100%/x?y#z":      "100%25/x%3Fy%23z",
+		"back\\slash.txt": "back%5Cslash.txt",
+	}
+	for in, want := range tests {
+		if got := escapeName(in); got != want {
+			t.Errorf("escapeName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCleanPathAndKey(t *testing.T) {
+	s := &Storage{}
+	keys := map[string]string{
+		"/":        "",
+		"/a/b.txt": "a/b.txt",
+		"a/b.txt":  "a/b.txt",
+		"/a//b":    "a/b",
+		"/a\\b":    "a\\b",
+	}
+	for in, want := range keys {
+		if got := s.key(in); got != want {
+			t.Errorf("key(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	rooted := &Storage{root: "起点"}
+	if got := rooted.key("/a.txt"); got != "起点/a.txt" {
+		t.Errorf("起点つき key = %q", got)
+	}
+	if got := rooted.pathOf("起点/a.txt"); got != "/a.txt" {
+		t.Errorf("起点つき pathOf = %q", got)
+	}
+}
@@ -0,0 +1,79 @@
+package b2
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// defaultEndpoint は認可を求める先です。接続先はここの応答で決まります。
+const defaultEndpoint = "https://api.backblazeb2.com"
+
+// Config は Backblaze B2 の設定です。
+type Config struct {
+	// Name は設定ファイルで付けた名前です。
+	Name string
+
+	// KeyID はアプリケーションキーの ID（keyID）です。
+	// 口座の主キーを使う場合は口座の ID です。
+	KeyID string
+	// ApplicationKey はアプリケーションキーそのものです。
+	ApplicationKey string
+	// Endpoint は認可を求める先です。省略すると https://api.backblazeb2.com です。
+	Endpoint string
+
+	// Bucket は入れ物（バケット）の名前です。
+	Bucket string
+
+	// HideOnDelete が真なら、削除のかわりに「隠す」印を付けます。
+	// 以前の版は残り、バケットのライフサイクル規則に従って消えます。
+	HideOnDelete bool
+	// Versions が真なら、一覧に以前の版も並べます。このときは読むだけです。
+	Versions bool
+	// DirectoryMarkers が偽なら、空のディレクトリを表す印を書きません。
+	DirectoryMarkers *bool
+
+	// UploadChunkSizeMiB は大きなファイルを分けて送るときの1つぶんの大きさです。
+	// 0 なら既定値です。これ以下のものは分けずに1回で送ります。
+	UploadChunkSizeMiB int64
+	// UploadConcurrency は分けたものを同時に送る数です。0 なら既定値です。
+	UploadConcurrency int
+
+	// Root を指定すると、その下を起点として扱います。
+	Root string
+
+	// httpOverride は試験のために通信の相手を差し替えるためのものです。
+	httpOverride *http.Client
+}
+
+func (c Config) directoryMarkers() bool {
+	if c.DirectoryMarkers == nil {
+		return true
+	}
+	return *c.DirectoryMarkers
+}
+
+func (c Config) endpoint() string {
+	if c.Endpoint == "" {
+		return defaultEndpoint
+	}
+	return strings.TrimSuffix(c.Endpoint, "/")
+}
+
+// validate は接続を試みる前に設定の不足を知らせます。
+func (c Config) validate() error {
+	if c.Bucket == "" {
+		return errors.New("入れ物（bucket）が指定されていません")
+	}
+	if c.KeyID == "" || c.ApplicationKey == "" {
+		return errors.New("key_id と application_key の両方を指定してください")
+	}
+	if c.UploadChunkSizeMiB < 0 {
+		return errors.New("upload_chunk_size_mib には正の数を指定してください")
+	}
+	if c.Versions && c.HideOnDelete {
+		// versions を指定すると書き込まないので、どちらかの指定は意味を持たない。
+		return errors.New("versions と hide_on_delete は同時に指定できません")
+	}
+	return nil
+}
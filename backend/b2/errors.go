@@ -0,0 +1,147 @@
+package b2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// B2 の失敗は、HTTP の状態コードと code の2段で表されます。
+//
+//	400 → 要求の誤り（名前が長すぎる、など）
+//	401 → 認証が通っていない、トークンが切れた
+//	403 → 容量や取り出し量の上限（cap_exceeded）
+//	404 → 存在しない
+//	408 → 時間切れ
+//	416 → 範囲の誤り
+//	429 → 要求が多すぎる
+//	503 → 混んでいる。送り先を取り直して送り直す
+//
+// トークンが切れたもの（expired_auth_token）は apiClient が取り直して
+// 送り直すので、ここまで届くのは取り直しても通らなかった場合です。
+
+// wrapErr は B2 のエラーを storage のエラーに変換します。
+func (s *Storage) wrapErr(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	v := classify(err)
+	if v.sentinel != nil && !errors.Is(err, v.sentinel) {
+		// 元のエラーも失わないよう、両方を包む。
+		err = fmt.Errorf("%w (%w)", v.sentinel, err)
+	}
+
+	return &storage.OpError{
+		Op:         op,
+		Storage:    s.name,
+		Path:       path,
+		Class:      v.class,
+		RetryAfter: v.retryAfter,
+		Err:        err,
+	}
+}
+
+// verdict は失敗の見立てです。
+type verdict struct {
+	// sentinel は対応する番兵エラーです。該当するものがなければ nil です。
+	sentinel error
+	class    storage.Class
+	// retryAfter はサーバーから指示された待ち時間です。
+	retryAfter time.Duration
+}
+
+// classify はエラーの見立てを求めます。
+func classify(err error) verdict {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return verdict{class: storage.ClassCanceled}
+	case errors.Is(err, storage.ErrNotFound):
+		return verdict{sentinel: storage.ErrNotFound, class: storage.ClassPermanent}
+	case errors.Is(err, storage.ErrNotEmpty), errors.Is(err, storage.ErrNotDir),
+		errors.Is(err, storage.ErrIsDir), errors.Is(err, storage.ErrUnsupported):
+		return verdict{class: storage.ClassPermanent}
+	}
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		v := classifyStatus(apiErr.Status, apiErr.Code)
+		v.retryAfter = apiErr.RetryAfter
+		return v
+	}
+
+	// 接続そのものが切れた場合。繋ぎ直せば通ることがある。
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return verdict{class: storage.ClassRetryable}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return verdict{class: storage.ClassRetryable}
+	}
+
+	return verdict{class: storage.ClassUnknown}
+}
+
+// classifyStatus は状態コードと code から判断します。
+func classifyStatus(status int, code string) verdict {
+	switch code {
+	case "not_found", "no_such_file", "file_not_present":
+		return verdict{sentinel: storage.ErrNotFound, class: storage.ClassPermanent}
+	case "unauthorized", "bad_auth_token", "expired_auth_token", "access_denied":
+		return verdict{class: storage.ClassAuth}
+	case "cap_exceeded", "storage_cap_exceeded", "transaction_cap_exceeded", "download_cap_exceeded":
+		// 上限は日ごと・月ごとに戻るが、待って済む長さではない。
+		return verdict{class: storage.ClassPermanent}
+	case "too_many_requests":
+		return verdict{class: storage.ClassRateLimit}
+	}
+
+	switch status {
+	case http.StatusNotFound:
+		return verdict{sentinel: storage.ErrNotFound, class: storage.ClassPermanent}
+	case http.StatusUnauthorized:
+		return verdict{class: storage.ClassAuth}
+	case http.StatusTooManyRequests:
+		return verdict{class: storage.ClassRateLimit}
+	case http.StatusRequestTimeout:
+		return verdict{class: storage.ClassRetryable}
+	}
+
+	switch {
+	case status >= 500 && status <= 599:
+		return verdict{class: storage.ClassRetryable}
+	case status >= 400 && status <= 499:
+		return verdict{class: storage.ClassPermanent}
+	}
+	return verdict{class: storage.ClassUnknown}
+}
+
+// isNotFound はエラーが「存在しない」を表すかを返します。
+func isNotFound(err error) bool {
+	v := classify(err)
+	return v.sentinel != nil && errors.Is(v.sentinel, storage.ErrNotFound)
+}
+
+// parseRetryAfter は待つよう指示された時間を読み取ります。
+func parseRetryAfter(raw string) time.Duration {
+	if raw == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(raw); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(raw); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,674 @@
+package b2
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 偽の B2 サーバーです。
+//
+// 鍵もバケットもなしに、認可の取り直し・版と隠す印・分割送信・
+// ページ分割・エラーの分類までを試験できるようにするためのものです。
+// 認可の窓口の応答で接続先が決まるので、Endpoint を差し替えるだけで
+// すべての要求がここへ届きます。
+
+const (
+	testBucket   = "test-bucket"
+	testBucketID = "bucket-0001"
+	testKeyID    = "test-key-id"
+	testAppKey   = "test-app-key"
+)
+
+// fakeVersion は偽サーバー上の1つの版です。
+type fakeVersion struct {
+	id          string
+	name        string
+	action      string
+	data        []byte
+	sha1        string
+	contentType string
+	info        map[string]string
+	uploaded    int64
+}
+
+// fakeLarge は分割送信の途中経過です。
+type fakeLarge struct {
+	version *fakeVersion
+	parts   map[int][]byte
+}
+
+// fakeB2 は native API のごく一部を再現します。
+type fakeB2 struct {
+	mu sync.Mutex
+	// versions はすべての版です。隠す印や仕上がっていない分割送信も含みます。
+	versions []*fakeVersion
+	large    map[string]*fakeLarge
+	seq      int
+	// clock は次に書き込む版の時刻（ミリ秒）です。書くたびに進めます。
+	clock int64
+
+	// token はいま有効なトークンです。expireToken で無効にできます。
+	token    string
+	tokenGen int
+	// restrictedTo が空でなければ、キーはその入れ物だけに限られます。
+	restrictedTo string
+	// minPartSize は分割送信の1つぶんの最小の大きさです。
+	minPartSize int64
+
+	// pageSize は一覧が1回に返す件数の上限です。
+	// 小さくしてあるので、続きの取得を必ず通ります。
+	pageSize int
+
+	failures map[string]*fakeFailure
+	calls    map[string]int
+
+	srv *httptest.Server
+}
+
+type fakeFailure struct {
+	remaining int
+	status    int
+	code      string
+}
+
+// fakeEpoch は最初の版の時刻です。ミリ秒まで端数があるようにしてあります。
+var fakeEpoch = time.Date(2024, 3, 1, 9, 15, 0, 123*int(time.Millisecond), time.UTC)
+
+func newFakeB2() *fakeB2 {
+	return &fakeB2{
+		large:       map[string]*fakeLarge{},
+		clock:       fakeEpoch.UnixMilli(),
+		minPartSize: 1024,
+		pageSize:    3,
+		failures:    map[string]*fakeFailure{},
+		calls:       map[string]int{},
+	}
+}
+
+// start は偽サーバーを立ち上げ（まだなら）、そこへ向いたストレージを返します。
+// 何度呼んでも同じ中身を見ます。
+func (f *fakeB2) start(t *testing.T, mutate ...func(*Config)) *Storage {
+	t.Helper()
+
+	if f.srv == nil {
+		f.srv = httptest.NewServer(f)
+		t.Cleanup(f.srv.Close)
+	}
+
+	cfg := Config{
+		Name:           "偽b2",
+		KeyID:          testKeyID,
+		ApplicationKey: testAppKey,
+		Endpoint:       f.srv.URL,
+		Bucket:         testBucket,
+		httpOverride:   f.srv.Client(),
+	}
+	for _, m := range mutate {
+		m(&cfg)
+	}
+	s, err := New(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("偽サーバーへ向けたストレージを作れません: %v", err)
+	}
+	return s
+}
+
+func (f *fakeB2) failNext(route string, n, status int, code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[route] = &fakeFailure{remaining: n, status: status, code: code}
+}
+
+func (f *fakeB2) callCount(route string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[route]
+}
+
+// expireToken はトークンを切らします。クライアントには知らせません。
+func (f *fakeB2) expireToken() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.token = "expired"
+}
+
+// versionsOf は名前 name の版を、新しい順に返します。
+func (f *fakeB2) versionsOf(name string) []*fakeVersion {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []*fakeVersion
+	for _, v := range f.sorted() {
+		if v.name == name {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (f *fakeB2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := routeName(r)
+
+	f.mu.Lock()
+	f.calls[route]++
+	if fail, ok := f.failures[route]; ok && fail.remaining > 0 {
+		fail.remaining--
+		status, code := fail.status, fail.code
+		f.mu.Unlock()
+		w.Header().Set("Retry-After", "7")
+		writeError(w, status, code, "わざと失敗させました")
+		return
+	}
+	f.mu.Unlock()
+
+	if route == "authorize_account" {
+		f.authorize(w, r)
+		return
+	}
+	if !f.authorized(w, r) {
+		return
+	}
+
+	switch route {
+	case "upload":
+		f.upload(w, r)
+	case "upload_part":
+		f.uploadPart(w, r, strings.TrimPrefix(r.URL.Path, "/upload_part/"))
+	case "download_file_by_id":
+		f.downloadByID(w, r)
+	case "download_by_name":
+		f.downloadByName(w, r)
+	default:
+		f.call(w, r, route)
+	}
+}
+
+// routeName は失敗の注入と回数の集計に使う名前です。
+// 窓口の名前から "b2_" を除いたものです。
+func routeName(r *http.Request) string {
+	p := r.URL.Path
+	switch {
+	case strings.HasPrefix(p, "/b2api/v2/b2_"):
+		return strings.TrimPrefix(p, "/b2api/v2/b2_")
+	case strings.HasPrefix(p, "/upload_part/"):
+		return "upload_part"
+	case strings.HasPrefix(p, "/upload/"):
+		return "upload"
+	case strings.HasPrefix(p, "/file/"):
+		return "download_by_name"
+	}
+	return "unknown"
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"status": status, "code": code, "message": message})
+}
+
+// --- 認可 ---
+
+func (f *fakeB2) authorize(w http.ResponseWriter, r *http.Request) {
+	id, key, ok := r.BasicAuth()
+	if !ok || id != testKeyID || key != testAppKey {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "鍵が違います")
+		return
+	}
+
+	f.mu.Lock()
+	f.tokenGen++
+	f.token = fmt.Sprintf("token-%d", f.tokenGen)
+	res := map[string]any{
+		"accountId":               "account-0001",
+		"authorizationToken":      f.token,
+		"apiUrl":                  f.srv.URL,
+		"downloadUrl":             f.srv.URL,
+		"recommendedPartSize":     100 * 1000 * 1000,
+		"absoluteMinimumPartSize": f.minPartSize,
+		"allowed":                 map[string]any{"bucketId": nil, "bucketName": nil},
+	}
+	if f.restrictedTo != "" {
+		bucketID := "bucket-other"
+		if f.restrictedTo == testBucket {
+			bucketID = testBucketID
+		}
+		res["allowed"] = map[string]any{"bucketId": bucketID, "bucketName": f.restrictedTo}
+	}
+	f.mu.Unlock()
+
+	writeJSON(w, res)
+}
+
+// authorized はトークンを確かめます。書き込みは送り先ごとのトークンです。
+func (f *fakeB2) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := r.Header.Get("Authorization")
+
+	f.mu.Lock()
+	current := f.token
+	f.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(token, "upload-"):
+		return true
+	case token == "" || current == "":
+		writeError(w, http.StatusUnauthorized, "bad_auth_token", "トークンがありません")
+		return false
+	case token != current:
+		writeError(w, http.StatusUnauthorized, "expired_auth_token", "トークンが切れています")
+		return false
+	}
+	return true
+}
+
+// --- JSON の窓口 ---
+
+func (f *fakeB2) call(w http.ResponseWriter, r *http.Request, route string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", r.Method)
+		return
+	}
+	var in map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	str := func(k string) string { s, _ := in[k].(string); return s }
+
+	if id, ok := in["bucketId"]; ok && id != testBucketID {
+		writeError(w, http.StatusBadRequest, "bad_bucket_id", fmt.Sprintf("知らない入れ物です: %v", id))
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch route {
+	case "list_buckets":
+		var buckets []map[string]any
+		if str("bucketName") == testBucket {
+			buckets = append(buckets, map[string]any{"bucketId": testBucketID, "bucketName": testBucket})
+		}
+		writeJSON(w, map[string]any{"buckets": buckets})
+	case "list_file_names":
+		f.list(w, in, false)
+	case "list_file_versions":
+		f.list(w, in, true)
+	case "get_upload_url":
+		f.seq++
+		writeJSON(w, map[string]any{
+			"bucketId":           testBucketID,
+			"uploadUrl":          fmt.Sprintf("%s/upload/%d", f.srv.URL, f.seq),
+			"authorizationToken": fmt.Sprintf("upload-%d", f.seq),
+		})
+	case "start_large_file":
+		v := f.newVersion(str("fileName"), "start")
+		v.contentType = str("contentType")
+		v.info = stringMap(in["fileInfo"])
+		f.large[v.id] = &fakeLarge{version: v, parts: map[int][]byte{}}
+		writeJSON(w, toFile(v))
+	case "get_upload_part_url":
+		if _, ok := f.large[str("fileId")]; !ok {
+			writeError(w, http.StatusBadRequest, "bad_request", "分割送信がありません")
+			return
+		}
+		f.seq++
+		writeJSON(w, map[string]any{
+			"fileId":             str("fileId"),
+			"uploadUrl":          f.srv.URL + "/upload_part/" + str("fileId"),
+			"authorizationToken": fmt.Sprintf("upload-%d", f.seq),
+		})
+	case "finish_large_file":
+		f.finishLarge(w, str("fileId"), in["partSha1Array"])
+	case "cancel_large_file":
+		l, ok := f.large[str("fileId")]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "bad_request", "分割送信がありません")
+			return
+		}
+		delete(f.large, l.version.id)
+		f.remove(l.version.id)
+		writeJSON(w, map[string]any{"fileId": l.version.id, "fileName": l.version.name})
+	case "delete_file_version":
+		v := f.find(str("fileId"))
+		if v == nil || v.name != str("fileName") {
+			writeError(w, http.StatusBadRequest, "file_not_present", "その版はありません")
+			return
+		}
+		f.remove(v.id)
+		writeJSON(w, map[string]any{"fileId": v.id, "fileName": v.name})
+	case "hide_file":
+		if f.latest(str("fileName")) == nil {
+			writeError(w, http.StatusBadRequest, "no_such_file", "隠すものがありません")
+			return
+		}
+		writeJSON(w, toFile(f.newVersion(str("fileName"), "hide")))
+	case "copy_file":
+		src := f.find(str("sourceFileId"))
+		if src == nil || src.action != "upload" {
+			writeError(w, http.StatusNotFound, "not_found", "コピー元がありません")
+			return
+		}
+		if str("metadataDirective") != "COPY" {
+			writeError(w, http.StatusBadRequest, "bad_request", "metadataDirective が違います")
+			return
+		}
+		v := f.newVersion(str("fileName"), "upload")
+		v.data, v.sha1, v.contentType, v.info = src.data, src.sha1, src.contentType, src.info
+		writeJSON(w, toFile(v))
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "知らない窓口です: "+r.URL.Path)
+	}
+}
+
+func stringMap(v any) map[string]string {
+	m, _ := v.(map[string]any)
+	out := map[string]string{}
+	for k, v := range m {
+		out[k], _ = v.(string)
+	}
+	return out
+}
+
+// --- 蓄えの操作（呼ぶ側で f.mu を取っておく） ---
+
+// newVersion は新しい版を加えます。時刻は1秒と1ミリ秒ずつ進めます。
+func (f *fakeB2) newVersion(name, action string) *fakeVersion {
+	f.seq++
+	v := &fakeVersion{
+		id:       fmt.Sprintf("4_z%08d", f.seq),
+		name:     name,
+		action:   action,
+		info:     map[string]string{},
+		uploaded: f.clock,
+	}
+	f.clock += 1001
+	f.versions = append(f.versions, v)
+	return v
+}
+
+func (f *fakeB2) find(id string) *fakeVersion {
+	for _, v := range f.versions {
+		if v.id == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func (f *fakeB2) remove(id string) {
+	for i, v := range f.versions {
+		if v.id == id {
+			f.versions = append(f.versions[:i], f.versions[i+1:]...)
+			return
+		}
+	}
+}
+
+// sorted は版を名前の順に、同じ名前なら新しい順に並べます。
+func (f *fakeB2) sorted() []*fakeVersion {
+	out := append([]*fakeVersion(nil), f.versions...)
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].name != out[j].name {
+			return out[i].name < out[j].name
+		}
+		return out[i].uploaded > out[j].uploaded
+	})
+	return out
+}
+
+// latest は名前の見えている版を返します。隠されていれば nil です。
+func (f *fakeB2) latest(name string) *fakeVersion {
+	for _, v := range f.sorted() {
+		if v.name != name || v.action == "start" {
+			continue
+		}
+		if v.action == "hide" {
+			return nil
+		}
+		return v
+	}
+	return nil
+}
+
+func toFile(v *fakeVersion) map[string]any {
+	out := map[string]any{
+		"accountId":       "account-0001",
+		"bucketId":        testBucketID,
+		"fileId":          v.id,
+		"fileName":        v.name,
+		"action":          v.action,
+		"contentLength":   len(v.data),
+		"contentSha1":     v.sha1,
+		"contentType":     v.contentType,
+		"fileInfo":        v.info,
+		"uploadTimestamp": v.uploaded,
+	}
+	if v.action != "upload" {
+		out["contentSha1"] = "none"
+	}
+	return out
+}
+
+func fakeSHA1(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// --- 一覧 ---
+
+func (f *fakeB2) list(w http.ResponseWriter, in map[string]any, allVersions bool) {
+	prefix, _ := in["prefix"].(string)
+	delimiter, _ := in["delimiter"].(string)
+	startName, _ := in["startFileName"].(string)
+	startID, _ := in["startFileId"].(string)
+	max := f.pageSize
+	if n, ok := in["maxFileCount"].(float64); ok && int(n) > 0 && int(n) < max {
+		max = int(n)
+	}
+
+	// 区切り文字があれば、その先はひとまとめにして "folder" として返す。
+	var entries []map[string]any
+	seen := map[string]bool{}
+	for _, v := range f.sorted() {
+		if !strings.HasPrefix(v.name, prefix) {
+			continue
+		}
+		if !allVersions && (v.action == "start" || f.latest(v.name) != v) {
+			continue
+		}
+		if delimiter != "" {
+			rest := strings.TrimPrefix(v.name, prefix)
+			if i := strings.Index(rest, delimiter); i >= 0 {
+				p := prefix + rest[:i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					entries = append(entries, map[string]any{"fileName": p, "action": "folder", "fileId": nil})
+				}
+				continue
+			}
+		}
+		entries = append(entries, toFile(v))
+	}
+
+	first := len(entries)
+	for i, e := range entries {
+		name := e["fileName"].(string)
+		if name < startName {
+			continue
+		}
+		if startID != "" && name == startName && e["fileId"] != startID {
+			continue
+		}
+		first = i
+		break
+	}
+	entries = entries[first:]
+
+	res := map[string]any{"files": []map[string]any{}, "nextFileName": nil}
+	if len(entries) > max {
+		res["nextFileName"] = entries[max]["fileName"]
+		if allVersions {
+			res["nextFileId"] = entries[max]["fileId"]
+		}
+		entries = entries[:max]
+	}
+	if len(entries) > 0 {
+		res["files"] = entries
+	}
+	writeJSON(w, res)
+}
+
+// --- 書き込み ---
+
+// upload は1回で送られたものを書き込みます。
+//
+// 実物と同じく、添えられた SHA1 と中身を照らし合わせ、食い違えば書き込みません。
+func (f *fakeB2) upload(w http.ResponseWriter, r *http.Request) {
+	name, err := url.PathUnescape(r.Header.Get("X-Bz-File-Name"))
+	if err != nil || name == "" || strings.HasSuffix(name, "/") {
+		writeError(w, http.StatusBadRequest, "bad_request", "名前が不正です")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if r.ContentLength != int64(len(data)) {
+		writeError(w, http.StatusBadRequest, "bad_request", "Content-Length が合いません")
+		return
+	}
+	if r.Header.Get("X-Bz-Content-Sha1") != fakeSHA1(data) {
+		writeError(w, http.StatusBadRequest, "bad_request", "Checksum did not match data received")
+		return
+	}
+
+	info := map[string]string{}
+	for k := range r.Header {
+		if !strings.HasPrefix(k, infoHeaderPrefix) {
+			continue
+		}
+		v, _ := url.PathUnescape(r.Header.Get(k))
+		info[strings.ToLower(strings.TrimPrefix(k, infoHeaderPrefix))] = v
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v := f.newVersion(name, "upload")
+	v.data, v.sha1, v.contentType, v.info = data, fakeSHA1(data), r.Header.Get("Content-Type"), info
+	writeJSON(w, toFile(v))
+}
+
+func (f *fakeB2) uploadPart(w http.ResponseWriter, r *http.Request, fileID string) {
+	n, err := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+	if err != nil || n < 1 || n > maxParts {
+		writeError(w, http.StatusBadRequest, "bad_request", "部分の番号が不正です")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if r.Header.Get("X-Bz-Content-Sha1") != fakeSHA1(data) {
+		writeError(w, http.StatusBadRequest, "bad_request", "Checksum did not match data received")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, ok := f.large[fileID]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "分割送信がありません")
+		return
+	}
+	l.parts[n] = data
+	writeJSON(w, map[string]any{"fileId": fileID, "partNumber": n, "contentLength": len(data), "contentSha1": fakeSHA1(data)})
+}
+
+func (f *fakeB2) finishLarge(w http.ResponseWriter, fileID string, rawSums any) {
+	l, ok := f.large[fileID]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "分割送信がありません")
+		return
+	}
+	sums, _ := rawSums.([]any)
+	if len(sums) != len(l.parts) || len(sums) < 2 {
+		writeError(w, http.StatusBadRequest, "bad_request",
+			fmt.Sprintf("部分の数が合いません（%d 個の SHA1、%d 個の部分）", len(sums), len(l.parts)))
+		return
+	}
+
+	var data []byte
+	for i := 1; i <= len(sums); i++ {
+		part, ok := l.parts[i]
+		if !ok || sums[i-1] != fakeSHA1(part) {
+			writeError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("部分 %d が合いません", i))
+			return
+		}
+		if i < len(sums) && int64(len(part)) < f.minPartSize {
+			writeError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("部分 %d が小さすぎます", i))
+			return
+		}
+		data = append(data, part...)
+	}
+
+	delete(f.large, fileID)
+	v := l.version
+	v.action, v.data, v.sha1 = "upload", data, "none"
+	writeJSON(w, toFile(v))
+}
+
+// --- 読み出し ---
+
+func (f *fakeB2) downloadByID(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	v := f.find(r.URL.Query().Get("fileId"))
+	f.mu.Unlock()
+	if v == nil || v.action != "upload" {
+		writeError(w, http.StatusNotFound, "not_found", "その版はありません")
+		return
+	}
+	serve(w, r, v)
+}
+
+func (f *fakeB2) downloadByName(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/file/")
+	bucket, name, _ := strings.Cut(rest, "/")
+	if bucket != testBucket {
+		writeError(w, http.StatusNotFound, "not_found", "知らない入れ物です")
+		return
+	}
+
+	f.mu.Lock()
+	v := f.latest(name)
+	f.mu.Unlock()
+	if v == nil {
+		writeError(w, http.StatusNotFound, "not_found", "ありません")
+		return
+	}
+	serve(w, r, v)
+}
+
+func serve(w http.ResponseWriter, r *http.Request, v *fakeVersion) {
+	w.Header().Set("X-Bz-File-Id", v.id)
+	w.Header().Set("X-Bz-Content-Sha1", v.sha1)
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(string(v.data)))
+}
@@ -0,0 +1,72 @@
+package b2
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/storage"
+)
+
+func init() {
+	backend.Register(backend.Descriptor{
+		Type:    Type,
+		Summary: "Backblaze B2（B2 自身の窓口）",
+		ConfigDoc: `  # - name: b2
+  #   type: b2
+  #   key_id: アプリケーションキーの ID（keyID）
+  #   application_key: ${B2_APPLICATION_KEY}
+  #   bucket: 入れ物（バケット）の名前
+  #   hide_on_delete: false  # true なら削除のかわりに隠し、以前の版を残す
+  #   versions: false        # true なら以前の版も並べる（読むだけ）
+  #   directory_markers: true
+  #   upload_chunk_size_mib: 96
+  #   upload_concurrency: 4
+  #   root: 起点にする接頭辞
+`,
+		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
+			chunkSize, err := intParam(params, "upload_chunk_size_mib")
+			if err != nil {
+				return nil, fmt.Errorf("b2 %s: %w", name, err)
+			}
+			concurrency, err := intParam(params, "upload_concurrency")
+			if err != nil {
+				return nil, fmt.Errorf("b2 %s: %w", name, err)
+			}
+
+			cfg := Config{
+				Name:               name,
+				KeyID:              params.Get("key_id"),
+				ApplicationKey:     params.Get("application_key"),
+				Endpoint:           params.Get("endpoint"),
+				Bucket:             params.Get("bucket"),
+				HideOnDelete:       params.Get("hide_on_delete") == "true",
+				Versions:           params.Get("versions") == "true",
+				UploadChunkSizeMiB: int64(chunkSize),
+				UploadConcurrency:  concurrency,
+				Root:               params.Get("root"),
+			}
+			if raw := params.Get("directory_markers"); raw != "" {
+				markers := raw == "true"
+				cfg.DirectoryMarkers = &markers
+			}
+
+			return New(ctx, cfg)
+		},
+	})
+}
+
+// intParam は数として指定された設定を読みます。
+func intParam(params backend.Params, key string) (int, error) {
+	raw := params.Get(key)
+	if raw == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s には数を指定してください（%q が指定されました）", key, raw)
+	}
+	return n, nil
+}
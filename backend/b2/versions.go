@@ -0,0 +1,122 @@
+package b2
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// versions を指定すると、以前の版も一覧に並べます。以前の版の名前には
+// 書き込まれた時刻を添えます。
+//
+//	report.txt                        ← 最新の版
+//	report-v2024-03-01-091500-123.txt ← 2024-03-01 09:15:00.123（UTC）に書かれた版
+//
+// 名前の形は rclone の --b2-versions と同じで、どちらで取り出しても
+// 同じ名前になります。隠したものは最新の版として並ばず、以前の版だけが
+// 並びます。
+
+// versionTimeLayout は名前に添える時刻の書式です。ミリ秒は別に添えます。
+const versionTimeLayout = "2006-01-02-150405"
+
+// versionSuffix は名前に添えた時刻を見つけます。
+var versionSuffix = regexp.MustCompile(`-v(\d{4}-\d{2}-\d{2}-\d{6})-(\d{3})$`)
+
+// versionName は name の、時刻 t に書かれた版を表す名前を返します。
+//
+// 時刻は拡張子の前に添えます。拡張子で種類を見分けるものが困らないようにするためです。
+func versionName(name string, t time.Time) string {
+	dir, base := path.Split(name)
+	ext := path.Ext(base)
+	t = t.UTC()
+	return fmt.Sprintf("%s%s-v%s-%03d%s",
+		dir, strings.TrimSuffix(base, ext), t.Format(versionTimeLayout), t.Nanosecond()/int(time.Millisecond), ext)
+}
+
+// parseVersion は版を表す名前から、元の名前と時刻を取り出します。
+func parseVersion(name string) (string, time.Time, bool) {
+	dir, base := path.Split(name)
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+
+	m := versionSuffix.FindStringSubmatchIndex(stem)
+	if m == nil {
+		return "", time.Time{}, false
+	}
+	t, err := time.Parse(versionTimeLayout, stem[m[2]:m[3]])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	ms, err := strconv.Atoi(stem[m[4]:m[5]])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return dir + stem[:m[0]] + ext, t.Add(time.Duration(ms) * time.Millisecond), true
+}
+
+// versionFilter は版の一覧を読み進めながら、それぞれの版を並べる名前を決めます。
+//
+// b2_list_file_versions は名前の順に、同じ名前なら新しい順に返すので、
+// 名前が変わって最初に来たものが最新の版です。
+type versionFilter struct {
+	name string
+	// seenLatest は、いまの名前の最新の版をもう見たかです。
+	seenLatest bool
+}
+
+// visible は版 f を並べる名前を返します。並べないものなら ok は偽です。
+func (v *versionFilter) visible(f file) (name string, ok bool) {
+	if f.Action == "start" {
+		// 仕上がっていない分割送信。まだ版ではない。
+		return "", false
+	}
+	if f.FileName != v.name {
+		v.name = f.FileName
+		v.seenLatest = false
+	}
+
+	latest := !v.seenLatest
+	v.seenLatest = true
+	switch {
+	case f.Action == "hide":
+		// 隠す印。最新なら、名前そのものは並べない。
+		return "", false
+	case latest:
+		return f.FileName, true
+	}
+	return versionName(f.FileName, time.UnixMilli(f.UploadTimestamp)), true
+}
+
+// lookupVersion は版を表す名前 key にあたる版を探します。
+func (s *Storage) lookupVersion(ctx context.Context, key string) (*file, error) {
+	name, t, ok := parseVersion(key)
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+
+	startID := ""
+	for {
+		page, err := s.api.listFileVersions(ctx, name, "", name, startID, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for i, f := range page.Files {
+			if f.FileName != name {
+				return nil, storage.ErrNotFound
+			}
+			if f.Action == "upload" && f.UploadTimestamp == t.UnixMilli() {
+				return &page.Files[i], nil
+			}
+		}
+		if page.NextFileName != name {
+			return nil, storage.ErrNotFound
+		}
+		startID = page.NextFileID
+	}
+}
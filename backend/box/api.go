@@ -0,0 +1,529 @@
+package box
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Box の窓口（Content API）は JSON をやりとりする素直な形で、hbg が使うのは
+// 一覧・取得・作成・削除・移動・コピーと分割送信の十数個です。onedrive と
+// 同じく、必要なところだけ自前で組み立てます。
+//
+// 公式の SDK を使わないのも onedrive と同じ理由です。生成された部品が
+// 大きいわりに、hbg が触るのはそのごく一部です。
+
+// apiBase は窓口の入口です。
+const apiBase = "https://api.box.com/2.0"
+
+// uploadBase は書き込みの入口です。書き込みだけは別のホストで受け付けます。
+const uploadBase = "https://upload.box.com/api/2.0"
+
+// itemFields は1件について取得する項目です。
+//
+// 指定しないと sha1 や content_modified_at が省かれることがあります。
+const itemFields = "type,id,name,size,sha1,modified_at,content_modified_at"
+
+// listPageSize は一覧が1回に要求する件数です。Box の上限は1000件です。
+const listPageSize = 1000
+
+// commitWait は、分割送信の仕上げを待つよう言われたときに、
+// 待ち時間の指示がなければ待つ時間です。
+var commitWait = time.Second
+
+// commitAttempts は、分割送信の仕上げを待つ回数の上限です。
+const commitAttempts = 60
+
+// 項目の種類。
+const (
+	typeFile   = "file"
+	typeFolder = "folder"
+	// typeWebLink はブックマークです。中身を持たないので一覧に出しません。
+	typeWebLink = "web_link"
+)
+
+// apiClient は Box とのやりとりです。
+type apiClient struct {
+	http   *http.Client
+	base   string
+	upload string
+}
+
+// item は Box が返すファイルやフォルダです。
+type item struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// SHA1 は内容の SHA1 を16進で表したものです。ファイルにだけあります。
+	SHA1              string `json:"sha1"`
+	ModifiedAt        string `json:"modified_at"`
+	ContentModifiedAt string `json:"content_modified_at"`
+}
+
+func (i item) isDir() bool { return i.Type == typeFolder }
+
+// modTime は元のファイルの更新時刻を返します。
+//
+// content_modified_at は書き込んだ側が伝えた時刻で、
+// modified_at は Box の上で何かが変わった時刻です（改名でも変わる）。
+// 同期の判断に要るのは前者です。
+func (i item) modTime() time.Time {
+	for _, raw := range []string{i.ContentModifiedAt, i.ModifiedAt} {
+		if raw == "" {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, raw); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// kind は接続先に埋め込む種類の名前です。
+func (i item) kind() string {
+	if i.isDir() {
+		return "folders"
+	}
+	return "files"
+}
+
+// itemsPage は一覧の1ページです。
+type itemsPage struct {
+	Entries    []item `json:"entries"`
+	NextMarker string `json:"next_marker"`
+}
+
+// uploadSession は分割送信の受付です。
+type uploadSession struct {
+	ID string `json:"id"`
+	// PartSize は1つぶんの大きさです。最後の1つを除き、この大きさで送ります。
+	PartSize   int64 `json:"part_size"`
+	TotalParts int   `json:"total_parts"`
+}
+
+// uploadedPart は送り終えた1つぶんです。仕上げのときにまとめて返します。
+type uploadedPart struct {
+	PartID string `json:"part_id"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	SHA1   string `json:"sha1"`
+}
+
+// --- 要求の送信 ---
+
+// request は1つの要求を送ります。応答は呼び出し側が閉じてください。
+func (c *apiClient) request(
+	ctx context.Context,
+	method, rawURL string,
+	body io.Reader,
+	contentLength int64,
+	headers map[string]string,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = contentLength
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := statusError(res); err != nil {
+		drain(res)
+		return nil, err
+	}
+	return res, nil
+}
+
+// doJSON は要求を送り、応答を out に読み込みます。out が nil なら読み捨てます。
+func (c *apiClient) doJSON(ctx context.Context, method, rawURL string, in, out any) error {
+	var body io.Reader
+	length := int64(0)
+	headers := map[string]string{"Accept": "application/json"}
+
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+		length = int64(len(encoded))
+		headers["Content-Type"] = "application/json"
+	}
+
+	res, err := c.request(ctx, method, rawURL, body, length, headers)
+	if err != nil {
+		return err
+	}
+	defer drain(res)
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("応答を解釈できません: %w", err)
+	}
+	return nil
+}
+
+// drain は応答を読み捨てて閉じます。接続を使い回せるようにするためです。
+func drain(res *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	_ = res.Body.Close()
+}
+
+// statusError は成功でない状態コードをエラーにします。
+func statusError(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return nil
+	}
+
+	e := &apiError{
+		Status:     res.StatusCode,
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+	// 応答の中身に理由が入っている。HEAD や転送先の失敗には入っていない。
+	_ = json.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(e)
+	e.Status = res.StatusCode
+	return e
+}
+
+// apiError は Box が返した失敗です。
+type apiError struct {
+	Status     int           `json:"status"`
+	Code       string        `json:"code"`
+	Message    string        `json:"message"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *apiError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%d %s (%s)", e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+}
+
+// withFields は取得する項目の指定を添えます。
+func withFields(rawURL string) string {
+	return rawURL + "?fields=" + url.QueryEscape(itemFields)
+}
+
+// --- 各操作 ---
+
+// getItem は1件のメタデータを取得します。kind は "files" か "folders" です。
+func (c *apiClient) getItem(ctx context.Context, kind, id string) (*item, error) {
+	var it item
+	if err := c.doJSON(ctx, http.MethodGet, withFields(c.base+"/"+kind+"/"+id), nil, &it); err != nil {
+		return nil, err
+	}
+	return &it, nil
+}
+
+// listItems はフォルダの直下を返します。
+//
+// 続きは marker でたどります。offset でたどると、件数の多いフォルダでは
+// 先へ進むほど遅くなり、上限を超えると断られます。
+func (c *apiClient) listItems(ctx context.Context, folderID string, fn func(item) error) error {
+	marker := ""
+	for {
+		q := url.Values{}
+		q.Set("fields", itemFields)
+		q.Set("limit", strconv.Itoa(listPageSize))
+		q.Set("usemarker", "true")
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+
+		var page itemsPage
+		if err := c.doJSON(ctx, http.MethodGet, c.base+"/folders/"+folderID+"/items?"+q.Encode(), nil, &page); err != nil {
+			return err
+		}
+		for _, it := range page.Entries {
+			if it.Type == typeWebLink {
+				continue
+			}
+			if err := fn(it); err != nil {
+				return err
+			}
+		}
+		if page.NextMarker == "" {
+			return nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+// download は内容を読み出します。
+//
+// Box は実際の置き場所へ転送するので、応答はそちらから返ります。
+func (c *apiClient) download(ctx context.Context, id string, headers map[string]string) (io.ReadCloser, error) {
+	res, err := c.request(ctx, http.MethodGet, c.base+"/files/"+id+"/content", nil, 0, headers)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// createFolder はフォルダを1つ作ります。
+func (c *apiClient) createFolder(ctx context.Context, parentID, name string) (*item, error) {
+	body := map[string]any{
+		"name":   name,
+		"parent": map[string]string{"id": parentID},
+	}
+
+	var it item
+	if err := c.doJSON(ctx, http.MethodPost, withFields(c.base+"/folders"), body, &it); err != nil {
+		return nil, err
+	}
+	return &it, nil
+}
+
+// deleteItem は1件を削除します。削除したものは Box のゴミ箱に入ります。
+//
+// recursive が偽なら、空でないフォルダの削除は断られます。
+func (c *apiClient) deleteItem(ctx context.Context, it item, recursive bool) error {
+	u := c.base + "/" + it.kind() + "/" + it.ID
+	if it.isDir() {
+		u += "?recursive=" + strconv.FormatBool(recursive)
+	}
+	return c.doJSON(ctx, http.MethodDelete, u, nil, nil)
+}
+
+// updateItem は項目の情報を書き換えます。移動や改名に使います。
+func (c *apiClient) updateItem(ctx context.Context, it item, body map[string]any) (*item, error) {
+	var updated item
+	if err := c.doJSON(ctx, http.MethodPut, withFields(c.base+"/"+it.kind()+"/"+it.ID), body, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// copyFile はファイルをサーバー側で複製します。
+func (c *apiClient) copyFile(ctx context.Context, id, parentID, name string) (*item, error) {
+	body := map[string]any{
+		"name":   name,
+		"parent": map[string]string{"id": parentID},
+	}
+
+	var it item
+	if err := c.doJSON(ctx, http.MethodPost, withFields(c.base+"/files/"+id+"/copy"), body, &it); err != nil {
+		return nil, err
+	}
+	return &it, nil
+}
+
+// uploadSmall は1回の要求で書き込みます。
+//
+// existingID が空でなければ、そのファイルの新しい版として書き込みます。
+// Box は同じ名前での新規作成を断るので、上書きはこちらの経路になります。
+func (c *apiClient) uploadSmall(
+	ctx context.Context,
+	parentID, existingID, name string,
+	content []byte,
+	sum []byte,
+	modTime time.Time,
+) (*item, error) {
+	attrs := map[string]any{"name": name}
+	u := c.upload + "/files/content"
+	if existingID != "" {
+		u = c.upload + "/files/" + existingID + "/content"
+	} else {
+		attrs["parent"] = map[string]string{"id": parentID}
+	}
+	if !modTime.IsZero() {
+		attrs["content_modified_at"] = formatTime(modTime)
+	}
+
+	body, contentType, err := multipartBody(attrs, name, content)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.request(ctx, http.MethodPost, withFields(u), bytes.NewReader(body), int64(len(body)),
+		map[string]string{
+			"Content-Type": contentType,
+			// 名前は MD5 だが、Box はここで SHA1 を受け取って照合する。
+			"Content-MD5": hex.EncodeToString(sum),
+		})
+	if err != nil {
+		return nil, err
+	}
+	defer drain(res)
+
+	return decodeUploaded(res.Body)
+}
+
+// multipartBody は1回で送るときの本文を組み立てます。
+//
+// Box は attributes を file より先に置くことを求めます。
+func multipartBody(attrs map[string]any, name string, content []byte) ([]byte, string, error) {
+	encoded, err := json.Marshal(attrs)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if err := w.WriteField("attributes", string(encoded)); err != nil {
+		return nil, "", err
+	}
+	part, err := w.CreateFormFile("file", name)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := part.Write(content); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), w.FormDataContentType(), nil
+}
+
+// decodeUploaded は書き込みの応答から、書き込まれたファイルを取り出します。
+func decodeUploaded(r io.Reader) (*item, error) {
+	var out struct {
+		Entries []item `json:"entries"`
+	}
+	if err := json.NewDecoder(r).Decode(&out); err != nil {
+		return nil, fmt.Errorf("応答を解釈できません: %w", err)
+	}
+	if len(out.Entries) == 0 {
+		return nil, fmt.Errorf("書き込んだファイルが応答に含まれていません")
+	}
+	return &out.Entries[0], nil
+}
+
+// createSession は分割送信を始めます。
+//
+// existingID が空でなければ、そのファイルの新しい版として送ります。
+func (c *apiClient) createSession(ctx context.Context, parentID, existingID, name string, size int64) (*uploadSession, error) {
+	body := map[string]any{
+		"file_name": name,
+		"file_size": size,
+	}
+	u := c.upload + "/files/upload_sessions"
+	if existingID != "" {
+		u = c.upload + "/files/" + existingID + "/upload_sessions"
+	} else {
+		body["folder_id"] = parentID
+	}
+
+	var sess uploadSession
+	if err := c.doJSON(ctx, http.MethodPost, u, body, &sess); err != nil {
+		return nil, err
+	}
+	if sess.ID == "" || sess.PartSize <= 0 {
+		return nil, fmt.Errorf("分割送信の受付が正しく返ってきませんでした")
+	}
+	return &sess, nil
+}
+
+// uploadPart は分割送信の1つぶんを送ります。
+func (c *apiClient) uploadPart(ctx context.Context, sessionID string, chunk []byte, offset, total int64) (*uploadedPart, error) {
+	res, err := c.request(ctx, http.MethodPut, c.upload+"/files/upload_sessions/"+sessionID,
+		bytes.NewReader(chunk), int64(len(chunk)),
+		map[string]string{
+			"Content-Type":  "application/octet-stream",
+			"Content-Range": fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(len(chunk))-1, total),
+			"Digest":        digest(sha1Sum(chunk)),
+		})
+	if err != nil {
+		return nil, err
+	}
+	defer drain(res)
+
+	var out struct {
+		Part uploadedPart `json:"part"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("応答を解釈できません: %w", err)
+	}
+	return &out.Part, nil
+}
+
+// commitSession は分割送信を仕上げます。sum は全体の SHA1 です。
+//
+// 送った内容を Box が組み立て終えるまで、仕上げは 202 で待たされます。
+// そのあいだは言われた時間だけ待って、同じ要求を送り直します。
+func (c *apiClient) commitSession(
+	ctx context.Context,
+	sessionID string,
+	parts []uploadedPart,
+	sum []byte,
+	modTime time.Time,
+) (*item, error) {
+	in := map[string]any{"parts": parts}
+	if !modTime.IsZero() {
+		in["attributes"] = map[string]any{"content_modified_at": formatTime(modTime)}
+	}
+	encoded, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	for range commitAttempts {
+		res, err := c.request(ctx, http.MethodPost,
+			withFields(c.upload+"/files/upload_sessions/"+sessionID+"/commit"),
+			bytes.NewReader(encoded), int64(len(encoded)),
+			map[string]string{
+				"Content-Type": "application/json",
+				"Digest":       digest(sum),
+			})
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode != http.StatusAccepted {
+			it, err := decodeUploaded(res.Body)
+			drain(res)
+			return it, err
+		}
+
+		wait := parseRetryAfter(res.Header.Get("Retry-After"))
+		drain(res)
+		if wait <= 0 {
+			wait = commitWait
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return nil, fmt.Errorf("分割送信の仕上げが終わりませんでした（%d 回待ちました）", commitAttempts)
+}
+
+// abortSession は始めた分割送信を取り消します。
+// 取り消せなくても、受付は期限が来れば消えるので、失敗は伝えません。
+func (c *apiClient) abortSession(ctx context.Context, sessionID string) {
+	res, err := c.request(ctx, http.MethodDelete, c.upload+"/files/upload_sessions/"+sessionID, nil, 0, nil)
+	if err != nil {
+		return
+	}
+	drain(res)
+}
+
+// digest は Digest ヘッダーの値を組み立てます。SHA1 を base64 で表します。
+func digest(sum []byte) string {
+	return "sha=" + base64.StdEncoding.EncodeToString(sum)
+}
+
+// formatTime は Box に渡す時刻を組み立てます。Box が保つのは秒までです。
+func formatTime(t time.Time) string {
+	return t.UTC().Truncate(time.Second).Format(time.RFC3339)
+}
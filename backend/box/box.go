@@ -0,0 +1,424 @@
+// Package box は Box を storage.Storage として実装します。
+//
+// Box は Google Drive と同じく、ファイルを ID で扱います。パスからの
+// 引き当ては resolve.go にまとめてあります。
+package box
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Type はこのバックエンドの種別名です。
+const Type = "box"
+
+// rootFolderID はすべてのファイルのルートにあたるフォルダの ID です。
+const rootFolderID = "0"
+
+// errFound は一覧を途中で打ち切るための印です。
+var errFound = errors.New("見つかりました")
+
+// Storage は Box です。
+type Storage struct {
+	name string
+	api  *apiClient
+
+	// rootID はこのストレージのルートにあたるフォルダの ID です。
+	rootID string
+
+	resolver *resolver
+}
+
+// New は保存済みのトークンを使って Box に接続します。
+//
+// ここでは通信しません。トークンがない場合はエラーを返すので、
+// hbg auth login <名前> で認証してください。
+func New(ctx context.Context, cfg Config) (*Storage, error) {
+	httpClient, err := newHTTPClient(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("box %s: %w", cfg.Name, err)
+	}
+
+	base := apiBase
+	if cfg.baseOverride != "" {
+		base = cfg.baseOverride
+	}
+	upload := uploadBase
+	if cfg.uploadOverride != "" {
+		upload = cfg.uploadOverride
+	}
+
+	rootID := cfg.RootFolderID
+	if rootID == "" {
+		rootID = rootFolderID
+	}
+
+	s := &Storage{
+		name:   cfg.Name,
+		api:    &apiClient{http: httpClient, base: base, upload: upload},
+		rootID: rootID,
+	}
+	s.resolver = newResolver(s)
+	return s, nil
+}
+
+// Type はストレージの種別を返します。
+func (s *Storage) Type() string { return Type }
+
+// Name は設定ファイルで付けた名前を返します。
+func (s *Storage) Name() string { return s.name }
+
+// Features は Box にできることを返します。
+func (s *Storage) Features() *storage.Features {
+	return &storage.Features{
+		// content_modified_at は秒までしか保たれません。
+		ModTimePrecision: time.Second,
+		CanSetModTime:    true,
+		// 同じフォルダに大文字小文字だけが違う名前を置けません。
+		CaseInsensitive: true,
+		Hashes:          storage.HashSet{storage.SHA1},
+		ImplicitDirs:    true,
+		EmptyDirs:       true,
+		// 書き込みは完了してはじめて見えます。
+		AtomicPut: true,
+		// Box のファイル名に使えない文字。"/" は区切りなので含めません。
+		IllegalChars: `\`,
+	}
+}
+
+// Close はストレージを閉じます。
+func (s *Storage) Close() error {
+	s.api = nil
+	return nil
+}
+
+// List はフォルダの直下を1件ずつ fn に渡します。
+func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	dirID, err := s.resolver.dirID(ctx, dir)
+	if err != nil {
+		return s.wrapErr("list", dir, err)
+	}
+
+	base := cleanPath(dir)
+	var fnErr error
+	err = s.api.listItems(ctx, dirID, func(it item) error {
+		fi := toFileInfo(it, base)
+		if fi.IsDir {
+			// 続けて中へ入ることが多いので、たどり直さずに済むよう覚えておく。
+			s.resolver.remember(fi.Path, it.ID)
+		}
+		fnErr = fn(fi)
+		return fnErr
+	})
+
+	switch {
+	case fnErr != nil:
+		return fnErr
+	case err != nil:
+		return s.wrapErr("list", dir, err)
+	}
+	return nil
+}
+
+// findChild は親フォルダの中から名前で1件を探します。
+// 見つからない場合は nil を返します（エラーではありません）。
+//
+// Box は大文字小文字を区別しないので、比べるときも区別しません。
+func (s *Storage) findChild(ctx context.Context, parentID, name string) (*item, error) {
+	var found *item
+	err := s.api.listItems(ctx, parentID, func(it item) error {
+		if strings.EqualFold(it.Name, name) {
+			found = &it
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errFound) {
+		return nil, err
+	}
+	return found, nil
+}
+
+// Stat は1件のメタデータを返します。
+func (s *Storage) Stat(ctx context.Context, p string) (*storage.FileInfo, error) {
+	it, err := s.resolver.file(ctx, p)
+	if err != nil {
+		return nil, s.wrapErr("stat", p, err)
+	}
+
+	fi := toFileInfo(*it, path.Dir(cleanPath(p)))
+	if cleanPath(p) == "/" {
+		fi.Path, fi.Name = "/", "/"
+	}
+	return &fi, nil
+}
+
+// Open はファイルの内容を読む ReadCloser を返します。
+func (s *Storage) Open(ctx context.Context, p string) (io.ReadCloser, *storage.FileInfo, error) {
+	it, err := s.resolver.file(ctx, p)
+	if err != nil {
+		return nil, nil, s.wrapErr("open", p, err)
+	}
+	if it.isDir() {
+		return nil, nil, s.wrapErr("open", p, storage.ErrIsDir)
+	}
+
+	rc, err := s.api.download(ctx, it.ID, nil)
+	if err != nil {
+		return nil, nil, s.wrapErr("open", p, err)
+	}
+
+	fi := toFileInfo(*it, path.Dir(cleanPath(p)))
+	return rc, &fi, nil
+}
+
+// OpenRange は offset から length バイトを読む ReadCloser を返します。
+func (s *Storage) OpenRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	it, err := s.resolver.file(ctx, p)
+	if err != nil {
+		return nil, s.wrapErr("open", p, err)
+	}
+	if it.isDir() {
+		return nil, s.wrapErr("open", p, storage.ErrIsDir)
+	}
+
+	rc, err := s.api.download(ctx, it.ID, map[string]string{
+		"Range": rangeHeader(offset, length),
+	})
+	if err != nil {
+		return nil, s.wrapErr("open", p, err)
+	}
+	return rc, nil
+}
+
+func rangeHeader(offset, length int64) string {
+	if length < 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// Put はファイルを書き込みます。
+//
+// すでに同じ名前のファイルがあれば、その新しい版として書き込みます。
+// Box は版を残すので、上書きする前の内容も Box の画面から取り出せます。
+func (s *Storage) Put(ctx context.Context, p string, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	cp := cleanPath(p)
+	if cp == "/" {
+		return nil, s.wrapErr("put", p, errors.New("ルートをファイルとして書き込むことはできません"))
+	}
+
+	dir, name := path.Dir(cp), path.Base(cp)
+	parentID, err := s.resolver.dirIDCreating(ctx, dir)
+	if err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+
+	existingID := ""
+	existing, err := s.findChild(ctx, parentID, name)
+	switch {
+	case err != nil:
+		return nil, s.wrapErr("put", p, err)
+	case existing != nil && existing.isDir():
+		return nil, s.wrapErr("put", p, storage.ErrIsDir)
+	case existing != nil:
+		existingID = existing.ID
+	}
+
+	// 先を読んでみて、収まりきるなら1回の要求で送る。
+	head, atEOF, err := readHead(r, uploadCutoff)
+	if err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+
+	var written *item
+	if atEOF {
+		written, err = s.api.uploadSmall(ctx, parentID, existingID, name, head, sha1Sum(head), meta.ModTime)
+	} else {
+		written, err = s.uploadLarge(ctx, parentID, existingID, name, head, r, meta)
+	}
+	if err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+
+	fi := toFileInfo(*written, dir)
+	return &fi, nil
+}
+
+// Mkdir はフォルダを（必要なら親ごと）作ります。すでにあれば何もしません。
+func (s *Storage) Mkdir(ctx context.Context, dir string) error {
+	if _, err := s.resolver.dirIDCreating(ctx, dir); err != nil {
+		return s.wrapErr("mkdir", dir, err)
+	}
+	return nil
+}
+
+// Remove は1つのファイル、または空のフォルダを削除します。
+//
+// 削除したものは Box のゴミ箱に入ります。
+func (s *Storage) Remove(ctx context.Context, p string) error {
+	cp := cleanPath(p)
+	if cp == "/" {
+		return s.wrapErr("remove", p, errors.New("ルートは削除できません"))
+	}
+
+	it, err := s.resolver.file(ctx, cp)
+	if err != nil {
+		return s.wrapErr("remove", p, err)
+	}
+
+	// 中身ごと消さないよう頼めば、空でないフォルダは Box が断る。
+	// 先に中を数えるより、往復が1回で済む。
+	return s.wrapErr("remove", p, s.discard(ctx, cp, *it, false))
+}
+
+// Purge はフォルダを中身ごと削除します。
+func (s *Storage) Purge(ctx context.Context, dir string) error {
+	cp := cleanPath(dir)
+	if cp == "/" {
+		return s.wrapErr("purge", dir, errors.New("ルートは削除できません"))
+	}
+
+	it, err := s.resolver.file(ctx, cp)
+	if err != nil {
+		return s.wrapErr("purge", dir, err)
+	}
+	return s.wrapErr("purge", dir, s.discard(ctx, cp, *it, true))
+}
+
+// discard は1件を捨てます。
+func (s *Storage) discard(ctx context.Context, p string, it item, recursive bool) error {
+	if err := s.api.deleteItem(ctx, it, recursive); err != nil {
+		return err
+	}
+	// 覚えていた ID を捨てる。消したあとに同じ名前で作り直された場合、
+	// 古い ID を掴んだままだと、ゴミ箱の中のものを操作することになる。
+	s.resolver.forget(p)
+	return nil
+}
+
+// Hash はファイルのハッシュを返します。扱えるのは SHA1 だけです。
+func (s *Storage) Hash(ctx context.Context, p string, ht storage.HashType) (string, error) {
+	if ht != storage.SHA1 {
+		return "", fmt.Errorf("%w: box が扱えるのは %s だけです（%s を要求されました）",
+			storage.ErrUnsupported, storage.SHA1, ht)
+	}
+
+	it, err := s.resolver.file(ctx, p)
+	if err != nil {
+		return "", s.wrapErr("hash", p, err)
+	}
+	if it.isDir() {
+		return "", s.wrapErr("hash", p, storage.ErrIsDir)
+	}
+	if it.SHA1 == "" {
+		return "", s.wrapErr("hash", p, fmt.Errorf(
+			"%w: sha1 が返されませんでした", storage.ErrUnsupported))
+	}
+	return it.SHA1, nil
+}
+
+// ServerSideCopy は内容を転送せずにコピーします。
+func (s *Storage) ServerSideCopy(ctx context.Context, srcPath, dstPath string) (*storage.FileInfo, error) {
+	src, err := s.resolver.file(ctx, srcPath)
+	if err != nil {
+		return nil, s.wrapErr("copy", srcPath, err)
+	}
+	if src.isDir() {
+		return nil, s.wrapErr("copy", srcPath, storage.ErrIsDir)
+	}
+
+	dir, name := path.Dir(cleanPath(dstPath)), path.Base(cleanPath(dstPath))
+	parentID, err := s.resolver.dirIDCreating(ctx, dir)
+	if err != nil {
+		return nil, s.wrapErr("copy", dstPath, err)
+	}
+
+	// すでにあるものはどける。Box は同じ名前へのコピーを断る。
+	if err := s.removeIfExists(ctx, parentID, dir, name, src.ID); err != nil {
+		return nil, s.wrapErr("copy", dstPath, err)
+	}
+
+	copied, err := s.api.copyFile(ctx, src.ID, parentID, name)
+	if err != nil {
+		return nil, s.wrapErr("copy", srcPath, err)
+	}
+
+	fi := toFileInfo(*copied, dir)
+	return &fi, nil
+}
+
+// Move は内容を転送せずに移動・改名します。
+func (s *Storage) Move(ctx context.Context, srcPath, dstPath string) error {
+	src, err := s.resolver.file(ctx, srcPath)
+	if err != nil {
+		return s.wrapErr("move", srcPath, err)
+	}
+
+	dir, name := path.Dir(cleanPath(dstPath)), path.Base(cleanPath(dstPath))
+	parentID, err := s.resolver.dirIDCreating(ctx, dir)
+	if err != nil {
+		return s.wrapErr("move", dstPath, err)
+	}
+
+	// Box の移動は上書きを受け付けない。
+	if err := s.removeIfExists(ctx, parentID, dir, name, src.ID); err != nil {
+		return s.wrapErr("move", dstPath, err)
+	}
+
+	s.resolver.forget(srcPath)
+
+	_, err = s.api.updateItem(ctx, *src, map[string]any{
+		"name":   name,
+		"parent": map[string]string{"id": parentID},
+	})
+	return s.wrapErr("move", srcPath, err)
+}
+
+// removeIfExists は、その場所にすでにあるものを捨てます。
+//
+// keepID と同じものなら捨てません。大文字小文字だけを変える改名では、
+// 移動先として見つかるのが移動元そのものだからです。
+func (s *Storage) removeIfExists(ctx context.Context, parentID, dir, name, keepID string) error {
+	existing, err := s.findChild(ctx, parentID, name)
+	if err != nil || existing == nil || existing.ID == keepID {
+		return err
+	}
+	return s.discard(ctx, path.Join(dir, name), *existing, false)
+}
+
+// toFileInfo は Box の項目を storage.FileInfo にします。
+func toFileInfo(it item, dir string) storage.FileInfo {
+	fi := storage.FileInfo{
+		Path:    path.Join(dir, it.Name),
+		Name:    it.Name,
+		IsDir:   it.isDir(),
+		Size:    it.Size,
+		ModTime: it.modTime(),
+		ID:      it.ID,
+	}
+	if fi.IsDir {
+		// フォルダの size は中身の合計で、フォルダ自体の大きさではない。
+		fi.Size = storage.SizeUnknown
+	}
+	if it.SHA1 != "" {
+		fi.Hashes = map[storage.HashType]string{storage.SHA1: it.SHA1}
+	}
+	return fi
+}
+
+var (
+	_ storage.Storage          = (*Storage)(nil)
+	_ storage.Hasher           = (*Storage)(nil)
+	_ storage.Purger           = (*Storage)(nil)
+	_ storage.Mover            = (*Storage)(nil)
+	_ storage.RangeOpener      = (*Storage)(nil)
+	_ storage.ServerSideCopier = (*Storage)(nil)
+)
@@ -0,0 +1,381 @@
+package box
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mt3hr/hbg/internal/auth"
+	"github.com/mt3hr/hbg/storage"
+	"github.com/mt3hr/hbg/storage/storagetest"
+)
+
+// 適合性テストを偽サーバーに対して実行します。
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Harness{
+		NewStorage: func(t *testing.T) (storage.Storage, string) {
+			f := newFakeBox()
+			s := f.start(t)
+
+			root := "/試験"
+			if err := s.Mkdir(context.Background(), root); err != nil {
+				t.Fatalf("試験用のディレクトリを作れません: %v", err)
+			}
+			return s, root
+		},
+		LargeDirCount: 120,
+	})
+}
+
+func newTestStorage(t *testing.T, mutate ...func(*Config)) (context.Context, *fakeBox, *Storage) {
+	t.Helper()
+	f := newFakeBox()
+	return context.Background(), f, f.start(t, mutate...)
+}
+
+func put(t *testing.T, ctx context.Context, s *Storage, p, content string) *storage.FileInfo {
+	t.Helper()
+	fi, err := s.Put(ctx, p, strings.NewReader(content), storage.ObjectMeta{
+		Size: int64(len(content)),
+	})
+	if err != nil {
+		t.Fatalf("Put(%s): %v", p, err)
+	}
+	return fi
+}
+
+func readAll(t *testing.T, ctx context.Context, s *Storage, p string) string {
+	t.Helper()
+	rc, _, err := s.Open(ctx, p)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", p, err)
+	}
+	defer rc.Close()
+
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll(%s): %v", p, err)
+	}
+	return string(b)
+}
+
+// withUploadCutoff は、分割送信に切り替える大きさを試験のあいだだけ小さくします。
+func withUploadCutoff(t *testing.T, n int64) {
+	t.Helper()
+	old := uploadCutoff
+	uploadCutoff = n
+	t.Cleanup(func() { uploadCutoff = old })
+}
+
+// 大きなファイルが分割送信で書き込まれ、SHA1 が合うことを確かめます。
+func TestLargeUploadUsesSession(t *testing.T) {
+	withUploadCutoff(t, 10)
+	ctx, f, s := newTestStorage(t)
+
+	content := "0123456789abcdefghijklm" // 23バイト。4バイトずつ6つに分かれる。
+	want := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	fi, err := s.Put(ctx, "/大きい.bin", strings.NewReader(content), storage.ObjectMeta{
+		Size:    int64(len(content)),
+		ModTime: want,
+	})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if got := f.callCount("session"); got != 1 {
+		t.Errorf("分割送信の受付 = %d 回, want 1", got)
+	}
+	if got := f.callCount("part"); got != 6 {
+		t.Errorf("送った数 = %d, want 6", got)
+	}
+	if got := f.callCount("upload"); got != 0 {
+		t.Errorf("1回で送る経路を %d 回通った", got)
+	}
+	if got := readAll(t, ctx, s, "/大きい.bin"); got != content {
+		t.Errorf("内容 = %q, want %q", got, content)
+	}
+	if fi.Hashes[storage.SHA1] != fakeSHA1([]byte(content)) {
+		t.Errorf("SHA1 = %q", fi.Hashes[storage.SHA1])
+	}
+	if !fi.ModTime.Equal(want) {
+		t.Errorf("更新時刻 = %v, want %v", fi.ModTime, want)
+	}
+}
+
+// 大きさが分からなくても分割送信できることを確かめます。
+// Box は始めるときに全体の大きさを求めるので、一時ファイルで数えます。
+func TestLargeUploadWithUnknownSize(t *testing.T) {
+	withUploadCutoff(t, 10)
+	ctx, f, s := newTestStorage(t)
+
+	content := strings.Repeat("あ", 20)
+	if _, err := s.Put(ctx, "/不明.txt", strings.NewReader(content), storage.ObjectMeta{
+		Size: storage.SizeUnknown,
+	}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := f.callCount("commit"); got != 1 {
+		t.Errorf("仕上げ = %d 回, want 1", got)
+	}
+	if got := readAll(t, ctx, s, "/不明.txt"); got != content {
+		t.Errorf("内容 = %q, want %q", got, content)
+	}
+}
+
+// 申告より内容が短ければ、書きかけを残さずに失敗することを確かめます。
+func TestLargeUploadSizeMismatchAborts(t *testing.T) {
+	withUploadCutoff(t, 10)
+	ctx, f, s := newTestStorage(t)
+
+	content := "0123456789abcdef"
+	_, err := s.Put(ctx, "/短い.bin", strings.NewReader(content), storage.ObjectMeta{
+		Size: int64(len(content)) + 5,
+	})
+	if err == nil {
+		t.Fatal("申告と食い違うのに成功した")
+	}
+	if got := f.callCount("abort"); got != 1 {
+		t.Errorf("取り消し = %d 回, want 1", got)
+	}
+	f.mu.Lock()
+	left := len(f.sessions)
+	f.mu.Unlock()
+	if left != 0 {
+		t.Errorf("受付が %d 件残っている", left)
+	}
+	if _, err := s.Stat(ctx, "/短い.bin"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("書きかけが見える: %v", err)
+	}
+}
+
+// 仕上げを待たされても、言われたとおり待って送り直すことを確かめます。
+func TestCommitWaitsWhileProcessing(t *testing.T) {
+	withUploadCutoff(t, 10)
+	old := commitWait
+	commitWait = time.Millisecond
+	t.Cleanup(func() { commitWait = old })
+
+	ctx, f, s := newTestStorage(t)
+	f.pendingCommits = 2
+
+	put(t, ctx, s, "/待つ.bin", "0123456789abcdef")
+	if got := f.callCount("commit"); got != 3 {
+		t.Errorf("仕上げ = %d 回, want 3", got)
+	}
+}
+
+// 上書きは新しい版として書かれ、ID が変わらないことを確かめます。
+// 消して作り直すと、共有の設定や以前の版が失われます。
+func TestOverwriteAddsVersion(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+
+	first := put(t, ctx, s, "/版.txt", "一")
+	second := put(t, ctx, s, "/版.txt", "二")
+
+	if first.ID != second.ID {
+		t.Errorf("ID が変わった: %s → %s", first.ID, second.ID)
+	}
+	f.mu.Lock()
+	versions := f.items[second.ID].versions
+	f.mu.Unlock()
+	if versions != 2 {
+		t.Errorf("版の数 = %d, want 2", versions)
+	}
+	if got := readAll(t, ctx, s, "/版.txt"); got != "二" {
+		t.Errorf("内容 = %q", got)
+	}
+
+	// 分割送信でも同じ。
+	withUploadCutoff(t, 2)
+	third := put(t, ctx, s, "/版.txt", "三番目の版")
+	if third.ID != first.ID {
+		t.Errorf("分割送信で ID が変わった: %s → %s", first.ID, third.ID)
+	}
+}
+
+// 一度たどったディレクトリは、たどり直さないことを確かめます。
+func TestResolverCachesDirectories(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+	put(t, ctx, s, "/a/b/c/1.txt", "1")
+
+	f.resetCalls()
+	for range 3 {
+		if _, err := s.Stat(ctx, "/a/b/c/1.txt"); err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+	}
+	// 毎回引くのはファイルそのものだけ。
+	if got := f.callCount("items"); got != 3 {
+		t.Errorf("一覧を %d 回引いた, want 3", got)
+	}
+}
+
+// 消したディレクトリの ID を掴み続けないことを確かめます。
+func TestResolverForgetsRemovedDirectories(t *testing.T) {
+	ctx, _, s := newTestStorage(t)
+	put(t, ctx, s, "/a/b/1.txt", "古い")
+
+	if err := s.Purge(ctx, "/a"); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	if _, err := s.Stat(ctx, "/a/b/1.txt"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("消したのに見える: %v", err)
+	}
+
+	put(t, ctx, s, "/A/b/1.txt", "新しい")
+	if got := readAll(t, ctx, s, "/a/b/1.txt"); got != "新しい" {
+		t.Errorf("内容 = %q", got)
+	}
+}
+
+// 大文字小文字の違いを同じものとして扱うことを確かめます。
+func TestCaseInsensitiveNames(t *testing.T) {
+	ctx, _, s := newTestStorage(t)
+	put(t, ctx, s, "/Docs/Report.txt", "x")
+
+	if got := readAll(t, ctx, s, "/docs/REPORT.txt"); got != "x" {
+		t.Errorf("内容 = %q", got)
+	}
+
+	// 大文字小文字だけを変える改名で、自分自身を消さないこと。
+	if err := s.Move(ctx, "/Docs/Report.txt", "/Docs/report.txt"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	fi, err := s.Stat(ctx, "/Docs/report.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Name != "report.txt" {
+		t.Errorf("名前 = %q, want report.txt", fi.Name)
+	}
+}
+
+// ブックマーク（web_link）は中身を持たないので、一覧に出さないことを確かめます。
+func TestWebLinksAreSkipped(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+	put(t, ctx, s, "/本物.txt", "x")
+	f.addWebLink(rootFolderID, "しおり")
+
+	var names []string
+	if err := s.List(ctx, "/", func(fi storage.FileInfo) error {
+		names = append(names, fi.Name)
+		return nil
+	}); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if !slices.Equal(names, []string{"本物.txt"}) {
+		t.Errorf("一覧 = %v", names)
+	}
+}
+
+// 途中から読めることを確かめます。内容は別の場所へ転送されてから返ります。
+func TestOpenRangeFollowsRedirect(t *testing.T) {
+	ctx, _, s := newTestStorage(t)
+	put(t, ctx, s, "/範囲.txt", "0123456789")
+
+	rc, err := s.OpenRange(ctx, "/範囲.txt", 3, 4)
+	if err != nil {
+		t.Fatalf("OpenRange: %v", err)
+	}
+	defer rc.Close()
+	b, _ := io.ReadAll(rc)
+	if string(b) != "3456" {
+		t.Errorf("内容 = %q, want 3456", b)
+	}
+}
+
+// Box のエラーが storage の分類に直されることを確かめます。
+func TestErrorClassification(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		code     string
+		class    storage.Class
+		sentinel error
+	}{
+		{"要求が多すぎる", http.StatusTooManyRequests, "rate_limit_exceeded", storage.ClassRateLimit, nil},
+		{"認証切れ", http.StatusUnauthorized, "unauthorized", storage.ClassAuth, nil},
+		{"容量切れ", http.StatusForbidden, "storage_limit_exceeded", storage.ClassPermanent, nil},
+		{"名前を押さえられている", http.StatusConflict, "name_temporarily_reserved", storage.ClassRetryable, nil},
+		{"ゴミ箱にある", http.StatusNotFound, "trashed", storage.ClassPermanent, storage.ErrNotFound},
+		{"障害", http.StatusServiceUnavailable, "", storage.ClassRetryable, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, f, s := newTestStorage(t)
+			put(t, ctx, s, "/a.txt", "x")
+
+			f.failNext("items", 1, tt.status, tt.code)
+			_, err := s.Stat(ctx, "/a.txt")
+
+			var opErr *storage.OpError
+			if !errors.As(err, &opErr) {
+				t.Fatalf("OpError でない: %v", err)
+			}
+			if opErr.Class != tt.class {
+				t.Errorf("Class = %v, want %v", opErr.Class, tt.class)
+			}
+			if tt.sentinel != nil && !errors.Is(err, tt.sentinel) {
+				t.Errorf("%v を含んでいない: %v", tt.sentinel, err)
+			}
+			if opErr.RetryAfter != 7*time.Second {
+				t.Errorf("RetryAfter = %v, want 7s", opErr.RetryAfter)
+			}
+		})
+	}
+}
+
+// 空でないフォルダの Remove を Box が断ったとき、ErrNotEmpty になることを確かめます。
+func TestRemoveNonEmptyFolder(t *testing.T) {
+	ctx, _, s := newTestStorage(t)
+	put(t, ctx, s, "/d/1.txt", "x")
+
+	if err := s.Remove(ctx, "/d"); !errors.Is(err, storage.ErrNotEmpty) {
+		t.Errorf("err = %v, want ErrNotEmpty", err)
+	}
+	if got := readAll(t, ctx, s, "/d/1.txt"); got != "x" {
+		t.Errorf("中身が消えた: %q", got)
+	}
+}
+
+// ルートにするフォルダを指定できることを確かめます。
+func TestRootFolderID(t *testing.T) {
+	f := newFakeBox()
+	ctx := context.Background()
+	s := f.start(t)
+	put(t, ctx, s, "/共有/中.txt", "x")
+	sharedID, err := s.resolver.dirID(ctx, "/共有")
+	if err != nil {
+		t.Fatalf("dirID: %v", err)
+	}
+
+	rooted := f.start(t, func(c *Config) { c.RootFolderID = sharedID })
+	if got := readAll(t, ctx, rooted, "/中.txt"); got != "x" {
+		t.Errorf("内容 = %q", got)
+	}
+}
+
+// リダイレクト URI がアプリ登録時の案内と一致していることを確かめます。
+// Dropbox と同じ理由です（外れると認可画面でしか分からない）。
+func TestLoginFlowRedirectMatchesRegisteredURIs(t *testing.T) {
+	flow := loginFlow(auth.BoxOAuth2Config(auth.ClientCredentials{ClientID: "id", ClientSecret: "secret"}), auth.LoginOptions{})
+
+	if flow.RedirectHost != auth.BoxRedirectHost {
+		t.Errorf("RedirectHost = %q, want %q", flow.RedirectHost, auth.BoxRedirectHost)
+	}
+	if len(flow.FixedPorts) == 0 {
+		t.Fatal("ポートを固定していない")
+	}
+	registered := auth.BoxRedirectURIs()
+	for _, port := range flow.FixedPorts {
+		uri := auth.RedirectURI(flow.RedirectHost, port)
+		if !slices.Contains(registered, uri) {
+			t.Errorf("%s を使いうるが、登録案内に載っていない: %v", uri, registered)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package box
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mt3hr/hbg/internal/auth"
+	"golang.org/x/oauth2"
+)
+
+// Config は Box ストレージの設定です。
+type Config struct {
+	// Name は設定ファイルで付けた名前です。コマンドで "名前:パス" として使います。
+	Name string
+	// ClientID と ClientSecret は Box のアプリの識別情報です。
+	// 空の場合は環境変数やビルド時に埋め込まれた値が使われます。
+	ClientID     string
+	ClientSecret string
+
+	// RootFolderID を指定すると、そのフォルダをルートとして扱います。
+	// 空ならすべてのファイルのルート（"0"）です。
+	RootFolderID string
+
+	// httpOverride は試験のために通信の相手を差し替えるためのものです。
+	httpOverride *http.Client
+	// baseOverride と uploadOverride は試験のために入口を差し替えるためのものです。
+	baseOverride   string
+	uploadOverride string
+}
+
+// oauth2Config は設定から oauth2.Config を組み立てます。
+func oauth2Config(cfg Config) (*oauth2.Config, error) {
+	creds, err := auth.ResolveBox(cfg.ClientID, cfg.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	return auth.BoxOAuth2Config(creds), nil
+}
+
+// loginFlow は認可フローを組み立てます。
+//
+// Login から切り出してあるのは、リダイレクト URI の指定が
+// アプリ登録時の値と一致していることをテストから確かめるためです。
+func loginFlow(oauthCfg *oauth2.Config, opts auth.LoginOptions) *auth.Flow {
+	return &auth.Flow{
+		Config: oauthCfg,
+		// Box はシークレットで認可するので PKCE は使わない。
+		// 付けても害はないが、受け付けるとは案内されていない。
+		UsePKCE: false,
+		// Box はリダイレクト URI の完全一致を要求するため、
+		// アプリ登録時に設定したホストとポートを使う。
+		FixedPorts:   auth.BoxRedirectPorts,
+		RedirectHost: auth.BoxRedirectHost,
+		OpenBrowser:  opts.OpenBrowser,
+		Prompt:       opts.Prompt,
+	}
+}
+
+// Login は対話的に認可を行い、トークンを保存します。
+// hbg auth login から呼ばれます。
+func Login(ctx context.Context, cfg Config, opts auth.LoginOptions) error {
+	oauthCfg, err := oauth2Config(cfg)
+	if err != nil {
+		return err
+	}
+
+	tok, err := loginFlow(oauthCfg, opts).Run(ctx)
+	if err != nil {
+		return err
+	}
+	if tok.RefreshToken == "" {
+		// Box は認可のたびに必ずリフレッシュトークンを返す。
+		// 得られない場合、アクセストークンは1時間ほどで失効してしまう。
+		return errors.New("リフレッシュトークンを取得できませんでした。" +
+			"アプリの認証方法が User Authentication (OAuth 2.0) になっているか確認してください")
+	}
+
+	return auth.NewFileStore().Save(Type, cfg.Name, tok)
+}
+
+// newHTTPClient は認証を付ける HTTP のやりとりを用意します。
+func newHTTPClient(ctx context.Context, cfg Config) (*http.Client, error) {
+	if cfg.httpOverride != nil {
+		return cfg.httpOverride, nil
+	}
+
+	oauthCfg, err := oauth2Config(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	store := auth.NewFileStore()
+	tok, err := store.Load(Type, cfg.Name)
+	if err != nil {
+		if errors.Is(err, auth.ErrNoToken) {
+			return nil, fmt.Errorf("box %q は未認証です。hbg auth login %s で認証してください", cfg.Name, cfg.Name)
+		}
+		return nil, err
+	}
+
+	if tok.RefreshToken == "" {
+		return nil, fmt.Errorf("box %q のトークンは更新できません。"+
+			"hbg auth login %s で認証をやり直してください", cfg.Name, cfg.Name)
+	}
+
+	// Box のリフレッシュトークンは使い捨てで、更新のたびに新しいものに
+	// 替わる。書き戻さないと、次の起動では使えないトークンから始めることになる。
+	src := auth.PersistingTokenSource(
+		oauthCfg.TokenSource(ctx, tok), store, Type, cfg.Name, tok)
+
+	return oauth2.NewClient(ctx, explainingTokenSource(src, cfg.Name)), nil
+}
+
+// explainingTokenSource は、トークン更新の失敗に説明を添える TokenSource を返します。
+func explainingTokenSource(src oauth2.TokenSource, name string) oauth2.TokenSource {
+	return &helpfulTokenSource{src: src, name: name}
+}
+
+type helpfulTokenSource struct {
+	src  oauth2.TokenSource
+	name string
+}
+
+func (h *helpfulTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := h.src.Token()
+	if err == nil {
+		return tok, nil
+	}
+
+	// リフレッシュトークンは60日使わないと失効する。しばらく動かして
+	// いなかった環境で踏みやすいので、やり直し方を添える。
+	if strings.Contains(err.Error(), "invalid_grant") {
+		return nil, fmt.Errorf("box %q のトークンが無効になりました: %w\n"+
+			"  Box のリフレッシュトークンは60日使わないと失効します。\n"+
+			"  hbg auth login %s をやり直してください",
+			h.name, err, h.name)
+	}
+	return nil, err
+}
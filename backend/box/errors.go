@@ -0,0 +1,160 @@
+package box
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Box の失敗は、HTTP の状態コードと code の2段で表されます。
+//
+//	400 → 要求の誤り。空でないフォルダの削除（folder_not_empty）もこれ
+//	401 → 認証が通っていない
+//	403 → 権限がない、または容量が足りない（code で見分ける）
+//	404 → 存在しない。ゴミ箱にあるもの（trashed）もこれ
+//	409 → 同じ名前のものがある（item_name_in_use）
+//	429 → 要求が多すぎる（Retry-After 秒待つ）
+//	5xx → 一時的な障害
+
+// wrapErr は Box のエラーを storage のエラーに変換します。
+func (s *Storage) wrapErr(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	v := classify(err)
+	if v.sentinel != nil && !errors.Is(err, v.sentinel) {
+		// 元のエラーも失わないよう、両方を包む。
+		err = fmt.Errorf("%w (%w)", v.sentinel, err)
+	}
+
+	return &storage.OpError{
+		Op:         op,
+		Storage:    s.name,
+		Path:       path,
+		Class:      v.class,
+		RetryAfter: v.retryAfter,
+		Err:        err,
+	}
+}
+
+// verdict は失敗の見立てです。
+type verdict struct {
+	// sentinel は対応する番兵エラーです。該当するものがなければ nil です。
+	sentinel error
+	class    storage.Class
+	// retryAfter はサーバーから指示された待ち時間です。
+	retryAfter time.Duration
+}
+
+// classify はエラーの見立てを求めます。
+func classify(err error) verdict {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return verdict{class: storage.ClassCanceled}
+	case errors.Is(err, storage.ErrNotFound):
+		return verdict{sentinel: storage.ErrNotFound, class: storage.ClassPermanent}
+	case errors.Is(err, storage.ErrNotEmpty), errors.Is(err, storage.ErrNotDir),
+		errors.Is(err, storage.ErrIsDir), errors.Is(err, storage.ErrExist),
+		errors.Is(err, storage.ErrUnsupported):
+		return verdict{class: storage.ClassPermanent}
+	}
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		v := classifyStatus(apiErr.Status, apiErr.Code)
+		v.retryAfter = apiErr.RetryAfter
+		return v
+	}
+
+	// 接続そのものが切れた場合。繋ぎ直せば通ることがある。
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return verdict{class: storage.ClassRetryable}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return verdict{class: storage.ClassRetryable}
+	}
+
+	return verdict{class: storage.ClassUnknown}
+}
+
+// classifyStatus は状態コードと code から判断します。
+func classifyStatus(status int, code string) verdict {
+	// code のほうが具体的なので先に見る。
+	switch code {
+	case "not_found", "trashed", "item_trashed":
+		return verdict{sentinel: storage.ErrNotFound, class: storage.ClassPermanent}
+	case "item_name_in_use":
+		return verdict{sentinel: storage.ErrExist, class: storage.ClassPermanent}
+	case "folder_not_empty":
+		return verdict{sentinel: storage.ErrNotEmpty, class: storage.ClassPermanent}
+	case "name_temporarily_reserved", "operation_blocked_temporary":
+		// 直前の操作が片付くまで、その名前が押さえられている。待てば通る。
+		return verdict{class: storage.ClassRetryable}
+	case "storage_limit_exceeded", "file_size_limit_exceeded":
+		// 容量や1ファイルの上限。待っても直らない。
+		return verdict{class: storage.ClassPermanent}
+	case "rate_limit_exceeded":
+		return verdict{class: storage.ClassRateLimit}
+	case "unauthorized", "access_denied_insufficient_permissions", "access_denied_item_locked":
+		return verdict{class: storage.ClassAuth}
+	}
+
+	switch status {
+	case http.StatusNotFound:
+		return verdict{sentinel: storage.ErrNotFound, class: storage.ClassPermanent}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return verdict{class: storage.ClassAuth}
+	case http.StatusConflict:
+		return verdict{sentinel: storage.ErrExist, class: storage.ClassPermanent}
+	case http.StatusTooManyRequests:
+		return verdict{class: storage.ClassRateLimit}
+	case http.StatusRequestTimeout:
+		return verdict{class: storage.ClassRetryable}
+	}
+
+	switch {
+	case status >= 500 && status <= 599:
+		return verdict{class: storage.ClassRetryable}
+	case status >= 400 && status <= 499:
+		return verdict{class: storage.ClassPermanent}
+	}
+	return verdict{class: storage.ClassUnknown}
+}
+
+// isNotFound はエラーが「存在しない」を表すかを返します。
+func isNotFound(err error) bool {
+	v := classify(err)
+	return v.sentinel != nil && errors.Is(v.sentinel, storage.ErrNotFound)
+}
+
+// isNameInUse は、同じ名前のものがあって断られたかを返します。
+func isNameInUse(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.Code == "item_name_in_use"
+}
+
+// parseRetryAfter は待つよう指示された時間を読み取ります。
+func parseRetryAfter(raw string) time.Duration {
+	if raw == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(raw); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(raw); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
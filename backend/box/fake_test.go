@@ -0,0 +1,666 @@
+package box
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 偽の Box サーバーです。
+//
+// 認証情報なしで、ID の引き当て・続きの取得・分割送信・
+// エラーの分類までを試験できるようにするためのものです。
+//
+// 実物と違って認証は確かめません。確かめたいのは hbg 側の
+// 振る舞いで、トークンの扱いは internal/auth の受け持ちです。
+
+// fakeItem は偽サーバー上の1件です。
+type fakeItem struct {
+	id       string
+	parentID string
+	name     string
+	kind     string
+	data     []byte
+	// contentModified は書き込んだ側が伝えた更新時刻です。
+	contentModified time.Time
+	modified        time.Time
+	// versions は書き込まれた版の数です。
+	versions int
+}
+
+// fakeSession は分割送信の途中経過です。
+type fakeSession struct {
+	folderID string
+	fileID   string
+	name     string
+	size     int64
+	// parts は送られた1つぶんを始まりの位置ごとに持ちます。
+	parts map[int64][]byte
+}
+
+// fakeBox は Box の窓口のごく一部を再現します。
+type fakeBox struct {
+	mu       sync.Mutex
+	items    map[string]*fakeItem
+	sessions map[string]*fakeSession
+	seq      int
+
+	// pageSize は一覧が1回に返す件数です。
+	// 小さくしてあるので、続きの取得を必ず通ります。
+	pageSize int
+	// partSize は分割送信の1つぶんの大きさです。
+	partSize int64
+	// pendingCommits は、仕上げを 202 で待たせる回数です。
+	pendingCommits int
+
+	failures map[string]*fakeFailure
+	calls    map[string]int
+}
+
+type fakeFailure struct {
+	remaining int
+	status    int
+	code      string
+}
+
+func newFakeBox() *fakeBox {
+	f := &fakeBox{
+		items:    map[string]*fakeItem{},
+		sessions: map[string]*fakeSession{},
+		pageSize: 3,
+		partSize: 4,
+		failures: map[string]*fakeFailure{},
+		calls:    map[string]int{},
+	}
+	f.items[rootFolderID] = &fakeItem{id: rootFolderID, kind: typeFolder, name: "All Files"}
+	return f
+}
+
+// start は偽サーバーを立ち上げ、そこへ向いたストレージを返します。
+func (f *fakeBox) start(t *testing.T, mutate ...func(*Config)) *Storage {
+	t.Helper()
+
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	cfg := Config{
+		Name:           "偽box",
+		httpOverride:   srv.Client(),
+		baseOverride:   srv.URL + "/2.0",
+		uploadOverride: srv.URL + "/upload",
+	}
+	for _, m := range mutate {
+		m(&cfg)
+	}
+
+	s, err := New(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("ストレージを作れません: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func (f *fakeBox) failNext(route string, n, status int, code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[route] = &fakeFailure{remaining: n, status: status, code: code}
+}
+
+func (f *fakeBox) callCount(route string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[route]
+}
+
+func (f *fakeBox) resetCalls() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = map[string]int{}
+}
+
+// addWebLink はブックマークを置きます。
+func (f *fakeBox) addWebLink(parentID, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	id := strconv.Itoa(1000 + f.seq)
+	f.items[id] = &fakeItem{id: id, parentID: parentID, name: name, kind: typeWebLink}
+}
+
+func (f *fakeBox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	route, args := routeOf(r)
+	f.calls[route]++
+
+	if fail := f.failures[route]; fail != nil && fail.remaining > 0 {
+		fail.remaining--
+		w.Header().Set("Retry-After", "7")
+		writeBoxError(w, fail.status, fail.code)
+		return
+	}
+
+	switch route {
+	case "items":
+		f.handleItems(w, r, args[0])
+	case "get":
+		f.handleGet(w, args[0], args[1])
+	case "download":
+		// 実物と同じく、中身は別の場所へ転送して返す。
+		w.Header().Set("Location", "/dl/"+args[0])
+		w.WriteHeader(http.StatusFound)
+	case "dl":
+		f.handleDownload(w, r, args[0])
+	case "mkdir":
+		f.handleMkdir(w, r)
+	case "delete":
+		f.handleDelete(w, r, args[0], args[1])
+	case "update":
+		f.handleUpdate(w, r, args[0], args[1])
+	case "copy":
+		f.handleCopy(w, r, args[0])
+	case "upload":
+		f.handleUpload(w, r, args[0])
+	case "session":
+		f.handleSession(w, r, args[0])
+	case "part":
+		f.handlePart(w, r, args[0])
+	case "commit":
+		f.handleCommit(w, r, args[0])
+	case "abort":
+		delete(f.sessions, args[0])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeBoxError(w, http.StatusNotFound, "not_found")
+	}
+}
+
+// routeOf は要求を名前と引数に分けます。
+func routeOf(r *http.Request) (string, []string) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case parts[0] == "dl" && len(parts) == 2:
+		return "dl", parts[1:]
+
+	case parts[0] == "2.0" && len(parts) == 2 && parts[1] == "folders" && r.Method == http.MethodPost:
+		return "mkdir", nil
+	case parts[0] == "2.0" && len(parts) == 4 && parts[1] == "folders" && parts[3] == "items":
+		return "items", parts[2:3]
+	case parts[0] == "2.0" && len(parts) == 4 && parts[1] == "files" && parts[3] == "content":
+		return "download", parts[2:3]
+	case parts[0] == "2.0" && len(parts) == 4 && parts[1] == "files" && parts[3] == "copy":
+		return "copy", parts[2:3]
+	case parts[0] == "2.0" && len(parts) == 3:
+		switch r.Method {
+		case http.MethodGet:
+			return "get", parts[1:3]
+		case http.MethodDelete:
+			return "delete", parts[1:3]
+		case http.MethodPut:
+			return "update", parts[1:3]
+		}
+
+	case parts[0] == "upload" && len(parts) >= 3 && parts[2] == "upload_sessions":
+		// /upload/files/upload_sessions[/{id}[/commit]]
+		switch {
+		case len(parts) == 3:
+			return "session", []string{""}
+		case len(parts) == 5 && parts[4] == "commit":
+			return "commit", parts[3:4]
+		case r.Method == http.MethodPut:
+			return "part", parts[3:4]
+		case r.Method == http.MethodDelete:
+			return "abort", parts[3:4]
+		}
+	case parts[0] == "upload" && len(parts) == 4 && parts[3] == "upload_sessions":
+		// /upload/files/{id}/upload_sessions
+		return "session", parts[2:3]
+	case parts[0] == "upload" && len(parts) == 3 && parts[2] == "content":
+		return "upload", []string{""}
+	case parts[0] == "upload" && len(parts) == 4 && parts[3] == "content":
+		return "upload", parts[2:3]
+	}
+	return "", nil
+}
+
+// --- 応答の組み立て ---
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeBoxError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]any{
+		"type":    "error",
+		"status":  status,
+		"code":    code,
+		"message": code,
+	})
+}
+
+func (it *fakeItem) json() map[string]any {
+	out := map[string]any{
+		"type":        it.kind,
+		"id":          it.id,
+		"name":        it.name,
+		"modified_at": it.modified.UTC().Format(time.RFC3339),
+	}
+	if it.kind == typeFile {
+		out["size"] = len(it.data)
+		out["sha1"] = fakeSHA1(it.data)
+		out["content_modified_at"] = it.contentModified.UTC().Format(time.RFC3339)
+	}
+	return out
+}
+
+func fakeSHA1(b []byte) string {
+	sum := sha1.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// --- 各窓口 ---
+
+// children は親の直下を名前の順に返します。
+func (f *fakeBox) children(parentID string) []*fakeItem {
+	var out []*fakeItem
+	for _, it := range f.items {
+		if it.parentID == parentID && it.id != rootFolderID {
+			out = append(out, it)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+// conflict は同じ親に同じ名前（大文字小文字を区別しない）のものがあるかです。
+func (f *fakeBox) conflict(parentID, name, exceptID string) bool {
+	for _, it := range f.children(parentID) {
+		if it.id != exceptID && strings.EqualFold(it.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeBox) lookup(kind, id string) (*fakeItem, bool) {
+	it, ok := f.items[id]
+	if !ok || it.kind+"s" != kind {
+		return nil, false
+	}
+	return it, true
+}
+
+func (f *fakeBox) handleItems(w http.ResponseWriter, r *http.Request, folderID string) {
+	if _, ok := f.lookup("folders", folderID); !ok {
+		writeBoxError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	if r.URL.Query().Get("usemarker") != "true" {
+		writeBoxError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+
+	all := f.children(folderID)
+	start, _ := strconv.Atoi(r.URL.Query().Get("marker"))
+	end := min(start+f.pageSize, len(all))
+
+	entries := []map[string]any{}
+	for _, it := range all[start:end] {
+		entries = append(entries, it.json())
+	}
+	next := ""
+	if end < len(all) {
+		next = strconv.Itoa(end)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries, "next_marker": next})
+}
+
+func (f *fakeBox) handleGet(w http.ResponseWriter, kind, id string) {
+	it, ok := f.lookup(kind, id)
+	if !ok {
+		writeBoxError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	writeJSON(w, http.StatusOK, it.json())
+}
+
+func (f *fakeBox) handleDownload(w http.ResponseWriter, r *http.Request, id string) {
+	it, ok := f.lookup("files", id)
+	if !ok {
+		writeBoxError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	// Range の解釈は標準の実装に任せる。
+	http.ServeContent(w, r, it.name, it.modified, bytes.NewReader(it.data))
+}
+
+type fakeRequest struct {
+	Name   string `json:"name"`
+	Parent *struct {
+		ID string `json:"id"`
+	} `json:"parent"`
+	ContentModifiedAt string `json:"content_modified_at"`
+}
+
+func (f *fakeBox) handleMkdir(w http.ResponseWriter, r *http.Request) {
+	var in fakeRequest
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Parent == nil {
+		writeBoxError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	if _, ok := f.lookup("folders", in.Parent.ID); !ok {
+		writeBoxError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	if f.conflict(in.Parent.ID, in.Name, "") {
+		writeBoxError(w, http.StatusConflict, "item_name_in_use")
+		return
+	}
+
+	it := f.newItem(in.Parent.ID, in.Name, typeFolder)
+	writeJSON(w, http.StatusCreated, it.json())
+}
+
+func (f *fakeBox) newItem(parentID, name, kind string) *fakeItem {
+	f.seq++
+	it := &fakeItem{
+		id:       strconv.Itoa(1000 + f.seq),
+		parentID: parentID,
+		name:     name,
+		kind:     kind,
+		modified: time.Now(),
+	}
+	f.items[it.id] = it
+	return it
+}
+
+func (f *fakeBox) handleDelete(w http.ResponseWriter, r *http.Request, kind, id string) {
+	it, ok := f.lookup(kind, id)
+	if !ok {
+		writeBoxError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	if it.kind == typeFolder && r.URL.Query().Get("recursive") != "true" && len(f.children(id)) > 0 {
+		writeBoxError(w, http.StatusBadRequest, "folder_not_empty")
+		return
+	}
+	f.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// remove は1件を配下ごと消します。
+func (f *fakeBox) remove(id string) {
+	for _, child := range f.children(id) {
+		f.remove(child.id)
+	}
+	delete(f.items, id)
+}
+
+func (f *fakeBox) handleUpdate(w http.ResponseWriter, r *http.Request, kind, id string) {
+	it, ok := f.lookup(kind, id)
+	if !ok {
+		writeBoxError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	var in fakeRequest
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeBoxError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+
+	parentID, name := it.parentID, it.name
+	if in.Parent != nil {
+		parentID = in.Parent.ID
+	}
+	if in.Name != "" {
+		name = in.Name
+	}
+	if _, ok := f.lookup("folders", parentID); !ok {
+		writeBoxError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	if f.conflict(parentID, name, id) {
+		writeBoxError(w, http.StatusConflict, "item_name_in_use")
+		return
+	}
+
+	it.parentID, it.name, it.modified = parentID, name, time.Now()
+	writeJSON(w, http.StatusOK, it.json())
+}
+
+func (f *fakeBox) handleCopy(w http.ResponseWriter, r *http.Request, id string) {
+	src, ok := f.lookup("files", id)
+	if !ok {
+		writeBoxError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	var in fakeRequest
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Parent == nil {
+		writeBoxError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	name := in.Name
+	if name == "" {
+		name = src.name
+	}
+	if f.conflict(in.Parent.ID, name, "") {
+		writeBoxError(w, http.StatusConflict, "item_name_in_use")
+		return
+	}
+
+	it := f.newItem(in.Parent.ID, name, typeFile)
+	it.data = bytes.Clone(src.data)
+	it.contentModified = src.contentModified
+	it.versions = 1
+	writeJSON(w, http.StatusCreated, it.json())
+}
+
+// handleUpload は1回で送られたものを受け取ります。
+// fileID が空でなければ、そのファイルの新しい版です。
+func (f *fakeBox) handleUpload(w http.ResponseWriter, r *http.Request, fileID string) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeBoxError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	// 実物と同じく、attributes が file より先にないと受け付けない。
+	if len(r.MultipartForm.Value["attributes"]) == 0 || len(r.MultipartForm.File["file"]) == 0 {
+		writeBoxError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	var in fakeRequest
+	if err := json.Unmarshal([]byte(r.MultipartForm.Value["attributes"][0]), &in); err != nil {
+		writeBoxError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	fh, err := r.MultipartForm.File["file"][0].Open()
+	if err != nil {
+		writeBoxError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	data, _ := io.ReadAll(fh)
+	_ = fh.Close()
+
+	if r.Header.Get("Content-MD5") != fakeSHA1(data) {
+		writeBoxError(w, http.StatusPreconditionFailed, "sha1_mismatch")
+		return
+	}
+
+	it, status, code := f.write(fileID, in, data)
+	if it == nil {
+		writeBoxError(w, status, code)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{"total_count": 1, "entries": []any{it.json()}})
+}
+
+// write は新しいファイルか、既存のファイルの新しい版を書きます。
+func (f *fakeBox) write(fileID string, in fakeRequest, data []byte) (*fakeItem, int, string) {
+	var it *fakeItem
+	if fileID != "" {
+		existing, ok := f.lookup("files", fileID)
+		if !ok {
+			return nil, http.StatusNotFound, "not_found"
+		}
+		it = existing
+	} else {
+		if in.Parent == nil {
+			return nil, http.StatusBadRequest, "bad_request"
+		}
+		if _, ok := f.lookup("folders", in.Parent.ID); !ok {
+			return nil, http.StatusNotFound, "not_found"
+		}
+		if f.conflict(in.Parent.ID, in.Name, "") {
+			return nil, http.StatusConflict, "item_name_in_use"
+		}
+		it = f.newItem(in.Parent.ID, in.Name, typeFile)
+	}
+
+	it.data = data
+	it.versions++
+	it.modified = time.Now()
+	it.contentModified = it.modified
+	if in.ContentModifiedAt != "" {
+		t, err := time.Parse(time.RFC3339, in.ContentModifiedAt)
+		if err != nil {
+			return nil, http.StatusBadRequest, "bad_request"
+		}
+		it.contentModified = t
+	}
+	return it, 0, ""
+}
+
+func (f *fakeBox) handleSession(w http.ResponseWriter, r *http.Request, fileID string) {
+	var in struct {
+		FolderID string `json:"folder_id"`
+		FileSize int64  `json:"file_size"`
+		FileName string `json:"file_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeBoxError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+
+	f.seq++
+	id := fmt.Sprintf("S%d", f.seq)
+	f.sessions[id] = &fakeSession{
+		folderID: in.FolderID,
+		fileID:   fileID,
+		name:     in.FileName,
+		size:     in.FileSize,
+		parts:    map[int64][]byte{},
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"id":          id,
+		"part_size":   f.partSize,
+		"total_parts": (in.FileSize + f.partSize - 1) / f.partSize,
+	})
+}
+
+func (f *fakeBox) handlePart(w http.ResponseWriter, r *http.Request, id string) {
+	sess, ok := f.sessions[id]
+	if !ok {
+		writeBoxError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	data, _ := io.ReadAll(r.Body)
+
+	var start, end, total int64
+	if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil ||
+		total != sess.size || end-start+1 != int64(len(data)) {
+		writeBoxError(w, http.StatusRequestedRangeNotSatisfiable, "range_mismatch")
+		return
+	}
+	// 最後の1つを除き、決められた大きさでなければ断る。
+	if start%f.partSize != 0 || (int64(len(data)) != f.partSize && end != total-1) {
+		writeBoxError(w, http.StatusRequestedRangeNotSatisfiable, "range_mismatch")
+		return
+	}
+	sum := sha1.Sum(data)
+	if r.Header.Get("Digest") != "sha="+base64.StdEncoding.EncodeToString(sum[:]) {
+		writeBoxError(w, http.StatusPreconditionFailed, "sha1_mismatch")
+		return
+	}
+
+	sess.parts[start] = data
+	writeJSON(w, http.StatusOK, map[string]any{"part": map[string]any{
+		"part_id": fmt.Sprintf("P%d", start),
+		"offset":  start,
+		"size":    len(data),
+		"sha1":    hex.EncodeToString(sum[:]),
+	}})
+}
+
+func (f *fakeBox) handleCommit(w http.ResponseWriter, r *http.Request, id string) {
+	sess, ok := f.sessions[id]
+	if !ok {
+		writeBoxError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	var in struct {
+		Parts      []uploadedPart `json:"parts"`
+		Attributes struct {
+			ContentModifiedAt string `json:"content_modified_at"`
+		} `json:"attributes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeBoxError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+
+	var data []byte
+	for _, part := range in.Parts {
+		chunk, ok := sess.parts[part.Offset]
+		if !ok || int64(len(data)) != part.Offset {
+			writeBoxError(w, http.StatusBadRequest, "missing_parts")
+			return
+		}
+		data = append(data, chunk...)
+	}
+	if int64(len(data)) != sess.size {
+		writeBoxError(w, http.StatusBadRequest, "missing_parts")
+		return
+	}
+	sum := sha1.Sum(data)
+	if r.Header.Get("Digest") != "sha="+base64.StdEncoding.EncodeToString(sum[:]) {
+		writeBoxError(w, http.StatusPreconditionFailed, "sha1_mismatch")
+		return
+	}
+
+	if f.pendingCommits > 0 {
+		f.pendingCommits--
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	req := fakeRequest{Name: sess.name, ContentModifiedAt: in.Attributes.ContentModifiedAt}
+	if sess.fileID == "" {
+		req.Parent = &struct {
+			ID string `json:"id"`
+		}{ID: sess.folderID}
+	}
+	it, status, code := f.write(sess.fileID, req, data)
+	if it == nil {
+		writeBoxError(w, status, code)
+		return
+	}
+	delete(f.sessions, id)
+	writeJSON(w, http.StatusCreated, map[string]any{"entries": []any{it.json()}})
+}
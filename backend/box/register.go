@@ -0,0 +1,29 @@
+package box
+
+import (
+	"context"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/storage"
+)
+
+func init() {
+	backend.Register(backend.Descriptor{
+		Type:    Type,
+		Summary: "Box",
+		ConfigDoc: `  # - name: box
+  #   type: box
+  #   client_id: ${HBG_BOX_CLIENT_ID}
+  #   client_secret: ${HBG_BOX_CLIENT_SECRET}
+  #   root_folder_id: ルートにするフォルダのID（省略時はすべてのファイル）
+`,
+		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
+			return New(ctx, Config{
+				Name:         name,
+				ClientID:     params.Get("client_id"),
+				ClientSecret: params.Get("client_secret"),
+				RootFolderID: params.Get("root_folder_id"),
+			})
+		},
+	})
+}
@@ -0,0 +1,170 @@
+package box
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Box も Google Drive と同じく、パスの木ではなく ID の網です。
+// "/a/b/c.txt" のような場所の指定は窓口になく、根から1段ずつ
+// 名前で引き当てていく必要があります。
+//
+// Drive と違うのは、名前で絞り込んだ問い合わせができないことです。
+// 検索の窓口はありますが、索引に載るまで数分かかることがあり、
+// 書いた直後のものを見つけられません。そこで1段ごとにフォルダの中身を
+// たどり、見つかった時点で打ち切ります。
+//
+// 1段ぶんの手間が大きいぶん、解決したディレクトリの ID は覚えておきます。
+// 同じ木の中を歩くあいだは、たどり直しません。
+
+// resolver はパスから Box の ID を求めます。
+type resolver struct {
+	s *Storage
+
+	mu sync.RWMutex
+	// dirs は正規化したディレクトリのパスから ID への対応です。
+	// ファイルは覚えません。書き換えられると古い ID を掴むためです。
+	dirs map[string]string
+}
+
+func newResolver(s *Storage) *resolver {
+	return &resolver{
+		s:    s,
+		dirs: map[string]string{"/": s.rootID},
+	}
+}
+
+// dirID はディレクトリの ID を返します。見つからなければ ErrNotFound です。
+func (r *resolver) dirID(ctx context.Context, dir string) (string, error) {
+	return r.walk(ctx, cleanPath(dir), false)
+}
+
+// dirIDCreating はディレクトリの ID を返します。途中の段がなければ作ります。
+func (r *resolver) dirIDCreating(ctx context.Context, dir string) (string, error) {
+	return r.walk(ctx, cleanPath(dir), true)
+}
+
+// walk は根から1段ずつたどります。
+func (r *resolver) walk(ctx context.Context, dir string, create bool) (string, error) {
+	if id, ok := r.cached(dir); ok {
+		return id, nil
+	}
+
+	parent := path.Dir(dir)
+	parentID, err := r.walk(ctx, parent, create)
+	if err != nil {
+		return "", err
+	}
+
+	name := path.Base(dir)
+	found, err := r.s.findChild(ctx, parentID, name)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case found == nil && !create:
+		return "", fmt.Errorf("%w: ディレクトリ %s", storage.ErrNotFound, dir)
+	case found == nil:
+		found, err = r.s.api.createFolder(ctx, parentID, name)
+		if isNameInUse(err) {
+			// 並行して作られた場合に備える。
+			found, err = r.s.findChild(ctx, parentID, name)
+			if err == nil && found == nil {
+				err = errors.New("作ったはずのフォルダが見つかりません")
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+		if !found.isDir() {
+			return "", fmt.Errorf("%w: %s は既にファイルです", storage.ErrExist, dir)
+		}
+	case !found.isDir():
+		return "", fmt.Errorf("%w: %s", storage.ErrNotDir, dir)
+	}
+
+	r.remember(dir, found.ID)
+	return found.ID, nil
+}
+
+func (r *resolver) cached(dir string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id, ok := r.dirs[dir]
+	return id, ok
+}
+
+func (r *resolver) remember(dir, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dirs[dir] = id
+}
+
+// forget は、そのパスと配下の記憶を捨てます。
+// 削除や移動のあとに古い ID を掴まないようにするためのものです。
+//
+// Box は大文字小文字を区別しないので、"/A" を消したら "/a" の記憶も捨てます。
+func (r *resolver) forget(p string) {
+	p = cleanPath(p)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for k := range r.dirs {
+		if k == "/" {
+			continue
+		}
+		if strings.EqualFold(k, p) || hasPrefixFold(k, prefix) {
+			delete(r.dirs, k)
+		}
+	}
+}
+
+// hasPrefixFold は大文字小文字を区別せずに接頭辞を比べます。
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// file はパスに対応するファイル（またはフォルダ）を返します。
+func (r *resolver) file(ctx context.Context, p string) (*item, error) {
+	p = cleanPath(p)
+	if p == "/" {
+		return &item{Type: typeFolder, ID: r.s.rootID, Name: "/"}, nil
+	}
+
+	parentID, err := r.dirID(ctx, path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := r.s.findChild(ctx, parentID, path.Base(p))
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s", storage.ErrNotFound, p)
+	}
+	return found, nil
+}
+
+// cleanPath はパスを正規化します。区切りは "/"、先頭は "/" です。
+//
+// "\\" は区切りとして扱いません。Box のファイル名には使えない文字なので、
+// 区切りに読み替えると、書けないはずの名前が別の場所に書けてしまいます。
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return path.Clean(p)
+}
@@ -0,0 +1,145 @@
+package box
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Box の分割送信（upload session）は、始めるときに全体の大きさを伝え、
+// Box が決めた大きさ（part_size）で区切って送り、最後に全体の SHA1 を
+// 添えて仕上げます。途中で失敗したら受付を取り消します。
+//
+// 全体の大きさが先に要るので、meta.Size が分からないときは
+// いったん一時ファイルに書き出して数えます。分かっているときは
+// そのまま流し、申告と実際が食い違えば失敗させます。
+
+// uploadCutoff は、1回の要求で送りきる大きさの上限です。
+//
+// Box は 50MB までを1回で受け付け、分割送信は 20MB から使えます。
+// 1回で送れるものは、往復の少ない1回で送ります。
+var uploadCutoff int64 = 50 * 1000 * 1000
+
+// readHead は先頭を最大 limit バイト読み、読みきったかどうかを返します。
+//
+// limit ぴったりのファイルを「まだ続きがある」と誤らないよう、
+// 1バイト余分に読んで判断します。
+func readHead(r io.Reader, limit int64) (buf []byte, atEOF bool, err error) {
+	buf = make([]byte, limit+1)
+	n, err := io.ReadFull(r, buf)
+	switch {
+	case err == nil:
+		return buf, false, nil
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return buf[:n], true, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// uploadLarge は分割して送ります。
+func (s *Storage) uploadLarge(
+	ctx context.Context,
+	parentID, existingID, name string,
+	head []byte,
+	rest io.Reader,
+	meta storage.ObjectMeta,
+) (*item, error) {
+	r := io.MultiReader(bytes.NewReader(head), rest)
+	size := meta.Size
+	if size < int64(len(head)) {
+		// 大きさが分からないか、すでに読んだぶんより小さく申告されている。
+		f, n, err := spool(r)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}()
+		r, size = f, n
+	}
+
+	sess, err := s.api.createSession(ctx, parentID, existingID, name, size)
+	if err != nil {
+		return nil, err
+	}
+
+	written, err := s.sendParts(ctx, sess, r, size, meta)
+	if err != nil {
+		// 取り消しは、呼び出し側が止めた場合でも送る。
+		// 送らないと、受付が期限まで残り続ける。
+		s.api.abortSession(context.WithoutCancel(ctx), sess.ID)
+		return nil, err
+	}
+	return written, nil
+}
+
+// sendParts は size バイトを区切って送り、仕上げます。
+func (s *Storage) sendParts(ctx context.Context, sess *uploadSession, r io.Reader, size int64, meta storage.ObjectMeta) (*item, error) {
+	whole := sha1.New()
+	parts := make([]uploadedPart, 0, sess.TotalParts)
+	buf := make([]byte, sess.PartSize)
+
+	for offset := int64(0); offset < size; {
+		chunk := buf[:min(sess.PartSize, size-offset)]
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, fmt.Errorf("内容が申告された大きさ（%d バイト）より短いです", size)
+			}
+			return nil, err
+		}
+		whole.Write(chunk)
+
+		part, err := s.api.uploadPart(ctx, sess.ID, chunk, offset, size)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, *part)
+		offset += int64(len(chunk))
+	}
+
+	// 申告より長くないかを確かめる。黙って切り詰めると、
+	// 中身の欠けたファイルが正しく書けたように見えてしまう。
+	var extra [1]byte
+	switch _, err := io.ReadFull(r, extra[:]); {
+	case err == nil:
+		return nil, fmt.Errorf("内容が申告された大きさ（%d バイト）より長いです", size)
+	case !errors.Is(err, io.EOF):
+		return nil, err
+	}
+
+	return s.api.commitSession(ctx, sess.ID, parts, whole.Sum(nil), meta.ModTime)
+}
+
+// spool は r を一時ファイルに書き出し、先頭に戻したファイルと大きさを返します。
+// 使い終わったら閉じて消してください。
+func spool(r io.Reader) (*os.File, int64, error) {
+	f, err := os.CreateTemp("", "hbg-box-*")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	n, err := io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, 0, err
+	}
+	return f, n, nil
+}
+
+// sha1Sum は内容の SHA1 を返します。
+func sha1Sum(b []byte) []byte {
+	sum := sha1.Sum(b)
+	return sum[:]
+}
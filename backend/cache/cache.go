@@ -0,0 +1,411 @@
+// Package cache は、遅いストレージの上に重ねて、一覧と内容を手元に
+// 控えておくストレージです。
+//
+// 回線越しの SFTP や WebDAV を hbg shell で見て回ると、同じ一覧や同じ
+// ファイルを何度も取りに行くことになります。cache を重ねておけば、
+// 一覧は決めた時間（list_ttl）のあいだ、内容は決めた大きさ（max_size）に
+// 収まるあいだ、手元の控えから返します。控えは $HBG_HOME/caches の下に
+// 置くので、hbg を終えても次の実行で使えます。
+//
+// 内容の控えは、取ってきたときの大きさと更新時刻が一覧と食い違えば
+// 使いません。一覧の控えが古いあいだは、cache を通さずに変えられたことに
+// 気づかないので、list_ttl はそれを許せる長さにしてください。
+// cache を通した書き込み・削除・移動は、関わる控えをその場で捨てます。
+//
+// 控えを使えたか（hit）、取りに行ったか（miss）は、デバッグのログに出します。
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Type はこのバックエンドの種別名です。
+const Type = "cache"
+
+// 既定値。
+const (
+	// DefaultListTTL は一覧の控えを使う時間の既定値です。
+	DefaultListTTL = 5 * time.Minute
+	// DefaultMaxSize は内容の控えの合計の上限の既定値です。
+	DefaultMaxSize int64 = 1 << 30
+)
+
+// Config は cache の設定です。
+type Config struct {
+	// Dir は控えを置くディレクトリです。
+	Dir string
+	// ListTTL は一覧を取ってきてから控えを使う時間です。0 なら DefaultListTTL です。
+	ListTTL time.Duration
+	// MaxSize は内容の控えの合計の上限です。0 なら DefaultMaxSize です。
+	// これより大きなファイルは控えません。
+	MaxSize int64
+}
+
+// Storage は一覧と内容を控えながら、下のストレージを読み書きします。
+type Storage struct {
+	name  string
+	inner storage.Storage
+	ttl   time.Duration
+	store *store
+}
+
+// New は inner の上に重ねる cache を作ります。
+//
+// inner は閉じません。閉じるのは inner を組み立てた側です。
+func New(name string, inner storage.Storage, cfg Config) (*Storage, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("控えを置くディレクトリが指定されていません")
+	}
+	ttl, maxSize := cfg.ListTTL, cfg.MaxSize
+	if ttl == 0 {
+		ttl = DefaultListTTL
+	}
+	if maxSize == 0 {
+		maxSize = DefaultMaxSize
+	}
+	if ttl < 0 || maxSize < 0 {
+		return nil, fmt.Errorf("控えの時間と大きさには正の値を指定してください（%v・%d が指定されました）", ttl, maxSize)
+	}
+	st, err := newStore(cfg.Dir, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{name: name, inner: inner, ttl: ttl, store: st}, nil
+}
+
+// Type はストレージの種別を返します。
+func (s *Storage) Type() string { return Type }
+
+// Name は設定ファイルで付けた名前を返します。
+func (s *Storage) Name() string { return s.name }
+
+// Features は下のストレージのものをそのまま返します。
+// 控えるだけで、置き方は変えないためです。
+func (s *Storage) Features() *storage.Features {
+	f := *s.inner.Features()
+	return &f
+}
+
+// Supports は、下のストレージで使える能力だけを使えると答えます。
+func (s *Storage) Supports(c storage.Capability) bool {
+	switch c {
+	case storage.CapHash, storage.CapRangeOpen, storage.CapMove,
+		storage.CapPurge, storage.CapSetModTime, storage.CapAbout:
+		return storage.Supports(s.inner, c)
+	}
+	return false
+}
+
+// Close は何もしません。下のストレージは組み立てた側が閉じます。
+// 控えはその都度ディスクに書いているので、書き出すものもありません。
+func (s *Storage) Close() error { return nil }
+
+// Permit は下のストレージで op が許されているかを返します。
+// 控えは手元に書きますが、変更は下へ届けるので下の制限に従います。
+func (s *Storage) Permit(op string) error { return storage.Permit(s.inner, op) }
+
+func (s *Storage) wrapErr(op, p string, err error) error {
+	return storage.Wrap(op, s.name, p, storage.ClassOf(err), err)
+}
+
+func (s *Storage) notFound(op, p string) error {
+	return storage.Wrap(op, s.name, p, storage.ClassPermanent, fmt.Errorf("%w: %s", storage.ErrNotFound, p))
+}
+
+// logResult は控えを使えたかをデバッグのログに出します。
+func (s *Storage) logResult(ctx context.Context, op, p string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	slog.LogAttrs(ctx, slog.LevelDebug, "cache",
+		slog.String("result", result),
+		slog.String("storage", s.name),
+		slog.String("op", op),
+		slog.String("path", p),
+	)
+}
+
+// --- 控えを捨てる ---
+
+// invalidate は、p を変えたときに古くなる控えを捨てます。
+//
+// p の内容と一覧に加えて、祖先の一覧もすべて捨てます。親ディレクトリを
+// 暗黙に作るストレージでは、書き込みで祖先の一覧も変わるためです。
+func (s *Storage) invalidate(p string) {
+	s.store.dropContent(p)
+	s.store.dropList(p)
+	for d := p; d != "/"; {
+		d = path.Dir(d)
+		s.store.dropList(d)
+	}
+}
+
+// invalidateTree は、ディレクトリ dir を中身ごと変えたときに古くなる控えを捨てます。
+func (s *Storage) invalidateTree(dir string) {
+	s.invalidate(dir)
+	s.store.dropContentsUnder(dir)
+	s.store.dropAllLists()
+}
+
+// --- 基本の操作 ---
+
+// List は、控えが新しければ控えから、無ければ下のストレージから一覧を返します。
+//
+// 下のストレージの一覧は、最後まで取れたときだけ控えます。fn が途中で
+// やめたときの一覧は、欠けているかもしれないためです。
+func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	dir = storage.CleanPath(dir)
+	if entries, ok := s.store.list(dir, s.ttl); ok {
+		s.logResult(ctx, "list", dir, true)
+		for _, fi := range entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(fi); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	s.logResult(ctx, "list", dir, false)
+	fetched := time.Now()
+	var entries []storage.FileInfo
+	if err := s.inner.List(ctx, dir, func(fi storage.FileInfo) error {
+		entries = append(entries, fi)
+		return fn(fi)
+	}); err != nil {
+		return err
+	}
+	s.store.putList(dir, fetched, entries)
+	return nil
+}
+
+// Stat は、親ディレクトリの一覧の控えが新しければ、そこから返します。
+// 一覧に無ければ、下のストレージに尋ねずに ErrNotFound を返します。
+func (s *Storage) Stat(ctx context.Context, p string) (*storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	if p != "/" {
+		if entries, ok := s.store.list(path.Dir(p), s.ttl); ok {
+			for _, fi := range entries {
+				if fi.Name == path.Base(p) {
+					s.logResult(ctx, "stat", p, true)
+					return &fi, nil
+				}
+			}
+			// 大文字小文字を区別しないストレージでは、名前の書き方が
+			// 一覧と違うだけかもしれないので、無いとは言い切れない。
+			if !s.inner.Features().CaseInsensitive {
+				s.logResult(ctx, "stat", p, true)
+				return nil, s.notFound("stat", p)
+			}
+		}
+	}
+	s.logResult(ctx, "stat", p, false)
+	return s.inner.Stat(ctx, p)
+}
+
+// Open は、内容の控えが使えれば控えから、無ければ下のストレージから読みます。
+//
+// 下のストレージから読んだものは、最後まで読まれたときに控えます。
+func (s *Storage) Open(ctx context.Context, p string) (io.ReadCloser, *storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	info, err := s.Stat(ctx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !info.IsDir {
+		if f, ok := s.store.open(p, info); ok {
+			s.logResult(ctx, "open", p, true)
+			return f, info, nil
+		}
+	}
+
+	s.logResult(ctx, "open", p, false)
+	rc, fi, err := s.inner.Open(ctx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.IsDir || !s.store.fits(fi.Size) {
+		return rc, fi, nil
+	}
+	tmp, err := s.store.newFill()
+	if err != nil {
+		return rc, fi, nil
+	}
+	return &fillReader{rc: rc, store: s.store, path: p, info: *fi, tmp: tmp}, fi, nil
+}
+
+// Put は下のストレージに書き、p に関わる控えを捨てます。
+func (s *Storage) Put(ctx context.Context, p string, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	// 失敗しても途中まで書かれているかもしれないので、いつでも捨てる。
+	defer s.invalidate(p)
+	return s.inner.Put(ctx, p, r, meta)
+}
+
+// Mkdir は下のストレージにディレクトリを作り、祖先の一覧の控えを捨てます。
+func (s *Storage) Mkdir(ctx context.Context, dir string) error {
+	dir = storage.CleanPath(dir)
+	defer s.invalidate(dir)
+	return s.inner.Mkdir(ctx, dir)
+}
+
+// Remove は下のストレージから消し、p に関わる控えを捨てます。
+func (s *Storage) Remove(ctx context.Context, p string) error {
+	p = storage.CleanPath(p)
+	defer s.invalidate(p)
+	return s.inner.Remove(ctx, p)
+}
+
+// --- 下のストレージが持っていれば使える能力 ---
+
+// Hash は下のストレージにハッシュを求めさせます。
+func (s *Storage) Hash(ctx context.Context, p string, ht storage.HashType) (string, error) {
+	p = storage.CleanPath(p)
+	info, err := s.Stat(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	return storage.GetHash(ctx, s.inner, info, ht)
+}
+
+// OpenRange は、内容の控えが使えれば控えから、無ければ下のストレージから
+// 途中から読みます。途中から読んだものは控えません。
+func (s *Storage) OpenRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	p = storage.CleanPath(p)
+	info, err := s.Stat(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir {
+		if f, ok := s.store.open(p, info); ok {
+			s.logResult(ctx, "open", p, true)
+			if length < 0 {
+				length = info.Size - offset
+			}
+			return &rangeFile{Reader: io.NewSectionReader(f, offset, max(length, 0)), f: f}, nil
+		}
+	}
+	s.logResult(ctx, "open", p, false)
+	return storage.OpenRange(ctx, s.inner, p, offset, length)
+}
+
+// Move は下のストレージの中で移動し、移動元と移動先に関わる控えを捨てます。
+func (s *Storage) Move(ctx context.Context, srcPath, dstPath string) error {
+	srcPath, dstPath = storage.CleanPath(srcPath), storage.CleanPath(dstPath)
+	info, err := s.Stat(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if info.IsDir {
+			s.invalidateTree(srcPath)
+			s.invalidateTree(dstPath)
+			return
+		}
+		s.invalidate(srcPath)
+		s.invalidate(dstPath)
+	}()
+	return storage.Move(ctx, s.inner, srcPath, dstPath)
+}
+
+// Purge は下のストレージから中身ごと消し、dir より下の控えを捨てます。
+func (s *Storage) Purge(ctx context.Context, dir string) error {
+	dir = storage.CleanPath(dir)
+	defer s.invalidateTree(dir)
+	return storage.PurgeAll(ctx, s.inner, dir)
+}
+
+// SetModTime は下のストレージで最終更新時刻を変更し、p に関わる控えを捨てます。
+func (s *Storage) SetModTime(ctx context.Context, p string, t time.Time) error {
+	p = storage.CleanPath(p)
+	defer s.invalidate(p)
+	return storage.SetModTime(ctx, s.inner, p, t)
+}
+
+// About は下のストレージの容量を返します。容量は控えません。
+func (s *Storage) About(ctx context.Context, p string) (*storage.Usage, error) {
+	return storage.About(ctx, s.inner, storage.CleanPath(p))
+}
+
+// --- 読みながら控える ---
+
+// fillReader は、下のストレージから読んだものを一時ファイルにも書きます。
+// 最後まで読まれ、大きさが合っていれば、それを内容の控えにします。
+type fillReader struct {
+	rc    io.ReadCloser
+	store *store
+	path  string
+	info  storage.FileInfo
+	// tmp は書いている一時ファイルです。控えるのをやめたら nil にします。
+	tmp *os.File
+	n   int64
+}
+
+func (r *fillReader) Read(b []byte) (int, error) {
+	n, err := r.rc.Read(b)
+	if n > 0 && r.tmp != nil {
+		if _, werr := r.tmp.Write(b[:n]); werr != nil {
+			r.abandon()
+		}
+		r.n += int64(n)
+	}
+	if errors.Is(err, io.EOF) && r.tmp != nil {
+		r.commit()
+	}
+	return n, err
+}
+
+func (r *fillReader) Close() error {
+	if r.tmp != nil {
+		r.abandon()
+	}
+	return r.rc.Close()
+}
+
+func (r *fillReader) commit() {
+	tmp := r.tmp
+	r.tmp = nil
+	if err := tmp.Close(); err != nil || r.n != r.info.Size {
+		_ = os.Remove(tmp.Name())
+		return
+	}
+	r.store.commit(r.path, tmp.Name(), r.n, r.info.ModTime)
+}
+
+func (r *fillReader) abandon() {
+	_ = r.tmp.Close()
+	_ = os.Remove(r.tmp.Name())
+	r.tmp = nil
+}
+
+// rangeFile は内容の控えの一部を読み、閉じたら控えのファイルを閉じます。
+type rangeFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (r *rangeFile) Close() error { return r.f.Close() }
+
+var (
+	_ storage.Storage            = (*Storage)(nil)
+	_ storage.CapabilityReporter = (*Storage)(nil)
+	_ storage.Permitter          = (*Storage)(nil)
+	_ storage.Hasher             = (*Storage)(nil)
+	_ storage.RangeOpener        = (*Storage)(nil)
+	_ storage.Mover              = (*Storage)(nil)
+	_ storage.Purger             = (*Storage)(nil)
+	_ storage.SetModTimer        = (*Storage)(nil)
+	_ storage.Abouter            = (*Storage)(nil)
+)
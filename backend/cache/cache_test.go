@@ -0,0 +1,272 @@
+package cache_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/backend/cache"
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/internal/hbghome"
+	"github.com/mt3hr/hbg/storage"
+	"github.com/mt3hr/hbg/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Harness{
+		NewStorage: func(t *testing.T) (storage.Storage, string) {
+			t.Setenv(hbghome.EnvHome, t.TempDir())
+			r, err := backend.NewResolver([]backend.Entry{
+				{Name: "mem", Type: memory.Type},
+				{Name: "slow", Type: cache.Type, Params: backend.Params{"remote": "mem:/cached", "max_size": "1M"}},
+			})
+			if err != nil {
+				t.Fatalf("NewResolver: %v", err)
+			}
+			t.Cleanup(func() { r.Close() })
+			s, err := r.Get(context.Background(), "slow")
+			if err != nil {
+				t.Fatalf("Get(slow): %v", err)
+			}
+			return s, "/root"
+		},
+	})
+}
+
+// counter は、下のストレージに届いた操作を数えます。
+type counter struct {
+	mu  sync.Mutex
+	ops map[string]int
+}
+
+func (c *counter) count(op string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ops[op]
+}
+
+// newCache は、操作を数えるメモリの上に cache を重ねます。
+func newCache(t *testing.T, dir string, cfg cache.Config) (*cache.Storage, *memory.Storage, *counter) {
+	t.Helper()
+	mem := memory.New("mem")
+	c := &counter{ops: map[string]int{}}
+	mem.SetHooks(memory.Hooks{BeforeOp: func(op, _ string) error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.ops[op]++
+		return nil
+	}})
+	cfg.Dir = dir
+	s, err := cache.New("slow", mem, cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s, mem, c
+}
+
+func put(t *testing.T, s storage.Storage, p, content string) {
+	t.Helper()
+	if _, err := s.Put(context.Background(), p, strings.NewReader(content), storage.ObjectMeta{
+		Size:    int64(len(content)),
+		ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+	}); err != nil {
+		t.Fatalf("Put(%s): %v", p, err)
+	}
+}
+
+func read(t *testing.T, s storage.Storage, p string) string {
+	t.Helper()
+	rc, _, err := s.Open(context.Background(), p)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", p, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll(%s): %v", p, err)
+	}
+	return string(data)
+}
+
+func names(t *testing.T, s storage.Storage, dir string) string {
+	t.Helper()
+	entries, err := storage.ListAllSorted(context.Background(), s, dir)
+	if err != nil {
+		t.Fatalf("List(%s): %v", dir, err)
+	}
+	var out []string
+	for _, e := range entries {
+		out = append(out, e.Name)
+	}
+	return strings.Join(out, " ")
+}
+
+// 一覧の控えがあるあいだは、一覧も Stat も下のストレージに尋ねないことを確認します。
+func TestListCached(t *testing.T) {
+	ctx := context.Background()
+	s, mem, c := newCache(t, t.TempDir(), cache.Config{})
+	put(t, mem, "/dir/a.txt", "a")
+
+	for range 2 {
+		if got := names(t, s, "/dir"); got != "a.txt" {
+			t.Fatalf("一覧 = %q", got)
+		}
+	}
+	if got := c.count("list"); got != 1 {
+		t.Errorf("下のストレージの一覧の回数 = %d, want 1", got)
+	}
+
+	if _, err := s.Stat(ctx, "/dir/a.txt"); err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+	if _, err := s.Stat(ctx, "/dir/none.txt"); !storage.IsNotFound(err) {
+		t.Errorf("無いものの Stat = %v, want ErrNotFound", err)
+	}
+	if got := c.count("stat"); got != 0 {
+		t.Errorf("下のストレージの Stat の回数 = %d, want 0", got)
+	}
+}
+
+// 一覧の控えは、決めた時間を過ぎたら使わないことを確認します。
+func TestListExpires(t *testing.T) {
+	s, mem, c := newCache(t, t.TempDir(), cache.Config{ListTTL: time.Nanosecond})
+	put(t, mem, "/dir/a.txt", "a")
+
+	names(t, s, "/dir")
+	put(t, mem, "/dir/b.txt", "b")
+	if got := names(t, s, "/dir"); got != "a.txt b.txt" {
+		t.Errorf("一覧 = %q", got)
+	}
+	if got := c.count("list"); got != 2 {
+		t.Errorf("下のストレージの一覧の回数 = %d, want 2", got)
+	}
+}
+
+// 内容は、最後まで読んだものだけを控えから返すことを確認します。
+func TestOpenCached(t *testing.T) {
+	s, mem, c := newCache(t, t.TempDir(), cache.Config{})
+	put(t, mem, "/a.txt", "内容")
+
+	// 途中でやめたものは控えない。
+	rc, _, err := s.Open(context.Background(), "/a.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	rc.Close()
+
+	for range 2 {
+		if got := read(t, s, "/a.txt"); got != "内容" {
+			t.Fatalf("内容 = %q", got)
+		}
+	}
+	if got := c.count("open"); got != 2 {
+		t.Errorf("下のストレージから読んだ回数 = %d, want 2", got)
+	}
+
+	rc, err = storage.OpenRange(context.Background(), s, "/a.txt", 3, -1)
+	if err != nil {
+		t.Fatalf("OpenRange: %v", err)
+	}
+	defer rc.Close()
+	if data, _ := io.ReadAll(rc); string(data) != "容" {
+		t.Errorf("途中からの内容 = %q", data)
+	}
+	if got := c.count("open"); got != 2 {
+		t.Errorf("途中から読んだのに下のストレージから読んだ: %d", got)
+	}
+}
+
+// cache を通した変更は、関わる控えをその場で捨てることを確認します。
+func TestInvalidate(t *testing.T) {
+	ctx := context.Background()
+	s, _, _ := newCache(t, t.TempDir(), cache.Config{})
+	put(t, s, "/dir/a.txt", "古い")
+	names(t, s, "/dir")
+	read(t, s, "/dir/a.txt")
+
+	put(t, s, "/dir/a.txt", "新しい内容")
+	if got := read(t, s, "/dir/a.txt"); got != "新しい内容" {
+		t.Errorf("上書きのあとの内容 = %q", got)
+	}
+
+	put(t, s, "/dir/b.txt", "b")
+	if got := names(t, s, "/dir"); got != "a.txt b.txt" {
+		t.Errorf("書いたあとの一覧 = %q", got)
+	}
+
+	if err := storage.Move(ctx, s, "/dir/b.txt", "/dir/c.txt"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if got := names(t, s, "/dir"); got != "a.txt c.txt" {
+		t.Errorf("移動のあとの一覧 = %q", got)
+	}
+
+	if err := s.Remove(ctx, "/dir/a.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if got := names(t, s, "/dir"); got != "c.txt" {
+		t.Errorf("削除のあとの一覧 = %q", got)
+	}
+	if _, _, err := s.Open(ctx, "/dir/a.txt"); !storage.IsNotFound(err) {
+		t.Errorf("消したものを開いたときのエラー = %v, want ErrNotFound", err)
+	}
+
+	names(t, s, "/")
+	if err := storage.PurgeAll(ctx, s, "/dir"); err != nil {
+		t.Fatalf("PurgeAll: %v", err)
+	}
+	if _, err := s.Stat(ctx, "/dir/c.txt"); !storage.IsNotFound(err) {
+		t.Errorf("中身ごと消したものの Stat = %v, want ErrNotFound", err)
+	}
+	if got := names(t, s, "/"); got != "" {
+		t.Errorf("中身ごと消したあとの起点の一覧 = %q", got)
+	}
+}
+
+// 内容の控えが上限を超えたら、最後に使ったのが古いものから捨てることを確認します。
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	s, mem, c := newCache(t, t.TempDir(), cache.Config{MaxSize: 10})
+	put(t, mem, "/a.txt", "aaaa")
+	put(t, mem, "/b.txt", "bbbb")
+	put(t, mem, "/c.txt", "cccc")
+
+	read(t, s, "/a.txt")
+	read(t, s, "/b.txt")
+	read(t, s, "/a.txt") // a を使ったので、次に溢れたら b が捨てられる
+	read(t, s, "/c.txt")
+	opens := c.count("open")
+
+	read(t, s, "/a.txt")
+	if got := c.count("open"); got != opens {
+		t.Errorf("最近使った a が捨てられた")
+	}
+	read(t, s, "/b.txt")
+	if got := c.count("open"); got != opens+1 {
+		t.Errorf("古い b が残っていた")
+	}
+}
+
+// 控えはディスクにあるので、作り直しても使えることを確認します。
+func TestPersists(t *testing.T) {
+	dir := t.TempDir()
+	s, mem, _ := newCache(t, dir, cache.Config{})
+	put(t, mem, "/a.txt", "内容")
+	names(t, s, "/")
+	read(t, s, "/a.txt")
+
+	again, err := cache.New("slow", mem, cache.Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	mem.SetHooks(memory.Hooks{BeforeOp: func(op, p string) error {
+		t.Errorf("下のストレージに %s %s が届いた", op, p)
+		return nil
+	}})
+	if got := read(t, again, "/a.txt"); got != "内容" {
+		t.Errorf("内容 = %q", got)
+	}
+}
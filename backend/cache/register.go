@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/internal/hbghome"
+	"github.com/mt3hr/hbg/storage"
+)
+
+func init() {
+	backend.Register(backend.Descriptor{
+		Type:    Type,
+		Summary: "遅いストレージの上に重ねて、一覧と内容を手元に控える",
+		ConfigDoc: `  # - name: slow
+  #   type: cache
+  #   remote: sftp:/home/me  # 控えるストレージ（設定にあるストレージ名:パス）
+  #   list_ttl: 5m  # 省略可。一覧の控えを使う時間
+  #   max_size: 1G  # 省略可。内容の控えの合計の上限
+`,
+		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
+			remote := params.Get("remote")
+			if remote == "" {
+				return nil, fmt.Errorf("cache %s: remote が設定されていません", name)
+			}
+			var cfg Config
+			if v := params.Get("list_ttl"); v != "" {
+				ttl, err := time.ParseDuration(v)
+				if err != nil || ttl <= 0 {
+					return nil, fmt.Errorf("cache %s: list_ttl は 30s や 5m のように指定してください（%q が指定されました）", name, v)
+				}
+				cfg.ListTTL = ttl
+			}
+			if v := params.Get("max_size"); v != "" {
+				size, err := backend.ParseSize(v)
+				if err != nil || size <= 0 {
+					return nil, fmt.Errorf("cache %s: max_size は 500M や 1G のように指定してください（%q が指定されました）", name, v)
+				}
+				cfg.MaxSize = size
+			}
+
+			// 重ねる先ごとに分ける。remote を書き換えたときに、前の控えを
+			// 取り違えて使わないため。
+			dir, err := hbghome.StorageCacheDir(name + "\n" + remote)
+			if err != nil {
+				return nil, fmt.Errorf("cache %s: %w", name, err)
+			}
+			cfg.Dir = dir
+
+			inner, err := backend.Remote(ctx, remote)
+			if err != nil {
+				return nil, fmt.Errorf("cache %s: %w", name, err)
+			}
+			s, err := New(name, inner, cfg)
+			if err != nil {
+				return nil, fmt.Errorf("cache %s: %w", name, err)
+			}
+			return s, nil
+		},
+	})
+}
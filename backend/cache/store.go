@@ -0,0 +1,285 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mt3hr/hbg/internal/hbghome"
+	"github.com/mt3hr/hbg/storage"
+)
+
+// store は控えをディスクに置きます。
+//
+//	<dir>/
+//	├── lists/<key>.json   ディレクトリの一覧と、取ってきた時刻
+//	└── files/
+//	    ├── <key>          ファイルの内容
+//	    └── <key>.json     内容を取ってきたときの大きさと更新時刻
+//
+// key はパスのハッシュです。パスをそのまま名前に使うと、手元の
+// ファイルシステムで使えない文字や長すぎる名前が混じるためです。
+//
+// 控えの読み書きに失敗しても、呼び出し側には伝えません。控えが
+// 使えないだけで、下のストレージから取ってくれば済むからです。
+type store struct {
+	dir     string
+	maxSize int64
+
+	mu sync.Mutex
+	// contents は内容の控えの一覧です。最初に使うときにディスクから読みます。
+	contents map[string]*content
+	// total は内容の控えの大きさの合計です。
+	total int64
+}
+
+// content は内容の控え1つです。
+type content struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+
+	// used は最後に使った時刻です。内容のファイルの更新時刻に持たせておき、
+	// 溢れたときに古いものから捨てます。
+	used time.Time
+}
+
+// listing は一覧の控え1つです。
+type listing struct {
+	Dir     string             `json:"dir"`
+	Fetched time.Time          `json:"fetched"`
+	Entries []storage.FileInfo `json:"entries"`
+}
+
+func newStore(dir string, maxSize int64) (*store, error) {
+	for _, sub := range []string{"lists", "files"} {
+		if err := hbghome.EnsureDir(filepath.Join(dir, sub)); err != nil {
+			return nil, err
+		}
+	}
+	return &store{dir: dir, maxSize: maxSize}, nil
+}
+
+func keyOf(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (st *store) listFile(dir string) string {
+	return filepath.Join(st.dir, "lists", keyOf(dir)+".json")
+}
+
+func (st *store) dataFile(p string) string {
+	return filepath.Join(st.dir, "files", keyOf(p))
+}
+
+// writeJSON は v を書いてから名前を付け替えます。
+// 書いている途中の控えを、他の hbg が読まないようにするためです。
+func writeJSON(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// --- 一覧 ---
+
+// list は dir の一覧の控えを返します。取ってきてから ttl を過ぎていれば
+// 無いものとします。
+func (st *store) list(dir string, ttl time.Duration) ([]storage.FileInfo, bool) {
+	data, err := os.ReadFile(st.listFile(dir))
+	if err != nil {
+		return nil, false
+	}
+	var l listing
+	// ハッシュが偶然ぶつかったときのために、元のパスも確かめる。
+	if err := json.Unmarshal(data, &l); err != nil || l.Dir != dir {
+		return nil, false
+	}
+	if time.Since(l.Fetched) >= ttl {
+		return nil, false
+	}
+	return l.Entries, true
+}
+
+func (st *store) putList(dir string, fetched time.Time, entries []storage.FileInfo) {
+	_ = writeJSON(st.listFile(dir), listing{Dir: dir, Fetched: fetched, Entries: entries})
+}
+
+func (st *store) dropList(dir string) {
+	_ = os.Remove(st.listFile(dir))
+}
+
+// dropAllLists は一覧の控えをすべて捨てます。
+// 控えの名前はハッシュなので、ある範囲のものだけを選んで捨てられないためです。
+func (st *store) dropAllLists() {
+	names, _ := filepath.Glob(filepath.Join(st.dir, "lists", "*.json"))
+	for _, name := range names {
+		_ = os.Remove(name)
+	}
+}
+
+// --- 内容 ---
+
+// load は内容の控えの一覧を、まだならディスクから読みます。st.mu を持って呼びます。
+func (st *store) load() {
+	if st.contents != nil {
+		return
+	}
+	st.contents = map[string]*content{}
+	names, _ := filepath.Glob(filepath.Join(st.dir, "files", "*.json"))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		var c content
+		if err := json.Unmarshal(data, &c); err != nil {
+			continue
+		}
+		fi, err := os.Stat(strings.TrimSuffix(name, ".json"))
+		if err != nil || fi.Size() != c.Size {
+			// 内容の欠けた控えは使わない。
+			_ = os.Remove(name)
+			continue
+		}
+		c.used = fi.ModTime()
+		st.contents[keyOf(c.Path)] = &c
+		st.total += c.Size
+	}
+}
+
+// open は p の内容の控えを開きます。
+// 控えを取ったときから大きさか更新時刻が変わっていれば、無いものとします。
+func (st *store) open(p string, info *storage.FileInfo) (*os.File, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.load()
+
+	c, ok := st.contents[keyOf(p)]
+	if !ok || c.Path != p {
+		return nil, false
+	}
+	if c.Size != info.Size || !c.ModTime.Equal(info.ModTime) {
+		st.dropLocked(keyOf(p))
+		return nil, false
+	}
+	f, err := os.Open(st.dataFile(p))
+	if err != nil {
+		st.dropLocked(keyOf(p))
+		return nil, false
+	}
+	now := time.Now()
+	c.used = now
+	_ = os.Chtimes(f.Name(), now, now)
+	return f, true
+}
+
+// fits は、大きさ size の内容を控えられるかを返します。
+func (st *store) fits(size int64) bool {
+	return size != storage.SizeUnknown && size <= st.maxSize
+}
+
+// newFill は、内容の控えを書き始めるための一時ファイルを作ります。
+func (st *store) newFill() (*os.File, error) {
+	return os.CreateTemp(filepath.Join(st.dir, "files"), ".tmp-*")
+}
+
+// commit は書き終えた一時ファイル tmp を p の内容の控えにします。
+// 入りきらなくなれば、最後に使ったのが古いものから捨てます。
+func (st *store) commit(p, tmp string, size int64, modTime time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.load()
+
+	key := keyOf(p)
+	st.dropLocked(key)
+	c := &content{Path: p, Size: size, ModTime: modTime, used: time.Now()}
+	if err := os.Rename(tmp, st.dataFile(p)); err != nil {
+		_ = os.Remove(tmp)
+		return
+	}
+	if err := writeJSON(st.dataFile(p)+".json", c); err != nil {
+		_ = os.Remove(st.dataFile(p))
+		return
+	}
+	st.contents[key] = c
+	st.total += size
+	st.evictLocked(key)
+}
+
+// evictLocked は合計が上限に収まるまで、最後に使ったのが古いものから捨てます。
+// keep は書いたばかりのものなので捨てません。
+func (st *store) evictLocked(keep string) {
+	if st.total <= st.maxSize {
+		return
+	}
+	keys := make([]string, 0, len(st.contents))
+	for key := range st.contents {
+		if key != keep {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return st.contents[a].used.Compare(st.contents[b].used)
+	})
+	for _, key := range keys {
+		if st.total <= st.maxSize {
+			return
+		}
+		st.dropLocked(key)
+	}
+}
+
+func (st *store) dropLocked(key string) {
+	data := filepath.Join(st.dir, "files", key)
+	// 控えを先に消す。読んでいる途中で内容を消せない（Windows）ときも、
+	// 控えの無い内容は次から使われない。
+	_ = os.Remove(data + ".json")
+	_ = os.Remove(data)
+	if c, ok := st.contents[key]; ok {
+		st.total -= c.Size
+		delete(st.contents, key)
+	}
+}
+
+// dropContent は p の内容の控えを捨てます。
+func (st *store) dropContent(p string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.load()
+	st.dropLocked(keyOf(p))
+}
+
+// dropContentsUnder は dir より下にあるものの内容の控えを捨てます。
+func (st *store) dropContentsUnder(dir string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.load()
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for key, c := range st.contents {
+		if strings.HasPrefix(c.Path, prefix) {
+			st.dropLocked(key)
+		}
+	}
+}
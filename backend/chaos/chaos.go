@@ -0,0 +1,330 @@
+// Package chaos は、他のストレージの上に重ねて、わざと障害を起こすストレージです。
+//
+// 夜間に回している hbg の処理が、調子の悪いストレージに当たったときに
+// どう振る舞うか（再試行・--retry-pass・--max-errors がどう効くか）を、
+// 本当に障害が起きる前に確かめておくためのものです。テストで使っている
+// memory の Hooks と同じことを、設定ファイルだけで、どのストレージにも
+// 起こせます。
+//
+// 起こせる障害は次のとおりです。どれも規則ごとに、操作・パスのグロブ・
+// 割合で対象を絞ります。
+//
+//   - 種類（storage.Class）を指定した失敗。待ち時間の指示も添えられる
+//   - 操作の前の待ち
+//   - 読み書きする内容の途切れ
+//   - 読み書きする速さの上限
+//
+// 起こした障害は --log debug のログに出ます。
+package chaos
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Type はこのバックエンドの種別名です。
+const Type = "chaos"
+
+// ErrInjected は、chaos が起こした失敗であることを表します。
+// 失敗の種類は、包んでいる OpError の Class で表します。
+var ErrInjected = errors.New("chaos が起こした失敗です")
+
+// Config は chaos の設定です。
+type Config struct {
+	// Rules は起こす障害の規則です。当てはまるものはすべて起こします。
+	Rules []Rule
+	// Seed は割合を決める乱数の種です。0 なら実行ごとに変わります。
+	// 同じ種なら、同じ順の操作に同じ障害が起きます。
+	Seed uint64
+}
+
+// Storage は、下のストレージへの操作に障害を差し込みます。
+type Storage struct {
+	name  string
+	inner storage.Storage
+	rules []Rule
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// New は inner の上に重ねる chaos を作ります。
+//
+// inner は閉じません。閉じるのは inner を組み立てた側です。
+func New(name string, inner storage.Storage, cfg Config) *Storage {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	return &Storage{
+		name:  name,
+		inner: inner,
+		rules: slices.Clone(cfg.Rules),
+		rand:  rand.New(rand.NewPCG(seed, seed)),
+	}
+}
+
+// Type はストレージの種別を返します。
+func (s *Storage) Type() string { return Type }
+
+// Name は設定ファイルで付けた名前を返します。
+func (s *Storage) Name() string { return s.name }
+
+// Features は下のストレージのものをそのまま返します。
+func (s *Storage) Features() *storage.Features { return s.inner.Features() }
+
+// Supports は下のストレージで使えるものを使えると答えます。
+//
+// 続きからの書き込みは使えないと答えます。途切れさせた書き込みを
+// 続きから書き直されると、途切れたことが見えなくなるためです。
+func (s *Storage) Supports(c storage.Capability) bool {
+	switch c {
+	case storage.CapHash, storage.CapServerSideCopy, storage.CapMove, storage.CapRangeOpen,
+		storage.CapPurge, storage.CapSetModTime, storage.CapAbout:
+		return storage.Supports(s.inner, c)
+	}
+	return false
+}
+
+// Close は何もしません。下のストレージは組み立てた側が閉じます。
+func (s *Storage) Close() error { return nil }
+
+// Permit は下のストレージで op が許されているかを返します。
+func (s *Storage) Permit(op string) error { return storage.Permit(s.inner, op) }
+
+func (s *Storage) wrapErr(op, p string, err error) error {
+	return storage.Wrap(op, s.name, p, storage.ClassOf(err), err)
+}
+
+// --- 障害を起こす ---
+
+// stream は、読み書きする内容に起こす障害です。
+type stream struct {
+	truncate  int64
+	bandwidth int64
+}
+
+// inject は、op に当てはまる規則の障害を起こします。
+//
+// 待ちと失敗はここで起こし、内容に起こすものは返します。
+// paths の先頭を、失敗を報告するときのパスにします。
+func (s *Storage) inject(ctx context.Context, op string, paths ...string) (stream, error) {
+	var st stream
+	p := paths[0]
+	for i := range s.rules {
+		r := &s.rules[i]
+		if !r.matches(op, paths) || !s.roll(r.Probability) {
+			continue
+		}
+		if r.Latency > 0 {
+			s.logFault(ctx, op, p, "latency")
+			if err := sleep(ctx, r.Latency); err != nil {
+				return stream{}, s.wrapErr(op, p, err)
+			}
+		}
+		if r.Fail {
+			s.logFault(ctx, op, p, r.Class.String())
+			return stream{}, &storage.OpError{
+				Op:         op,
+				Storage:    s.name,
+				Path:       p,
+				Class:      r.Class,
+				RetryAfter: r.RetryAfter,
+				Err:        ErrInjected,
+			}
+		}
+		if r.Truncate > 0 && (st.truncate == 0 || r.Truncate < st.truncate) {
+			s.logFault(ctx, op, p, "truncate")
+			st.truncate = r.Truncate
+		}
+		if r.Bandwidth > 0 && (st.bandwidth == 0 || r.Bandwidth < st.bandwidth) {
+			s.logFault(ctx, op, p, "bandwidth")
+			st.bandwidth = r.Bandwidth
+		}
+	}
+	return st, nil
+}
+
+// roll は、割合 p で真を返します。
+func (s *Storage) roll(p float64) bool {
+	switch {
+	case p >= 1:
+		return true
+	case p <= 0:
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Float64() < p
+}
+
+// wrap は、読み書きする内容に st の障害を起こします。
+func (s *Storage) wrap(ctx context.Context, st stream, op, p string, r io.Reader) io.Reader {
+	if st.truncate > 0 {
+		r = &truncatedReader{r: r, left: st.truncate, err: s.wrapErr(op, p, io.ErrUnexpectedEOF)}
+	}
+	if st.bandwidth > 0 {
+		r = &throttledReader{ctx: ctx, r: r, rate: st.bandwidth}
+	}
+	return r
+}
+
+// logFault は起こした障害をデバッグのログに出します。
+func (s *Storage) logFault(ctx context.Context, op, p, fault string) {
+	slog.LogAttrs(ctx, slog.LevelDebug, "chaos",
+		slog.String("fault", fault),
+		slog.String("storage", s.name),
+		slog.String("op", op),
+		slog.String("path", p),
+	)
+}
+
+// --- 基本の操作 ---
+
+// List は下のストレージの一覧を返します。
+func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	if _, err := s.inject(ctx, "list", storage.CleanPath(dir)); err != nil {
+		return err
+	}
+	return s.inner.List(ctx, dir, fn)
+}
+
+// Stat は下のストレージのメタデータを返します。
+func (s *Storage) Stat(ctx context.Context, p string) (*storage.FileInfo, error) {
+	if _, err := s.inject(ctx, "stat", storage.CleanPath(p)); err != nil {
+		return nil, err
+	}
+	return s.inner.Stat(ctx, p)
+}
+
+// Open は下のストレージから読みます。
+func (s *Storage) Open(ctx context.Context, p string) (io.ReadCloser, *storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	st, err := s.inject(ctx, "open", p)
+	if err != nil {
+		return nil, nil, err
+	}
+	rc, fi, err := s.inner.Open(ctx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return readCloser{s.wrap(ctx, st, "open", p, rc), rc}, fi, nil
+}
+
+// Put は下のストレージに書きます。
+func (s *Storage) Put(ctx context.Context, p string, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	st, err := s.inject(ctx, "put", p)
+	if err != nil {
+		return nil, err
+	}
+	return s.inner.Put(ctx, p, s.wrap(ctx, st, "put", p, r), meta)
+}
+
+// Mkdir は下のストレージにディレクトリを作ります。
+func (s *Storage) Mkdir(ctx context.Context, dir string) error {
+	if _, err := s.inject(ctx, "mkdir", storage.CleanPath(dir)); err != nil {
+		return err
+	}
+	return s.inner.Mkdir(ctx, dir)
+}
+
+// Remove は下のストレージから消します。
+func (s *Storage) Remove(ctx context.Context, p string) error {
+	if _, err := s.inject(ctx, "remove", storage.CleanPath(p)); err != nil {
+		return err
+	}
+	return s.inner.Remove(ctx, p)
+}
+
+// --- 下のストレージが持っていれば使える能力 ---
+
+// Hash は下のストレージにハッシュを求めさせます。
+func (s *Storage) Hash(ctx context.Context, p string, ht storage.HashType) (string, error) {
+	p = storage.CleanPath(p)
+	if _, err := s.inject(ctx, "hash", p); err != nil {
+		return "", err
+	}
+	return storage.GetHash(ctx, s.inner, &storage.FileInfo{Path: p}, ht)
+}
+
+// ServerSideCopy は下のストレージの中でコピーします。
+func (s *Storage) ServerSideCopy(ctx context.Context, srcPath, dstPath string) (*storage.FileInfo, error) {
+	srcPath, dstPath = storage.CleanPath(srcPath), storage.CleanPath(dstPath)
+	if _, err := s.inject(ctx, "copy", srcPath, dstPath); err != nil {
+		return nil, err
+	}
+	return storage.ServerSideCopy(ctx, s.inner, s.inner, srcPath, dstPath)
+}
+
+// OpenRange は下のストレージから途中から読みます。
+// 障害は Open と同じ規則（op=open）で起こします。
+func (s *Storage) OpenRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	p = storage.CleanPath(p)
+	st, err := s.inject(ctx, "open", p)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := storage.OpenRange(ctx, s.inner, p, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return readCloser{s.wrap(ctx, st, "open", p, rc), rc}, nil
+}
+
+// Move は下のストレージの中で移動します。
+func (s *Storage) Move(ctx context.Context, srcPath, dstPath string) error {
+	srcPath, dstPath = storage.CleanPath(srcPath), storage.CleanPath(dstPath)
+	if _, err := s.inject(ctx, "move", srcPath, dstPath); err != nil {
+		return err
+	}
+	return storage.Move(ctx, s.inner, srcPath, dstPath)
+}
+
+// Purge は下のストレージから中身ごと消します。
+func (s *Storage) Purge(ctx context.Context, dir string) error {
+	dir = storage.CleanPath(dir)
+	if _, err := s.inject(ctx, "purge", dir); err != nil {
+		return err
+	}
+	return storage.PurgeAll(ctx, s.inner, dir)
+}
+
+// SetModTime は下のストレージで最終更新時刻を変更します。
+func (s *Storage) SetModTime(ctx context.Context, p string, t time.Time) error {
+	p = storage.CleanPath(p)
+	if _, err := s.inject(ctx, "setmodtime", p); err != nil {
+		return err
+	}
+	return storage.SetModTime(ctx, s.inner, p, t)
+}
+
+// About は下のストレージの容量を返します。
+func (s *Storage) About(ctx context.Context, p string) (*storage.Usage, error) {
+	p = storage.CleanPath(p)
+	if _, err := s.inject(ctx, "about", p); err != nil {
+		return nil, err
+	}
+	return storage.About(ctx, s.inner, p)
+}
+
+var (
+	_ storage.Storage            = (*Storage)(nil)
+	_ storage.CapabilityReporter = (*Storage)(nil)
+	_ storage.Permitter          = (*Storage)(nil)
+	_ storage.Hasher             = (*Storage)(nil)
+	_ storage.ServerSideCopier   = (*Storage)(nil)
+	_ storage.RangeOpener        = (*Storage)(nil)
+	_ storage.Mover              = (*Storage)(nil)
+	_ storage.Purger             = (*Storage)(nil)
+	_ storage.SetModTimer        = (*Storage)(nil)
+	_ storage.Abouter            = (*Storage)(nil)
+)
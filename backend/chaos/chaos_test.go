@@ -0,0 +1,229 @@
+package chaos_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/backend/chaos"
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/storage"
+	"github.com/mt3hr/hbg/storage/storagetest"
+	"github.com/mt3hr/hbg/transfer"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Harness{
+		NewStorage: func(t *testing.T) (storage.Storage, string) {
+			r, err := backend.NewResolver([]backend.Entry{
+				{Name: "mem", Type: memory.Type},
+				// 障害を起こさない規則だけにしておけば、下と同じに振る舞う。
+				{Name: "flaky", Type: chaos.Type, Params: backend.Params{"remote": "mem:/chaos", "faults": "op=about p=0 error=retryable"}},
+			})
+			if err != nil {
+				t.Fatalf("NewResolver: %v", err)
+			}
+			t.Cleanup(func() { r.Close() })
+			s, err := r.Get(context.Background(), "flaky")
+			if err != nil {
+				t.Fatalf("Get(flaky): %v", err)
+			}
+			return s, "/root"
+		},
+	})
+}
+
+func newChaos(t *testing.T, faults string, seed uint64) (*chaos.Storage, *memory.Storage) {
+	t.Helper()
+	rules, err := chaos.ParseRules(faults)
+	if err != nil {
+		t.Fatalf("ParseRules: %v", err)
+	}
+	mem := memory.New("mem")
+	return chaos.New("flaky", mem, chaos.Config{Rules: rules, Seed: seed}), mem
+}
+
+func put(t *testing.T, s storage.Storage, p, content string) {
+	t.Helper()
+	if _, err := s.Put(context.Background(), p, strings.NewReader(content), storage.ObjectMeta{
+		Size:    int64(len(content)),
+		ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+	}); err != nil {
+		t.Fatalf("Put(%s): %v", p, err)
+	}
+}
+
+// 起こした失敗は、指定した種類と待ち時間を持つことを確認します。
+// 操作とパスで対象を絞れることも確認します。
+func TestInjectError(t *testing.T) {
+	ctx := context.Background()
+	s, mem := newChaos(t, `
+		# 写真の読み込みだけを制限する
+		op=open path=*.jpg error=ratelimit retry_after=30s
+	`, 1)
+	put(t, mem, "/a.jpg", "写真")
+	put(t, mem, "/a.txt", "文書")
+
+	_, _, err := s.Open(ctx, "/a.jpg")
+	if !errors.Is(err, chaos.ErrInjected) {
+		t.Fatalf("Open(a.jpg) = %v, want ErrInjected", err)
+	}
+	if got := storage.ClassOf(err); got != storage.ClassRateLimit {
+		t.Errorf("種類 = %v, want ratelimit", got)
+	}
+	if got := storage.RetryAfterOf(err); got != 30*time.Second {
+		t.Errorf("待ち時間 = %v, want 30s", got)
+	}
+
+	rc, _, err := s.Open(ctx, "/a.txt")
+	if err != nil {
+		t.Fatalf("対象でないパスが失敗した: %v", err)
+	}
+	rc.Close()
+	if _, err := s.Stat(ctx, "/a.jpg"); err != nil {
+		t.Errorf("対象でない操作が失敗した: %v", err)
+	}
+}
+
+// 割合を指定すると一部だけが失敗し、同じ種なら同じものが失敗することを確認します。
+func TestProbability(t *testing.T) {
+	ctx := context.Background()
+	failures := func(seed uint64) string {
+		s, mem := newChaos(t, "op=stat p=0.3 error=retryable", seed)
+		put(t, mem, "/a.txt", "a")
+		var out strings.Builder
+		for range 200 {
+			if _, err := s.Stat(ctx, "/a.txt"); err != nil {
+				out.WriteByte('x')
+			} else {
+				out.WriteByte('.')
+			}
+		}
+		return out.String()
+	}
+
+	got := failures(7)
+	if n := strings.Count(got, "x"); n < 30 || n > 90 {
+		t.Errorf("200回のうち %d 回失敗した、want 60 回前後", n)
+	}
+	if again := failures(7); again != got {
+		t.Errorf("同じ種なのに失敗したものが違う\n%s\n%s", got, again)
+	}
+}
+
+// 内容を途切れさせると、途中まで読んだところで再試行できる失敗になることを確認します。
+func TestTruncate(t *testing.T) {
+	ctx := context.Background()
+	s, mem := newChaos(t, "op=open truncate=4", 1)
+	put(t, mem, "/a.txt", "0123456789")
+
+	rc, _, err := s.Open(ctx, "/a.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if string(data) != "0123" {
+		t.Errorf("読めた内容 = %q, want 0123", data)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !storage.ClassOf(err).Retryable() {
+		t.Errorf("途切れたときのエラー = %v, want 再試行できる ErrUnexpectedEOF", err)
+	}
+
+	// 書き込みでも途切れる。
+	s, _ = newChaos(t, "op=put truncate=4", 1)
+	if _, err := s.Put(ctx, "/b.txt", strings.NewReader("0123456789"), storage.ObjectMeta{Size: 10}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("途切れた書き込み = %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+// 待ちと速さの上限が効くことと、待っているあいだに取り消せることを確認します。
+func TestSlow(t *testing.T) {
+	ctx := context.Background()
+	s, mem := newChaos(t, "op=list latency=50ms\nop=open bandwidth=1K", 1)
+	put(t, mem, "/a.txt", strings.Repeat("a", 200))
+
+	start := time.Now()
+	if _, err := storage.ListAll(ctx, s, "/"); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	rc, _, err := s.Open(ctx, "/a.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	io.Copy(io.Discard, rc)
+	rc.Close()
+	// 待ち 50ms と、200バイトを 1K/秒で読む約 200ms。
+	if got := time.Since(start); got < 200*time.Millisecond {
+		t.Errorf("かかった時間 = %v, want 200ms 以上", got)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := s.List(canceled, "/", func(storage.FileInfo) error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Errorf("取り消したあとの List = %v, want context.Canceled", err)
+	}
+}
+
+// 転送の再試行で、起こした失敗を乗り越えられることを確認します。
+func TestTransferRetries(t *testing.T) {
+	src := memory.New("src")
+	for i := range 20 {
+		put(t, src, fmt.Sprintf("/data/%02d.txt", i), fmt.Sprint(i))
+	}
+	dst, mem := newChaos(t, "op=put p=0.3 error=retryable", 3)
+
+	result, err := transfer.Run(context.Background(), transfer.Options{
+		Src:     src,
+		Dst:     dst,
+		SrcPath: "/data",
+		DstDir:  "/backup",
+		Workers: 2,
+		Compare: transfer.DefaultComparePolicy(),
+		Retry:   transfer.RetryPolicy{MaxAttempts: 10, Wait: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.Transferred != 20 || result.Failed != 0 {
+		t.Errorf("Transferred=%d Failed=%d, want 20 と 0", result.Transferred, result.Failed)
+	}
+	if got := len(mem.Snapshot()); got < 20 {
+		t.Errorf("届いたファイル = %d, want 20", got)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := chaos.ParseRules("op=open,put path=/photos/* p=0.5 error=auth\n\n# コメント\nbandwidth=1M")
+	if err != nil {
+		t.Fatalf("ParseRules: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("規則の数 = %d, want 2", len(rules))
+	}
+	if r := rules[0]; len(r.Ops) != 2 || r.Path != "/photos/*" || r.Probability != 0.5 || !r.Fail || r.Class != storage.ClassAuth {
+		t.Errorf("1つ目 = %+v", r)
+	}
+	if r := rules[1]; r.Ops != nil || r.Probability != 1 || r.Bandwidth != 1<<20 {
+		t.Errorf("2つ目 = %+v", r)
+	}
+
+	for _, bad := range []string{
+		"op=open",               // 起こす障害が無い
+		"op=read error=auth",    // 知らない操作
+		"error=flaky",           // 知らない種類
+		"p=2 error=retryable",   // 割合が範囲外
+		"latency=soon",          // 時間でない
+		"truncate=0",            // 大きさが 0
+		"error=retryable extra", // key=value でない
+	} {
+		if _, err := chaos.ParseRules(bad); err == nil {
+			t.Errorf("ParseRules(%q) がエラーにならなかった", bad)
+		}
+	}
+}
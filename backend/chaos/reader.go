@@ -0,0 +1,78 @@
+package chaos
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// truncatedReader は、left バイト読んだところで err を返します。
+// 接続が途中で切れて、内容が途切れたことを再現します。
+type truncatedReader struct {
+	r    io.Reader
+	left int64
+	err  error
+}
+
+func (t *truncatedReader) Read(b []byte) (int, error) {
+	if t.left <= 0 {
+		return 0, t.err
+	}
+	if int64(len(b)) > t.left {
+		b = b[:t.left]
+	}
+	n, err := t.r.Read(b)
+	t.left -= int64(n)
+	return n, err
+}
+
+// throttledReader は、読む速さを rate バイト/秒に抑えます。
+// 細い回線の向こうにあるストレージを再現します。
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	// 一度に大きく読ませると、そのあとの待ちがまとめて長くなる。
+	// 0.1秒ぶんずつに分けて、なだらかに流す。
+	if chunk := max(t.rate/10, 1); int64(len(b)) > chunk {
+		b = b[:chunk]
+	}
+	n, err := t.r.Read(b)
+	t.n += int64(n)
+	due := t.start.Add(time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second)))
+	if serr := sleep(t.ctx, time.Until(due)); serr != nil && err == nil {
+		err = serr
+	}
+	return n, err
+}
+
+// readCloser は障害を起こす Reader と、下のストレージの Closer をまとめます。
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// sleep は ctx が取り消されたら途中で戻る待機です。
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,52 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/storage"
+)
+
+func init() {
+	backend.Register(backend.Descriptor{
+		Type:    Type,
+		Summary: "他のストレージの上に重ねて、わざと障害を起こす",
+		ConfigDoc: `  # - name: flaky
+  #   type: chaos
+  #   remote: nas:/backup  # 障害を起こすストレージ（設定にあるストレージ名:パス）
+  #   faults: |  # 起こす障害を1行に1つ書く
+  #     op=open,put p=0.1 error=retryable
+  #     op=put path=*.mp4 p=0.05 error=ratelimit retry_after=30s
+  #     op=list latency=2s
+  #     op=open p=0.2 truncate=1M
+  #     bandwidth=512K
+  #   seed: 1  # 省略可。同じ値なら同じ順の操作に同じ障害が起きる
+`,
+		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
+			remote := params.Get("remote")
+			if remote == "" {
+				return nil, fmt.Errorf("chaos %s: remote が設定されていません", name)
+			}
+			rules, err := ParseRules(params.Get("faults"))
+			if err != nil {
+				return nil, fmt.Errorf("chaos %s: %w", name, err)
+			}
+			cfg := Config{Rules: rules}
+			if v := params.Get("seed"); v != "" {
+				seed, err := strconv.ParseUint(v, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("chaos %s: seed は正の整数で指定してください（%q が指定されました）", name, v)
+				}
+				cfg.Seed = seed
+			}
+
+			inner, err := backend.Remote(ctx, remote)
+			if err != nil {
+				return nil, fmt.Errorf("chaos %s: %w", name, err)
+			}
+			return New(name, inner, cfg), nil
+		},
+	})
+}
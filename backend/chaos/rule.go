@@ -0,0 +1,206 @@
+package chaos
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Ops は、規則の op に書ける操作の名前です。
+// 各バックエンドが OpError に入れる名前と揃えています。
+var Ops = []string{
+	"list", "stat", "open", "put", "mkdir", "remove",
+	"hash", "copy", "move", "purge", "setmodtime", "about",
+}
+
+// Rule は、どの操作にどんな障害をどのくらいの割合で起こすかの規則1つです。
+type Rule struct {
+	// Ops は対象の操作です。空ならすべての操作です。
+	Ops []string
+	// Path は対象のパスのグロブです（path.Match の書き方）。空ならすべてです。
+	// "/" を含まなければ、ファイル名だけと照らし合わせます。
+	Path string
+	// Probability は起こす割合です（0〜1）。
+	Probability float64
+
+	// Latency は、操作の前に待たせる時間です。
+	Latency time.Duration
+	// Fail が真なら、操作を Class の失敗にします。
+	Fail  bool
+	Class storage.Class
+	// RetryAfter は、失敗に添えるサーバーからの待ち時間の指示です。
+	RetryAfter time.Duration
+	// Truncate は、読み書きする内容をこのバイト数で途切れさせます。0 なら途切れさせません。
+	Truncate int64
+	// Bandwidth は、読み書きする速さの上限（バイト/秒）です。0 なら上限を設けません。
+	Bandwidth int64
+}
+
+// matches は、規則が op と paths のどれかに当てはまるかを返します。
+// 移動やコピーでは、元と先のどちらかが当てはまれば対象とします。
+func (r *Rule) matches(op string, paths []string) bool {
+	if len(r.Ops) > 0 && !slices.Contains(r.Ops, op) {
+		return false
+	}
+	if r.Path == "" {
+		return true
+	}
+	for _, p := range paths {
+		name := p
+		if !strings.Contains(r.Path, "/") {
+			name = path.Base(p)
+		}
+		if ok, _ := path.Match(r.Path, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRules は、1行に1つ書いた規則を読みます。
+//
+// 各行は key=value を空白で区切って並べます。空行と # で始まる行は読み飛ばします。
+//
+//	op=open,put path=/photos/* p=0.1 error=retryable
+//	op=put p=0.05 error=ratelimit retry_after=30s
+//	op=list latency=2s
+//	op=open truncate=1M
+//	bandwidth=512K
+//
+// p を省略すると、当てはまる操作のすべてで起こします。
+func ParseRules(text string) ([]Rule, error) {
+	var rules []Rule
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("faults の %d行目: %w", i+1, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func parseRule(line string) (Rule, error) {
+	r := Rule{Probability: 1}
+	effect := false
+	for _, field := range strings.Fields(line) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return Rule{}, fmt.Errorf("%q は key=value の形で書いてください", field)
+		}
+		switch key {
+		case "op":
+			for _, op := range strings.Split(value, ",") {
+				if op == "*" {
+					r.Ops = nil
+					break
+				}
+				if !slices.Contains(Ops, op) {
+					return Rule{}, fmt.Errorf("知らない操作です: %q（使えるのは %s）", op, strings.Join(Ops, ", "))
+				}
+				r.Ops = append(r.Ops, op)
+			}
+		case "path":
+			if _, err := path.Match(value, ""); err != nil {
+				return Rule{}, fmt.Errorf("path のグロブが不正です: %q", value)
+			}
+			r.Path = value
+		case "p":
+			p, err := strconv.ParseFloat(value, 64)
+			if err != nil || p < 0 || p > 1 {
+				return Rule{}, fmt.Errorf("p は 0 から 1 の数で指定してください（%q が指定されました）", value)
+			}
+			r.Probability = p
+		case "error":
+			class, ok := parseClass(value)
+			if !ok {
+				return Rule{}, fmt.Errorf("知らない失敗の種類です: %q（使えるのは %s）", value, strings.Join(classNames(), ", "))
+			}
+			r.Fail, r.Class = true, class
+			effect = true
+		case "retry_after":
+			d, err := parseDuration(key, value)
+			if err != nil {
+				return Rule{}, err
+			}
+			r.RetryAfter = d
+		case "latency":
+			d, err := parseDuration(key, value)
+			if err != nil {
+				return Rule{}, err
+			}
+			r.Latency = d
+			effect = true
+		case "truncate":
+			n, err := backend.ParseSize(value)
+			if err != nil || n <= 0 {
+				return Rule{}, fmt.Errorf("truncate は 100K や 1M のように指定してください（%q が指定されました）", value)
+			}
+			r.Truncate = n
+			effect = true
+		case "bandwidth":
+			n, err := backend.ParseSize(value)
+			if err != nil || n <= 0 {
+				return Rule{}, fmt.Errorf("bandwidth は 1秒あたりの大きさを 512K や 10M のように指定してください（%q が指定されました）", value)
+			}
+			r.Bandwidth = n
+			effect = true
+		default:
+			return Rule{}, fmt.Errorf("知らない項目です: %q", key)
+		}
+	}
+	if r.RetryAfter > 0 && !r.Fail {
+		// 待ち時間の指示は、要求の制限に添えて返ってくるもの。
+		r.Fail, r.Class = true, storage.ClassRateLimit
+		effect = true
+	}
+	if !effect {
+		return Rule{}, fmt.Errorf("起こす障害（error・latency・truncate・bandwidth のどれか）がありません")
+	}
+	return r, nil
+}
+
+func parseDuration(key, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s は 500ms や 30s のように指定してください（%q が指定されました）", key, value)
+	}
+	return d, nil
+}
+
+// classes は error に書ける失敗の種類です。
+var classes = []storage.Class{
+	storage.ClassUnknown,
+	storage.ClassPermanent,
+	storage.ClassRetryable,
+	storage.ClassRateLimit,
+	storage.ClassAuth,
+	storage.ClassCanceled,
+}
+
+func parseClass(name string) (storage.Class, bool) {
+	for _, c := range classes {
+		if c.String() == name {
+			return c, true
+		}
+	}
+	return storage.ClassUnknown, false
+}
+
+func classNames() []string {
+	out := make([]string, 0, len(classes))
+	for _, c := range classes {
+		out = append(out, c.String())
+	}
+	return out
+}
@@ -0,0 +1,618 @@
+// Package chunker は、他のストレージの上に重ねて、大きなファイルを
+// 決まった大きさの断片に分けて置くストレージです。
+//
+// 1ファイルの大きさに上限のあるストレージ（Dropbox の 350GiB、
+// 4GiB までしか受け付けない FTP や WebDAV のサーバーなど）にも、
+// 上限を超えるファイルを置けるようにします。断片は一覧に出さず、
+// 読むときにつなげて返すので、呼び出し側からは1つのファイルに見えます。
+//
+// 断片の大きさに収まるファイルは分けずにそのまま置きます。
+// 置き方は meta.go を見てください。
+package chunker
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Type はこのバックエンドの種別名です。
+const Type = "chunker"
+
+// defaultChunkSize は、設定にも下のストレージの上限にもよらないときの
+// 断片の大きさです。4GiB で断るサーバーに収まる大きさにしています。
+const defaultChunkSize int64 = 2 << 30
+
+// Config は chunker の設定です。
+type Config struct {
+	// ChunkSize は断片の大きさです。0 なら下のストレージの上限
+	// （無ければ 2GiB）を使います。
+	ChunkSize int64
+}
+
+// Storage は大きなファイルを分けて、下のストレージに置きます。
+type Storage struct {
+	name      string
+	inner     storage.Storage
+	chunkSize int64
+	// hashes は分けたファイルの目録に書くハッシュの種類です。
+	// 分けていないファイルと同じものが得られるよう、下のストレージの
+	// 種類のうち手元で計算できるものにしています。
+	hashes storage.HashSet
+}
+
+// New は inner の上に重ねる chunker を作ります。
+//
+// inner は閉じません。閉じるのは inner を組み立てた側です。
+func New(name string, inner storage.Storage, cfg Config) (*Storage, error) {
+	in := inner.Features()
+	size := cfg.ChunkSize
+	if size == 0 {
+		size = defaultChunkSize
+		if in.MaxFileSize > 0 {
+			size = min(size, in.MaxFileSize)
+		}
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("断片の大きさは 1 バイト以上にしてください（%d が指定されました）", size)
+	}
+	if in.MaxFileSize > 0 && size > in.MaxFileSize {
+		return nil, fmt.Errorf("断片の大きさ %d が、下のストレージの上限 %d を超えています", size, in.MaxFileSize)
+	}
+
+	s := &Storage{name: name, inner: inner, chunkSize: size}
+	for _, ht := range in.Hashes {
+		if _, err := storage.NewHash(ht); err == nil {
+			s.hashes = append(s.hashes, ht)
+		}
+	}
+	return s, nil
+}
+
+// Type はストレージの種別を返します。
+func (s *Storage) Type() string { return Type }
+
+// Name は設定ファイルで付けた名前を返します。
+func (s *Storage) Name() string { return s.name }
+
+// Features はこのストレージにできることを返します。
+//
+// 1ファイルの上限は無くなります。それ以外は下のストレージのとおりです。
+// 書き込みは、目録を置いてから元の名前のファイルを消したところで
+// 切り替わるので、下のストレージが不可分に書ければ途中経過は見えません。
+func (s *Storage) Features() *storage.Features {
+	in := s.inner.Features()
+	return &storage.Features{
+		ModTimePrecision: in.ModTimePrecision,
+		CanSetModTime:    in.CanSetModTime,
+		CaseInsensitive:  in.CaseInsensitive,
+		Hashes:           s.hashes,
+		ImplicitDirs:     in.ImplicitDirs,
+		EmptyDirs:        in.EmptyDirs,
+		AtomicPut:        in.AtomicPut,
+		IllegalChars:     in.IllegalChars,
+	}
+}
+
+// Supports は、下のストレージで使える能力だけを使えると答えます。
+// ハッシュと範囲読み出しは、下にできなければ読んで肩代わりします。
+func (s *Storage) Supports(c storage.Capability) bool {
+	switch c {
+	case storage.CapHash, storage.CapRangeOpen:
+		return true
+	}
+	return storage.Supports(s.inner, c)
+}
+
+// Close は何もしません。下のストレージは組み立てた側が閉じます。
+func (s *Storage) Close() error { return nil }
+
+// Permit は下のストレージで op が許されているかを返します。
+// 断片を書くのも古い断片を消すのも下なので、下の制限がそのまま効きます。
+func (s *Storage) Permit(op string) error { return storage.Permit(s.inner, op) }
+
+func (s *Storage) wrapErr(op, p string, err error) error {
+	return storage.Wrap(op, s.name, p, storage.ClassOf(err), err)
+}
+
+func (s *Storage) notFound(op, p string) error {
+	return storage.Wrap(op, s.name, p, storage.ClassPermanent, fmt.Errorf("%w: %s", storage.ErrNotFound, p))
+}
+
+// --- 1件を引く ---
+
+// object は、元のパスにあるものです。whole と split のどちらかが入ります。
+type object struct {
+	// whole は分けずに置いたもの（ディレクトリを含む）です。
+	whole *storage.FileInfo
+	// split は分けて置いたものの目録で、splitInfo は目録そのもののメタデータです。
+	split     *manifest
+	splitInfo *storage.FileInfo
+}
+
+// lookup は p にあるものを引きます。
+//
+// 元の名前のものがあればそれを先に使います。分けて置き直すときは
+// 目録を置いてから元の名前のものを消すので、消すまでは古い内容が見えます。
+func (s *Storage) lookup(ctx context.Context, op, p string) (*object, error) {
+	if reserved(path.Base(p)) {
+		return nil, s.notFound(op, p)
+	}
+	fi, err := s.inner.Stat(ctx, p)
+	if err == nil {
+		return &object{whole: fi}, nil
+	}
+	if !storage.IsNotFound(err) {
+		return nil, err
+	}
+	m, mfi, merr := s.readManifest(ctx, p)
+	if merr != nil {
+		if storage.IsNotFound(merr) {
+			return nil, err
+		}
+		return nil, merr
+	}
+	return &object{split: m, splitInfo: mfi}, nil
+}
+
+// oldSplit は p に残っている目録を返します。無ければ nil です。
+func (s *Storage) oldSplit(ctx context.Context, p string) (*manifest, error) {
+	m, _, err := s.readManifest(ctx, p)
+	if storage.IsNotFound(err) {
+		return nil, nil
+	}
+	return m, err
+}
+
+// info は o を元の側のメタデータに直します。
+func (o *object) info(p string) *storage.FileInfo {
+	if o.whole != nil {
+		out := *o.whole
+		out.Path = p
+		out.Name = path.Base(p)
+		return &out
+	}
+	return &storage.FileInfo{
+		Path:    p,
+		Name:    path.Base(p),
+		Size:    o.split.Size,
+		ModTime: o.splitInfo.ModTime,
+		Hashes:  o.split.Hashes,
+		ID:      o.splitInfo.ID,
+	}
+}
+
+// --- Storage ---
+
+// List は dir の直下にあるものを fn に渡します。
+//
+// 断片は渡しません。分けたファイルは目録を読んで、元の大きさで渡します。
+func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	dir = storage.CleanPath(dir)
+	seen := map[string]bool{}
+	return s.inner.List(ctx, dir, func(fi storage.FileInfo) error {
+		return s.listed(ctx, fi, seen, fn)
+	})
+}
+
+// ListRecursive は dir の配下をまとめて一覧します。
+// ディレクトリの名前は変えないので、届いた順にそのまま渡せます。
+func (s *Storage) ListRecursive(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	dir = storage.CleanPath(dir)
+	seen := map[string]bool{}
+	return storage.ListRecursive(ctx, s.inner, dir, func(fi storage.FileInfo) error {
+		return s.listed(ctx, fi, seen, fn)
+	})
+}
+
+// listed は一覧で届いた1件を元の側に直して fn に渡します。
+//
+// 置き直しの途中では、元の名前のものと目録が両方あることがあります。
+// 同じ名前を2度渡さないよう、渡したパスを seen に覚えておきます。
+func (s *Storage) listed(ctx context.Context, fi storage.FileInfo, seen map[string]bool, fn func(storage.FileInfo) error) error {
+	if fi.IsDir {
+		return fn(fi)
+	}
+	if isChunk(fi.Name) {
+		return nil
+	}
+	if p, ok := strings.CutSuffix(fi.Path, manifestExt); ok {
+		if seen[p] {
+			return nil
+		}
+		m, mfi, err := s.readManifest(ctx, p)
+		if storage.IsNotFound(err) {
+			// 一覧のあとで消された。
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		seen[p] = true
+		return fn(*(&object{split: m, splitInfo: mfi}).info(p))
+	}
+	if seen[fi.Path] {
+		return nil
+	}
+	seen[fi.Path] = true
+	return fn(fi)
+}
+
+// Stat は1件のメタデータを返します。
+func (s *Storage) Stat(ctx context.Context, p string) (*storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	o, err := s.lookup(ctx, "stat", p)
+	if err != nil {
+		return nil, err
+	}
+	return o.info(p), nil
+}
+
+// Open は内容を読む ReadCloser を返します。分けたものは断片をつなげて読みます。
+func (s *Storage) Open(ctx context.Context, p string) (io.ReadCloser, *storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	o, err := s.lookup(ctx, "open", p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if o.whole != nil {
+		rc, fi, err := s.inner.Open(ctx, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		return rc, (&object{whole: fi}).info(p), nil
+	}
+	return s.newChunkReader(ctx, p, o.split, 0), o.info(p), nil
+}
+
+// OpenRange は offset から length バイトを読みます。length が負なら末尾までです。
+//
+// 分けたものは offset を含む断片から読みます。下のストレージが範囲読み出し
+// できなければ、その断片だけを頭から読み捨てます。
+func (s *Storage) OpenRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	p = storage.CleanPath(p)
+	o, err := s.lookup(ctx, "open", p)
+	if err != nil {
+		return nil, err
+	}
+
+	var rc io.ReadCloser
+	if o.whole != nil {
+		rc, err = s.openAt(ctx, p, offset)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if offset >= o.split.Size {
+			return io.NopCloser(strings.NewReader("")), nil
+		}
+		rc = s.newChunkReader(ctx, p, o.split, offset)
+	}
+	if length >= 0 {
+		rc = readCloser{io.LimitReader(rc, length), rc}
+	}
+	return rc, nil
+}
+
+// openAt は下のストレージの p を offset から読みます。
+func (s *Storage) openAt(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	if offset > 0 && storage.Supports(s.inner, storage.CapRangeOpen) {
+		return storage.OpenRange(ctx, s.inner, p, offset, -1)
+	}
+	rc, _, err := s.inner.Open(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := io.CopyN(io.Discard, rc, offset); err != nil {
+			rc.Close()
+			if errors.Is(err, io.EOF) {
+				// 末尾より先から読むときは、空を返す。
+				return io.NopCloser(strings.NewReader("")), nil
+			}
+			return nil, s.wrapErr("open", p, err)
+		}
+	}
+	return rc, nil
+}
+
+// Put は p に書き込みます。
+//
+// 大きさが分かっていて断片に収まるなら、分けずにそのまま置きます。
+// それ以外は断片に分けて書き、最後に目録を置きます。大きさが分からず、
+// 書いてみたら1つの断片に収まったときは、元の名前へ移します。
+func (s *Storage) Put(ctx context.Context, p string, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	if reserved(path.Base(p)) {
+		return nil, s.wrapErr("put", p, fmt.Errorf("%w: %s や %s を含む名前は chunker が使うため置けません",
+			storage.ErrUnsupported, manifestExt, chunkMark))
+	}
+	old, err := s.oldSplit(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.Size >= 0 && meta.Size <= s.chunkSize {
+		fi, err := s.inner.Put(ctx, p, r, meta)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.removeSplit(ctx, p, old); err != nil {
+			return nil, err
+		}
+		return fi, nil
+	}
+
+	m, err := s.putChunks(ctx, p, r, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Chunks == 1 {
+		if err := storage.Move(ctx, s.inner, m.chunkPath(p, 0), p); err != nil {
+			s.removeChunks(context.WithoutCancel(ctx), p, m)
+			return nil, err
+		}
+		if err := s.removeSplit(ctx, p, old); err != nil {
+			return nil, err
+		}
+		return s.inner.Stat(ctx, p)
+	}
+
+	mfi, err := s.writeManifest(ctx, p, m, meta.ModTime)
+	if err != nil {
+		s.removeChunks(context.WithoutCancel(ctx), p, m)
+		return nil, err
+	}
+	// 元の名前のものを消したところで、新しい内容に切り替わる。
+	if err := s.inner.Remove(ctx, p); err != nil && !storage.IsNotFound(err) {
+		return nil, err
+	}
+	if old != nil && old.ID != m.ID {
+		if err := s.removeChunks(ctx, p, old); err != nil {
+			return nil, err
+		}
+	}
+	return (&object{split: m, splitInfo: mfi}).info(p), nil
+}
+
+// putChunks は r を断片に分けて書き、目録にする中身を返します。
+// 失敗したら、書いた断片を消します。
+func (s *Storage) putChunks(ctx context.Context, p string, r io.Reader, meta storage.ObjectMeta) (*manifest, error) {
+	hw, sum, err := storage.MultiHasher(s.hashes...)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(io.TeeReader(r, hw))
+	m := &manifest{ChunkSize: s.chunkSize, ID: newID()}
+
+	// fail は、書いた（書きかけを含む）written 個の断片を消します。
+	fail := func(written int, err error) (*manifest, error) {
+		m.Chunks = written
+		s.removeChunks(context.WithoutCancel(ctx), p, m)
+		return nil, err
+	}
+
+	for {
+		size := storage.SizeUnknown
+		if meta.Size >= 0 {
+			size = max(min(s.chunkSize, meta.Size-m.Size), 0)
+		}
+		cr := &countingReader{r: io.LimitReader(br, s.chunkSize)}
+		if _, err := s.inner.Put(ctx, m.chunkPath(p, m.Chunks), cr, storage.ObjectMeta{
+			Size:    size,
+			ModTime: meta.ModTime,
+		}); err != nil {
+			return fail(m.Chunks+1, err)
+		}
+		m.Chunks++
+		m.Size += cr.n
+		if cr.n < s.chunkSize {
+			break
+		}
+		if _, err := br.Peek(1); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fail(m.Chunks, s.wrapErr("put", p, err))
+		}
+	}
+	m.Hashes = sum()
+	return m, nil
+}
+
+// Mkdir はディレクトリを作ります。
+func (s *Storage) Mkdir(ctx context.Context, dir string) error {
+	return s.inner.Mkdir(ctx, dir)
+}
+
+// Remove は1つのファイル、または空のディレクトリを削除します。
+func (s *Storage) Remove(ctx context.Context, p string) error {
+	p = storage.CleanPath(p)
+	o, err := s.lookup(ctx, "remove", p)
+	if err != nil {
+		return err
+	}
+	if o.whole != nil {
+		return s.inner.Remove(ctx, p)
+	}
+	return s.removeSplit(ctx, p, o.split)
+}
+
+// --- 下のストレージが持っていれば使える能力 ---
+
+// Hash は元の内容のハッシュを返します。
+//
+// 分けていないものは下のストレージから得ます。分けたものは目録から
+// 返します。どちらにも無ければ内容を読んで求めます。
+func (s *Storage) Hash(ctx context.Context, p string, ht storage.HashType) (string, error) {
+	p = storage.CleanPath(p)
+	o, err := s.lookup(ctx, "hash", p)
+	if err != nil {
+		return "", err
+	}
+	if o.whole != nil {
+		if o.whole.IsDir {
+			return "", s.wrapErr("hash", p, storage.ErrIsDir)
+		}
+		h, err := storage.GetHash(ctx, s.inner, o.whole, ht)
+		if !errors.Is(err, storage.ErrUnsupported) {
+			return h, err
+		}
+	} else if h, ok := o.split.Hashes[ht]; ok && h != "" {
+		return h, nil
+	}
+
+	h, err := storage.NewHash(ht)
+	if err != nil {
+		return "", err
+	}
+	rc, _, err := s.Open(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", s.wrapErr("hash", p, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// relocate は src を dst へ移すかコピーします。transfer は下のストレージでの
+// 1件の移動かコピーです。分けたものは断片を新しい ID で移し、目録を置きます。
+func (s *Storage) relocate(ctx context.Context, op, srcPath, dstPath string, transfer func(src, dst string) error) (*object, error) {
+	srcPath = storage.CleanPath(srcPath)
+	dstPath = storage.CleanPath(dstPath)
+	if reserved(path.Base(dstPath)) {
+		return nil, s.wrapErr(op, dstPath, fmt.Errorf("%w: %s", storage.ErrUnsupported, dstPath))
+	}
+	src, err := s.lookup(ctx, op, srcPath)
+	if err != nil {
+		return nil, err
+	}
+	old, err := s.oldSplit(ctx, dstPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if src.whole != nil {
+		if err := transfer(srcPath, dstPath); err != nil {
+			return nil, err
+		}
+		if err := s.removeSplit(ctx, dstPath, old); err != nil {
+			return nil, err
+		}
+		return &object{whole: src.whole}, nil
+	}
+
+	m := *src.split
+	m.ID = newID()
+	for i := range m.Chunks {
+		if err := transfer(src.split.chunkPath(srcPath, i), m.chunkPath(dstPath, i)); err != nil {
+			return nil, err
+		}
+	}
+	mfi, err := s.writeManifest(ctx, dstPath, &m, src.splitInfo.ModTime)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.inner.Remove(ctx, dstPath); err != nil && !storage.IsNotFound(err) {
+		return nil, err
+	}
+	if old != nil {
+		if err := s.removeChunks(ctx, dstPath, old); err != nil {
+			return nil, err
+		}
+	}
+	return &object{split: &m, splitInfo: mfi}, nil
+}
+
+// ServerSideCopy は、下のストレージで内容を運ばずにコピーします。
+func (s *Storage) ServerSideCopy(ctx context.Context, srcPath, dstPath string) (*storage.FileInfo, error) {
+	o, err := s.relocate(ctx, "copy", srcPath, dstPath, func(src, dst string) error {
+		_, err := storage.ServerSideCopy(ctx, s.inner, s.inner, src, dst)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return o.info(storage.CleanPath(dstPath)), nil
+}
+
+// Move は、下のストレージで内容を運ばずに移動します。
+func (s *Storage) Move(ctx context.Context, srcPath, dstPath string) error {
+	o, err := s.relocate(ctx, "move", srcPath, dstPath, func(src, dst string) error {
+		return storage.Move(ctx, s.inner, src, dst)
+	})
+	if err != nil {
+		return err
+	}
+	if o.split != nil {
+		// 断片はもう移したので、目録だけを消す。
+		return s.inner.Remove(ctx, storage.CleanPath(srcPath)+manifestExt)
+	}
+	return nil
+}
+
+// Purge はディレクトリを中身ごと削除します。
+func (s *Storage) Purge(ctx context.Context, dir string) error {
+	return storage.PurgeAll(ctx, s.inner, dir)
+}
+
+// SetModTime は最終更新時刻を変更します。分けたものは目録の時刻を変えます。
+func (s *Storage) SetModTime(ctx context.Context, p string, t time.Time) error {
+	p = storage.CleanPath(p)
+	o, err := s.lookup(ctx, "setmodtime", p)
+	if err != nil {
+		return err
+	}
+	if o.whole != nil {
+		return storage.SetModTime(ctx, s.inner, p, t)
+	}
+	return storage.SetModTime(ctx, s.inner, p+manifestExt, t)
+}
+
+// About は下のストレージの使用量を返します。
+func (s *Storage) About(ctx context.Context, p string) (*storage.Usage, error) {
+	return storage.About(ctx, s.inner, p)
+}
+
+// countingReader は読んだバイト数を数えます。
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readCloser は Reader と Closer をまとめます。
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+var (
+	_ storage.Storage            = (*Storage)(nil)
+	_ storage.CapabilityReporter = (*Storage)(nil)
+	_ storage.Permitter          = (*Storage)(nil)
+	_ storage.Hasher             = (*Storage)(nil)
+	_ storage.RangeOpener        = (*Storage)(nil)
+	_ storage.ServerSideCopier   = (*Storage)(nil)
+	_ storage.Mover              = (*Storage)(nil)
+	_ storage.Purger             = (*Storage)(nil)
+	_ storage.SetModTimer        = (*Storage)(nil)
+	_ storage.RecursiveLister    = (*Storage)(nil)
+	_ storage.Abouter            = (*Storage)(nil)
+)
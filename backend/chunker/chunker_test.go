@@ -0,0 +1,241 @@
+package chunker_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/backend/chunker"
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/storage"
+	"github.com/mt3hr/hbg/storage/storagetest"
+)
+
+// newChunker は、メモリの /parts に断片を置く chunker を設定から組み立てます。
+func newChunker(t *testing.T, chunkSize string) (storage.Storage, *memory.Storage) {
+	t.Helper()
+	r, err := backend.NewResolver([]backend.Entry{
+		{Name: "mem", Type: memory.Type},
+		{Name: "big", Type: chunker.Type, Params: backend.Params{"remote": "mem:/parts", "chunk_size": chunkSize}},
+	})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	ctx := context.Background()
+	s, err := r.Get(ctx, "big")
+	if err != nil {
+		t.Fatalf("Get(big): %v", err)
+	}
+	inner, err := r.Get(ctx, "mem")
+	if err != nil {
+		t.Fatalf("Get(mem): %v", err)
+	}
+	return s, inner.(*memory.Storage)
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Harness{
+		NewStorage: func(t *testing.T) (storage.Storage, string) {
+			// 大きめのファイル（3MiB）と取り消しの試験（1MiB）が分けて置かれる大きさ。
+			s, _ := newChunker(t, "256K")
+			return s, "/root"
+		},
+	})
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+// 断片に分けて置き、一覧には元の名前と大きさだけが出ることを確認します。
+func TestSplitsAndHidesChunks(t *testing.T) {
+	ctx := context.Background()
+	data := testData(2500)
+
+	for _, size := range []int64{int64(len(data)), storage.SizeUnknown} {
+		s, inner := newChunker(t, "1K")
+		if _, err := s.Put(ctx, "/dir/big.bin", bytes.NewReader(data), storage.ObjectMeta{Size: size}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+
+		var chunks int
+		for p, content := range inner.Snapshot() {
+			if strings.HasSuffix(p, ".hbgchunks") {
+				continue
+			}
+			chunks++
+			if len(content) > 1024 {
+				t.Errorf("%s が断片の大きさを超えている（%d バイト）", p, len(content))
+			}
+		}
+		if chunks != 3 {
+			t.Errorf("大きさ %d で書いた断片の数 = %d, want 3", size, chunks)
+		}
+
+		entries, err := storage.ListAll(ctx, s, "/dir")
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if len(entries) != 1 || entries[0].Name != "big.bin" || entries[0].Size != int64(len(data)) {
+			t.Errorf("一覧 = %v, want big.bin（%d バイト）だけ", entries, len(data))
+		}
+
+		rc, _, err := s.Open(ctx, "/dir/big.bin")
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("読んだ内容が違う（%d バイト, %v）", len(got), err)
+		}
+	}
+}
+
+// 分けて置いたものと分けずに置いたものを上書きし合っても、残りが出ないことを確認します。
+func TestOverwriteBetweenSplitAndWhole(t *testing.T) {
+	ctx := context.Background()
+	s, inner := newChunker(t, "1K")
+	big := testData(3000)
+
+	if _, err := s.Put(ctx, "/a.bin", bytes.NewReader(big), storage.ObjectMeta{Size: int64(len(big))}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := s.Put(ctx, "/a.bin", strings.NewReader("小さい"), storage.ObjectMeta{Size: storage.SizeUnknown}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if snap := inner.Snapshot(); len(snap) != 1 || snap["/parts/a.bin"] != "小さい" {
+		t.Errorf("小さく上書きしたあとの下のストレージ = %v", snap)
+	}
+
+	if _, err := s.Put(ctx, "/a.bin", bytes.NewReader(big), storage.ObjectMeta{Size: int64(len(big))}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	snap := inner.Snapshot()
+	if _, ok := snap["/parts/a.bin"]; ok || len(snap) != 4 {
+		t.Errorf("大きく上書きしたあとの下のストレージ = %d 件", len(snap))
+	}
+
+	if err := s.Remove(ctx, "/a.bin"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if snap := inner.Snapshot(); len(snap) != 0 {
+		t.Errorf("消したあとに残っている: %v", snap)
+	}
+}
+
+// noRange は、範囲読み出しのできない下のストレージを表します。
+type noRange struct{ storage.Storage }
+
+// 断片の境目をまたぐ範囲読み出しが、下のストレージの能力によらず正しいことを確認します。
+func TestOpenRangeAcrossChunks(t *testing.T) {
+	const chunk = 100
+	data := testData(3*chunk + 10)
+
+	for _, tt := range []struct {
+		name  string
+		inner func(*memory.Storage) storage.Storage
+	}{
+		{"範囲読み出しできる", func(m *memory.Storage) storage.Storage { return m }},
+		{"範囲読み出しできない", func(m *memory.Storage) storage.Storage { return noRange{m} }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, err := chunker.New("c", tt.inner(memory.New("mem")), chunker.Config{ChunkSize: chunk})
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			if _, err := s.Put(ctx, "/big.bin", bytes.NewReader(data), storage.ObjectMeta{Size: int64(len(data))}); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			for _, rg := range []struct{ offset, length int64 }{
+				{0, chunk},
+				{chunk - 10, 20},
+				{chunk, chunk},
+				{2*chunk + 5, -1},
+				{3 * chunk, 10},
+				{3*chunk + 5, 1000},
+				{int64(len(data)) + 10, -1},
+			} {
+				rc, err := s.OpenRange(ctx, "/big.bin", rg.offset, rg.length)
+				if err != nil {
+					t.Errorf("OpenRange(%d, %d): %v", rg.offset, rg.length, err)
+					continue
+				}
+				got, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Errorf("OpenRange(%d, %d) の読み取り: %v", rg.offset, rg.length, err)
+					continue
+				}
+				start := min(rg.offset, int64(len(data)))
+				end := int64(len(data))
+				if rg.length >= 0 {
+					end = min(start+rg.length, end)
+				}
+				if !bytes.Equal(got, data[start:end]) {
+					t.Errorf("OpenRange(%d, %d) の内容が違う（%d バイト）", rg.offset, rg.length, len(got))
+				}
+			}
+		})
+	}
+}
+
+// 断片が欠けていれば、読み取りがエラーになることを確認します。
+func TestMissingChunk(t *testing.T) {
+	ctx := context.Background()
+	s, inner := newChunker(t, "1K")
+	data := testData(2500)
+	if _, err := s.Put(ctx, "/a.bin", bytes.NewReader(data), storage.ObjectMeta{Size: int64(len(data))}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	for p := range inner.Snapshot() {
+		if strings.HasSuffix(p, "-001") {
+			if err := inner.Remove(ctx, p); err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+		}
+	}
+
+	rc, _, err := s.Open(ctx, "/a.bin")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); err == nil {
+		t.Error("断片が欠けているのに読めてしまった")
+	}
+}
+
+// 下のストレージの上限を超える断片の大きさは設定できないことを確認します。
+func TestChunkSizeWithinLimit(t *testing.T) {
+	if _, err := chunker.New("c", limited{memory.New("mem")}, chunker.Config{ChunkSize: 2 << 20}); err == nil {
+		t.Error("上限を超える断片の大きさで組み立てられてしまった")
+	}
+	s, err := chunker.New("c", limited{memory.New("mem")}, chunker.Config{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got := s.Features().MaxFileSize; got != 0 {
+		t.Errorf("MaxFileSize = %d, want 0（上限なし）", got)
+	}
+}
+
+// limited は、1ファイルの上限が 1MiB のストレージを表します。
+type limited struct{ *memory.Storage }
+
+func (l limited) Features() *storage.Features {
+	f := l.Storage.Features()
+	f.MaxFileSize = 1 << 20
+	return f
+}
@@ -0,0 +1,136 @@
+package chunker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// 分けたファイルは、下のストレージにこう置きます。
+//
+//	名前.hbgchunks                  目録（大きさ・分けた数・ハッシュ）
+//	名前.hbgchunk-<書き込みID>-000   1つめ
+//	名前.hbgchunk-<書き込みID>-001   2つめ ...
+//
+// 分けずに済む大きさのファイルは、元の名前のまま置きます。
+// 書き込みごとに ID を変えるのは、上書きの途中で古い目録が新しい
+// 断片を指してしまわないようにするためです。
+const (
+	manifestExt = ".hbgchunks"
+	chunkMark   = ".hbgchunk-"
+)
+
+// manifest は目録の中身です。
+type manifest struct {
+	// Size は元のファイルの大きさです。
+	Size int64 `json:"size"`
+	// ChunkSize は最後を除く断片の大きさです。
+	ChunkSize int64 `json:"chunk_size"`
+	// ID は書き込みごとの識別子です。断片の名前に入ります。
+	ID string `json:"id"`
+	// Chunks は断片の数です。
+	Chunks int `json:"chunks"`
+	// Hashes は元の内容のハッシュです。
+	Hashes map[storage.HashType]string `json:"hashes,omitempty"`
+}
+
+// newID は書き込みの識別子を作ります。
+func newID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// chunkPath は、p を分けた i 番目の断片のパスを返します。
+func (m *manifest) chunkPath(p string, i int) string {
+	return fmt.Sprintf("%s%s%s-%03d", p, chunkMark, m.ID, i)
+}
+
+// chunkLen は i 番目の断片の大きさです。
+func (m *manifest) chunkLen(i int) int64 {
+	if i == m.Chunks-1 {
+		return m.Size - int64(m.Chunks-1)*m.ChunkSize
+	}
+	return m.ChunkSize
+}
+
+// isChunk は、name が断片の名前かを返します。
+func isChunk(name string) bool {
+	i := strings.LastIndex(name, chunkMark)
+	if i <= 0 {
+		return false
+	}
+	id, index, ok := strings.Cut(name[i+len(chunkMark):], "-")
+	if !ok || id == "" || index == "" {
+		return false
+	}
+	_, err := strconv.Atoi(index)
+	return err == nil
+}
+
+// reserved は、chunker が下のストレージで自分のために使う名前かを返します。
+// この名前のファイルは置けません。
+func reserved(name string) bool {
+	return strings.HasSuffix(name, manifestExt) || isChunk(name)
+}
+
+// readManifest は p の目録と、目録そのもののメタデータを読みます。
+// 無ければ ErrNotFound を含むエラーを返します。
+//
+// 更新時刻は目録のものを、分けたファイルの更新時刻とします。
+func (s *Storage) readManifest(ctx context.Context, p string) (*manifest, *storage.FileInfo, error) {
+	rc, fi, err := s.inner.Open(ctx, p+manifestExt)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rc.Close()
+
+	var m manifest
+	if err := json.NewDecoder(io.LimitReader(rc, 1<<16)).Decode(&m); err != nil {
+		return nil, nil, s.wrapErr("stat", p, fmt.Errorf("目録 %s を読めません: %w", p+manifestExt, err))
+	}
+	if m.ID == "" || m.Chunks <= 0 || m.ChunkSize <= 0 || m.Size < 0 ||
+		m.Size > int64(m.Chunks)*m.ChunkSize || m.Size <= int64(m.Chunks-1)*m.ChunkSize {
+		return nil, nil, s.wrapErr("stat", p, fmt.Errorf("目録 %s の中身が合いません", p+manifestExt))
+	}
+	return &m, fi, nil
+}
+
+// writeManifest は p の目録を書きます。
+func (s *Storage) writeManifest(ctx context.Context, p string, m *manifest, modTime time.Time) (*storage.FileInfo, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return s.inner.Put(ctx, p+manifestExt, strings.NewReader(string(data)), storage.ObjectMeta{
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+		MIMEType: "application/json",
+	})
+}
+
+// removeChunks は m の断片を消します。無くなっているものは飛ばします。
+func (s *Storage) removeChunks(ctx context.Context, p string, m *manifest) error {
+	for i := range m.Chunks {
+		if err := s.inner.Remove(ctx, m.chunkPath(p, i)); err != nil && !storage.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSplit は、目録と断片を消します。目録を先に消すので、途中で
+// 止まっても、読めない目録が残ることはありません。
+func (s *Storage) removeSplit(ctx context.Context, p string, m *manifest) error {
+	if m == nil {
+		return nil
+	}
+	if err := s.inner.Remove(ctx, p+manifestExt); err != nil && !storage.IsNotFound(err) {
+		return err
+	}
+	return s.removeChunks(ctx, p, m)
+}
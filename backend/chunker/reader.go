@@ -0,0 +1,92 @@
+package chunker
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// chunkReader は断片を順に開いて、つなげて読みます。
+//
+// 断片は読む番が来てから開きます。先に全部を開くと、クラウドでは
+// 使わない接続を断片の数だけ抱えることになります。
+type chunkReader struct {
+	ctx context.Context
+	s   *Storage
+	p   string
+	m   *manifest
+
+	// next は次に開く断片の番号、offset はその断片の中で読み始める位置です。
+	next   int
+	offset int64
+
+	cur io.ReadCloser
+	// remain は、開いている断片から読めるはずの残りです。
+	remain int64
+}
+
+// newChunkReader は p を offset から読む chunkReader を作ります。
+func (s *Storage) newChunkReader(ctx context.Context, p string, m *manifest, offset int64) *chunkReader {
+	return &chunkReader{
+		ctx:    ctx,
+		s:      s,
+		p:      p,
+		m:      m,
+		next:   int(offset / m.ChunkSize),
+		offset: offset % m.ChunkSize,
+	}
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if r.next >= r.m.Chunks {
+				return 0, io.EOF
+			}
+			rc, err := r.s.openAt(r.ctx, r.m.chunkPath(r.p, r.next), r.offset)
+			if err != nil {
+				return 0, err
+			}
+			r.cur = rc
+			r.remain = r.m.chunkLen(r.next) - r.offset
+			r.next++
+			r.offset = 0
+		}
+
+		n, err := r.cur.Read(b[:min(int64(len(b)), max(r.remain, 1))])
+		r.remain -= int64(n)
+		switch {
+		case r.remain < 0:
+			return n + int(r.remain), r.broken(fmt.Errorf("断片 %d が目録より大きい", r.next-1))
+		case err == io.EOF:
+			r.cur.Close()
+			r.cur = nil
+			if r.remain > 0 {
+				return n, r.broken(fmt.Errorf("断片 %d が目録より %d バイト小さい", r.next-1, r.remain))
+			}
+			if n > 0 {
+				return n, nil
+			}
+		default:
+			return n, err
+		}
+	}
+}
+
+// broken は、断片が目録と合わないことを表すエラーを返します。
+// 読み直しても直らないので、再試行の対象にしません。
+func (r *chunkReader) broken(err error) error {
+	return storage.Wrap("open", r.s.name, r.p, storage.ClassPermanent, err)
+}
+
+// Close は開いている断片を閉じます。
+func (r *chunkReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
@@ -0,0 +1,45 @@
+package chunker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/storage"
+)
+
+func init() {
+	backend.Register(backend.Descriptor{
+		Type:    Type,
+		Summary: "他のストレージの上に重ねて、大きなファイルを分けて置く",
+		ConfigDoc: `  # - name: bigftp
+  #   type: chunker
+  #   remote: ftp:/backup  # 分けたものを置く場所（設定にあるストレージ名:パス）
+  #   chunk_size: 2G  # 省略可。省略すると下のストレージの上限（無ければ 2G）
+`,
+		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
+			remote := params.Get("remote")
+			if remote == "" {
+				return nil, fmt.Errorf("chunker %s: remote が設定されていません", name)
+			}
+			var cfg Config
+			if v := params.Get("chunk_size"); v != "" {
+				size, err := backend.ParseSize(v)
+				if err != nil || size <= 0 {
+					return nil, fmt.Errorf("chunker %s: chunk_size は 100M や 2G のように指定してください（%q が指定されました）", name, v)
+				}
+				cfg.ChunkSize = size
+			}
+
+			inner, err := backend.Remote(ctx, remote)
+			if err != nil {
+				return nil, fmt.Errorf("chunker %s: %w", name, err)
+			}
+			s, err := New(name, inner, cfg)
+			if err != nil {
+				return nil, fmt.Errorf("chunker %s: %w", name, err)
+			}
+			return s, nil
+		},
+	})
+}
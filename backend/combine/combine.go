@@ -0,0 +1,560 @@
+// Package combine は、設定にある複数のストレージを、1つの起点の下に
+// ディレクトリとして並べて見せるストレージです。
+//
+//	storages:
+//	  - name: team
+//	    type: combine
+//	    upstreams: photos=local:/photos offsite=s3:/backups shared=googledrive:/team
+//
+// と書けば、team:/photos はローカルの /photos を、team:/offsite は S3 を指します。
+// 1回の hbg check や hbg list -l で、置き場所の違うものをまとめて見られます。
+//
+// union と違って、同じパスを複数のストレージが持つことはありません。
+// いちばん上のディレクトリの名前で、どのストレージかが1つに決まります。
+// いちばん上には登録したディレクトリしか置けず、それを消したり動かしたり
+// することもできません。
+package combine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Type はこのバックエンドの種別名です。
+const Type = "combine"
+
+// Member は、いちばん上のディレクトリ1つと、それが指すストレージです。
+type Member struct {
+	// Dir はいちばん上のディレクトリの名前です。"/" を含められません。
+	Dir     string
+	Storage storage.Storage
+}
+
+// Storage は複数のストレージを、いちばん上のディレクトリとして並べます。
+type Storage struct {
+	name     string
+	members  []Member
+	features *storage.Features
+}
+
+// New は members を並べる combine を作ります。
+//
+// メンバーは閉じません。閉じるのはメンバーを組み立てた側です。
+func New(name string, members []Member) (*Storage, error) {
+	if len(members) == 0 {
+		return nil, errors.New("並べるストレージがありません")
+	}
+	seen := map[string]bool{}
+	for _, m := range members {
+		switch {
+		case m.Dir == "", m.Dir == ".", m.Dir == "..", strings.Contains(m.Dir, "/"):
+			return nil, fmt.Errorf("ディレクトリの名前が不正です: %q", m.Dir)
+		case seen[m.Dir]:
+			return nil, fmt.Errorf("ディレクトリの名前が重複しています: %q", m.Dir)
+		}
+		seen[m.Dir] = true
+	}
+	return &Storage{
+		name:     name,
+		members:  slices.Clone(members),
+		features: features(members),
+	}, nil
+}
+
+// features は、どのメンバーでも守れることだけを申告します。
+// 1ファイルの上限は、最も小さいメンバーに合わせます。
+func features(members []Member) *storage.Features {
+	f := &storage.Features{
+		CanSetModTime: true,
+		ImplicitDirs:  true,
+		EmptyDirs:     true,
+		AtomicPut:     true,
+	}
+	var illegal strings.Builder
+	for i, m := range members {
+		in := m.Storage.Features()
+		f.ModTimePrecision = max(f.ModTimePrecision, in.ModTimePrecision)
+		f.CanSetModTime = f.CanSetModTime && in.CanSetModTime
+		f.CaseInsensitive = f.CaseInsensitive || in.CaseInsensitive
+		f.ImplicitDirs = f.ImplicitDirs && in.ImplicitDirs
+		f.EmptyDirs = f.EmptyDirs && in.EmptyDirs
+		f.AtomicPut = f.AtomicPut && in.AtomicPut
+		if i == 0 {
+			f.Hashes = slices.Clone(in.Hashes)
+		} else {
+			f.Hashes = slices.DeleteFunc(f.Hashes, func(ht storage.HashType) bool { return !in.Hashes.Has(ht) })
+		}
+		if in.MaxFileSize > 0 && (f.MaxFileSize == 0 || in.MaxFileSize < f.MaxFileSize) {
+			f.MaxFileSize = in.MaxFileSize
+		}
+		for _, c := range in.IllegalChars {
+			if !strings.ContainsRune(illegal.String(), c) {
+				illegal.WriteRune(c)
+			}
+		}
+	}
+	f.IllegalChars = illegal.String()
+	return f
+}
+
+// Type はストレージの種別を返します。
+func (s *Storage) Type() string { return Type }
+
+// Name は設定ファイルで付けた名前を返します。
+func (s *Storage) Name() string { return s.name }
+
+// Features はこのストレージにできることを返します。
+func (s *Storage) Features() *storage.Features {
+	f := *s.features
+	return &f
+}
+
+// Supports は、メンバーの全員が使える能力だけを使えると答えます。
+//
+// 能力はパスを問わずに答えるので、1つでも使えないメンバーがあれば、
+// 使えるメンバーの中でも使いません。ただし次のものは例外です。
+//
+//   - 移動と削除は、メンバーにできなくてもヘルパが肩代わりするので使えます。
+//   - サーバー側コピーは、使えるメンバーが1つでもあれば使えると答えます。
+//     使えないメンバーやメンバーをまたぐコピーでは ErrUnsupported を返し、
+//     storage.Copy がそれを見て読んで書くほうへ回ります。
+func (s *Storage) Supports(c storage.Capability) bool {
+	switch c {
+	case storage.CapMove, storage.CapPurge:
+		return true
+	case storage.CapServerSideCopy:
+		return slices.ContainsFunc(s.members, func(m Member) bool { return storage.Supports(m.Storage, c) })
+	}
+	for _, m := range s.members {
+		if !storage.Supports(m.Storage, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Close は何もしません。メンバーは組み立てた側が閉じます。
+func (s *Storage) Close() error { return nil }
+
+// Permit は、メンバーのどれかで op が許されていれば許します。
+// どのメンバーに当たるかはパスで決まるので、全員に禁じられているときだけ断ります。
+func (s *Storage) Permit(op string) error {
+	var denied error
+	for _, m := range s.members {
+		err := storage.Permit(m.Storage, op)
+		if err == nil {
+			return nil
+		}
+		if denied == nil {
+			denied = err
+		}
+	}
+	return denied
+}
+
+func (s *Storage) wrapErr(op, p string, err error) error {
+	return storage.Wrap(op, s.name, p, storage.ClassOf(err), err)
+}
+
+func (s *Storage) notFound(op, p string) error {
+	return storage.Wrap(op, s.name, p, storage.ClassPermanent, fmt.Errorf("%w: %s", storage.ErrNotFound, p))
+}
+
+// topLevel は、いちばん上を変えようとしたときのエラーです。
+func (s *Storage) topLevel(op, p string) error {
+	return storage.Wrap(op, s.name, p, storage.ClassPermanent,
+		fmt.Errorf("%w: いちばん上には登録したディレクトリ（%s）しか置けず、それを消したり動かしたりもできません",
+			storage.ErrUnsupported, strings.Join(s.dirs(), ", ")))
+}
+
+// acrossMembers は、メンバーをまたいでコピーや移動をしようとしたときのエラーです。
+func (s *Storage) acrossMembers(op, p string, src, dst Member) error {
+	return storage.Wrap(op, s.name, p, storage.ClassPermanent,
+		fmt.Errorf("%w: %s から %s へはまたげません", storage.ErrUnsupported, src.Dir, dst.Dir))
+}
+
+func (s *Storage) dirs() []string {
+	out := make([]string, 0, len(s.members))
+	for _, m := range s.members {
+		out = append(out, m.Dir)
+	}
+	return out
+}
+
+// --- パスの振り分け ---
+
+// split は p を、いちばん上のディレクトリの名前と、その下のパスに分けます。
+// p が起点なら dir は空です。
+func split(p string) (dir, rest string) {
+	p = storage.CleanPath(p)
+	if p == "/" {
+		return "", "/"
+	}
+	dir, rest, _ = strings.Cut(p[1:], "/")
+	return dir, "/" + rest
+}
+
+func (s *Storage) member(dir string) (Member, bool) {
+	i := slices.IndexFunc(s.members, func(m Member) bool { return m.Dir == dir })
+	if i < 0 {
+		return Member{}, false
+	}
+	return s.members[i], true
+}
+
+// route は、読むときに p を持っているメンバーと、その中でのパスを返します。
+// 起点そのものは呼び出し側で扱ってください。
+func (s *Storage) route(op, p string) (Member, string, error) {
+	dir, rest := split(p)
+	m, ok := s.member(dir)
+	if !ok {
+		return Member{}, "", s.notFound(op, p)
+	}
+	return m, rest, nil
+}
+
+// routeWrite は、変えるときに p を持っているメンバーと、その中でのパスを返します。
+// いちばん上のディレクトリそのものや、その並びは変えられません。
+func (s *Storage) routeWrite(op, p string) (Member, string, error) {
+	dir, rest := split(p)
+	m, ok := s.member(dir)
+	if !ok || rest == "/" {
+		return Member{}, "", s.topLevel(op, p)
+	}
+	return m, rest, nil
+}
+
+// outer は、メンバーでのパスを combine でのパスに直します。
+func outer(m Member, p string) string {
+	p = storage.CleanPath(p)
+	if p == "/" {
+		return "/" + m.Dir
+	}
+	return "/" + m.Dir + p
+}
+
+func info(m Member, fi *storage.FileInfo) *storage.FileInfo {
+	if fi == nil {
+		return nil
+	}
+	out := *fi
+	out.Path = outer(m, fi.Path)
+	if storage.CleanPath(fi.Path) == "/" {
+		out.Name = m.Dir
+	}
+	return &out
+}
+
+// rootInfo は起点のメタデータです。
+func rootInfo() *storage.FileInfo {
+	return &storage.FileInfo{Path: "/", Name: "/", IsDir: true}
+}
+
+// memberInfo は、一覧の起点に並べるメンバーのディレクトリです。
+// 中身の更新時刻は分からないので、ゼロ値にします。
+func memberInfo(m Member) storage.FileInfo {
+	return storage.FileInfo{Path: "/" + m.Dir, Name: m.Dir, IsDir: true}
+}
+
+// --- 基本の操作 ---
+
+// List は dir の中身を返します。起点では、メンバーのディレクトリを並べます。
+func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	if storage.CleanPath(dir) == "/" {
+		for _, m := range s.members {
+			if err := fn(memberInfo(m)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	m, p, err := s.route("list", dir)
+	if err != nil {
+		return err
+	}
+	return m.Storage.List(ctx, p, func(fi storage.FileInfo) error {
+		return fn(*info(m, &fi))
+	})
+}
+
+// Stat は p を持っているメンバーのメタデータを返します。
+func (s *Storage) Stat(ctx context.Context, p string) (*storage.FileInfo, error) {
+	if storage.CleanPath(p) == "/" {
+		return rootInfo(), nil
+	}
+	m, rest, err := s.route("stat", p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := m.Storage.Stat(ctx, rest)
+	if err != nil {
+		return nil, err
+	}
+	return info(m, fi), nil
+}
+
+// Open は p を持っているメンバーから読みます。
+func (s *Storage) Open(ctx context.Context, p string) (io.ReadCloser, *storage.FileInfo, error) {
+	if storage.CleanPath(p) == "/" {
+		return nil, nil, storage.Wrap("open", s.name, "/", storage.ClassPermanent, storage.ErrIsDir)
+	}
+	m, rest, err := s.route("open", p)
+	if err != nil {
+		return nil, nil, err
+	}
+	rc, fi, err := m.Storage.Open(ctx, rest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rc, info(m, fi), nil
+}
+
+// Put は p を持つメンバーに書きます。
+func (s *Storage) Put(ctx context.Context, p string, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	m, rest, err := s.routeWrite("put", p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := m.Storage.Put(ctx, rest, r, meta)
+	if err != nil {
+		return nil, err
+	}
+	return info(m, fi), nil
+}
+
+// Mkdir は dir を持つメンバーにディレクトリを作ります。
+// 起点と、メンバーのディレクトリはすでにあるので何もしません。
+func (s *Storage) Mkdir(ctx context.Context, dir string) error {
+	d, rest := split(dir)
+	if d == "" {
+		return nil
+	}
+	m, ok := s.member(d)
+	if !ok {
+		return s.topLevel("mkdir", dir)
+	}
+	return m.Storage.Mkdir(ctx, rest)
+}
+
+// Remove は p を持つメンバーから消します。
+func (s *Storage) Remove(ctx context.Context, p string) error {
+	m, rest, err := s.routeWrite("remove", p)
+	if err != nil {
+		return err
+	}
+	return m.Storage.Remove(ctx, rest)
+}
+
+// --- メンバーが持っていれば使える能力 ---
+
+// Hash は p を持つメンバーにハッシュを求めさせます。
+func (s *Storage) Hash(ctx context.Context, p string, ht storage.HashType) (string, error) {
+	m, rest, err := s.route("hash", p)
+	if err != nil {
+		return "", err
+	}
+	return storage.GetHash(ctx, m.Storage, &storage.FileInfo{Path: rest}, ht)
+}
+
+// ServerSideCopy は、同じメンバーの中ならそのメンバーの中でコピーします。
+//
+// メンバーをまたぐときは ErrUnsupported を返します。内容を運ぶことになるので、
+// 呼び出し側のふつうのコピー（進みぐあいや再試行を伴うもの）に任せます。
+func (s *Storage) ServerSideCopy(ctx context.Context, srcPath, dstPath string) (*storage.FileInfo, error) {
+	src, srcRest, err := s.route("copy", srcPath)
+	if err != nil {
+		return nil, err
+	}
+	dst, dstRest, err := s.routeWrite("copy", dstPath)
+	if err != nil {
+		return nil, err
+	}
+	if src.Dir != dst.Dir {
+		return nil, s.acrossMembers("copy", srcPath, src, dst)
+	}
+	fi, err := storage.ServerSideCopy(ctx, src.Storage, dst.Storage, srcRest, dstRest)
+	if err != nil {
+		return nil, err
+	}
+	return info(dst, fi), nil
+}
+
+// OpenRange は p を持つメンバーから途中から読みます。
+func (s *Storage) OpenRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	m, rest, err := s.route("open", p)
+	if err != nil {
+		return nil, err
+	}
+	return storage.OpenRange(ctx, m.Storage, rest, offset, length)
+}
+
+// Move は、同じメンバーの中ならそのメンバーの中で移動します。
+//
+// メンバーをまたぐときは ErrUnsupported を返します。コピーしてから消すと
+// 一度には済まず、途中で失敗すると両方のメンバーに残るためです。
+func (s *Storage) Move(ctx context.Context, srcPath, dstPath string) error {
+	src, srcRest, err := s.routeWrite("move", srcPath)
+	if err != nil {
+		return err
+	}
+	dst, dstRest, err := s.routeWrite("move", dstPath)
+	if err != nil {
+		return err
+	}
+	if src.Dir != dst.Dir {
+		return s.acrossMembers("move", srcPath, src, dst)
+	}
+	return storage.Move(ctx, src.Storage, srcRest, dstRest)
+}
+
+// Purge は dir を持つメンバーから中身ごと消します。
+func (s *Storage) Purge(ctx context.Context, dir string) error {
+	m, rest, err := s.routeWrite("purge", dir)
+	if err != nil {
+		return err
+	}
+	return storage.PurgeAll(ctx, m.Storage, rest)
+}
+
+// SetModTime は p を持つメンバーで最終更新時刻を変更します。
+func (s *Storage) SetModTime(ctx context.Context, p string, t time.Time) error {
+	m, rest, err := s.routeWrite("setmodtime", p)
+	if err != nil {
+		return err
+	}
+	return storage.SetModTime(ctx, m.Storage, rest, t)
+}
+
+// Partial は p を持つメンバーの書きかけを返します。
+func (s *Storage) Partial(ctx context.Context, p string) (*storage.FileInfo, error) {
+	m, rest, err := s.route("partial", p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := storage.PartialOf(ctx, m.Storage, rest)
+	if err != nil {
+		return nil, err
+	}
+	return info(m, fi), nil
+}
+
+// PutResume は p を持つメンバーで書きかけの続きを書きます。
+func (s *Storage) PutResume(ctx context.Context, p string, offset int64, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	m, rest, err := s.routeWrite("put", p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := storage.PutResume(ctx, m.Storage, rest, offset, r, meta)
+	if err != nil {
+		return nil, err
+	}
+	return info(m, fi), nil
+}
+
+// OpenWriterAt は p を持つメンバーで好きな位置へ書ける口を開きます。
+func (s *Storage) OpenWriterAt(ctx context.Context, p string, size int64) (storage.PartWriter, error) {
+	m, rest, err := s.routeWrite("put", p)
+	if err != nil {
+		return nil, err
+	}
+	w, err := storage.OpenWriterAt(ctx, m.Storage, rest, size)
+	if err != nil {
+		return nil, err
+	}
+	return &partWriter{PartWriter: w, member: m}, nil
+}
+
+// ListRecursive は dir の配下をまとめて返します。
+// 起点では、メンバーのディレクトリと、それぞれの配下を返します。
+func (s *Storage) ListRecursive(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	if storage.CleanPath(dir) != "/" {
+		m, p, err := s.route("list", dir)
+		if err != nil {
+			return err
+		}
+		return storage.ListRecursive(ctx, m.Storage, p, func(fi storage.FileInfo) error {
+			return fn(*info(m, &fi))
+		})
+	}
+
+	for _, m := range s.members {
+		if err := fn(memberInfo(m)); err != nil {
+			return err
+		}
+		if err := storage.ListRecursive(ctx, m.Storage, "/", func(fi storage.FileInfo) error {
+			return fn(*info(m, &fi))
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// About は p を持つメンバーの容量を返します。
+// 起点では、メンバーの使用量を足し合わせます。同じボリュームにある
+// 2つのメンバーは二重に数えます。
+func (s *Storage) About(ctx context.Context, p string) (*storage.Usage, error) {
+	if storage.CleanPath(p) != "/" {
+		m, rest, err := s.route("about", p)
+		if err != nil {
+			return nil, err
+		}
+		return storage.About(ctx, m.Storage, rest)
+	}
+
+	sum := &storage.Usage{}
+	add := func(total *int64, v int64) {
+		if *total == storage.SizeUnknown || v == storage.SizeUnknown {
+			*total = storage.SizeUnknown
+			return
+		}
+		*total += v
+	}
+	for _, m := range s.members {
+		u, err := storage.About(ctx, m.Storage, "/")
+		if err != nil {
+			return nil, s.wrapErr("about", p, err)
+		}
+		add(&sum.Total, u.Total)
+		add(&sum.Used, u.Used)
+		add(&sum.Free, u.Free)
+	}
+	return sum, nil
+}
+
+// partWriter は書き終えたときのパスを combine でのパスに直します。
+type partWriter struct {
+	storage.PartWriter
+	member Member
+}
+
+func (w *partWriter) Commit(ctx context.Context, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	fi, err := w.PartWriter.Commit(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+	return info(w.member, fi), nil
+}
+
+var (
+	_ storage.Storage            = (*Storage)(nil)
+	_ storage.CapabilityReporter = (*Storage)(nil)
+	_ storage.Permitter          = (*Storage)(nil)
+	_ storage.Hasher             = (*Storage)(nil)
+	_ storage.ServerSideCopier   = (*Storage)(nil)
+	_ storage.RangeOpener        = (*Storage)(nil)
+	_ storage.Mover              = (*Storage)(nil)
+	_ storage.Purger             = (*Storage)(nil)
+	_ storage.SetModTimer        = (*Storage)(nil)
+	_ storage.Resumer            = (*Storage)(nil)
+	_ storage.OffsetWriter       = (*Storage)(nil)
+	_ storage.RecursiveLister    = (*Storage)(nil)
+	_ storage.Abouter            = (*Storage)(nil)
+)
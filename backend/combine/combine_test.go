@@ -0,0 +1,314 @@
+package combine_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/backend/combine"
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/storage"
+	"github.com/mt3hr/hbg/storage/storagetest"
+)
+
+// newCombine は、メモリ2つを photos と offsite として並べる combine を設定から組み立てます。
+func newCombine(t *testing.T) (storage.Storage, *memory.Storage, *memory.Storage) {
+	t.Helper()
+	r, err := backend.NewResolver([]backend.Entry{
+		{Name: "mem1", Type: memory.Type},
+		{Name: "mem2", Type: memory.Type},
+		{Name: "team", Type: combine.Type, Params: backend.Params{"upstreams": "photos=mem1:/photos offsite=mem2:/"}},
+	})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	ctx := context.Background()
+	s, err := r.Get(ctx, "team")
+	if err != nil {
+		t.Fatalf("Get(team): %v", err)
+	}
+	mem1, err := r.Get(ctx, "mem1")
+	if err != nil {
+		t.Fatalf("Get(mem1): %v", err)
+	}
+	mem2, err := r.Get(ctx, "mem2")
+	if err != nil {
+		t.Fatalf("Get(mem2): %v", err)
+	}
+	return s, mem1.(*memory.Storage), mem2.(*memory.Storage)
+}
+
+// 1行に1つずつ並べれば、ディレクトリ名にもパスにも空白を使えることを確認します。
+func TestUpstreamsWithSpaces(t *testing.T) {
+	r, err := backend.NewResolver([]backend.Entry{
+		{Name: "mem1", Type: memory.Type},
+		{Name: "team", Type: combine.Type, Params: backend.Params{"upstreams": "My Photos=mem1:/My Photos\nrest=mem1:/rest"}},
+	})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	defer r.Close()
+	ctx := context.Background()
+	s, err := r.Get(ctx, "team")
+	if err != nil {
+		t.Fatalf("Get(team): %v", err)
+	}
+
+	if _, err := s.Put(ctx, "/My Photos/a.jpg", strings.NewReader("a"), storage.ObjectMeta{Size: 1}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	mem1, _ := r.Get(ctx, "mem1")
+	if got := mem1.(*memory.Storage).Snapshot()["/My Photos/a.jpg"]; got != "a" {
+		t.Errorf("空白を含むパスのメンバーに置かれていない: %q", got)
+	}
+}
+
+// メンバーに付けた制限は、全員に禁じられているときだけ始める前に断ることを確認します。
+func TestPermitFollowsMembers(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		policy backend.Policy
+		denied bool
+	}{
+		{"片方だけ read_only", backend.Policy{}, false},
+		{"両方 read_only", backend.Policy{ReadOnly: true}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := backend.NewResolver([]backend.Entry{
+				{Name: "mem1", Type: memory.Type, Policy: backend.Policy{ReadOnly: true}},
+				{Name: "mem2", Type: memory.Type, Policy: tt.policy},
+				{Name: "team", Type: combine.Type, Params: backend.Params{"upstreams": "photos=mem1:/ offsite=mem2:/"}},
+			})
+			if err != nil {
+				t.Fatalf("NewResolver: %v", err)
+			}
+			defer r.Close()
+			s, err := r.Get(context.Background(), "team")
+			if err != nil {
+				t.Fatalf("Get(team): %v", err)
+			}
+
+			err = storage.Permit(s, "put")
+			if got := errors.Is(err, storage.ErrReadOnly); got != tt.denied {
+				t.Errorf("Permit(put) = %v, want 断る=%v", err, tt.denied)
+			}
+		})
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Harness{
+		NewStorage: func(t *testing.T) (storage.Storage, string) {
+			s, _, _ := newCombine(t)
+			return s, "/photos/root"
+		},
+	})
+}
+
+func put(t *testing.T, s storage.Storage, p, content string) {
+	t.Helper()
+	if _, err := s.Put(context.Background(), p, strings.NewReader(content), storage.ObjectMeta{
+		Size:    int64(len(content)),
+		ModTime: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+	}); err != nil {
+		t.Fatalf("Put(%s): %v", p, err)
+	}
+}
+
+// 起点にはメンバーのディレクトリが並び、その下は各メンバーに振り分けられることを確認します。
+func TestRouting(t *testing.T) {
+	ctx := context.Background()
+	s, mem1, mem2 := newCombine(t)
+	put(t, s, "/photos/2025/a.jpg", "写真")
+	put(t, s, "/offsite/db.tar", "控え")
+
+	if got := mem1.Snapshot(); len(got) != 1 || got["/photos/2025/a.jpg"] != "写真" {
+		t.Errorf("mem1 = %v", got)
+	}
+	if got := mem2.Snapshot(); len(got) != 1 || got["/db.tar"] != "控え" {
+		t.Errorf("mem2 = %v", got)
+	}
+
+	root, err := storage.ListAllSorted(ctx, s, "/")
+	if err != nil {
+		t.Fatalf("List(/): %v", err)
+	}
+	if len(root) != 2 || root[0].Path != "/offsite" || root[1].Path != "/photos" || !root[0].IsDir || !root[1].IsDir {
+		t.Errorf("起点の一覧 = %+v", root)
+	}
+
+	fi, err := s.Stat(ctx, "/offsite")
+	if err != nil {
+		t.Fatalf("Stat(/offsite): %v", err)
+	}
+	if fi.Path != "/offsite" || fi.Name != "offsite" || !fi.IsDir {
+		t.Errorf("Stat(/offsite) = %+v", fi)
+	}
+
+	var all []string
+	if err := storage.ListRecursive(ctx, s, "/", func(fi storage.FileInfo) error {
+		all = append(all, fi.Path)
+		return nil
+	}); err != nil {
+		t.Fatalf("ListRecursive: %v", err)
+	}
+	for _, want := range []string{"/photos", "/photos/2025/a.jpg", "/offsite", "/offsite/db.tar"} {
+		if !strings.Contains(strings.Join(all, " ")+" ", want+" ") {
+			t.Errorf("配下の一覧に %s が無い: %v", want, all)
+		}
+	}
+
+	if _, err := s.Stat(ctx, "/shared/x"); !storage.IsNotFound(err) {
+		t.Errorf("登録していないディレクトリの Stat = %v, want ErrNotFound", err)
+	}
+}
+
+// いちばん上は変えられないことを確認します。
+func TestTopLevel(t *testing.T) {
+	ctx := context.Background()
+	s, _, _ := newCombine(t)
+
+	for name, err := range map[string]error{
+		"起点に置く": func() error {
+			_, err := s.Put(ctx, "/a.txt", strings.NewReader("a"), storage.ObjectMeta{Size: 1})
+			return err
+		}(),
+		"知らないディレクトリを作る": s.Mkdir(ctx, "/shared"),
+		"メンバーを消す":       s.Remove(ctx, "/photos"),
+		"メンバーを動かす":      storage.Move(ctx, s, "/photos", "/pictures"),
+	} {
+		if !errors.Is(err, storage.ErrUnsupported) || storage.ClassOf(err) != storage.ClassPermanent {
+			t.Errorf("%s = %v, want 再試行しない ErrUnsupported", name, err)
+		}
+	}
+	if err := s.Mkdir(ctx, "/photos"); err != nil {
+		t.Errorf("メンバーのディレクトリの Mkdir = %v, want nil", err)
+	}
+}
+
+// serverCopy は、サーバー側コピーを持つことにしたメモリのストレージです。
+// メモリのストレージそのものは持ちません。
+type serverCopy struct {
+	*memory.Storage
+}
+
+func (s serverCopy) ServerSideCopy(ctx context.Context, srcPath, dstPath string) (*storage.FileInfo, error) {
+	rc, fi, err := s.Open(ctx, srcPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return s.Put(ctx, dstPath, rc, storage.ObjectMeta{Size: fi.Size, ModTime: fi.ModTime})
+}
+
+// メンバーをまたぐ移動とサーバー側コピーは断り、ふつうのコピーに任せることを確認します。
+func TestAcrossMembers(t *testing.T) {
+	ctx := context.Background()
+	mem1, mem2 := memory.New("mem1"), memory.New("mem2")
+	s, err := combine.New("team", []combine.Member{
+		{Dir: "photos", Storage: serverCopy{mem1}},
+		{Dir: "offsite", Storage: serverCopy{mem2}},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	put(t, s, "/photos/a.jpg", "写真")
+	put(t, s, "/photos/dir/b.jpg", "写真2")
+
+	for _, from := range []string{"/photos/a.jpg", "/photos/dir"} {
+		err := storage.Move(ctx, s, from, "/offsite/x")
+		if !errors.Is(err, storage.ErrUnsupported) || storage.ClassOf(err) != storage.ClassPermanent {
+			t.Errorf("%s をまたぐ Move = %v, want 再試行しない ErrUnsupported", from, err)
+		}
+	}
+	if _, err := storage.ServerSideCopy(ctx, s, s, "/photos/a.jpg", "/offsite/a.jpg"); !errors.Is(err, storage.ErrUnsupported) {
+		t.Errorf("またぐ ServerSideCopy = %v, want ErrUnsupported", err)
+	}
+	if got := mem2.Snapshot(); len(got) != 0 {
+		t.Errorf("断ったのに書かれた: %v", got)
+	}
+	if got := mem1.Snapshot(); got["/a.jpg"] != "写真" {
+		t.Errorf("断ったのに移動元が変わった: %v", got)
+	}
+
+	// storage.Copy は断られたら読んで書く。
+	if _, err := storage.Copy(ctx, s, "/photos/a.jpg", s, "/offsite/a.jpg", storage.CopyOptions{}); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if got := mem2.Snapshot(); got["/a.jpg"] != "写真" {
+		t.Errorf("コピー先 = %v", got)
+	}
+
+	// 同じメンバーの中なら、そのメンバーに任せる。
+	if err := storage.Move(ctx, s, "/photos/dir/b.jpg", "/photos/moved/b.jpg"); err != nil {
+		t.Fatalf("同じメンバーの中の Move: %v", err)
+	}
+	if got := mem1.Snapshot(); got["/moved/b.jpg"] != "写真2" {
+		t.Errorf("同じメンバーの中の移動先 = %v", got)
+	}
+}
+
+// サーバー側コピーを持たないメンバーがあっても、持つメンバーの中では使えることを確認します。
+func TestServerSideCopyPerMember(t *testing.T) {
+	ctx := context.Background()
+	mem1, mem2 := memory.New("mem1"), memory.New("mem2")
+	s, err := combine.New("team", []combine.Member{
+		{Dir: "photos", Storage: serverCopy{mem1}},
+		{Dir: "offsite", Storage: mem2},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	put(t, s, "/photos/a.jpg", "写真")
+	put(t, s, "/offsite/b.tar", "控え")
+
+	if !storage.Supports(s, storage.CapServerSideCopy) {
+		t.Fatal("サーバー側コピーを使えると答えていない")
+	}
+	if _, err := storage.ServerSideCopy(ctx, s, s, "/photos/a.jpg", "/photos/c.jpg"); err != nil {
+		t.Errorf("持つメンバーの中の ServerSideCopy = %v", err)
+	}
+	if _, err := storage.ServerSideCopy(ctx, s, s, "/offsite/b.tar", "/offsite/d.tar"); !errors.Is(err, storage.ErrUnsupported) {
+		t.Errorf("持たないメンバーの中の ServerSideCopy = %v, want ErrUnsupported", err)
+	}
+	if _, err := storage.Copy(ctx, s, "/offsite/b.tar", s, "/offsite/d.tar", storage.CopyOptions{}); err != nil {
+		t.Errorf("持たないメンバーの中の Copy = %v", err)
+	}
+	if got := mem2.Snapshot(); got["/d.tar"] != "控え" {
+		t.Errorf("コピー先 = %v", got)
+	}
+}
+
+// できることは、メンバーの全員が守れることに絞られることを確認します。
+func TestFeatures(t *testing.T) {
+	a, b := memory.New("a"), memory.New("b")
+	s, err := combine.New("team", []combine.Member{{Dir: "a", Storage: a}, {Dir: "b", Storage: b}})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	want := a.Features()
+	got := s.Features()
+	if got.CanSetModTime != want.CanSetModTime || got.ModTimePrecision != want.ModTimePrecision || len(got.Hashes) != len(want.Hashes) {
+		t.Errorf("同じメンバーだけなのに Features が変わった: %+v, want %+v", got, want)
+	}
+	if got.OSPath {
+		t.Error("OSPath = true, want false")
+	}
+
+	for _, bad := range [][]combine.Member{
+		nil,
+		{{Dir: "", Storage: a}},
+		{{Dir: "a/b", Storage: a}},
+		{{Dir: "..", Storage: a}},
+		{{Dir: "a", Storage: a}, {Dir: "a", Storage: b}},
+	} {
+		if _, err := combine.New("team", bad); err == nil {
+			t.Errorf("New(%+v) がエラーにならなかった", bad)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package combine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/storage"
+)
+
+func init() {
+	backend.Register(backend.Descriptor{
+		Type:    Type,
+		Summary: "複数のストレージを、1つの起点の下にディレクトリとして並べる",
+		ConfigDoc: `  # - name: team
+  #   type: combine
+  #   upstreams: photos=local:/photos offsite=s3:/backups shared=googledrive:/team  # ディレクトリ名=ストレージ名:パス を空白で区切る。空白を含むものは YAML の並びで1つずつ書く
+`,
+		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
+			specs := params.List("upstreams")
+			if len(specs) == 0 {
+				return nil, fmt.Errorf("combine %s: upstreams が設定されていません", name)
+			}
+
+			members := make([]Member, 0, len(specs))
+			for _, spec := range specs {
+				dir, remote, ok := strings.Cut(spec, "=")
+				if !ok {
+					return nil, fmt.Errorf("combine %s: upstreams は ディレクトリ名=ストレージ名:パス の形で書いてください（%q が指定されました）", name, spec)
+				}
+				s, err := backend.Remote(ctx, remote)
+				if err != nil {
+					return nil, fmt.Errorf("combine %s: %w", name, err)
+				}
+				members = append(members, Member{Dir: dir, Storage: s})
+			}
+
+			s, err := New(name, members)
+			if err != nil {
+				return nil, fmt.Errorf("combine %s: %w", name, err)
+			}
+			return s, nil
+		},
+	})
+}
@@ -0,0 +1,71 @@
+package compress
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 圧縮の形式です。
+const (
+	// Gzip は標準ライブラリの gzip です。どこでも展開できるので既定にしています。
+	Gzip = "gzip"
+	// Zstd は Zstandard です。gzip より速く、よく縮みます。
+	Zstd = "zstd"
+)
+
+// checkLevel は、algorithm の圧縮の強さとして level を使えるか確かめます。
+// 0 は既定の強さです。
+func checkLevel(algorithm string, level int) error {
+	lo, hi := gzip.BestSpeed, gzip.BestCompression
+	if algorithm == Zstd {
+		// zstd コマンドと同じ数え方。klauspost/compress は4段階に丸める。
+		lo, hi = 1, 22
+	}
+	if level != 0 && (level < lo || level > hi) {
+		return fmt.Errorf("%s の圧縮の強さは %d〜%d で指定してください（%d が指定されました）", algorithm, lo, hi, level)
+	}
+	return nil
+}
+
+// newWriter は、w へ algorithm で圧縮して書く口を返します。
+// Close は圧縮したものを書き切りますが、w は閉じません。
+func newWriter(algorithm string, level int, w io.Writer) (io.WriteCloser, error) {
+	if algorithm == Zstd {
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	}
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+// newReader は、algorithm で圧縮された r を展開しながら読む口を返します。
+// Close は r を閉じません。
+func newReader(algorithm string, r io.Reader) (io.ReadCloser, error) {
+	switch algorithm {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("知らない圧縮の形式です: %q", algorithm)
+}
+
+// contentType は algorithm で圧縮したものの内容の種類です。
+func contentType(algorithm string) string {
+	if algorithm == Zstd {
+		return "application/zstd"
+	}
+	return "application/gzip"
+}
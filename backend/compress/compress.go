@@ -0,0 +1,575 @@
+// Package compress は、他のストレージの上に重ねて、内容を圧縮して置く
+// ストレージです。
+//
+// 圧縮は手元で行い、下のストレージには gzip か zstd で縮めたものを渡します。
+// 読むときは展開して返すので、呼び出し側からは元の内容と大きさに見えます。
+// 写真や動画、書庫のようにすでに圧縮されている形式は、縮まないうえに
+// CPU を使うだけなので、拡張子か内容の種類で見分けてそのまま置きます。
+//
+// 元の大きさとハッシュは控え（サイドカー）に書いておきます。置き方は
+// meta.go を見てください。
+package compress
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Type はこのバックエンドの種別名です。
+const Type = "compress"
+
+// hashTypes は控えに書くハッシュの種類です。
+// 多くのクラウドと突き合わせられる2つにしています。
+var hashTypes = storage.HashSet{storage.SHA256, storage.MD5}
+
+// Config は compress の設定です。
+type Config struct {
+	// Algorithm は圧縮の形式です（Gzip か Zstd）。空なら Gzip です。
+	Algorithm string
+	// Level は圧縮の強さです。gzip は 1〜9、zstd は 1〜22 で、
+	// 0 なら形式ごとの既定の強さです。
+	Level int
+}
+
+// Storage は内容を圧縮して、下のストレージに置きます。
+type Storage struct {
+	name      string
+	inner     storage.Storage
+	algorithm string
+	level     int
+}
+
+// New は inner の上に重ねる compress を作ります。
+//
+// 形式は書くときにだけ使います。読むときは控えに書いた形式で展開するので、
+// 形式を変えても、前に書いたものはそのまま読めます。
+//
+// inner は閉じません。閉じるのは inner を組み立てた側です。
+func New(name string, inner storage.Storage, cfg Config) (*Storage, error) {
+	algorithm := cfg.Algorithm
+	switch algorithm {
+	case "":
+		algorithm = Gzip
+	case Gzip, Zstd:
+	default:
+		return nil, fmt.Errorf("圧縮の形式は %s か %s で指定してください（%q が指定されました）", Gzip, Zstd, algorithm)
+	}
+	if err := checkLevel(algorithm, cfg.Level); err != nil {
+		return nil, err
+	}
+	return &Storage{name: name, inner: inner, algorithm: algorithm, level: cfg.Level}, nil
+}
+
+// Type はストレージの種別を返します。
+func (s *Storage) Type() string { return Type }
+
+// Name は設定ファイルで付けた名前を返します。
+func (s *Storage) Name() string { return s.name }
+
+// Features はこのストレージにできることを返します。
+//
+// 時刻やディレクトリ、名前の扱いは下のストレージのとおりです。
+// ハッシュは控えに書いた元の内容のものを返します。
+//
+// 書き込みは、控えを書き換えたところで新しい内容に切り替わるので、
+// 下のストレージが不可分に書ければ、途中経過は見えません。
+func (s *Storage) Features() *storage.Features {
+	in := s.inner.Features()
+	return &storage.Features{
+		ModTimePrecision: in.ModTimePrecision,
+		CanSetModTime:    in.CanSetModTime,
+		CaseInsensitive:  in.CaseInsensitive,
+		Hashes:           hashTypes,
+		ImplicitDirs:     in.ImplicitDirs,
+		EmptyDirs:        in.EmptyDirs,
+		AtomicPut:        in.AtomicPut,
+		MaxFileSize:      in.MaxFileSize,
+		IllegalChars:     in.IllegalChars,
+	}
+}
+
+// Supports は、下のストレージで使える能力だけを使えると答えます。
+// ハッシュは控えか内容から自分で求めるので、いつでも使えます。
+func (s *Storage) Supports(c storage.Capability) bool {
+	if c == storage.CapHash {
+		return true
+	}
+	return storage.Supports(s.inner, c)
+}
+
+// Close は何もしません。下のストレージは組み立てた側が閉じます。
+func (s *Storage) Close() error { return nil }
+
+// Permit は下のストレージで op が許されているかを返します。
+func (s *Storage) Permit(op string) error { return storage.Permit(s.inner, op) }
+
+func (s *Storage) wrapErr(op, p string, err error) error {
+	return storage.Wrap(op, s.name, p, storage.ClassOf(err), err)
+}
+
+func (s *Storage) notFound(op, p string) error {
+	return storage.Wrap(op, s.name, p, storage.ClassPermanent, fmt.Errorf("%w: %s", storage.ErrNotFound, p))
+}
+
+// --- 本体を引く ---
+
+// object は、元のパスに対応する下のストレージの本体です。
+type object struct {
+	// data は本体のパスです。
+	data string
+	// meta は控えです。控えの無い（compress を通さずに置かれた）ものなら nil です。
+	meta *sidecar
+}
+
+// compressed は本体が圧縮されているかを返します。
+func (o *object) compressed() bool {
+	_, size, _ := parseName(path.Base(o.data))
+	return size >= 0 && o.meta != nil
+}
+
+// lookup は p の本体を引きます。
+//
+// 控えがあれば、控えの指す本体です。無ければ p そのものを本体とみなします。
+// ディレクトリや、compress を通さずに置かれたファイルがこれにあたります。
+func (s *Storage) lookup(ctx context.Context, op, p string) (*object, error) {
+	if reserved(path.Base(p)) {
+		return nil, s.notFound(op, p)
+	}
+	m, err := s.readSidecar(ctx, p)
+	if err != nil {
+		if storage.IsNotFound(err) {
+			return &object{data: p}, nil
+		}
+		return nil, err
+	}
+	return &object{data: dataPath(p, m), meta: m}, nil
+}
+
+// info は本体のメタデータを、元の側のものに直します。
+func (s *Storage) info(fi *storage.FileInfo, p string, o *object) *storage.FileInfo {
+	out := storage.FileInfo{
+		Path:    p,
+		Name:    path.Base(p),
+		IsDir:   fi.IsDir,
+		Size:    fi.Size,
+		ModTime: fi.ModTime,
+		Hashes:  fi.Hashes,
+		ID:      fi.ID,
+	}
+	if o.meta != nil {
+		out.Size = o.meta.Size
+		out.Hashes = o.meta.Hashes
+	}
+	return &out
+}
+
+// --- Storage ---
+
+// List は dir の直下にあるものを fn に渡します。
+//
+// 控えと書きかけは渡しません。圧縮した本体は、名前から元の名前と
+// 大きさを読み取るので、控えは読みません。
+func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	dir = storage.CleanPath(dir)
+	seen := map[string]bool{}
+	return s.inner.List(ctx, dir, func(fi storage.FileInfo) error {
+		out, ok := listed(fi, seen)
+		if !ok {
+			return nil
+		}
+		return fn(out)
+	})
+}
+
+// ListRecursive は dir の配下をまとめて一覧します。
+// ディレクトリの名前は変えないので、届いた順にそのまま渡せます。
+func (s *Storage) ListRecursive(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	dir = storage.CleanPath(dir)
+	seen := map[string]bool{}
+	return storage.ListRecursive(ctx, s.inner, dir, func(fi storage.FileInfo) error {
+		out, ok := listed(fi, seen)
+		if !ok {
+			return nil
+		}
+		return fn(out)
+	})
+}
+
+// listed は一覧で届いた1件を元の側に直します。
+//
+// 書き込みが本体と控えのあいだで止まると、控えから指されない本体が
+// 残ることがあります。同じ名前を2度渡さないよう、渡したパスを seen に
+// 覚えておきます。Stat と Open は控えの指す本体を使うので、どちらが
+// 残っていても内容を取り違えることはありません。
+func listed(fi storage.FileInfo, seen map[string]bool) (storage.FileInfo, bool) {
+	if fi.IsDir {
+		return fi, true
+	}
+	name, size, ok := parseName(fi.Name)
+	if !ok {
+		return storage.FileInfo{}, false
+	}
+	fi.Path = path.Join(path.Dir(fi.Path), name)
+	fi.Name = name
+	if seen[fi.Path] {
+		return storage.FileInfo{}, false
+	}
+	seen[fi.Path] = true
+	if size >= 0 {
+		fi.Size = size
+		// 下のストレージのハッシュは圧縮したもののなので、渡さない。
+		fi.Hashes = nil
+	}
+	return fi, true
+}
+
+// Stat は1件のメタデータを返します。
+func (s *Storage) Stat(ctx context.Context, p string) (*storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	o, err := s.lookup(ctx, "stat", p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := s.inner.Stat(ctx, o.data)
+	if err != nil {
+		return nil, err
+	}
+	return s.info(fi, p, o), nil
+}
+
+// Open は内容を展開しながら読む ReadCloser を返します。
+func (s *Storage) Open(ctx context.Context, p string) (io.ReadCloser, *storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	o, err := s.lookup(ctx, "open", p)
+	if err != nil {
+		return nil, nil, err
+	}
+	rc, fi, err := s.inner.Open(ctx, o.data)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := s.info(fi, p, o)
+	if !o.compressed() {
+		return rc, info, nil
+	}
+
+	zr, err := newReader(o.meta.algorithm(), rc)
+	if err != nil {
+		rc.Close()
+		return nil, nil, s.wrapErr("open", p, fmt.Errorf("%s を展開できません: %w", o.data, err))
+	}
+	return readCloser{zr, rc}, info, nil
+}
+
+// Put は内容を、圧縮するものは圧縮して書き込みます。
+//
+// 本体を書いてから控えを書き換え、そのあとで古い本体を消します。
+// 控えを書き換えるまでは古い内容が読めます。
+func (s *Storage) Put(ctx context.Context, p string, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	name := path.Base(p)
+	if reserved(name) {
+		return nil, s.wrapErr("put", p, fmt.Errorf("%w: %s と %s で終わる名前は compress が使うため置けません",
+			storage.ErrUnsupported, metaExt, partialExt))
+	}
+
+	old, err := s.lookup(ctx, "put", p)
+	if err != nil {
+		return nil, err
+	}
+
+	hw, sum, err := storage.MultiHasher(hashTypes...)
+	if err != nil {
+		return nil, err
+	}
+	counter := &countingReader{r: io.TeeReader(r, hw)}
+
+	var data string
+	if shouldCompress(name, meta.MIMEType) {
+		data, err = s.putCompressed(ctx, p, counter, meta)
+	} else {
+		data = p
+		_, err = s.inner.Put(ctx, data, counter, meta)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &sidecar{Data: path.Base(data), Size: counter.n, Hashes: sum()}
+	if data != p {
+		m.Algorithm = s.algorithm
+	}
+	if err := s.writeSidecar(ctx, p, m); err != nil {
+		if data != old.data {
+			s.inner.Remove(context.WithoutCancel(ctx), data)
+		}
+		return nil, err
+	}
+	if old.meta != nil && old.data != data {
+		if err := s.inner.Remove(ctx, old.data); err != nil && !storage.IsNotFound(err) {
+			return nil, err
+		}
+	}
+
+	fi, err := s.inner.Stat(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	return s.info(fi, p, &object{data: data, meta: m}), nil
+}
+
+// putCompressed は r を圧縮して書き、本体のパスを返します。
+//
+// 本体の名前には元の大きさが入るので、大きさが分からないときは
+// 書きかけの名前で書いてから移します。申告された大きさと実際が
+// 違ったときも同じです。
+func (s *Storage) putCompressed(ctx context.Context, p string, r *countingReader, meta storage.ObjectMeta) (string, error) {
+	dir, name := path.Split(p)
+	dst := path.Join(dir, compressedName(name, meta.Size))
+	if meta.Size < 0 {
+		dst = p + "." + strconv.FormatInt(time.Now().UnixNano(), 36) + partialExt
+	}
+
+	pr, pw := io.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		zw, err := newWriter(s.algorithm, s.level, pw)
+		if err == nil {
+			if _, err = io.Copy(zw, r); err == nil {
+				err = zw.Close()
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+
+	_, err := s.inner.Put(ctx, dst, pr, storage.ObjectMeta{
+		Size:     storage.SizeUnknown,
+		ModTime:  meta.ModTime,
+		MIMEType: contentType(s.algorithm),
+	})
+	// 下のストレージが途中でやめたときに、圧縮する側を止める。
+	pr.CloseWithError(errors.New("書き込みが終わりました"))
+	wg.Wait()
+	if err != nil {
+		return "", err
+	}
+
+	final := path.Join(dir, compressedName(name, r.n))
+	if final == dst {
+		return dst, nil
+	}
+	if err := storage.Move(ctx, s.inner, dst, final); err != nil {
+		s.inner.Remove(context.WithoutCancel(ctx), dst)
+		return "", err
+	}
+	return final, nil
+}
+
+// Mkdir はディレクトリを作ります。
+func (s *Storage) Mkdir(ctx context.Context, dir string) error {
+	return s.inner.Mkdir(ctx, dir)
+}
+
+// Remove は1つのファイル、または空のディレクトリを削除します。
+func (s *Storage) Remove(ctx context.Context, p string) error {
+	p = storage.CleanPath(p)
+	o, err := s.lookup(ctx, "remove", p)
+	if err != nil {
+		return err
+	}
+	if o.meta == nil {
+		return s.inner.Remove(ctx, o.data)
+	}
+	if err := s.inner.Remove(ctx, o.data); err != nil && !storage.IsNotFound(err) {
+		return err
+	}
+	return s.inner.Remove(ctx, p+metaExt)
+}
+
+// --- 下のストレージが持っていれば使える能力 ---
+
+// Hash は元の内容のハッシュを返します。
+//
+// 控えにあればそれを返します。控えの無いものや、控えに無い種類は
+// 内容を読んで求めます。
+func (s *Storage) Hash(ctx context.Context, p string, ht storage.HashType) (string, error) {
+	p = storage.CleanPath(p)
+	o, err := s.lookup(ctx, "hash", p)
+	if err != nil {
+		return "", err
+	}
+	if o.meta != nil {
+		if h, ok := o.meta.Hashes[ht]; ok && h != "" {
+			return h, nil
+		}
+	}
+
+	h, err := storage.NewHash(ht)
+	if err != nil {
+		return "", err
+	}
+	rc, fi, err := s.Open(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	if fi.IsDir {
+		return "", s.wrapErr("hash", p, storage.ErrIsDir)
+	}
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", s.wrapErr("hash", p, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// relocate は src の本体と控えを dst へ移すかコピーします。
+// transfer は下のストレージでの本体の移動かコピーです。
+func (s *Storage) relocate(ctx context.Context, op, srcPath, dstPath string, transfer func(src, dst string) error) (*object, error) {
+	srcPath = storage.CleanPath(srcPath)
+	dstPath = storage.CleanPath(dstPath)
+	if reserved(path.Base(dstPath)) {
+		return nil, s.wrapErr(op, dstPath, fmt.Errorf("%w: %s", storage.ErrUnsupported, dstPath))
+	}
+	src, err := s.lookup(ctx, op, srcPath)
+	if err != nil {
+		return nil, err
+	}
+	old, err := s.lookup(ctx, op, dstPath)
+	if err != nil {
+		return nil, err
+	}
+
+	moved := &object{data: dstPath}
+	if src.meta == nil {
+		// 控えの無いもの（ディレクトリを含む）は、そのまま移す。
+		if err := transfer(srcPath, dstPath); err != nil {
+			return nil, err
+		}
+	} else {
+		dstName := path.Base(dstPath)
+		if src.compressed() {
+			dstName = compressedName(dstName, src.meta.Size)
+		}
+		m := *src.meta
+		m.Data = dstName
+		moved = &object{data: path.Join(path.Dir(dstPath), dstName), meta: &m}
+		if err := transfer(src.data, moved.data); err != nil {
+			return nil, err
+		}
+		if err := s.writeSidecar(ctx, dstPath, &m); err != nil {
+			return nil, err
+		}
+	}
+
+	// 移した先にあったものの本体と控えを片付ける。
+	if old.meta != nil {
+		if old.data != moved.data {
+			if err := s.inner.Remove(ctx, old.data); err != nil && !storage.IsNotFound(err) {
+				return nil, err
+			}
+		}
+		if moved.meta == nil {
+			if err := s.inner.Remove(ctx, dstPath+metaExt); err != nil && !storage.IsNotFound(err) {
+				return nil, err
+			}
+		}
+	}
+	return moved, nil
+}
+
+// ServerSideCopy は圧縮したまま本体をコピーし、控えを書き直します。
+func (s *Storage) ServerSideCopy(ctx context.Context, srcPath, dstPath string) (*storage.FileInfo, error) {
+	o, err := s.relocate(ctx, "copy", srcPath, dstPath, func(src, dst string) error {
+		_, err := storage.ServerSideCopy(ctx, s.inner, s.inner, src, dst)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	fi, err := s.inner.Stat(ctx, o.data)
+	if err != nil {
+		return nil, err
+	}
+	return s.info(fi, storage.CleanPath(dstPath), o), nil
+}
+
+// Move は圧縮したまま本体を移動し、控えを移します。
+func (s *Storage) Move(ctx context.Context, srcPath, dstPath string) error {
+	o, err := s.relocate(ctx, "move", srcPath, dstPath, func(src, dst string) error {
+		return storage.Move(ctx, s.inner, src, dst)
+	})
+	if err != nil {
+		return err
+	}
+	if o.meta != nil {
+		return s.inner.Remove(ctx, storage.CleanPath(srcPath)+metaExt)
+	}
+	return nil
+}
+
+// Purge はディレクトリを中身ごと削除します。
+func (s *Storage) Purge(ctx context.Context, dir string) error {
+	return storage.PurgeAll(ctx, s.inner, dir)
+}
+
+// SetModTime は本体の最終更新時刻を変更します。
+func (s *Storage) SetModTime(ctx context.Context, p string, t time.Time) error {
+	p = storage.CleanPath(p)
+	o, err := s.lookup(ctx, "setmodtime", p)
+	if err != nil {
+		return err
+	}
+	return storage.SetModTime(ctx, s.inner, o.data, t)
+}
+
+// About は下のストレージの使用量を返します。圧縮したあとの大きさで数えます。
+func (s *Storage) About(ctx context.Context, p string) (*storage.Usage, error) {
+	return storage.About(ctx, s.inner, p)
+}
+
+// countingReader は読んだバイト数を数えます。
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readCloser は展開する側と、下のストレージから読む側をまとめて閉じます。
+type readCloser struct {
+	io.ReadCloser
+	inner io.Closer
+}
+
+func (r readCloser) Close() error {
+	r.ReadCloser.Close()
+	return r.inner.Close()
+}
+
+var (
+	_ storage.Storage            = (*Storage)(nil)
+	_ storage.CapabilityReporter = (*Storage)(nil)
+	_ storage.Permitter          = (*Storage)(nil)
+	_ storage.Hasher             = (*Storage)(nil)
+	_ storage.ServerSideCopier   = (*Storage)(nil)
+	_ storage.Mover              = (*Storage)(nil)
+	_ storage.Purger             = (*Storage)(nil)
+	_ storage.SetModTimer        = (*Storage)(nil)
+	_ storage.RecursiveLister    = (*Storage)(nil)
+	_ storage.Abouter            = (*Storage)(nil)
+)
@@ -0,0 +1,190 @@
+package compress_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/backend/compress"
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/storage"
+	"github.com/mt3hr/hbg/storage/storagetest"
+)
+
+// newCompress は、メモリの /packed に圧縮したものを置く compress を設定から組み立てます。
+func newCompress(t *testing.T) (storage.Storage, *memory.Storage) {
+	t.Helper()
+	r, err := backend.NewResolver([]backend.Entry{
+		{Name: "mem", Type: memory.Type},
+		{Name: "archive", Type: compress.Type, Params: backend.Params{"remote": "mem:/packed"}},
+	})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	ctx := context.Background()
+	s, err := r.Get(ctx, "archive")
+	if err != nil {
+		t.Fatalf("Get(archive): %v", err)
+	}
+	inner, err := r.Get(ctx, "mem")
+	if err != nil {
+		t.Fatalf("Get(mem): %v", err)
+	}
+	return s, inner.(*memory.Storage)
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Harness{
+		NewStorage: func(t *testing.T) (storage.Storage, string) {
+			s, _ := newCompress(t)
+			return s, "/root"
+		},
+	})
+}
+
+func put(t *testing.T, s storage.Storage, p, content string, meta storage.ObjectMeta) {
+	t.Helper()
+	if _, err := s.Put(context.Background(), p, strings.NewReader(content), meta); err != nil {
+		t.Fatalf("Put(%s): %v", p, err)
+	}
+}
+
+// innerSize は下のストレージに置かれた本体の大きさを返します。控えは数えません。
+func innerSize(snap map[string]string) int {
+	var n int
+	for p, content := range snap {
+		if !strings.HasSuffix(p, ".hbgmeta") {
+			n += len(content)
+		}
+	}
+	return n
+}
+
+// よく縮む内容は縮めて置き、一覧と Stat には元の大きさが出ることを確認します。
+func TestCompressesAndReportsOriginalSize(t *testing.T) {
+	ctx := context.Background()
+	content := strings.Repeat("同じ行の繰り返し\n", 10000)
+
+	for _, size := range []int64{int64(len(content)), storage.SizeUnknown} {
+		s, inner := newCompress(t)
+		put(t, s, "/log/app.log", content, storage.ObjectMeta{Size: size})
+
+		if got := innerSize(inner.Snapshot()); got*10 > len(content) {
+			t.Errorf("大きさ %d で書いたら下に %d バイト置かれた（元は %d バイト）", size, got, len(content))
+		}
+
+		entries, err := storage.ListAll(ctx, s, "/log")
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if len(entries) != 1 || entries[0].Name != "app.log" || entries[0].Size != int64(len(content)) {
+			t.Errorf("一覧 = %v, want app.log（%d バイト）だけ", entries, len(content))
+		}
+		fi, err := s.Stat(ctx, "/log/app.log")
+		if err != nil || fi.Size != int64(len(content)) {
+			t.Errorf("Stat = %v, %v, want 大きさ %d", fi, err, len(content))
+		}
+
+		rc, _, err := s.Open(ctx, "/log/app.log")
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(got) != content {
+			t.Errorf("読んだ内容が違う（%d バイト, %v）", len(got), err)
+		}
+	}
+}
+
+// すでに圧縮されている形式は、拡張子か内容の種類で見分けてそのまま置くことを確認します。
+func TestSkipsCompressedTypes(t *testing.T) {
+	content := strings.Repeat("x", 4096)
+	for _, tt := range []struct {
+		path string
+		meta storage.ObjectMeta
+	}{
+		{"/photo.JPG", storage.ObjectMeta{}},
+		{"/backup.tar.gz", storage.ObjectMeta{}},
+		{"/拡張子なし", storage.ObjectMeta{MIMEType: "video/mp4"}},
+		{"/data.bin", storage.ObjectMeta{MIMEType: "application/zip"}},
+	} {
+		s, inner := newCompress(t)
+		tt.meta.Size = int64(len(content))
+		put(t, s, tt.path, content, tt.meta)
+
+		if got := inner.Snapshot()["/packed"+tt.path]; got != content {
+			t.Errorf("%s がそのまま置かれていない", tt.path)
+		}
+	}
+}
+
+// compress を通さずに置かれたものも読めて、控えに使う名前は置けないことを確認します。
+func TestPlainAndReservedNames(t *testing.T) {
+	ctx := context.Background()
+	s, inner := newCompress(t)
+	put(t, inner, "/packed/readme.txt", "平文", storage.ObjectMeta{Size: int64(len("平文"))})
+
+	fi, err := s.Stat(ctx, "/readme.txt")
+	if err != nil || fi.Size != int64(len("平文")) {
+		t.Errorf("Stat = %v, %v", fi, err)
+	}
+	if h, err := storage.GetHash(ctx, s, fi, storage.SHA256); err != nil || h == "" {
+		t.Errorf("控えの無いもののハッシュ = %q, %v", h, err)
+	}
+
+	if _, err := s.Put(ctx, "/a.hbgmeta", strings.NewReader("x"), storage.ObjectMeta{Size: 1}); err == nil {
+		t.Error("控えと同じ名前のファイルが置けてしまった")
+	}
+}
+
+// zstd で書いたものが zstd で置かれ、形式を gzip に戻しても読めることを確認します。
+func TestAlgorithm(t *testing.T) {
+	ctx := context.Background()
+	content := strings.Repeat("同じ行の繰り返し\n", 10000)
+	inner := memory.New("mem")
+
+	z, err := compress.New("archive", inner, compress.Config{Algorithm: compress.Zstd, Level: 19})
+	if err != nil {
+		t.Fatalf("New(zstd): %v", err)
+	}
+	put(t, z, "/app.log", content, storage.ObjectMeta{Size: int64(len(content))})
+
+	var body string
+	for p, c := range inner.Snapshot() {
+		if strings.HasSuffix(p, ".hbgz") {
+			body = c
+		}
+	}
+	if !strings.HasPrefix(body, "\x28\xb5\x2f\xfd") || len(body)*10 > len(content) {
+		t.Errorf("本体が zstd で縮められていない（%d バイト, 先頭 %q）", len(body), body[:min(4, len(body))])
+	}
+
+	g, err := compress.New("archive", inner, compress.Config{})
+	if err != nil {
+		t.Fatalf("New(gzip): %v", err)
+	}
+	rc, _, err := g.Open(ctx, "/app.log")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(got) != content {
+		t.Errorf("形式を変えたら読めない（%d バイト, %v）", len(got), err)
+	}
+
+	for _, cfg := range []compress.Config{
+		{Algorithm: "lz4"},
+		{Level: 19},
+		{Algorithm: compress.Zstd, Level: 23},
+	} {
+		if _, err := compress.New("archive", inner, cfg); err == nil {
+			t.Errorf("New(%+v) が通ってしまった", cfg)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package compress
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// 下のストレージには、1つのファイルにつき2つを置きます。
+//
+//	名前.<元の大きさの16進>.hbgz   圧縮した本体
+//	名前                          圧縮しないと決めたものの本体
+//	名前.hbgmeta                  控え（本体の名前・元の大きさ・ハッシュ・圧縮の形式）
+//
+// 元の大きさを本体の名前に入れておくのは、一覧のたびに控えを1件ずつ
+// 読まずに済ませるためです。控えは Stat・Open・Hash のときに本体を
+// 引くのと、ハッシュを返すのに使います。更新時刻は本体にそのまま
+// 付けるので、控えには入れません。
+const (
+	compressedExt = ".hbgz"
+	metaExt       = ".hbgmeta"
+	// partialExt は、大きさが分からないまま圧縮して書いている途中の本体です。
+	// 書き終えて大きさが分かってから、本来の名前へ移します。
+	partialExt = ".hbgz-part"
+)
+
+// sidecar は控えの中身です。
+type sidecar struct {
+	// Data は本体の名前です。ディレクトリは含みません。
+	Data string `json:"data"`
+	// Size は元の大きさです。
+	Size int64 `json:"size"`
+	// Hashes は元の内容のハッシュです。
+	Hashes map[storage.HashType]string `json:"hashes,omitempty"`
+	// Algorithm は本体の圧縮の形式です。圧縮していない本体なら空です。
+	Algorithm string `json:"algorithm,omitempty"`
+}
+
+// algorithm は本体を展開する形式を返します。
+// 形式を書いていない控えは、gzip しか無かったころのものです。
+func (m *sidecar) algorithm() string {
+	if m.Algorithm == "" {
+		return Gzip
+	}
+	return m.Algorithm
+}
+
+// compressedName は圧縮した本体の名前を返します。
+func compressedName(name string, size int64) string {
+	return name + "." + strconv.FormatInt(size, 16) + compressedExt
+}
+
+// parseName は下のストレージでの名前を元の名前に戻します。
+// 控えと書きかけなら ok が偽です。圧縮した本体なら size に元の大きさが入り、
+// そうでなければ -1 です。
+func parseName(inner string) (name string, size int64, ok bool) {
+	if reserved(inner) {
+		return "", 0, false
+	}
+	if base, found := strings.CutSuffix(inner, compressedExt); found {
+		if i := strings.LastIndexByte(base, '.'); i > 0 {
+			if n, err := strconv.ParseInt(base[i+1:], 16, 64); err == nil && n >= 0 {
+				return base[:i], n, true
+			}
+		}
+	}
+	return inner, -1, true
+}
+
+// reserved は、compress が下のストレージで自分のために使う名前かを返します。
+// この名前のファイルは置けません。
+func reserved(name string) bool {
+	return strings.HasSuffix(name, metaExt) || strings.HasSuffix(name, partialExt)
+}
+
+// readSidecar は p の控えを読みます。無ければ ErrNotFound を含むエラーを返します。
+func (s *Storage) readSidecar(ctx context.Context, p string) (*sidecar, error) {
+	rc, _, err := s.inner.Open(ctx, p+metaExt)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var m sidecar
+	if err := json.NewDecoder(io.LimitReader(rc, 1<<16)).Decode(&m); err != nil {
+		return nil, s.wrapErr("stat", p, fmt.Errorf("控え %s を読めません: %w", p+metaExt, err))
+	}
+	if m.Data == "" || strings.Contains(m.Data, "/") {
+		return nil, s.wrapErr("stat", p, fmt.Errorf("控え %s の本体の名前が変です: %q", p+metaExt, m.Data))
+	}
+	return &m, nil
+}
+
+// writeSidecar は p の控えを書きます。
+func (s *Storage) writeSidecar(ctx context.Context, p string, m *sidecar) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = s.inner.Put(ctx, p+metaExt, strings.NewReader(string(data)), storage.ObjectMeta{
+		Size:     int64(len(data)),
+		MIMEType: "application/json",
+	})
+	return err
+}
+
+// dataPath は控えが指す本体のパスを返します。
+func dataPath(p string, m *sidecar) string {
+	return path.Join(path.Dir(p), m.Data)
+}
+
+// --- 圧縮するかどうか ---
+
+// incompressibleExts は、すでに圧縮されていて、縮まない形式の拡張子です。
+// 圧縮し直しても CPU を使うだけで、かえって少し大きくなります。
+var incompressibleExts = map[string]bool{
+	// 書庫・圧縮
+	".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".lz4": true,
+	".br": true, ".zip": true, ".7z": true, ".rar": true, ".jar": true, ".apk": true,
+	// 画像
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".heic": true, ".heif": true, ".avif": true,
+	// 音声・動画
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".opus": true, ".flac": true,
+	".mp4": true, ".m4v": true, ".mov": true, ".mkv": true, ".webm": true, ".avi": true,
+	// 中身が zip の文書
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".ods": true, ".epub": true,
+}
+
+// incompressibleMIMEs は、すでに圧縮されている application/ の種類です。
+// image/・video/・audio/ はまとめて圧縮しません。
+var incompressibleMIMEs = map[string]bool{
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/zstd":             true,
+	"application/x-7z-compressed":  true,
+	"application/vnd.rar":          true,
+	"application/x-rar-compressed": true,
+}
+
+// shouldCompress は、name の内容を圧縮するかを決めます。
+//
+// 拡張子か、分かっていれば内容の種類で決めます。内容を読んで
+// 確かめないのは、読み始めてからでは置き場所（本体の名前）を
+// 変えられないためです。
+func shouldCompress(name, mimeType string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == compressedExt {
+		// 圧縮した本体と取り違えないよう、この拡張子は必ず圧縮して名前を変える。
+		return true
+	}
+	if incompressibleExts[ext] {
+		return false
+	}
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		if incompressibleMIMEs[mediaType] {
+			return false
+		}
+		switch mediaType[:strings.IndexByte(mediaType, '/')] {
+		case "image", "video", "audio":
+			// SVG は文字なのでよく縮む。
+			return mediaType == "image/svg+xml"
+		}
+	}
+	return true
+}
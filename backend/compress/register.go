@@ -0,0 +1,48 @@
+package compress
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/storage"
+)
+
+func init() {
+	backend.Register(backend.Descriptor{
+		Type:    Type,
+		Summary: "他のストレージの上に重ねて、内容を圧縮して置く",
+		ConfigDoc: `  # - name: archive
+  #   type: compress
+  #   remote: s3:/archive  # 圧縮したものを置く場所（設定にあるストレージ名:パス）
+  #   algorithm: gzip  # 省略可。gzip か zstd。変えても前に書いたものは読める
+  #   level: 6  # 省略可。1（速い）〜9（よく縮む）。zstd は 1〜22
+`,
+		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
+			remote := params.Get("remote")
+			if remote == "" {
+				return nil, fmt.Errorf("compress %s: remote が設定されていません", name)
+			}
+
+			cfg := Config{Algorithm: params.Get("algorithm")}
+			if v := params.Get("level"); v != "" {
+				level, err := strconv.Atoi(v)
+				if err != nil {
+					return nil, fmt.Errorf("compress %s: level は数で指定してください（%q が指定されました）", name, v)
+				}
+				cfg.Level = level
+			}
+
+			inner, err := backend.Remote(ctx, remote)
+			if err != nil {
+				return nil, fmt.Errorf("compress %s: %w", name, err)
+			}
+			s, err := New(name, inner, cfg)
+			if err != nil {
+				return nil, fmt.Errorf("compress %s: %w", name, err)
+			}
+			return s, nil
+		},
+	})
+}
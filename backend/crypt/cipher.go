@@ -0,0 +1,362 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// 暗号化したファイルの形式です。
+//
+//	ヘッダー: magic（8バイト）+ nonce（24バイト）
+//	本体:     平文を blockSize ごとに区切り、それぞれを secretbox で封じたもの
+//
+// 1つの塊の nonce は、ヘッダーの nonce に塊の番号を足したものです。
+// 塊ごとに独立して開けるので、途中から読むときは、その位置を含む
+// 塊から読めば済みます。ファイル全体を読み直す必要はありません。
+//
+// 塊の並べ替えや差し替えは、nonce が合わなくなるので開けずに分かります。
+// 末尾の塊をまとめて切り落とされたことは分かりません。サイズは一覧の
+// 値から計算するので、転送の検証で食い違いとして表れます。
+const (
+	magic      = "HBGCRYPT"
+	nonceSize  = 24
+	headerSize = len(magic) + nonceSize
+	// blockSize は平文の塊の大きさです。
+	blockSize = 64 * 1024
+	// blockOverhead は塊ごとに増える認証子の大きさです。
+	blockOverhead = secretbox.Overhead
+	sealedSize    = blockSize + blockOverhead
+)
+
+// defaultSalt は password2 を指定しないときの塩です。
+//
+// 塩を設定ごとに変えれば、同じパスワードから同じ鍵が出ることを防げます。
+// ただ、塩を失うと復号できなくなるので、既定では固定の値を使います。
+var defaultSalt = []byte{
+	0x68, 0x62, 0x67, 0x2d, 0x63, 0x72, 0x79, 0x70,
+	0x74, 0xa7, 0x1d, 0x3e, 0x92, 0x5c, 0x0b, 0xf4,
+}
+
+// scrypt の強さです。鍵を導くのは組み立てのときの1回だけなので、
+// 数十ミリ秒かかっても構いません。
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// ErrDecrypt は、復号できなかったことを表します。
+// パスワードが違うか、暗号化した内容が壊れています。
+var ErrDecrypt = errors.New("復号できません（パスワードが違うか、内容が壊れています）")
+
+// nameEncoding はファイル名の符号化です。
+//
+// 小文字だけを使うので、大文字小文字を区別しないストレージでも
+// 別の名前どうしがぶつかりません。
+var nameEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// keys は1つのパスワードから導いた鍵の組です。
+type keys struct {
+	data    [32]byte
+	name    [32]byte
+	nameMAC [32]byte
+}
+
+// deriveKeys はパスワードと塩から鍵を導きます。
+func deriveKeys(password, salt string) (*keys, error) {
+	if password == "" {
+		return nil, errors.New("password が設定されていません")
+	}
+	s := defaultSalt
+	if salt != "" {
+		s = []byte(salt)
+	}
+	material, err := scrypt.Key([]byte(password), s, scryptN, scryptR, scryptP, 96)
+	if err != nil {
+		return nil, fmt.Errorf("鍵を導けません: %w", err)
+	}
+	k := &keys{}
+	copy(k.data[:], material[:32])
+	copy(k.name[:], material[32:64])
+	copy(k.nameMAC[:], material[64:])
+	return k, nil
+}
+
+// --- 大きさの換算 ---
+
+// encryptedSize は平文の大きさから、暗号化したあとの大きさを求めます。
+func encryptedSize(size int64) int64 {
+	if size < 0 {
+		return size
+	}
+	full := size / blockSize
+	out := int64(headerSize) + full*sealedSize
+	if rest := size % blockSize; rest > 0 {
+		out += rest + blockOverhead
+	}
+	return out
+}
+
+// decryptedSize は暗号化したあとの大きさから、平文の大きさを求めます。
+// この形式ではありえない大きさなら偽を返します。
+func decryptedSize(size int64) (int64, bool) {
+	if size < 0 {
+		return size, true
+	}
+	size -= int64(headerSize)
+	if size < 0 {
+		return 0, false
+	}
+	full := size / sealedSize
+	out := full * blockSize
+	if rest := size % sealedSize; rest > 0 {
+		if rest <= blockOverhead {
+			return 0, false
+		}
+		out += rest - blockOverhead
+	}
+	return out, true
+}
+
+// plainSizeWithin は、暗号化したあとが limit に収まる平文の大きさの上限を求めます。
+func plainSizeWithin(limit int64) int64 {
+	body := limit - int64(headerSize)
+	if body <= 0 {
+		return 0
+	}
+	out := body / sealedSize * blockSize
+	if rest := body % sealedSize; rest > blockOverhead {
+		out += rest - blockOverhead
+	}
+	return out
+}
+
+// --- 内容 ---
+
+// blockNonce は index 番目の塊の nonce を返します。
+// base を24バイトのリトルエンディアンの数とみなして index を足します。
+func blockNonce(base *[nonceSize]byte, index uint64) *[nonceSize]byte {
+	n := *base
+	carry := index
+	for i := 0; i < nonceSize && carry > 0; i++ {
+		sum := uint64(n[i]) + carry&0xff
+		n[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	return &n
+}
+
+// encrypter は平文を読みながら暗号文を返す Reader です。
+type encrypter struct {
+	src   io.Reader
+	key   *[32]byte
+	nonce [nonceSize]byte
+	index uint64
+
+	plain  []byte
+	sealed []byte
+	out    []byte
+	// err は src が返した終わりか失敗です。
+	err error
+}
+
+// newNonce はファイル1つぶんの nonce を作ります。
+func newNonce() (*[nonceSize]byte, error) {
+	var n [nonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, n[:]); err != nil {
+		return nil, fmt.Errorf("nonce を作れません: %w", err)
+	}
+	return &n, nil
+}
+
+func newEncrypter(src io.Reader, k *keys, nonce *[nonceSize]byte) *encrypter {
+	e := &encrypter{
+		src:    src,
+		key:    &k.data,
+		nonce:  *nonce,
+		plain:  make([]byte, blockSize),
+		sealed: make([]byte, 0, sealedSize),
+	}
+	e.out = append([]byte(magic), e.nonce[:]...)
+	return e
+}
+
+func (e *encrypter) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		n, err := io.ReadFull(e.src, e.plain)
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			e.err = io.EOF
+		default:
+			e.err = err
+			return 0, err
+		}
+		if n > 0 {
+			e.out = secretbox.Seal(e.sealed[:0], e.plain[:n], blockNonce(&e.nonce, e.index), e.key)
+			e.index++
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// readHeader はヘッダーを読み、nonce を返します。
+func readHeader(r io.Reader) (*[nonceSize]byte, error) {
+	var buf [headerSize]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: ヘッダーが足りません", ErrDecrypt)
+		}
+		return nil, err
+	}
+	if string(buf[:len(magic)]) != magic {
+		return nil, fmt.Errorf("%w: crypt で暗号化したファイルではありません", ErrDecrypt)
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], buf[len(magic):])
+	return &nonce, nil
+}
+
+// decrypter は暗号文を読みながら平文を返す Reader です。
+// 読み始めの位置は塊の区切りです。
+type decrypter struct {
+	src   io.Reader
+	key   *[32]byte
+	nonce *[nonceSize]byte
+	index uint64
+
+	sealed []byte
+	plain  []byte
+	out    []byte
+	// skip は最初の塊の頭から読み飛ばす大きさです。
+	skip int
+	err  error
+}
+
+func newDecrypter(src io.Reader, k *keys, nonce *[nonceSize]byte, index uint64, skip int) *decrypter {
+	return &decrypter{
+		src:    src,
+		key:    &k.data,
+		nonce:  nonce,
+		index:  index,
+		sealed: make([]byte, sealedSize),
+		plain:  make([]byte, 0, blockSize),
+		skip:   skip,
+	}
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		n, err := io.ReadFull(d.src, d.sealed)
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			d.err = io.EOF
+		default:
+			d.err = err
+			return 0, err
+		}
+		if n == 0 {
+			continue
+		}
+		plain, ok := secretbox.Open(d.plain[:0], d.sealed[:n], blockNonce(d.nonce, d.index), d.key)
+		if !ok {
+			d.err = fmt.Errorf("%w: %d 番目の塊", ErrDecrypt, d.index)
+			return 0, d.err
+		}
+		d.index++
+		if d.skip > 0 {
+			s := min(d.skip, len(plain))
+			plain = plain[s:]
+			d.skip -= s
+		}
+		d.out = plain
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// --- 名前 ---
+
+// nameCipher はファイル名1つを暗号化します。
+//
+// 同じ名前はいつも同じ暗号文になる必要があります。そうでないと、
+// パスからファイルを引けません。そこで、名前から HMAC で求めた値を
+// 初期値にして AES-CTR で暗号化し、初期値を頭に付けます（SIV と同じ考え方）。
+// 復号したあとに初期値を求め直して、改ざんや取り違えを見つけます。
+type nameCipher struct {
+	block cipher.Block
+	mac   []byte
+}
+
+func newNameCipher(k *keys) (*nameCipher, error) {
+	block, err := aes.NewCipher(k.name[:])
+	if err != nil {
+		return nil, err
+	}
+	return &nameCipher{block: block, mac: k.nameMAC[:]}, nil
+}
+
+func (c *nameCipher) iv(name []byte) []byte {
+	m := hmac.New(sha256.New, c.mac)
+	m.Write(name)
+	return m.Sum(nil)[:aes.BlockSize]
+}
+
+func (c *nameCipher) encrypt(name string) string {
+	iv := c.iv([]byte(name))
+	out := make([]byte, aes.BlockSize+len(name))
+	copy(out, iv)
+	cipher.NewCTR(c.block, iv).XORKeyStream(out[aes.BlockSize:], []byte(name))
+	return strings.ToLower(nameEncoding.EncodeToString(out))
+}
+
+// encryptedNameLen は、n バイトの名前を暗号化したあとの長さです。
+// 初期値の 16 バイトが付き、base32 で 8/5 倍になります。
+func encryptedNameLen(n int) int {
+	return nameEncoding.EncodedLen(aes.BlockSize + n)
+}
+
+// plainNameWithin は、暗号化したあとが limit に収まる名前の長さの上限です。
+func plainNameWithin(limit int) int {
+	n := limit*5/8 - aes.BlockSize
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+func (c *nameCipher) decrypt(encoded string) (string, error) {
+	raw, err := nameEncoding.DecodeString(strings.ToUpper(encoded))
+	if err != nil || len(raw) <= aes.BlockSize {
+		return "", fmt.Errorf("%w: 名前 %q", ErrDecrypt, encoded)
+	}
+	iv, sealed := raw[:aes.BlockSize], raw[aes.BlockSize:]
+	name := make([]byte, len(sealed))
+	cipher.NewCTR(c.block, iv).XORKeyStream(name, sealed)
+	if !bytes.Equal(c.iv(name), iv) {
+		return "", fmt.Errorf("%w: 名前 %q", ErrDecrypt, encoded)
+	}
+	return string(name), nil
+}
@@ -0,0 +1,488 @@
+// Package crypt は、他のストレージの上に重ねて、内容と名前を暗号化する
+// ストレージです。
+//
+// 暗号化は手元で行い、下のストレージには暗号文だけを渡します。
+// 鍵は設定のパスワードから導くので、パスワードが同じなら別の端末からも
+// 同じものが読めます。形式は cipher.go を見てください。
+//
+// 下のストレージの能力（サーバー側コピーや移動、範囲読み出しなど）は
+// そのまま使えます。ハッシュだけは暗号文のものしか得られないので、
+// 申告しません。平文との照合は Verify で行います。
+package crypt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Type はこのバックエンドの種別名です。
+const Type = "crypt"
+
+// Config は crypt の設定です。
+type Config struct {
+	// Password は鍵を導くパスワードです。
+	Password string
+	// Salt は鍵を導くときの塩です。空なら固定の値を使います。
+	Salt string
+	// PlainNames を真にすると、ファイル名を暗号化しません。
+	// 名前の長さに制限のあるストレージで使います。
+	PlainNames bool
+}
+
+// Storage は内容と名前を暗号化して、下のストレージに置きます。
+type Storage struct {
+	name  string
+	inner storage.Storage
+	keys  *keys
+	// names はファイル名の暗号化です。名前を暗号化しないなら nil です。
+	names *nameCipher
+}
+
+// New は inner の上に重ねる crypt を作ります。
+//
+// inner は閉じません。閉じるのは inner を組み立てた側です。
+func New(name string, inner storage.Storage, cfg Config) (*Storage, error) {
+	k, err := deriveKeys(cfg.Password, cfg.Salt)
+	if err != nil {
+		return nil, err
+	}
+	s := &Storage{name: name, inner: inner, keys: k}
+	if !cfg.PlainNames {
+		if s.names, err = newNameCipher(k); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Type はストレージの種別を返します。
+func (s *Storage) Type() string { return Type }
+
+// Name は設定ファイルで付けた名前を返します。
+func (s *Storage) Name() string { return s.name }
+
+// Features はこのストレージにできることを返します。
+//
+// 時刻やディレクトリの扱いは下のストレージのとおりです。
+// 名前を暗号化すると、使える文字と大文字小文字の扱いは
+// 暗号文の側の問題になるので、制限はなくなります。
+// 名前の長さの上限は、暗号化で延びるぶん短くなります。
+func (s *Storage) Features() *storage.Features {
+	in := s.inner.Features()
+	f := &storage.Features{
+		ModTimePrecision: in.ModTimePrecision,
+		CanSetModTime:    in.CanSetModTime,
+		CaseInsensitive:  in.CaseInsensitive,
+		ImplicitDirs:     in.ImplicitDirs,
+		EmptyDirs:        in.EmptyDirs,
+		AtomicPut:        in.AtomicPut,
+		IllegalChars:     in.IllegalChars,
+	}
+	if s.names != nil {
+		f.CaseInsensitive = false
+		f.IllegalChars = ""
+	}
+	if in.MaxNameLength > 0 {
+		f.MaxNameLength = in.MaxNameLength
+		if s.names != nil {
+			f.MaxNameLength = plainNameWithin(in.MaxNameLength)
+		}
+	}
+	if in.MaxFileSize > 0 {
+		f.MaxFileSize = plainSizeWithin(in.MaxFileSize)
+	}
+	return f
+}
+
+// Supports は、下のストレージで使える能力だけを使えると答えます。
+// ハッシュは下のストレージでは暗号文のものになるので、使えません。
+// 平文との照合は自分で行うので、下のストレージによらず使えます。
+func (s *Storage) Supports(c storage.Capability) bool {
+	switch c {
+	case storage.CapHash:
+		return false
+	case storage.CapVerify:
+		return true
+	}
+	return storage.Supports(s.inner, c)
+}
+
+// Close は何もしません。下のストレージは組み立てた側が閉じます。
+func (s *Storage) Close() error { return nil }
+
+// Permit は下のストレージで op が許されているかを返します。
+func (s *Storage) Permit(op string) error { return storage.Permit(s.inner, op) }
+
+func (s *Storage) wrapErr(op, p string, err error) error {
+	return storage.Wrap(op, s.name, p, storage.ClassOf(err), err)
+}
+
+// --- パスと名前 ---
+
+// encryptPath は下のストレージでのパスを返します。
+func (s *Storage) encryptPath(p string) string {
+	p = storage.CleanPath(p)
+	if s.names == nil || p == "/" {
+		return p
+	}
+	parts := strings.Split(p[1:], "/")
+	for i, part := range parts {
+		parts[i] = s.names.encrypt(part)
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// checkNames は、p の名前を暗号化したものが、下のストレージの名前の
+// 長さの上限に収まるかを確かめます。
+//
+// 暗号化した名前は平文のおよそ 1.6 倍に初期値のぶんを足した長さになるので、
+// 平文では収まる名前でも、下のストレージでは長すぎることがあります。
+// 書き込む前に断らないと、下のストレージから何の名前のことか分からない
+// エラーが返るだけになります。
+func (s *Storage) checkNames(op, p string) error {
+	limit := s.inner.Features().MaxNameLength
+	if s.names == nil || limit <= 0 {
+		return nil
+	}
+	p = storage.CleanPath(p)
+	if p == "/" {
+		return nil
+	}
+	for _, part := range strings.Split(p[1:], "/") {
+		if n := encryptedNameLen(len(part)); n > limit {
+			return storage.Wrap(op, s.name, p, storage.ClassPermanent, fmt.Errorf(
+				"名前 %q は暗号化すると %d バイトになり、%s の上限 %d バイトを超えます（平文で %d バイトまで）",
+				part, n, s.inner.Type(), limit, plainNameWithin(limit)))
+		}
+	}
+	return nil
+}
+
+// decryptName は下のストレージでの名前を平文に戻します。
+func (s *Storage) decryptName(name string) (string, error) {
+	if s.names == nil {
+		return name, nil
+	}
+	return s.names.decrypt(name)
+}
+
+// info は下のストレージのメタデータを、平文の側のものに直します。
+// plainPath は平文でのパスです。
+func (s *Storage) info(fi *storage.FileInfo, plainPath string) (*storage.FileInfo, error) {
+	out := storage.FileInfo{
+		Path:    plainPath,
+		Name:    path.Base(plainPath),
+		IsDir:   fi.IsDir,
+		Size:    fi.Size,
+		ModTime: fi.ModTime,
+		ID:      fi.ID,
+	}
+	if !fi.IsDir {
+		size, ok := decryptedSize(fi.Size)
+		if !ok {
+			return nil, fmt.Errorf("%w: 大きさ %d は暗号化したファイルのものではありません", ErrDecrypt, fi.Size)
+		}
+		out.Size = size
+	}
+	return &out, nil
+}
+
+// listed は一覧で届いた1件を平文の側に直します。
+// 復号できないもの（crypt を通さずに置かれたものなど）は偽を返します。
+func (s *Storage) listed(fi storage.FileInfo, plainDir string) (storage.FileInfo, bool) {
+	name, err := s.decryptName(fi.Name)
+	if err != nil {
+		return storage.FileInfo{}, false
+	}
+	out, err := s.info(&fi, path.Join(plainDir, name))
+	if err != nil {
+		return storage.FileInfo{}, false
+	}
+	return *out, true
+}
+
+// --- Storage ---
+
+// List は dir の直下にあるものを、名前を復号して fn に渡します。
+//
+// 名前を復号できないものは、crypt を通さずに置かれたものとみなして飛ばします。
+func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	dir = storage.CleanPath(dir)
+	return s.inner.List(ctx, s.encryptPath(dir), func(fi storage.FileInfo) error {
+		out, ok := s.listed(fi, dir)
+		if !ok {
+			return nil
+		}
+		return fn(out)
+	})
+}
+
+// Stat は1件のメタデータを返します。
+func (s *Storage) Stat(ctx context.Context, p string) (*storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	fi, err := s.inner.Stat(ctx, s.encryptPath(p))
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.info(fi, p)
+	if err != nil {
+		return nil, s.wrapErr("stat", p, err)
+	}
+	return out, nil
+}
+
+// Open は内容を復号しながら読む ReadCloser を返します。
+func (s *Storage) Open(ctx context.Context, p string) (io.ReadCloser, *storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	rc, fi, err := s.inner.Open(ctx, s.encryptPath(p))
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := s.info(fi, p)
+	if err != nil {
+		rc.Close()
+		return nil, nil, s.wrapErr("open", p, err)
+	}
+	nonce, err := readHeader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, nil, s.wrapErr("open", p, err)
+	}
+	return readCloser{newDecrypter(rc, s.keys, nonce, 0, 0), rc}, info, nil
+}
+
+// OpenRange は offset から length バイトを復号して読みます。
+// length が負なら末尾までです。
+//
+// 下のストレージが範囲読み出しできれば、ヘッダーと、offset を含む塊から
+// 先だけを読みます。できなければ頭から読んで読み捨てます。
+func (s *Storage) OpenRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	p = storage.CleanPath(p)
+	enc := s.encryptPath(p)
+	index := offset / blockSize
+	start := int64(headerSize) + index*sealedSize
+	skip := int(offset % blockSize)
+
+	var (
+		nonce *[nonceSize]byte
+		rc    io.ReadCloser
+		err   error
+	)
+	if storage.Supports(s.inner, storage.CapRangeOpen) {
+		nonce, err = s.readNonce(ctx, enc)
+		if err != nil {
+			return nil, s.wrapErr("open", p, err)
+		}
+		sealedLength := int64(-1)
+		if length >= 0 {
+			end := (offset + length + blockSize - 1) / blockSize
+			sealedLength = (end - index) * sealedSize
+		}
+		rc, err = storage.OpenRange(ctx, s.inner, enc, start, sealedLength)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		rc, _, err = s.inner.Open(ctx, enc)
+		if err != nil {
+			return nil, err
+		}
+		if nonce, err = readHeader(rc); err == nil {
+			_, err = io.CopyN(io.Discard, rc, start-int64(headerSize))
+		}
+		if err != nil {
+			rc.Close()
+			if errors.Is(err, io.EOF) {
+				// 末尾より先から読むときは、空を返す。
+				return io.NopCloser(strings.NewReader("")), nil
+			}
+			return nil, s.wrapErr("open", p, err)
+		}
+	}
+
+	var r io.Reader = newDecrypter(rc, s.keys, nonce, uint64(index), skip)
+	if length >= 0 {
+		r = io.LimitReader(r, length)
+	}
+	return readCloser{r, rc}, nil
+}
+
+// readNonce は暗号化したファイルのヘッダーだけを読みます。
+func (s *Storage) readNonce(ctx context.Context, enc string) (*[nonceSize]byte, error) {
+	rc, err := storage.OpenRange(ctx, s.inner, enc, 0, int64(headerSize))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return readHeader(rc)
+}
+
+// Put は内容を暗号化して書き込みます。
+//
+// 下のストレージには、暗号文の大きさと更新時刻だけを渡します。
+// 平文のハッシュは渡すと中身の手がかりになるうえ、暗号文とは
+// 合わないので渡しません。
+func (s *Storage) Put(ctx context.Context, p string, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	if err := s.checkNames("put", p); err != nil {
+		return nil, err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+	fi, err := s.inner.Put(ctx, s.encryptPath(p), newEncrypter(r, s.keys, nonce), storage.ObjectMeta{
+		Size:    encryptedSize(meta.Size),
+		ModTime: meta.ModTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.info(fi, p)
+	if err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+	return out, nil
+}
+
+// Mkdir はディレクトリを作ります。
+func (s *Storage) Mkdir(ctx context.Context, dir string) error {
+	if err := s.checkNames("mkdir", dir); err != nil {
+		return err
+	}
+	return s.inner.Mkdir(ctx, s.encryptPath(dir))
+}
+
+// Remove は1つのファイル、または空のディレクトリを削除します。
+func (s *Storage) Remove(ctx context.Context, p string) error {
+	return s.inner.Remove(ctx, s.encryptPath(p))
+}
+
+// --- 下のストレージが持っていれば使える能力 ---
+
+// ServerSideCopy は暗号文のままコピーします。
+// 内容の暗号化は置き場所によらないので、コピーしても読めます。
+func (s *Storage) ServerSideCopy(ctx context.Context, srcPath, dstPath string) (*storage.FileInfo, error) {
+	dstPath = storage.CleanPath(dstPath)
+	if err := s.checkNames("copy", dstPath); err != nil {
+		return nil, err
+	}
+	fi, err := storage.ServerSideCopy(ctx, s.inner, s.inner, s.encryptPath(srcPath), s.encryptPath(dstPath))
+	if err != nil {
+		return nil, err
+	}
+	out, err := s.info(fi, dstPath)
+	if err != nil {
+		return nil, s.wrapErr("copy", dstPath, err)
+	}
+	return out, nil
+}
+
+// Move は暗号文のまま移動します。
+func (s *Storage) Move(ctx context.Context, srcPath, dstPath string) error {
+	if err := s.checkNames("move", dstPath); err != nil {
+		return err
+	}
+	return storage.Move(ctx, s.inner, s.encryptPath(srcPath), s.encryptPath(dstPath))
+}
+
+// Purge はディレクトリを中身ごと削除します。
+func (s *Storage) Purge(ctx context.Context, dir string) error {
+	return storage.PurgeAll(ctx, s.inner, s.encryptPath(dir))
+}
+
+// SetModTime は最終更新時刻を変更します。
+func (s *Storage) SetModTime(ctx context.Context, p string, t time.Time) error {
+	return storage.SetModTime(ctx, s.inner, s.encryptPath(p), t)
+}
+
+// About は下のストレージの使用量を返します。暗号化で増える分は含みます。
+func (s *Storage) About(ctx context.Context, p string) (*storage.Usage, error) {
+	return storage.About(ctx, s.inner, s.encryptPath(p))
+}
+
+// ListRecursive は dir の配下をまとめて一覧し、名前を復号して fn に渡します。
+//
+// 名前を復号できないものは飛ばします。ディレクトリを飛ばしたときは、
+// その配下も親が分からないので飛ばします。
+func (s *Storage) ListRecursive(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	dir = storage.CleanPath(dir)
+	encDir := s.encryptPath(dir)
+	// 下のストレージでのディレクトリのパスから、平文のパスを引く表。
+	// 親は子より先に届くとは限らないので、届いたものを順に覚える。
+	plain := map[string]string{encDir: dir}
+	var pending []storage.FileInfo
+
+	deliver := func(fi storage.FileInfo) (bool, error) {
+		parent, ok := plain[path.Dir(fi.Path)]
+		if !ok {
+			return false, nil
+		}
+		out, ok := s.listed(fi, parent)
+		if !ok {
+			return true, nil
+		}
+		if fi.IsDir {
+			plain[fi.Path] = out.Path
+		}
+		return true, fn(out)
+	}
+
+	err := storage.ListRecursive(ctx, s.inner, encDir, func(fi storage.FileInfo) error {
+		done, err := deliver(fi)
+		if err != nil || done {
+			return err
+		}
+		pending = append(pending, fi)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// 親より先に届いたものを、親が分かるようになった順に渡す。
+	for progressed := true; progressed && len(pending) > 0; {
+		progressed = false
+		rest := pending[:0]
+		for _, fi := range pending {
+			done, err := deliver(fi)
+			if err != nil {
+				return err
+			}
+			if done {
+				progressed = true
+			} else {
+				rest = append(rest, fi)
+			}
+		}
+		pending = rest
+	}
+	return nil
+}
+
+// readCloser は復号した Reader と、下のストレージの Closer をまとめます。
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+var (
+	_ storage.Storage            = (*Storage)(nil)
+	_ storage.CapabilityReporter = (*Storage)(nil)
+	_ storage.Permitter          = (*Storage)(nil)
+	_ storage.RangeOpener        = (*Storage)(nil)
+	_ storage.ServerSideCopier   = (*Storage)(nil)
+	_ storage.Mover              = (*Storage)(nil)
+	_ storage.Purger             = (*Storage)(nil)
+	_ storage.SetModTimer        = (*Storage)(nil)
+	_ storage.RecursiveLister    = (*Storage)(nil)
+	_ storage.Abouter            = (*Storage)(nil)
+	_ storage.Verifier           = (*Storage)(nil)
+)
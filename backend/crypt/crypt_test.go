@@ -0,0 +1,347 @@
+package crypt_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/backend/crypt"
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/storage"
+	"github.com/mt3hr/hbg/storage/storagetest"
+)
+
+// newCrypt は、メモリの /secret に暗号文を置く crypt を設定から組み立てます。
+func newCrypt(t *testing.T, params backend.Params) (storage.Storage, *memory.Storage) {
+	t.Helper()
+	if params == nil {
+		params = backend.Params{}
+	}
+	params.Set("remote", "mem:/secret")
+	if params.Get("password") == "" {
+		params.Set("password", "正しいパスワード")
+	}
+
+	r, err := backend.NewResolver([]backend.Entry{
+		{Name: "mem", Type: memory.Type},
+		{Name: "secure", Type: crypt.Type, Params: params},
+	})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	ctx := context.Background()
+	s, err := r.Get(ctx, "secure")
+	if err != nil {
+		t.Fatalf("Get(secure): %v", err)
+	}
+	inner, err := r.Get(ctx, "mem")
+	if err != nil {
+		t.Fatalf("Get(mem): %v", err)
+	}
+	return s, inner.(*memory.Storage)
+}
+
+// 下のストレージに付けた read_only が、重ねた crypt からも始める前に分かることを確認します。
+func TestPermitFollowsInner(t *testing.T) {
+	r, err := backend.NewResolver([]backend.Entry{
+		{Name: "mem", Type: memory.Type, Policy: backend.Policy{ReadOnly: true}},
+		{Name: "secure", Type: crypt.Type, Params: backend.Params{"remote": "mem:/secret", "password": "p"}},
+	})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	defer r.Close()
+
+	s, err := r.Get(context.Background(), "secure")
+	if err != nil {
+		t.Fatalf("Get(secure): %v", err)
+	}
+	if err := storage.Permit(s, "put"); !errors.Is(err, storage.ErrReadOnly) || !strings.Contains(err.Error(), "read_only") {
+		t.Errorf("Permit(put) = %v, want read_only による ErrReadOnly", err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Harness{
+		NewStorage: func(t *testing.T) (storage.Storage, string) {
+			s, _ := newCrypt(t, nil)
+			return s, "/root"
+		},
+	})
+}
+
+func TestConformancePlainNames(t *testing.T) {
+	storagetest.Run(t, storagetest.Harness{
+		NewStorage: func(t *testing.T) (storage.Storage, string) {
+			s, _ := newCrypt(t, backend.Params{"filename_encryption": "off"})
+			return s, "/root"
+		},
+		SkipLargeDirs: true,
+	})
+}
+
+func put(t *testing.T, s storage.Storage, p, content string) {
+	t.Helper()
+	if _, err := s.Put(context.Background(), p, strings.NewReader(content), storage.ObjectMeta{
+		Size: int64(len(content)),
+	}); err != nil {
+		t.Fatalf("Put(%s): %v", p, err)
+	}
+}
+
+// 下のストレージには、名前も内容も平文では置かれないことを確認します。
+func TestInnerHoldsNoPlaintext(t *testing.T) {
+	s, inner := newCrypt(t, nil)
+	put(t, s, "/顧客/名簿.csv", "山田太郎,090-0000-0000")
+
+	snap := inner.Snapshot()
+	if len(snap) != 1 {
+		t.Fatalf("下のストレージのファイル = %v, want 1件", snap)
+	}
+	for p, content := range snap {
+		if !strings.HasPrefix(p, "/secret/") {
+			t.Errorf("remote の外に置かれた: %s", p)
+		}
+		if strings.Contains(p, "顧客") || strings.Contains(p, "名簿") {
+			t.Errorf("名前が平文のまま: %s", p)
+		}
+		if strings.Contains(content, "山田") {
+			t.Errorf("内容が平文のまま: %s", p)
+		}
+	}
+}
+
+// パスワードが違えば、名前も内容も読めないことを確認します。
+func TestWrongPassword(t *testing.T) {
+	ctx := context.Background()
+	r, err := backend.NewResolver([]backend.Entry{
+		{Name: "mem", Type: memory.Type},
+		{Name: "right", Type: crypt.Type, Params: backend.Params{
+			"remote": "mem:/", "password": "正しい", "filename_encryption": "off",
+		}},
+		{Name: "wrong", Type: crypt.Type, Params: backend.Params{
+			"remote": "mem:/", "password": "違う", "filename_encryption": "off",
+		}},
+	})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	defer r.Close()
+	right, err := r.Get(ctx, "right")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	wrong, err := r.Get(ctx, "wrong")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	put(t, right, "/a.txt", "秘密")
+	rc, _, err := wrong.Open(ctx, "/a.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); !errors.Is(err, crypt.ErrDecrypt) {
+		t.Errorf("違うパスワードで読んだ err = %v, want ErrDecrypt", err)
+	}
+}
+
+// 名前を暗号化していると、違うパスワードの一覧には何も出ないことを確認します。
+func TestWrongPasswordHidesNames(t *testing.T) {
+	ctx := context.Background()
+	inner := memory.New("mem")
+	right, err := crypt.New("right", inner, crypt.Config{Password: "正しい"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	wrong, err := crypt.New("wrong", inner, crypt.Config{Password: "違う"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	put(t, right, "/a.txt", "秘密")
+	// crypt を通さずに置かれたものも出ない。
+	put(t, inner, "/readme.txt", "平文")
+
+	entries, err := storage.ListAll(ctx, wrong, "/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("一覧 = %v, want 空", entries)
+	}
+	entries, err = storage.ListAll(ctx, right, "/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name != "a.txt" || entries[0].Size != int64(len("秘密")) {
+		t.Errorf("一覧 = %v, want a.txt だけ", entries)
+	}
+}
+
+// noRange は、範囲読み出しとハッシュのできない下のストレージを表します。
+type noRange struct{ storage.Storage }
+
+// 塊の境目をまたぐ範囲読み出しが、下のストレージの能力によらず正しいことを確認します。
+func TestOpenRangeAcrossBlocks(t *testing.T) {
+	const block = 64 * 1024
+	data := make([]byte, 3*block+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		inner func(*memory.Storage) storage.Storage
+	}{
+		{"範囲読み出しできる", func(m *memory.Storage) storage.Storage { return m }},
+		{"範囲読み出しできない", func(m *memory.Storage) storage.Storage { return noRange{m} }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, err := crypt.New("c", tt.inner(memory.New("mem")), crypt.Config{Password: "p"})
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			if _, err := s.Put(ctx, "/big.bin", bytes.NewReader(data), storage.ObjectMeta{Size: int64(len(data))}); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			if fi, err := s.Stat(ctx, "/big.bin"); err != nil || fi.Size != int64(len(data)) {
+				t.Fatalf("Stat = %v, %v, want 大きさ %d", fi, err, len(data))
+			}
+
+			ranges := []struct{ offset, length int64 }{
+				{0, block},
+				{block - 10, 20},
+				{block, block},
+				{2*block + 5, -1},
+				{3 * block, 100},
+				{3*block + 50, 1000},
+				{int64(len(data)) + 10, -1},
+			}
+			for _, rg := range ranges {
+				rc, err := s.OpenRange(ctx, "/big.bin", rg.offset, rg.length)
+				if err != nil {
+					t.Errorf("OpenRange(%d, %d): %v", rg.offset, rg.length, err)
+					continue
+				}
+				got, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Errorf("OpenRange(%d, %d) の読み取り: %v", rg.offset, rg.length, err)
+					continue
+				}
+				start := min(rg.offset, int64(len(data)))
+				end := int64(len(data))
+				if rg.length >= 0 {
+					end = min(start+rg.length, end)
+				}
+				if !bytes.Equal(got, data[start:end]) {
+					t.Errorf("OpenRange(%d, %d) の内容が違う（%d バイト）", rg.offset, rg.length, len(got))
+				}
+			}
+		})
+	}
+}
+
+// shortNames は、名前の長さに上限のある下のストレージを表します。
+type shortNames struct{ *memory.Storage }
+
+func (s shortNames) Features() *storage.Features {
+	f := *s.Storage.Features()
+	f.MaxNameLength = 255
+	return &f
+}
+
+// 暗号化すると下のストレージの上限を超える名前は、書き込む前に
+// 平文のパスの分かるエラーで断ることを確認します。
+func TestLongNameRejected(t *testing.T) {
+	ctx := context.Background()
+	inner := memory.New("mem")
+	s, err := crypt.New("c", shortNames{inner}, crypt.Config{Password: "p"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// 255 バイトに収まる平文は 143 バイトまで。
+	if got := s.Features().MaxNameLength; got != 143 {
+		t.Errorf("MaxNameLength = %d, want 143", got)
+	}
+
+	put(t, s, "/dir/"+strings.Repeat("a", 143), "収まる")
+
+	long := "/dir/" + strings.Repeat("b", 144)
+	_, err = s.Put(ctx, long, strings.NewReader("長すぎる"), storage.ObjectMeta{Size: int64(len("長すぎる"))})
+	if err == nil {
+		t.Fatal("長すぎる名前を書けてしまった")
+	}
+	if storage.ClassOf(err) != storage.ClassPermanent || !strings.Contains(err.Error(), long) {
+		t.Errorf("Put = %v, want 平文のパスを含む ClassPermanent のエラー", err)
+	}
+	if err := s.Mkdir(ctx, long); storage.ClassOf(err) != storage.ClassPermanent {
+		t.Errorf("Mkdir = %v, want ClassPermanent", err)
+	}
+	if got := len(inner.Snapshot()); got != 1 {
+		t.Errorf("下のストレージに %d 件ある、want 収まる1件だけ", got)
+	}
+}
+
+// 平文と、暗号化して置いたものとを照合できることを確認します。
+func TestVerify(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		inner func(*memory.Storage) storage.Storage
+	}{
+		// メモリはハッシュを返せるので、暗号化し直したハッシュで比べる。
+		{"暗号文のハッシュで比べる", func(m *memory.Storage) storage.Storage { return m }},
+		{"復号して比べる", func(m *memory.Storage) storage.Storage { return noRange{m} }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, err := crypt.New("c", tt.inner(memory.New("mem")), crypt.Config{Password: "p"})
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			content := strings.Repeat("照合する内容", 20000)
+			put(t, s, "/a.txt", content)
+
+			if err := s.Verify(ctx, "/a.txt", strings.NewReader(content)); err != nil {
+				t.Errorf("同じ内容なのに Verify = %v", err)
+			}
+			if err := s.Verify(ctx, "/a.txt", strings.NewReader(content+"!")); !errors.Is(err, crypt.ErrMismatch) {
+				t.Errorf("違う内容の Verify = %v, want ErrMismatch", err)
+			}
+			if err := s.Verify(ctx, "/無い.txt", strings.NewReader(content)); !storage.IsNotFound(err) {
+				t.Errorf("無いファイルの Verify = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+// 設定の誤りは、どの設定のものかが分かるエラーになることを確認します。
+func TestConfigErrors(t *testing.T) {
+	for _, params := range []backend.Params{
+		{"remote": "mem:/", "password": "p", "filename_encryption": "obfuscate"},
+		{"remote": "mem:/"},
+		{"password": "p"},
+	} {
+		r, err := backend.NewResolver([]backend.Entry{
+			{Name: "mem", Type: memory.Type},
+			{Name: "secure", Type: crypt.Type, Params: params},
+		})
+		if err != nil {
+			t.Fatalf("NewResolver: %v", err)
+		}
+		if _, err := r.Get(context.Background(), "secure"); err == nil {
+			t.Errorf("%v で組み立てられてしまった", params)
+		} else if !strings.Contains(err.Error(), "secure") {
+			t.Errorf("どの設定の誤りか分からない: %v", err)
+		}
+		r.Close()
+	}
+}
@@ -0,0 +1,52 @@
+package crypt
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/storage"
+)
+
+func init() {
+	backend.Register(backend.Descriptor{
+		Type:    Type,
+		Summary: "他のストレージの上に重ねて、内容と名前を暗号化する",
+		ConfigDoc: `  # - name: secure
+  #   type: crypt
+  #   remote: dropbox:/secure  # 暗号文を置く場所（設定にあるストレージ名:パス）
+  #   password: ${HBG_CRYPT_PASSWORD}
+  #   password2: ${HBG_CRYPT_SALT}  # 省略可。鍵を導くときの塩
+  #   filename_encryption: standard  # standard / off（off で名前は暗号化しない）
+`,
+		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
+			remote := params.Get("remote")
+			if remote == "" {
+				return nil, fmt.Errorf("crypt %s: remote が設定されていません", name)
+			}
+
+			var plainNames bool
+			switch mode := params.Get("filename_encryption"); mode {
+			case "", "standard":
+			case "off":
+				plainNames = true
+			default:
+				return nil, fmt.Errorf("crypt %s: filename_encryption には standard か off を指定してください（%q が指定されました）", name, mode)
+			}
+
+			inner, err := backend.Remote(ctx, remote)
+			if err != nil {
+				return nil, fmt.Errorf("crypt %s: %w", name, err)
+			}
+			s, err := New(name, inner, Config{
+				Password:   params.Get("password"),
+				Salt:       params.Get("password2"),
+				PlainNames: plainNames,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("crypt %s: %w", name, err)
+			}
+			return s, nil
+		},
+	})
+}
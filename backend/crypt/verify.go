@@ -0,0 +1,114 @@
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// ErrMismatch は、暗号化して置いてある内容が平文と合わないことを表します。
+var ErrMismatch = errors.New("暗号化した内容が平文と一致しません")
+
+// Verify は、p に暗号化して置いてある内容が plain と同じかを確かめます。
+// 合わなければ ErrMismatch を含むエラーを返します。
+//
+// 下のストレージが暗号文のハッシュを返せるなら、置いてあるファイルの
+// nonce で plain を暗号化し直し、そのハッシュと比べます。読み出すのは
+// ヘッダーだけなので、下がクラウドでも速く確かめられます。
+// 返せなければ、復号して読んだ内容と plain の SHA-256 を比べます。
+func (s *Storage) Verify(ctx context.Context, p string, plain io.Reader) error {
+	p = storage.CleanPath(p)
+	enc := s.encryptPath(p)
+
+	fi, err := s.inner.Stat(ctx, enc)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir {
+		return s.wrapErr("verify", p, storage.ErrIsDir)
+	}
+
+	if ht, ok := s.innerHash(fi); ok {
+		return s.verifyByHash(ctx, p, enc, fi, ht, plain)
+	}
+	return s.verifyByContent(ctx, p, plain)
+}
+
+// innerHash は、下のストレージで暗号文のハッシュに使える種類を返します。
+func (s *Storage) innerHash(fi *storage.FileInfo) (storage.HashType, bool) {
+	for _, ht := range s.inner.Features().Hashes {
+		if _, err := storage.NewHash(ht); err != nil {
+			continue
+		}
+		if _, ok := fi.Hashes[ht]; ok || storage.Supports(s.inner, storage.CapHash) {
+			return ht, true
+		}
+	}
+	return "", false
+}
+
+func (s *Storage) verifyByHash(ctx context.Context, p, enc string, fi *storage.FileInfo, ht storage.HashType, plain io.Reader) error {
+	var nonce *[nonceSize]byte
+	if storage.Supports(s.inner, storage.CapRangeOpen) {
+		n, err := s.readNonce(ctx, enc)
+		if err != nil {
+			return s.wrapErr("verify", p, err)
+		}
+		nonce = n
+	} else {
+		rc, _, err := s.inner.Open(ctx, enc)
+		if err != nil {
+			return err
+		}
+		nonce, err = readHeader(rc)
+		rc.Close()
+		if err != nil {
+			return s.wrapErr("verify", p, err)
+		}
+	}
+
+	want, err := storage.GetHash(ctx, s.inner, fi, ht)
+	if err != nil {
+		return err
+	}
+
+	h, err := storage.NewHash(ht)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(h, newEncrypter(plain, s.keys, nonce)); err != nil {
+		return s.wrapErr("verify", p, err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, want) {
+		return s.wrapErr("verify", p, fmt.Errorf("%w（暗号文の %s が %s、平文から求めると %s）", ErrMismatch, ht, want, got))
+	}
+	return nil
+}
+
+func (s *Storage) verifyByContent(ctx context.Context, p string, plain io.Reader) error {
+	rc, _, err := s.Open(ctx, p)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	stored := sha256.New()
+	if _, err := io.Copy(stored, rc); err != nil {
+		return s.wrapErr("verify", p, err)
+	}
+	want := sha256.New()
+	if _, err := io.Copy(want, plain); err != nil {
+		return s.wrapErr("verify", p, err)
+	}
+	if !bytes.Equal(stored.Sum(nil), want.Sum(nil)) {
+		return s.wrapErr("verify", p, ErrMismatch)
+	}
+	return nil
+}
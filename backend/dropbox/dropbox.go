@@ -99,8 +99,9 @@ func (d *Storage) Features() *storage.Features {
 		ImplicitDirs:    true,
 		EmptyDirs:       true,
 		// アップロードは完了時にはじめて見えるので不可分。
-		AtomicPut:   true,
-		MaxFileSize: maxFileSize,
+		AtomicPut:     true,
+		MaxFileSize:   maxFileSize,
+		MaxNameLength: 255,
 	}
 }
 
@@ -115,9 +116,22 @@ func (d *Storage) Close() error {
 //
 // 続きは cursor をたどって取得します。全件をメモリに溜めません。
 func (d *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	return d.list(ctx, dir, false, fn)
+}
+
+// ListRecursive は dir の配下を深さを問わず1件ずつ fn に渡します。
+//
+// Dropbox は配下をまとめて返す一覧を持っているので、それを使います。
+// ディレクトリの数によらず、件数ぶんのページで済みます。
+func (d *Storage) ListRecursive(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	return d.list(ctx, dir, true, fn)
+}
+
+func (d *Storage) list(ctx context.Context, dir string, recursive bool, fn func(storage.FileInfo) error) error {
 	nd := normalize(dir)
 
 	arg := dbx.NewListFolderArg(nd)
+	arg.Recursive = recursive
 	arg.Limit = listPageSize
 
 	res, err := d.client.ListFolderContext(ctx, arg)
@@ -127,6 +141,11 @@ func (d *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo
 
 	for {
 		for _, m := range res.Entries {
+			if f, ok := m.(*dbx.FolderMetadata); ok && recursive && strings.EqualFold(f.PathLower, nd) {
+				// 配下をまとめて返すときは、dir 自身も含まれる。
+				continue
+			}
+			// 表示用のパスは必ず付いてくるので、深い階層でも親を渡す必要はない。
 			fi, ok := toFileInfo(m, nd)
 			if !ok {
 				// 削除済みの記録などファイルでもディレクトリでもないもの。
@@ -528,5 +547,6 @@ var (
 	_ storage.Purger           = (*Storage)(nil)
 	_ storage.Mover            = (*Storage)(nil)
 	_ storage.RangeOpener      = (*Storage)(nil)
+	_ storage.RecursiveLister  = (*Storage)(nil)
 	_ storage.ServerSideCopier = (*Storage)(nil)
 )
@@ -184,6 +184,31 @@ func TestListFollowsCursor(t *testing.T) {
 	}
 }
 
+// 配下をまとめて一覧したとき、親の表記が子ごとに違っていても
+// 同じディレクトリの中身として引けることを確かめます。
+// Dropbox は子の表示用パスの親の部分を、登録時の表記のまま返します。
+func TestListRecursiveMergesParentCase(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+
+	put(t, ctx, s, "/写真/Sub/a.txt", "a")
+	put(t, ctx, s, "/写真/sub/b.txt", "b")
+
+	tree, err := storage.ListTree(ctx, s, "/写真")
+	if err != nil {
+		t.Fatalf("ListTree: %v", err)
+	}
+	entries, ok := tree.Dir("/写真/SUB")
+	if !ok || len(entries) != 2 {
+		t.Errorf("/写真/SUB の中身 = %v, %v, want 2件", entries, ok)
+	}
+	if root, _ := tree.Dir("/写真"); len(root) != 1 {
+		t.Errorf("/写真 の中身 = %v, want 1件", root)
+	}
+	if n := f.callCount("list_folder"); n != 1 {
+		t.Errorf("一覧の始め = %d回, want 1", n)
+	}
+}
+
 // 要求が多すぎるときに、待って再試行されることを確かめます。
 func TestRetriesOnRateLimit(t *testing.T) {
 	ctx, f, s := newTestStorage(t)
@@ -280,6 +280,20 @@ func (f *fakeDropbox) children(dir string) []*fakeEntry {
 	return out
 }
 
+// descendants は dir 自身と、その配下のすべてを返します。
+// 実物と同じく、ルート以外では dir 自身も含めます。
+func (f *fakeDropbox) descendants(dir string) []*fakeEntry {
+	out := []*fakeEntry{}
+	prefix := key(dir) + "/"
+	for k, e := range f.entries {
+		if k == key(dir) || strings.HasPrefix(k, prefix) {
+			out = append(out, e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].path < out[j].path })
+	return out
+}
+
 func displayDir(p string) string {
 	if p == "" {
 		return "/"
@@ -310,7 +324,8 @@ func (f *fakeDropbox) getMetadata(body json.RawMessage) (any, error) {
 
 func (f *fakeDropbox) listFolder(body json.RawMessage) (any, error) {
 	var arg struct {
-		Path string `json:"path"`
+		Path      string `json:"path"`
+		Recursive bool   `json:"recursive"`
 	}
 	if err := json.Unmarshal(body, &arg); err != nil {
 		return nil, err
@@ -324,6 +339,9 @@ func (f *fakeDropbox) listFolder(body json.RawMessage) (any, error) {
 		return nil, errNotFolder()
 	}
 
+	if arg.Recursive {
+		return f.page(&fakeCursor{entries: f.descendants(arg.Path)}), nil
+	}
 	cursor := &fakeCursor{entries: f.children(arg.Path)}
 	return f.page(cursor), nil
 }
@@ -460,6 +460,83 @@ func (s *Storage) Put(ctx context.Context, p string, r io.Reader, meta storage.O
 	return fi, nil
 }
 
+// Partial は書きかけのメタデータを返します。
+func (s *Storage) Partial(ctx context.Context, p string) (*storage.FileInfo, error) {
+	cp := cleanPath(p)
+
+	var entry *ftpc.Entry
+	err := s.withConn(ctx, func(conn *ftpc.ServerConn) error {
+		var statErr error
+		entry, statErr = conn.GetEntry(tempPath(s.full(p)))
+		return statErr
+	})
+	if err != nil {
+		return nil, s.wrapErr("partial", p, err)
+	}
+	if entry.Type == ftpc.EntryTypeFolder {
+		return nil, s.wrapErr("partial", p, storage.ErrIsDir)
+	}
+
+	fi := toFileInfo(entry, path.Dir(cp))
+	return &fi, nil
+}
+
+// PutResume は書きかけの続きから書き込み、書き終えたら本来の場所へ移します。
+//
+// 続きは REST で位置を伝えてから STOR で送ります。失敗しても
+// 書きかけは消しません。サーバーは受け取ったぶんを順に書くので、
+// 書きかけの大きさがそのまま確かに届いたところです。
+func (s *Storage) PutResume(ctx context.Context, p string, offset int64, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	cp := cleanPath(p)
+	if cp == "/" {
+		return nil, s.wrapErr("put", p, errors.New("起点をファイルとして書き込むことはできません"))
+	}
+
+	if err := s.ensureDir(ctx, path.Dir(s.full(p))); err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+
+	dst := s.full(p)
+	tmp := tempPath(dst)
+	counting := &countingReader{r: &ctxReader{ctx: ctx, r: r}}
+
+	err := s.withConn(ctx, func(conn *ftpc.ServerConn) error {
+		if offset > 0 {
+			size, err := conn.FileSize(tmp)
+			if err != nil {
+				return err
+			}
+			if size != offset {
+				return fmt.Errorf("%w: 書きかけの大きさ %d バイトが、続きを書く位置 %d バイトと食い違います",
+					storage.ErrNotFound, size, offset)
+			}
+		}
+
+		if err := conn.StorFrom(tmp, counting, uint64(offset)); err != nil {
+			return err
+		}
+		if !meta.ModTime.IsZero() && s.canSetModTime {
+			if err := conn.SetTime(tmp, meta.ModTime); err != nil {
+				return err
+			}
+		}
+		return replace(conn, tmp, dst)
+	})
+	if err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+
+	fi := &storage.FileInfo{
+		Path: cp,
+		Name: path.Base(cp),
+		Size: offset + counting.n,
+	}
+	if s.canSetModTime {
+		fi.ModTime = meta.ModTime
+	}
+	return fi, nil
+}
+
 // replace は一時ファイルを本来の場所へ移します。
 //
 // FTP の改名は置き換え先があると失敗します。先にどけるので、
@@ -698,5 +775,6 @@ var (
 	_ storage.Purger      = (*Storage)(nil)
 	_ storage.Mover       = (*Storage)(nil)
 	_ storage.RangeOpener = (*Storage)(nil)
+	_ storage.Resumer     = (*Storage)(nil)
 	_ storage.SetModTimer = (*Storage)(nil)
 )
@@ -0,0 +1,178 @@
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mt3hr/hbg/internal/auth"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	gcsapi "google.golang.org/api/storage/v1"
+)
+
+// 保管の種類（ストレージクラス）。
+const (
+	ClassStandard = "STANDARD"
+	ClassNearline = "NEARLINE"
+	ClassColdline = "COLDLINE"
+	ClassArchive  = "ARCHIVE"
+)
+
+// Config は Google Cloud Storage の設定です。
+//
+// 認証はサービスアカウントの鍵か、hbg auth login で得た OAuth のトークンの
+// どちらかで行います。鍵を指定しなければ OAuth です。
+type Config struct {
+	// Name は設定ファイルで付けた名前です。
+	Name string
+
+	// ServiceAccountFile はサービスアカウントの鍵（JSON）のパスです。
+	ServiceAccountFile string
+	// ServiceAccountCredentials は鍵の JSON そのものです。
+	// 環境変数から渡すときに使います。
+	ServiceAccountCredentials string
+
+	// ClientID と ClientSecret は OAuth クライアントの識別情報です。
+	// 空の場合は Google Drive と同じく、環境変数やビルド時に埋め込まれた値が使われます。
+	ClientID     string
+	ClientSecret string
+
+	// Bucket は入れ物（バケット）の名前です。
+	Bucket string
+	// StorageClass は書き込むときの保管の種類です。省略するとバケットの既定です。
+	StorageClass string
+	// DirectoryMarkers が偽なら、空のディレクトリを表す印を書きません。
+	DirectoryMarkers *bool
+
+	// UploadChunkSizeMiB は再開できる送信の1回ぶんの大きさです。0 なら既定値です。
+	// これより小さいものは1回の要求で送ります。
+	UploadChunkSizeMiB int64
+
+	// Root を指定すると、その下を起点として扱います。
+	Root string
+}
+
+// UsesOAuth は、OAuth で認証するか（hbg auth login が要るか）を返します。
+func (c Config) UsesOAuth() bool {
+	return c.ServiceAccountFile == "" && c.ServiceAccountCredentials == ""
+}
+
+func (c Config) directoryMarkers() bool {
+	if c.DirectoryMarkers == nil {
+		return true
+	}
+	return *c.DirectoryMarkers
+}
+
+// validate は接続を試みる前に設定の不足を知らせます。
+func (c Config) validate() error {
+	if c.Bucket == "" {
+		return errors.New("入れ物（bucket）が指定されていません")
+	}
+	switch c.StorageClass {
+	case "", ClassStandard, ClassNearline, ClassColdline, ClassArchive:
+	default:
+		return fmt.Errorf("storage_class には %s のいずれかを指定してください（%q が指定されました）",
+			strings.Join([]string{ClassStandard, ClassNearline, ClassColdline, ClassArchive}, ", "), c.StorageClass)
+	}
+	if c.ServiceAccountFile != "" && c.ServiceAccountCredentials != "" {
+		return errors.New("service_account_file と service_account_credentials はどちらか一方だけを指定してください")
+	}
+	if !c.UsesOAuth() && (c.ClientID != "" || c.ClientSecret != "") {
+		// どちらで認証されているのか分からなくなるので、混ぜさせない。
+		return errors.New("サービスアカウントで認証するときは client_id・client_secret を指定しないでください")
+	}
+	return nil
+}
+
+// oauth2Config は設定から oauth2.Config を組み立てます。
+func oauth2Config(cfg Config) (*oauth2.Config, error) {
+	creds, err := auth.ResolveGoogleCloudStorage(cfg.ClientID, cfg.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	return auth.GoogleCloudStorageOAuth2Config(creds), nil
+}
+
+// Login は対話的に認可を行い、トークンを保存します。
+// hbg auth login から呼ばれます。
+func Login(ctx context.Context, cfg Config, opts auth.LoginOptions) error {
+	if !cfg.UsesOAuth() {
+		return fmt.Errorf("gcs %q はサービスアカウントで認証するので、hbg auth login は要りません", cfg.Name)
+	}
+	oauthCfg, err := oauth2Config(cfg)
+	if err != nil {
+		return err
+	}
+
+	flow := &auth.Flow{
+		Config:               oauthCfg,
+		UsePKCE:              true,
+		ExtraAuthCodeOptions: auth.GoogleAuthCodeOptions(),
+		OpenBrowser:          opts.OpenBrowser,
+		Prompt:               opts.Prompt,
+	}
+
+	tok, err := flow.Run(ctx)
+	if err != nil {
+		return err
+	}
+	if tok.RefreshToken == "" {
+		return errors.New("リフレッシュトークンを取得できませんでした。" +
+			"Google Cloud の OAuth 同意画面で、いちど hbg のアクセス権を取り消してから再試行してください")
+	}
+
+	return auth.NewFileStore().Save(Type, cfg.Name, tok)
+}
+
+// newService は設定の認証を使って Cloud Storage のクライアントを作ります。
+func newService(ctx context.Context, cfg Config) (*gcsapi.Service, error) {
+	src, err := tokenSource(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return gcsapi.NewService(ctx, option.WithHTTPClient(oauth2.NewClient(ctx, src)))
+}
+
+// tokenSource は要求に付けるトークンの出どころを返します。
+func tokenSource(ctx context.Context, cfg Config) (oauth2.TokenSource, error) {
+	if !cfg.UsesOAuth() {
+		data := []byte(cfg.ServiceAccountCredentials)
+		if cfg.ServiceAccountFile != "" {
+			var err error
+			data, err = os.ReadFile(cfg.ServiceAccountFile)
+			if err != nil {
+				return nil, fmt.Errorf("サービスアカウントの鍵を読めません: %w", err)
+			}
+		}
+		// 種類を決めて読む。鍵の JSON に外部の実行ファイルを指す種類が
+		// 紛れ込んでいても、それを実行しないようにするため。
+		creds, err := google.CredentialsFromJSONWithType(ctx, data, google.ServiceAccount, auth.GoogleCloudStorageScope)
+		if err != nil {
+			return nil, fmt.Errorf("サービスアカウントの鍵を解釈できません: %w", err)
+		}
+		return creds.TokenSource, nil
+	}
+
+	oauthCfg, err := oauth2Config(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	store := auth.NewFileStore()
+	tok, err := store.Load(Type, cfg.Name)
+	if err != nil {
+		if errors.Is(err, auth.ErrNoToken) {
+			return nil, fmt.Errorf("gcs %q は未認証です。hbg auth login %s で認証するか、"+
+				"service_account_file を指定してください", cfg.Name, cfg.Name)
+		}
+		return nil, err
+	}
+
+	// 更新したトークンはディスクへ書き戻す。googledrive と同じ。
+	return auth.PersistingTokenSource(oauthCfg.TokenSource(ctx, tok), store, Type, cfg.Name, tok), nil
+}
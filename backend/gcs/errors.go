@@ -0,0 +1,156 @@
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// Cloud Storage の失敗は、HTTP の状態コードと reason の2段で表されます。
+//
+//	401 → 認証が通っていない
+//	403 → 権限がない（Drive と違い、流量制限には使われない）
+//	404 → 存在しない
+//	412 → 条件が合わない
+//	429 → 要求が多すぎる
+//	5xx → 一時的な障害
+//
+// 同じ名前への書き込みは1秒に1回までという制限があり、超えると 429 です。
+
+// wrapErr は Cloud Storage のエラーを storage のエラーに変換します。
+func (s *Storage) wrapErr(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	v := classify(err)
+	if v.sentinel != nil && !errors.Is(err, v.sentinel) {
+		// 元のエラーも失わないよう、両方を包む。
+		err = fmt.Errorf("%w (%w)", v.sentinel, err)
+	}
+
+	return &storage.OpError{
+		Op:         op,
+		Storage:    s.name,
+		Path:       path,
+		Class:      v.class,
+		RetryAfter: v.retryAfter,
+		Err:        err,
+	}
+}
+
+// verdict は失敗の見立てです。
+type verdict struct {
+	// sentinel は対応する番兵エラーです。該当するものがなければ nil です。
+	sentinel error
+	class    storage.Class
+	// retryAfter はサーバーから指示された待ち時間です。
+	retryAfter time.Duration
+}
+
+// classify はエラーの見立てを求めます。
+func classify(err error) verdict {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return verdict{class: storage.ClassCanceled}
+	case errors.Is(err, storage.ErrNotFound):
+		return verdict{sentinel: storage.ErrNotFound, class: storage.ClassPermanent}
+	case errors.Is(err, storage.ErrNotEmpty), errors.Is(err, storage.ErrNotDir),
+		errors.Is(err, storage.ErrIsDir), errors.Is(err, storage.ErrUnsupported):
+		return verdict{class: storage.ClassPermanent}
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		v := classifyStatus(apiErr.Code, reasonOf(apiErr))
+		v.retryAfter = parseRetryAfter(apiErr.Header.Get("Retry-After"))
+		return v
+	}
+
+	// 接続そのものが切れた場合。繋ぎ直せば通ることがある。
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return verdict{class: storage.ClassRetryable}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return verdict{class: storage.ClassRetryable}
+	}
+
+	return verdict{class: storage.ClassUnknown}
+}
+
+// classifyStatus は状態コードと reason から判断します。
+func classifyStatus(code int, reason string) verdict {
+	switch code {
+	case http.StatusNotFound:
+		return verdict{sentinel: storage.ErrNotFound, class: storage.ClassPermanent}
+	case http.StatusUnauthorized:
+		return verdict{class: storage.ClassAuth}
+	case http.StatusTooManyRequests:
+		return verdict{class: storage.ClassRateLimit}
+	case http.StatusForbidden:
+		switch reason {
+		case "rateLimitExceeded", "userRateLimitExceeded":
+			// 古い形の流量制限。いまは 429 で返るが、念のため。
+			return verdict{class: storage.ClassRateLimit}
+		case "userProjectMissing", "accountDisabled", "billingNotEnabled":
+			// 設定の問題。待っても直らないが、権限の問題でもない。
+			return verdict{class: storage.ClassPermanent}
+		}
+		return verdict{class: storage.ClassAuth}
+	case http.StatusRequestTimeout:
+		return verdict{class: storage.ClassRetryable}
+	case http.StatusBadRequest, http.StatusConflict, http.StatusPreconditionFailed,
+		http.StatusRequestedRangeNotSatisfiable:
+		return verdict{class: storage.ClassPermanent}
+	}
+
+	switch {
+	case code >= 500 && code <= 599:
+		return verdict{class: storage.ClassRetryable}
+	case code >= 400 && code <= 499:
+		return verdict{class: storage.ClassPermanent}
+	}
+	return verdict{class: storage.ClassUnknown}
+}
+
+// reasonOf はエラーの reason を取り出します。
+func reasonOf(err *googleapi.Error) string {
+	for _, e := range err.Errors {
+		if e.Reason != "" {
+			return e.Reason
+		}
+	}
+	return ""
+}
+
+// parseRetryAfter は待つよう指示された時間を読み取ります。
+func parseRetryAfter(raw string) time.Duration {
+	if raw == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(raw); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(raw); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// isNotFound はエラーが「存在しない」を表すかを返します。
+func isNotFound(err error) bool {
+	v := classify(err)
+	return v.sentinel != nil && errors.Is(v.sentinel, storage.ErrNotFound)
+}
@@ -0,0 +1,594 @@
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+	gcsapi "google.golang.org/api/storage/v1"
+)
+
+// 偽の Cloud Storage サーバーです。
+//
+// 認証情報もバケットもなしに、ディレクトリの見せかけ・ページ分割・
+// 再開できる送信・書き写しの続き・エラーの分類までを試験できるように
+// するためのものです。クライアントは option.WithEndpoint で到達先を
+// 差し替えられます。
+//
+// JSON API はオブジェクトの名前の "/" を %2F にして送ってくるので、
+// パスは r.URL.Path ではなく、エスケープされたままの形で切り分けます。
+
+const testBucket = "test-bucket"
+
+// fakeObject は偽サーバー上の1件です。
+type fakeObject struct {
+	data        []byte
+	meta        map[string]string
+	contentType string
+	updated     time.Time
+	generation  int64
+	// composite は合成で作られたことを表します。MD5 を持ちません。
+	composite bool
+}
+
+// fakeSession は再開できる送信の途中経過です。
+type fakeSession struct {
+	object *gcsapi.Object
+	data   []byte
+}
+
+// fakeGCS は JSON API のごく一部を再現します。
+type fakeGCS struct {
+	mu       sync.Mutex
+	objects  map[string]*fakeObject
+	sessions map[string]*fakeSession
+	seq      int64
+
+	// pageSize は一覧が1回に返す件数の上限です。
+	// 小さくしてあるので、続きの取得を必ず通ります。
+	pageSize int
+	// pendingRewrites は、書き写しを何回「途中」と答えてから終えるかです。
+	pendingRewrites int
+	// rewriteToken は最後に渡した続きの札です。
+	rewriteToken string
+
+	failures map[string]*fakeFailure
+	calls    map[string]int
+
+	baseURL string
+}
+
+type fakeFailure struct {
+	remaining int
+	status    int
+	reason    string
+}
+
+func newFakeGCS() *fakeGCS {
+	return &fakeGCS{
+		objects:  map[string]*fakeObject{},
+		sessions: map[string]*fakeSession{},
+		pageSize: 3,
+		failures: map[string]*fakeFailure{},
+		calls:    map[string]int{},
+	}
+}
+
+// start は偽サーバーを立ち上げ、そこへ向いたストレージを返します。
+func (f *fakeGCS) start(t *testing.T, mutate ...func(*Config)) *Storage {
+	t.Helper()
+
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	f.baseURL = srv.URL
+
+	svc, err := gcsapi.NewService(context.Background(),
+		option.WithEndpoint(srv.URL+"/storage/v1/"),
+		option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("偽サーバーへ向けたクライアントを作れません: %v", err)
+	}
+
+	cfg := Config{Name: "偽gcs", Bucket: testBucket}
+	for _, m := range mutate {
+		m(&cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("設定が誤っています: %v", err)
+	}
+	return newWithService(cfg, svc)
+}
+
+func (f *fakeGCS) failNext(route string, n, status int, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[route] = &fakeFailure{remaining: n, status: status, reason: reason}
+}
+
+func (f *fakeGCS) callCount(route string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[route]
+}
+
+// object は入っている1件を返します。
+func (f *fakeGCS) object(name string) (*fakeObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.objects[name]
+	return o, ok
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segs, err := splitEscapedPath(r.URL.EscapedPath())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	route := routeName(r, segs)
+
+	f.mu.Lock()
+	f.calls[route]++
+	if fail, ok := f.failures[route]; ok && fail.remaining > 0 {
+		fail.remaining--
+		status, reason := fail.status, fail.reason
+		f.mu.Unlock()
+		w.Header().Set("Retry-After", "7")
+		writeError(w, status, reason, "わざと失敗させました")
+		return
+	}
+	f.mu.Unlock()
+
+	switch route {
+	case "list":
+		f.list(w, r)
+	case "upload":
+		f.upload(w, r)
+	case "upload_chunk":
+		f.uploadChunk(w, r, segs[1])
+	case "get":
+		f.get(w, segs[5])
+	case "download":
+		f.download(w, r, segs[5])
+	case "delete":
+		f.delete(w, segs[5])
+	case "rewrite":
+		f.rewrite(w, r, segs[5], segs[10])
+	default:
+		writeError(w, http.StatusNotFound, "notFound", "知らない経路です: "+r.Method+" "+r.URL.Path)
+	}
+}
+
+// splitEscapedPath はパスを "/" で切り、それぞれのエスケープを戻します。
+func splitEscapedPath(p string) ([]string, error) {
+	segs := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for i, s := range segs {
+		u, err := url.PathUnescape(s)
+		if err != nil {
+			return nil, err
+		}
+		segs[i] = u
+	}
+	return segs, nil
+}
+
+// routeName は失敗の注入と回数の集計に使う名前です。
+func routeName(r *http.Request, segs []string) string {
+	isBucket := func(i int) bool { return len(segs) > i+1 && segs[i] == "b" && segs[i+1] == testBucket }
+
+	switch {
+	case len(segs) == 2 && segs[0] == "resumable":
+		return "upload_chunk"
+	case len(segs) == 6 && segs[0] == "upload" && isBucket(3) && segs[5] == "o":
+		return "upload"
+	case len(segs) == 5 && segs[0] == "storage" && isBucket(2) && segs[4] == "o" && r.Method == http.MethodGet:
+		return "list"
+	case len(segs) == 6 && segs[0] == "storage" && isBucket(2) && segs[4] == "o":
+		switch {
+		case r.Method == http.MethodDelete:
+			return "delete"
+		case r.URL.Query().Get("alt") == "media":
+			return "download"
+		}
+		return "get"
+	case len(segs) == 11 && segs[0] == "storage" && isBucket(2) && segs[6] == "rewriteTo" && isBucket(7):
+		return "rewrite"
+	}
+	return "unknown"
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, reason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"code":    status,
+			"message": message,
+			"errors":  []map[string]any{{"reason": reason, "message": message}},
+		},
+	})
+}
+
+// --- 蓄えの操作 ---
+
+// md5Base64 と crc32cBase64 は、Cloud Storage と同じく base64 で返します。
+func md5Base64(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func crc32cBase64(data []byte) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+func toObject(name string, o *fakeObject) *gcsapi.Object {
+	out := &gcsapi.Object{
+		Bucket:      testBucket,
+		Name:        name,
+		Size:        uint64(len(o.data)),
+		ContentType: o.contentType,
+		Metadata:    o.meta,
+		Updated:     o.updated.UTC().Format(time.RFC3339Nano),
+		Generation:  o.generation,
+		Crc32c:      crc32cBase64(o.data),
+	}
+	if !o.composite {
+		out.Md5Hash = md5Base64(o.data)
+	}
+	return out
+}
+
+// commit は送られてきたものを書き込みます。呼ぶ側で f.mu を取っておきます。
+//
+// 実物と同じく、ハッシュが添えられていれば中身と照らし合わせ、
+// 食い違えば書き込みません。
+func (f *fakeGCS) commit(meta *gcsapi.Object, data []byte) (*gcsapi.Object, int, string) {
+	if meta.Name == "" {
+		return nil, http.StatusBadRequest, "名前がありません"
+	}
+	if meta.Md5Hash != "" && meta.Md5Hash != md5Base64(data) {
+		return nil, http.StatusBadRequest, "MD5 が中身と合いません"
+	}
+	if meta.Crc32c != "" && meta.Crc32c != crc32cBase64(data) {
+		return nil, http.StatusBadRequest, "CRC32C が中身と合いません"
+	}
+
+	f.seq++
+	o := &fakeObject{
+		data:        data,
+		meta:        meta.Metadata,
+		contentType: meta.ContentType,
+		updated:     time.Now(),
+		generation:  f.seq,
+	}
+	f.objects[meta.Name] = o
+	return toObject(meta.Name, o), 0, ""
+}
+
+// --- 一覧 ---
+
+func (f *fakeGCS) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// 区切り文字があれば、その先はひとまとめにして接頭辞として返す。
+	type entry struct {
+		name     string
+		isPrefix bool
+	}
+	var entries []entry
+	seen := map[string]bool{}
+	for name := range f.objects {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, prefix)
+		if delimiter != "" {
+			if i := strings.Index(rest, delimiter); i >= 0 {
+				p := prefix + rest[:i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					entries = append(entries, entry{name: p, isPrefix: true})
+				}
+				continue
+			}
+		}
+		entries = append(entries, entry{name: name})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	pageSize := f.pageSize
+	if n, err := strconv.Atoi(q.Get("maxResults")); err == nil && n > 0 && n < pageSize {
+		pageSize = n
+	}
+	start := 0
+	if tok := q.Get("pageToken"); tok != "" {
+		start, _ = strconv.Atoi(tok)
+	}
+	end := min(start+pageSize, len(entries))
+
+	res := &gcsapi.Objects{}
+	for _, e := range entries[start:end] {
+		if e.isPrefix {
+			res.Prefixes = append(res.Prefixes, e.name)
+			continue
+		}
+		res.Items = append(res.Items, toObject(e.name, f.objects[e.name]))
+	}
+	if end < len(entries) {
+		res.NextPageToken = strconv.Itoa(end)
+	}
+	writeJSON(w, res)
+}
+
+// --- 読み出しと削除 ---
+
+func (f *fakeGCS) get(w http.ResponseWriter, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o, ok := f.objects[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "ありません: "+name)
+		return
+	}
+	writeJSON(w, toObject(name, o))
+}
+
+func (f *fakeGCS) download(w http.ResponseWriter, r *http.Request, name string) {
+	f.mu.Lock()
+	o, ok := f.objects[name]
+	f.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "ありません: "+name)
+		return
+	}
+	if g := r.URL.Query().Get("generation"); g != "" && g != strconv.FormatInt(o.generation, 10) {
+		// 世代を指定されたら、その世代のものしか返さない。
+		writeError(w, http.StatusNotFound, "notFound", "その世代はありません: "+g)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(o.data))
+}
+
+func (f *fakeGCS) delete(w http.ResponseWriter, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.objects[name]; !ok {
+		writeError(w, http.StatusNotFound, "notFound", "ありません: "+name)
+		return
+	}
+	delete(f.objects, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- 書き写し ---
+
+func (f *fakeGCS) rewrite(w http.ResponseWriter, r *http.Request, src, dst string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o, ok := f.objects[src]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "ありません: "+src)
+		return
+	}
+	if tok := r.URL.Query().Get("rewriteToken"); tok != f.rewriteToken {
+		writeError(w, http.StatusBadRequest, "invalid",
+			fmt.Sprintf("続きの札が違います（%q と %q）", tok, f.rewriteToken))
+		return
+	}
+
+	if f.pendingRewrites > 0 {
+		f.pendingRewrites--
+		f.seq++
+		f.rewriteToken = fmt.Sprintf("札%d", f.seq)
+		writeJSON(w, &gcsapi.RewriteResponse{
+			Done:         false,
+			RewriteToken: f.rewriteToken,
+			ObjectSize:   int64(len(o.data)),
+		})
+		return
+	}
+	f.rewriteToken = ""
+
+	// 利用者定義の項目も一緒に写る。
+	meta := map[string]string{}
+	for k, v := range o.meta {
+		meta[k] = v
+	}
+	f.seq++
+	c := &fakeObject{
+		data:        bytes.Clone(o.data),
+		meta:        meta,
+		contentType: o.contentType,
+		updated:     time.Now(),
+		generation:  f.seq,
+		composite:   o.composite,
+	}
+	f.objects[dst] = c
+	writeJSON(w, &gcsapi.RewriteResponse{
+		Done:                true,
+		ObjectSize:          int64(len(c.data)),
+		TotalBytesRewritten: int64(len(c.data)),
+		Resource:            toObject(dst, c),
+	})
+}
+
+// --- 書き込み ---
+
+func (f *fakeGCS) upload(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("uploadType") {
+	case "multipart":
+		f.uploadMultipart(w, r)
+	case "resumable":
+		f.uploadStart(w, r)
+	default:
+		writeError(w, http.StatusBadRequest, "invalid",
+			"扱えない uploadType です: "+r.URL.Query().Get("uploadType"))
+	}
+}
+
+func (f *fakeGCS) uploadMultipart(w http.ResponseWriter, r *http.Request) {
+	meta, data, err := readMultipart(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	o, status, msg := f.commit(meta, data)
+	if o == nil {
+		writeError(w, status, "invalid", msg)
+		return
+	}
+	writeJSON(w, o)
+}
+
+// readMultipart はメタデータと中身に分かれた本体を読みます。
+func readMultipart(r *http.Request) (*gcsapi.Object, []byte, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mr := multipart.NewReader(r.Body, params["boundary"])
+
+	metaPart, err := mr.NextPart()
+	if err != nil {
+		return nil, nil, fmt.Errorf("メタデータの部分がありません: %w", err)
+	}
+	var meta gcsapi.Object
+	if err := json.NewDecoder(metaPart).Decode(&meta); err != nil {
+		return nil, nil, err
+	}
+
+	dataPart, err := mr.NextPart()
+	if err != nil {
+		return nil, nil, fmt.Errorf("中身の部分がありません: %w", err)
+	}
+	data, err := io.ReadAll(dataPart)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &meta, data, nil
+}
+
+func (f *fakeGCS) uploadStart(w http.ResponseWriter, r *http.Request) {
+	var meta gcsapi.Object
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	f.seq++
+	session := fmt.Sprintf("session%d", f.seq)
+	f.sessions[session] = &fakeSession{object: &meta}
+	f.mu.Unlock()
+
+	w.Header().Set("Location", f.baseURL+"/resumable/"+session)
+	writeJSON(w, map[string]any{})
+}
+
+func (f *fakeGCS) uploadChunk(w http.ResponseWriter, r *http.Request, session string) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.sessions[session]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "その送信は始まっていません")
+		return
+	}
+
+	start, final, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	if start != int64(len(s.data)) {
+		writeError(w, http.StatusBadRequest, "invalid",
+			fmt.Sprintf("送信位置が食い違っています（%d と %d）", start, len(s.data)))
+		return
+	}
+	s.data = append(s.data, data...)
+
+	if !final {
+		// 実物は 308 を返すが、クライアントが X-GUploader-No-308 を
+		// 付けてくるので、200 と上書き用のヘッダで返す。
+		w.Header().Set("X-Http-Status-Code-Override", "308")
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.data)-1))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	delete(f.sessions, session)
+
+	o, status, msg := f.commit(s.object, s.data)
+	if o == nil {
+		writeError(w, status, "invalid", msg)
+		return
+	}
+	writeJSON(w, o)
+}
+
+// parseContentRange は "bytes 0-9/10" や "bytes 0-9/*" を読み取ります。
+func parseContentRange(spec string) (start int64, final bool, err error) {
+	spec = strings.TrimPrefix(spec, "bytes ")
+	rng, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, false, fmt.Errorf("Content-Range を解釈できません: %q", spec)
+	}
+	final = total != "*"
+
+	if rng == "*" {
+		// 中身が空のまま終わる場合。
+		n, err := strconv.ParseInt(total, 10, 64)
+		return n, true, err
+	}
+
+	lo, _, _ := strings.Cut(rng, "-")
+	start, err = strconv.ParseInt(lo, 10, 64)
+	return start, final, err
+}
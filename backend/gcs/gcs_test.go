@@ -0,0 +1,489 @@
+package gcs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+	"github.com/mt3hr/hbg/storage/storagetest"
+)
+
+// 適合性テストを偽サーバーに対して実行します。
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Harness{
+		NewStorage: func(t *testing.T) (storage.Storage, string) {
+			f := newFakeGCS()
+			s := f.start(t)
+
+			root := "/試験"
+			if err := s.Mkdir(context.Background(), root); err != nil {
+				t.Fatalf("試験用のディレクトリを作れません: %v", err)
+			}
+			return s, root
+		},
+		LargeDirCount: 120,
+	})
+}
+
+func newTestStorage(t *testing.T, mutate ...func(*Config)) (context.Context, *fakeGCS, *Storage) {
+	t.Helper()
+	f := newFakeGCS()
+	return context.Background(), f, f.start(t, mutate...)
+}
+
+func put(t *testing.T, ctx context.Context, s *Storage, p, content string) *storage.FileInfo {
+	t.Helper()
+	fi, err := s.Put(ctx, p, strings.NewReader(content), storage.ObjectMeta{
+		Size: int64(len(content)),
+	})
+	if err != nil {
+		t.Fatalf("Put(%s): %v", p, err)
+	}
+	return fi
+}
+
+func readAll(t *testing.T, ctx context.Context, s *Storage, p string) string {
+	t.Helper()
+	rc, _, err := s.Open(ctx, p)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", p, err)
+	}
+	defer rc.Close()
+
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll(%s): %v", p, err)
+	}
+	return string(b)
+}
+
+func md5Hex(content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func crc32cHex(content string) string {
+	return fmt.Sprintf("%08x", crc32.Checksum([]byte(content), crc32.MakeTable(crc32.Castagnoli)))
+}
+
+// 名前の中の "/" が階層として見え、印を書かなくても済むことを確かめます。
+func TestDirectoriesAreVirtual(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+
+	put(t, ctx, s, "/写真/2024/a.jpg", "A")
+	put(t, ctx, s, "/写真/2023/c.jpg", "C")
+	put(t, ctx, s, "/直下.txt", "D")
+
+	f.mu.Lock()
+	count := len(f.objects)
+	f.mu.Unlock()
+	if count != 3 {
+		t.Errorf("入っている件数 = %d, want 3", count)
+	}
+
+	entries := map[string]bool{}
+	if err := s.List(ctx, "/", func(fi storage.FileInfo) error {
+		entries[fi.Name] = fi.IsDir
+		return nil
+	}); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if isDir, ok := entries["写真"]; !ok || !isDir {
+		t.Error("写真 がディレクトリとして見えていない")
+	}
+	if isDir, ok := entries["直下.txt"]; !ok || isDir {
+		t.Error("直下.txt がファイルとして見えていない")
+	}
+	if len(entries) != 2 {
+		t.Errorf("ルートの一覧 = %v, 2件であるべき", entries)
+	}
+
+	fi, err := s.Stat(ctx, "/写真/2024")
+	if err != nil || !fi.IsDir {
+		t.Errorf("Stat(/写真/2024) = %+v, %v", fi, err)
+	}
+	if _, err := s.Stat(ctx, "/写真/2022"); !storage.IsNotFound(err) {
+		t.Errorf("Stat(/写真/2022) = %v, want ErrNotFound", err)
+	}
+}
+
+// 元のファイルの更新時刻が、Stat でも一覧でも見えることを確かめます。
+//
+// 一覧に利用者定義の項目が含まれるので、1件ずつ問い合わせずに済むことも確かめます。
+func TestModTimeSurvivesRoundTrip(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+
+	want := time.Date(2021, 6, 15, 12, 34, 56, 123456789, time.UTC)
+	if _, err := s.Put(ctx, "/時刻.txt", strings.NewReader("x"), storage.ObjectMeta{
+		Size:    1,
+		ModTime: want,
+	}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	fi, err := s.Stat(ctx, "/時刻.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if !fi.ModTime.Equal(want) {
+		t.Errorf("Stat の更新時刻 = %v, want %v", fi.ModTime, want)
+	}
+
+	before := f.callCount("get")
+	var listed storage.FileInfo
+	if err := s.List(ctx, "/", func(e storage.FileInfo) error {
+		if e.Name == "時刻.txt" {
+			listed = e
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if !listed.ModTime.Equal(want) {
+		t.Errorf("一覧の更新時刻 = %v, want %v", listed.ModTime, want)
+	}
+	if n := f.callCount("get") - before; n != 0 {
+		t.Errorf("一覧のための問い合わせ = %d件, want 0", n)
+	}
+}
+
+// 更新時刻の書式が rclone と同じで、gsutil の書いたものも読めることを確かめます。
+func TestModTimeFormat(t *testing.T) {
+	tm := time.Date(2024, 1, 2, 3, 4, 5, 600000000, time.FixedZone("JST", 9*60*60))
+	got := formatModTime(tm)
+	if want := "2024-01-01T18:04:05.6Z"; got != want {
+		t.Errorf("formatModTime = %q, want %q", got, want)
+	}
+	back, ok := metaModTime(map[string]string{mtimeMeta: got})
+	if !ok || !back.Equal(tm) {
+		t.Errorf("読み戻し = %v, %v", back, ok)
+	}
+
+	gsutil, ok := metaModTime(map[string]string{gsutilMtimeMeta: "1700000000"})
+	if !ok || !gsutil.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("gsutil の時刻 = %v, %v", gsutil, ok)
+	}
+	// 両方あれば、精度の高い mtime を使う。
+	both, _ := metaModTime(map[string]string{mtimeMeta: got, gsutilMtimeMeta: "1700000000"})
+	if !both.Equal(tm) {
+		t.Errorf("両方あるときの時刻 = %v, want %v", both, tm)
+	}
+	if _, ok := metaModTime(map[string]string{mtimeMeta: "1700000000.5"}); ok {
+		t.Error("読めない書式を時刻として扱っている")
+	}
+}
+
+// 分割の大きさを超えるものは、再開できる送信で分けて送ることを確かめます。
+func TestResumableUpload(t *testing.T) {
+	ctx, f, s := newTestStorage(t, func(c *Config) { c.UploadChunkSizeMiB = 1 })
+
+	content := strings.Repeat("0123456789", 350000) // 3.5MB 程度、4回に分かれる
+	fi := put(t, ctx, s, "/大きい.bin", content)
+
+	if n := f.callCount("upload"); n != 1 {
+		t.Errorf("送信を始めた回数 = %d, want 1", n)
+	}
+	if n := f.callCount("upload_chunk"); n != 4 {
+		t.Errorf("分けて送った回数 = %d, want 4", n)
+	}
+	if fi.Size != int64(len(content)) {
+		t.Errorf("Put の大きさ = %d, want %d", fi.Size, len(content))
+	}
+	if got := readAll(t, ctx, s, "/大きい.bin"); got != content {
+		t.Errorf("内容の長さ = %d, want %d", len(got), len(content))
+	}
+	if fi.Hashes[storage.MD5] != md5Hex(content) || fi.Hashes[storage.CRC32C] != crc32cHex(content) {
+		t.Errorf("Put のハッシュ = %v", fi.Hashes)
+	}
+}
+
+// 転送元のハッシュを添えると、食い違ったものは書き込まれないことを確かめます。
+func TestPutSendsHashesForVerification(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+
+	if _, err := s.Put(ctx, "/正しい.txt", strings.NewReader("なかみ"), storage.ObjectMeta{
+		Hashes: map[storage.HashType]string{
+			storage.MD5:    md5Hex("なかみ"),
+			storage.CRC32C: crc32cHex("なかみ"),
+		},
+	}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	_, err := s.Put(ctx, "/壊れた.txt", strings.NewReader("なかみ"), storage.ObjectMeta{
+		Hashes: map[storage.HashType]string{storage.MD5: md5Hex("ちがう")},
+	})
+	if err == nil {
+		t.Fatal("ハッシュが食い違うのに書き込めてしまった")
+	}
+	if class := storage.ClassOf(err); class != storage.ClassPermanent {
+		t.Errorf("失敗の種類 = %v, want permanent", class)
+	}
+	if _, ok := f.object("壊れた.txt"); ok {
+		t.Error("食い違ったものが書き込まれている")
+	}
+}
+
+// 合成されたものは MD5 を持たないので、できないとはっきり伝えることを確かめます。
+func TestHashOfCompositeObject(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+	put(t, ctx, s, "/ふつう.txt", "なかみ")
+
+	got, err := s.Hash(ctx, "/ふつう.txt", storage.MD5)
+	if err != nil || got != md5Hex("なかみ") {
+		t.Errorf("Hash(MD5) = %s, %v", got, err)
+	}
+	got, err = s.Hash(ctx, "/ふつう.txt", storage.CRC32C)
+	if err != nil || got != crc32cHex("なかみ") {
+		t.Errorf("Hash(CRC32C) = %s, %v", got, err)
+	}
+
+	// 他の道具が合成（compose）で作ったものを装う。
+	f.mu.Lock()
+	f.objects["合成.bin"] = &fakeObject{data: []byte("x"), updated: time.Now(), generation: 1, composite: true}
+	f.mu.Unlock()
+
+	if _, err := s.Hash(ctx, "/合成.bin", storage.MD5); !errors.Is(err, storage.ErrUnsupported) {
+		t.Errorf("Hash(MD5) = %v, want ErrUnsupported", err)
+	}
+	if got, err := s.Hash(ctx, "/合成.bin", storage.CRC32C); err != nil || got != crc32cHex("x") {
+		t.Errorf("合成したものの CRC32C = %s, %v", got, err)
+	}
+	if _, err := s.Hash(ctx, "/ふつう.txt", storage.SHA1); !errors.Is(err, storage.ErrUnsupported) {
+		t.Errorf("Hash(SHA1) = %v, want ErrUnsupported", err)
+	}
+}
+
+// 範囲を指定して読めることを確かめます。
+func TestOpenRange(t *testing.T) {
+	ctx, _, s := newTestStorage(t)
+	put(t, ctx, s, "/範囲.txt", "0123456789")
+
+	tests := []struct {
+		offset, length int64
+		want           string
+	}{
+		{2, 3, "234"},
+		{7, -1, "789"},
+		{0, 10, "0123456789"},
+	}
+	for _, tt := range tests {
+		rc, err := s.OpenRange(ctx, "/範囲.txt", tt.offset, tt.length)
+		if err != nil {
+			t.Fatalf("OpenRange(%d, %d): %v", tt.offset, tt.length, err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(b) != tt.want {
+			t.Errorf("OpenRange(%d, %d) = %q, want %q", tt.offset, tt.length, b, tt.want)
+		}
+	}
+}
+
+// コピーが中身と更新時刻を写し、移動が元を消すことを確かめます。
+// 1回で終わらなかった書き写しも、札を添えて終わるまで続けることを確かめます。
+func TestServerSideCopyAndMove(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+
+	mtime := time.Date(2020, 2, 2, 2, 2, 2, 0, time.UTC)
+	if _, err := s.Put(ctx, "/元.txt", strings.NewReader("なかみ"), storage.ObjectMeta{ModTime: mtime}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	f.mu.Lock()
+	f.pendingRewrites = 2
+	f.mu.Unlock()
+
+	fi, err := s.ServerSideCopy(ctx, "/元.txt", "/写し.txt")
+	if err != nil {
+		t.Fatalf("ServerSideCopy: %v", err)
+	}
+	if n := f.callCount("rewrite"); n != 3 {
+		t.Errorf("書き写しの呼び出し = %d回, want 3", n)
+	}
+	if !fi.ModTime.Equal(mtime) || fi.Hashes[storage.MD5] != md5Hex("なかみ") {
+		t.Errorf("写しの情報 = %+v", fi)
+	}
+	if got := readAll(t, ctx, s, "/写し.txt"); got != "なかみ" {
+		t.Errorf("写しの内容 = %q", got)
+	}
+
+	if err := s.Move(ctx, "/写し.txt", "/移動先/写し.txt"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if _, err := s.Stat(ctx, "/写し.txt"); !storage.IsNotFound(err) {
+		t.Errorf("移動元が残っている: %v", err)
+	}
+	if got := readAll(t, ctx, s, "/移動先/写し.txt"); got != "なかみ" {
+		t.Errorf("移動先の内容 = %q", got)
+	}
+}
+
+// Remove が中身ごと消してしまわないことを確かめます。
+func TestRemoveRefusesNonEmptyDir(t *testing.T) {
+	ctx, _, s := newTestStorage(t)
+	put(t, ctx, s, "/消さない/中身.txt", "だいじ")
+
+	err := s.Remove(ctx, "/消さない")
+	if !errors.Is(err, storage.ErrNotEmpty) {
+		t.Fatalf("Remove = %v, want ErrNotEmpty", err)
+	}
+	if _, err := s.Stat(ctx, "/消さない/中身.txt"); err != nil {
+		t.Errorf("中身が消えている: %v", err)
+	}
+
+	if err := s.Purge(ctx, "/消さない"); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	if _, err := s.Stat(ctx, "/消さない"); !storage.IsNotFound(err) {
+		t.Errorf("Purge のあとも残っている: %v", err)
+	}
+}
+
+// root を指定すると、その下が起点になることを確かめます。
+func TestRootIsApplied(t *testing.T) {
+	ctx, f, s := newTestStorage(t, func(c *Config) { c.Root = "起点" })
+
+	put(t, ctx, s, "/中身.txt", "なかみ")
+
+	if _, ok := f.object("起点/中身.txt"); !ok {
+		t.Error("起点の下に書かれていない")
+	}
+	if got := readAll(t, ctx, s, "/中身.txt"); got != "なかみ" {
+		t.Errorf("内容 = %q", got)
+	}
+}
+
+// 配下をまとめて一覧すると、ページの数だけの問い合わせで済むことを確かめます。
+func TestListRecursiveIgnoresDirCount(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+
+	for i := range 10 {
+		put(t, ctx, s, fmt.Sprintf("/木/%d/中/a.txt", i), "x")
+	}
+
+	before := f.callCount("list")
+	tree, err := storage.ListTree(ctx, s, "/木")
+	if err != nil {
+		t.Fatalf("ListTree: %v", err)
+	}
+	// 偽物は3件ずつ返すので、10件で4ページ。
+	if n := f.callCount("list") - before; n != 4 {
+		t.Errorf("一覧の問い合わせ = %d回, want 4", n)
+	}
+	if entries, ok := tree.Dir("/木/3/中"); !ok || len(entries) != 1 {
+		t.Errorf("/木/3/中 の中身 = %v, %v", entries, ok)
+	}
+}
+
+// エラーの分類を確かめます。
+func TestClassifyStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		reason string
+		want   storage.Class
+	}{
+		{404, "notFound", storage.ClassPermanent},
+		{401, "required", storage.ClassAuth},
+		{403, "forbidden", storage.ClassAuth},
+		{403, "rateLimitExceeded", storage.ClassRateLimit},
+		// 請求先の設定がないものは、待っても権限を取り直しても直らない。
+		{403, "userProjectMissing", storage.ClassPermanent},
+		{429, "rateLimitExceeded", storage.ClassRateLimit},
+		{503, "backendError", storage.ClassRetryable},
+		{408, "", storage.ClassRetryable},
+		{412, "conditionNotMet", storage.ClassPermanent},
+		{400, "invalid", storage.ClassPermanent},
+	}
+	for _, tt := range tests {
+		if got := classifyStatus(tt.status, tt.reason); got.class != tt.want {
+			t.Errorf("classifyStatus(%d, %q) = %v, want %v", tt.status, tt.reason, got.class, tt.want)
+		}
+	}
+}
+
+// 流量制限のときの待ち時間の指示が伝わることを確かめます。
+func TestRetryAfterIsHonored(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+	put(t, ctx, s, "/混む.txt", "x")
+	f.failNext("download", 1, 429, "rateLimitExceeded")
+
+	_, _, err := s.Open(ctx, "/混む.txt")
+	if class := storage.ClassOf(err); class != storage.ClassRateLimit {
+		t.Errorf("失敗の種類 = %v, want rate_limit", class)
+	}
+	var opErr *storage.OpError
+	if !errors.As(err, &opErr) || opErr.RetryAfter != 7*time.Second {
+		t.Errorf("待ち時間が伝わっていない: %v", err)
+	}
+}
+
+// 設定の誤りは接続を試みる前に知らせることを確かめます。
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"入れ物がない", Config{}, "bucket"},
+		{"知らない保管の種類", Config{Bucket: "b", StorageClass: "WARM"}, "storage_class"},
+		{"鍵が2つ", Config{Bucket: "b", ServiceAccountFile: "k.json", ServiceAccountCredentials: "{}"}, "service_account_credentials"},
+		{"鍵と OAuth の両方", Config{Bucket: "b", ServiceAccountFile: "k.json", ClientID: "id"}, "client_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if err == nil {
+				t.Fatal("誤りなのに通ってしまった")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("どこが悪いのか分からない: %v", err)
+			}
+		})
+	}
+}
+
+// サービスアカウントの鍵があれば、hbg auth login が要らないことを確かめます。
+func TestUsesOAuth(t *testing.T) {
+	if !(Config{Bucket: "b"}).UsesOAuth() {
+		t.Error("鍵がないのに OAuth を使わない")
+	}
+	if (Config{Bucket: "b", ServiceAccountFile: "k.json"}).UsesOAuth() {
+		t.Error("鍵のファイルがあるのに OAuth を使う")
+	}
+	if (Config{Bucket: "b", ServiceAccountCredentials: "{}"}).UsesOAuth() {
+		t.Error("鍵の中身があるのに OAuth を使う")
+	}
+}
+
+func TestCleanPathAndKey(t *testing.T) {
+	s := &Storage{}
+	keys := map[string]string{
+		"/":        "",
+		"/a/b.txt": "a/b.txt",
+		"a/b.txt":  "a/b.txt",
+		"/a//b":    "a/b",
+		"/a\\b":    "a\\b",
+	}
+	for in, want := range keys {
+		if got := s.key(in); got != want {
+			t.Errorf("key(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	rooted := &Storage{root: "起点"}
+	if got := rooted.key("/a.txt"); got != "起点/a.txt" {
+		t.Errorf("起点つき key = %q", got)
+	}
+	if got := rooted.pathOf("起点/a.txt"); got != "/a.txt" {
+		t.Errorf("起点つき pathOf = %q", got)
+	}
+}
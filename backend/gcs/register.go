@@ -0,0 +1,67 @@
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/storage"
+)
+
+func init() {
+	backend.Register(backend.Descriptor{
+		Type:    Type,
+		Summary: "Google Cloud Storage",
+		ConfigDoc: `  # - name: gcs
+  #   type: gcs
+  #   service_account_file: サービスアカウントの鍵（JSON）のパス。省略すると hbg auth login で認証
+  #   service_account_credentials: ${GCS_SERVICE_ACCOUNT_JSON}  # 鍵の中身を直接渡す場合
+  #   client_id: 省略可（OAuth のとき。Google Drive と同じクライアントを使える）
+  #   client_secret: 省略可
+  #   bucket: 入れ物（バケット）の名前
+  #   storage_class: STANDARD  # STANDARD / NEARLINE / COLDLINE / ARCHIVE（省略するとバケットの既定）
+  #   directory_markers: true
+  #   upload_chunk_size_mib: 16
+  #   root: 起点にする接頭辞
+`,
+		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
+			chunkSize, err := intParam(params, "upload_chunk_size_mib")
+			if err != nil {
+				return nil, fmt.Errorf("gcs %s: %w", name, err)
+			}
+
+			cfg := Config{
+				Name:                      name,
+				ServiceAccountFile:        params.Get("service_account_file"),
+				ServiceAccountCredentials: params.Get("service_account_credentials"),
+				ClientID:                  params.Get("client_id"),
+				ClientSecret:              params.Get("client_secret"),
+				Bucket:                    params.Get("bucket"),
+				StorageClass:              params.Get("storage_class"),
+				UploadChunkSizeMiB:        int64(chunkSize),
+				Root:                      params.Get("root"),
+			}
+			if raw := params.Get("directory_markers"); raw != "" {
+				markers := raw == "true"
+				cfg.DirectoryMarkers = &markers
+			}
+
+			return New(ctx, cfg)
+		},
+	})
+}
+
+// intParam は数として指定された設定を読みます。
+func intParam(params backend.Params, key string) (int, error) {
+	raw := params.Get(key)
+	if raw == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s には数を指定してください（%q が指定されました）", key, raw)
+	}
+	return n, nil
+}
@@ -14,6 +14,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -288,11 +289,15 @@ func (f *fakeDrive) list(w http.ResponseWriter, r *http.Request) {
 
 // selectFiles は検索式に合うものを返します。
 func (f *fakeDrive) selectFiles(query string) ([]*fakeFile, error) {
-	m := parentRe.FindStringSubmatch(query)
-	if m == nil {
+	// 「'a' in parents or 'b' in parents」のように、親を複数並べてもよい。
+	ms := parentRe.FindAllStringSubmatch(query, -1)
+	if ms == nil {
 		return nil, fmt.Errorf("親の指定がない検索式は扱えません: %q", query)
 	}
-	parent := unescapeQuery(m[1])
+	parents := make([]string, len(ms))
+	for i, m := range ms {
+		parents[i] = unescapeQuery(m[1])
+	}
 
 	name := ""
 	if m := nameRe.FindStringSubmatch(query); m != nil {
@@ -303,7 +308,7 @@ func (f *fakeDrive) selectFiles(query string) ([]*fakeFile, error) {
 	out := []*fakeFile{}
 	for _, e := range f.files {
 		switch {
-		case !slicesContains(e.parents, parent):
+		case !slices.ContainsFunc(parents, func(p string) bool { return slicesContains(e.parents, p) }):
 			continue
 		case name != "" && e.name != name:
 			continue
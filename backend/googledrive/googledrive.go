@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"io"
 	"path"
+	"slices"
 	"strings"
 	"time"
 
@@ -52,6 +53,11 @@ const listFields = "nextPageToken,files(" + fileFields + ")"
 // listPageSize は一覧が1回に要求する件数です。
 const listPageSize = 1000
 
+// listParentsBatch は、配下をまとめて一覧するときに1つの検索式へ
+// 入れるフォルダの数です。検索式の長さには上限があるので、
+// 多くはまとめられません。
+const listParentsBatch = 50
+
 // uploadChunkSize は分割送信の1回ぶんの大きさです。
 // これより小さいものは1回の要求で送ります。
 var uploadChunkSize = googleapi.DefaultUploadChunkSize
@@ -195,6 +201,71 @@ func (g *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo
 	return nil
 }
 
+// ListRecursive は dir の配下を深さを問わず1件ずつ fn に渡します。
+//
+// Drive には配下をまとめて返す一覧がありません。代わりに、同じ階層の
+// フォルダを「'a' in parents or 'b' in parents ...」とまとめて問い合わせます。
+// フォルダ1つごとに一覧するより、往復の数がずっと少なく済みます。
+// 見つけたフォルダのIDは覚えておくので、続く読み書きでもたどり直しません。
+func (g *Storage) ListRecursive(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	dirID, err := g.resolver.dirID(ctx, dir)
+	if err != nil {
+		return g.wrapErr("list", dir, err)
+	}
+
+	// queue はまだ中を見ていないフォルダのIDで、paths はそのパスです。
+	queue := []string{dirID}
+	paths := map[string]string{dirID: cleanPath(dir)}
+
+	for len(queue) > 0 {
+		batch := queue[:min(listParentsBatch, len(queue))]
+		queue = queue[len(batch):]
+
+		conds := make([]string, len(batch))
+		for i, id := range batch {
+			conds[i] = fmt.Sprintf("'%s' in parents", escapeQuery(id))
+		}
+		q := "(" + strings.Join(conds, " or ") + ") and trashed = false"
+
+		var cbErr error
+		call := g.listCall(ctx, q)
+		err := call.Pages(ctx, func(page *drive.FileList) error {
+			for _, f := range page.Files {
+				if g.skipNative(f) {
+					continue
+				}
+				// 親を複数持つものは、この問い合わせに含めた親ごとに渡す。
+				for _, parentID := range f.Parents {
+					parent, ok := paths[parentID]
+					if !ok || !slices.Contains(batch, parentID) {
+						continue
+					}
+					fi := g.toFileInfo(f, parent)
+					if fi.IsDir {
+						if _, seen := paths[f.Id]; !seen {
+							paths[f.Id] = fi.Path
+							queue = append(queue, f.Id)
+						}
+						g.resolver.remember(fi.Path, f.Id)
+					}
+					if cbErr = fn(fi); cbErr != nil {
+						return cbErr
+					}
+				}
+			}
+			return nil
+		})
+
+		switch {
+		case cbErr != nil:
+			return cbErr
+		case err != nil:
+			return g.wrapErr("list", dir, err)
+		}
+	}
+	return nil
+}
+
 // listCall は一覧の呼び出しを組み立てます。
 func (g *Storage) listCall(ctx context.Context, q string) *drive.FilesListCall {
 	call := g.srv.Files.List().
@@ -634,5 +705,6 @@ var (
 	_ storage.Purger           = (*Storage)(nil)
 	_ storage.Mover            = (*Storage)(nil)
 	_ storage.RangeOpener      = (*Storage)(nil)
+	_ storage.RecursiveLister  = (*Storage)(nil)
 	_ storage.ServerSideCopier = (*Storage)(nil)
 )
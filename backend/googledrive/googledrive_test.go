@@ -97,6 +97,30 @@ func TestListFollowsPages(t *testing.T) {
 	}
 }
 
+// 配下をまとめて一覧すると、同じ階層のフォルダを1つの問い合わせに
+// まとめることを確かめます。
+func TestListRecursiveBatchesParents(t *testing.T) {
+	ctx, f, s := newTestStorage(t)
+
+	for i := range 5 {
+		put(t, ctx, s, fmt.Sprintf("/木/%d/中/a.txt", i), "x")
+	}
+
+	before := f.callCount("list")
+	tree, err := storage.ListTree(ctx, s, "/木")
+	if err != nil {
+		t.Fatalf("ListTree: %v", err)
+	}
+	// 階層ごとに5件ずつ、1ページ3件なので2ページ。3階層で6回。
+	// フォルダごとに一覧すれば11のフォルダで11回以上かかる。
+	if n := f.callCount("list") - before; n != 6 {
+		t.Errorf("一覧の呼び出し = %d, want 6", n)
+	}
+	if entries, ok := tree.Dir("/木/3/中"); !ok || len(entries) != 1 || entries[0].Name != "a.txt" {
+		t.Errorf("/木/3/中 の中身 = %v, %v", entries, ok)
+	}
+}
+
 // 存在しない途中の段があったら、その場で失敗することを確かめます。
 //
 // 以前は見つからない段を黙って読み飛ばし、ひとつ上の階層の中身を
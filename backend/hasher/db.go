@@ -0,0 +1,287 @@
+package hasher
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// ハッシュの記録は、1ファイルにつき1行の JSON を書き足していくファイルです。
+//
+//   - 1行目は版を表す見出しです。版が違えば、記録は空から始めます。
+//   - 同じパスの行が何度も出てきたら、後の行が勝ちます。消したものは
+//     removed の行で表します。
+//   - 開くときに読み込んで、最新の行だけに詰めて書き直します。書き足すだけ
+//     だと、上書きを重ねるうちに記録が膨らみ続けるためです。
+//   - 強制終了で最後の行が欠けても、それより前は読めます。欠けた行は
+//     読み飛ばします。
+//
+// 記録は補助です。失っても、ハッシュが分からないものが増えるだけです。
+
+// dbVersion は記録の形式の版です。形式を変えたら上げます。
+const dbVersion = 1
+
+// record は1ファイルぶんの記録です。
+type record struct {
+	Path    string                      `json:"path"`
+	Size    int64                       `json:"size,omitempty"`
+	ModTime time.Time                   `json:"mod_time,omitzero"`
+	Hashes  map[storage.HashType]string `json:"hashes,omitempty"`
+	Removed bool                        `json:"removed,omitempty"`
+}
+
+// db はハッシュの記録です。複数のワーカーから同時に使えます。
+type db struct {
+	path string
+	// precision は更新時刻を照合するときの許容幅です。
+	precision time.Duration
+
+	mu      sync.Mutex
+	f       *os.File
+	records map[string]record
+	// err は最初の書き込みの失敗です。失敗したら以降は書きません。
+	err error
+}
+
+func dbHeader() string {
+	return fmt.Sprintf("hbg-hashes %d", dbVersion)
+}
+
+// openDB は記録を開きます。無ければ作ります。
+func openDB(file string, precision time.Duration) (*db, error) {
+	d := &db{path: file, precision: precision, records: map[string]record{}}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return nil, fmt.Errorf("ハッシュの記録の置き場所を作れませんでした: %w", err)
+	}
+	// 詰めたものを別の名前で書いてから置き換える。途中で止まっても、
+	// 元の記録が残るようにするため。
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("ハッシュの記録を書けませんでした: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	w.WriteString(dbHeader() + "\n")
+	for _, r := range d.records {
+		line, _ := json.Marshal(r)
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("ハッシュの記録を書けませんでした: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("ハッシュの記録を書けませんでした: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("ハッシュの記録を置き換えられませんでした: %w", err)
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("ハッシュの記録を開けませんでした: %w", err)
+	}
+	d.f = f
+	return d, nil
+}
+
+// load は残っている記録を読みます。
+func (d *db) load() error {
+	f, err := os.Open(d.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("ハッシュの記録を読めませんでした: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !sc.Scan() || sc.Text() != dbHeader() {
+		// 形式の違うもの。使わない。
+		return nil
+	}
+	for sc.Scan() {
+		var r record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil || r.Path == "" {
+			// 書いている途中で止まった行。
+			continue
+		}
+		if r.Removed {
+			delete(d.records, r.Path)
+			continue
+		}
+		d.records[r.Path] = r
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("ハッシュの記録を読めませんでした: %w", err)
+	}
+	return nil
+}
+
+// close は記録を閉じます。記録はそのまま残ります。
+func (d *db) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.f == nil {
+		return nil
+	}
+	err := d.f.Close()
+	d.f = nil
+	return err
+}
+
+// get は info のファイルの記録を返します。記録したときから大きさか更新時刻が
+// 変わっていれば、無いものとします。
+func (d *db) get(info *storage.FileInfo) (map[storage.HashType]string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r, ok := d.records[info.Path]
+	if !ok || !d.fresh(r, info) {
+		return nil, false
+	}
+	return r.Hashes, true
+}
+
+// fresh は、記録 r が info のファイルのものとして使えるかを返します。
+//
+// 更新時刻は分解能の範囲で比べます。書いたときに返ってきた時刻と、
+// あとで一覧に出る時刻とで、丸め方が違うストレージがあるためです。
+// 更新時刻の分からないストレージでは、大きさだけで照合します。
+func (d *db) fresh(r record, info *storage.FileInfo) bool {
+	if r.Size != info.Size {
+		return false
+	}
+	diff := r.ModTime.Sub(info.ModTime)
+	return diff.Abs() <= d.precision
+}
+
+// set は info のファイルのハッシュを記録します。
+// 同じ大きさと更新時刻の記録があれば、種類を足し合わせます。
+func (d *db) set(info *storage.FileInfo, hashes map[storage.HashType]string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := record{Path: info.Path, Size: info.Size, ModTime: info.ModTime, Hashes: map[storage.HashType]string{}}
+	if prev, ok := d.records[info.Path]; ok && d.fresh(prev, info) {
+		maps.Copy(r.Hashes, prev.Hashes)
+	}
+	maps.Copy(r.Hashes, hashes)
+	d.records[r.Path] = r
+	d.writeLocked(r)
+}
+
+// touch は、内容を変えずに更新時刻だけを変えたときに、記録を引き継ぎます。
+func (d *db) touch(info *storage.FileInfo, modTime time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r, ok := d.records[info.Path]
+	if !ok {
+		return
+	}
+	if !d.fresh(r, info) {
+		d.removeLocked(info.Path)
+		return
+	}
+	r.ModTime = modTime
+	d.records[r.Path] = r
+	d.writeLocked(r)
+}
+
+// forget は p の記録を消します。
+func (d *db) forget(p string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.records[p]; ok {
+		d.removeLocked(p)
+	}
+}
+
+// remove は p と、p より下にあるものの記録を消します。
+func (d *db) remove(p string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for q := range d.records {
+		if under(q, p) {
+			d.removeLocked(q)
+		}
+	}
+}
+
+// rename は p と、p より下にあるものの記録を dst の下へ移します。
+func (d *db) rename(src, dst string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// 移動先にあったものは上書きされている。
+	for q := range d.records {
+		if under(q, dst) {
+			d.removeLocked(q)
+		}
+	}
+	var moved []record
+	for q, r := range d.records {
+		if under(q, src) {
+			d.removeLocked(q)
+			r.Path = dst + strings.TrimPrefix(q, src)
+			moved = append(moved, r)
+		}
+	}
+	for _, r := range moved {
+		d.records[r.Path] = r
+		d.writeLocked(r)
+	}
+}
+
+// copy は、src のファイルの記録を、コピーしてできた dst のファイルにも付けます。
+func (d *db) copy(src, dst *storage.FileInfo) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r, ok := d.records[src.Path]
+	if !ok || !d.fresh(r, src) || dst.Size != src.Size {
+		return
+	}
+	r = record{Path: dst.Path, Size: dst.Size, ModTime: dst.ModTime, Hashes: r.Hashes}
+	d.records[r.Path] = r
+	d.writeLocked(r)
+}
+
+func (d *db) removeLocked(p string) {
+	delete(d.records, p)
+	d.writeLocked(record{Path: p, Removed: true})
+}
+
+// writeLocked は記録を1行書き足します。
+// 1行を1度の書き込みで書くので、強制終了しても欠けるのは最後の行だけです。
+func (d *db) writeLocked(r record) {
+	if d.f == nil || d.err != nil {
+		return
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	if _, err := d.f.Write(append(line, '\n')); err != nil {
+		d.err = err
+	}
+}
+
+// under は q が p そのものか、p より下にあるかを返します。
+func under(q, p string) bool {
+	return q == p || p == "/" || strings.HasPrefix(q, p+"/")
+}
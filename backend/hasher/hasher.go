@@ -0,0 +1,414 @@
+// Package hasher は、ハッシュを求められないストレージの上に重ねて、
+// 手元に記録したハッシュを答えるストレージです。
+//
+// SFTP・SMB・WebDAV・FTP はハッシュを返せないので、そのままでは
+// --compare hash（--checksum）で比べられません。hasher を重ねておくと、
+// 書き込むときに流れる内容からハッシュを求めて記録し、一覧や Hash では
+// その記録を答えます。最後まで読んだものも、ついでに記録します。
+//
+// 記録はパスごとに、記録したときの大きさと更新時刻を添えて持ちます。
+// どちらかが変わっていれば、hasher を通さずに書き換えられたものとして
+// 使いません。記録の無いものは、hash_missing を指定すれば内容を読んで
+// 求め、指定しなければ求められないというエラーを返します。空を返すと、
+// 比べる側で空どうしが一致して、中身の違うものを同じと見てしまうためです。
+package hasher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Type はこのバックエンドの種別名です。
+const Type = "hasher"
+
+// DefaultHashes は、記録する種類を指定しなかったときに記録するハッシュです。
+// 多くのクラウドと突き合わせられる2つにしています。
+var DefaultHashes = storage.HashSet{storage.SHA256, storage.MD5}
+
+// Config は hasher の設定です。
+type Config struct {
+	// DB はハッシュを記録するファイルです。
+	DB string
+	// Hashes は記録するハッシュの種類です。空なら DefaultHashes です。
+	Hashes storage.HashSet
+	// HashMissing が真なら、記録の無いものや古いもののハッシュを、
+	// 内容を読んで求めます。偽なら ErrUnsupported のエラーを返します。
+	HashMissing bool
+}
+
+// Storage は、下のストレージのハッシュを手元に記録して答えます。
+type Storage struct {
+	name        string
+	inner       storage.Storage
+	hashes      storage.HashSet
+	hashMissing bool
+	db          *db
+}
+
+// New は inner の上に重ねる hasher を作ります。
+//
+// inner は閉じません。閉じるのは inner を組み立てた側です。
+// 記録のファイルは Close で閉じます。
+func New(name string, inner storage.Storage, cfg Config) (*Storage, error) {
+	if cfg.DB == "" {
+		return nil, errors.New("ハッシュを記録するファイルが指定されていません")
+	}
+	hashes := slices.Clone(cfg.Hashes)
+	if len(hashes) == 0 {
+		hashes = slices.Clone(DefaultHashes)
+	}
+	for _, ht := range hashes {
+		if _, err := storage.NewHash(ht); err != nil {
+			return nil, err
+		}
+	}
+	d, err := openDB(cfg.DB, inner.Features().ModTimePrecision)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{
+		name:        name,
+		inner:       inner,
+		hashes:      hashes,
+		hashMissing: cfg.HashMissing,
+		db:          d,
+	}, nil
+}
+
+// Type はストレージの種別を返します。
+func (s *Storage) Type() string { return Type }
+
+// Name は設定ファイルで付けた名前を返します。
+func (s *Storage) Name() string { return s.name }
+
+// Features は下のストレージのものに、記録するハッシュを足して返します。
+func (s *Storage) Features() *storage.Features {
+	f := *s.inner.Features()
+	f.Hashes = slices.Clone(f.Hashes)
+	for _, ht := range s.hashes {
+		if !f.Hashes.Has(ht) {
+			f.Hashes = append(f.Hashes, ht)
+		}
+	}
+	return &f
+}
+
+// Supports は、ハッシュはいつでも、それ以外は下のストレージで使える
+// ものだけを使えると答えます。
+//
+// 続きからの書き込みは使えないと答えます。書いた内容の全体を
+// 通して見ないと、ハッシュを求められないためです。
+func (s *Storage) Supports(c storage.Capability) bool {
+	switch c {
+	case storage.CapHash:
+		return true
+	case storage.CapServerSideCopy, storage.CapMove, storage.CapRangeOpen,
+		storage.CapPurge, storage.CapSetModTime, storage.CapAbout:
+		return storage.Supports(s.inner, c)
+	}
+	return false
+}
+
+// Close は記録のファイルを閉じます。下のストレージは組み立てた側が閉じます。
+func (s *Storage) Close() error { return s.db.close() }
+
+// Permit は下のストレージで op が許されているかを返します。
+// ハッシュの記録は手元に書きますが、内容の変更は下の制限に従います。
+func (s *Storage) Permit(op string) error { return storage.Permit(s.inner, op) }
+
+func (s *Storage) wrapErr(op, p string, err error) error {
+	return storage.Wrap(op, s.name, p, storage.ClassOf(err), err)
+}
+
+// withHashes は、記録にあるハッシュを fi に添えて返します。
+func (s *Storage) withHashes(fi *storage.FileInfo) *storage.FileInfo {
+	if fi.IsDir {
+		return fi
+	}
+	recorded, ok := s.db.get(fi)
+	if !ok {
+		return fi
+	}
+	out := *fi
+	out.Hashes = maps.Clone(fi.Hashes)
+	if out.Hashes == nil {
+		out.Hashes = map[storage.HashType]string{}
+	}
+	maps.Copy(out.Hashes, recorded)
+	return &out
+}
+
+// recorded は、記録するハッシュがすべて fi について記録済みかを返します。
+func (s *Storage) recorded(fi *storage.FileInfo) bool {
+	hashes, ok := s.db.get(fi)
+	if !ok {
+		return false
+	}
+	for _, ht := range s.hashes {
+		if hashes[ht] == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// --- 基本の操作 ---
+
+// List は下のストレージの一覧に、記録にあるハッシュを添えて返します。
+func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	return s.inner.List(ctx, dir, func(fi storage.FileInfo) error {
+		return fn(*s.withHashes(&fi))
+	})
+}
+
+// Stat は下のストレージのメタデータに、記録にあるハッシュを添えて返します。
+func (s *Storage) Stat(ctx context.Context, p string) (*storage.FileInfo, error) {
+	fi, err := s.inner.Stat(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return s.withHashes(fi), nil
+}
+
+// Open は下のストレージから読みます。
+// まだ記録の揃っていないものは、最後まで読まれたらハッシュを記録します。
+func (s *Storage) Open(ctx context.Context, p string) (io.ReadCloser, *storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	rc, fi, err := s.inner.Open(ctx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.IsDir || fi.Size == storage.SizeUnknown || s.recorded(fi) {
+		return rc, s.withHashes(fi), nil
+	}
+	w, sum, err := storage.MultiHasher(s.hashes...)
+	if err != nil {
+		rc.Close()
+		return nil, nil, s.wrapErr("open", p, err)
+	}
+	info := *fi
+	info.Path = p
+	return &hashingReader{rc: rc, w: w, sum: sum, db: s.db, info: info}, s.withHashes(fi), nil
+}
+
+// Put は下のストレージに書きながらハッシュを求め、書き終えたら記録します。
+func (s *Storage) Put(ctx context.Context, p string, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	// 書き終えるまでは、前の内容のハッシュを答えないようにする。
+	s.db.forget(p)
+
+	w, sum, err := storage.MultiHasher(s.hashes...)
+	if err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+	cw := &countingWriter{w: w}
+	fi, err := s.inner.Put(ctx, p, io.TeeReader(r, cw), meta)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size == storage.SizeUnknown || fi.Size == cw.n {
+		info := *fi
+		info.Path, info.Size = p, cw.n
+		s.db.set(&info, sum())
+	}
+	return s.withHashes(fi), nil
+}
+
+// Mkdir は下のストレージにディレクトリを作ります。
+func (s *Storage) Mkdir(ctx context.Context, dir string) error {
+	return s.inner.Mkdir(ctx, dir)
+}
+
+// Remove は下のストレージから消し、記録も消します。
+func (s *Storage) Remove(ctx context.Context, p string) error {
+	p = storage.CleanPath(p)
+	if err := s.inner.Remove(ctx, p); err != nil {
+		return err
+	}
+	s.db.forget(p)
+	return nil
+}
+
+// --- 下のストレージが持っていれば使える能力 ---
+
+// Hash は記録にあるハッシュを返します。
+//
+// 記録が無ければ、下のストレージが求められる種類なら下に求めさせます。
+// それもできなければ、hash_missing の指定があるときは内容を読んで
+// 求めて記録し、無いときは ErrUnsupported のエラーを返します。
+// 記録しない種類は下に任せます。
+func (s *Storage) Hash(ctx context.Context, p string, ht storage.HashType) (string, error) {
+	p = storage.CleanPath(p)
+	if !s.hashes.Has(ht) {
+		return storage.GetHash(ctx, s.inner, &storage.FileInfo{Path: p}, ht)
+	}
+
+	fi, err := s.Stat(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir {
+		return "", s.wrapErr("hash", p, storage.ErrIsDir)
+	}
+	if h := fi.Hashes[ht]; h != "" {
+		return h, nil
+	}
+	if s.inner.Features().Hashes.Has(ht) {
+		return storage.GetHash(ctx, s.inner, fi, ht)
+	}
+	if !s.hashMissing {
+		return "", s.missing(p, ht)
+	}
+
+	// 読み切れば Open が記録する。
+	rc, _, err := s.Open(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		return "", s.wrapErr("hash", p, err)
+	}
+	if hr, ok := rc.(*hashingReader); ok {
+		return hr.sums[ht], nil
+	}
+	// 読んでいるあいだに、他のワーカーが記録を揃えていた。
+	fi, err = s.Stat(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	if h := fi.Hashes[ht]; h != "" {
+		return h, nil
+	}
+	return "", s.missing(p, ht)
+}
+
+// missing は、p の ht が記録に無く、求めもしないことを表すエラーを返します。
+func (s *Storage) missing(p string, ht storage.HashType) error {
+	return s.wrapErr("hash", p, fmt.Errorf("%w: ハッシュ %s の記録がありません", storage.ErrUnsupported, ht))
+}
+
+// ServerSideCopy は下のストレージの中でコピーし、記録も写します。
+func (s *Storage) ServerSideCopy(ctx context.Context, srcPath, dstPath string) (*storage.FileInfo, error) {
+	srcPath, dstPath = storage.CleanPath(srcPath), storage.CleanPath(dstPath)
+	src, err := s.inner.Stat(ctx, srcPath)
+	if err != nil {
+		return nil, err
+	}
+	s.db.forget(dstPath)
+	fi, err := storage.ServerSideCopy(ctx, s.inner, s.inner, srcPath, dstPath)
+	if err != nil {
+		return nil, err
+	}
+	info := *fi
+	info.Path = dstPath
+	s.db.copy(src, &info)
+	return s.withHashes(fi), nil
+}
+
+// OpenRange は下のストレージから途中から読みます。
+func (s *Storage) OpenRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	return storage.OpenRange(ctx, s.inner, p, offset, length)
+}
+
+// Move は下のストレージの中で移動し、記録も移します。
+func (s *Storage) Move(ctx context.Context, srcPath, dstPath string) error {
+	srcPath, dstPath = storage.CleanPath(srcPath), storage.CleanPath(dstPath)
+	if err := storage.Move(ctx, s.inner, srcPath, dstPath); err != nil {
+		return err
+	}
+	s.db.rename(srcPath, dstPath)
+	return nil
+}
+
+// Purge は下のストレージから中身ごと消し、記録も消します。
+func (s *Storage) Purge(ctx context.Context, dir string) error {
+	dir = storage.CleanPath(dir)
+	if err := storage.PurgeAll(ctx, s.inner, dir); err != nil {
+		return err
+	}
+	s.db.remove(dir)
+	return nil
+}
+
+// SetModTime は下のストレージで最終更新時刻を変更し、記録を引き継ぎます。
+// 内容は変わらないので、ハッシュはそのまま使えます。
+func (s *Storage) SetModTime(ctx context.Context, p string, t time.Time) error {
+	p = storage.CleanPath(p)
+	fi, err := s.inner.Stat(ctx, p)
+	if err != nil {
+		return err
+	}
+	if err := storage.SetModTime(ctx, s.inner, p, t); err != nil {
+		return err
+	}
+	s.db.touch(fi, t)
+	return nil
+}
+
+// About は下のストレージの容量を返します。
+func (s *Storage) About(ctx context.Context, p string) (*storage.Usage, error) {
+	return storage.About(ctx, s.inner, p)
+}
+
+// --- 流れる内容からハッシュを求める ---
+
+// countingWriter は書かれたバイト数を数えます。
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// hashingReader は、読んだ内容のハッシュを求めます。最後まで読まれ、
+// 大きさが合っていれば記録します。
+type hashingReader struct {
+	rc   io.ReadCloser
+	w    io.Writer
+	sum  func() map[storage.HashType]string
+	db   *db
+	info storage.FileInfo
+	n    int64
+	// sums は記録したハッシュです。最後まで読むまでは nil です。
+	sums map[storage.HashType]string
+}
+
+func (r *hashingReader) Read(b []byte) (int, error) {
+	n, err := r.rc.Read(b)
+	if n > 0 {
+		r.w.Write(b[:n])
+		r.n += int64(n)
+	}
+	if errors.Is(err, io.EOF) && r.sums == nil && r.n == r.info.Size {
+		r.sums = r.sum()
+		r.db.set(&r.info, r.sums)
+	}
+	return n, err
+}
+
+func (r *hashingReader) Close() error { return r.rc.Close() }
+
+var (
+	_ storage.Storage            = (*Storage)(nil)
+	_ storage.CapabilityReporter = (*Storage)(nil)
+	_ storage.Permitter          = (*Storage)(nil)
+	_ storage.Hasher             = (*Storage)(nil)
+	_ storage.ServerSideCopier   = (*Storage)(nil)
+	_ storage.RangeOpener        = (*Storage)(nil)
+	_ storage.Mover              = (*Storage)(nil)
+	_ storage.Purger             = (*Storage)(nil)
+	_ storage.SetModTimer        = (*Storage)(nil)
+	_ storage.Abouter            = (*Storage)(nil)
+)
@@ -0,0 +1,255 @@
+package hasher_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/backend/hasher"
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/internal/hbghome"
+	"github.com/mt3hr/hbg/storage"
+	"github.com/mt3hr/hbg/storage/storagetest"
+	"github.com/mt3hr/hbg/transfer"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Harness{
+		NewStorage: func(t *testing.T) (storage.Storage, string) {
+			t.Setenv(hbghome.EnvHome, t.TempDir())
+			r, err := backend.NewResolver([]backend.Entry{
+				{Name: "mem", Type: memory.Type},
+				{Name: "hashed", Type: hasher.Type, Params: backend.Params{"remote": "mem:/hashed", "hashes": "sha256 md5"}},
+			})
+			if err != nil {
+				t.Fatalf("NewResolver: %v", err)
+			}
+			t.Cleanup(func() { r.Close() })
+			s, err := r.Get(context.Background(), "hashed")
+			if err != nil {
+				t.Fatalf("Get(hashed): %v", err)
+			}
+			return s, "/root"
+		},
+	})
+}
+
+// noHash は、ハッシュを扱えないストレージです。
+// SFTP や FTP の代わりに使います。
+type noHash struct {
+	storage.Storage
+}
+
+func (n noHash) Features() *storage.Features {
+	f := *n.Storage.Features()
+	f.Hashes = nil
+	return &f
+}
+
+// newHasher は、ハッシュを扱えないメモリの上に hasher を重ねます。
+func newHasher(t *testing.T, db string, cfg hasher.Config) (*hasher.Storage, *memory.Storage) {
+	t.Helper()
+	mem := memory.New("mem")
+	cfg.DB = db
+	s, err := hasher.New("hashed", noHash{mem}, cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, mem
+}
+
+var modTime = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func put(t *testing.T, s storage.Storage, p, content string, mt time.Time) {
+	t.Helper()
+	if _, err := s.Put(context.Background(), p, strings.NewReader(content), storage.ObjectMeta{
+		Size:    int64(len(content)),
+		ModTime: mt,
+	}); err != nil {
+		t.Fatalf("Put(%s): %v", p, err)
+	}
+}
+
+func sha256Of(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// 書き込んだものは、一覧でも Hash でもハッシュが分かることを確認します。
+func TestPutRecords(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newHasher(t, filepath.Join(t.TempDir(), "hashes.jsonl"), hasher.Config{})
+	if !s.Features().Hashes.Has(storage.SHA256) {
+		t.Fatalf("Features().Hashes = %v", s.Features().Hashes)
+	}
+
+	put(t, s, "/dir/a.txt", "内容", modTime)
+	entries, err := storage.ListAll(ctx, s, "/dir")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if got := entries[0].Hashes[storage.SHA256]; got != sha256Of("内容") {
+		t.Errorf("一覧の sha256 = %q", got)
+	}
+	got, err := s.Hash(ctx, "/dir/a.txt", storage.SHA256)
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if got != sha256Of("内容") {
+		t.Errorf("Hash = %q", got)
+	}
+}
+
+// hasher を通さずに変えられたものは、記録を使わないことを確認します。
+func TestStaleRecord(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name        string
+		hashMissing bool
+		want        string
+	}{
+		{"記録だけ", false, ""},
+		{"読んで求める", true, sha256Of("別物")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, mem := newHasher(t, filepath.Join(t.TempDir(), "hashes.jsonl"), hasher.Config{HashMissing: tt.hashMissing})
+			put(t, s, "/a.txt", "内容", modTime)
+			// 大きさが同じでも、更新時刻が変われば古い記録とみなす。
+			put(t, mem, "/a.txt", "別物", modTime.Add(time.Hour))
+
+			got, err := s.Hash(ctx, "/a.txt", storage.SHA256)
+			if tt.want == "" {
+				if !errors.Is(err, storage.ErrUnsupported) {
+					t.Errorf("Hash = %q, %v; ErrUnsupported を期待", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Hash: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Hash = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 最後まで読んだものは、ついでに記録することを確認します。
+func TestOpenRecords(t *testing.T) {
+	ctx := context.Background()
+	s, mem := newHasher(t, filepath.Join(t.TempDir(), "hashes.jsonl"), hasher.Config{})
+	put(t, mem, "/a.txt", "内容", modTime)
+
+	rc, _, err := s.Open(ctx, "/a.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	io.Copy(io.Discard, rc)
+	rc.Close()
+
+	fi, err := s.Stat(ctx, "/a.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if got := fi.Hashes[storage.MD5]; got == "" {
+		t.Error("読んだものの md5 が記録されていない")
+	}
+}
+
+// 記録はファイルにあるので、作り直しても使えることを確認します。
+// 移動・削除も記録に反映されることを確認します。
+func TestPersists(t *testing.T) {
+	ctx := context.Background()
+	db := filepath.Join(t.TempDir(), "hashes.jsonl")
+	s, mem := newHasher(t, db, hasher.Config{})
+	put(t, s, "/dir/a.txt", "a", modTime)
+	put(t, s, "/dir/b.txt", "b", modTime)
+	put(t, s, "/c.txt", "c", modTime)
+	if err := storage.Move(ctx, s, "/dir/a.txt", "/moved/a.txt"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if err := s.Remove(ctx, "/c.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	put(t, mem, "/c.txt", "c", modTime)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	again, err := hasher.New("hashed", noHash{mem}, hasher.Config{DB: db})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer again.Close()
+	mem.SetHooks(memory.Hooks{BeforeOp: func(op, p string) error {
+		if op == "open" {
+			t.Errorf("記録があるのに %s を読んだ", p)
+		}
+		return nil
+	}})
+
+	// 消したあとに hasher を通さずに置かれたものは分からない。
+	if got, err := again.Hash(ctx, "/c.txt", storage.SHA256); !errors.Is(err, storage.ErrUnsupported) {
+		t.Errorf("Hash(/c.txt) = %q, %v; ErrUnsupported を期待", got, err)
+	}
+	for p, want := range map[string]string{
+		"/moved/a.txt": sha256Of("a"),
+		"/dir/b.txt":   sha256Of("b"),
+	} {
+		got, err := again.Hash(ctx, p, storage.SHA256)
+		if err != nil {
+			t.Fatalf("Hash(%s): %v", p, err)
+		}
+		if got != want {
+			t.Errorf("Hash(%s) = %q, want %q", p, got, want)
+		}
+	}
+}
+
+// 記録の無いもの同士は、大きさが同じでも「ハッシュが同じ」として
+// 飛ばさず、取得できなかったとして送ることを確認します。
+func TestCompareWithoutRecord(t *testing.T) {
+	ctx := context.Background()
+	src, srcMem := newHasher(t, filepath.Join(t.TempDir(), "src.jsonl"), hasher.Config{})
+	dst, dstMem := newHasher(t, filepath.Join(t.TempDir(), "dst.jsonl"), hasher.Config{})
+	put(t, srcMem, "/a.txt", "AAAA", modTime)
+	put(t, dstMem, "/a.txt", "BBBB", modTime)
+
+	c, err := transfer.NewComparer(transfer.ComparePolicy{
+		Fields: []transfer.CompareField{transfer.CompareSize, transfer.CompareHash},
+	}, src, dst)
+	if err != nil {
+		t.Fatalf("NewComparer: %v", err)
+	}
+	srcInfo, err := src.Stat(ctx, "/a.txt")
+	if err != nil {
+		t.Fatalf("Stat(src): %v", err)
+	}
+	dstInfo, err := dst.Stat(ctx, "/a.txt")
+	if err != nil {
+		t.Fatalf("Stat(dst): %v", err)
+	}
+	action, reason, err := c.Decide(ctx, *srcInfo, dstInfo)
+	if action != transfer.ActionCopy || !errors.Is(err, storage.ErrUnsupported) {
+		t.Errorf("Decide = %v, %q, %v; 取得できずに送ることを期待", action, reason, err)
+	}
+}
+
+// 記録する種類に知らないものを指定したら、組み立てられないことを確認します。
+func TestUnknownHash(t *testing.T) {
+	_, err := hasher.New("hashed", memory.New("mem"), hasher.Config{
+		DB:     filepath.Join(t.TempDir(), "hashes.jsonl"),
+		Hashes: storage.HashSet{"crc99"},
+	})
+	if err == nil {
+		t.Error("知らない種類を指定できてしまった")
+	}
+}
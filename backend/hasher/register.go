@@ -0,0 +1,52 @@
+package hasher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/internal/hbghome"
+	"github.com/mt3hr/hbg/storage"
+)
+
+func init() {
+	backend.Register(backend.Descriptor{
+		Type:    Type,
+		Summary: "他のストレージの上に重ねて、ハッシュを手元に記録する",
+		ConfigDoc: `  # - name: hashed
+  #   type: hasher
+  #   remote: sftp:/backup  # ハッシュを記録するストレージ（設定にあるストレージ名:パス）
+  #   hashes: sha256 md5  # 省略可。記録するハッシュを空白で区切る
+  #   hash_missing: true  # 省略可。記録の無いものは内容を読んで求める
+`,
+		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
+			remote := params.Get("remote")
+			if remote == "" {
+				return nil, fmt.Errorf("hasher %s: remote が設定されていません", name)
+			}
+			cfg := Config{HashMissing: params.Get("hash_missing") == "true"}
+			for _, v := range strings.Fields(params.Get("hashes")) {
+				cfg.Hashes = append(cfg.Hashes, storage.HashType(strings.ToLower(v)))
+			}
+
+			// 重ねる先ごとに分ける。remote を書き換えたときに、前の記録を
+			// 取り違えて使わないため。
+			db, err := hbghome.HashDBFile(name + "\n" + remote)
+			if err != nil {
+				return nil, fmt.Errorf("hasher %s: %w", name, err)
+			}
+			cfg.DB = db
+
+			inner, err := backend.Remote(ctx, remote)
+			if err != nil {
+				return nil, fmt.Errorf("hasher %s: %w", name, err)
+			}
+			s, err := New(name, inner, cfg)
+			if err != nil {
+				return nil, fmt.Errorf("hasher %s: %w", name, err)
+			}
+			return s, nil
+		},
+	})
+}
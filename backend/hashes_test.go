@@ -6,6 +6,7 @@ import (
 	"github.com/mt3hr/hbg/backend/dropbox"
 	"github.com/mt3hr/hbg/backend/googledrive"
 	"github.com/mt3hr/hbg/backend/local"
+	"github.com/mt3hr/hbg/backend/onedrive"
 	"github.com/mt3hr/hbg/storage"
 )
 
@@ -20,6 +21,7 @@ func TestCommonHashBetweenBackends(t *testing.T) {
 		"local":       local.New("local").Features().Hashes,
 		"dropbox":     (&dropbox.Storage{}).Features().Hashes,
 		"googledrive": (&googledrive.Storage{}).Features().Hashes,
+		"onedrive":    (&onedrive.Storage{}).Features().Hashes,
 	}
 
 	tests := []struct {
@@ -33,9 +35,14 @@ func TestCommonHashBetweenBackends(t *testing.T) {
 		{"local", "googledrive", storage.SHA256, true},
 		{"googledrive", "local", storage.SHA256, true},
 		{"local", "local", storage.SHA256, true},
+		// ローカルは quickXorHash も計算できる。
+		{"local", "onedrive", storage.QuickXor, true},
+		{"onedrive", "local", storage.QuickXor, true},
 		// Dropbox は独自形式、Drive は sha/md5 で、重なるものがない。
 		{"dropbox", "googledrive", "", false},
 		{"googledrive", "dropbox", "", false},
+		{"onedrive", "dropbox", "", false},
+		{"onedrive", "googledrive", "", false},
 	}
 
 	for _, tt := range tests {
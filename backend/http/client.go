@@ -0,0 +1,193 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// 一覧のときに大きさと更新時刻をどう求めるか。
+const (
+	// ListMetadataHead は1件ずつ HEAD で問い合わせます。
+	// 一覧の表示は分単位で、大きさも "1.2K" のように丸められていることが
+	// 多いので、比べるのに使える値はこちらでしか得られません。
+	ListMetadataHead = "head"
+	// ListMetadataNone は一覧に書かれた値をそのまま使います。
+	// 読み取れない値は不明として扱います。
+	ListMetadataNone = "none"
+)
+
+// Config は HTTP ストレージの設定です。
+type Config struct {
+	// Name は設定ファイルで付けた名前です。
+	Name string
+
+	// URL は一覧を公開している入口です。ここが起点になります。
+	URL string
+	// User と Password は Basic 認証に使います。公開されていれば不要です。
+	User     string
+	Password string
+
+	// ListMetadata は一覧のときに大きさと更新時刻をどう求めるかです。
+	// "head"（既定）か "none" を指定します。
+	ListMetadata string
+
+	// transportOverride は試験のために通信の経路を差し替えるためのものです。
+	transportOverride http.RoundTripper
+}
+
+func (c Config) listMetadata() string {
+	if c.ListMetadata == "" {
+		return ListMetadataHead
+	}
+	return c.ListMetadata
+}
+
+// validate は接続を試みる前に設定の不足を知らせます。
+func (c Config) validate() error {
+	if c.URL == "" {
+		return errors.New("入口（url）が指定されていません")
+	}
+	if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		return fmt.Errorf("url は http:// か https:// で始めてください（%q が指定されました）", c.URL)
+	}
+
+	switch c.listMetadata() {
+	case ListMetadataHead, ListMetadataNone:
+	default:
+		return fmt.Errorf("list_metadata には %q か %q を指定してください（%q が指定されました）",
+			ListMetadataHead, ListMetadataNone, c.ListMetadata)
+	}
+	return nil
+}
+
+// webClient は Web サーバーとのやりとりです。
+//
+// 使うのは GET と HEAD だけです。ディレクトリは末尾に "/" を付けた
+// 場所、ファイルは付けない場所として問い合わせます。
+type webClient struct {
+	base     *url.URL
+	user     string
+	password string
+	http     *http.Client
+}
+
+// newWebClient はやりとりの相手を用意します。
+func newWebClient(cfg Config) (*webClient, error) {
+	base, err := url.Parse(strings.TrimSuffix(cfg.URL, "/") + "/")
+	if err != nil {
+		return nil, fmt.Errorf("url を解釈できません: %w", err)
+	}
+
+	transport := cfg.transportOverride
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return &webClient{
+		base:     base,
+		user:     cfg.User,
+		password: cfg.Password,
+		http:     &http.Client{Transport: transport},
+	}, nil
+}
+
+// urlFor はパスに対応する接続先を組み立てます。
+// dir が真なら、ディレクトリとして末尾に "/" を付けます。
+func (c *webClient) urlFor(p string, dir bool) string {
+	u := *c.base
+	u.Path = path.Join(u.Path, p)
+	if dir && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+// request は1つの要求を送り、応答の状態を確かめます。
+// 失敗なら中身を捨ててエラーを返します。成功なら応答は呼び出し側が閉じてください。
+func (c *webClient) request(ctx context.Context, method, p string, dir bool, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.urlFor(p, dir), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := statusError(method, p, res); err != nil {
+		drain(res)
+		return nil, err
+	}
+	return res, nil
+}
+
+// remoteFile は HEAD や GET の応答から分かる1件の様子です。
+type remoteFile struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
+}
+
+// describe は応答のヘッダから1件の様子を読み取ります。
+//
+// 末尾に "/" の付いた場所へ転送されていれば、ディレクトリです。
+// nginx や Apache は、"/" なしで問い合わせたディレクトリをそうして
+// 案内します。
+func describe(res *http.Response) remoteFile {
+	f := remoteFile{
+		isDir: strings.HasSuffix(res.Request.URL.Path, "/"),
+		size:  res.ContentLength,
+	}
+	if f.isDir || f.size < 0 {
+		f.size = storage.SizeUnknown
+	}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		f.modTime = t
+	}
+	return f
+}
+
+// head は1件の様子を問い合わせます。
+func (c *webClient) head(ctx context.Context, p string, dir bool) (remoteFile, error) {
+	res, err := c.request(ctx, http.MethodHead, p, dir, nil)
+	if err != nil {
+		return remoteFile{}, err
+	}
+	drain(res)
+	return describe(res), nil
+}
+
+// get はファイルの内容を取りに行きます。
+//
+// 圧縮しないよう明示します。Go の通信は既定で gzip を求めて
+// 黙って展開するので、.gz のファイルに Content-Encoding を付けて
+// 返すサーバーだと、展開された別物を写してしまいます。
+func (c *webClient) get(ctx context.Context, p string, headers map[string]string) (*http.Response, error) {
+	h := map[string]string{"Accept-Encoding": "identity"}
+	for k, v := range headers {
+		h[k] = v
+	}
+	return c.request(ctx, http.MethodGet, p, false, h)
+}
+
+// drain は応答の中身を読み捨てて閉じます。
+// 読みきっておくと、接続を次の要求に使い回せます。
+func drain(res *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	_ = res.Body.Close()
+}
@@ -0,0 +1,154 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Web サーバーの失敗は HTTP の状態コードだけで返ります。
+// 読むだけなので、見分けが要るのは次のくらいです。
+//
+//	401, 403 → 認証が通っていない、または見せてもらえない
+//	404, 410 → 存在しない
+//	429, 503 → 混んでいる（Retry-After があれば従う）
+//	5xx      → 一時的な障害
+
+// wrapErr は失敗を storage のエラーに変換します。
+func (s *Storage) wrapErr(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	v := classify(err)
+	if v.sentinel != nil && !errors.Is(err, v.sentinel) {
+		// 元のエラーも失わないよう、両方を包む。
+		err = fmt.Errorf("%w (%w)", v.sentinel, err)
+	}
+
+	return &storage.OpError{
+		Op:         op,
+		Storage:    s.name,
+		Path:       path,
+		Class:      v.class,
+		RetryAfter: v.retryAfter,
+		Err:        err,
+	}
+}
+
+// verdict は失敗の見立てです。
+type verdict struct {
+	// sentinel は対応する番兵エラーです。該当するものがなければ nil です。
+	sentinel error
+	class    storage.Class
+	// retryAfter はサーバーから指示された待ち時間です。
+	retryAfter time.Duration
+}
+
+// classify はエラーの見立てを求めます。
+func classify(err error) verdict {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return verdict{class: storage.ClassCanceled}
+	case errors.Is(err, storage.ErrNotFound):
+		return verdict{sentinel: storage.ErrNotFound, class: storage.ClassPermanent}
+	case errors.Is(err, storage.ErrIsDir), errors.Is(err, storage.ErrNotDir),
+		errors.Is(err, storage.ErrUnsupported), errors.Is(err, errBadIndex):
+		return verdict{class: storage.ClassPermanent}
+	}
+
+	var httpErr *httpError
+	if errors.As(err, &httpErr) {
+		v := classifyStatus(httpErr.Status)
+		v.retryAfter = httpErr.RetryAfter
+		return v
+	}
+
+	// 接続そのものが切れた場合。繋ぎ直せば通ることがある。
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return verdict{class: storage.ClassRetryable}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return verdict{class: storage.ClassRetryable}
+	}
+
+	return verdict{class: storage.ClassUnknown}
+}
+
+// classifyStatus は状態コードから判断します。
+func classifyStatus(status int) verdict {
+	switch status {
+	case http.StatusNotFound, http.StatusGone:
+		return verdict{sentinel: storage.ErrNotFound, class: storage.ClassPermanent}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return verdict{class: storage.ClassAuth}
+	case http.StatusTooManyRequests:
+		return verdict{class: storage.ClassRateLimit}
+	case http.StatusRequestTimeout:
+		return verdict{class: storage.ClassRetryable}
+	}
+
+	switch {
+	case status >= 500 && status <= 599:
+		return verdict{class: storage.ClassRetryable}
+	case status >= 400 && status <= 499:
+		return verdict{class: storage.ClassPermanent}
+	}
+	return verdict{class: storage.ClassUnknown}
+}
+
+// isNotFound はエラーが「存在しない」を表すかを返します。
+func isNotFound(err error) bool {
+	v := classify(err)
+	return v.sentinel != nil && errors.Is(v.sentinel, storage.ErrNotFound)
+}
+
+// statusError は成功でない応答をエラーにします。
+func statusError(method, p string, res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return nil
+	}
+	return &httpError{
+		Method:     method,
+		Path:       p,
+		Status:     res.StatusCode,
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+}
+
+// httpError は Web サーバーが返した失敗です。
+type httpError struct {
+	Method     string
+	Path       string
+	Status     int
+	RetryAfter time.Duration
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.Status, http.StatusText(e.Status))
+}
+
+// parseRetryAfter は待つよう指示された時間を読み取ります。
+func parseRetryAfter(raw string) time.Duration {
+	if raw == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(raw); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(raw); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
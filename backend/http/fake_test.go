@@ -0,0 +1,322 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 試験用の Web サーバーです。
+//
+// この計算機のディレクトリを、よく見かける一覧の形で公開します。
+// 一覧の形は実物から写したもので、ファイルの中身は標準の
+// http.ServeContent が返すので、HEAD や Range の扱いは実物と同じです。
+
+// 一覧の形。
+const (
+	styleNginx     = "nginx"
+	styleApache    = "apache"
+	styleNginxJSON = "nginx-json"
+	styleCaddy     = "caddy"
+	// styleGo は Go の http.FileServer です。日時も大きさも載りません。
+	styleGo = "go"
+)
+
+// fakeWeb は試験用のサーバーです。
+type fakeWeb struct {
+	root  string
+	style string
+
+	mu sync.Mutex
+	// calls は手続きごとの呼び出し回数です。
+	calls map[string]int
+	// failures は手続き（と場所）ごとの「あと何回失敗させるか」です。
+	failures map[string]*fakeFailure
+	// ignoreRange が真なら、Range を無視して全体を返します。
+	ignoreRange bool
+	// noRedirect が真なら、"/" なしで問い合わせたディレクトリを転送せず 404 にします。
+	noRedirect bool
+}
+
+type fakeFailure struct {
+	remaining int
+	status    int
+}
+
+func newFakeWeb(root, style string) *fakeWeb {
+	return &fakeWeb{
+		root:     root,
+		style:    style,
+		calls:    map[string]int{},
+		failures: map[string]*fakeFailure{},
+	}
+}
+
+func (f *fakeWeb) failNext(method string, n, status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[method] = &fakeFailure{remaining: n, status: status}
+}
+
+// failNextAt は、その場所への手続きだけを失敗させます。
+func (f *fakeWeb) failNextAt(method, p string, n, status int) {
+	f.failNext(method+" "+p, n, status)
+}
+
+func (f *fakeWeb) callCount(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+// write は公開するファイルを置きます。
+func (f *fakeWeb) write(t *testing.T, p, content string, modTime time.Time) {
+	t.Helper()
+	local := filepath.Join(f.root, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(local), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(local, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(local, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mkdir は公開するディレクトリを置きます。
+func (f *fakeWeb) mkdir(t *testing.T, p string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(f.root, filepath.FromSlash(p)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *fakeWeb) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.calls[r.Method]++
+	fail, ok := f.failures[r.Method+" "+r.URL.Path]
+	if !ok {
+		fail, ok = f.failures[r.Method]
+	}
+	if ok && fail.remaining > 0 {
+		fail.remaining--
+		status := fail.status
+		f.mu.Unlock()
+		if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "7")
+		}
+		w.WriteHeader(status)
+		return
+	}
+	ignoreRange, noRedirect := f.ignoreRange, f.noRedirect
+	f.mu.Unlock()
+
+	if f.style == styleGo {
+		http.FileServer(http.Dir(f.root)).ServeHTTP(w, r)
+		return
+	}
+
+	local := filepath.Join(f.root, filepath.FromSlash(path.Clean(r.URL.Path)))
+	st, err := os.Stat(local)
+	switch {
+	case err != nil:
+		http.NotFound(w, r)
+	case st.IsDir() && !strings.HasSuffix(r.URL.Path, "/"):
+		if noRedirect {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+	case st.IsDir():
+		f.serveIndex(w, r, local)
+	case strings.HasSuffix(r.URL.Path, "/"):
+		http.NotFound(w, r)
+	default:
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		if strings.HasSuffix(local, ".gz") {
+			// よくある設定の誤り。.gz をそのまま返しつつ、圧縮して送ったと名乗る。
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		content, _ := os.ReadFile(local)
+		http.ServeContent(w, r, st.Name(), st.ModTime(), bytes.NewReader(content))
+	}
+}
+
+// serveIndex はディレクトリの一覧を返します。
+func (f *fakeWeb) serveIndex(w http.ResponseWriter, r *http.Request, local string) {
+	entries, err := os.ReadDir(local)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var infos []os.FileInfo
+	for _, e := range entries {
+		if fi, err := e.Info(); err == nil {
+			infos = append(infos, fi)
+		}
+	}
+
+	var body string
+	contentType := "text/html; charset=utf-8"
+	switch f.style {
+	case styleNginx:
+		body = nginxIndex(r.URL.Path, infos)
+	case styleApache:
+		body = apacheIndex(r.URL.Path, infos)
+	case styleNginxJSON:
+		body, contentType = nginxJSONIndex(infos), "application/json"
+	case styleCaddy:
+		// JSON を求められなければ HTML で返す。試験では中身を見ないので空にしておく。
+		body = "<!DOCTYPE html><html><body></body></html>"
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			body, contentType = caddyJSONIndex(infos), "application/json; charset=utf-8"
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write([]byte(body))
+}
+
+// nginxIndex は nginx の autoindex と同じ形の一覧を作ります。
+func nginxIndex(dir string, infos []os.FileInfo) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<html>\r\n<head><title>Index of %s</title></head>\r\n<body>\r\n", html.EscapeString(dir))
+	fmt.Fprintf(&b, "<h1>Index of %s</h1><hr><pre><a href=\"../\">../</a>\r\n", html.EscapeString(dir))
+	for _, fi := range infos {
+		name, size := fi.Name(), fmt.Sprint(fi.Size())
+		if fi.IsDir() {
+			name, size = name+"/", "-"
+		}
+		fmt.Fprintf(&b, "<a href=\"%s\">%s</a>%s %s %19s\r\n",
+			(&url.URL{Path: name}).EscapedPath(), html.EscapeString(name),
+			strings.Repeat(" ", max(1, 50-len(name))),
+			fi.ModTime().UTC().Format("02-Jan-2006 15:04"), size)
+	}
+	b.WriteString("</pre><hr></body>\r\n</html>\r\n")
+	return b.String()
+}
+
+// apacheIndex は Apache の mod_autoindex（FancyIndexing, HTMLTable）と同じ形の一覧を作ります。
+func apacheIndex(dir string, infos []os.FileInfo) string {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE HTML PUBLIC \"-//W3C//DTD HTML 3.2 Final//EN\">\n<html>\n <head>\n")
+	fmt.Fprintf(&b, "  <title>Index of %s</title>\n </head>\n <body>\n<h1>Index of %s</h1>\n", dir, dir)
+	b.WriteString("  <table>\n   <tr><th valign=\"top\"><img src=\"/icons/blank.gif\" alt=\"[ICO]\"></th>" +
+		"<th><a href=\"?C=N;O=D\">Name</a></th><th><a href=\"?C=M;O=A\">Last modified</a></th>" +
+		"<th><a href=\"?C=S;O=A\">Size</a></th><th><a href=\"?C=D;O=A\">Description</a></th></tr>\n")
+	b.WriteString("   <tr><th colspan=\"5\"><hr></th></tr>\n")
+	fmt.Fprintf(&b, "<tr><td valign=\"top\"><a href=\"%s\"><img src=\"/icons/back.gif\" alt=\"[PARENTDIR]\"></a></td>"+
+		"<td><a href=\"%s\">Parent Directory</a></td><td>&nbsp;</td><td align=\"right\">  - </td><td>&nbsp;</td></tr>\n",
+		path.Dir(strings.TrimSuffix(dir, "/"))+"/", path.Dir(strings.TrimSuffix(dir, "/"))+"/")
+	for _, fi := range infos {
+		name, size, icon := fi.Name(), apacheSize(fi.Size()), "[TXT]"
+		if fi.IsDir() {
+			name, size, icon = name+"/", "-", "[DIR]"
+		}
+		href := (&url.URL{Path: name}).EscapedPath()
+		// アイコンにもリンクを付ける設定（IconsAreLinks）。
+		fmt.Fprintf(&b, "<tr><td valign=\"top\"><a href=\"%s\"><img src=\"/icons/x.gif\" alt=\"%s\"></a></td>"+
+			"<td><a href=\"%s\">%s</a></td><td align=\"right\">%s  </td><td align=\"right\">%s</td><td>&nbsp;</td></tr>\n",
+			href, icon, href, html.EscapeString(name), fi.ModTime().UTC().Format("2006-01-02 15:04"), size)
+	}
+	b.WriteString("   <tr><th colspan=\"5\"><hr></th></tr>\n</table>\n<address>Apache Server</address>\n</body></html>\n")
+	return b.String()
+}
+
+// apacheSize は Apache と同じく大きさを丸めて表します。
+func apacheSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprint(n)
+	}
+	return fmt.Sprintf("%.1fK", float64(n)/1024)
+}
+
+// nginxJSONIndex は nginx の autoindex_format json と同じ形の一覧を作ります。
+func nginxJSONIndex(infos []os.FileInfo) string {
+	out := []map[string]any{}
+	for _, fi := range infos {
+		e := map[string]any{
+			"name":  fi.Name(),
+			"type":  "file",
+			"mtime": fi.ModTime().UTC().Format(http.TimeFormat),
+		}
+		if fi.IsDir() {
+			e["type"] = "directory"
+		} else {
+			e["size"] = fi.Size()
+		}
+		out = append(out, e)
+	}
+	b, _ := json.Marshal(out)
+	return string(b)
+}
+
+// caddyJSONIndex は Caddy の file_server browse が JSON で返す一覧を作ります。
+func caddyJSONIndex(infos []os.FileInfo) string {
+	out := []map[string]any{}
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() {
+			name += "/"
+		}
+		out = append(out, map[string]any{
+			"name":       name,
+			"size":       fi.Size(),
+			"url":        "./" + (&url.URL{Path: name}).EscapedPath(),
+			"mod_time":   fi.ModTime().UTC().Format(time.RFC3339Nano),
+			"mode":       uint32(fi.Mode()),
+			"is_dir":     fi.IsDir(),
+			"is_symlink": false,
+		})
+	}
+	b, _ := json.Marshal(out)
+	return string(b)
+}
+
+// start は試験用のサーバーを立ち上げ、そこへ向いたストレージを返します。
+func (f *fakeWeb) start(t *testing.T, mutate ...func(*Config)) *Storage {
+	t.Helper()
+
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	cfg := Config{
+		Name: "偽http",
+		URL:  srv.URL,
+	}
+	for _, m := range mutate {
+		m(&cfg)
+	}
+
+	s, err := New(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("ストレージを作れません: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+// newTestStorage は試験用のストレージを作ります。
+func newTestStorage(t *testing.T, style string, mutate ...func(*Config)) (context.Context, *fakeWeb, *Storage) {
+	t.Helper()
+	f := newFakeWeb(t.TempDir(), style)
+	return context.Background(), f, f.start(t, mutate...)
+}
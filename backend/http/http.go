@@ -0,0 +1,298 @@
+// Package http は、ディレクトリの一覧を公開している Web サーバーを
+// 読み取り専用の storage.Storage として実装します。
+//
+// nginx や Apache の autoindex で公開されたデータを、ほかの
+// ストレージへ写すためのものです。一覧は索引のページから読み取り
+// （index.go）、1件の様子は HEAD で、内容は GET で取りに行きます。
+// 書き込みにはすべて ErrUnsupported を返します。
+package http
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Type はこのバックエンドの種別名です。
+const Type = "http"
+
+// headConcurrency は一覧のときに HEAD で問い合わせる同時数です。
+const headConcurrency = 8
+
+// Storage は Web サーバーです。
+type Storage struct {
+	name   string
+	client *webClient
+
+	listMetadata string
+}
+
+// New は Web サーバーに接続します。
+//
+// ここでは通信しません。繋がるかどうかは最初の操作で分かります。
+func New(_ context.Context, cfg Config) (*Storage, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("http %s: %w", cfg.Name, err)
+	}
+
+	client, err := newWebClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("http %s: %w", cfg.Name, err)
+	}
+
+	return &Storage{
+		name:         cfg.Name,
+		client:       client,
+		listMetadata: cfg.listMetadata(),
+	}, nil
+}
+
+// Type はストレージの種別を返します。
+func (s *Storage) Type() string { return Type }
+
+// Name は設定ファイルで付けた名前を返します。
+func (s *Storage) Name() string { return s.name }
+
+// Features は Web サーバーにできることを返します。
+func (s *Storage) Features() *storage.Features {
+	// Last-Modified は RFC 1123 なので秒までです。
+	// 一覧の値だけを使うときは、HTML の一覧が分単位なのでそれに合わせます。
+	precision := time.Second
+	if s.listMetadata == ListMetadataNone {
+		precision = time.Minute
+	}
+	return &storage.Features{
+		ModTimePrecision: precision,
+		// 読むだけなので、書き込みにかかわる能力はすべて持ちません。
+		CanSetModTime:   false,
+		CaseInsensitive: false,
+		Hashes:          nil,
+		EmptyDirs:       true,
+	}
+}
+
+// Close はストレージを閉じます。
+func (s *Storage) Close() error {
+	s.client = nil
+	return nil
+}
+
+// cleanPath はパスを正規化します。
+//
+// "\" は区切りとして扱いません。URL の中ではふつうの文字です。
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return path.Clean(p)
+}
+
+// readOnly は書き込みを断ります。
+func (s *Storage) readOnly(op, p string) error {
+	return s.wrapErr(op, p, fmt.Errorf("%w: http は読むだけです", storage.ErrUnsupported))
+}
+
+// List はディレクトリの直下を1件ずつ fn に渡します。
+//
+// 一覧のページは1枚で全件が返るので、いったんすべて読み取ります。
+func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	entries, err := s.index(ctx, dir)
+	if err != nil {
+		return s.wrapErr("list", dir, err)
+	}
+	if err := s.fillMetadata(ctx, dir, entries); err != nil {
+		return s.wrapErr("list", dir, err)
+	}
+
+	base := cleanPath(dir)
+	for _, e := range entries {
+		if e.gone {
+			continue
+		}
+		if err := fn(e.info(base)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// index は一覧のページを取りに行き、読み取ります。
+func (s *Storage) index(ctx context.Context, dir string) ([]indexEntry, error) {
+	res, err := s.client.request(ctx, http.MethodGet, dir, true, map[string]string{
+		"Accept": indexAccept,
+	})
+	if err != nil {
+		if isNotFound(err) && cleanPath(dir) != "/" {
+			// 同じ名前のファイルがあるなら、そう伝える。
+			if f, headErr := s.client.head(ctx, dir, false); headErr == nil && !f.isDir {
+				return nil, storage.ErrNotDir
+			}
+		}
+		return nil, err
+	}
+	defer drain(res)
+
+	// 転送されていれば、リンクは転送先から解決する。
+	return parseIndex(res.Body, res.Header.Get("Content-Type"), res.Request.URL)
+}
+
+// fillMetadata は、一覧だけでは確かでない大きさと更新時刻を問い合わせます。
+//
+// 件数ぶんの往復が増えるので、まとめて並行に行います。
+func (s *Storage) fillMetadata(ctx context.Context, dir string, entries []indexEntry) error {
+	if s.listMetadata != ListMetadataHead {
+		return nil
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(headConcurrency)
+
+	for i := range entries {
+		if entries[i].isDir || entries[i].exact {
+			continue
+		}
+		g.Go(func() error {
+			f, err := s.client.head(gctx, path.Join(cleanPath(dir), entries[i].name), false)
+			switch {
+			case isNotFound(err):
+				// 一覧を取ったあとで消えた。
+				entries[i].gone = true
+				return nil
+			case err != nil:
+				return err
+			}
+			// 末尾の "/" を付けずにディレクトリを載せる一覧もある。
+			entries[i].isDir = f.isDir
+			entries[i].size = f.size
+			if !f.modTime.IsZero() {
+				entries[i].modTime = f.modTime
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+// Stat は1件のメタデータを返します。
+func (s *Storage) Stat(ctx context.Context, p string) (*storage.FileInfo, error) {
+	cp := cleanPath(p)
+	if cp == "/" {
+		return &storage.FileInfo{Path: "/", Name: "/", IsDir: true, Size: storage.SizeUnknown}, nil
+	}
+
+	f, err := s.client.head(ctx, cp, false)
+	if isNotFound(err) {
+		// ディレクトリを "/" なしで問い合わせても転送しないサーバーもある。
+		if dirInfo, dirErr := s.client.head(ctx, cp, true); dirErr == nil {
+			f, err = dirInfo, nil
+			f.isDir = true
+		}
+	}
+	if err != nil {
+		return nil, s.wrapErr("stat", p, err)
+	}
+
+	return &storage.FileInfo{
+		Path:    cp,
+		Name:    path.Base(cp),
+		IsDir:   f.isDir,
+		Size:    f.size,
+		ModTime: f.modTime,
+	}, nil
+}
+
+// Open はファイルの内容を読む ReadCloser を返します。
+func (s *Storage) Open(ctx context.Context, p string) (io.ReadCloser, *storage.FileInfo, error) {
+	cp := cleanPath(p)
+	if cp == "/" {
+		return nil, nil, s.wrapErr("open", p, storage.ErrIsDir)
+	}
+
+	res, err := s.client.get(ctx, cp, nil)
+	if err != nil {
+		return nil, nil, s.wrapErr("open", p, err)
+	}
+
+	f := describe(res)
+	if f.isDir {
+		drain(res)
+		return nil, nil, s.wrapErr("open", p, storage.ErrIsDir)
+	}
+
+	return res.Body, &storage.FileInfo{
+		Path:    cp,
+		Name:    path.Base(cp),
+		Size:    f.size,
+		ModTime: f.modTime,
+	}, nil
+}
+
+// OpenRange は offset から length バイトを読む ReadCloser を返します。
+//
+// Range を無視して全体を返すサーバーもあるので、そのときは
+// 手前を読み捨てて、求められたぶんだけを返します。
+func (s *Storage) OpenRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	res, err := s.client.get(ctx, cleanPath(p), map[string]string{
+		"Range": rangeHeader(offset, length),
+	})
+	if err != nil {
+		return nil, s.wrapErr("open", p, err)
+	}
+	if describe(res).isDir {
+		drain(res)
+		return nil, s.wrapErr("open", p, storage.ErrIsDir)
+	}
+	if res.StatusCode == http.StatusPartialContent {
+		return res.Body, nil
+	}
+
+	if _, err := io.CopyN(io.Discard, res.Body, offset); err != nil {
+		_ = res.Body.Close()
+		return nil, s.wrapErr("open", p, err)
+	}
+	if length < 0 {
+		return res.Body, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(res.Body, length), res.Body}, nil
+}
+
+func rangeHeader(offset, length int64) string {
+	if length < 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// Put は書き込めないので、常に ErrUnsupported を返します。
+func (s *Storage) Put(_ context.Context, p string, _ io.Reader, _ storage.ObjectMeta) (*storage.FileInfo, error) {
+	return nil, s.readOnly("put", p)
+}
+
+// Mkdir は作れないので、常に ErrUnsupported を返します。
+func (s *Storage) Mkdir(_ context.Context, dir string) error {
+	return s.readOnly("mkdir", dir)
+}
+
+// Remove は消せないので、常に ErrUnsupported を返します。
+func (s *Storage) Remove(_ context.Context, p string) error {
+	return s.readOnly("remove", p)
+}
+
+var (
+	_ storage.Storage     = (*Storage)(nil)
+	_ storage.RangeOpener = (*Storage)(nil)
+)
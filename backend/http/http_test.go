@@ -0,0 +1,497 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/storage"
+	"github.com/mt3hr/hbg/transfer"
+)
+
+// 書き込めないので、storagetest の適合性テストは通せません。
+// 読み出しにかかわる振る舞いを、一覧の形ごとにここで確かめます。
+
+var allStyles = []string{styleNginx, styleApache, styleNginxJSON, styleCaddy, styleGo}
+
+// when は試験で使う更新時刻です。HTTP の時刻は秒までなので、端数を持たせません。
+var when = time.Date(2025, 1, 15, 10, 20, 30, 0, time.UTC)
+
+// populate は試験用のファイルを並べます。
+func populate(t *testing.T, f *fakeWeb) {
+	t.Helper()
+	f.write(t, "/データ/こんにちは.txt", "こんにちは", when)
+	f.write(t, "/データ/大きい.bin", strings.Repeat("x", 3000), when.Add(time.Hour))
+	f.write(t, "/データ/名前 #1?.txt", "記号", when)
+	f.write(t, "/データ/下/奥.txt", "奥", when)
+	f.mkdir(t, "/データ/空")
+}
+
+func listAll(t *testing.T, ctx context.Context, s *Storage, dir string) map[string]storage.FileInfo {
+	t.Helper()
+	out := map[string]storage.FileInfo{}
+	if err := s.List(ctx, dir, func(fi storage.FileInfo) error {
+		out[fi.Name] = fi
+		return nil
+	}); err != nil {
+		t.Fatalf("List(%s): %v", dir, err)
+	}
+	return out
+}
+
+func readAll(t *testing.T, rc io.ReadCloser) string {
+	t.Helper()
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	return string(b)
+}
+
+// どの形の一覧からも、同じ中身が読み取れることを確かめます。
+func TestListStyles(t *testing.T) {
+	for _, style := range allStyles {
+		t.Run(style, func(t *testing.T) {
+			ctx, f, s := newTestStorage(t, style)
+			populate(t, f)
+
+			got := listAll(t, ctx, s, "/データ")
+			if len(got) != 5 {
+				t.Fatalf("件数 = %d, want 5: %v", len(got), got)
+			}
+
+			for name, size := range map[string]int64{
+				"こんにちは.txt":  int64(len("こんにちは")),
+				"大きい.bin":    3000,
+				"名前 #1?.txt": int64(len("記号")),
+			} {
+				fi, ok := got[name]
+				switch {
+				case !ok:
+					t.Errorf("%s が一覧にない", name)
+				case fi.IsDir:
+					t.Errorf("%s がディレクトリになっている", name)
+				case fi.Size != size:
+					t.Errorf("%s の大きさ = %d, want %d", name, fi.Size, size)
+				case fi.Path != "/データ/"+name:
+					t.Errorf("%s のパス = %q", name, fi.Path)
+				}
+			}
+			if fi := got["大きい.bin"]; !fi.ModTime.Equal(when.Add(time.Hour)) {
+				t.Errorf("更新時刻 = %v, want %v", fi.ModTime, when.Add(time.Hour))
+			}
+			for _, name := range []string{"下", "空"} {
+				if fi := got[name]; !fi.IsDir || fi.Size != storage.SizeUnknown {
+					t.Errorf("%s = %+v, want 大きさ不明のディレクトリ", name, fi)
+				}
+			}
+
+			if sub := listAll(t, ctx, s, "/データ/下"); len(sub) != 1 || sub["奥.txt"].Path != "/データ/下/奥.txt" {
+				t.Errorf("下の一覧 = %v", sub)
+			}
+		})
+	}
+}
+
+// 一覧で値が確かな形（JSON）では、1件ずつの問い合わせをしないことを確かめます。
+func TestListHeadsOnlyWhenNeeded(t *testing.T) {
+	tests := []struct {
+		style string
+		heads int
+	}{
+		{styleNginx, 3},
+		{styleApache, 3},
+		{styleNginxJSON, 0},
+		{styleCaddy, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.style, func(t *testing.T) {
+			ctx, f, s := newTestStorage(t, tt.style)
+			populate(t, f)
+
+			listAll(t, ctx, s, "/データ")
+			if got := f.callCount(http.MethodHead); got != tt.heads {
+				t.Errorf("HEAD = %d回, want %d", got, tt.heads)
+			}
+		})
+	}
+}
+
+// list_metadata: none では、一覧に書かれた値だけを使うことを確かめます。
+func TestListMetadataNone(t *testing.T) {
+	none := func(c *Config) { c.ListMetadata = ListMetadataNone }
+
+	t.Run("nginx は大きさを丸めない", func(t *testing.T) {
+		ctx, f, s := newTestStorage(t, styleNginx, none)
+		populate(t, f)
+
+		got := listAll(t, ctx, s, "/データ")
+		if f.callCount(http.MethodHead) != 0 {
+			t.Error("問い合わせている")
+		}
+		if fi := got["大きい.bin"]; fi.Size != 3000 {
+			t.Errorf("大きさ = %d, want 3000", fi.Size)
+		}
+		// 一覧は分単位なので、秒は落ちる。
+		if fi := got["こんにちは.txt"]; !fi.ModTime.Equal(when.Truncate(time.Minute)) {
+			t.Errorf("更新時刻 = %v, want %v", fi.ModTime, when.Truncate(time.Minute))
+		}
+		if s.Features().ModTimePrecision != time.Minute {
+			t.Errorf("時刻の精度 = %v, want 1分", s.Features().ModTimePrecision)
+		}
+	})
+
+	t.Run("Apache の丸めた大きさは不明として扱う", func(t *testing.T) {
+		ctx, f, s := newTestStorage(t, styleApache, none)
+		populate(t, f)
+
+		got := listAll(t, ctx, s, "/データ")
+		if fi := got["大きい.bin"]; fi.Size != storage.SizeUnknown {
+			t.Errorf("大きさ = %d, want 不明（一覧には 2.9K とある）", fi.Size)
+		}
+		if fi := got["こんにちは.txt"]; fi.Size != int64(len("こんにちは")) {
+			t.Errorf("1K 未満の大きさ = %d, want %d", fi.Size, len("こんにちは"))
+		}
+	})
+}
+
+// 直下を指さないリンクを拾わないことを確かめます。
+func TestParseHTMLIndexSkipsOtherLinks(t *testing.T) {
+	base, _ := url.Parse("https://例.invalid/公開/データ/")
+	page := `<html><body>
+<a href="../">../</a>
+<a href="/公開/">上へ</a>
+<a href="?C=M;O=A">並べ替え</a>
+<a href="#top">先頭</a>
+<a href="https://よそ.invalid/公開/データ/a.txt">よそ</a>
+<a href="mailto:admin@例.invalid">連絡先</a>
+<a href="./">ここ</a>
+<a href="下/奥.txt">奥</a>
+<a href="a.txt?download=1">付き</a>
+<a href="a.txt"><img src="/icons/text.gif"></a> <a href="a.txt">a.txt</a> 2025-01-15 10:20 12
+<a href="%E4%B8%8B/">下/</a> 15-Jan-2025 10:20 -
+<a href="https://例.invalid/公開/データ/b.txt">b.txt</a> 2025-Jan-15 10:20:30 34
+</body></html>`
+
+	entries, err := parseHTMLIndex(strings.NewReader(page), base)
+	if err != nil {
+		t.Fatalf("parseHTMLIndex: %v", err)
+	}
+
+	want := []indexEntry{
+		{name: "a.txt", size: 12, modTime: time.Date(2025, 1, 15, 10, 20, 0, 0, time.UTC)},
+		{name: "下", isDir: true, size: storage.SizeUnknown, modTime: time.Date(2025, 1, 15, 10, 20, 0, 0, time.UTC)},
+		{name: "b.txt", size: 34, modTime: when},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("拾ったもの = %+v, want %+v", entries, want)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("%d件目 = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestParseIndexRejectsOtherTypes(t *testing.T) {
+	base, _ := url.Parse("https://例.invalid/")
+	if _, err := parseIndex(strings.NewReader("%PDF"), "application/pdf", base); !errors.Is(err, errBadIndex) {
+		t.Errorf("PDF を一覧として読んだ: %v", err)
+	}
+	if _, err := parseIndex(strings.NewReader("{壊れた"), "application/json", base); !errors.Is(err, errBadIndex) {
+		t.Errorf("壊れた JSON を一覧として読んだ: %v", err)
+	}
+}
+
+func TestStat(t *testing.T) {
+	ctx, f, s := newTestStorage(t, styleNginx)
+	populate(t, f)
+
+	fi, err := s.Stat(ctx, "/データ/こんにちは.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.IsDir || fi.Size != int64(len("こんにちは")) || !fi.ModTime.Equal(when) || fi.Name != "こんにちは.txt" {
+		t.Errorf("Stat = %+v", fi)
+	}
+
+	for _, p := range []string{"/", "/データ", "/データ/下"} {
+		fi, err := s.Stat(ctx, p)
+		if err != nil {
+			t.Fatalf("Stat(%s): %v", p, err)
+		}
+		if !fi.IsDir {
+			t.Errorf("Stat(%s) がディレクトリになっていない", p)
+		}
+	}
+
+	if _, err := s.Stat(ctx, "/データ/無い.txt"); !storage.IsNotFound(err) {
+		t.Errorf("無いものの Stat = %v, want ErrNotFound", err)
+	}
+}
+
+// ディレクトリを "/" なしで問い合わせても転送しないサーバーでも、
+// ディレクトリだと分かることを確かめます。
+func TestStatDirectoryWithoutRedirect(t *testing.T) {
+	ctx, f, s := newTestStorage(t, styleNginx)
+	populate(t, f)
+	f.noRedirect = true
+
+	fi, err := s.Stat(ctx, "/データ/下")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if !fi.IsDir {
+		t.Error("ディレクトリになっていない")
+	}
+}
+
+func TestListErrors(t *testing.T) {
+	ctx, f, s := newTestStorage(t, styleNginx)
+	populate(t, f)
+
+	if err := s.List(ctx, "/無い", func(storage.FileInfo) error { return nil }); !storage.IsNotFound(err) {
+		t.Errorf("無いディレクトリの List = %v, want ErrNotFound", err)
+	}
+	if err := s.List(ctx, "/データ/こんにちは.txt", func(storage.FileInfo) error { return nil }); !errors.Is(err, storage.ErrNotDir) {
+		t.Errorf("ファイルの List = %v, want ErrNotDir", err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	ctx, f, s := newTestStorage(t, styleApache)
+	populate(t, f)
+
+	rc, fi, err := s.Open(ctx, "/データ/名前 #1?.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got := readAll(t, rc); got != "記号" {
+		t.Errorf("内容 = %q", got)
+	}
+	if fi.Size != int64(len("記号")) || !fi.ModTime.Equal(when) {
+		t.Errorf("Open の FileInfo = %+v", fi)
+	}
+
+	if _, _, err := s.Open(ctx, "/データ/下"); !errors.Is(err, storage.ErrIsDir) {
+		t.Errorf("ディレクトリの Open = %v, want ErrIsDir", err)
+	}
+}
+
+// 圧縮して送ったと名乗るサーバーでも、.gz の中身をそのまま写すことを確かめます。
+func TestOpenDoesNotDecompress(t *testing.T) {
+	ctx, f, s := newTestStorage(t, styleNginx)
+	raw := "\x1f\x8b\x08\x00圧縮されたつもりの中身"
+	f.write(t, "/a.gz", raw, when)
+
+	rc, _, err := s.Open(ctx, "/a.gz")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if got := readAll(t, rc); got != raw {
+		t.Errorf("内容 = %q, want %q", got, raw)
+	}
+}
+
+func TestOpenRange(t *testing.T) {
+	for _, ignoreRange := range []bool{false, true} {
+		name := "Range に応じる"
+		if ignoreRange {
+			name = "Range を無視する"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx, f, s := newTestStorage(t, styleNginx)
+			f.write(t, "/数字.txt", "0123456789", when)
+			f.ignoreRange = ignoreRange
+
+			rc, err := s.OpenRange(ctx, "/数字.txt", 3, 4)
+			if err != nil {
+				t.Fatalf("OpenRange: %v", err)
+			}
+			if got := readAll(t, rc); got != "3456" {
+				t.Errorf("内容 = %q, want 3456", got)
+			}
+
+			rc, err = s.OpenRange(ctx, "/数字.txt", 7, -1)
+			if err != nil {
+				t.Fatalf("OpenRange: %v", err)
+			}
+			if got := readAll(t, rc); got != "789" {
+				t.Errorf("末尾まで = %q, want 789", got)
+			}
+		})
+	}
+}
+
+// 書き込みはすべて、対応していない操作として断ることを確かめます。
+func TestWritesAreUnsupported(t *testing.T) {
+	ctx, f, s := newTestStorage(t, styleNginx)
+	populate(t, f)
+
+	_, putErr := s.Put(ctx, "/新しい.txt", strings.NewReader("x"), storage.ObjectMeta{Size: 1})
+	for op, err := range map[string]error{
+		"put":    putErr,
+		"mkdir":  s.Mkdir(ctx, "/新しい"),
+		"remove": s.Remove(ctx, "/データ/こんにちは.txt"),
+	} {
+		if !errors.Is(err, storage.ErrUnsupported) {
+			t.Errorf("%s = %v, want ErrUnsupported", op, err)
+		}
+		if storage.ClassOf(err).Retryable() {
+			t.Errorf("%s の失敗が再試行の対象になっている", op)
+		}
+	}
+	if storage.CanMove(s) {
+		t.Error("移動できると申告している")
+	}
+	if f.callCount(http.MethodPut)+f.callCount(http.MethodDelete) != 0 {
+		t.Error("書き込みの要求を送っている")
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	tests := []struct {
+		status int
+		class  storage.Class
+		// wait は Retry-After で指示される待ち時間です。
+		wait time.Duration
+	}{
+		{http.StatusServiceUnavailable, storage.ClassRetryable, 7 * time.Second},
+		{http.StatusTooManyRequests, storage.ClassRateLimit, 7 * time.Second},
+		{http.StatusUnauthorized, storage.ClassAuth, 0},
+		{http.StatusForbidden, storage.ClassAuth, 0},
+		{http.StatusGone, storage.ClassPermanent, 0},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			ctx, f, s := newTestStorage(t, styleNginx)
+			populate(t, f)
+			f.failNext(http.MethodGet, 1, tt.status)
+
+			_, _, err := s.Open(ctx, "/データ/こんにちは.txt")
+			if class := storage.ClassOf(err); class != tt.class {
+				t.Errorf("失敗の種類 = %v, want %v (%v)", class, tt.class, err)
+			}
+			var opErr *storage.OpError
+			if !errors.As(err, &opErr) {
+				t.Fatalf("OpError で包まれていない: %v", err)
+			}
+			if opErr.RetryAfter != tt.wait {
+				t.Errorf("待ち時間 = %v, want %v", opErr.RetryAfter, tt.wait)
+			}
+		})
+	}
+}
+
+// Basic 認証の合言葉を送ることを確かめます。
+func TestBasicAuth(t *testing.T) {
+	f := newFakeWeb(t.TempDir(), styleNginx)
+	f.write(t, "/秘密.txt", "中身", when)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "利用者" || pass != "ひみつ" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	open := func(password string) error {
+		s, err := New(context.Background(), Config{Name: "認証", URL: srv.URL, User: "利用者", Password: password})
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		rc, _, err := s.Open(context.Background(), "/秘密.txt")
+		if err == nil {
+			_ = rc.Close()
+		}
+		return err
+	}
+
+	if err := open("ひみつ"); err != nil {
+		t.Errorf("正しい合言葉で読めない: %v", err)
+	}
+	if err := open("ちがう"); storage.ClassOf(err) != storage.ClassAuth {
+		t.Errorf("違う合言葉 = %v, want auth", err)
+	}
+}
+
+// ほかのストレージへ写せること、写したあとは比べて飛ばせること、
+// 一時的な失敗を再試行で乗り越えられることを確かめます。
+func TestCopyToOtherStorage(t *testing.T) {
+	for _, style := range []string{styleNginx, styleApache, styleCaddy} {
+		t.Run(style, func(t *testing.T) {
+			_, f, src := newTestStorage(t, style)
+			populate(t, f)
+			dst := memory.New("写し")
+
+			opts := transfer.Options{
+				Src:     src,
+				Dst:     dst,
+				SrcPath: "/データ",
+				DstDir:  "/写し",
+				Workers: 2,
+				Compare: transfer.DefaultComparePolicy(),
+				Retry:   transfer.RetryPolicy{MaxAttempts: 3, Wait: time.Millisecond},
+			}
+
+			f.failNextAt(http.MethodGet, "/データ/大きい.bin", 1, http.StatusBadGateway)
+			result, err := transfer.Run(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if result.Transferred != 4 || result.Failed != 0 {
+				t.Errorf("Transferred=%d Failed=%d, want 4 と 0 (%v)", result.Transferred, result.Failed, result.Errors)
+			}
+
+			rc, _, err := dst.Open(context.Background(), "/写し/データ/下/奥.txt")
+			if err != nil {
+				t.Fatalf("写したものを開けません: %v", err)
+			}
+			if got := readAll(t, rc); got != "奥" {
+				t.Errorf("写した内容 = %q", got)
+			}
+
+			again, err := transfer.Run(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("2回目の Run: %v", err)
+			}
+			if again.Transferred != 0 || again.Skipped != 4 {
+				t.Errorf("2回目 Transferred=%d Skipped=%d, want 0 と 4", again.Transferred, again.Skipped)
+			}
+		})
+	}
+}
+
+// 設定の誤りは接続を試みる前に知らせることを確かめます。
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"入口がない", Config{}, "url"},
+		{"入口の書き方が違う", Config{URL: "ftp://例.invalid/公開"}, "http://"},
+		{"知らない一覧の指定", Config{URL: "https://例.invalid", ListMetadata: "ときどき"}, "list_metadata"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if err == nil {
+				t.Fatal("誤りなのに通ってしまった")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("どこが悪いのか分からない: %v", err)
+			}
+		})
+	}
+}
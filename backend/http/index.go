@@ -0,0 +1,292 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// ディレクトリの一覧は、サーバーが作る索引のページから読み取ります。
+//
+// 決まった形式はないので、次の2通りを受け付けます。
+//
+//   - HTML。nginx や Apache の autoindex、lighttpd の dirlisting、
+//     Go の http.FileServer など。直下を指すリンクを拾い、リンクの
+//     あとに続く文字から日時と大きさを読み取ります。
+//
+//   - JSON。nginx の autoindex_format json と、Caddy の file_server browse
+//     （Accept: application/json を付けたとき）。どちらも1件ずつの
+//     配列で、大きさと更新時刻がそのまま入っています。
+
+// indexAccept は一覧を求めるときの Accept です。
+// JSON を返せるサーバーには JSON で返してもらいます。
+const indexAccept = "application/json, text/html;q=0.9, */*;q=0.5"
+
+// errBadIndex は一覧として読めない応答だったことを表します。
+var errBadIndex = errors.New("ディレクトリの一覧として読めません")
+
+// indexEntry は一覧の1件です。
+type indexEntry struct {
+	name    string
+	isDir   bool
+	size    int64
+	modTime time.Time
+	// exact は、一覧の値がそのまま比べるのに使えるかです。
+	// HTML の一覧は分単位で大きさも丸められているので、偽です。
+	exact bool
+	// gone は、一覧に載っていたのに問い合わせると無かったことを表します。
+	gone bool
+}
+
+// info は一覧の1件を storage.FileInfo にします。
+func (e indexEntry) info(dir string) storage.FileInfo {
+	fi := storage.FileInfo{
+		Path:    path.Join(dir, e.name),
+		Name:    e.name,
+		IsDir:   e.isDir,
+		Size:    e.size,
+		ModTime: e.modTime,
+	}
+	if fi.IsDir || fi.Size < 0 {
+		fi.Size = storage.SizeUnknown
+	}
+	return fi
+}
+
+// parseIndex は一覧のページを読み取ります。
+// base は一覧を取得した場所で、リンクの解決に使います。
+func parseIndex(body io.Reader, contentType string, base *url.URL) ([]indexEntry, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json":
+		return parseJSONIndex(body)
+	case "text/html", "application/xhtml+xml", "":
+		return parseHTMLIndex(body, base)
+	}
+	return nil, fmt.Errorf("%w: 種類が %s です", errBadIndex, mediaType)
+}
+
+// validName は、直下の1件の名前として受け付けられるかを返します。
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// --- JSON ---
+
+// jsonEntry は JSON の一覧の1件です。nginx と Caddy の両方を受けます。
+type jsonEntry struct {
+	Name string `json:"name"`
+	// nginx は "directory"、"file"、"other" のいずれかを入れます。
+	Type string `json:"type"`
+	// Caddy はディレクトリかどうかをこちらで表します。
+	IsDir bool   `json:"is_dir"`
+	Size  *int64 `json:"size"`
+	// nginx は RFC 1123 の形で入れます。
+	MTime string `json:"mtime"`
+	// Caddy は RFC 3339 の形で入れます。
+	ModTime string `json:"mod_time"`
+}
+
+func parseJSONIndex(body io.Reader) ([]indexEntry, error) {
+	var raw []jsonEntry
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadIndex, err)
+	}
+
+	out := make([]indexEntry, 0, len(raw))
+	for _, r := range raw {
+		if r.Type == "other" {
+			// 特殊なファイル。読めるとは限らない。
+			continue
+		}
+		// Caddy はディレクトリの名前の末尾に "/" を付ける。
+		name := strings.TrimSuffix(r.Name, "/")
+		if !validName(name) {
+			continue
+		}
+
+		e := indexEntry{
+			name:  name,
+			isDir: r.IsDir || r.Type == "directory" || strings.HasSuffix(r.Name, "/"),
+			size:  storage.SizeUnknown,
+		}
+		if r.Size != nil {
+			e.size = *r.Size
+		}
+		var timeErr error
+		switch {
+		case r.MTime != "":
+			e.modTime, timeErr = http.ParseTime(r.MTime)
+		case r.ModTime != "":
+			e.modTime, timeErr = time.Parse(time.RFC3339Nano, r.ModTime)
+		default:
+			timeErr = errors.New("更新時刻がありません")
+		}
+		e.exact = r.Size != nil && timeErr == nil
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// --- HTML ---
+
+// listedTime は HTML の一覧に書かれる日時です。
+//
+//	nginx    15-Jan-2025 10:00
+//	Apache   2025-01-15 10:00
+//	lighttpd 2025-Jan-15 10:00:00
+var listedTime = regexp.MustCompile(
+	`\d{4}-\d{2}-\d{2} \d{2}:\d{2}(?::\d{2})?` +
+		`|\d{2}-[A-Za-z]{3}-\d{4} \d{2}:\d{2}(?::\d{2})?` +
+		`|\d{4}-[A-Za-z]{3}-\d{2} \d{2}:\d{2}(?::\d{2})?`)
+
+var listedTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"02-Jan-2006 15:04:05",
+	"02-Jan-2006 15:04",
+	"2006-Jan-02 15:04:05",
+	"2006-Jan-02 15:04",
+}
+
+// parseHTMLIndex は HTML の一覧から直下を指すリンクを拾います。
+//
+// 親へのリンク、並べ替えのリンク（?C=N;O=D など）、よそへのリンクは
+// 直下を指さないので拾いません。同じ場所へのリンクが2つある場合
+// （アイコンと名前のそれぞれにリンクがあるなど）は1件にまとめます。
+func parseHTMLIndex(body io.Reader, base *url.URL) ([]indexEntry, error) {
+	var (
+		out  []indexEntry
+		seen = map[string]int{}
+		// cur は、あとに続く文字を集めている最中の1件です。
+		cur  *indexEntry
+		tail strings.Builder
+		// inLink はリンクの中にいるかです。リンクの文字は名前なので、
+		// 日時や大きさとしては読まない。
+		inLink bool
+	)
+
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		cur.modTime, cur.size = listedDetails(tail.String())
+		if cur.isDir {
+			cur.size = storage.SizeUnknown
+		}
+		if i, ok := seen[cur.name]; ok {
+			if out[i].modTime.IsZero() {
+				out[i].modTime, out[i].size = cur.modTime, cur.size
+			}
+		} else {
+			seen[cur.name] = len(out)
+			out = append(out, *cur)
+		}
+		cur = nil
+		tail.Reset()
+	}
+
+	z := html.NewTokenizer(body)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if errors.Is(z.Err(), io.EOF) {
+				flush()
+				return out, nil
+			}
+			return nil, z.Err()
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "a":
+				flush()
+				inLink = true
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					if string(key) == "href" {
+						cur = childLink(base, string(val))
+					}
+				}
+			case "tr", "li":
+				// 表や箇条書きの1行ぶんで区切る。
+				flush()
+			}
+
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "a" {
+				inLink = false
+			}
+
+		case html.TextToken:
+			if cur != nil && !inLink {
+				tail.Write(z.Text())
+			}
+		}
+	}
+}
+
+// childLink は、リンクが base の直下を指していればその1件を返します。
+func childLink(base *url.URL, href string) *indexEntry {
+	if href == "" || strings.HasPrefix(href, "?") || strings.HasPrefix(href, "#") {
+		return nil
+	}
+	ref, err := base.Parse(href)
+	if err != nil || ref.Scheme != base.Scheme || ref.Host != base.Host || ref.RawQuery != "" {
+		return nil
+	}
+
+	dir := strings.TrimSuffix(base.Path, "/") + "/"
+	rest, ok := strings.CutPrefix(ref.Path, dir)
+	if !ok {
+		return nil
+	}
+	isDir := strings.HasSuffix(rest, "/")
+	name := strings.TrimSuffix(rest, "/")
+	if !validName(name) {
+		return nil
+	}
+	return &indexEntry{name: name, isDir: isDir, size: storage.SizeUnknown}
+}
+
+// listedDetails は、リンクのあとに続く文字から日時と大きさを読み取ります。
+//
+// 大きさは日時のすぐあとにあるものを使います。"1.2K" のように
+// 丸められたものや、ディレクトリの "-" は不明として扱います。
+// 日時はタイムゾーンが書かれていないので UTC として読みます。
+func listedDetails(text string) (time.Time, int64) {
+	loc := listedTime.FindStringIndex(text)
+	if loc == nil {
+		return time.Time{}, storage.SizeUnknown
+	}
+
+	var modTime time.Time
+	for _, layout := range listedTimeLayouts {
+		if t, err := time.Parse(layout, text[loc[0]:loc[1]]); err == nil {
+			modTime = t
+			break
+		}
+	}
+
+	size := storage.SizeUnknown
+	if fields := strings.Fields(text[loc[1]:]); len(fields) > 0 {
+		if n, err := strconv.ParseInt(fields[0], 10, 64); err == nil && n >= 0 {
+			size = n
+		}
+	}
+	return modTime, size
+}
@@ -0,0 +1,31 @@
+package http
+
+import (
+	"context"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/storage"
+)
+
+func init() {
+	backend.Register(backend.Descriptor{
+		Type:    Type,
+		Summary: "HTTP（nginx / Apache などのディレクトリ一覧。読み取り専用）",
+		ConfigDoc: `  # - name: http
+  #   type: http
+  #   url: https://例.invalid/datasets/
+  #   user: ログイン名（Basic 認証が要る場合）
+  #   password: ${HTTP_PASSWORD}
+  #   list_metadata: head  # head なら一覧のたびに大きさと更新時刻を問い合わせる
+`,
+		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
+			return New(ctx, Config{
+				Name:         name,
+				URL:          params.Get("url"),
+				User:         params.Get("user"),
+				Password:     params.Get("password"),
+				ListMetadata: params.Get("list_metadata"),
+			})
+		},
+	})
+}
@@ -49,11 +49,13 @@ func (s *Storage) Features() *storage.Features {
 		ModTimePrecision: 100 * time.Nanosecond,
 		CanSetModTime:    true,
 		CaseInsensitive:  os.PathSeparator == '\\',
-		Hashes:           storage.HashSet{storage.SHA256, storage.MD5, storage.SHA1, storage.DropboxContent},
+		Hashes:           storage.HashSet{storage.SHA256, storage.MD5, storage.SHA1, storage.DropboxContent, storage.QuickXor},
 		ImplicitDirs:     true,
 		EmptyDirs:        true,
 		AtomicPut:        true,
 		OSPath:           true,
+		// NTFS・ext4・APFS のどれも、名前は 255 まで。
+		MaxNameLength: 255,
 	}
 }
 
@@ -301,6 +303,199 @@ func (s *Storage) Put(ctx context.Context, path string, r io.Reader, meta storag
 	}, nil
 }
 
+// partPath は、続きから書くための書きかけの名前を組み立てます。
+//
+// Put の一時ファイルは並行して書いても衝突しないよう名前に乱数を
+// 含めますが、こちらは次の実行からも見つけられるよう決まった名前にします。
+func partPath(target string) string {
+	return filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+partialSuffix)
+}
+
+// Partial は書きかけのメタデータを返します。
+func (s *Storage) Partial(ctx context.Context, path string) (*storage.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, s.wrapErr("partial", path, err)
+	}
+
+	part := partPath(osPath(path))
+	info, err := os.Stat(part)
+	if err != nil {
+		return nil, s.wrapErr("partial", path, err)
+	}
+	if info.IsDir() {
+		return nil, s.wrapErr("partial", path, fmt.Errorf("%w: %s", storage.ErrIsDir, part))
+	}
+	return &storage.FileInfo{
+		Path:    slashPath(part),
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+// PutResume は書きかけの続きから書き込み、書き終えたら所定の名前へ移します。
+//
+// 失敗しても書きかけは消しません。ローカルの書き込みは先頭から順に
+// 進むので、書きかけの大きさはそのまま「確かに書けたところ」です。
+func (s *Storage) PutResume(ctx context.Context, path string, offset int64, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, s.wrapErr("put", path, err)
+	}
+
+	target := osPath(path)
+	if err := os.MkdirAll(filepath.Dir(target), 0o777); err != nil {
+		return nil, s.wrapErr("put", path, err)
+	}
+
+	part := partPath(target)
+	flag := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(part, flag, 0o666)
+	if err != nil {
+		return nil, s.wrapErr("put", path, err)
+	}
+
+	written, err := writePartFrom(ctx, f, offset, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, s.wrapErr("put", path, err)
+	}
+
+	if !meta.ModTime.IsZero() {
+		if timeErr := os.Chtimes(part, meta.ModTime, meta.ModTime); timeErr != nil {
+			return nil, s.wrapErr("put", path, timeErr)
+		}
+	}
+	if roErr := clearReadOnly(target); roErr != nil {
+		return nil, s.wrapErr("put", path, roErr)
+	}
+	if renameErr := os.Rename(part, target); renameErr != nil {
+		return nil, s.wrapErr("put", path, renameErr)
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, s.wrapErr("put", path, err)
+	}
+	return &storage.FileInfo{
+		Path:    slashPath(target),
+		Name:    info.Name(),
+		Size:    offset + written,
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+// OpenWriterAt は、好きな位置へ書き込める一時ファイルを開きます。
+//
+// Put と同じく乱数を含む名前の一時ファイルに書き、Commit で置き換えます。
+// 範囲はばらばらの順に届くので、書きかけとして続きから書くことはできません。
+func (s *Storage) OpenWriterAt(ctx context.Context, path string, size int64) (storage.PartWriter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, s.wrapErr("put", path, err)
+	}
+
+	target := osPath(path)
+	if err := os.MkdirAll(filepath.Dir(target), 0o777); err != nil {
+		return nil, s.wrapErr("put", path, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*"+partialSuffix)
+	if err != nil {
+		return nil, s.wrapErr("put", path, err)
+	}
+	// 先に大きさを決めておく。後ろの範囲から届いても穴が空かない。
+	if err := tmp.Truncate(size); err != nil {
+		tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return nil, s.wrapErr("put", path, err)
+	}
+	return &partWriter{s: s, path: path, target: target, f: tmp}, nil
+}
+
+// partWriter は OpenWriterAt が開いた一時ファイルです。
+type partWriter struct {
+	s      *Storage
+	path   string
+	target string
+
+	f    *os.File
+	done bool
+}
+
+func (w *partWriter) WriteAt(p []byte, off int64) (int, error) {
+	return w.f.WriteAt(p, off)
+}
+
+// Commit は一時ファイルを閉じて、本来の名前へ移します。
+func (w *partWriter) Commit(ctx context.Context, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, w.s.wrapErr("put", w.path, err)
+	}
+	tmpName := w.f.Name()
+	if err := w.f.Close(); err != nil {
+		return nil, w.s.wrapErr("put", w.path, err)
+	}
+	if !meta.ModTime.IsZero() {
+		if err := os.Chtimes(tmpName, meta.ModTime, meta.ModTime); err != nil {
+			return nil, w.s.wrapErr("put", w.path, err)
+		}
+	}
+	if err := clearReadOnly(w.target); err != nil {
+		return nil, w.s.wrapErr("put", w.path, err)
+	}
+	if err := os.Rename(tmpName, w.target); err != nil {
+		return nil, w.s.wrapErr("put", w.path, err)
+	}
+	w.done = true
+
+	info, err := os.Stat(w.target)
+	if err != nil {
+		return nil, w.s.wrapErr("put", w.path, err)
+	}
+	return &storage.FileInfo{
+		Path:    slashPath(w.target),
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+// Abort は一時ファイルを消します。
+func (w *partWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
+
+// partMismatch は、書きかけの大きさが続きを書く位置と食い違うことを表します。
+func partMismatch(size, offset int64) error {
+	return fmt.Errorf("%w: 書きかけの大きさ %d バイトが、続きを書く位置 %d バイトと食い違います",
+		storage.ErrNotFound, size, offset)
+}
+
+// writePartFrom は書きかけの offset バイト目から続きを書きます。
+func writePartFrom(ctx context.Context, f *os.File, offset int64, r io.Reader) (int64, error) {
+	if offset > 0 {
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if info.Size() != offset {
+			return 0, partMismatch(info.Size(), offset)
+		}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(f, &ctxLimitReader{ctx: ctx, r: r})
+}
+
 // ctxLimitReader は読み取りのたびに ctx を確認します。
 type ctxLimitReader struct {
 	ctx context.Context
@@ -403,6 +598,32 @@ func (s *Storage) Hash(ctx context.Context, path string, ht storage.HashType) (s
 	return hexString(h.Sum(nil)), nil
 }
 
+// About は path を含むボリュームの使用量を返します。
+//
+// まだ無いディレクトリを聞かれることもある（これから書く先など）ので、
+// 在る親までさかのぼって調べます。
+func (s *Storage) About(ctx context.Context, path string) (*storage.Usage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, s.wrapErr("about", path, err)
+	}
+	p := osPath(path)
+	for {
+		if _, err := os.Stat(p); err == nil {
+			break
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			break
+		}
+		p = parent
+	}
+	u, err := diskUsage(p)
+	if err != nil {
+		return nil, s.wrapErr("about", path, err)
+	}
+	return u, nil
+}
+
 func hexString(b []byte) string {
 	const digits = "0123456789abcdef"
 	var sb strings.Builder
@@ -416,10 +637,13 @@ func hexString(b []byte) string {
 
 // インターフェースを満たしていることをコンパイル時に確認する。
 var (
-	_ storage.Storage     = (*Storage)(nil)
-	_ storage.Hasher      = (*Storage)(nil)
-	_ storage.Mover       = (*Storage)(nil)
-	_ storage.Purger      = (*Storage)(nil)
-	_ storage.RangeOpener = (*Storage)(nil)
-	_ storage.SetModTimer = (*Storage)(nil)
+	_ storage.Storage      = (*Storage)(nil)
+	_ storage.Abouter      = (*Storage)(nil)
+	_ storage.Hasher       = (*Storage)(nil)
+	_ storage.Mover        = (*Storage)(nil)
+	_ storage.OffsetWriter = (*Storage)(nil)
+	_ storage.Purger       = (*Storage)(nil)
+	_ storage.RangeOpener  = (*Storage)(nil)
+	_ storage.Resumer      = (*Storage)(nil)
+	_ storage.SetModTimer  = (*Storage)(nil)
 )
@@ -162,3 +162,18 @@ func TestFeaturesDeclaresOptionalInterfaces(t *testing.T) {
 		t.Error("OS のパス規則に従うので OSPath は真であるべき")
 	}
 }
+
+// まだ無いディレクトリを聞かれても、在る親のボリュームの使用量を答えることを確認します。
+func TestAboutMissingDir(t *testing.T) {
+	ctx := context.Background()
+	s := local.New("local")
+	root := filepath.ToSlash(t.TempDir())
+
+	u, err := s.About(ctx, root+"/まだ無い/下")
+	if err != nil {
+		t.Fatalf("About: %v", err)
+	}
+	if u.Total <= 0 || u.Free < 0 || u.Free > u.Total {
+		t.Errorf("About = %+v", u)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package local
+
+import (
+	"fmt"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// diskUsage は、使用量を調べる手段の無い OS では ErrUnsupported を返します。
+func diskUsage(string) (*storage.Usage, error) {
+	return nil, fmt.Errorf("%w: 容量の取得", storage.ErrUnsupported)
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package local
+
+import (
+	"github.com/mt3hr/hbg/storage"
+	"golang.org/x/sys/unix"
+)
+
+// diskUsage は p を含むファイルシステムの使用量を返します。
+//
+// 空きは一般の利用者が使える分（Bavail）で数えます。root 用に
+// 取ってある分は hbg から書けるとは限らないためです。
+func diskUsage(p string) (*storage.Usage, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(p, &st); err != nil {
+		return nil, err
+	}
+	bsize := int64(st.Bsize)
+	total := int64(st.Blocks) * bsize
+	return &storage.Usage{
+		Total: total,
+		Used:  total - int64(st.Bfree)*bsize,
+		Free:  int64(st.Bavail) * bsize,
+	}, nil
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package local
+
+import (
+	"github.com/mt3hr/hbg/storage"
+	"golang.org/x/sys/windows"
+)
+
+// diskUsage は p を含むボリュームの使用量を返します。
+//
+// 空きは呼び出した利用者が使える分で数えます。クォータがあると
+// ボリューム全体の空きより小さくなります。
+func diskUsage(p string) (*storage.Usage, error) {
+	name, err := windows.UTF16PtrFromString(p)
+	if err != nil {
+		return nil, err
+	}
+	var avail, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &avail, &total, &free); err != nil {
+		return nil, err
+	}
+	return &storage.Usage{
+		Total: int64(total),
+		Used:  int64(total - free),
+		Free:  int64(avail),
+	}, nil
+}
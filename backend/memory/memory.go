@@ -7,6 +7,7 @@ package memory
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"path"
@@ -35,6 +36,8 @@ type Storage struct {
 	// entries はパスをキーにした平坦な表です。
 	// ディレクトリも1件として持ちます。
 	entries map[string]*entry
+	// parts は続きから書くための書きかけです。List には出しません。
+	parts map[string]*entry
 
 	// hooks は障害を差し込むためのものです。
 	hooks Hooks
@@ -43,7 +46,8 @@ type Storage struct {
 // Hooks はテストで障害を再現するための差し込み口です。
 type Hooks struct {
 	// BeforeOp は各操作の前に呼ばれます。非 nil を返すとその操作は失敗します。
-	// op は "list", "stat", "open", "put", "mkdir", "remove" のいずれかです。
+	// op は "list", "list-recursive", "stat", "open", "put", "mkdir", "remove",
+	// "partial" のいずれかです。
 	BeforeOp func(op, path string) error
 	// PutReader は Put が読む Reader を差し替えます。
 	// 途中で失敗する Reader を返すことで、転送の中断を再現できます。
@@ -55,6 +59,7 @@ func New(name string) *Storage {
 	s := &Storage{
 		name:    name,
 		entries: map[string]*entry{},
+		parts:   map[string]*entry{},
 	}
 	s.entries["/"] = &entry{isDir: true, modTime: time.Now()}
 	return s
@@ -78,7 +83,7 @@ func (s *Storage) Features() *storage.Features {
 	return &storage.Features{
 		ModTimePrecision: time.Nanosecond,
 		CanSetModTime:    true,
-		Hashes:           storage.HashSet{storage.SHA256, storage.MD5, storage.SHA1, storage.DropboxContent},
+		Hashes:           storage.HashSet{storage.SHA256, storage.MD5, storage.SHA1, storage.DropboxContent, storage.QuickXor},
 		ImplicitDirs:     true,
 		EmptyDirs:        true,
 		AtomicPut:        true,
@@ -118,8 +123,17 @@ func (s *Storage) check(ctx context.Context, op, p string) error {
 
 // List はディレクトリの中身を1件ずつ fn に渡します。
 func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	return s.list(ctx, "list", dir, false, fn)
+}
+
+// ListRecursive は dir の配下を深さを問わず1件ずつ fn に渡します。
+func (s *Storage) ListRecursive(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	return s.list(ctx, "list-recursive", dir, true, fn)
+}
+
+func (s *Storage) list(ctx context.Context, op, dir string, recursive bool, fn func(storage.FileInfo) error) error {
 	dir = clean(dir)
-	if err := s.check(ctx, "list", dir); err != nil {
+	if err := s.check(ctx, op, dir); err != nil {
 		return err
 	}
 
@@ -127,14 +141,14 @@ func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo
 	e, ok := s.entries[dir]
 	if !ok {
 		s.mu.RUnlock()
-		return s.notFound("list", dir)
+		return s.notFound(op, dir)
 	}
 	if !e.isDir {
 		s.mu.RUnlock()
-		return s.wrapErr("list", dir, storage.ClassPermanent, fmt.Errorf("%w: %s", storage.ErrNotDir, dir))
+		return s.wrapErr(op, dir, storage.ClassPermanent, fmt.Errorf("%w: %s", storage.ErrNotDir, dir))
 	}
 
-	// 直下のものだけを集める
+	// 直下のもの（recursive なら配下のすべて）を集める
 	infos := []storage.FileInfo{}
 	prefix := dir
 	if prefix != "/" {
@@ -145,7 +159,7 @@ func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo
 			continue
 		}
 		rest := strings.TrimPrefix(p, prefix)
-		if strings.Contains(rest, "/") {
+		if !recursive && strings.Contains(rest, "/") {
 			continue // 孫以降
 		}
 		infos = append(infos, s.infoLocked(p, child))
@@ -158,7 +172,7 @@ func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo
 
 	for _, fi := range infos {
 		if err := ctx.Err(); err != nil {
-			return s.wrapErr("list", dir, storage.ClassCanceled, err)
+			return s.wrapErr(op, dir, storage.ClassCanceled, err)
 		}
 		if err := fn(fi); err != nil {
 			return err
@@ -283,6 +297,174 @@ func (s *Storage) Put(ctx context.Context, p string, r io.Reader, meta storage.O
 	return &fi, nil
 }
 
+// Partial は書きかけのメタデータを返します。
+func (s *Storage) Partial(ctx context.Context, p string) (*storage.FileInfo, error) {
+	p = clean(p)
+	if err := s.check(ctx, "partial", p); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.parts[p]
+	if !ok {
+		return nil, s.notFound("partial", p)
+	}
+	fi := s.infoLocked(p, e)
+	return &fi, nil
+}
+
+// PutResume は書きかけの続きから書き込みます。
+//
+// 読めたぶんはその都度書きかけに足すので、途中で失敗しても
+// そこまでが書きかけとして残ります。
+func (s *Storage) PutResume(ctx context.Context, p string, offset int64, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	p = clean(p)
+	if err := s.check(ctx, "put", p); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	part, ok := s.parts[p]
+	switch {
+	case offset == 0:
+		part = &entry{modTime: time.Now()}
+		s.parts[p] = part
+	case !ok || int64(len(part.data)) != offset:
+		s.mu.Unlock()
+		return nil, s.notFound("put", p)
+	}
+	wrap := s.hooks.PutReader
+	s.mu.Unlock()
+
+	if wrap != nil {
+		r = wrap(p, r)
+	}
+
+	buf := make([]byte, 32*1024)
+	cr := &ctxReader{ctx: ctx, r: r}
+	for {
+		n, err := cr.Read(buf)
+		if n > 0 {
+			s.mu.Lock()
+			part.data = append(part.data, buf[:n]...)
+			part.modTime = time.Now()
+			s.mu.Unlock()
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, s.wrapErr("put", p, storage.ClassCanceled, err)
+			}
+			return nil, s.wrapErr("put", p, storage.ClassUnknown, err)
+		}
+	}
+
+	modTime := meta.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.parts, p)
+	s.mkdirAllLocked(path.Dir(p))
+	s.entries[p] = &entry{data: part.data, modTime: modTime}
+
+	fi := s.infoLocked(p, s.entries[p])
+	return &fi, nil
+}
+
+// OpenWriterAt は、好きな位置へ書き込める口を開きます。
+// 書いている間は List にも Stat にも出ません。
+func (s *Storage) OpenWriterAt(ctx context.Context, p string, size int64) (storage.PartWriter, error) {
+	p = clean(p)
+	if err := s.check(ctx, "put", p); err != nil {
+		return nil, err
+	}
+	return &partWriter{s: s, path: p, data: make([]byte, size)}, nil
+}
+
+// partWriter は OpenWriterAt が開いた書き込み口です。
+type partWriter struct {
+	s    *Storage
+	path string
+
+	mu   sync.Mutex
+	data []byte
+	done bool
+}
+
+func (w *partWriter) WriteAt(b []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done {
+		return 0, w.s.wrapErr("put", w.path, storage.ClassPermanent, errors.New("書き込み口は閉じています"))
+	}
+	if off < 0 || off+int64(len(b)) > int64(len(w.data)) {
+		return 0, w.s.wrapErr("put", w.path, storage.ClassPermanent,
+			fmt.Errorf("開いた大きさ %d バイトを超えて書こうとしました", len(w.data)))
+	}
+	return copy(w.data[off:], b), nil
+}
+
+// Commit は書いた内容を置きます。
+func (w *partWriter) Commit(ctx context.Context, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	if err := w.s.check(ctx, "put", w.path); err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	data := w.data
+	w.done = true
+	w.mu.Unlock()
+
+	modTime := meta.ModTime
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+
+	w.s.mkdirAllLocked(path.Dir(w.path))
+	w.s.entries[w.path] = &entry{data: data, modTime: modTime}
+
+	fi := w.s.infoLocked(w.path, w.s.entries[w.path])
+	return &fi, nil
+}
+
+// Abort は書いた内容を捨てます。
+func (w *partWriter) Abort() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.done = true
+	return nil
+}
+
+// SetPartial は書きかけを直接置きます。テストで中断された転送を再現するためのものです。
+func (s *Storage) SetPartial(p string, data []byte, modTime time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parts[clean(p)] = &entry{data: append([]byte(nil), data...), modTime: modTime}
+}
+
+// Partials は書きかけのパスを返します。テストの検証用です。
+func (s *Storage) Partials() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]string, 0, len(s.parts))
+	for p := range s.parts {
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out
+}
+
 // ctxReader は読み取りのたびに ctx を確認します。
 type ctxReader struct {
 	ctx context.Context
@@ -455,10 +637,13 @@ func (s *Storage) Snapshot() map[string]string {
 }
 
 var (
-	_ storage.Storage     = (*Storage)(nil)
-	_ storage.Hasher      = (*Storage)(nil)
-	_ storage.Mover       = (*Storage)(nil)
-	_ storage.Purger      = (*Storage)(nil)
-	_ storage.RangeOpener = (*Storage)(nil)
-	_ storage.SetModTimer = (*Storage)(nil)
+	_ storage.Storage         = (*Storage)(nil)
+	_ storage.Hasher          = (*Storage)(nil)
+	_ storage.Mover           = (*Storage)(nil)
+	_ storage.OffsetWriter    = (*Storage)(nil)
+	_ storage.Purger          = (*Storage)(nil)
+	_ storage.RangeOpener     = (*Storage)(nil)
+	_ storage.RecursiveLister = (*Storage)(nil)
+	_ storage.Resumer         = (*Storage)(nil)
+	_ storage.SetModTimer     = (*Storage)(nil)
 )
@@ -2,6 +2,7 @@ package onedrive
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -15,6 +16,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/mt3hr/hbg/storage"
 )
 
 // 偽の Microsoft Graph サーバーです。
@@ -305,7 +308,10 @@ func (f *fakeGraph) itemJSON(p string, e *fakeItem) map[string]any {
 	}
 
 	out["size"] = len(e.data)
-	out["file"] = map[string]any{"mimeType": "application/octet-stream"}
+	out["file"] = map[string]any{
+		"mimeType": "application/octet-stream",
+		"hashes":   map[string]any{"quickXorHash": quickXorBase64(e.data)},
+	}
 	if !e.fsModTime.IsZero() {
 		out["fileSystemInfo"] = map[string]any{
 			"lastModifiedDateTime": e.fsModTime.UTC().Format(time.RFC3339Nano),
@@ -314,6 +320,13 @@ func (f *fakeGraph) itemJSON(p string, e *fakeItem) map[string]any {
 	return out
 }
 
+// quickXorBase64 は実物と同じく base64 で表した quickXorHash を返します。
+func quickXorBase64(data []byte) string {
+	h := storage.NewQuickXorHash()
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
 // --- 各操作 ---
 
 func (f *fakeGraph) getItem(w http.ResponseWriter, itemPath string) {
@@ -3,6 +3,8 @@ package onedrive
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -82,6 +84,21 @@ func (i driveItem) modTime() time.Time {
 	return time.Time{}
 }
 
+// quickXorHash は quickXorHash を16進で返します。無ければ空です。
+//
+// Graph は base64 で返しますが、hbg のハッシュはどれも16進で表すので、
+// 計算した値とそのまま比べられるよう直しておきます。
+func (i driveItem) quickXorHash() string {
+	if i.File == nil || i.File.Hashes.QuickXorHash == "" {
+		return ""
+	}
+	sum, err := base64.StdEncoding.DecodeString(i.File.Hashes.QuickXorHash)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(sum)
+}
+
 // itemsPage は一覧の1ページです。
 type itemsPage struct {
 	Value    []driveItem `json:"value"`
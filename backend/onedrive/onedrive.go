@@ -92,15 +92,16 @@ func (s *Storage) Features() *storage.Features {
 		ModTimePrecision: time.Millisecond,
 		CanSetModTime:    true,
 		CaseInsensitive:  true,
-		// OneDrive が返すのは quickXorHash で、hbg はこれを
-		// 計算できません。詳しくは README の既知の制限を見てください。
-		Hashes:       nil,
+		// 個人用と職場・学校用のどちらでも返るのは quickXorHash だけです。
+		// sha1Hash は個人用にしかなく、当てにできません。
+		Hashes:       storage.HashSet{storage.QuickXor},
 		ImplicitDirs: true,
 		EmptyDirs:    true,
 		// 書き込みは完了してはじめて見えます。
 		AtomicPut: true,
 		// OneDrive のファイル名に使えない文字。
-		IllegalChars: `<>:"|?*\`,
+		IllegalChars:  `<>:"|?*\`,
+		MaxNameLength: 255,
 	}
 }
 
@@ -449,6 +450,29 @@ func (s *Storage) SetModTime(ctx context.Context, p string, t time.Time) error {
 	return s.wrapErr("setmodtime", p, err)
 }
 
+// Hash はファイルのハッシュを返します。扱えるのは quickXorHash だけです。
+func (s *Storage) Hash(ctx context.Context, p string, ht storage.HashType) (string, error) {
+	if ht != storage.QuickXor {
+		return "", fmt.Errorf("%w: onedrive が扱えるのは %s だけです（%s を要求されました）",
+			storage.ErrUnsupported, storage.QuickXor, ht)
+	}
+
+	item, err := s.client.getItem(ctx, s.full(p))
+	if err != nil {
+		return "", s.wrapErr("hash", p, err)
+	}
+	if item.isDir() {
+		return "", s.wrapErr("hash", p, storage.ErrIsDir)
+	}
+	h := item.quickXorHash()
+	if h == "" {
+		// 書き込んだ直後など、まだ計算されていないことがある。
+		return "", s.wrapErr("hash", p, fmt.Errorf(
+			"%w: quickXorHash が返されませんでした", storage.ErrUnsupported))
+	}
+	return h, nil
+}
+
 // parentReference は移動先の親を表す文字列を組み立てます。
 func (s *Storage) parentReference(dir string) string {
 	full := s.full(dir)
@@ -471,6 +495,9 @@ func toFileInfo(item driveItem, dir string) storage.FileInfo {
 	if fi.IsDir {
 		fi.Size = storage.SizeUnknown
 	}
+	if h := item.quickXorHash(); h != "" {
+		fi.Hashes = map[storage.HashType]string{storage.QuickXor: h}
+	}
 	return fi
 }
 
@@ -480,4 +507,5 @@ var (
 	_ storage.Mover       = (*Storage)(nil)
 	_ storage.RangeOpener = (*Storage)(nil)
 	_ storage.SetModTimer = (*Storage)(nil)
+	_ storage.Hasher      = (*Storage)(nil)
 )
@@ -115,6 +115,46 @@ func TestModTimeUsesFileSystemInfo(t *testing.T) {
 	}
 }
 
+// Graph が base64 で返す quickXorHash を、hbg の他のハッシュと同じく
+// 16進で扱うことを確かめます。ローカルで計算した値とそのまま比べられないと、
+// --checksum の比較がすべて「違う」になります。
+func TestQuickXorHashIsHex(t *testing.T) {
+	ctx, _, s := newTestStorage(t)
+	put(t, ctx, s, "/a.bin", "\xb5\xb4")
+
+	// OneDrive が "taAFAAAAAAAAAAAAAgAAAAAAAAA=" と返す内容。
+	want := "b5a005" + strings.Repeat("00", 9) + "02" + strings.Repeat("00", 7)
+
+	fi, err := s.Stat(ctx, "/a.bin")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if got := fi.Hashes[storage.QuickXor]; got != want {
+		t.Errorf("Stat の quickXorHash = %q, want %q", got, want)
+	}
+
+	got, err := s.Hash(ctx, "/a.bin", storage.QuickXor)
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if got != want {
+		t.Errorf("Hash = %q, want %q", got, want)
+	}
+
+	w, sum, err := storage.MultiHasher(storage.QuickXor)
+	if err != nil {
+		t.Fatalf("MultiHasher: %v", err)
+	}
+	io.WriteString(w, "\xb5\xb4")
+	if local := sum()[storage.QuickXor]; local != want {
+		t.Errorf("手元で計算した値 = %q, want %q", local, want)
+	}
+
+	if _, err := s.Hash(ctx, "/a.bin", storage.SHA1); !errors.Is(err, storage.ErrUnsupported) {
+		t.Errorf("sha1 を要求したときのエラー = %v, want ErrUnsupported", err)
+	}
+}
+
 // 分割送信の経路を通り、内容が壊れないことを確かめます。
 //
 // Graph の分割送信は1つぶんの大きさが 320KiB の倍数でなければ
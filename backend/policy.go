@@ -0,0 +1,249 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// Policy は、設定でストレージに課す制限です。
+//
+// 保管用のバケットや原本を置いた NAS を、打ち間違えたコマンドで
+// 書き換えたり消したりしないためのものです。Resolver.Get が返す
+// ストレージをこれで包むので、どのコマンドから使っても、重ねる種別の
+// 下にあっても同じように効きます。重ねる種別は Permit を下へ渡すので、
+// 上からも始める前に断れます。
+//
+// 禁じた変更には ErrUnsupported ではなく ErrReadOnly を返します。
+// どちらも再試行しない ClassPermanent ですが、ヘルパは ErrUnsupported を
+// 「別の方法でやり直せ」と読むことがあります（サーバー側コピーから読んで
+// 書くコピーへ、など）。禁じたものを別の方法で通させないためです。
+type Policy struct {
+	// ReadOnly は、変更をすべて禁じます。
+	ReadOnly bool
+	// NoDelete は、削除と移動を禁じます。書き込みと上書きはできます。
+	NoDelete bool
+	// AppendOnly は、新しく置くことだけを許します。
+	// 上書き・削除・移動を禁じます。
+	AppendOnly bool
+}
+
+// IsZero は、何も制限しないかを返します。
+func (p Policy) IsZero() bool { return p == Policy{} }
+
+// deny は、op を禁じている設定の項目名を返します。許されていれば空です。
+func (p Policy) deny(op string) string {
+	switch op {
+	case "put", "mkdir", "copy", "setmodtime":
+		if p.ReadOnly {
+			return "read_only"
+		}
+	case "remove", "move", "purge":
+		switch {
+		case p.ReadOnly:
+			return "read_only"
+		case p.NoDelete:
+			return "no_delete"
+		case p.AppendOnly:
+			return "append_only"
+		}
+	}
+	return ""
+}
+
+// restricted は、Policy で禁じた変更を下のストレージに届く前に断ります。
+type restricted struct {
+	inner storage.Storage
+	// name は設定で付けた名前です。断るときのエラーに使います。
+	name   string
+	policy Policy
+}
+
+// Restrict は、s への変更を policy で制限したストレージを返します。
+// policy が何も制限しなければ s をそのまま返します。
+//
+// 閉じても s は閉じません。
+func Restrict(s storage.Storage, name string, policy Policy) storage.Storage {
+	if policy.IsZero() {
+		return s
+	}
+	return &restricted{inner: s, name: name, policy: policy}
+}
+
+// unrestricted は、Restrict で包む前のストレージを返します。
+func unrestricted(s storage.Storage) storage.Storage {
+	if r, ok := s.(*restricted); ok {
+		return r.inner
+	}
+	return s
+}
+
+// Type は下のストレージの種別を返します。
+func (r *restricted) Type() string { return r.inner.Type() }
+
+// Name は下のストレージの名前を返します。
+// 同じストレージとして扱えるよう、名前は変えません。
+func (r *restricted) Name() string { return r.inner.Name() }
+
+// Features は下のストレージにできることを返します。
+func (r *restricted) Features() *storage.Features { return r.inner.Features() }
+
+// Supports は下のストレージが持つ能力を使えると答えます。
+// 禁じた変更は、呼ばれたときに断ります。
+func (r *restricted) Supports(c storage.Capability) bool {
+	return storage.Supports(r.inner, c)
+}
+
+// Close は何もしません。下のストレージは Resolver が閉じます。
+func (r *restricted) Close() error { return nil }
+
+// Permit は、op が設定で禁じられていないかを返します。
+func (r *restricted) Permit(op string) error {
+	return r.check(op, "")
+}
+
+func (r *restricted) check(op, p string) error {
+	key := r.policy.deny(op)
+	if key == "" {
+		return nil
+	}
+	return storage.Wrap(op, r.name, p, storage.ClassPermanent,
+		fmt.Errorf("%w（設定で %s を指定しています）", storage.ErrReadOnly, key))
+}
+
+// checkNew は、append_only のときに p がまだ無いことを確かめます。
+func (r *restricted) checkNew(ctx context.Context, op, p string) error {
+	if err := r.check(op, p); err != nil || !r.policy.AppendOnly {
+		return err
+	}
+	_, err := r.inner.Stat(ctx, p)
+	switch {
+	case err == nil:
+		return storage.Wrap(op, r.name, p, storage.ClassPermanent,
+			fmt.Errorf("%w（設定で append_only を指定しているので、すでにあるものは上書きできません）", storage.ErrReadOnly))
+	case storage.IsNotFound(err):
+		return nil
+	}
+	return err
+}
+
+func (r *restricted) List(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	return r.inner.List(ctx, dir, fn)
+}
+
+func (r *restricted) Stat(ctx context.Context, p string) (*storage.FileInfo, error) {
+	return r.inner.Stat(ctx, p)
+}
+
+func (r *restricted) Open(ctx context.Context, p string) (io.ReadCloser, *storage.FileInfo, error) {
+	return r.inner.Open(ctx, p)
+}
+
+func (r *restricted) Put(ctx context.Context, p string, rd io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	if err := r.checkNew(ctx, "put", p); err != nil {
+		return nil, err
+	}
+	return r.inner.Put(ctx, p, rd, meta)
+}
+
+func (r *restricted) Mkdir(ctx context.Context, dir string) error {
+	if err := r.check("mkdir", dir); err != nil {
+		return err
+	}
+	return r.inner.Mkdir(ctx, dir)
+}
+
+func (r *restricted) Remove(ctx context.Context, p string) error {
+	if err := r.check("remove", p); err != nil {
+		return err
+	}
+	return r.inner.Remove(ctx, p)
+}
+
+// --- 下のストレージが持っていれば使える能力 ---
+
+func (r *restricted) Hash(ctx context.Context, p string, ht storage.HashType) (string, error) {
+	return storage.GetHash(ctx, r.inner, &storage.FileInfo{Path: p}, ht)
+}
+
+func (r *restricted) ServerSideCopy(ctx context.Context, srcPath, dstPath string) (*storage.FileInfo, error) {
+	if err := r.checkNew(ctx, "copy", dstPath); err != nil {
+		return nil, err
+	}
+	return storage.ServerSideCopy(ctx, r.inner, r.inner, srcPath, dstPath)
+}
+
+func (r *restricted) Move(ctx context.Context, srcPath, dstPath string) error {
+	if err := r.check("move", srcPath); err != nil {
+		return err
+	}
+	return storage.Move(ctx, r.inner, srcPath, dstPath)
+}
+
+func (r *restricted) OpenRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	return storage.OpenRange(ctx, r.inner, p, offset, length)
+}
+
+func (r *restricted) Purge(ctx context.Context, dir string) error {
+	if err := r.check("purge", dir); err != nil {
+		return err
+	}
+	return storage.PurgeAll(ctx, r.inner, dir)
+}
+
+func (r *restricted) SetModTime(ctx context.Context, p string, t time.Time) error {
+	if err := r.check("setmodtime", p); err != nil {
+		return err
+	}
+	return storage.SetModTime(ctx, r.inner, p, t)
+}
+
+func (r *restricted) Partial(ctx context.Context, p string) (*storage.FileInfo, error) {
+	return storage.PartialOf(ctx, r.inner, p)
+}
+
+func (r *restricted) PutResume(ctx context.Context, p string, offset int64, rd io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	if err := r.checkNew(ctx, "put", p); err != nil {
+		return nil, err
+	}
+	return storage.PutResume(ctx, r.inner, p, offset, rd, meta)
+}
+
+func (r *restricted) OpenWriterAt(ctx context.Context, p string, size int64) (storage.PartWriter, error) {
+	if err := r.checkNew(ctx, "put", p); err != nil {
+		return nil, err
+	}
+	return storage.OpenWriterAt(ctx, r.inner, p, size)
+}
+
+func (r *restricted) ListRecursive(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	return storage.ListRecursive(ctx, r.inner, dir, fn)
+}
+
+func (r *restricted) About(ctx context.Context, p string) (*storage.Usage, error) {
+	return storage.About(ctx, r.inner, p)
+}
+
+func (r *restricted) Verify(ctx context.Context, p string, plain io.Reader) error {
+	return storage.Verify(ctx, r.inner, p, plain)
+}
+
+var (
+	_ storage.Storage            = (*restricted)(nil)
+	_ storage.CapabilityReporter = (*restricted)(nil)
+	_ storage.Permitter          = (*restricted)(nil)
+	_ storage.Hasher             = (*restricted)(nil)
+	_ storage.ServerSideCopier   = (*restricted)(nil)
+	_ storage.Mover              = (*restricted)(nil)
+	_ storage.RangeOpener        = (*restricted)(nil)
+	_ storage.Purger             = (*restricted)(nil)
+	_ storage.SetModTimer        = (*restricted)(nil)
+	_ storage.Resumer            = (*restricted)(nil)
+	_ storage.OffsetWriter       = (*restricted)(nil)
+	_ storage.RecursiveLister    = (*restricted)(nil)
+	_ storage.Abouter            = (*restricted)(nil)
+	_ storage.Verifier           = (*restricted)(nil)
+)
@@ -0,0 +1,95 @@
+package backend_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/storage"
+)
+
+// restrictedMemory は、policy を付けたメモリのストレージを返します。
+// 付ける前のものも返すので、下に何も届いていないことを確かめられます。
+func restrictedMemory(t *testing.T, policy backend.Policy) (storage.Storage, *memory.Storage) {
+	t.Helper()
+	mem := memory.New("mem")
+	if _, err := mem.Put(context.Background(), "/dir/old.txt", strings.NewReader("古い"), storage.ObjectMeta{Size: 6}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	return backend.Restrict(mem, "mem", policy), mem
+}
+
+// 禁じた変更が、下のストレージに届く前に断られることを確認します。
+func TestPolicy(t *testing.T) {
+	ctx := context.Background()
+	put := func(s storage.Storage, p string) error {
+		_, err := s.Put(ctx, p, strings.NewReader("新しい"), storage.ObjectMeta{Size: 9})
+		return err
+	}
+	ops := map[string]func(s storage.Storage) error{
+		"新しく置く":  func(s storage.Storage) error { return put(s, "/dir/new.txt") },
+		"上書き":    func(s storage.Storage) error { return put(s, "/dir/old.txt") },
+		"作る":     func(s storage.Storage) error { return s.Mkdir(ctx, "/made") },
+		"削除":     func(s storage.Storage) error { return s.Remove(ctx, "/dir/old.txt") },
+		"移動":     func(s storage.Storage) error { return storage.Move(ctx, s, "/dir/old.txt", "/moved.txt") },
+		"中身ごと削除": func(s storage.Storage) error { return storage.PurgeAll(ctx, s, "/dir") },
+	}
+
+	for _, tt := range []struct {
+		name    string
+		policy  backend.Policy
+		allowed []string
+	}{
+		{"read_only", backend.Policy{ReadOnly: true}, nil},
+		{"no_delete", backend.Policy{NoDelete: true}, []string{"新しく置く", "上書き", "作る"}},
+		{"append_only", backend.Policy{AppendOnly: true}, []string{"新しく置く", "作る"}},
+	} {
+		for op, do := range ops {
+			t.Run(tt.name+"/"+op, func(t *testing.T) {
+				guarded, mem := restrictedMemory(t, tt.policy)
+				err := do(guarded)
+				if slices.Contains(tt.allowed, op) {
+					if err != nil {
+						t.Errorf("許されるはずが失敗した: %v", err)
+					}
+					return
+				}
+				if !errors.Is(err, storage.ErrReadOnly) || storage.ClassOf(err) != storage.ClassPermanent {
+					t.Errorf("err = %v, want 再試行しない ErrReadOnly", err)
+				}
+				if got := mem.Snapshot(); len(got) != 1 || got["/dir/old.txt"] != "古い" {
+					t.Errorf("下のストレージが変わった: %v", got)
+				}
+			})
+		}
+	}
+}
+
+// 始める前に確かめられること、起点を指定した参照でも効くことを確認します。
+func TestPolicyPermit(t *testing.T) {
+	registerOverlay("test-overlay-policy")
+	r, err := backend.NewResolver([]backend.Entry{
+		{Name: "mem", Type: "memory", Policy: backend.Policy{NoDelete: true}},
+		{Name: "sub", Type: "test-overlay-policy", Params: backend.Params{"remote": "mem:/dir"}},
+	})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	defer r.Close()
+
+	sub, err := r.Get(context.Background(), "sub")
+	if err != nil {
+		t.Fatalf("Get(sub): %v", err)
+	}
+	if err := storage.Permit(sub, "put"); err != nil {
+		t.Errorf("Permit(put) = %v, want nil", err)
+	}
+	err = storage.Permit(sub, "remove")
+	if !errors.Is(err, storage.ErrReadOnly) || !strings.Contains(err.Error(), "no_delete") {
+		t.Errorf("Permit(remove) = %v, want no_delete による ErrReadOnly", err)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"context"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -30,6 +31,55 @@ func (p Params) Get(key string) string { return p[strings.ToLower(key)] }
 // Set は値を設定します。
 func (p Params) Set(key, value string) { p[strings.ToLower(key)] = value }
 
+// List は値を並びとして取り出します。
+//
+// 改行を含んでいれば1行を1つとし、前後の空白と空の行を除きます。
+// 設定ファイルで YAML の並びとして書いたものもこの形で届くので、
+// 空白を含む値はこちらで書きます。1行なら空白で区切ります。
+func (p Params) List(key string) []string {
+	v := p.Get(key)
+	if !strings.Contains(v, "\n") {
+		return strings.Fields(v)
+	}
+	var out []string
+	for line := range strings.Lines(v) {
+		if line = strings.TrimSpace(line); line != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// ParseSize は "2G" のような大きさの指定をバイト数に変換します。
+// 接尾辞は K・M・G・T（1024 の累乗）で、無ければバイトです。
+func ParseSize(v string) (int64, error) {
+	v = strings.TrimSpace(v)
+	shift := 0
+	if v != "" {
+		switch v[len(v)-1] {
+		case 'k', 'K':
+			shift = 10
+		case 'm', 'M':
+			shift = 20
+		case 'g', 'G':
+			shift = 30
+		case 't', 'T':
+			shift = 40
+		}
+		if shift > 0 {
+			v = v[:len(v)-1]
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("大きすぎます: %s", v)
+	}
+	return n << shift, nil
+}
+
 // Descriptor はバックエンドの種別1つぶんの定義です。
 type Descriptor struct {
 	// Type は設定ファイルで指定する種別名です。
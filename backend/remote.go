@@ -0,0 +1,67 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// 重ねる種別（crypt など）は、設定にある別のストレージの上で動きます。
+//
+//	- name: secure
+//	  type: crypt
+//	  remote: dropbox:/secure
+//
+// remote の先は、その種別の New の中で Remote を呼んで受け取ります。
+// New の引数を増やすと、他のストレージを使わない種別まで書き換えることに
+// なるので、組み立てている Resolver は ctx に載せて渡します。
+// 同じ仕組みで、組み立て中の名前の並びも持ち回り、参照の循環を見つけます。
+
+// scopeKey は ctx に載せる scope の鍵です。
+type scopeKey struct{}
+
+// scope は組み立て中のストレージの情報です。
+type scope struct {
+	resolver *Resolver
+	// chain は組み立て中の名前の並びです。外側が先です。
+	chain []string
+}
+
+func withScope(ctx context.Context, r *Resolver, chain []string) context.Context {
+	return context.WithValue(ctx, scopeKey{}, &scope{resolver: r, chain: chain})
+}
+
+// chainOf は組み立て中の名前の並びを返します。
+func chainOf(ctx context.Context) []string {
+	if sc, ok := ctx.Value(scopeKey{}).(*scope); ok {
+		return slices.Clone(sc.chain)
+	}
+	return nil
+}
+
+// Remote は、設定にある他のストレージを "名前:パス" の形で受け取ります。
+// 重ねる種別の New から呼びます。
+//
+// パスを指定すると、そこを起点としたストレージを返します。
+// 返したストレージは閉じないでください。Resolver がまとめて閉じます。
+func Remote(ctx context.Context, spec string) (storage.Storage, error) {
+	sc, ok := ctx.Value(scopeKey{}).(*scope)
+	if !ok {
+		return nil, errors.New("他のストレージは設定ファイルの中からしか参照できません")
+	}
+
+	name, p, found := strings.Cut(spec, ":")
+	if !found || name == "" {
+		return nil, fmt.Errorf("remote の記述が変です: %q（storage:path の形式で指定してください）", spec)
+	}
+
+	s, err := sc.resolver.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return Sub(s, p), nil
+}
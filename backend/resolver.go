@@ -3,6 +3,7 @@ package backend
 import (
 	"context"
 	"fmt"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -18,6 +19,8 @@ type Entry struct {
 	Type string
 	// Params は種別ごとの設定です。
 	Params Params
+	// Policy は変更の制限です。どの種別にも使えます。
+	Policy Policy
 }
 
 // Resolver は名前からストレージを解決します。
@@ -30,6 +33,11 @@ type Resolver struct {
 
 	mu   sync.Mutex
 	open map[string]storage.Storage
+	// building は名前ごとの、組み立ての排他です。
+	//
+	// 重ねる種別（crypt など）は組み立ての中で別の名前を解決するので、
+	// 全体を1つの排他で守ると自分自身を待って止まります。
+	building map[string]*sync.Mutex
 }
 
 // NewResolver は設定から Resolver を作ります。
@@ -38,9 +46,10 @@ type Resolver struct {
 // ネットワークへの接続は行わないので、設定の誤りは接続を待たずに分かります。
 func NewResolver(entries []Entry) (*Resolver, error) {
 	r := &Resolver{
-		entries: make(map[string]Entry, len(entries)),
-		order:   make([]string, 0, len(entries)),
-		open:    map[string]storage.Storage{},
+		entries:  make(map[string]Entry, len(entries)),
+		order:    make([]string, 0, len(entries)),
+		open:     map[string]storage.Storage{},
+		building: map[string]*sync.Mutex{},
 	}
 
 	for _, e := range entries {
@@ -93,28 +102,65 @@ func (r *Resolver) Get(ctx context.Context, name string) (storage.Storage, error
 			name, strings.Join(r.Names(), ", "))
 	}
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	// 重ねる種別の組み立ての途中で、同じ名前に戻ってきたら循環している。
+	chain := chainOf(ctx)
+	if slices.Contains(chain, name) {
+		return nil, fmt.Errorf("ストレージの参照が循環しています: %s",
+			strings.Join(append(chain, name), " → "))
+	}
+
+	lock := r.buildLock(name)
+	lock.Lock()
+	defer lock.Unlock()
 
-	if s, ok := r.open[name]; ok {
+	r.mu.Lock()
+	s, ok := r.open[name]
+	r.mu.Unlock()
+	if ok {
 		return s, nil
 	}
 
-	s, err := New(ctx, e.Type, e.Name, e.Params)
+	s, err := New(withScope(ctx, r, append(chain, name)), e.Type, e.Name, e.Params)
 	if err != nil {
 		return nil, err
 	}
+	s = Restrict(s, e.Name, e.Policy)
+
+	r.mu.Lock()
 	r.open[name] = s
+	r.mu.Unlock()
 	return s, nil
 }
 
+// buildLock は名前ごとの、組み立ての排他を返します。
+func (r *Resolver) buildLock(name string) *sync.Mutex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l, ok := r.building[name]
+	if !ok {
+		l = &sync.Mutex{}
+		r.building[name] = l
+	}
+	return l
+}
+
 // Close は組み立て済みのストレージをすべて閉じます。
+//
+// 別名（alias）は起点を指定しなければ指す先のストレージそのものを返すので、
+// 同じものが2つの名前で登録されていることがあります。2度は閉じません。
 func (r *Resolver) Close() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	var firstErr error
+	closed := make([]storage.Storage, 0, len(r.open))
 	for _, s := range r.open {
+		// 制限を付けたものは、付ける前のものを閉じる。
+		s = unrestricted(s)
+		if slices.Contains(closed, s) {
+			continue
+		}
+		closed = append(closed, s)
 		if err := s.Close(); err != nil && firstErr == nil {
 			firstErr = err
 		}
@@ -245,3 +245,124 @@ func TestTypesReflectRegistrations(t *testing.T) {
 		t.Error("実装されていない ftp が一覧に出ている")
 	}
 }
+
+// registerOverlay は、remote の先をそのまま返すテスト用の種別を登録します。
+func registerOverlay(typ string) {
+	backend.Register(backend.Descriptor{
+		Type:    typ,
+		Summary: "テスト用",
+		New: func(ctx context.Context, _ string, params backend.Params) (storage.Storage, error) {
+			return backend.Remote(ctx, params.Get("remote"))
+		},
+	})
+}
+
+// 重ねる種別が、設定にある他のストレージのディレクトリを起点として使えることを確認します。
+func TestRemoteUsesSubdirectory(t *testing.T) {
+	registerOverlay("test-overlay-sub")
+	r, err := backend.NewResolver([]backend.Entry{
+		{Name: "mem", Type: "memory"},
+		{Name: "over", Type: "test-overlay-sub", Params: backend.Params{"remote": "mem:/base"}},
+	})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	defer r.Close()
+	ctx := context.Background()
+
+	over, err := r.Get(ctx, "over")
+	if err != nil {
+		t.Fatalf("Get(over): %v", err)
+	}
+	if over.Name() != "mem:/base" {
+		t.Errorf("Name = %q, want mem:/base", over.Name())
+	}
+	if _, err := over.Put(ctx, "/dir/a.txt", strings.NewReader("a"), storage.ObjectMeta{Size: 1}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	mem, err := r.Get(ctx, "mem")
+	if err != nil {
+		t.Fatalf("Get(mem): %v", err)
+	}
+	if _, err := mem.Stat(ctx, "/base/dir/a.txt"); err != nil {
+		t.Errorf("起点の下に置かれていない: %v", err)
+	}
+
+	entries, err := storage.ListAll(ctx, over, "/dir")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != "/dir/a.txt" {
+		t.Errorf("一覧 = %v, want /dir/a.txt", entries)
+	}
+	if !storage.Supports(over, storage.CapHash) {
+		t.Error("下のストレージの能力が通っていない")
+	}
+}
+
+// 参照が循環していれば、止まらずにエラーになることを確認します。
+func TestRemoteDetectsCycle(t *testing.T) {
+	registerOverlay("test-overlay-cycle")
+	r, err := backend.NewResolver([]backend.Entry{
+		{Name: "a", Type: "test-overlay-cycle", Params: backend.Params{"remote": "b:/"}},
+		{Name: "b", Type: "test-overlay-cycle", Params: backend.Params{"remote": "a:/"}},
+	})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	defer r.Close()
+
+	_, err = r.Get(context.Background(), "a")
+	if err == nil || !strings.Contains(err.Error(), "a → b → a") {
+		t.Errorf("err = %v, 循環を知らせるべき", err)
+	}
+}
+
+// Resolver の外からは他のストレージを参照できないことを確認します。
+func TestRemoteOutsideResolver(t *testing.T) {
+	if _, err := backend.Remote(context.Background(), "mem:/"); err == nil {
+		t.Error("Resolver の外なのに成功した")
+	}
+}
+
+// closeCounter は閉じられた回数を数えるテスト用のストレージです。
+type closeCounter struct {
+	storage.Storage
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+// 起点を指定しない参照は下のストレージそのものを返すので、2つの名前で
+// 同じものを持っていても、閉じるのは1度だけであることを確認します。
+func TestResolverClosesSharedOnce(t *testing.T) {
+	registerOverlay("test-overlay-shared")
+	counter := &closeCounter{Storage: newStub("base", "test-close-counter")}
+	backend.Register(backend.Descriptor{
+		Type:    "test-close-counter",
+		Summary: "テスト用",
+		New: func(context.Context, string, backend.Params) (storage.Storage, error) {
+			return counter, nil
+		},
+	})
+	r, err := backend.NewResolver([]backend.Entry{
+		{Name: "base", Type: "test-close-counter"},
+		{Name: "all", Type: "test-overlay-shared", Params: backend.Params{"remote": "base:/"}},
+	})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	if _, err := r.Get(context.Background(), "all"); err != nil {
+		t.Fatalf("Get(all): %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if counter.closed != 1 {
+		t.Errorf("閉じた回数 = %d, want 1", counter.closed)
+	}
+}
@@ -241,6 +241,63 @@ func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo
 	return nil
 }
 
+// ListRecursive は dir の配下を深さを問わず1件ずつ fn に渡します。
+//
+// 区切り文字を指定せずに問い合わせると、配下のオブジェクトが
+// ディレクトリの数によらず1000件ずつのページで返ります。
+// 中身があるだけのディレクトリは渡しません。印のあるものだけ渡します。
+func (s *Storage) ListRecursive(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	prefix := s.dirPrefix(dir)
+
+	found := false
+	paginator := awss3.NewListObjectsV2Paginator(s.client, &awss3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int32(listPageSize),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return s.wrapErr("list", dir, err)
+		}
+
+		objects, err := s.pageObjects(ctx, page.Contents, prefix)
+		if err != nil {
+			return s.wrapErr("list", dir, err)
+		}
+		for _, obj := range objects {
+			found = true
+			if obj.key == prefix {
+				// dir 自身の印。
+				continue
+			}
+			p := s.pathOf(obj.key)
+			if obj.marker {
+				if err := fn(storage.FileInfo{
+					Path:  p,
+					Name:  path.Base(p),
+					IsDir: true,
+					Size:  storage.SizeUnknown,
+				}); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := fn(obj.info(path.Dir(p))); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !found && prefix != "" {
+		if err := s.requireDir(ctx, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // listedObject は一覧で見つかった1件です。
 type listedObject struct {
 	key     string
@@ -733,5 +790,6 @@ var (
 	_ storage.Purger           = (*Storage)(nil)
 	_ storage.Mover            = (*Storage)(nil)
 	_ storage.RangeOpener      = (*Storage)(nil)
+	_ storage.RecursiveLister  = (*Storage)(nil)
 	_ storage.ServerSideCopier = (*Storage)(nil)
 )
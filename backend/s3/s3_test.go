@@ -369,6 +369,34 @@ func TestListFollowsContinuation(t *testing.T) {
 	}
 }
 
+// 配下をまとめて一覧すると、ディレクトリの数によらず、
+// ページの数だけの問い合わせで済むことを確かめます。
+func TestListRecursiveIgnoresDirCount(t *testing.T) {
+	ctx, fake, s := newTestStorage(t)
+
+	for i := range 10 {
+		put(t, ctx, s, fmt.Sprintf("/木/%d/中/a.txt", i), "x")
+	}
+
+	before := fake.callCount("list")
+	tree, err := storage.ListTree(ctx, s, "/木")
+	if err != nil {
+		t.Fatalf("ListTree: %v", err)
+	}
+	// 偽物は3件ずつ返すので、10件で4ページ。
+	// ディレクトリごとに一覧すれば21回かかる。
+	if n := fake.callCount("list") - before; n != 4 {
+		t.Errorf("一覧の問い合わせ = %d回, want 4", n)
+	}
+
+	// 中身があるだけのディレクトリも補われている
+	for _, dir := range []string{"/木", "/木/3", "/木/3/中"} {
+		if entries, ok := tree.Dir(dir); !ok || len(entries) == 0 {
+			t.Errorf("%s の中身 = %v, %v", dir, entries, ok)
+		}
+	}
+}
+
 // エラーの分類を確かめます。
 func TestErrorClassification(t *testing.T) {
 	tests := []struct {
@@ -69,6 +69,11 @@ type Config struct {
 	// Root を指定すると、その下を起点として扱います。
 	Root string
 
+	// DisableHashCheck が真なら、サーバーで sha256sum などを実行して
+	// ハッシュを求めることをしません。コマンドを実行できない制限された
+	// シェルや、実行の記録を残したくないサーバーで使います。
+	DisableHashCheck bool
+
 	// Notify は利用者への通知です。ホスト鍵を記録したときなどに呼ばれます。
 	// nil なら何もしません。
 	Notify func(message string)
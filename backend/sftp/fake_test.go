@@ -5,11 +5,17 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 
+	"github.com/mt3hr/hbg/storage"
 	sftpc "github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
@@ -35,6 +41,10 @@ type fakeServer struct {
 
 	mu       sync.Mutex
 	sessions int
+	// execs は実行を求められたコマンドです。
+	execs []string
+	// noExec が真なら、制限されたシェルのようにコマンドの実行を断ります。
+	noExec bool
 }
 
 // startFakeServer は試験用のサーバーを立ち上げます。
@@ -122,6 +132,10 @@ func (s *fakeServer) handleConn(conn net.Conn, cfg *ssh.ServerConfig) {
 
 func (s *fakeServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
 	for req := range requests {
+		if req.Type == "exec" {
+			s.handleExec(channel, req)
+			return
+		}
 		if req.Type != "subsystem" || subsystemName(req.Payload) != "sftp" {
 			if req.WantReply {
 				_ = req.Reply(false, nil)
@@ -148,6 +162,101 @@ func (s *fakeServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Req
 	}
 }
 
+// handleExec はコマンドの実行を受け付けます。
+//
+// 本物のシェルは使わず、hbg が使う sha256sum・md5sum・sha1sum だけを
+// その場で計算して、coreutils と同じ形で答えます。
+func (s *fakeServer) handleExec(channel ssh.Channel, req *ssh.Request) {
+	defer channel.Close()
+
+	var msg struct{ Command string }
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		_ = req.Reply(false, nil)
+		return
+	}
+
+	s.mu.Lock()
+	s.execs = append(s.execs, msg.Command)
+	refuse := s.noExec
+	s.mu.Unlock()
+	if refuse {
+		_ = req.Reply(false, nil)
+		return
+	}
+	if req.WantReply {
+		_ = req.Reply(true, nil)
+	}
+
+	status := s.runHash(channel, msg.Command)
+	_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
+
+// runHash はハッシュのコマンドを1つ実行したことにして、終了の状態を返します。
+func (s *fakeServer) runHash(channel ssh.Channel, command string) uint32 {
+	types := map[string]storage.HashType{
+		"sha256sum": storage.SHA256,
+		"md5sum":    storage.MD5,
+		"sha1sum":   storage.SHA1,
+	}
+	name, arg, hasArg := strings.Cut(command, " ")
+	ht, ok := types[name]
+	if !ok {
+		fmt.Fprintf(channel.Stderr(), "%s: command not found\n", name)
+		return 127
+	}
+	h, _ := storage.NewHash(ht)
+
+	if !hasArg {
+		// 引数がなければ入力を読む。
+		_, _ = io.Copy(h, channel)
+		fmt.Fprintf(channel, "%x  -\n", h.Sum(nil))
+		return 0
+	}
+
+	p, ok := shellUnquote(arg)
+	if !ok {
+		fmt.Fprintf(channel.Stderr(), "sh: 引用符を解釈できません: %s\n", arg)
+		return 2
+	}
+	local := p
+	if !path.IsAbs(local) {
+		local = path.Join(s.rootDir, local)
+	}
+	f, err := os.Open(filepath.FromSlash(local))
+	if err == nil {
+		_, err = io.Copy(h, f)
+		f.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "%s: %s: %v\n", name, p, err)
+		return 1
+	}
+	fmt.Fprintf(channel, "%x  %s\n", h.Sum(nil), p)
+	return 0
+}
+
+// shellUnquote は shellQuote で囲んだ引数を元に戻します。
+func shellUnquote(arg string) (string, bool) {
+	var b strings.Builder
+	for arg != "" {
+		switch {
+		case strings.HasPrefix(arg, `\'`):
+			b.WriteByte('\'')
+			arg = arg[2:]
+		case arg[0] == '\'':
+			end := strings.IndexByte(arg[1:], '\'')
+			if end < 0 {
+				return "", false
+			}
+			b.WriteString(arg[1 : end+1])
+			arg = arg[end+2:]
+		default:
+			return "", false
+		}
+	}
+	return b.String(), true
+}
+
 // subsystemName は subsystem 要求の中身を読み取ります。
 func subsystemName(payload []byte) string {
 	var msg struct{ Name string }
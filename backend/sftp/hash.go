@@ -0,0 +1,183 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP そのものには内容のハッシュを求める方法がありません。
+// check-file という拡張はありますが、対応するサーバーはわずかで、
+// pkg/sftp からも任意の拡張の要求は送れません。
+//
+// 一方、SFTP の相手はたいてい普通の Linux で、sha256sum などが
+// 入っています。そこで同じ SSH の接続でコマンドを実行して求めます。
+// 使えるかどうかは接続時に空の入力で試し、答えが合ったものだけを
+// Features().Hashes として申告します。
+
+// hashCommands は、ハッシュの種類ごとにサーバーで実行するコマンドです。
+// 並びは優先順です。
+var hashCommands = []struct {
+	ht      storage.HashType
+	command string
+}{
+	{storage.SHA256, "sha256sum"},
+	{storage.MD5, "md5sum"},
+	{storage.SHA1, "sha1sum"},
+}
+
+// hashProbeTimeout は、接続時にコマンドを試すときの待ち時間です。
+// 制限されたシェルが入力を待ち続けても、接続が止まらないようにします。
+const hashProbeTimeout = 10 * time.Second
+
+// detectHashes は、サーバーで使えるハッシュのコマンドを調べます。
+//
+// 空の入力のハッシュを求めさせ、既知の値と合うものだけを返します。
+// コマンドを実行できないサーバーでは空を返し、接続そのものは続けます。
+func detectHashes(ctx context.Context, conn *ssh.Client) storage.HashSet {
+	ctx, cancel := context.WithTimeout(ctx, hashProbeTimeout)
+	defer cancel()
+
+	var found storage.HashSet
+	for _, c := range hashCommands {
+		h, err := storage.NewHash(c.ht)
+		if err != nil {
+			continue
+		}
+		want := hex.EncodeToString(h.Sum(nil))
+
+		out, err := runCommand(ctx, conn, c.command)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if got, ok := parseHashOutput(out, c.ht); ok && got == want {
+			found = append(found, c.ht)
+		}
+	}
+	return found
+}
+
+// Hash はサーバーでコマンドを実行して、ファイルのハッシュを求めます。
+func (s *Storage) Hash(ctx context.Context, p string, ht storage.HashType) (string, error) {
+	command, ok := s.hashCommand(ht)
+	if !ok {
+		return "", fmt.Errorf("%w: sftp %s では %s を求められません",
+			storage.ErrUnsupported, s.name, ht)
+	}
+
+	full := s.full(p)
+	out, err := runCommand(ctx, s.conn, command+" "+shellQuote(full))
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", s.wrapErr("hash", p, ctx.Err())
+		}
+		// コマンドの失敗からは、無いのか読めないのかが分からない。
+		// SFTP で確かめ直して、分かる形のエラーにする。
+		info, statErr := s.client.Stat(full)
+		switch {
+		case statErr != nil:
+			return "", s.wrapErr("hash", p, statErr)
+		case info.IsDir():
+			return "", s.wrapErr("hash", p, storage.ErrIsDir)
+		}
+		return "", s.wrapErr("hash", p, err)
+	}
+
+	sum, ok := parseHashOutput(out, ht)
+	if !ok {
+		return "", s.wrapErr("hash", p, fmt.Errorf("%s の出力を読めません: %q", command, out))
+	}
+	return sum, nil
+}
+
+// hashCommand は、申告しているハッシュに対応するコマンドを返します。
+func (s *Storage) hashCommand(ht storage.HashType) (string, bool) {
+	if !s.hashes.Has(ht) {
+		return "", false
+	}
+	for _, c := range hashCommands {
+		if c.ht == ht {
+			return c.command, true
+		}
+	}
+	return "", false
+}
+
+// runCommand はサーバーでコマンドを実行し、標準出力を返します。
+// 入力は空です。
+func runCommand(ctx context.Context, conn *ssh.Client, command string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	done := make(chan error, 1)
+	go func() { done <- session.Run(command) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("%s: %w", msg, err)
+			}
+			return nil, err
+		}
+		return stdout.Bytes(), nil
+	case <-ctx.Done():
+		// 閉じれば Run も戻る。出力を読み終えるのを待ってから返す。
+		session.Close()
+		<-done
+		return nil, ctx.Err()
+	}
+}
+
+// parseHashOutput は sha256sum などの出力からハッシュを取り出します。
+//
+// 出力は "ハッシュ  名前" の形です。名前に "\" や改行を含むと、
+// GNU coreutils は行の頭に "\" を付けるので、それも読み飛ばします。
+func parseHashOutput(out []byte, ht storage.HashType) (string, bool) {
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", false
+	}
+	sum := strings.ToLower(strings.TrimPrefix(fields[0], `\`))
+
+	h, err := storage.NewHash(ht)
+	if err != nil || len(sum) != h.Size()*2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(sum); err != nil {
+		return "", false
+	}
+	return sum, true
+}
+
+// shellQuote はパスをシェルにそのまま渡せる形にします。
+//
+// 全体を ' で囲みます。中の ' は、いったん閉じて \' を挟み、開き直します。
+// "-" で始まる相対パスがコマンドの指定と取り違えられないよう、
+// 相対パスには "./" を付けます。
+func shellQuote(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = "./" + p
+	}
+	return "'" + strings.ReplaceAll(p, "'", `'\''`) + "'"
+}
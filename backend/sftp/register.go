@@ -26,6 +26,7 @@ func init() {
   #   known_hosts_file: 省略時は $HOME/hbg/configs/known_hosts
   #   strict_host_key_checking: yes  # yes / accept-new / no
   #   root: 起点にするディレクトリ
+  #   disable_hashcheck: false  # true でサーバーでの sha256sum などの実行をしない
 `,
 		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
 			port, err := intParam(params, "port")
@@ -45,6 +46,7 @@ func init() {
 				KnownHostsFile:        params.Get("known_hosts_file"),
 				StrictHostKeyChecking: params.Get("strict_host_key_checking"),
 				Root:                  params.Get("root"),
+				DisableHashCheck:      params.Get("disable_hashcheck") == "true",
 				Notify: func(message string) {
 					fmt.Fprintf(os.Stderr, "hbg: %s\n", message)
 				},
@@ -37,6 +37,8 @@ type Storage struct {
 	conn   *ssh.Client
 	client *sftpc.Client
 	root   string
+	// hashes はサーバーでコマンドを実行して求められるハッシュです。
+	hashes storage.HashSet
 }
 
 // New は SFTP に接続します。
@@ -52,12 +54,16 @@ func New(ctx context.Context, cfg Config) (*Storage, error) {
 		return nil, fmt.Errorf("sftp %s: %w", cfg.Name, err)
 	}
 
-	return &Storage{
+	s := &Storage{
 		name:   cfg.Name,
 		conn:   conn,
 		client: client,
 		root:   cfg.Root,
-	}, nil
+	}
+	if !cfg.DisableHashCheck {
+		s.hashes = detectHashes(ctx, conn)
+	}
+	return s, nil
 }
 
 // newSFTPClient は SSH の接続の上に SFTP のやりとりを乗せます。
@@ -85,8 +91,9 @@ func (s *Storage) Features() *storage.Features {
 		ModTimePrecision: time.Second,
 		CanSetModTime:    true,
 		CaseInsensitive:  false,
-		// 内容のハッシュを求める標準の方法がありません。
-		Hashes:       nil,
+		// SFTP には内容のハッシュを求める方法がないので、
+		// サーバーでコマンドを実行して求めます（hash.go）。
+		Hashes:       s.hashes,
 		ImplicitDirs: true,
 		EmptyDirs:    true,
 		// 別名で書いてから置き換えます。
@@ -271,6 +278,100 @@ func (s *Storage) Put(ctx context.Context, p string, r io.Reader, meta storage.O
 	}, nil
 }
 
+// Partial は書きかけのメタデータを返します。
+func (s *Storage) Partial(ctx context.Context, p string) (*storage.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, s.wrapErr("partial", p, err)
+	}
+
+	tmp := tempPath(s.full(p))
+	info, err := s.client.Stat(tmp)
+	if err != nil {
+		return nil, s.wrapErr("partial", p, err)
+	}
+	if info.IsDir() {
+		return nil, s.wrapErr("partial", p, storage.ErrIsDir)
+	}
+	fi := toFileInfo(info, path.Dir(cleanPath(p)))
+	return &fi, nil
+}
+
+// PutResume は書きかけの続きから書き込み、書き終えたら本来の場所へ移します。
+//
+// 並行して書く設定なので、失敗したときの書きかけには穴が空きえます。
+// 確かに書けたところ（pkg/sftp が覚えている位置）で切り詰めてから
+// 残すので、次に続きから書いても中身が食い違いません。
+func (s *Storage) PutResume(ctx context.Context, p string, offset int64, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+
+	dst := s.full(p)
+	tmp := tempPath(dst)
+
+	f, err := s.openPart(tmp, offset)
+	if err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+
+	written, err := f.ReadFrom(&ctxReader{ctx: ctx, r: r})
+	if err != nil {
+		// 確かに書けたところまでに揃えて残す。
+		if safe, seekErr := f.Seek(0, io.SeekCurrent); seekErr == nil {
+			_ = f.Truncate(safe)
+		}
+		f.Close()
+		return nil, s.wrapErr("put", p, err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+
+	if !meta.ModTime.IsZero() {
+		if err := s.client.Chtimes(tmp, meta.ModTime, meta.ModTime); err != nil {
+			return nil, s.wrapErr("put", p, err)
+		}
+	}
+	if err := s.replace(tmp, dst); err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+
+	return &storage.FileInfo{
+		Path:    cleanPath(p),
+		Name:    path.Base(cleanPath(p)),
+		Size:    offset + written,
+		ModTime: meta.ModTime,
+	}, nil
+}
+
+// openPart は書きかけを offset に揃えて開きます。
+// offset が 0 なら作り直します。
+func (s *Storage) openPart(tmp string, offset int64) (*sftpc.File, error) {
+	if offset == 0 {
+		return s.createTemp(tmp)
+	}
+
+	f, err := s.client.OpenFile(tmp, os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() != offset {
+		f.Close()
+		return nil, fmt.Errorf("%w: 書きかけの大きさ %d バイトが、続きを書く位置 %d バイトと食い違います",
+			storage.ErrNotFound, info.Size(), offset)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
 // createTemp は書き込み用の一時ファイルを作ります。
 // 親ディレクトリがなければ作ってから作り直します。
 func (s *Storage) createTemp(tmp string) (*sftpc.File, error) {
@@ -404,6 +505,40 @@ func (s *Storage) SetModTime(ctx context.Context, p string, t time.Time) error {
 	return s.wrapErr("setmodtime", p, s.client.Chtimes(s.full(p), t, t))
 }
 
+// statvfsExtension は、容量を答えるための OpenSSH の拡張です。
+const statvfsExtension = "statvfs@openssh.com"
+
+// Supports は、容量を答えられるかをサーバーの拡張で判断します。
+// それ以外の能力はいつでも使えます。
+func (s *Storage) Supports(c storage.Capability) bool {
+	if c == storage.CapAbout {
+		if s.client == nil {
+			return false
+		}
+		_, ok := s.client.HasExtension(statvfsExtension)
+		return ok
+	}
+	return true
+}
+
+// About は p を含むファイルシステムの使用量を返します。
+// 空きは一般の利用者が使える分で数えます。
+func (s *Storage) About(ctx context.Context, p string) (*storage.Usage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, s.wrapErr("about", p, err)
+	}
+	st, err := s.client.StatVFS(s.full(p))
+	if err != nil {
+		return nil, s.wrapErr("about", p, err)
+	}
+	total := int64(st.TotalSpace())
+	return &storage.Usage{
+		Total: total,
+		Used:  total - int64(st.FreeSpace()),
+		Free:  int64(st.Frsize * st.Bavail),
+	}, nil
+}
+
 // --- パスとメタデータ ---
 
 // cleanPath はパスを正規化します。
@@ -460,9 +595,13 @@ func isNotExist(err error) bool {
 }
 
 var (
-	_ storage.Storage     = (*Storage)(nil)
-	_ storage.Purger      = (*Storage)(nil)
-	_ storage.Mover       = (*Storage)(nil)
-	_ storage.RangeOpener = (*Storage)(nil)
-	_ storage.SetModTimer = (*Storage)(nil)
+	_ storage.Storage            = (*Storage)(nil)
+	_ storage.Purger             = (*Storage)(nil)
+	_ storage.Mover              = (*Storage)(nil)
+	_ storage.RangeOpener        = (*Storage)(nil)
+	_ storage.Resumer            = (*Storage)(nil)
+	_ storage.SetModTimer        = (*Storage)(nil)
+	_ storage.Hasher             = (*Storage)(nil)
+	_ storage.Abouter            = (*Storage)(nil)
+	_ storage.CapabilityReporter = (*Storage)(nil)
 )
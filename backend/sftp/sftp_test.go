@@ -8,6 +8,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -459,3 +460,110 @@ func TestLargerFile(t *testing.T) {
 		t.Errorf("内容の長さ = %d, want %d", len(got), len(content))
 	}
 }
+
+// サーバーでコマンドを実行してハッシュを求められることを確かめます。
+// 名前に引用符や空白、"-" で始まるものがあっても、別の引数として
+// 解釈されてはいけません。
+func TestHashRunsRemoteCommand(t *testing.T) {
+	ctx, _, s := newTestStorage(t)
+
+	if got := s.Features().Hashes; !slices.Equal(got, storage.HashSet{storage.SHA256, storage.MD5, storage.SHA1}) {
+		t.Fatalf("Hashes = %v", got)
+	}
+
+	for _, name := range []string{"it's $(x).txt", "-n.txt", "日本語 名前.txt"} {
+		put(t, ctx, s, name, "hello world")
+		got, err := s.Hash(ctx, name, storage.SHA256)
+		if err != nil {
+			t.Errorf("Hash(%q): %v", name, err)
+			continue
+		}
+		if want := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"; got != want {
+			t.Errorf("Hash(%q) = %s, want %s", name, got, want)
+		}
+	}
+
+	if _, err := s.Hash(ctx, "無い.txt", storage.MD5); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("無いファイルのエラー = %v, want ErrNotFound", err)
+	}
+	if err := s.Mkdir(ctx, "dir"); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if _, err := s.Hash(ctx, "dir", storage.MD5); !errors.Is(err, storage.ErrIsDir) {
+		t.Errorf("ディレクトリのエラー = %v, want ErrIsDir", err)
+	}
+}
+
+// コマンドを実行できないサーバーや、無効にした場合は、
+// ハッシュを申告せず、接続はそのまま使えることを確かめます。
+func TestHashUnavailable(t *testing.T) {
+	t.Run("実行を断るシェル", func(t *testing.T) {
+		srv := startFakeServer(t, t.TempDir())
+		srv.mu.Lock()
+		srv.noExec = true
+		srv.mu.Unlock()
+		s, _ := srv.connect(t)
+
+		if got := s.Features().Hashes; len(got) != 0 {
+			t.Errorf("Hashes = %v, want 空", got)
+		}
+		put(t, context.Background(), s, "a.txt", "a")
+		if _, err := s.Hash(context.Background(), "a.txt", storage.SHA256); !errors.Is(err, storage.ErrUnsupported) {
+			t.Errorf("Hash のエラー = %v, want ErrUnsupported", err)
+		}
+	})
+
+	t.Run("disable_hashcheck", func(t *testing.T) {
+		srv := startFakeServer(t, t.TempDir())
+		s, _ := srv.connect(t, func(c *Config) { c.DisableHashCheck = true })
+
+		if got := s.Features().Hashes; len(got) != 0 {
+			t.Errorf("Hashes = %v, want 空", got)
+		}
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		if len(srv.execs) != 0 {
+			t.Errorf("無効にしたのにコマンドを実行した: %v", srv.execs)
+		}
+	})
+}
+
+func TestParseHashOutput(t *testing.T) {
+	const sum = "5eb63bbbe01eeed093cb22bb8f5acdc3"
+	tests := []struct {
+		out  string
+		want string
+		ok   bool
+	}{
+		{sum + "  a.txt\n", sum, true},
+		{sum + "  -\n", sum, true},
+		// 名前に "\" を含むと、coreutils は頭に "\" を付ける。
+		{`\` + sum + `  a\\b.txt` + "\n", sum, true},
+		{strings.ToUpper(sum) + "  a.txt\n", sum, true},
+		{"", "", false},
+		{"md5sum: a.txt: No such file or directory\n", "", false},
+		{sum[:30] + "  a.txt\n", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := parseHashOutput([]byte(tt.out), storage.MD5)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseHashOutput(%q) = %q, %v, want %q, %v", tt.out, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// statvfs 拡張のあるサーバーでは、容量を答えられることを確かめます。
+func TestAbout(t *testing.T) {
+	ctx, _, s := newTestStorage(t)
+
+	if !storage.Supports(s, storage.CapAbout) {
+		t.Skip("このサーバーは statvfs 拡張に対応していません")
+	}
+	u, err := storage.About(ctx, s, ".")
+	if err != nil {
+		t.Fatalf("About: %v", err)
+	}
+	if u.Total <= 0 || u.Free < 0 || u.Free > u.Total || u.Used < 0 {
+		t.Errorf("About = %+v", u)
+	}
+}
@@ -104,6 +104,17 @@ func (l *localFS) Open(name string) (file, error) {
 	return f, nil
 }
 
+func (l *localFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	if err := l.check("openfile"); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(l.abs(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
 func (l *localFS) Stat(name string) (os.FileInfo, error) {
 	if err := l.check("stat"); err != nil {
 		return nil, err
@@ -169,6 +180,18 @@ func (l *localFS) Chtimes(name string, atime, mtime time.Time) error {
 	return os.Chtimes(l.abs(name), atime, mtime)
 }
 
+// Statfs は決まった大きさを答えます。この計算機の空きを調べる手段は
+// OS ごとに違うので、共有の大きさを答えられることだけを試します。
+func (l *localFS) Statfs(name string) (total, free uint64, err error) {
+	if err := l.check("statfs"); err != nil {
+		return 0, 0, err
+	}
+	if _, err := os.Stat(l.abs(name)); err != nil {
+		return 0, 0, err
+	}
+	return 1 << 30, 1 << 28, nil
+}
+
 func (l *localFS) Close() error { return nil }
 
 // newTestStorage は試験用のストレージを作ります。
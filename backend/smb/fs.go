@@ -29,12 +29,16 @@ type fileSystem interface {
 
 	Create(name string) (file, error)
 	Open(name string) (file, error)
+	// OpenFile は書きかけの続きを書くために、フラグを指定して開きます。
+	OpenFile(name string, flag int, perm os.FileMode) (file, error)
 	Stat(name string) (os.FileInfo, error)
 	ReadDir(name string) ([]os.FileInfo, error)
 	Mkdir(name string, perm os.FileMode) error
 	Remove(name string) error
 	Rename(oldpath, newpath string) error
 	Chtimes(name string, atime, mtime time.Time) error
+	// Statfs は name を含む共有の大きさと、利用者が使える空きをバイトで返します。
+	Statfs(name string) (total, free uint64, err error)
 	Close() error
 }
 
@@ -70,6 +74,14 @@ func (s smbShare) Open(name string) (file, error) {
 	return f, nil
 }
 
+func (s smbShare) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	f, err := s.share.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
 func (s smbShare) Stat(name string) (os.FileInfo, error) { return s.share.Stat(name) }
 
 func (s smbShare) ReadDir(name string) ([]os.FileInfo, error) { return s.share.ReadDir(name) }
@@ -84,4 +96,12 @@ func (s smbShare) Chtimes(name string, atime, mtime time.Time) error {
 	return s.share.Chtimes(name, atime, mtime)
 }
 
+func (s smbShare) Statfs(name string) (total, free uint64, err error) {
+	info, err := s.share.Statfs(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.BlockSize() * info.TotalBlockCount(), info.BlockSize() * info.AvailableBlockCount(), nil
+}
+
 func (s smbShare) Close() error { return s.share.Umount() }
@@ -282,6 +282,92 @@ func (s *Storage) Put(ctx context.Context, p string, r io.Reader, meta storage.O
 	}, nil
 }
 
+// Partial は書きかけのメタデータを返します。
+func (s *Storage) Partial(ctx context.Context, p string) (*storage.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, s.wrapErr("partial", p, err)
+	}
+
+	info, err := s.with(ctx).Stat(tempPath(s.full(p)))
+	if err != nil {
+		return nil, s.wrapErr("partial", p, err)
+	}
+	if info.IsDir() {
+		return nil, s.wrapErr("partial", p, storage.ErrIsDir)
+	}
+	fi := toFileInfo(info, path.Dir(cleanPath(p)))
+	return &fi, nil
+}
+
+// PutResume は書きかけの続きから書き込み、書き終えたら本来の場所へ移します。
+//
+// 失敗しても書きかけは消しません。書き込みは先頭から順に進むので、
+// 書きかけの大きさがそのまま確かに書けたところです。
+func (s *Storage) PutResume(ctx context.Context, p string, offset int64, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+
+	fs := s.with(ctx)
+	dst := s.full(p)
+	tmp := tempPath(dst)
+
+	f, err := s.openPart(fs, tmp, offset)
+	if err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+
+	written, err := writeAndClose(ctx, f, r)
+	if err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+
+	if !meta.ModTime.IsZero() {
+		if err := fs.Chtimes(tmp, meta.ModTime, meta.ModTime); err != nil {
+			return nil, s.wrapErr("put", p, err)
+		}
+	}
+	if err := s.replace(fs, tmp, dst); err != nil {
+		return nil, s.wrapErr("put", p, err)
+	}
+
+	cp := cleanPath(p)
+	return &storage.FileInfo{
+		Path:    cp,
+		Name:    path.Base(cp),
+		Size:    offset + written,
+		ModTime: meta.ModTime,
+	}, nil
+}
+
+// openPart は書きかけを offset に揃えて開きます。
+// offset が 0 なら作り直します。
+func (s *Storage) openPart(fs fileSystem, tmp string, offset int64) (file, error) {
+	if offset == 0 {
+		return s.createTemp(fs, tmp)
+	}
+
+	f, err := fs.OpenFile(tmp, os.O_WRONLY, filePerm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() != offset {
+		f.Close()
+		return nil, fmt.Errorf("%w: 書きかけの大きさ %d バイトが、続きを書く位置 %d バイトと食い違います",
+			storage.ErrNotFound, info.Size(), offset)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
 // createTemp は書き込み用の一時ファイルを作ります。
 // 親ディレクトリがなければ作ってから作り直します。
 func (s *Storage) createTemp(fs fileSystem, tmp string) (file, error) {
@@ -464,6 +550,26 @@ func (s *Storage) SetModTime(ctx context.Context, p string, t time.Time) error {
 	return s.wrapErr("setmodtime", p, s.with(ctx).Chtimes(s.full(p), t, t))
 }
 
+// About は共有の大きさと空きを返します。
+//
+// SMB が答える空きは、クォータがあればその利用者が使える分です。
+// 使用量は共有全体の大きさから空きを引いて求めるので、他の利用者の
+// 分も含みます。
+func (s *Storage) About(ctx context.Context, p string) (*storage.Usage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, s.wrapErr("about", p, err)
+	}
+	total, free, err := s.with(ctx).Statfs(s.full(p))
+	if err != nil {
+		return nil, s.wrapErr("about", p, err)
+	}
+	return &storage.Usage{
+		Total: int64(total),
+		Used:  int64(total - free),
+		Free:  int64(free),
+	}, nil
+}
+
 // toFileInfo は os.FileInfo を storage.FileInfo にします。
 func toFileInfo(info os.FileInfo, dir string) storage.FileInfo {
 	fi := storage.FileInfo{
@@ -484,5 +590,7 @@ var (
 	_ storage.Purger      = (*Storage)(nil)
 	_ storage.Mover       = (*Storage)(nil)
 	_ storage.RangeOpener = (*Storage)(nil)
+	_ storage.Resumer     = (*Storage)(nil)
 	_ storage.SetModTimer = (*Storage)(nil)
+	_ storage.Abouter     = (*Storage)(nil)
 )
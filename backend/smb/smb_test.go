@@ -196,6 +196,22 @@ func TestModTimeRoundTrip(t *testing.T) {
 	}
 }
 
+// 共有の大きさと空きから、使用量を求めることを確かめます。
+func TestAbout(t *testing.T) {
+	ctx, _, s := newTestStorage(t)
+
+	u, err := storage.About(ctx, s, "/")
+	if err != nil {
+		t.Fatalf("About: %v", err)
+	}
+	if want := (storage.Usage{Total: 1 << 30, Used: 1<<30 - 1<<28, Free: 1 << 28}); *u != want {
+		t.Errorf("About = %+v, want %+v", *u, want)
+	}
+	if _, err := storage.About(ctx, s, "/無い"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("無いパスのエラー = %v, want ErrNotFound", err)
+	}
+}
+
 // 相手が使用中のときは、待って試し直す対象になることを確かめます。
 func TestSharingViolationIsRetryable(t *testing.T) {
 	ctx, fs, s := newTestStorage(t)
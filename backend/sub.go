@@ -0,0 +1,243 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// subStorage は、他のストレージのディレクトリ1つを起点として見せます。
+//
+// 外から見えるパスは起点からの相対で、"/" が起点です。
+// 下のストレージが持つ能力はそのまま通します。
+type subStorage struct {
+	inner storage.Storage
+	// root は下のストレージでの起点です。
+	root string
+}
+
+// Sub は s の root を起点として見せるストレージを返します。
+// root が空や "/" なら s をそのまま返します。
+//
+// 閉じても s は閉じません。
+func Sub(s storage.Storage, root string) storage.Storage {
+	root = cleanRoot(s, root)
+	if root == "/" {
+		return s
+	}
+	return &subStorage{inner: s, root: root}
+}
+
+func cleanRoot(s storage.Storage, root string) string {
+	if root == "" {
+		return "/"
+	}
+	if f := s.Features(); f != nil && f.OSPath {
+		// ローカルは "/" 区切りにそろえたパスを返すので、それに合わせる。
+		return path.Clean(strings.ReplaceAll(root, `\`, "/"))
+	}
+	return storage.CleanPath(root)
+}
+
+// Type は下のストレージの種別を返します。
+func (s *subStorage) Type() string { return s.inner.Type() }
+
+// Name は "名前:起点" を返します。
+//
+// 起点の違うもの同士を同じストレージと見なすと、サーバー側コピーで
+// 起点の違うパスを渡してしまうので、名前を分けます。
+func (s *subStorage) Name() string { return s.inner.Name() + ":" + s.root }
+
+// Features は下のストレージにできることを返します。
+// パスは起点からの相対になるので、OS のパス規則には従いません。
+func (s *subStorage) Features() *storage.Features {
+	f := *s.inner.Features()
+	f.OSPath = false
+	return &f
+}
+
+// Supports は下のストレージが持つ能力だけを使えると答えます。
+func (s *subStorage) Supports(c storage.Capability) bool {
+	return storage.Supports(s.inner, c)
+}
+
+// Close は何もしません。下のストレージは Resolver が閉じます。
+func (s *subStorage) Close() error { return nil }
+
+// Permit は下のストレージで op が許されているかを返します。
+func (s *subStorage) Permit(op string) error { return storage.Permit(s.inner, op) }
+
+// full は下のストレージでのパスを返します。
+func (s *subStorage) full(p string) string {
+	return path.Join(s.root, storage.CleanPath(p))
+}
+
+// rel は下のストレージでのパスを、起点からの相対に直します。
+func (s *subStorage) rel(p string) string {
+	p = path.Clean(p)
+	if p == s.root {
+		return "/"
+	}
+	prefix := s.root
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if f := s.inner.Features(); f != nil && f.CaseInsensitive && len(p) >= len(prefix) &&
+		strings.EqualFold(p[:len(prefix)], prefix) {
+		return "/" + p[len(prefix):]
+	}
+	return "/" + strings.TrimPrefix(p, prefix)
+}
+
+func (s *subStorage) info(fi *storage.FileInfo) *storage.FileInfo {
+	if fi == nil {
+		return nil
+	}
+	out := *fi
+	out.Path = s.rel(fi.Path)
+	if out.Path == "/" {
+		out.Name = "/"
+	}
+	return &out
+}
+
+func (s *subStorage) List(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	return s.inner.List(ctx, s.full(dir), func(fi storage.FileInfo) error {
+		return fn(*s.info(&fi))
+	})
+}
+
+func (s *subStorage) Stat(ctx context.Context, p string) (*storage.FileInfo, error) {
+	fi, err := s.inner.Stat(ctx, s.full(p))
+	if err != nil {
+		return nil, err
+	}
+	return s.info(fi), nil
+}
+
+func (s *subStorage) Open(ctx context.Context, p string) (io.ReadCloser, *storage.FileInfo, error) {
+	rc, fi, err := s.inner.Open(ctx, s.full(p))
+	if err != nil {
+		return nil, nil, err
+	}
+	return rc, s.info(fi), nil
+}
+
+func (s *subStorage) Put(ctx context.Context, p string, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	fi, err := s.inner.Put(ctx, s.full(p), r, meta)
+	if err != nil {
+		return nil, err
+	}
+	return s.info(fi), nil
+}
+
+func (s *subStorage) Mkdir(ctx context.Context, dir string) error {
+	return s.inner.Mkdir(ctx, s.full(dir))
+}
+
+func (s *subStorage) Remove(ctx context.Context, p string) error {
+	return s.inner.Remove(ctx, s.full(p))
+}
+
+// --- 下のストレージが持っていれば使える能力 ---
+
+func (s *subStorage) Hash(ctx context.Context, p string, ht storage.HashType) (string, error) {
+	return storage.GetHash(ctx, s.inner, &storage.FileInfo{Path: s.full(p)}, ht)
+}
+
+func (s *subStorage) ServerSideCopy(ctx context.Context, srcPath, dstPath string) (*storage.FileInfo, error) {
+	fi, err := storage.ServerSideCopy(ctx, s.inner, s.inner, s.full(srcPath), s.full(dstPath))
+	if err != nil {
+		return nil, err
+	}
+	return s.info(fi), nil
+}
+
+func (s *subStorage) Move(ctx context.Context, srcPath, dstPath string) error {
+	return storage.Move(ctx, s.inner, s.full(srcPath), s.full(dstPath))
+}
+
+func (s *subStorage) OpenRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	return storage.OpenRange(ctx, s.inner, s.full(p), offset, length)
+}
+
+func (s *subStorage) Purge(ctx context.Context, dir string) error {
+	return storage.PurgeAll(ctx, s.inner, s.full(dir))
+}
+
+func (s *subStorage) SetModTime(ctx context.Context, p string, t time.Time) error {
+	return storage.SetModTime(ctx, s.inner, s.full(p), t)
+}
+
+func (s *subStorage) Partial(ctx context.Context, p string) (*storage.FileInfo, error) {
+	fi, err := storage.PartialOf(ctx, s.inner, s.full(p))
+	if err != nil {
+		return nil, err
+	}
+	return s.info(fi), nil
+}
+
+func (s *subStorage) PutResume(ctx context.Context, p string, offset int64, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	fi, err := storage.PutResume(ctx, s.inner, s.full(p), offset, r, meta)
+	if err != nil {
+		return nil, err
+	}
+	return s.info(fi), nil
+}
+
+func (s *subStorage) OpenWriterAt(ctx context.Context, p string, size int64) (storage.PartWriter, error) {
+	w, err := storage.OpenWriterAt(ctx, s.inner, s.full(p), size)
+	if err != nil {
+		return nil, err
+	}
+	return &subPartWriter{PartWriter: w, sub: s}, nil
+}
+
+func (s *subStorage) ListRecursive(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	return storage.ListRecursive(ctx, s.inner, s.full(dir), func(fi storage.FileInfo) error {
+		return fn(*s.info(&fi))
+	})
+}
+
+func (s *subStorage) About(ctx context.Context, p string) (*storage.Usage, error) {
+	return storage.About(ctx, s.inner, s.full(p))
+}
+
+func (s *subStorage) Verify(ctx context.Context, p string, plain io.Reader) error {
+	return storage.Verify(ctx, s.inner, s.full(p), plain)
+}
+
+// subPartWriter は書き終えたときのパスを起点からの相対に直します。
+type subPartWriter struct {
+	storage.PartWriter
+	sub *subStorage
+}
+
+func (w *subPartWriter) Commit(ctx context.Context, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	fi, err := w.PartWriter.Commit(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+	return w.sub.info(fi), nil
+}
+
+var (
+	_ storage.Storage            = (*subStorage)(nil)
+	_ storage.CapabilityReporter = (*subStorage)(nil)
+	_ storage.Permitter          = (*subStorage)(nil)
+	_ storage.Hasher             = (*subStorage)(nil)
+	_ storage.ServerSideCopier   = (*subStorage)(nil)
+	_ storage.Mover              = (*subStorage)(nil)
+	_ storage.RangeOpener        = (*subStorage)(nil)
+	_ storage.Purger             = (*subStorage)(nil)
+	_ storage.SetModTimer        = (*subStorage)(nil)
+	_ storage.Resumer            = (*subStorage)(nil)
+	_ storage.OffsetWriter       = (*subStorage)(nil)
+	_ storage.RecursiveLister    = (*subStorage)(nil)
+	_ storage.Abouter            = (*subStorage)(nil)
+	_ storage.Verifier           = (*subStorage)(nil)
+)
@@ -0,0 +1,51 @@
+package union
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/storage"
+)
+
+// readOnlySuffix を upstreams の1つに付けると、読むだけのメンバーになります。
+const readOnlySuffix = ":ro"
+
+func init() {
+	backend.Register(backend.Descriptor{
+		Type:    Type,
+		Summary: "複数のストレージを束ねて1つに見せる",
+		ConfigDoc: `  # - name: pool
+  #   type: union
+  #   upstreams: disk1:/pool disk2:/pool old:/archive:ro  # 束ねるもの（ストレージ名:パス）を空白で区切る。:ro を付けると読むだけ。空白を含むパスは YAML の並びで1つずつ書く
+  #   create_policy: mfs  # 省略可。新しく置く先。ff（先のもの）・mfs（空きの多いもの）・rr（順番）
+  #   search_policy: ff  # 省略可。同じ名前があるとき見せるもの。ff（先のもの）・newest（新しいもの）
+`,
+		New: func(ctx context.Context, name string, params backend.Params) (storage.Storage, error) {
+			specs := params.List("upstreams")
+			if len(specs) == 0 {
+				return nil, fmt.Errorf("union %s: upstreams が設定されていません", name)
+			}
+
+			members := make([]Member, 0, len(specs))
+			for _, spec := range specs {
+				remote, readOnly := strings.CutSuffix(spec, readOnlySuffix)
+				s, err := backend.Remote(ctx, remote)
+				if err != nil {
+					return nil, fmt.Errorf("union %s: %w", name, err)
+				}
+				members = append(members, Member{Storage: s, ReadOnly: readOnly})
+			}
+
+			s, err := New(name, members, Config{
+				Create: Policy(params.Get("create_policy")),
+				Search: Policy(params.Get("search_policy")),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("union %s: %w", name, err)
+			}
+			return s, nil
+		},
+	})
+}
@@ -0,0 +1,645 @@
+// Package union は、設定にある複数のストレージを束ねて1つに見せる
+// ストレージです。
+//
+// 容量の足りない置き場所をいくつか並べて1つの送り先にしたり、
+// 読むだけの古い置き場所を新しい置き場所の下に重ねたりするのに使います。
+// 一覧は全員の分を合わせて返し、同じ名前があれば探し方の方針で1つを選びます。
+// 新しく置くものは、作り方の方針で選んだ1つのメンバーに置きます。
+// すでにあるものを上書きするときは、見えているものを持っているメンバーに
+// 書きます。別のメンバーに書くと、古いほうが見え続けることがあるためです。
+//
+// メンバーの間でファイルを動かすことはしません。移動や削除は、
+// そのパスを持っているメンバーの中だけで行います。
+package union
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// Type はこのバックエンドの種別名です。
+const Type = "union"
+
+// Policy は、複数のメンバーから1つを選ぶ方針です。
+type Policy string
+
+// 選ぶ方針。
+const (
+	// FirstFound は並びの先にあるメンバーを選びます。
+	FirstFound Policy = "ff"
+	// MostFreeSpace は空きの最も多いメンバーを選びます。作るときだけ使えます。
+	// 空きの分からないメンバーは後回しにします。
+	MostFreeSpace Policy = "mfs"
+	// RoundRobin はメンバーを順番に選びます。作るときだけ使えます。
+	RoundRobin Policy = "rr"
+	// Newest は更新時刻の最も新しいものを選びます。探すときだけ使えます。
+	Newest Policy = "newest"
+)
+
+// Member は束ねるストレージ1つです。
+type Member struct {
+	Storage storage.Storage
+	// ReadOnly なら読むだけにして、書き込み・削除・移動の先にしません。
+	ReadOnly bool
+}
+
+// Config は union の設定です。
+type Config struct {
+	// Create は新しく置くもののメンバーを選ぶ方針です。空なら FirstFound です。
+	Create Policy
+	// Search は同じパスを複数のメンバーが持っているときに、どれを見せるかの
+	// 方針です。空なら FirstFound です。
+	Search Policy
+}
+
+// Storage は複数のストレージを束ねます。
+type Storage struct {
+	name     string
+	members  []Member
+	create   Policy
+	search   Policy
+	features *storage.Features
+
+	// next は RoundRobin で次に選ぶ番号です。
+	next atomic.Uint64
+}
+
+// New は members を束ねる union を作ります。並びの先にあるものほど優先します。
+//
+// メンバーは閉じません。閉じるのはメンバーを組み立てた側です。
+func New(name string, members []Member, cfg Config) (*Storage, error) {
+	if len(members) == 0 {
+		return nil, errors.New("束ねるストレージがありません")
+	}
+	create, search := cfg.Create, cfg.Search
+	if create == "" {
+		create = FirstFound
+	}
+	if search == "" {
+		search = FirstFound
+	}
+	switch create {
+	case FirstFound, MostFreeSpace, RoundRobin:
+	default:
+		return nil, fmt.Errorf("作り方の方針には ff・mfs・rr のどれかを指定してください（%q が指定されました）", create)
+	}
+	switch search {
+	case FirstFound, Newest:
+	default:
+		return nil, fmt.Errorf("探し方の方針には ff・newest のどちらかを指定してください（%q が指定されました）", search)
+	}
+	return &Storage{
+		name:     name,
+		members:  slices.Clone(members),
+		create:   create,
+		search:   search,
+		features: features(members),
+	}, nil
+}
+
+// features は、どのメンバーに当たっても守れることだけを申告します。
+//
+// 親ディレクトリは書く前に自分で作るので、ImplicitDirs はいつでも真です。
+// 1ファイルの上限は、書けるメンバーのうち最も大きく置けるものに合わせます。
+// 大きなファイルは、置けるメンバーを選んで書くためです。
+func features(members []Member) *storage.Features {
+	f := &storage.Features{
+		CanSetModTime: true,
+		ImplicitDirs:  true,
+		EmptyDirs:     true,
+		AtomicPut:     true,
+	}
+	var illegal strings.Builder
+	unlimited := false
+	for i, m := range members {
+		in := m.Storage.Features()
+		f.ModTimePrecision = max(f.ModTimePrecision, in.ModTimePrecision)
+		f.CaseInsensitive = f.CaseInsensitive || in.CaseInsensitive
+		f.EmptyDirs = f.EmptyDirs && in.EmptyDirs
+		if i == 0 {
+			f.Hashes = slices.Clone(in.Hashes)
+		} else {
+			f.Hashes = slices.DeleteFunc(f.Hashes, func(ht storage.HashType) bool { return !in.Hashes.Has(ht) })
+		}
+		for _, c := range in.IllegalChars {
+			if !strings.ContainsRune(illegal.String(), c) {
+				illegal.WriteRune(c)
+			}
+		}
+		if m.ReadOnly {
+			continue
+		}
+		f.CanSetModTime = f.CanSetModTime && in.CanSetModTime
+		f.AtomicPut = f.AtomicPut && in.AtomicPut
+		if in.MaxFileSize == 0 {
+			unlimited = true
+		}
+		f.MaxFileSize = max(f.MaxFileSize, in.MaxFileSize)
+	}
+	if unlimited {
+		f.MaxFileSize = 0
+	}
+	f.IllegalChars = illegal.String()
+	return f
+}
+
+// Type はストレージの種別を返します。
+func (s *Storage) Type() string { return Type }
+
+// Name は設定ファイルで付けた名前を返します。
+func (s *Storage) Name() string { return s.name }
+
+// Features はこのストレージにできることを返します。
+func (s *Storage) Features() *storage.Features {
+	f := *s.features
+	return &f
+}
+
+// Supports は、どのメンバーに当たっても使える能力だけを使えると答えます。
+//
+// 移動と削除は、メンバーにできなくてもヘルパが肩代わりするので使えます。
+// 容量は、答えられるメンバーが1つでもあればその分を答えます。
+func (s *Storage) Supports(c storage.Capability) bool {
+	switch c {
+	case storage.CapMove, storage.CapPurge:
+		return true
+	case storage.CapHash, storage.CapRangeOpen:
+		return s.all(c, false)
+	case storage.CapSetModTime:
+		return s.all(c, true)
+	case storage.CapAbout:
+		return slices.ContainsFunc(s.members, func(m Member) bool { return storage.Supports(m.Storage, c) })
+	}
+	return false
+}
+
+// all は、メンバーの全員が c を使えるかを返します。
+// writable が真なら、書けるメンバーだけを見ます。
+func (s *Storage) all(c storage.Capability, writable bool) bool {
+	for _, m := range s.members {
+		if writable && m.ReadOnly {
+			continue
+		}
+		if !storage.Supports(m.Storage, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Close は何もしません。メンバーは組み立てた側が閉じます。
+func (s *Storage) Close() error { return nil }
+
+// Permit は、書けるメンバーのどれかで op が許されていれば許します。
+//
+// どのメンバーで行うかはパスや空きで決まるので、ここではどれにも
+// できないと分かるときだけ断ります。
+func (s *Storage) Permit(op string) error {
+	var denied error
+	for _, m := range s.members {
+		if m.ReadOnly {
+			continue
+		}
+		err := storage.Permit(m.Storage, op)
+		if err == nil {
+			return nil
+		}
+		if denied == nil {
+			denied = err
+		}
+	}
+	if denied == nil {
+		denied = storage.Wrap(op, s.name, "", storage.ClassPermanent,
+			fmt.Errorf("%w: すべてのメンバーが読むだけです", storage.ErrReadOnly))
+	}
+	return denied
+}
+
+func (s *Storage) wrapErr(op, p string, err error) error {
+	return storage.Wrap(op, s.name, p, storage.ClassOf(err), err)
+}
+
+func (s *Storage) notFound(op, p string) error {
+	return storage.Wrap(op, s.name, p, storage.ClassPermanent, fmt.Errorf("%w: %s", storage.ErrNotFound, p))
+}
+
+func (s *Storage) readOnly(op, p string, m Member) error {
+	return storage.Wrap(op, s.name, p, storage.ClassPermanent,
+		fmt.Errorf("%w: %s は %s にあります", storage.ErrReadOnly, p, m.Storage.Name()))
+}
+
+// --- メンバーを選ぶ ---
+
+// holder は、あるパスを持っているメンバーです。
+type holder struct {
+	Member
+	// index はメンバーの並びでの位置です。
+	index int
+	info  *storage.FileInfo
+}
+
+// holders は p を持っているメンバーを並びの順に返します。
+// 問い合わせは全員に同時に出します。
+func (s *Storage) holders(ctx context.Context, p string) ([]holder, error) {
+	infos := make([]*storage.FileInfo, len(s.members))
+	g, gctx := errgroup.WithContext(ctx)
+	for i, m := range s.members {
+		g.Go(func() error {
+			fi, err := m.Storage.Stat(gctx, p)
+			if storage.IsNotFound(err) {
+				return nil
+			}
+			infos[i] = fi
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	var found []holder
+	for i, fi := range infos {
+		if fi != nil {
+			found = append(found, holder{Member: s.members[i], index: i, info: fi})
+		}
+	}
+	return found, nil
+}
+
+// lookup は p について見せるものを、探し方の方針で選びます。
+func (s *Storage) lookup(ctx context.Context, op, p string) (holder, []holder, error) {
+	found, err := s.holders(ctx, p)
+	if err != nil {
+		return holder{}, nil, s.wrapErr(op, p, err)
+	}
+	if len(found) == 0 {
+		return holder{}, nil, s.notFound(op, p)
+	}
+	pick := found[0]
+	for _, h := range found[1:] {
+		if s.prefer(h.info, pick.info) {
+			pick = h
+		}
+	}
+	return pick, found, nil
+}
+
+// prefer は、a を b より優先して見せるかを返します。
+// ディレクトリは中身を合わせて見せるので、どれを選んでも同じです。
+func (s *Storage) prefer(a, b *storage.FileInfo) bool {
+	return s.search == Newest && !a.IsDir && !b.IsDir && a.ModTime.After(b.ModTime)
+}
+
+// writable は、変更する前に、p を持っているメンバーがすべて書けることを確かめます。
+// 読むだけのメンバーに残ると、変更が見えないままになるためです。
+func (s *Storage) writable(op, p string, found []holder) error {
+	for _, h := range found {
+		if h.ReadOnly {
+			return s.readOnly(op, p, h.Member)
+		}
+	}
+	return nil
+}
+
+// createTarget は、新しく置くもののメンバーを作り方の方針で選びます。
+// size が分かっていれば、1ファイルの上限に収まるメンバーだけから選びます。
+func (s *Storage) createTarget(ctx context.Context, op, p string, size int64) (Member, error) {
+	var candidates []Member
+	for _, m := range s.members {
+		if m.ReadOnly {
+			continue
+		}
+		if limit := m.Storage.Features().MaxFileSize; limit > 0 && size > limit {
+			continue
+		}
+		candidates = append(candidates, m)
+	}
+	if len(candidates) == 0 {
+		return Member{}, storage.Wrap(op, s.name, p, storage.ClassPermanent,
+			fmt.Errorf("%w: 置けるメンバーがありません", storage.ErrReadOnly))
+	}
+
+	switch s.create {
+	case RoundRobin:
+		return candidates[(s.next.Add(1)-1)%uint64(len(candidates))], nil
+	case MostFreeSpace:
+		best, bestFree := candidates[0], storage.SizeUnknown
+		for _, m := range candidates {
+			// 答えられないメンバーや、問い合わせに失敗したメンバーは後回しにする。
+			u, err := storage.About(ctx, m.Storage, "/")
+			if err != nil || u.Free == storage.SizeUnknown {
+				continue
+			}
+			if u.Free > bestFree {
+				best, bestFree = m, u.Free
+			}
+		}
+		return best, nil
+	}
+	return candidates[0], nil
+}
+
+// --- 基本の操作 ---
+
+// List は、メンバー全員の dir の中身を合わせて返します。
+//
+// 同じ名前を複数のメンバーが持っていれば、探し方の方針で1つを選びます。
+// どのメンバーも dir を持っていなければ ErrNotFound です。
+func (s *Storage) List(ctx context.Context, dir string, fn func(storage.FileInfo) error) error {
+	dir = storage.CleanPath(dir)
+	lists := make([][]storage.FileInfo, len(s.members))
+	exists := make([]bool, len(s.members))
+	g, gctx := errgroup.WithContext(ctx)
+	for i, m := range s.members {
+		g.Go(func() error {
+			err := m.Storage.List(gctx, dir, func(fi storage.FileInfo) error {
+				lists[i] = append(lists[i], fi)
+				return nil
+			})
+			if storage.IsNotFound(err) {
+				return nil
+			}
+			exists[i] = err == nil
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return s.wrapErr("list", dir, err)
+	}
+	if !slices.Contains(exists, true) {
+		return s.notFound("list", dir)
+	}
+
+	var names []string
+	picked := map[string]storage.FileInfo{}
+	for _, list := range lists {
+		for _, fi := range list {
+			prev, ok := picked[fi.Name]
+			if !ok {
+				names = append(names, fi.Name)
+			}
+			if !ok || s.prefer(&fi, &prev) {
+				picked[fi.Name] = fi
+			}
+		}
+	}
+	for _, name := range names {
+		if err := fn(picked[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stat は、探し方の方針で選んだメンバーのものを返します。
+func (s *Storage) Stat(ctx context.Context, p string) (*storage.FileInfo, error) {
+	h, _, err := s.lookup(ctx, "stat", storage.CleanPath(p))
+	if err != nil {
+		return nil, err
+	}
+	return h.info, nil
+}
+
+// Open は、探し方の方針で選んだメンバーから読みます。
+func (s *Storage) Open(ctx context.Context, p string) (io.ReadCloser, *storage.FileInfo, error) {
+	h, _, err := s.lookup(ctx, "open", storage.CleanPath(p))
+	if err != nil {
+		return nil, nil, err
+	}
+	return h.Storage.Open(ctx, p)
+}
+
+// Put は、p が見えていればそのメンバーに上書きし、無ければ作り方の方針で
+// 選んだメンバーに置きます。
+//
+// 見えているものが読むだけのメンバーにあれば、書かずに ErrReadOnly を返します。
+func (s *Storage) Put(ctx context.Context, p string, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	p = storage.CleanPath(p)
+	var target Member
+	h, _, err := s.lookup(ctx, "put", p)
+	switch {
+	case err == nil:
+		if h.ReadOnly {
+			return nil, s.readOnly("put", p, h.Member)
+		}
+		target = h.Member
+	case storage.IsNotFound(err):
+		target, err = s.createTarget(ctx, "put", p, meta.Size)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	if !target.Storage.Features().ImplicitDirs {
+		if err := target.Storage.Mkdir(ctx, path.Dir(p)); err != nil {
+			return nil, err
+		}
+	}
+	return target.Storage.Put(ctx, p, r, meta)
+}
+
+// Mkdir は、dir が無ければ作り方の方針で選んだメンバーに作ります。
+func (s *Storage) Mkdir(ctx context.Context, dir string) error {
+	dir = storage.CleanPath(dir)
+	h, _, err := s.lookup(ctx, "mkdir", dir)
+	switch {
+	case err == nil:
+		if h.info.IsDir {
+			return nil
+		}
+		// 同じ名前のファイルがあるときの扱いは、持っているメンバーに任せる。
+		return h.Storage.Mkdir(ctx, dir)
+	case !storage.IsNotFound(err):
+		return err
+	}
+
+	target, err := s.createTarget(ctx, "mkdir", dir, storage.SizeUnknown)
+	if err != nil {
+		return err
+	}
+	return target.Storage.Mkdir(ctx, dir)
+}
+
+// Remove は、p を持っているメンバーすべてから消します。
+// 読むだけのメンバーも持っていれば、何も消さずに ErrReadOnly を返します。
+func (s *Storage) Remove(ctx context.Context, p string) error {
+	p = storage.CleanPath(p)
+	h, found, err := s.lookup(ctx, "remove", p)
+	if err != nil {
+		return err
+	}
+	if err := s.writable("remove", p, found); err != nil {
+		return err
+	}
+	if h.info.IsDir {
+		// 中身は複数のメンバーに分かれていることがある。1つのメンバーでは
+		// 空でも、合わせると空でないことがあるので、合わせたもので確かめる。
+		empty := true
+		err := s.List(ctx, p, func(storage.FileInfo) error {
+			empty = false
+			return errStop
+		})
+		if err != nil && !errors.Is(err, errStop) {
+			return err
+		}
+		if !empty {
+			return storage.Wrap("remove", s.name, p, storage.ClassPermanent, fmt.Errorf("%w: %s", storage.ErrNotEmpty, p))
+		}
+	}
+	for _, h := range found {
+		if err := h.Storage.Remove(ctx, p); err != nil && !storage.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// errStop は List を途中で打ち切るための合図です。
+var errStop = errors.New("打ち切り")
+
+// --- メンバーが持っていれば使える能力 ---
+
+// Hash は、探し方の方針で選んだメンバーにハッシュを求めさせます。
+func (s *Storage) Hash(ctx context.Context, p string, ht storage.HashType) (string, error) {
+	h, _, err := s.lookup(ctx, "hash", storage.CleanPath(p))
+	if err != nil {
+		return "", err
+	}
+	return storage.GetHash(ctx, h.Storage, h.info, ht)
+}
+
+// OpenRange は、探し方の方針で選んだメンバーから途中から読みます。
+func (s *Storage) OpenRange(ctx context.Context, p string, offset, length int64) (io.ReadCloser, error) {
+	h, _, err := s.lookup(ctx, "open", storage.CleanPath(p))
+	if err != nil {
+		return nil, err
+	}
+	return storage.OpenRange(ctx, h.Storage, p, offset, length)
+}
+
+// Move は、srcPath を持っているメンバーそれぞれの中で移動します。
+//
+// 移動先を他のメンバーも持っていれば、移したものが隠れないように
+// そちらは消します。
+func (s *Storage) Move(ctx context.Context, srcPath, dstPath string) error {
+	srcPath, dstPath = storage.CleanPath(srcPath), storage.CleanPath(dstPath)
+	_, src, err := s.lookup(ctx, "move", srcPath)
+	if err != nil {
+		return err
+	}
+	if err := s.writable("move", srcPath, src); err != nil {
+		return err
+	}
+	dst, err := s.holders(ctx, dstPath)
+	if err != nil {
+		return s.wrapErr("move", dstPath, err)
+	}
+	if err := s.writable("move", dstPath, dst); err != nil {
+		return err
+	}
+
+	for _, h := range src {
+		if err := storage.Move(ctx, h.Storage, srcPath, dstPath); err != nil {
+			return err
+		}
+	}
+	for _, h := range dst {
+		moved := slices.ContainsFunc(src, func(m holder) bool { return m.index == h.index })
+		if moved || h.info.IsDir {
+			continue
+		}
+		if err := h.Storage.Remove(ctx, dstPath); err != nil && !storage.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Purge は、dir を持っているメンバーすべてから中身ごと消します。
+func (s *Storage) Purge(ctx context.Context, dir string) error {
+	dir = storage.CleanPath(dir)
+	_, found, err := s.lookup(ctx, "purge", dir)
+	if err != nil {
+		return err
+	}
+	if err := s.writable("purge", dir, found); err != nil {
+		return err
+	}
+	for _, h := range found {
+		if err := storage.PurgeAll(ctx, h.Storage, dir); err != nil && !storage.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetModTime は、見えているものの最終更新時刻を変更します。
+func (s *Storage) SetModTime(ctx context.Context, p string, t time.Time) error {
+	p = storage.CleanPath(p)
+	h, _, err := s.lookup(ctx, "setmodtime", p)
+	if err != nil {
+		return err
+	}
+	if h.ReadOnly {
+		return s.readOnly("setmodtime", p, h.Member)
+	}
+	return storage.SetModTime(ctx, h.Storage, p, t)
+}
+
+// About は、容量を答えられるメンバーの使用量を足し合わせて返します。
+//
+// 同じボリュームにある2つのメンバーは二重に数えます。どれかのメンバーが
+// 分からない項目は、合計も SizeUnknown にします。
+func (s *Storage) About(ctx context.Context, p string) (*storage.Usage, error) {
+	sum := &storage.Usage{}
+	answered := false
+	add := func(total *int64, v int64) {
+		if *total == storage.SizeUnknown || v == storage.SizeUnknown {
+			*total = storage.SizeUnknown
+			return
+		}
+		*total += v
+	}
+	for _, m := range s.members {
+		if !storage.Supports(m.Storage, storage.CapAbout) {
+			continue
+		}
+		// メンバーの容量は、パスではなく置き場所で決まるので、起点で尋ねる。
+		u, err := storage.About(ctx, m.Storage, "/")
+		if err != nil {
+			return nil, s.wrapErr("about", p, err)
+		}
+		add(&sum.Total, u.Total)
+		add(&sum.Used, u.Used)
+		add(&sum.Free, u.Free)
+		answered = true
+	}
+	if !answered {
+		return nil, s.wrapErr("about", p, fmt.Errorf("%w: 容量の取得", storage.ErrUnsupported))
+	}
+	return sum, nil
+}
+
+var (
+	_ storage.Storage            = (*Storage)(nil)
+	_ storage.CapabilityReporter = (*Storage)(nil)
+	_ storage.Permitter          = (*Storage)(nil)
+	_ storage.Hasher             = (*Storage)(nil)
+	_ storage.RangeOpener        = (*Storage)(nil)
+	_ storage.Mover              = (*Storage)(nil)
+	_ storage.Purger             = (*Storage)(nil)
+	_ storage.SetModTimer        = (*Storage)(nil)
+	_ storage.Abouter            = (*Storage)(nil)
+)
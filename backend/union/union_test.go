@@ -0,0 +1,324 @@
+package union_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/backend/union"
+	"github.com/mt3hr/hbg/storage"
+	"github.com/mt3hr/hbg/storage/storagetest"
+)
+
+// newUnion は、メモリ2つを束ねる union を設定から組み立てます。
+func newUnion(t *testing.T, params backend.Params) (storage.Storage, *memory.Storage, *memory.Storage) {
+	t.Helper()
+	r, err := backend.NewResolver([]backend.Entry{
+		{Name: "mem1", Type: memory.Type},
+		{Name: "mem2", Type: memory.Type},
+		{Name: "pool", Type: union.Type, Params: params},
+	})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	ctx := context.Background()
+	s, err := r.Get(ctx, "pool")
+	if err != nil {
+		t.Fatalf("Get(pool): %v", err)
+	}
+	mem1, err := r.Get(ctx, "mem1")
+	if err != nil {
+		t.Fatalf("Get(mem1): %v", err)
+	}
+	mem2, err := r.Get(ctx, "mem2")
+	if err != nil {
+		t.Fatalf("Get(mem2): %v", err)
+	}
+	return s, mem1.(*memory.Storage), mem2.(*memory.Storage)
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Harness{
+		NewStorage: func(t *testing.T) (storage.Storage, string) {
+			// 順番に置けば、ディレクトリの中身が2つに分かれる場合も試せる。
+			s, _, _ := newUnion(t, backend.Params{"upstreams": "mem1:/a mem2:/b", "create_policy": "rr"})
+			return s, "/root"
+		},
+	})
+}
+
+func put(t *testing.T, s storage.Storage, p, content string, modTime time.Time) {
+	t.Helper()
+	if _, err := s.Put(context.Background(), p, strings.NewReader(content), storage.ObjectMeta{
+		Size:    int64(len(content)),
+		ModTime: modTime,
+	}); err != nil {
+		t.Fatalf("Put(%s): %v", p, err)
+	}
+}
+
+func read(t *testing.T, s storage.Storage, p string) string {
+	t.Helper()
+	rc, _, err := s.Open(context.Background(), p)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", p, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll(%s): %v", p, err)
+	}
+	return string(data)
+}
+
+// 一覧は全員の分を合わせ、同じ名前は探し方の方針で1つを選ぶことを確認します。
+func TestListMergesMembers(t *testing.T) {
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := old.Add(time.Hour)
+
+	for _, tt := range []struct {
+		search string
+		want   string
+	}{
+		{"ff", "先"},
+		{"newest", "新しい"},
+	} {
+		t.Run(tt.search, func(t *testing.T) {
+			ctx := context.Background()
+			s, mem1, mem2 := newUnion(t, backend.Params{"upstreams": "mem1:/ mem2:/", "search_policy": tt.search})
+			put(t, mem1, "/dir/a.txt", "a", old)
+			put(t, mem2, "/dir/b.txt", "b", old)
+			put(t, mem1, "/dir/same.txt", "先", old)
+			put(t, mem2, "/dir/same.txt", "新しい", newer)
+
+			entries, err := storage.ListAllSorted(ctx, s, "/dir")
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name)
+			}
+			if got := strings.Join(names, " "); got != "a.txt b.txt same.txt" {
+				t.Errorf("一覧 = %s", got)
+			}
+			if got := read(t, s, "/dir/same.txt"); got != tt.want {
+				t.Errorf("same.txt の内容 = %q, want %q", got, tt.want)
+			}
+			if got := entries[2].Size; got != int64(len(tt.want)) {
+				t.Errorf("一覧の same.txt の大きさ = %d, want %d", got, len(tt.want))
+			}
+		})
+	}
+}
+
+// 上書きは、見えているものを持っているメンバーに書くことを確認します。
+func TestOverwriteGoesToHolder(t *testing.T) {
+	ctx := context.Background()
+	s, mem1, mem2 := newUnion(t, backend.Params{"upstreams": "mem1:/ mem2:/"})
+	put(t, mem2, "/a.txt", "古い", time.Time{})
+
+	put(t, s, "/a.txt", "新しい", time.Time{})
+	if _, err := mem1.Stat(ctx, "/a.txt"); !storage.IsNotFound(err) {
+		t.Errorf("先のメンバーに書かれた: %v", err)
+	}
+	if got := read(t, mem2, "/a.txt"); got != "新しい" {
+		t.Errorf("持っていたメンバーの内容 = %q", got)
+	}
+
+	put(t, s, "/b.txt", "b", time.Time{})
+	if _, err := mem1.Stat(ctx, "/b.txt"); err != nil {
+		t.Errorf("新しいものが先のメンバーに無い: %v", err)
+	}
+}
+
+// 読むだけのメンバーは見えるが、変更の先にはならないことを確認します。
+func TestReadOnlyMember(t *testing.T) {
+	ctx := context.Background()
+	s, mem1, mem2 := newUnion(t, backend.Params{"upstreams": "mem1:/:ro mem2:/"})
+	put(t, mem1, "/old.txt", "古い", time.Time{})
+
+	if got := read(t, s, "/old.txt"); got != "古い" {
+		t.Errorf("読むだけのメンバーのものが読めない: %q", got)
+	}
+	if _, err := s.Put(ctx, "/old.txt", strings.NewReader("x"), storage.ObjectMeta{Size: 1}); !errors.Is(err, storage.ErrReadOnly) {
+		t.Errorf("上書きのエラー = %v, want ErrReadOnly", err)
+	}
+	if err := s.Remove(ctx, "/old.txt"); !errors.Is(err, storage.ErrReadOnly) {
+		t.Errorf("削除のエラー = %v, want ErrReadOnly", err)
+	}
+	if err := storage.Move(ctx, s, "/old.txt", "/moved.txt"); !errors.Is(err, storage.ErrReadOnly) {
+		t.Errorf("移動のエラー = %v, want ErrReadOnly", err)
+	}
+	if got := read(t, mem1, "/old.txt"); got != "古い" {
+		t.Errorf("読むだけのメンバーが変わった: %q", got)
+	}
+
+	put(t, s, "/new.txt", "新しい", time.Time{})
+	if _, err := mem1.Stat(ctx, "/new.txt"); !storage.IsNotFound(err) {
+		t.Errorf("読むだけのメンバーに書かれた: %v", err)
+	}
+	if got := read(t, mem2, "/new.txt"); got != "新しい" {
+		t.Errorf("書けるメンバーの内容 = %q", got)
+	}
+}
+
+// 1行に1つずつ並べれば、空白を含むパスも書けることを確認します。
+func TestUpstreamsWithSpaces(t *testing.T) {
+	s, mem1, mem2 := newUnion(t, backend.Params{"upstreams": "mem1:/My Pool:ro\n  mem2:/Other Pool  \n"})
+	put(t, mem1, "/My Pool/old.txt", "古い", time.Time{})
+
+	if got := read(t, s, "/old.txt"); got != "古い" {
+		t.Errorf("空白を含むパスのメンバーが読めない: %q", got)
+	}
+	put(t, s, "/new.txt", "新しい", time.Time{})
+	if got := read(t, mem2, "/Other Pool/new.txt"); got != "新しい" {
+		t.Errorf("書けるメンバーの内容 = %q", got)
+	}
+}
+
+// 全員が読むだけなら、新しく置けないことを確認します。
+func TestAllReadOnly(t *testing.T) {
+	s, _, _ := newUnion(t, backend.Params{"upstreams": "mem1:/:ro mem2:/:ro"})
+	_, err := s.Put(context.Background(), "/a.txt", strings.NewReader("a"), storage.ObjectMeta{Size: 1})
+	if !errors.Is(err, storage.ErrReadOnly) {
+		t.Errorf("Put のエラー = %v, want ErrReadOnly", err)
+	}
+	if err := storage.Permit(s, "put"); !errors.Is(err, storage.ErrReadOnly) {
+		t.Errorf("Permit(put) = %v, want ErrReadOnly", err)
+	}
+}
+
+// メンバーに付けた制限は、どのメンバーにも許されないときだけ始める前に断ることを確認します。
+func TestPermitFollowsMembers(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		policy backend.Policy
+		denied bool
+	}{
+		{"片方だけ read_only", backend.Policy{}, false},
+		{"両方 read_only", backend.Policy{ReadOnly: true}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := backend.NewResolver([]backend.Entry{
+				{Name: "mem1", Type: memory.Type, Policy: backend.Policy{ReadOnly: true}},
+				{Name: "mem2", Type: memory.Type, Policy: tt.policy},
+				{Name: "pool", Type: union.Type, Params: backend.Params{"upstreams": "mem1:/ mem2:/"}},
+			})
+			if err != nil {
+				t.Fatalf("NewResolver: %v", err)
+			}
+			defer r.Close()
+			s, err := r.Get(context.Background(), "pool")
+			if err != nil {
+				t.Fatalf("Get(pool): %v", err)
+			}
+
+			err = storage.Permit(s, "put")
+			if got := errors.Is(err, storage.ErrReadOnly); got != tt.denied {
+				t.Errorf("Permit(put) = %v, want 断る=%v", err, tt.denied)
+			}
+		})
+	}
+}
+
+// sized は、空きを決まった値で答えるメモリのストレージです。
+type sized struct {
+	*memory.Storage
+	free int64
+}
+
+func (s sized) About(context.Context, string) (*storage.Usage, error) {
+	return &storage.Usage{Total: 1 << 30, Used: 1<<30 - s.free, Free: s.free}, nil
+}
+
+// 作り方の方針で、新しく置くメンバーが決まることを確認します。
+func TestCreatePolicy(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		policy union.Policy
+		// want は a・b・c を置いたメンバーの番号です。
+		want [3]int
+	}{
+		{union.FirstFound, [3]int{0, 0, 0}},
+		{union.RoundRobin, [3]int{0, 1, 2}},
+		{union.MostFreeSpace, [3]int{1, 1, 1}},
+	} {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			mems := []*memory.Storage{memory.New("m0"), memory.New("m1"), memory.New("m2")}
+			s, err := union.New("pool", []union.Member{
+				{Storage: sized{mems[0], 10 << 20}},
+				{Storage: sized{mems[1], 30 << 20}},
+				// 空きの分からないメンバーは後回しになる。
+				{Storage: mems[2]},
+			}, union.Config{Create: tt.policy})
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			for i, name := range []string{"/a.txt", "/b.txt", "/c.txt"} {
+				put(t, s, name, name, time.Time{})
+				for j, m := range mems {
+					_, err := m.Stat(ctx, name)
+					if got := err == nil; got != (j == tt.want[i]) {
+						t.Errorf("%s がメンバー %d にあるか = %v", name, j, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+// 方針の名前を間違えたら、組み立てられないことを確認します。
+func TestUnknownPolicy(t *testing.T) {
+	members := []union.Member{{Storage: memory.New("m")}}
+	if _, err := union.New("pool", members, union.Config{Create: "newest"}); err == nil {
+		t.Error("作り方に newest を指定できてしまった")
+	}
+	if _, err := union.New("pool", members, union.Config{Search: "mfs"}); err == nil {
+		t.Error("探し方に mfs を指定できてしまった")
+	}
+}
+
+// 容量は、答えられるメンバーの分を足し合わせることを確認します。
+func TestAboutSumsMembers(t *testing.T) {
+	s, err := union.New("pool", []union.Member{
+		{Storage: sized{memory.New("m0"), 10}},
+		{Storage: sized{memory.New("m1"), 20}},
+		{Storage: memory.New("m2")},
+	}, union.Config{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	u, err := storage.About(context.Background(), s, "/")
+	if err != nil {
+		t.Fatalf("About: %v", err)
+	}
+	if want := (storage.Usage{Total: 2 << 30, Used: 2<<30 - 30, Free: 30}); *u != want {
+		t.Errorf("About = %+v, want %+v", *u, want)
+	}
+}
+
+// ディレクトリの中身が複数のメンバーに分かれていれば、片方が空でも消さないことを確認します。
+func TestRemoveDirSplitAcrossMembers(t *testing.T) {
+	ctx := context.Background()
+	s, mem1, mem2 := newUnion(t, backend.Params{"upstreams": "mem1:/ mem2:/"})
+	if err := mem1.Mkdir(ctx, "/dir"); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	put(t, mem2, "/dir/a.txt", "a", time.Time{})
+
+	if err := s.Remove(ctx, "/dir"); !errors.Is(err, storage.ErrNotEmpty) {
+		t.Errorf("Remove のエラー = %v, want ErrNotEmpty", err)
+	}
+	if _, err := mem1.Stat(ctx, "/dir"); err != nil {
+		t.Errorf("空だったほうのディレクトリが消えた: %v", err)
+	}
+}
@@ -15,6 +15,7 @@ require (
 	github.com/fclairamb/ftpserverlib v0.32.3
 	github.com/gobwas/glob v0.2.3
 	github.com/jlaffaye/ftp v0.2.2
+	github.com/klauspost/compress v1.18.0
 	github.com/mattn/go-runewidth v0.0.27
 	github.com/pkg/sftp v1.13.11
 	github.com/skeema/knownhosts v1.3.2
@@ -28,6 +29,7 @@ require (
 	golang.org/x/net v0.57.0
 	golang.org/x/oauth2 v0.36.0
 	golang.org/x/sync v0.22.0
+	golang.org/x/sys v0.47.0
 	golang.org/x/term v0.45.0
 	golang.org/x/time v0.15.0
 	google.golang.org/api v0.293.0
@@ -84,7 +86,6 @@ require (
 	go.opentelemetry.io/otel/metric v1.44.0 // indirect
 	go.opentelemetry.io/otel/trace v1.44.0 // indirect
 	go.yaml.in/yaml/v3 v3.0.5 // indirect
-	golang.org/x/sys v0.47.0 // indirect
 	golang.org/x/text v0.41.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20260807164820-c8921c73eeea // indirect
 	google.golang.org/grpc v1.83.0 // indirect
@@ -21,6 +21,7 @@ import (
 //   - Microsoft も「パブリッククライアント」として登録すればシークレットは不要です。
 //   - Google は installed app でもシークレットを要求するため、
 //     利用者自身の Google Cloud プロジェクトを使うことを既定とします。
+//   - Box もシークレットを要求するため、利用者自身が登録したアプリを使います。
 //
 // なお、過去に公開されてしまった鍵は失効させる以外に対処がありません。
 var (
@@ -35,6 +36,11 @@ var (
 	// MicrosoftClientID は Microsoft のアプリ（クライアント）IDです。
 	// パブリッククライアントとして登録すればシークレットは不要です。
 	MicrosoftClientID = ""
+
+	// BoxClientID は Box のアプリのクライアントIDです。
+	BoxClientID = ""
+	// BoxClientSecret は Box のアプリのクライアントシークレットです。
+	BoxClientSecret = ""
 )
 
 // 環境変数名。
@@ -43,6 +49,8 @@ const (
 	EnvGoogleClientID     = "HBG_GOOGLE_CLIENT_ID"
 	EnvGoogleClientSecret = "HBG_GOOGLE_CLIENT_SECRET"
 	EnvMicrosoftClientID  = "HBG_MICROSOFT_CLIENT_ID"
+	EnvBoxClientID        = "HBG_BOX_CLIENT_ID"
+	EnvBoxClientSecret    = "HBG_BOX_CLIENT_SECRET"
 )
 
 // ClientCredentials は OAuth クライアントの識別情報です。
@@ -64,10 +72,21 @@ func ResolveDropbox(fromConfig string) (ClientCredentials, error) {
 
 // ResolveGoogle は Google の OAuth クライアント情報を解決します。
 func ResolveGoogle(idFromConfig, secretFromConfig string) (ClientCredentials, error) {
+	return resolveGoogle("googledrive", idFromConfig, secretFromConfig)
+}
+
+// ResolveGoogleCloudStorage は Google Cloud Storage の OAuth クライアント情報を解決します。
+//
+// 探す場所は Google Drive と同じです。違うのは、見つからないときの案内だけです。
+func ResolveGoogleCloudStorage(idFromConfig, secretFromConfig string) (ClientCredentials, error) {
+	return resolveGoogle("gcs", idFromConfig, secretFromConfig)
+}
+
+func resolveGoogle(storageType, idFromConfig, secretFromConfig string) (ClientCredentials, error) {
 	id := firstNonEmpty(idFromConfig, os.Getenv(EnvGoogleClientID), GoogleClientID)
 	secret := firstNonEmpty(secretFromConfig, os.Getenv(EnvGoogleClientSecret), GoogleClientSecret)
 	if id == "" || secret == "" {
-		return ClientCredentials{}, missingCredentialsError("googledrive")
+		return ClientCredentials{}, missingCredentialsError(storageType)
 	}
 	return ClientCredentials{ClientID: id, ClientSecret: secret}, nil
 }
@@ -151,6 +170,30 @@ func setupInstructions(storageType string) string {
   分類されており、アプリを一般公開するには年次のセキュリティ評価が
   必要です。そのため hbg では利用者自身のプロジェクトを使います。`
 
+	case "gcs":
+		return `Google Cloud プロジェクトを用意してください:
+
+  1. https://console.cloud.google.com/ でプロジェクトを作成
+  2. Cloud Storage API（Google Cloud Storage JSON API）を有効化
+  3. OAuth 同意画面を設定し、公開ステータスを「本番環境」にする
+     ※「テスト」のままだとリフレッシュトークンが7日で失効します
+  4. 認証情報 > OAuth クライアント ID を作成
+     - アプリケーションの種類: デスクトップアプリ
+  5. 発行されたIDとシークレットを設定ファイルに書く
+
+       storages:
+         - name: gcs
+           type: gcs
+           bucket: 入れ物の名前
+           client_id: ${HBG_GOOGLE_CLIENT_ID}
+           client_secret: ${HBG_GOOGLE_CLIENT_SECRET}
+
+     または環境変数 HBG_GOOGLE_CLIENT_ID / HBG_GOOGLE_CLIENT_SECRET に設定する。
+
+  サーバーで動かすなど、ブラウザで認可できない場合は、OAuth のかわりに
+  サービスアカウントの鍵（service_account_file）を指定してください。
+  その場合 hbg auth login は要りません。`
+
 	case "onedrive":
 		return `Microsoft のアプリを登録してください:
 
@@ -174,6 +217,29 @@ func setupInstructions(storageType string) string {
      または環境変数 HBG_MICROSOFT_CLIENT_ID に設定する。
 
   クライアント シークレットは必要ありません（PKCE を使います）。`
+
+	case "box":
+		return `Box のアプリを登録してください:
+
+  1. https://app.box.com/developers/console で Create New App を選び、
+     Custom App を作成
+     - 認証方法: User Authentication (OAuth 2.0)
+  2. Configuration タブの OAuth 2.0 Redirect URIs に以下を登録
+` + indentLines(BoxRedirectURIs(), "       ") + `
+  3. Application Scopes で以下を有効にして保存
+       Read all files and folders stored in Box
+       Write all files and folders stored in Box
+  4. Client ID と Client Secret を設定ファイルに書く
+
+       storages:
+         - name: box
+           type: box
+           client_id: ${HBG_BOX_CLIENT_ID}
+           client_secret: ${HBG_BOX_CLIENT_SECRET}
+
+     または環境変数 HBG_BOX_CLIENT_ID / HBG_BOX_CLIENT_SECRET に設定する。
+
+  組織の Box では、管理者がアプリを承認するまで認可できないことがあります。`
 	}
 	return ""
 }
@@ -189,3 +255,15 @@ func ResolveMicrosoft(fromConfig string) (ClientCredentials, error) {
 	}
 	return ClientCredentials{ClientID: id}, nil
 }
+
+// ResolveBox は Box の OAuth クライアント情報を解決します。
+//
+// Box は PKCE だけでは認可できず、シークレットも要ります。
+func ResolveBox(idFromConfig, secretFromConfig string) (ClientCredentials, error) {
+	id := firstNonEmpty(idFromConfig, os.Getenv(EnvBoxClientID), BoxClientID)
+	secret := firstNonEmpty(secretFromConfig, os.Getenv(EnvBoxClientSecret), BoxClientSecret)
+	if id == "" || secret == "" {
+		return ClientCredentials{}, missingCredentialsError("box")
+	}
+	return ClientCredentials{ClientID: id, ClientSecret: secret}, nil
+}
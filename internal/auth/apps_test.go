@@ -115,6 +115,9 @@ func TestNoHardcodedCredentials(t *testing.T) {
 	if GoogleClientSecret != "" {
 		t.Errorf("GoogleClientSecret がソースに埋め込まれている: %q", GoogleClientSecret)
 	}
+	if BoxClientSecret != "" {
+		t.Errorf("BoxClientSecret がソースに埋め込まれている: %q", BoxClientSecret)
+	}
 }
 
 func TestDropboxAuthCodeOptionsRequestsOfflineAccess(t *testing.T) {
@@ -208,10 +211,68 @@ func TestMicrosoftRedirectURIsMatchInstructions(t *testing.T) {
 	}
 }
 
+func TestResolveBox(t *testing.T) {
+	t.Run("IDとシークレットが揃えば解決する", func(t *testing.T) {
+		t.Setenv(EnvBoxClientID, "from-env")
+		t.Setenv(EnvBoxClientSecret, "from-env")
+		creds, err := ResolveBox("id", "secret")
+		if err != nil {
+			t.Fatalf("ResolveBox: %v", err)
+		}
+		if creds.ClientID != "id" || creds.ClientSecret != "secret" {
+			t.Errorf("creds = %+v", creds)
+		}
+	})
+
+	t.Run("片方だけでは足りない", func(t *testing.T) {
+		t.Setenv(EnvBoxClientID, "")
+		t.Setenv(EnvBoxClientSecret, "")
+		if _, err := ResolveBox("id", ""); err == nil {
+			t.Error("シークレットがないのに成功した")
+		}
+		if _, err := ResolveBox("", "secret"); err == nil {
+			t.Error("IDがないのに成功した")
+		}
+	})
+
+	t.Run("どこにもなければ手順を案内する", func(t *testing.T) {
+		t.Setenv(EnvBoxClientID, "")
+		t.Setenv(EnvBoxClientSecret, "")
+		_, err := ResolveBox("", "")
+		if err == nil {
+			t.Fatal("エラーになるはずだった")
+		}
+		for _, want := range []string{"box", "Redirect URIs", "HBG_BOX_CLIENT_ID", "HBG_BOX_CLIENT_SECRET"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("案内に %q が含まれていない", want)
+			}
+		}
+	})
+}
+
+// Box も完全一致でしか照合しないので、Dropbox と同じことを確かめます。
+func TestBoxRedirectURIsMatchInstructions(t *testing.T) {
+	instructions := setupInstructions("box")
+
+	uris := BoxRedirectURIs()
+	if len(uris) != len(BoxRedirectPorts) {
+		t.Fatalf("URI が %d 個、ポートは %d 個", len(uris), len(BoxRedirectPorts))
+	}
+	for _, uri := range uris {
+		if !strings.Contains(instructions, uri) {
+			t.Errorf("登録手順に %q が載っていない", uri)
+		}
+		// Box が http を許すのは localhost だけ。
+		if !strings.HasPrefix(uri, "http://localhost:") {
+			t.Errorf("%q は localhost でない。Box には登録できない", uri)
+		}
+	}
+}
+
 // 認証を要する提供元には、必ず登録手順があることを確かめます。
 // 提供元を足したときに、案内だけ書き忘れるのを防ぎます。
 func TestEveryOAuthProviderHasInstructions(t *testing.T) {
-	for _, storageType := range []string{"dropbox", "googledrive", "onedrive"} {
+	for _, storageType := range []string{"dropbox", "googledrive", "gcs", "onedrive", "box"} {
 		if setupInstructions(storageType) == "" {
 			t.Errorf("%s の登録手順が空", storageType)
 		}
@@ -91,6 +91,25 @@ func GoogleDriveOAuth2Config(creds ClientCredentials) *oauth2.Config {
 	}
 }
 
+// GoogleCloudStorageScope は hbg が必要とする Google Cloud Storage の権限です。
+//
+// オブジェクトの読み書きと削除ができれば足ります。バケットの作成や
+// 権限の変更まで許す full_control は要求しません。
+const GoogleCloudStorageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// GoogleCloudStorageOAuth2Config は Google Cloud Storage 用の oauth2.Config を返します。
+//
+// クライアントは Google Drive と同じものを使えます。同じ Google Cloud
+// プロジェクトで Cloud Storage の API も有効にしておいてください。
+func GoogleCloudStorageOAuth2Config(creds ClientCredentials) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     creds.ClientID,
+		ClientSecret: creds.ClientSecret,
+		Endpoint:     google.Endpoint,
+		Scopes:       []string{GoogleCloudStorageScope},
+	}
+}
+
 // GoogleAuthCodeOptions は Google の認可要求に付ける追加パラメータです。
 //
 // AccessTypeOffline でリフレッシュトークンを要求し、
@@ -163,3 +182,43 @@ func MicrosoftOAuth2Config(creds ClientCredentials, tenant string) *oauth2.Confi
 		Scopes:   MicrosoftScopes,
 	}
 }
+
+// BoxRedirectPorts と BoxRedirectHost は、Box の認可で使うリダイレクト先です。
+//
+// Box もリダイレクト URI の完全一致を求め、http を許すのは localhost だけです。
+// Dropbox と同じく、登録しておいた候補を順に試します。
+var BoxRedirectPorts = []int{53688, 53689, 53690}
+
+// BoxRedirectHost は Box のリダイレクト URI に書くホストです。
+const BoxRedirectHost = "localhost"
+
+// BoxRedirectURIs は、アプリ登録時に Redirect URIs へ入れる文字列です。
+// 認可要求に載せる URI と同じ組み立て方をするので、ずれません。
+func BoxRedirectURIs() []string {
+	uris := make([]string, 0, len(BoxRedirectPorts))
+	for _, port := range BoxRedirectPorts {
+		uris = append(uris, RedirectURI(BoxRedirectHost, port))
+	}
+	return uris
+}
+
+// boxEndpoint は Box の OAuth2 エンドポイントです。
+//
+// Box のトークンの窓口は、クライアントの情報を本文で受け取ります。
+var boxEndpoint = oauth2.Endpoint{
+	AuthURL:   "https://account.box.com/api/oauth2/authorize",
+	TokenURL:  "https://api.box.com/oauth2/token",
+	AuthStyle: oauth2.AuthStyleInParams,
+}
+
+// BoxOAuth2Config は Box 用の oauth2.Config を返します。
+//
+// 権限はアプリの設定画面で決めるので、ここでは要求しません。
+// 要求すると、設定画面で許していないものを含んだときに認可が通らなくなります。
+func BoxOAuth2Config(creds ClientCredentials) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     creds.ClientID,
+		ClientSecret: creds.ClientSecret,
+		Endpoint:     boxEndpoint,
+	}
+}
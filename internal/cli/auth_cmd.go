@@ -10,7 +10,9 @@ import (
 	"time"
 
 	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/backend/box"
 	"github.com/mt3hr/hbg/backend/dropbox"
+	"github.com/mt3hr/hbg/backend/gcs"
 	"github.com/mt3hr/hbg/backend/googledrive"
 	"github.com/mt3hr/hbg/backend/onedrive"
 	"github.com/mt3hr/hbg/internal/auth"
@@ -20,7 +22,9 @@ import (
 var authCmd = &cobra.Command{
 	Use:   "auth",
 	Short: "クラウドストレージの認証を行う",
-	Long: `Dropbox や Google Drive の認証を行います。
+	Long: `Dropbox・Google Drive・OneDrive・Box の認証を行います。
+Cloud Storage（gcs）も、サービスアカウントの鍵を設定していなければ
+同じように認証します。
 
 認証はブラウザで行います。hbg が一時的にローカルの待ち受けを開き、
 許可のあとリダイレクトされてくる認可コードを受け取ります。
@@ -57,7 +61,7 @@ var authLoginCmd = &cobra.Command{
 		}
 
 		entry, ok := findStorageEntry(config, name)
-		if !ok || !needsAuth(entry.Type) {
+		if !ok || !needsAuth(entry) {
 			return withExitCode(ExitUsage, fmt.Errorf(
 				"設定に認証が必要なストレージ %q がありません。%s を確認してください",
 				name, mustConfigFile()))
@@ -91,10 +95,29 @@ func loginTo(ctx context.Context, entry backend.Entry, opts auth.LoginOptions) e
 			ClientID: entry.Params.Get("client_id"),
 			Tenant:   entry.Params.Get("tenant"),
 		}, opts)
+	case gcs.Type:
+		return gcs.Login(ctx, gcsConfig(entry), opts)
+	case box.Type:
+		return box.Login(ctx, box.Config{
+			Name:         entry.Name,
+			ClientID:     entry.Params.Get("client_id"),
+			ClientSecret: entry.Params.Get("client_secret"),
+		}, opts)
 	}
 	return fmt.Errorf("ストレージ %q（種別 %s）は認証を必要としません", entry.Name, entry.Type)
 }
 
+// gcsConfig は認証に関わる項目だけを読みます。
+func gcsConfig(entry backend.Entry) gcs.Config {
+	return gcs.Config{
+		Name:                      entry.Name,
+		ServiceAccountFile:        entry.Params.Get("service_account_file"),
+		ServiceAccountCredentials: entry.Params.Get("service_account_credentials"),
+		ClientID:                  entry.Params.Get("client_id"),
+		ClientSecret:              entry.Params.Get("client_secret"),
+	}
+}
+
 func authLoginError(name string, err error) error {
 	if errors.Is(err, auth.ErrDenied) {
 		return fmt.Errorf("%s の認証は許可されませんでした", name)
@@ -123,7 +146,7 @@ var authLogoutCmd = &cobra.Command{
 		if !ok {
 			return withExitCode(ExitUsage, fmt.Errorf("設定にストレージ %q がありません", name))
 		}
-		if !needsAuth(entry.Type) {
+		if !needsAuth(entry) {
 			return withExitCode(ExitUsage, fmt.Errorf(
 				"ストレージ %q（種別 %s）は認証を必要としません", name, entry.Type))
 		}
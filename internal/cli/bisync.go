@@ -0,0 +1,215 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mt3hr/hbg/internal/hbghome"
+	"github.com/mt3hr/hbg/internal/hbglog"
+	"github.com/mt3hr/hbg/transfer"
+	"github.com/spf13/cobra"
+)
+
+var bisyncCmd = &cobra.Command{
+	Use:   "bisync storage1:path1 storage2:path2",
+	Short: "2つのディレクトリを双方向に同期する",
+	Long: `2つのディレクトリの、どちらで起きた変更ももう片方へ反映します。
+ノートPCと Dropbox の両方で同じフォルダを編集する場合に使います。
+
+前回の同期が終わった時点の両側の一覧を $HOME/hbg/caches/bisync に記録し、
+それと今の一覧を比べて、どちら側で何が追加・変更・削除されたかを調べます。
+はじめての実行では記録がないので、片側にしかないものを反対側へ写すだけで、
+何も消しません。
+
+両側で変更されたものは衝突として、--conflict に従って扱います。
+
+  keep-both  両方を名前を変えて残します（既定）。
+             報告.docx は 報告.conflict1.docx（path1 の版）と
+             報告.conflict2.docx（path2 の版）になります。
+  newer      更新時刻の新しいほうで古いほうを上書きします。
+             時刻で決着がつかない場合は両方を残します。
+  abort      衝突があれば何もせずに止めます。
+
+次の場合は消さない側に倒します。
+
+  - 片側で削除され、もう片側で変更されたものは、変更した側を残して書き戻します。
+  - 片側の中身が丸ごと無くなっていたら、何もせずに止めます。
+    外付けのディスクを挿し忘れただけで、もう片側が空になっては困るためです。
+    本当に空にしたのなら --resync を付けてください。
+  - 失敗したものは前回の記録のままにして、次の実行でやり直します。
+
+--resync を付けると、前回の記録を使わずに合わせ直します。
+はじめての実行と同じく、何も消しません。
+
+copy と違い、path1 と path2 の中身どうしを合わせます。
+path1 の名前のディレクトリを path2 の中に作りはしません。
+
+copy のフラグのうち、比較・絞り込み・再試行・速さ・進捗の指定だけを
+受け付けます。--backup-dir や --multi-streams のような片方向の転送の
+ための指定は効かないので、受け付けません。
+
+` + supportedStorageTypesHelp(),
+	Example: `使用例
+hbg bisync --dry-run local:C:/Users/me/仕事 dropbox:/仕事
+hbg bisync local:C:/Users/me/仕事 dropbox:/仕事
+hbg bisync --conflict newer local:C:/Users/me/仕事 dropbox:/仕事
+`,
+	Args:    cobra.ExactArgs(2),
+	PreRunE: copyCmd.PreRunE,
+	RunE:    runBisync,
+}
+
+var bisyncOpt = struct {
+	conflict string
+	resync   bool
+}{}
+
+func init() {
+	// copy と同じ比較・絞り込み・再試行の指定のうち、双方向でも効くものだけを受け付ける。
+	fs := bisyncCmd.Flags()
+	registerBaseTransferFlags(fs)
+	fs.StringVar(&bisyncOpt.conflict, "conflict", string(transfer.ConflictKeepBoth),
+		"両側で変更されたものの扱い ("+strings.Join(transfer.ConflictPolicyNames(), ", ")+")")
+	fs.BoolVar(&bisyncOpt.resync, "resync", false,
+		"前回の記録を使わずに合わせ直す（何も消さない）")
+}
+
+func runBisync(cmd *cobra.Command, _ []string) error {
+	ctx := cmd.Context()
+
+	resolver, err := resolverFromConfig(config)
+	if err != nil {
+		return withExitCode(ExitUsage, err)
+	}
+	defer resolver.Close()
+
+	// PreRunE を copy と共有しているので、1つめは src、2つめは dest に入っている。
+	s1, err := resolver.Get(ctx, copyOpt.srcStorage)
+	if err != nil {
+		return withExitCode(ExitUsage, err)
+	}
+	s2, err := resolver.Get(ctx, copyOpt.destStorage)
+	if err != nil {
+		return withExitCode(ExitUsage, err)
+	}
+	path1 := transfer.BisyncSide{Storage: s1, Dir: copyOpt.srcPath}
+	path2 := transfer.BisyncSide{Storage: s2, Dir: copyOpt.destDirPath}
+
+	conflict, ok := transfer.ParseConflictPolicy(bisyncOpt.conflict)
+	if !ok {
+		return withExitCode(ExitUsage, fmt.Errorf("--conflict の指定が不正です: %q（%s のいずれか）",
+			bisyncOpt.conflict, strings.Join(transfer.ConflictPolicyNames(), ", ")))
+	}
+	compare, err := buildComparePolicy()
+	if err != nil {
+		return withExitCode(ExitUsage, err)
+	}
+	filter, err := buildFilter()
+	if err != nil {
+		return withExitCode(ExitUsage, err)
+	}
+	bwLimit, err := parseByteSize(copyOpt.bwLimit)
+	if err != nil {
+		return withExitCode(ExitUsage, fmt.Errorf("--bwlimit の指定が不正です: %w", err))
+	}
+
+	stateFile, err := hbghome.BisyncStateFile(path1.String(), path2.String())
+	if err != nil {
+		return err
+	}
+
+	reporter, err := newReporter()
+	if err != nil {
+		return withExitCode(ExitUsage, err)
+	}
+	defer reporter.Close()
+
+	result, err := transfer.RunBisync(ctx, transfer.BisyncOptions{
+		Path1:     path1,
+		Path2:     path2,
+		StateFile: stateFile,
+		Resync:    bisyncOpt.resync,
+		Workers:   copyOpt.worker,
+		Compare:   compare,
+		Conflict:  conflict,
+		Filter:    filter,
+		Retry: transfer.RetryPolicy{
+			MaxAttempts: copyOpt.retry + 1, // 初回 + 再試行回数
+			Wait:        copyOpt.retryWait,
+			Backoff:     copyOpt.retryBackoff,
+			MaxWait:     5 * time.Minute,
+		},
+		TPS:            copyOpt.tps,
+		BandwidthLimit: bwLimit,
+		FastList:       copyOpt.fastList,
+		DryRun:         copyOpt.dryRun,
+		Reporter:       reporter,
+		OnTransfer:     logBisyncEvent(s1.Type(), s2.Type()),
+	})
+
+	// まとめを書く前に表示を閉じる。理由は runTransfer を参照。
+	_ = reporter.Close()
+
+	if result != nil {
+		hbglog.LogSummary(result.Copied, result.Failed, result.Elapsed)
+		writeBisyncSummary(os.Stdout, result)
+	}
+
+	if err != nil {
+		switch {
+		case isCanceled(err):
+			return withExitCode(ExitInterrupted, fmt.Errorf("中断しました"))
+		case errors.Is(err, transfer.ErrBisyncConflict), errors.Is(err, transfer.ErrBisyncSideEmpty):
+			return withExitCode(ExitTransferFailed, err)
+		}
+		return fmt.Errorf("error at bisync %s:%s and %s:%s: %w",
+			s1.Type(), path1.Dir, s2.Type(), path2.Dir, err)
+	}
+	if result.Failed > 0 {
+		return withExitCode(ExitTransferFailed,
+			fmt.Errorf("%d件の操作に失敗しました。次の実行でやり直します", result.Failed))
+	}
+	return nil
+}
+
+// logBisyncEvent は転送1件ごとにログを残す関数を返します。
+// 向きが1件ごとに変わるので、ストレージの種別もそのつど選びます。
+func logBisyncEvent(type1, type2 string) func(transfer.TransferEvent, bool) {
+	forward := logTransferEvent(type1, type2)
+	backward := logTransferEvent(type2, type1)
+	return func(ev transfer.TransferEvent, toPath2 bool) {
+		if toPath2 {
+			forward(ev)
+			return
+		}
+		backward(ev)
+	}
+}
+
+// writeBisyncSummary は双方向同期の結果の要約を書き出します。
+func writeBisyncSummary(w io.Writer, r *transfer.BisyncResult) {
+	if r.FirstRun {
+		fmt.Fprintln(w, "\n前回の記録がないため、片側にしかないものを写すだけにしました。")
+	}
+	fmt.Fprintf(w, "\n双方向同期完了: %d件転送, %d件削除, %d件衝突, %d件失敗",
+		r.Copied, r.Deleted, r.Conflicts, r.Failed)
+	if r.Elapsed > 0 {
+		fmt.Fprintf(w, " (%s)", r.Elapsed.Round(time.Millisecond))
+	}
+	fmt.Fprintln(w)
+
+	if len(r.Errors) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n失敗した内容:\n")
+	for _, err := range r.Errors {
+		fmt.Fprintf(w, "  %v\n", err)
+	}
+	if r.Failed > len(r.Errors) {
+		fmt.Fprintf(w, "  ... ほか %d件\n", r.Failed-len(r.Errors))
+	}
+}
@@ -0,0 +1,24 @@
+package cli
+
+import "testing"
+
+// bisync は、双方向の同期で効かない copy のフラグを受け付けないことを確かめます。
+func TestBisyncFlags(t *testing.T) {
+	for _, name := range []string{"checksum", "include", "retry", "bwlimit", "fast-list", "dry-run", "quiet"} {
+		if bisyncCmd.Flags().Lookup(name) == nil {
+			t.Errorf("bisync に --%s がない", name)
+		}
+	}
+	for _, name := range []string{
+		"update", "overwrite", "ignore-existing", "verify", "json", "retry-pass",
+		"partial-min-size", "multi-stream-cutoff", "multi-streams", "checkers",
+		"backup-dir", "suffix", "max-errors", "resume",
+	} {
+		if copyCmd.Flags().Lookup(name) == nil {
+			t.Errorf("copy に --%s がない", name)
+		}
+		if bisyncCmd.Flags().Lookup(name) != nil {
+			t.Errorf("bisync が効かない --%s を受け付ける", name)
+		}
+	}
+}
@@ -93,6 +93,8 @@ func runCheck(cmd *cobra.Command, _ []string) error {
 		Filter:     filter,
 		Retry:      transfer.RetryPolicy{MaxAttempts: 1},
 		TPS:        copyOpt.tps,
+		FastList:   copyOpt.fastList,
+		Checkers:   copyOpt.checkers,
 		DryRun:     true,
 		Reporter:   progress.NewNop(),
 		OnDecision: onDecision,
@@ -169,8 +171,8 @@ func (r *checkReport) write(w *os.File) {
 		return
 	}
 
-	// 並び順を安定させる。走査は並行しないが、
-	// 表示の再現性があると比べやすい。
+	// 並び順を安定させる。判断は走査の順に届くが、
+	// 表示は場所の順のほうが見比べやすい。
 	sortRows(r.rows)
 
 	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
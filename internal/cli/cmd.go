@@ -9,13 +9,24 @@ import (
 	"syscall"
 
 	"github.com/mt3hr/hbg/backend"
-	_ "github.com/mt3hr/hbg/backend/ftp"      // 種別 ftp を登録する
-	_ "github.com/mt3hr/hbg/backend/local"    // 種別 local を登録する
-	_ "github.com/mt3hr/hbg/backend/onedrive" // 種別 onedrive を登録する
-	_ "github.com/mt3hr/hbg/backend/s3"       // 種別 s3 を登録する
-	_ "github.com/mt3hr/hbg/backend/sftp"     // 種別 sftp を登録する
-	_ "github.com/mt3hr/hbg/backend/smb"      // 種別 smb を登録する
-	_ "github.com/mt3hr/hbg/backend/webdav"   // 種別 webdav を登録する
+	_ "github.com/mt3hr/hbg/backend/alias"     // 種別 alias を登録する
+	_ "github.com/mt3hr/hbg/backend/azureblob" // 種別 azureblob を登録する
+	_ "github.com/mt3hr/hbg/backend/b2"        // 種別 b2 を登録する
+	_ "github.com/mt3hr/hbg/backend/cache"     // 種別 cache を登録する
+	_ "github.com/mt3hr/hbg/backend/chaos"     // 種別 chaos を登録する
+	_ "github.com/mt3hr/hbg/backend/chunker"   // 種別 chunker を登録する
+	_ "github.com/mt3hr/hbg/backend/combine"   // 種別 combine を登録する
+	_ "github.com/mt3hr/hbg/backend/compress"  // 種別 compress を登録する
+	_ "github.com/mt3hr/hbg/backend/ftp"       // 種別 ftp を登録する
+	_ "github.com/mt3hr/hbg/backend/hasher"    // 種別 hasher を登録する
+	_ "github.com/mt3hr/hbg/backend/http"      // 種別 http を登録する
+	_ "github.com/mt3hr/hbg/backend/local"     // 種別 local を登録する
+	_ "github.com/mt3hr/hbg/backend/onedrive"  // 種別 onedrive を登録する
+	_ "github.com/mt3hr/hbg/backend/s3"        // 種別 s3 を登録する
+	_ "github.com/mt3hr/hbg/backend/sftp"      // 種別 sftp を登録する
+	_ "github.com/mt3hr/hbg/backend/smb"       // 種別 smb を登録する
+	_ "github.com/mt3hr/hbg/backend/union"     // 種別 union を登録する
+	_ "github.com/mt3hr/hbg/backend/webdav"    // 種別 webdav を登録する
 	"github.com/spf13/cobra"
 )
 
@@ -153,6 +164,7 @@ var (
 func init() {
 	rootCmd.AddCommand(copyCmd)
 	rootCmd.AddCommand(syncCmd)
+	rootCmd.AddCommand(bisyncCmd)
 	rootCmd.AddCommand(moveCmd)
 	rootCmd.AddCommand(mkdirCmd)
 	rootCmd.AddCommand(removeCmd)
@@ -161,6 +173,7 @@ func init() {
 	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(authCmd)
 	rootCmd.AddCommand(checkCmd)
+	rootCmd.AddCommand(cryptcheckCmd)
 	rootCmd.AddCommand(completionCmd)
 
 	rootPf := rootCmd.PersistentFlags()
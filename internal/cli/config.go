@@ -25,6 +25,11 @@ func defaultConfigYAML() string {
 # 同じ種類のストレージに別々の名前を与えると、複数アカウントを使い分けられます。
 # 使わないストレージの項目は削除するかコメントアウトしてください。
 # クラウドは初回に hbg auth login <名前> で認証してください。
+#
+# どのストレージにも、誤った操作から守るための制限を付けられます。
+#   read_only: true    # 変更をすべて断る
+#   no_delete: true    # 削除と移動を断る
+#   append_only: true  # 新しく置くことだけを許す
 
 # 同時処理数。copy の -w で上書きできます。
 DefaultWorker: 2
@@ -30,13 +30,15 @@ var (
 クラウドは初回に hbg auth login <名前> で認証してください。
 
 転送に失敗した場合は、--retry で同じファイルを試し直し、
-それでも残ったものを --retry-pass でまとめて試し直せます。`,
+それでも残ったものを --retry-pass でまとめて試し直せます。
+中断したときは、同じ指定に --resume を付けると済んだところを飛ばして続けます。`,
 		Example: `使用例
 hbg copy local:C:/hoge/test.txt dropbox:/hbg
 hbg copy dropbox:/hbg/test.txt local:/home/user/documents
 hbg copy -w 10 local:C:/hoge local:C:/fuga
 hbg copy --dry-run local:C:/hoge dropbox:/hbg
 hbg copy --retry 3 --retry-wait 5s --retry-pass 2 local:C:/hoge dropbox:/hbg
+hbg copy --resume local:C:/hoge dropbox:/hbg
 `,
 		PreRunE: func(_ *cobra.Command, args []string) error {
 			srcInfo, destInfo := args[0], args[1]
@@ -99,10 +101,18 @@ hbg copy --retry 3 --retry-wait 5s --retry-pass 2 local:C:/hoge dropbox:/hbg
 		retryPass     int
 		retryPassWait time.Duration
 
-		tps       float64
-		bwLimit   string
-		dryRun    bool
-		maxErrors int
+		tps            float64
+		bwLimit        string
+		partialMinSize string
+		multiCutoff    string
+		multiStreams   int
+		fastList       bool
+		checkers       int
+		backupDir      string
+		suffix         string
+		resume         bool
+		dryRun         bool
+		maxErrors      int
 
 		progress     string
 		progressBars int
@@ -129,6 +139,41 @@ var defaultIgnores = []string{
 // コマンドごとの init に書き分けると、実行順序によっては
 // 片方でフラグが登録されないままになります。
 func registerTransferFlags(fs *pflag.FlagSet) {
+	registerBaseTransferFlags(fs)
+
+	fs.BoolVar(&copyOpt.update, "update", true, "コピー先のほうが新しい場合は上書きしない")
+	fs.BoolVar(&copyOpt.overwrite, "overwrite", false, "コピー先のほうが新しくても上書きする")
+	fs.BoolVar(&copyOpt.ignoreExisting, "ignore-existing", false, "コピー先にあるものは内容を問わず転送しない")
+	fs.StringVar(&copyOpt.verify, "verify", "auto",
+		"転送後の内容の検証 (auto, always, never)")
+	fs.BoolVar(&copyOpt.jsonOut, "json", false,
+		"結果を1行1件の JSON で標準出力へ流す（人向けの表示は標準エラーへ）")
+
+	fs.IntVar(&copyOpt.retryPass, "retry-pass", 0, "失敗が残っていたときに全体をやり直す回数（0で無効）")
+	fs.DurationVar(&copyOpt.retryPassWait, "retry-pass-wait", time.Minute, "全体をやり直すまでの待ち時間")
+
+	fs.StringVar(&copyOpt.partialMinSize, "partial-min-size", "32M",
+		"これ以上の大きさのファイルは、途中で切れても書きかけの続きから送る（0で無効）")
+	fs.StringVar(&copyOpt.multiCutoff, "multi-stream-cutoff", "256M",
+		"これ以上の大きさのファイルは、コピー元から範囲に分けて同時に読む（0で無効）")
+	fs.IntVar(&copyOpt.multiStreams, "multi-streams", 4,
+		"範囲に分けて読むときに同時に読む本数（1以下で無効）")
+	fs.IntVar(&copyOpt.checkers, "checkers", 8,
+		"ディレクトリを同時に一覧する数（1で1つずつ）")
+	fs.StringVar(&copyOpt.backupDir, "backup-dir", "",
+		"上書きや削除で失われるものを、消す前に移しておく先（storage:path）")
+	fs.StringVar(&copyOpt.suffix, "suffix", "",
+		"退避したものの名前に付ける印。{time} は実行した日時になる（--backup-dir と併用）")
+	fs.IntVar(&copyOpt.maxErrors, "max-errors", 0, "この件数を超えて失敗したら中断する（0で無制限）")
+}
+
+// registerBaseTransferFlags は、bisync も含めて転送するコマンドが
+// どれも従うフラグを登録します。
+//
+// bisync は、上書きの向きの指定や、書きかけの続き・範囲に分けた読み出し・
+// 退避のような片方向の転送の仕組みを使いません。受け付けて黙って
+// 無視すると効いたと思わせてしまうので、bisync にはこちらだけを登録します。
+func registerBaseTransferFlags(fs *pflag.FlagSet) {
 	fs.IntVarP(&copyOpt.worker, "worker", "w", 0, "同時処理数。0だとconfigファイルの値で動きます。")
 
 	fs.StringVar(&copyOpt.compare, "compare", "size,modtime",
@@ -137,17 +182,10 @@ func registerTransferFlags(fs *pflag.FlagSet) {
 	fs.BoolVar(&copyOpt.sizeOnly, "size-only", false, "サイズだけで比較する (--compare size と同じ)")
 	fs.DurationVar(&copyOpt.modifyWindow, "modify-window", 0,
 		"この時間以内の更新時刻の差は同一とみなす（0で自動）")
-	fs.BoolVar(&copyOpt.update, "update", true, "コピー先のほうが新しい場合は上書きしない")
-	fs.BoolVar(&copyOpt.overwrite, "overwrite", false, "コピー先のほうが新しくても上書きする")
-	fs.BoolVar(&copyOpt.ignoreExisting, "ignore-existing", false, "コピー先にあるものは内容を問わず転送しない")
-	fs.StringVar(&copyOpt.verify, "verify", "auto",
-		"転送後の内容の検証 (auto, always, never)")
 
 	fs.StringArrayVarP(&copyOpt.ignore, "ignore", "i", defaultIgnores, "無視するファイル名（完全一致）")
 	fs.StringArrayVar(&copyOpt.include, "include", nil, "このパターンに一致するものだけを転送する")
 	fs.StringArrayVar(&copyOpt.exclude, "exclude", nil, "このパターンに一致するものを転送しない")
-	fs.BoolVar(&copyOpt.jsonOut, "json", false,
-		"結果を1行1件の JSON で標準出力へ流す（人向けの表示は標準エラーへ）")
 
 	fs.StringVar(&copyOpt.minSize, "min-size", "", "これより小さいファイルを転送しない（例: 1M）")
 	fs.StringVar(&copyOpt.maxSize, "max-size", "", "これより大きいファイルを転送しない（例: 1G）")
@@ -155,13 +193,12 @@ func registerTransferFlags(fs *pflag.FlagSet) {
 	fs.IntVar(&copyOpt.retry, "retry", 3, "1ファイルの転送に失敗したときの再試行回数（0で無効）")
 	fs.DurationVar(&copyOpt.retryWait, "retry-wait", 5*time.Second, "再試行までの待ち時間")
 	fs.BoolVar(&copyOpt.retryBackoff, "retry-backoff", false, "再試行の待ち時間を試行ごとに伸ばす")
-	fs.IntVar(&copyOpt.retryPass, "retry-pass", 0, "失敗が残っていたときに全体をやり直す回数（0で無効）")
-	fs.DurationVar(&copyOpt.retryPassWait, "retry-pass-wait", time.Minute, "全体をやり直すまでの待ち時間")
 
 	fs.Float64Var(&copyOpt.tps, "tps", 0, "1秒あたりのAPI呼び出し回数の上限（0で無制限）")
 	fs.StringVar(&copyOpt.bwLimit, "bwlimit", "", "転送速度の上限（例: 10M, 512K）")
+	fs.BoolVar(&copyOpt.fastList, "fast-list", false,
+		"配下をまとめて一覧してから比べる。往復は減るが、一覧をすべてメモリに持つ")
 	fs.BoolVar(&copyOpt.dryRun, "dry-run", false, "実際には転送せず、何が転送されるかだけを表示する")
-	fs.IntVar(&copyOpt.maxErrors, "max-errors", 0, "この件数を超えて失敗したら中断する（0で無制限）")
 
 	fs.StringVar(&copyOpt.progress, "progress", "auto",
 		"進捗の表示 (auto, always, never, none)")
@@ -174,6 +211,14 @@ func registerTransferFlags(fs *pflag.FlagSet) {
 
 func init() {
 	registerTransferFlags(copyCmd.Flags())
+	registerResumeFlag(copyCmd.Flags())
+}
+
+// registerResumeFlag は copy と sync の --resume を登録します。
+// check と bisync は途中経過を記録しないので、共通のフラグには入れません。
+func registerResumeFlag(fs *pflag.FlagSet) {
+	fs.BoolVar(&copyOpt.resume, "resume", false,
+		"前回中断した同じ転送の、済んだディレクトリとファイルを飛ばして続ける")
 }
 
 func runCopy(cmd *cobra.Command, _ []string) error {
@@ -207,6 +252,19 @@ func runTransfer(cmd *cobra.Command, deleteExtraneous bool) error {
 	if err != nil {
 		return withExitCode(ExitUsage, fmt.Errorf("--bwlimit の指定が不正です: %w", err))
 	}
+	partialMinSize, err := parseByteSize(copyOpt.partialMinSize)
+	if err != nil {
+		return withExitCode(ExitUsage, fmt.Errorf("--partial-min-size の指定が不正です: %w", err))
+	}
+	multiCutoff, err := parseByteSize(copyOpt.multiCutoff)
+	if err != nil {
+		return withExitCode(ExitUsage, fmt.Errorf("--multi-stream-cutoff の指定が不正です: %w", err))
+	}
+
+	backupStorage, backupDir, err := resolveBackupDir(ctx, resolver)
+	if err != nil {
+		return withExitCode(ExitUsage, err)
+	}
 
 	reporter, err := newReporter()
 	if err != nil {
@@ -243,14 +301,23 @@ func runTransfer(cmd *cobra.Command, deleteExtraneous bool) error {
 			Backoff:     copyOpt.retryBackoff,
 			MaxWait:     5 * time.Minute,
 		},
-		TPS:             copyOpt.tps,
-		BandwidthLimit:  bwLimit,
-		Delete:          deleteExtraneous,
-		DeleteOnPartial: deleteExtraneous && syncOpt.deleteOnPartial,
-		DryRun:          copyOpt.dryRun,
-		MaxErrors:       copyOpt.maxErrors,
-		Reporter:        reporter,
-		OnTransfer:      logTransferEvent(srcStorage.Type(), destStorage.Type()),
+		TPS:               copyOpt.tps,
+		BandwidthLimit:    bwLimit,
+		PartialMinSize:    partialMinSize,
+		MultiStreamCutoff: multiCutoff,
+		MultiStreams:      copyOpt.multiStreams,
+		FastList:          copyOpt.fastList,
+		Checkers:          copyOpt.checkers,
+		BackupStorage:     backupStorage,
+		BackupDir:         backupDir,
+		BackupSuffix:      backupSuffix(copyOpt.suffix, time.Now()),
+		Delete:            deleteExtraneous,
+		DeleteOnPartial:   deleteExtraneous && syncOpt.deleteOnPartial,
+		TrackRenames:      deleteExtraneous && syncOpt.trackRenames,
+		DryRun:            copyOpt.dryRun,
+		MaxErrors:         copyOpt.maxErrors,
+		Reporter:          reporter,
+		OnTransfer:        logTransferEvent(srcStorage.Type(), destStorage.Type()),
 	}
 
 	// --json のときは、機械向けの出力を標準出力へ流す。
@@ -268,6 +335,20 @@ func runTransfer(cmd *cobra.Command, deleteExtraneous bool) error {
 		opts.OnDecision = jsonw.onDecision()
 	}
 
+	journal, err := openJournal(srcStorage, destStorage, deleteExtraneous)
+	if err != nil {
+		return withExitCode(ExitUsage, err)
+	}
+	if journal != nil {
+		if journal.Resumed() {
+			dirs, files := journal.Done()
+			reporter.Logf("前回の途中経過から続けます（済んだディレクトリ %d件、ファイル %d件）", dirs, files)
+		} else if copyOpt.resume {
+			reporter.Logf("前回の途中経過が見つからないため、最初から始めます")
+		}
+		opts.Journal = journal
+	}
+
 	pass := transfer.PassPolicy{
 		MaxPasses: copyOpt.retryPass + 1, // 初回 + やり直し回数
 		Wait:      copyOpt.retryPassWait,
@@ -282,6 +363,8 @@ func runTransfer(cmd *cobra.Command, deleteExtraneous bool) error {
 	// Close は二度呼んでも害がないので、後始末の defer はそのまま残す。
 	_ = reporter.Close()
 
+	finishJournal(journal, cmd, result, err)
+
 	if result != nil {
 		hbglog.LogSummary(result.Transferred, result.Failed, result.Elapsed)
 		if jsonw != nil {
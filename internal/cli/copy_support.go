@@ -5,12 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/internal/hbghome"
 	"github.com/mt3hr/hbg/progress"
+	"github.com/mt3hr/hbg/storage"
 	"github.com/mt3hr/hbg/transfer"
+	"github.com/spf13/cobra"
 )
 
 // newReporter は進みぐあいの表示先を作ります。
@@ -48,6 +53,12 @@ func writeSummary(w io.Writer, r *transfer.Result) {
 	if s := deleteSummary(r.Deleted, r.DeleteFailed); s != "" {
 		fmt.Fprintln(w, s)
 	}
+	if r.Renamed > 0 {
+		fmt.Fprintf(w, "改名: %d件（送らずにコピー先で移動）\n", r.Renamed)
+	}
+	if r.BackedUp > 0 {
+		fmt.Fprintf(w, "退避: %d件\n", r.BackedUp)
+	}
 
 	if len(r.Errors) == 0 {
 		return
@@ -148,3 +159,105 @@ func buildFilter() (*transfer.Filter, error) {
 		MaxSize: maxSize,
 	})
 }
+
+// resolveBackupDir は --backup-dir の指定から退避先を求めます。
+// 指定がなければ nil を返します。
+func resolveBackupDir(ctx context.Context, resolver *backend.Resolver) (storage.Storage, string, error) {
+	if copyOpt.backupDir == "" {
+		if copyOpt.suffix != "" {
+			return nil, "", fmt.Errorf("--suffix は --backup-dir と併せて指定してください")
+		}
+		return nil, "", nil
+	}
+	if strings.Contains(copyOpt.suffix, "/") {
+		return nil, "", fmt.Errorf("--suffix に / は使えません: %q", copyOpt.suffix)
+	}
+
+	name, dir, ok := strings.Cut(copyOpt.backupDir, ":")
+	if !ok {
+		return nil, "", fmt.Errorf("--backup-dir の記述が変です: %q（storage:path の形式で指定してください）",
+			copyOpt.backupDir)
+	}
+	s, err := resolver.Get(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	return s, dir, nil
+}
+
+// backupSuffix は --suffix の {time} を実行した日時に置き換えます。
+//
+// 毎回同じ印だと、同じファイルを2回退避したときに前のものが
+// 上書きされて消えます。日時を入れておけば、退避するたびに残ります。
+func backupSuffix(spec string, now time.Time) string {
+	return strings.ReplaceAll(spec, "{time}", now.Format("20060102-150405"))
+}
+
+// journalKey は途中経過の記録の持ち主を表す文字列を作ります。
+//
+// コピー元・コピー先に加えて、転送するかどうかの判断を変える指定を含めます。
+// 指定を変えて実行したのに前の記録で飛ばすと、送るべきものを送らずに終わるためです。
+func journalKey(src, dst storage.Storage, deleteExtraneous bool) string {
+	compare := copyOpt.compare
+	switch {
+	case copyOpt.checksum:
+		compare = "size,hash"
+	case copyOpt.sizeOnly:
+		compare = "size"
+	}
+	return strings.Join([]string{
+		fmt.Sprintf("src=%s:%s:%s", src.Type(), src.Name(), copyOpt.srcPath),
+		fmt.Sprintf("dst=%s:%s:%s", dst.Type(), dst.Name(), copyOpt.destDirPath),
+		fmt.Sprintf("compare=%s window=%s update=%t overwrite=%t ignore-existing=%t",
+			compare, copyOpt.modifyWindow, copyOpt.update, copyOpt.overwrite, copyOpt.ignoreExisting),
+		fmt.Sprintf("ignore=%q include=%q exclude=%q min=%s max=%s",
+			copyOpt.ignore, copyOpt.include, copyOpt.exclude, copyOpt.minSize, copyOpt.maxSize),
+		fmt.Sprintf("delete=%t", deleteExtraneous),
+	}, "\n")
+}
+
+// openJournal は途中経過の記録を開きます。
+//
+// 記録は --resume の有無に関わらず取ります。中断してから続きを
+// 望んでも、記録がなければ最初からやり直すしかないためです。
+// 試しに動かすだけのときは何も済まないので、記録しません。
+func openJournal(src, dst storage.Storage, deleteExtraneous bool) (*transfer.Journal, error) {
+	if copyOpt.dryRun {
+		if copyOpt.resume {
+			return nil, fmt.Errorf("--resume と --dry-run は同時に指定できません")
+		}
+		return nil, nil
+	}
+	key := journalKey(src, dst, deleteExtraneous)
+	file, err := hbghome.JournalFile(key)
+	if err != nil {
+		return nil, err
+	}
+	return transfer.OpenJournal(file, key, copyOpt.resume)
+}
+
+// finishJournal は転送を終えた記録を片付けます。
+//
+// 最後まで済んだら記録を消します。失敗や中断が残っていれば、
+// 続きから実行できるように記録を残して、そのことを伝えます。
+func finishJournal(j *transfer.Journal, cmd *cobra.Command, result *transfer.Result, err error) {
+	if j == nil {
+		return
+	}
+	if werr := j.Err(); werr != nil {
+		warnf("途中経過の記録を書けなかったため、続きからの実行では一部を調べ直します: %v", werr)
+	}
+
+	if err == nil && result != nil && result.Failed == 0 && result.DeleteFailed == 0 && !result.Aborted {
+		if derr := j.Discard(); derr != nil {
+			warnf("途中経過の記録を消せませんでした: %v", derr)
+		}
+		return
+	}
+	if cerr := j.Close(); cerr != nil {
+		warnf("途中経過の記録を閉じられませんでした: %v", cerr)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "hbg: 同じ指定に --resume を付けて %s を実行すると、済んだところを飛ばして続けます\n",
+		cmd.CommandPath())
+}
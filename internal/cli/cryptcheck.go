@@ -0,0 +1,195 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/mt3hr/hbg/backend/crypt"
+	"github.com/mt3hr/hbg/storage"
+	"github.com/spf13/cobra"
+)
+
+var cryptcheckCmd = &cobra.Command{
+	Use:   "cryptcheck srcStorage:srcPath cryptStorage:destDirPath",
+	Short: "暗号化して置いたものが元と同じかを確かめる",
+	Long: `コピー元の平文と、crypt のストレージに暗号化して置いたものを1件ずつ照合します。
+
+crypt は暗号文のハッシュしか持たないので、hbg check --checksum では
+内容まで比べられません。cryptcheck は置いてあるファイルのヘッダーを読み、
+コピー元を同じ形で暗号化し直して、下のストレージのハッシュと比べます。
+下のストレージがハッシュを返せなければ、復号して読んで比べます。
+
+場所の対応は copy と同じです。srcPath は destDirPath の下の同じ名前と比べます。`,
+	Example: `使用例
+hbg cryptcheck local:C:/customers secure:/
+`,
+	Args: cobra.ExactArgs(2),
+	RunE: runCryptcheck,
+}
+
+func runCryptcheck(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
+	srcName, srcPath, err := splitStoragePath(args[0])
+	if err != nil {
+		return withExitCode(ExitUsage, err)
+	}
+	dstName, dstDir, err := splitStoragePath(args[1])
+	if err != nil {
+		return withExitCode(ExitUsage, err)
+	}
+
+	resolver, err := resolverFromConfig(config)
+	if err != nil {
+		return withExitCode(ExitUsage, err)
+	}
+	defer resolver.Close()
+
+	src, err := resolver.Get(ctx, srcName)
+	if err != nil {
+		return withExitCode(ExitUsage, err)
+	}
+	dst, err := resolver.Get(ctx, dstName)
+	if err != nil {
+		return withExitCode(ExitUsage, err)
+	}
+	// 別名や read_only で包まれていても照合できるよう、型ではなく能力で見る。
+	if !storage.CanVerify(dst) {
+		return withExitCode(ExitUsage, fmt.Errorf("%s は crypt のストレージではありません（種別 %s）",
+			dstName, dst.Type()))
+	}
+
+	rows, err := cryptcheck(ctx, src, srcPath, dst, dstDir)
+	if err != nil {
+		if isCanceled(err) {
+			return withExitCode(ExitInterrupted, fmt.Errorf("中断しました"))
+		}
+		return err
+	}
+
+	differing := writeCryptcheck(os.Stdout, rows)
+	if differing > 0 {
+		return withExitCode(ExitTransferFailed, fmt.Errorf("%d件が一致しません", differing))
+	}
+	return nil
+}
+
+// cryptcheckRow は照合の結果1件です。
+type cryptcheckRow struct {
+	path   string
+	ok     bool
+	reason string
+}
+
+// cryptcheck は src の srcPath と、dst の destDir の下の同じ名前とを照合します。
+func cryptcheck(ctx context.Context, src storage.Storage, srcPath string, dst storage.Storage, destDir string) ([]cryptcheckRow, error) {
+	root, err := src.Stat(ctx, srcPath)
+	if err != nil {
+		return nil, err
+	}
+	dstRoot := path.Join("/", destDir, root.Name)
+
+	srcFiles := map[string]string{}
+	if root.IsDir {
+		if err := walkFiles(ctx, src, root.Path, "", srcFiles); err != nil {
+			return nil, err
+		}
+	} else {
+		srcFiles[root.Name] = root.Path
+		dstRoot = path.Join("/", destDir)
+	}
+
+	dstFiles := map[string]string{}
+	if root.IsDir {
+		if err := walkFiles(ctx, dst, dstRoot, "", dstFiles); err != nil && !storage.IsNotFound(err) {
+			return nil, err
+		}
+	}
+
+	var rows []cryptcheckRow
+	for rel, p := range srcFiles {
+		row := cryptcheckRow{path: rel, ok: true, reason: "一致"}
+		if err := verifyOne(ctx, src, p, dst, path.Join(dstRoot, rel)); err != nil {
+			if isCanceled(err) {
+				return nil, err
+			}
+			row.ok = false
+			switch {
+			case storage.IsNotFound(err):
+				row.reason = "コピー先にない"
+			case errors.Is(err, crypt.ErrMismatch):
+				row.reason = "内容が違う"
+			default:
+				row.reason = "確かめられない: " + err.Error()
+			}
+		}
+		rows = append(rows, row)
+	}
+	for rel := range dstFiles {
+		if _, ok := srcFiles[rel]; !ok {
+			rows = append(rows, cryptcheckRow{path: rel, reason: "コピー元にない"})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].path < rows[j].path })
+	return rows, nil
+}
+
+// verifyOne は src の1ファイルを読み、dst に置いたものと照合します。
+func verifyOne(ctx context.Context, src storage.Storage, srcPath string, dst storage.Storage, dstPath string) error {
+	// 先に有無を確かめて、無いものはコピー元を読まずに済ませる。
+	if _, err := dst.Stat(ctx, dstPath); err != nil {
+		return err
+	}
+	rc, _, err := src.Open(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return storage.Verify(ctx, dst, dstPath, rc)
+}
+
+// walkFiles は dir の配下のファイルを、dir からの相対パスと実際のパスの対応で集めます。
+func walkFiles(ctx context.Context, s storage.Storage, dir, rel string, out map[string]string) error {
+	entries, err := storage.ListAll(ctx, s, dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		r := path.Join(rel, e.Name)
+		if e.IsDir {
+			if err := walkFiles(ctx, s, e.Path, r, out); err != nil {
+				return err
+			}
+			continue
+		}
+		out[r] = e.Path
+	}
+	return nil
+}
+
+// writeCryptcheck は結果を書き出し、一致しなかった件数を返します。
+func writeCryptcheck(w *os.File, rows []cryptcheckRow) int {
+	var same, differing int
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, row := range rows {
+		if row.ok {
+			same++
+			continue
+		}
+		differing++
+		fmt.Fprintf(tw, "%s\t%s\n", row.path, row.reason)
+	}
+	tw.Flush()
+
+	if differing == 0 {
+		fmt.Fprintf(w, "すべて一致しました（%d件）。\n", same)
+		return 0
+	}
+	fmt.Fprintf(w, "\n不一致 %d件、一致 %d件\n", differing, same)
+	return differing
+}
@@ -0,0 +1,123 @@
+package cli
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/backend/alias"
+	"github.com/mt3hr/hbg/backend/crypt"
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/storage"
+)
+
+// 平文と暗号化したものを照合し、違い・欠け・余りを見分けることを確認します。
+func TestCryptcheck(t *testing.T) {
+	ctx := context.Background()
+	src := memory.New("src")
+	dst, err := crypt.New("secure", memory.New("inner"), crypt.Config{Password: "p"})
+	if err != nil {
+		t.Fatalf("crypt.New: %v", err)
+	}
+	put := func(s storage.Storage, p, content string) {
+		t.Helper()
+		if _, err := s.Put(ctx, p, strings.NewReader(content), storage.ObjectMeta{Size: int64(len(content))}); err != nil {
+			t.Fatalf("Put(%s): %v", p, err)
+		}
+	}
+
+	put(src, "/data/same.txt", "同じ")
+	put(src, "/data/奥/changed.txt", "新しい")
+	put(src, "/data/missing.txt", "まだ送っていない")
+	put(dst, "/backup/data/same.txt", "同じ")
+	put(dst, "/backup/data/奥/changed.txt", "古い")
+	put(dst, "/backup/data/extra.txt", "消したもの")
+
+	rows, err := cryptcheck(ctx, src, "/data", dst, "/backup")
+	if err != nil {
+		t.Fatalf("cryptcheck: %v", err)
+	}
+
+	got := map[string]string{}
+	for _, row := range rows {
+		got[row.path] = row.reason
+	}
+	want := map[string]string{
+		"same.txt":      "一致",
+		"奥/changed.txt": "内容が違う",
+		"missing.txt":   "コピー先にない",
+		"extra.txt":     "コピー元にない",
+	}
+	if len(got) != len(want) {
+		t.Errorf("結果 = %v, want %v", got, want)
+	}
+	for p, reason := range want {
+		if got[p] != reason {
+			t.Errorf("%s = %q, want %q", p, got[p], reason)
+		}
+	}
+}
+
+// 別名の先の crypt や、read_only を付けた crypt でも照合できることを確かめます。
+//
+// 以前は *crypt.Storage への型アサーションで確かめていたので、
+// 包まれた crypt は「crypt ではない」と断られていました。
+func TestCryptcheckWrappedCrypt(t *testing.T) {
+	ctx := context.Background()
+	r, err := backend.NewResolver([]backend.Entry{
+		{Name: "mem", Type: memory.Type},
+		{Name: "secure", Type: crypt.Type, Params: backend.Params{"remote": "mem:/", "password": "p"}},
+		{Name: "vault", Type: alias.Type, Params: backend.Params{"remote": "secure:/sub"}},
+		// 同じ置き場所を、同じパスワードで読むだけにしたもの。
+		{Name: "ro", Type: crypt.Type, Params: backend.Params{"remote": "mem:/", "password": "p"},
+			Policy: backend.Policy{ReadOnly: true}},
+	})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	defer r.Close()
+
+	secure, err := r.Get(ctx, "secure")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	src := memory.New("src")
+	for p, content := range map[string]string{"/data/a.txt": "あ", "/data/b.txt": "い"} {
+		if _, err := src.Put(ctx, p, strings.NewReader(content), storage.ObjectMeta{Size: int64(len(content))}); err != nil {
+			t.Fatalf("Put(%s): %v", p, err)
+		}
+	}
+	for p, content := range map[string]string{"/sub/data/a.txt": "あ", "/sub/data/b.txt": "違う"} {
+		if _, err := secure.Put(ctx, p, strings.NewReader(content), storage.ObjectMeta{Size: int64(len(content))}); err != nil {
+			t.Fatalf("Put(%s): %v", p, err)
+		}
+	}
+
+	for _, tt := range []struct{ name, dir string }{
+		{"vault", "/"},
+		{"ro", "/sub"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, err := r.Get(ctx, tt.name)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if !storage.CanVerify(dst) {
+				t.Fatal("包まれた crypt を照合できないと答えた")
+			}
+
+			rows, err := cryptcheck(ctx, src, "/data", dst, tt.dir)
+			if err != nil {
+				t.Fatalf("cryptcheck: %v", err)
+			}
+			got := map[string]string{}
+			for _, row := range rows {
+				got[row.path] = row.reason
+			}
+			if got["a.txt"] != "一致" || got["b.txt"] != "内容が違う" || len(got) != 2 {
+				t.Errorf("結果 = %v", got)
+			}
+		})
+	}
+}
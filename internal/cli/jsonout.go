@@ -74,6 +74,8 @@ type jsonSummary struct {
 	Failed       int      `json:"failed"`
 	Deleted      int      `json:"deleted,omitempty"`
 	DeleteFailed int      `json:"delete_failed,omitempty"`
+	BackedUp     int      `json:"backed_up,omitempty"`
+	Renamed      int      `json:"renamed,omitempty"`
 	Bytes        int64    `json:"bytes"`
 	BytesSkipped int64    `json:"bytes_skipped"`
 	ElapsedMS    int64    `json:"elapsed_ms"`
@@ -142,6 +144,8 @@ func (j *jsonWriter) summary(r *transfer.Result) {
 		Failed:       r.Failed,
 		Deleted:      r.Deleted,
 		DeleteFailed: r.DeleteFailed,
+		BackedUp:     r.BackedUp,
+		Renamed:      r.Renamed,
 		Bytes:        r.Bytes,
 		BytesSkipped: r.BytesSkipped,
 		ElapsedMS:    r.Elapsed.Round(time.Millisecond).Milliseconds(),
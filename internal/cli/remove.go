@@ -52,6 +52,10 @@ func runRemove(cmd *cobra.Command, _ []string) error {
 
 // remove は指定されたパスを中身ごと削除します。
 func remove(ctx context.Context, s storage.Storage, path string) error {
+	// 消せないストレージなら、一覧を取りに行く前に断る。
+	if err := storage.Permit(s, "remove"); err != nil {
+		return err
+	}
 	// もとはエラーメッセージに引数の path ではなく
 	// パッケージ変数を使っていたため、シェルなど別経路から
 	// 呼んだときに誤ったパスが表示されていた。
@@ -7,7 +7,9 @@ import (
 	"strings"
 
 	"github.com/mt3hr/hbg/backend"
+	"github.com/mt3hr/hbg/backend/box"
 	"github.com/mt3hr/hbg/backend/dropbox"
+	"github.com/mt3hr/hbg/backend/gcs"
 	"github.com/mt3hr/hbg/backend/googledrive"
 	"github.com/mt3hr/hbg/backend/onedrive"
 	"github.com/spf13/cast"
@@ -24,6 +26,9 @@ import (
 //
 // 種別ごとの項目は type と name 以外そのまま Params へ入るので、
 // 新しいストレージを足してもここは変わりません。
+//
+// read_only・no_delete・append_only は、どの種別にも書ける変更の制限です。
+// 種別ごとの実装には渡さず、backend.Policy として Resolver がまとめて効かせます。
 
 // StorageEntry は storages: の1件です。
 type StorageEntry struct {
@@ -31,6 +36,12 @@ type StorageEntry struct {
 	Name string
 	// Type はストレージの種別です。
 	Type string
+	// ReadOnly は変更をすべて禁じます。
+	ReadOnly bool `mapstructure:"read_only"`
+	// NoDelete は削除と移動を禁じます。
+	NoDelete bool `mapstructure:"no_delete"`
+	// AppendOnly は新しく置くことだけを許します。
+	AppendOnly bool `mapstructure:"append_only"`
 	// Params は name と type 以外の指定をまとめたものです。
 	// 種別ごとに何が使えるかは hbg config init が書き出す雛形を見てください。
 	Params map[string]any `mapstructure:",remain"`
@@ -40,10 +51,17 @@ type StorageEntry struct {
 //
 // ${環境変数} は展開します。秘密情報を設定ファイルに直接書かずに済むよう、
 // どの項目でも使えるようにしています。
+//
+// YAML の並びは1行に1つずつ並べた文字列にします。backend.Params.List で
+// 取り出せます。
 func (e StorageEntry) params() backend.Params {
 	p := backend.Params{}
 	for k, v := range e.Params {
-		p.Set(k, os.ExpandEnv(cast.ToString(v)))
+		s := cast.ToString(v)
+		if list, ok := v.([]any); ok {
+			s = strings.Join(cast.ToStringSlice(list), "\n")
+		}
+		p.Set(k, os.ExpandEnv(s))
 	}
 	return p
 }
@@ -64,6 +82,11 @@ func storageEntries(c *Config) ([]backend.Entry, error) {
 			Name:   e.Name,
 			Type:   e.Type,
 			Params: e.params(),
+			Policy: backend.Policy{
+				ReadOnly:   e.ReadOnly,
+				NoDelete:   e.NoDelete,
+				AppendOnly: e.AppendOnly,
+			},
 		})
 	}
 
@@ -93,7 +116,7 @@ func authRequiredEntries(c *Config) []backend.Entry {
 
 	out := []backend.Entry{}
 	for _, e := range entries {
-		if needsAuth(e.Type) {
+		if needsAuth(e) {
 			out = append(out, e)
 		}
 	}
@@ -101,11 +124,16 @@ func authRequiredEntries(c *Config) []backend.Entry {
 	return out
 }
 
-// needsAuth は、その種別が hbg auth login を必要とするかを返します。
-func needsAuth(storageType string) bool {
-	switch storageType {
-	case dropbox.Type, googledrive.Type, onedrive.Type:
+// needsAuth は、そのストレージが hbg auth login を必要とするかを返します。
+//
+// gcs はサービスアカウントの鍵があれば login が要らないので、
+// 種別だけでなく設定も見ます。
+func needsAuth(e backend.Entry) bool {
+	switch e.Type {
+	case dropbox.Type, googledrive.Type, onedrive.Type, box.Type:
 		return true
+	case gcs.Type:
+		return gcsConfig(e).UsesOAuth()
 	}
 	return false
 }
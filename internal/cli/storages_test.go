@@ -3,9 +3,11 @@ package cli
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
+	"github.com/mt3hr/hbg/backend"
 	"github.com/spf13/viper"
 )
 
@@ -77,6 +79,59 @@ storages:
 	}
 }
 
+// YAML の並びは1行に1つずつ並べて渡し、空白を含む値も分けずに取り出せることを確かめます。
+func TestStorageEntriesList(t *testing.T) {
+	t.Setenv("HBG_TEST_POOL", "Pool")
+
+	cfg := loadConfigFrom(t, `
+storages:
+  - name: pool
+    type: union
+    upstreams:
+      - disk1:/My ${HBG_TEST_POOL}
+      - old:/Old Archive:ro
+`)
+
+	entries, err := storageEntries(cfg)
+	if err != nil {
+		t.Fatalf("storageEntries: %v", err)
+	}
+	got := entries[0].Params.List("upstreams")
+	want := []string{"disk1:/My Pool", "old:/Old Archive:ro"}
+	if !slices.Equal(got, want) {
+		t.Errorf("upstreams = %q, want %q", got, want)
+	}
+}
+
+// 変更の制限は種別ごとの設定に混ぜず、Policy として渡すことを確かめます。
+func TestStorageEntriesPolicy(t *testing.T) {
+	cfg := loadConfigFrom(t, `
+storages:
+  - name: archive
+    type: s3
+    bucket: backups
+    read_only: true
+  - name: originals
+    type: local
+    no_delete: true
+    append_only: true
+`)
+
+	entries, err := storageEntries(cfg)
+	if err != nil {
+		t.Fatalf("storageEntries: %v", err)
+	}
+	if got := entries[0].Policy; got != (backend.Policy{ReadOnly: true}) {
+		t.Errorf("archive の Policy = %+v", got)
+	}
+	if got := entries[1].Policy; got != (backend.Policy{NoDelete: true, AppendOnly: true}) {
+		t.Errorf("originals の Policy = %+v", got)
+	}
+	if got := entries[0].Params.Get("read_only"); got != "" {
+		t.Errorf("params に read_only が混ざった: %q", got)
+	}
+}
+
 // 書き方の誤りは、接続を試みる前に知らせることを確かめます。
 func TestStorageEntriesRejectsIncomplete(t *testing.T) {
 	tests := []struct {
@@ -152,3 +207,32 @@ func TestDefaultConfigIsLoadable(t *testing.T) {
 		t.Errorf("雛形から解決器を作れません: %v", err)
 	}
 }
+
+// gcs はサービスアカウントの鍵があれば hbg auth login を求めないことを確かめます。
+// box は常に求めます。
+func TestAuthRequiredEntries(t *testing.T) {
+	cfg := loadConfigFrom(t, `
+storages:
+  - name: local
+    type: local
+  - name: drive
+    type: googledrive
+  - name: gcs-oauth
+    type: gcs
+    bucket: b
+  - name: gcs-key
+    type: gcs
+    bucket: b
+    service_account_file: key.json
+  - name: box
+    type: box
+`)
+
+	var names []string
+	for _, e := range authRequiredEntries(cfg) {
+		names = append(names, e.Name)
+	}
+	if got, want := strings.Join(names, ","), "box,drive,gcs-oauth"; got != want {
+		t.Errorf("認証が必要なもの = %s, want %s", got, want)
+	}
+}
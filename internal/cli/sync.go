@@ -29,6 +29,10 @@ var syncCmd = &cobra.Command{
     例外は hbg 自身が置き去りにした書き込み中ファイル(.hbgpart)で、
     これは利用者のデータではないので絞り込みに関わらず片付けます。
 
+--track-renames を付けると、コピー元で場所や名前を変えただけのものを、
+送り直さずにコピー先の中で移動します。写真の整理などでフォルダを
+組み替えたときに、すべてを送り直さずに済みます。
+
 --dry-run を付けると、何が消えるかだけを確かめられます。
 はじめて実行するときは、まずこちらで確かめてください。
 
@@ -45,6 +49,9 @@ hbg sync --delete local:C:/photos dropbox:/backup
 	Args:    cobra.ExactArgs(2),
 	PreRunE: copyCmd.PreRunE,
 	RunE: func(cmd *cobra.Command, _ []string) error {
+		if syncOpt.trackRenames && !syncOpt.delete {
+			return withExitCode(ExitUsage, fmt.Errorf("--track-renames は --delete と併せて指定してください"))
+		}
 		return runTransfer(cmd, syncOpt.delete)
 	},
 }
@@ -52,15 +59,19 @@ hbg sync --delete local:C:/photos dropbox:/backup
 var syncOpt = struct {
 	delete          bool
 	deleteOnPartial bool
+	trackRenames    bool
 }{}
 
 func init() {
 	fs := syncCmd.Flags()
 	registerTransferFlags(fs)
+	registerResumeFlag(fs)
 	fs.BoolVar(&syncOpt.delete, "delete", false,
 		"コピー元にないものをコピー先から削除する")
 	fs.BoolVar(&syncOpt.deleteOnPartial, "delete-on-partial", false,
 		"転送に失敗があっても削除する（--delete と併用）")
+	fs.BoolVar(&syncOpt.trackRenames, "track-renames", false,
+		"場所や名前を変えただけのものを、送り直さずにコピー先で移動する（--delete と併用）")
 }
 
 // deleteSummary は削除の結果を1行にまとめます。
@@ -10,13 +10,15 @@
 //	├── tokens/              OAuth トークン
 //	├── credentials/         ストレージ固有の資格情報
 //	├── logs/                ログ
-//	├── caches/              キャッシュ・再開情報
+//	├── caches/              キャッシュ・再開情報・双方向同期の記録
 //	└── shell_history        対話シェルの履歴
 //
 // hbg が読み書きするのはこの配置だけです。
 package hbghome
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -128,6 +130,48 @@ func TokenFile(storageType, name string) (string, error) {
 	return filepath.Join(dir, fmt.Sprintf("%s_%s.json", storageType, name)), nil
 }
 
+// BisyncStateFile は双方向同期の記録を置くパスを返します。
+//
+// 組み合わせごとに別のファイルにします。path1 と path2 をそのまま
+// 名前に使うと区切り文字や使えない文字が混じるので、ハッシュにします。
+// 向きも区別します。入れ替えて実行すると、記録の両側が食い違うためです。
+func BisyncStateFile(path1, path2 string) (string, error) {
+	return keyedCacheFile("bisync", path1+"\n"+path2, ".json")
+}
+
+// JournalFile は転送の途中経過の記録を置くパスを返します。
+//
+// key には、コピー元・コピー先と、判断に関わる指定をまとめたものを渡します。
+// 指定を変えて実行したときに、前の記録を取り違えて使わないためです。
+func JournalFile(key string) (string, error) {
+	return keyedCacheFile("journal", key, ".log")
+}
+
+// HashDBFile は、hasher の種別がハッシュを記録するファイルのパスを返します。
+//
+// key には、ストレージの名前と重ねる先をまとめたものを渡します。
+func HashDBFile(key string) (string, error) {
+	return keyedCacheFile("hashes", key, ".jsonl")
+}
+
+// StorageCacheDir は、cache の種別が一覧と内容を控えるディレクトリを返します。
+//
+// key には、ストレージの名前と重ねる先をまとめたものを渡します。
+// 設定で重ねる先を変えたときに、前の控えを取り違えて使わないためです。
+func StorageCacheDir(key string) (string, error) {
+	return keyedCacheFile("storages", key, "")
+}
+
+// keyedCacheFile は caches/sub の下に、key ごとのファイルのパスを返します。
+func keyedCacheFile(sub, key, ext string) (string, error) {
+	dir, err := CachesDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, sub, hex.EncodeToString(sum[:8])+ext), nil
+}
+
 // EnsureDir はディレクトリを（親ごと）作成します。すでにあれば何もしません。
 func EnsureDir(dir string) error {
 	if err := os.MkdirAll(dir, DirPerm); err != nil {
@@ -96,6 +96,80 @@ func TestTokenFile(t *testing.T) {
 	}
 }
 
+// 双方向同期の記録は、組み合わせと向きごとに別になることを確かめます。
+func TestBisyncStateFile(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv(EnvHome, root)
+
+	ab, err := BisyncStateFile("local:a:/x", "dropbox:b:/y")
+	if err != nil {
+		t.Fatalf("BisyncStateFile: %v", err)
+	}
+	if dir := filepath.Dir(ab); dir != filepath.Join(root, "caches", "bisync") {
+		t.Errorf("置き場所 = %q", dir)
+	}
+
+	again, _ := BisyncStateFile("local:a:/x", "dropbox:b:/y")
+	swapped, _ := BisyncStateFile("dropbox:b:/y", "local:a:/x")
+	if again != ab {
+		t.Errorf("同じ組み合わせで違うパスになった: %q と %q", ab, again)
+	}
+	if swapped == ab {
+		t.Error("向きを入れ替えても同じパスになった")
+	}
+}
+
+func TestJournalFile(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv(EnvHome, root)
+
+	a, err := JournalFile("local:a:/x\ndropbox:b:/y\nsize,modtime")
+	if err != nil {
+		t.Fatalf("JournalFile: %v", err)
+	}
+	if dir := filepath.Dir(a); dir != filepath.Join(root, "caches", "journal") {
+		t.Errorf("置き場所 = %q", dir)
+	}
+	b, _ := JournalFile("local:a:/x\ndropbox:b:/y\nsize,hash")
+	if a == b {
+		t.Error("指定が違うのに同じパスになった")
+	}
+}
+
+func TestStorageCacheDir(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv(EnvHome, root)
+
+	a, err := StorageCacheDir("slow\nsftp:/home")
+	if err != nil {
+		t.Fatalf("StorageCacheDir: %v", err)
+	}
+	if dir := filepath.Dir(a); dir != filepath.Join(root, "caches", "storages") {
+		t.Errorf("置き場所 = %q", dir)
+	}
+	b, _ := StorageCacheDir("slow\nsftp:/srv")
+	if a == b {
+		t.Error("重ねる先が違うのに同じパスになった")
+	}
+}
+
+func TestHashDBFile(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv(EnvHome, root)
+
+	a, err := HashDBFile("hashed\nsftp:/home")
+	if err != nil {
+		t.Fatalf("HashDBFile: %v", err)
+	}
+	if dir := filepath.Dir(a); dir != filepath.Join(root, "caches", "hashes") {
+		t.Errorf("置き場所 = %q", dir)
+	}
+	b, _ := HashDBFile("hashed\nsftp:/srv")
+	if a == b {
+		t.Error("重ねる先が違うのに同じパスになった")
+	}
+}
+
 func TestWriteSecretFile(t *testing.T) {
 	root := t.TempDir()
 	t.Setenv(EnvHome, root)
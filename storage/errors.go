@@ -24,6 +24,8 @@ var (
 	ErrNotEmpty = errors.New("空ではありません")
 	// ErrUnsupported はそのストレージが対応していない操作であることを表します。
 	ErrUnsupported = errors.New("対応していない操作です")
+	// ErrReadOnly は書き込みを許されていない場所への変更であることを表します。
+	ErrReadOnly = errors.New("読み取り専用です")
 )
 
 // Class は失敗の種類です。再試行してよいかを決めるのに使います。
@@ -129,7 +131,8 @@ func ClassOf(err error) Class {
 	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
 		return ClassCanceled
 	case errors.Is(err, ErrNotFound), errors.Is(err, ErrIsDir),
-		errors.Is(err, ErrNotDir), errors.Is(err, ErrUnsupported):
+		errors.Is(err, ErrNotDir), errors.Is(err, ErrUnsupported),
+		errors.Is(err, ErrReadOnly):
 		return ClassPermanent
 	case errors.Is(err, io.ErrUnexpectedEOF):
 		return ClassRetryable
@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"hash"
+	"hash/crc32"
 	"io"
 	"slices"
 )
@@ -23,7 +24,13 @@ const (
 	// 4MiB ごとのブロックの SHA-256 を連結し、それをもう一度 SHA-256 したものです。
 	DropboxContent HashType = "dropbox"
 	// QuickXor は OneDrive の quickXorHash です。
+	// 1バイトずつ 11 ビットずらしながら 160 ビットの値に XOR で畳み込み、
+	// 最後に長さを XOR したものです。
+	// OneDrive は base64 で返しますが、hbg では他と同じく16進で表します。
 	QuickXor HashType = "quickxor"
+	// CRC32C は Castagnoli の多項式による CRC-32 です。Google Cloud Storage が
+	// すべてのオブジェクトに持ちます。4バイトをビッグエンディアンで並べた16進で表します。
+	CRC32C HashType = "crc32c"
 )
 
 // HashSet はストレージが扱えるハッシュの集合です。
@@ -57,6 +64,10 @@ func NewHash(t HashType) (hash.Hash, error) {
 		return sha256.New(), nil
 	case DropboxContent:
 		return NewDropboxContentHash(), nil
+	case QuickXor:
+		return NewQuickXorHash(), nil
+	case CRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
 	}
 	return nil, fmt.Errorf("%w: ハッシュ %q", ErrUnsupported, t)
 }
@@ -157,3 +168,70 @@ func (d *dropboxContentHash) Reset() {
 
 func (d *dropboxContentHash) Size() int      { return sha256.Size }
 func (d *dropboxContentHash) BlockSize() int { return dropboxBlockSize }
+
+// quickXor の定数。
+const (
+	// quickXorSize は quickXorHash の大きさ（160 ビット）です。
+	quickXorSize = 20
+	// quickXorShift は1バイトごとにずらすビット数です。
+	quickXorShift = 11
+	// quickXorWidth は値の幅をビットで表したものです。
+	quickXorWidth = quickXorSize * 8
+)
+
+// quickXorHash は OneDrive の quickXorHash を計算します。
+//
+// k バイト目は (11k mod 160) ビット目から XOR されます。11×160 は 160 の
+// 倍数なので、160 バイト離れたバイトは同じ位置に重なります。そこで
+// 受け取ったバイトは位置を 160 で割った余りごとに XOR で溜めておき、
+// Sum のときにだけずらして畳み込みます。Write は1バイトあたり XOR 1回で済み、
+// Sum も状態を変えません。
+type quickXorHash struct {
+	// cells[i] は、位置を 160 で割った余りが i のバイトを XOR したものです。
+	cells [quickXorWidth]byte
+	// length はこれまでに受け取ったバイト数です。
+	length uint64
+}
+
+// NewQuickXorHash は OneDrive の quickXorHash を計算する hash.Hash を返します。
+func NewQuickXorHash() hash.Hash {
+	return &quickXorHash{}
+}
+
+func (q *quickXorHash) Write(p []byte) (int, error) {
+	i := int(q.length % quickXorWidth)
+	for _, b := range p {
+		q.cells[i] ^= b
+		i++
+		if i == quickXorWidth {
+			i = 0
+		}
+	}
+	q.length += uint64(len(p))
+	return len(p), nil
+}
+
+func (q *quickXorHash) Sum(b []byte) []byte {
+	// 末尾の1バイトは、160 ビットからはみ出して先頭へ回り込む分です。
+	var sum [quickXorSize + 1]byte
+	for i, c := range q.cells {
+		bit := (i * quickXorShift) % quickXorWidth
+		shifted := uint16(c) << (bit % 8)
+		sum[bit/8] ^= byte(shifted)
+		sum[bit/8+1] ^= byte(shifted >> 8)
+	}
+	sum[0] ^= sum[quickXorSize]
+
+	// 長さはリトルエンディアンで末尾の 8 バイトに XOR する。
+	for i := range 8 {
+		sum[quickXorSize-8+i] ^= byte(q.length >> (8 * i))
+	}
+	return append(b, sum[:quickXorSize]...)
+}
+
+func (q *quickXorHash) Reset() {
+	*q = quickXorHash{}
+}
+
+func (q *quickXorHash) Size() int      { return quickXorSize }
+func (q *quickXorHash) BlockSize() int { return quickXorWidth }
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"io"
 	"strings"
@@ -110,6 +111,93 @@ func TestDropboxContentHashReset(t *testing.T) {
 	}
 }
 
+// expectedQuickXorHash は Microsoft の参照実装と同じく、1ビットずつ
+// 素朴に計算したものです。まとめて畳み込む実装と一致することを確かめます。
+func expectedQuickXorHash(data []byte) []byte {
+	var sum [quickXorSize]byte
+	for k, b := range data {
+		for j := range 8 {
+			if b&(1<<j) == 0 {
+				continue
+			}
+			bit := (k*quickXorShift + j) % quickXorWidth
+			sum[bit/8] ^= 1 << (bit % 8)
+		}
+	}
+	for i := range 8 {
+		sum[quickXorSize-8+i] ^= byte(uint64(len(data)) >> (8 * i))
+	}
+	return sum[:]
+}
+
+// OneDrive が返す値（base64）と突き合わせます。
+func TestQuickXorHashReferenceVectors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"空", nil, "AAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+		{"1バイト", []byte{0x4a}, "SgAAAAAAAAAAAAAAAQAAAAAAAAA="},
+		{"2バイト", []byte{0xb5, 0xb4}, "taAFAAAAAAAAAAAAAgAAAAAAAAA="},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewQuickXorHash()
+			h.Write(tt.data)
+			if got := base64.StdEncoding.EncodeToString(h.Sum(nil)); got != tt.want {
+				t.Errorf("ハッシュが一致しない\n got: %s\nwant: %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuickXorHash(t *testing.T) {
+	// 160 バイトで位置が一巡し、160 ビットの端で先頭へ回り込む。
+	// その前後を押さえる。
+	for _, size := range []int{1, 14, 15, 159, 160, 161, 1760, 1761, 100000} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i*7 + i/251)
+		}
+
+		want := hex.EncodeToString(expectedQuickXorHash(data))
+		for _, chunk := range []int{1, 3, 160, 4096, size} {
+			h := NewQuickXorHash()
+			for i := 0; i < len(data); i += chunk {
+				end := min(i+chunk, len(data))
+				h.Write(data[i:end])
+			}
+			if got := hex.EncodeToString(h.Sum(nil)); got != want {
+				t.Errorf("%d バイトを %d バイトずつ\n got: %s\nwant: %s", size, chunk, got, want)
+			}
+		}
+	}
+}
+
+// Sum は状態を変えてはいけません。
+func TestQuickXorHashSumDoesNotMutate(t *testing.T) {
+	h := NewQuickXorHash()
+	h.Write([]byte("hello"))
+	first := hex.EncodeToString(h.Sum(nil))
+	if second := hex.EncodeToString(h.Sum(nil)); first != second {
+		t.Errorf("Sum を2回呼ぶと結果が変わる: %s / %s", first, second)
+	}
+
+	h.Write([]byte(" world"))
+	got := hex.EncodeToString(h.Sum(nil))
+	if want := hex.EncodeToString(expectedQuickXorHash([]byte("hello world"))); got != want {
+		t.Errorf("Sum のあとの Write で結果がおかしい\n got: %s\nwant: %s", got, want)
+	}
+
+	h.Reset()
+	h.Write([]byte("abc"))
+	if got, want := hex.EncodeToString(h.Sum(nil)), hex.EncodeToString(expectedQuickXorHash([]byte("abc"))); got != want {
+		t.Errorf("Reset 後の結果がおかしい\n got: %s\nwant: %s", got, want)
+	}
+}
+
 func TestCommonHash(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -155,7 +243,7 @@ func TestCommonHash(t *testing.T) {
 func TestMultiHasher(t *testing.T) {
 	data := "hello world"
 
-	w, sum, err := MultiHasher(MD5, SHA256, DropboxContent)
+	w, sum, err := MultiHasher(MD5, SHA256, DropboxContent, QuickXor)
 	if err != nil {
 		t.Fatalf("MultiHasher: %v", err)
 	}
@@ -164,8 +252,8 @@ func TestMultiHasher(t *testing.T) {
 	}
 
 	got := sum()
-	if len(got) != 3 {
-		t.Fatalf("結果の数 = %d, want 3", len(got))
+	if len(got) != 4 {
+		t.Fatalf("結果の数 = %d, want 4", len(got))
 	}
 	// MD5("hello world") の既知の値
 	if got[MD5] != "5eb63bbbe01eeed093cb22bb8f5acdc3" {
@@ -174,10 +262,29 @@ func TestMultiHasher(t *testing.T) {
 	if got[DropboxContent] != expectedDropboxHash([]byte(data)) {
 		t.Errorf("DropboxContent = %s", got[DropboxContent])
 	}
+	if want := hex.EncodeToString(expectedQuickXorHash([]byte(data))); got[QuickXor] != want {
+		t.Errorf("QuickXor = %s, want %s", got[QuickXor], want)
+	}
+}
+
+// CRC32C が Google Cloud Storage と同じ値になることを確かめます。
+//
+// GCS の説明にある値（"hello world" の crc32c は base64 で yZRlqg==）を16進にしたものです。
+func TestCRC32C(t *testing.T) {
+	w, sum, err := MultiHasher(CRC32C)
+	if err != nil {
+		t.Fatalf("MultiHasher: %v", err)
+	}
+	if _, err := io.WriteString(w, "hello world"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := sum()[CRC32C]; got != "c99465aa" {
+		t.Errorf("CRC32C = %s, want c99465aa", got)
+	}
 }
 
 func TestNewHashUnsupported(t *testing.T) {
-	if _, err := NewHash(QuickXor); err == nil {
+	if _, err := NewHash(HashType("crc32")); err == nil {
 		t.Error("未実装のハッシュでエラーにならない")
 	}
 }
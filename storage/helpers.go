@@ -15,20 +15,68 @@ import (
 // 1箇所に閉じ込めるためのものです。呼び出し側は「できるなら速い方法、
 // できないなら確実な方法」を意識せずに済みます。
 
+// Supports は、s が c の能力を実際に使えるかを返します。
+//
+// 型としてインターフェースを実装していても、CapabilityReporter が
+// 使えないと答えたものは使えないとします。
+func Supports(s Storage, c Capability) bool {
+	var ok bool
+	switch c {
+	case CapHash:
+		_, ok = s.(Hasher)
+	case CapServerSideCopy:
+		_, ok = s.(ServerSideCopier)
+	case CapMove:
+		_, ok = s.(Mover)
+	case CapRangeOpen:
+		_, ok = s.(RangeOpener)
+	case CapPurge:
+		_, ok = s.(Purger)
+	case CapSetModTime:
+		_, ok = s.(SetModTimer)
+	case CapResume:
+		_, ok = s.(Resumer)
+	case CapOffsetWrite:
+		_, ok = s.(OffsetWriter)
+	case CapListRecursive:
+		_, ok = s.(RecursiveLister)
+	case CapAbout:
+		_, ok = s.(Abouter)
+	case CapVerify:
+		_, ok = s.(Verifier)
+	}
+	if !ok {
+		return false
+	}
+	if r, isReporter := s.(CapabilityReporter); isReporter {
+		return r.Supports(c)
+	}
+	return true
+}
+
+// as は、s が c の能力を実際に使えるなら、そのインターフェースとして返します。
+func as[T any](s Storage, c Capability) (T, bool) {
+	if !Supports(s, c) {
+		var zero T
+		return zero, false
+	}
+	v, ok := s.(T)
+	return v, ok
+}
+
 // CanServerSideCopy は、src から dst へサーバー側コピーができるかを返します。
 // 同じストレージ（種別と名前が一致）でなければ使えません。
 func CanServerSideCopy(src, dst Storage) bool {
 	if src.Type() != dst.Type() || src.Name() != dst.Name() {
 		return false
 	}
-	_, ok := dst.(ServerSideCopier)
-	return ok
+	return Supports(dst, CapServerSideCopy)
 }
 
 // ServerSideCopy は内容を転送せずにコピーします。
 // できない場合は ErrUnsupported を返します。
 func ServerSideCopy(ctx context.Context, src, dst Storage, srcPath, dstPath string) (*FileInfo, error) {
-	copier, ok := dst.(ServerSideCopier)
+	copier, ok := as[ServerSideCopier](dst, CapServerSideCopy)
 	if !ok || !CanServerSideCopy(src, dst) {
 		return nil, fmt.Errorf("%w: サーバー側コピー", ErrUnsupported)
 	}
@@ -38,7 +86,11 @@ func ServerSideCopy(ctx context.Context, src, dst Storage, srcPath, dstPath stri
 // Move は同じストレージ内でファイルを移動します。
 // Mover を実装していない場合はコピーしてから削除します。
 func Move(ctx context.Context, s Storage, srcPath, dstPath string) error {
-	if mover, ok := s.(Mover); ok {
+	// コピーまで済ませてから、元を消せずに止まることのないよう先に確かめる。
+	if err := Permit(s, "move"); err != nil {
+		return err
+	}
+	if mover, ok := as[Mover](s, CapMove); ok {
 		return mover.Move(ctx, srcPath, dstPath)
 	}
 
@@ -64,10 +116,21 @@ func Move(ctx context.Context, s Storage, srcPath, dstPath string) error {
 	return s.Remove(ctx, srcPath)
 }
 
+// CanMove は、内容を運ばずに移動できるかを返します。
+//
+// Move は Mover でなくても動きますが、その場合は読み直して書き直すので、
+// 「運ばずに済ませたい」場面では使えるかを先に確かめてください。
+func CanMove(s Storage) bool {
+	return Supports(s, CapMove)
+}
+
 // PurgeAll はディレクトリを中身ごと削除します。
 // Purger を実装していない場合は、後行順にたどって1件ずつ削除します。
 func PurgeAll(ctx context.Context, s Storage, dir string) error {
-	if purger, ok := s.(Purger); ok {
+	if err := Permit(s, "purge"); err != nil {
+		return err
+	}
+	if purger, ok := as[Purger](s, CapPurge); ok {
 		return purger.Purge(ctx, dir)
 	}
 
@@ -90,6 +153,15 @@ func PurgeAll(ctx context.Context, s Storage, dir string) error {
 	return s.Remove(ctx, dir)
 }
 
+// Permit は、s で op の変更が許されているかを返します。
+// Permitter を実装していなければ、すべて許されているとします。
+func Permit(s Storage, op string) error {
+	if p, ok := s.(Permitter); ok {
+		return p.Permit(op)
+	}
+	return nil
+}
+
 // ListAll はディレクトリの中身をすべて集めて返します。
 //
 // List はメモリを一定に保つためコールバック型ですが、
@@ -121,6 +193,76 @@ func ListAllSorted(ctx context.Context, s Storage, dir string) ([]FileInfo, erro
 	return entries, nil
 }
 
+// CanListRecursive は、s が配下をまとめて一覧できるかを返します。
+func CanListRecursive(s Storage) bool {
+	return Supports(s, CapListRecursive)
+}
+
+// ListTree は dir の配下をまとめて一覧し、ディレクトリごとに引ける形で返します。
+//
+// まとめて一覧できないストレージではエラーを返します。呼び出し側は
+// CanListRecursive で確かめてから使ってください。
+func ListTree(ctx context.Context, s Storage, dir string) (*Tree, error) {
+	lister, ok := as[RecursiveLister](s, CapListRecursive)
+	if !ok {
+		return nil, fmt.Errorf("%s: 配下をまとめて一覧できません: %w", s.Type(), ErrUnsupported)
+	}
+	t := NewTree(s, dir)
+	if err := lister.ListRecursive(ctx, dir, func(fi FileInfo) error {
+		t.add(fi)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	t.addDir(t.root)
+	return t, nil
+}
+
+// ListRecursive は dir の配下をまとめて一覧します。
+// まとめて一覧できなければ ErrUnsupported を返します。
+func ListRecursive(ctx context.Context, s Storage, dir string, fn func(FileInfo) error) error {
+	lister, ok := as[RecursiveLister](s, CapListRecursive)
+	if !ok {
+		return fmt.Errorf("%s: 配下をまとめて一覧できません: %w", s.Type(), ErrUnsupported)
+	}
+	return lister.ListRecursive(ctx, dir, fn)
+}
+
+// OpenRange は offset から length バイトを読む ReadCloser を返します。
+// 途中から読めなければ ErrUnsupported を返します。
+func OpenRange(ctx context.Context, s Storage, path string, offset, length int64) (io.ReadCloser, error) {
+	opener, ok := as[RangeOpener](s, CapRangeOpen)
+	if !ok {
+		return nil, fmt.Errorf("%w: 途中からの読み出し", ErrUnsupported)
+	}
+	return opener.OpenRange(ctx, path, offset, length)
+}
+
+// About は path を含む置き場所の使用量を返します。
+// 答えられなければ ErrUnsupported を返します。
+func About(ctx context.Context, s Storage, path string) (*Usage, error) {
+	abouter, ok := as[Abouter](s, CapAbout)
+	if !ok {
+		return nil, fmt.Errorf("%w: 容量の取得", ErrUnsupported)
+	}
+	return abouter.About(ctx, path)
+}
+
+// CanVerify は、s が置いてある内容を平文と照合できるかを返します。
+func CanVerify(s Storage) bool {
+	return Supports(s, CapVerify)
+}
+
+// Verify は、s の path に置いてある内容が plain と同じかを確かめます。
+// 照合できなければ ErrUnsupported を返します。
+func Verify(ctx context.Context, s Storage, path string, plain io.Reader) error {
+	verifier, ok := as[Verifier](s, CapVerify)
+	if !ok {
+		return fmt.Errorf("%w: 平文との照合", ErrUnsupported)
+	}
+	return verifier.Verify(ctx, path, plain)
+}
+
 // Exists はパスが存在するかを返します。
 func Exists(ctx context.Context, s Storage, path string) (bool, error) {
 	_, err := s.Stat(ctx, path)
@@ -141,7 +283,7 @@ func IsNotFound(err error) bool {
 // SetModTime は最終更新時刻を変更します。
 // 対応していない場合は ErrUnsupported を返します。
 func SetModTime(ctx context.Context, s Storage, path string, t time.Time) error {
-	setter, ok := s.(SetModTimer)
+	setter, ok := as[SetModTimer](s, CapSetModTime)
 	if !ok {
 		return fmt.Errorf("%w: 更新時刻の変更", ErrUnsupported)
 	}
@@ -159,7 +301,7 @@ func GetHash(ctx context.Context, s Storage, info *FileInfo, ht HashType) (strin
 		}
 	}
 
-	hasher, ok := s.(Hasher)
+	hasher, ok := as[Hasher](s, CapHash)
 	if !ok {
 		return "", fmt.Errorf("%w: ハッシュ %s の取得", ErrUnsupported, ht)
 	}
@@ -178,15 +320,27 @@ type CopyOptions struct {
 	// VerifyHash に種類を指定すると、転送しながら計算したハッシュと
 	// 書き込み後のハッシュを突き合わせます。
 	VerifyHash HashType
+	// Streams が2以上なら、MultiStreamCopy と ResumeCopy は内容を範囲に
+	// 分けて、その本数で同時に読みます。Wrap は範囲ごとに割り込みます。
+	Streams int
+	// ChunkSize は同時に読むときの1つの範囲の大きさです。
+	// 0 なら DefaultChunkSize です。
+	ChunkSize int64
 }
 
 // Copy は src の1ファイルを dst へコピーします。
 //
 // 同じストレージ内でサーバー側コピーが使える場合はそちらを使い、
 // 使えない場合は内容を読んで書き込みます。
+//
+// サーバー側コピーが ErrUnsupported を返したときも、読んで書きます。
+// 束ねるストレージ（combine）は、パスによってはサーバー側でコピーできません。
 func Copy(ctx context.Context, src Storage, srcPath string, dst Storage, dstPath string, opts CopyOptions) (*FileInfo, error) {
-	if copier, ok := dst.(ServerSideCopier); ok && CanServerSideCopy(src, dst) {
-		return copier.ServerSideCopy(ctx, srcPath, dstPath)
+	if copier, ok := as[ServerSideCopier](dst, CapServerSideCopy); ok && CanServerSideCopy(src, dst) {
+		fi, err := copier.ServerSideCopy(ctx, srcPath, dstPath)
+		if !errors.Is(err, ErrUnsupported) {
+			return fi, err
+		}
 	}
 
 	rc, info, err := src.Open(ctx, srcPath)
@@ -199,7 +353,11 @@ func Copy(ctx context.Context, src Storage, srcPath string, dst Storage, dstPath
 	if opts.Wrap != nil {
 		r = opts.Wrap(r)
 	}
+	return putChecked(ctx, dst, dstPath, r, *info, opts)
+}
 
+// putChecked は r の内容を dst へ書き、大きさとハッシュを確かめます。
+func putChecked(ctx context.Context, dst Storage, dstPath string, r io.Reader, info FileInfo, opts CopyOptions) (*FileInfo, error) {
 	var sum func() map[HashType]string
 	if opts.VerifyHash != "" {
 		w, getSum, hashErr := MultiHasher(opts.VerifyHash)
@@ -221,15 +379,226 @@ func Copy(ctx context.Context, src Storage, srcPath string, dst Storage, dstPath
 
 	// 宣言されたサイズと実際に書かれたサイズの食い違いは、
 	// 内容が切り詰められたことを意味する。必ず検査する。
-	if info.Size != SizeUnknown && written.Size != SizeUnknown && written.Size != info.Size {
-		return nil, fmt.Errorf("転送したサイズが一致しません（元 %d バイト、先 %d バイト）: %s",
-			info.Size, written.Size, dstPath)
+	if err := checkWrittenSize(info.Size, written, dstPath); err != nil {
+		return nil, err
+	}
+
+	if sum != nil {
+		if err := verifyHash(sum(), written, opts.VerifyHash, dstPath); err != nil {
+			return nil, err
+		}
+	}
+	return written, nil
+}
+
+// CanMultiStream は、src から dst への転送で内容を範囲に分けて
+// 同時に読めるかを返します。
+//
+// 読み出し元が RangeOpener である必要があります。サーバー側コピーが
+// 使える組み合わせでは使いません。内容が流れないためです。
+func CanMultiStream(src, dst Storage) bool {
+	if CanServerSideCopy(src, dst) {
+		return false
+	}
+	return Supports(src, CapRangeOpen)
+}
+
+// MultiStreamCopy は src の1ファイルを、範囲に分けて同時に読みながら
+// dst へコピーします。
+//
+// 書き込み先が OffsetWriter なら、届いた範囲をその位置へ直接書きます。
+// ただし VerifyHash を指定した場合は、先頭から順に並べ直して Put へ
+// 流します。ハッシュは先頭から順に計算するしかないためです。
+//
+// 範囲に分けられない場合（RangeOpener でない、大きさが分からない、
+// Streams が2未満）は Copy と同じです。
+func MultiStreamCopy(
+	ctx context.Context,
+	src Storage, srcInfo FileInfo,
+	dst Storage, dstPath string,
+	opts CopyOptions,
+) (*FileInfo, error) {
+	opener, ok := as[RangeOpener](src, CapRangeOpen)
+	if !ok || opts.Streams < 2 || srcInfo.Size == SizeUnknown || !CanMultiStream(src, dst) {
+		return Copy(ctx, src, srcInfo.Path, dst, dstPath, opts)
+	}
+
+	meta := ObjectMeta{
+		Size:    srcInfo.Size,
+		ModTime: srcInfo.ModTime,
+		Hashes:  srcInfo.Hashes,
+	}
+
+	if ow, ok := as[OffsetWriter](dst, CapOffsetWrite); ok && opts.VerifyHash == "" {
+		pw, err := ow.OpenWriterAt(ctx, dstPath, srcInfo.Size)
+		if err != nil {
+			return nil, err
+		}
+		defer pw.Abort()
+
+		if err := writeRangesAt(ctx, opener, srcInfo.Path, srcInfo.Size, pw,
+			opts.Streams, opts.ChunkSize, opts.Wrap); err != nil {
+			return nil, err
+		}
+		written, err := pw.Commit(ctx, meta)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkWrittenSize(srcInfo.Size, written, dstPath); err != nil {
+			return nil, err
+		}
+		return written, nil
+	}
+
+	rr := newRangeReader(ctx, opener, srcInfo.Path, 0, srcInfo.Size,
+		opts.Streams, opts.ChunkSize, opts.Wrap)
+	defer rr.Close()
+	return putChecked(ctx, dst, dstPath, rr, srcInfo, opts)
+}
+
+// checkWrittenSize は、書かれた大きさが宣言どおりかを確かめます。
+func checkWrittenSize(want int64, written *FileInfo, dstPath string) error {
+	if want != SizeUnknown && written.Size != SizeUnknown && written.Size != want {
+		return fmt.Errorf("転送したサイズが一致しません（元 %d バイト、先 %d バイト）: %s",
+			want, written.Size, dstPath)
+	}
+	return nil
+}
+
+// CanResume は、src から dst への転送を書きかけの続きから行えるかを返します。
+//
+// 書き込み先が Resumer で、読み出し元が RangeOpener である必要があります。
+// サーバー側コピーが使える組み合わせでは使いません。内容が流れないので、
+// 続きから送る意味がないためです。
+func CanResume(src, dst Storage) bool {
+	if CanServerSideCopy(src, dst) {
+		return false
+	}
+	if !Supports(dst, CapResume) {
+		return false
+	}
+	return Supports(src, CapRangeOpen)
+}
+
+// PartialOf は path に対する書きかけのメタデータを返します。
+// 書きかけが無ければ ErrNotFound を、対応していなければ ErrUnsupported を返します。
+func PartialOf(ctx context.Context, s Storage, path string) (*FileInfo, error) {
+	resumer, ok := as[Resumer](s, CapResume)
+	if !ok {
+		return nil, fmt.Errorf("%w: 書きかけからの再開", ErrUnsupported)
+	}
+	return resumer.Partial(ctx, path)
+}
+
+// PutResume は書きかけの offset バイト目から続きを書きます。
+// 対応していなければ ErrUnsupported を返します。
+func PutResume(ctx context.Context, s Storage, path string, offset int64, r io.Reader, meta ObjectMeta) (*FileInfo, error) {
+	resumer, ok := as[Resumer](s, CapResume)
+	if !ok {
+		return nil, fmt.Errorf("%w: 書きかけからの再開", ErrUnsupported)
+	}
+	return resumer.PutResume(ctx, path, offset, r, meta)
+}
+
+// OpenWriterAt は好きな位置へ書ける書き込み口を開きます。
+// 対応していなければ ErrUnsupported を返します。
+func OpenWriterAt(ctx context.Context, s Storage, path string, size int64) (PartWriter, error) {
+	ow, ok := as[OffsetWriter](s, CapOffsetWrite)
+	if !ok {
+		return nil, fmt.Errorf("%w: 位置を指定した書き込み", ErrUnsupported)
+	}
+	return ow.OpenWriterAt(ctx, path, size)
+}
+
+// ResumeCopy は src の1ファイルを、dst にある書きかけの offset バイト目から
+// 続けてコピーします。offset が 0 なら最初から書きますが、失敗しても
+// 書きかけが残るので、次は続きから送れます。
+//
+// 書きかけの中身が srcInfo のものの先頭と一致しているかどうかは、
+// 呼び出し側が確かめてください。ここでは続きを足すことしかしません。
+//
+// VerifyHash を指定した場合、offset が 0 なら Copy と同じく転送しながら
+// 求めたハッシュで検証します。続きから書いたときは、続きだけのハッシュでは
+// 全体を検証できないので、書き込み先が返した全体のハッシュをコピー元の
+// ハッシュと突き合わせます。書きかけのぶんをコピー元から読み直すことは
+// しません。書き込み先がハッシュを返さなければ、読み直しても検証できず、
+// 続きから送る意味が無くなるためです。
+func ResumeCopy(
+	ctx context.Context,
+	src Storage, srcInfo FileInfo,
+	dst Storage, dstPath string,
+	offset int64, opts CopyOptions,
+) (*FileInfo, error) {
+	resumer, ok := as[Resumer](dst, CapResume)
+	if !ok {
+		return nil, fmt.Errorf("%w: 書きかけからの再開", ErrUnsupported)
+	}
+	opener, ok := as[RangeOpener](src, CapRangeOpen)
+	if !ok {
+		return nil, fmt.Errorf("%w: 範囲読み出し", ErrUnsupported)
+	}
+
+	var sum func() map[HashType]string
+	var hw io.Writer
+	if opts.VerifyHash != "" && offset == 0 {
+		w, getSum, err := MultiHasher(opts.VerifyHash)
+		if err != nil {
+			return nil, err
+		}
+		hw, sum = w, getSum
+	}
+
+	var r io.Reader
+	if opts.Streams >= 2 && srcInfo.Size != SizeUnknown {
+		// 続きも範囲に分けて同時に読める。書きかけへは先頭から順に
+		// 書き足すしかないので、並べ直してから渡す。
+		rr := newRangeReader(ctx, opener, srcInfo.Path, offset, srcInfo.Size-offset,
+			opts.Streams, opts.ChunkSize, opts.Wrap)
+		defer rr.Close()
+		r = rr
+	} else {
+		rc, err := opener.OpenRange(ctx, srcInfo.Path, offset, -1)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+
+		r = rc
+		if opts.Wrap != nil {
+			r = opts.Wrap(r)
+		}
+	}
+	if hw != nil {
+		r = io.TeeReader(r, hw)
+	}
+
+	written, err := resumer.PutResume(ctx, dstPath, offset, r, ObjectMeta{
+		Size:    srcInfo.Size,
+		ModTime: srcInfo.ModTime,
+		Hashes:  srcInfo.Hashes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkWrittenSize(srcInfo.Size, written, dstPath); err != nil {
+		return nil, err
 	}
 
 	if sum != nil {
 		if err := verifyHash(sum(), written, opts.VerifyHash, dstPath); err != nil {
 			return nil, err
 		}
+	} else if opts.VerifyHash != "" && written.Hashes[opts.VerifyHash] != "" {
+		// 書き込み先が全体のハッシュを返したときだけ、コピー元に問い合わせる。
+		want, err := GetHash(ctx, src, &srcInfo, opts.VerifyHash)
+		if err != nil {
+			return nil, err
+		}
+		computed := map[HashType]string{opts.VerifyHash: want}
+		if err := verifyHash(computed, written, opts.VerifyHash, dstPath); err != nil {
+			return nil, err
+		}
 	}
 	return written, nil
 }
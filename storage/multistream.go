@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// 大きなファイルを範囲に分けて同時に読む仕組みです。
+//
+// クラウドストレージは1本の接続あたりの速さに上限があることが多く、
+// 1つの大きなファイルを1本で読むと、回線に余裕があってもそこで頭打ちに
+// なります。範囲読み出し（RangeOpener）で何本かに分けて読めば、
+// そのぶん速く運べます。
+//
+//   - 書き込み先が OffsetWriter なら、届いた範囲をその位置へ直接書きます。
+//   - そうでなければ、先頭から順に並べ直して Put へ流します。
+//     並べ直しのために、同時に読む本数ぶんの範囲をメモリに持ちます。
+
+// DefaultChunkSize は、範囲に分けて読むときの1回の大きさの既定値です。
+const DefaultChunkSize = 16 << 20
+
+// rangeChunk は読み出した1つの範囲です。
+type rangeChunk struct {
+	data []byte
+	err  error
+}
+
+// rangeReader は、範囲に分けて同時に読んだ内容を、先頭から順に返します。
+type rangeReader struct {
+	// ctx は読みかけの範囲を取り消すためのものです。取り消されると、
+	// まだ読み始めていない範囲は読まれず、届くこともありません。
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// results[i] に i 番目の範囲が届きます。
+	results []chan rangeChunk
+	// slots は同時に持つ範囲の数を抑えます。読み終えた範囲の分だけ空きます。
+	slots chan struct{}
+
+	next int
+	cur  []byte
+	err  error
+}
+
+// newRangeReader は path の offset から length バイトを、streams 本に
+// 分けて読む Reader を返します。wrap は範囲ごとの読み取りに割り込みます。
+func newRangeReader(
+	ctx context.Context,
+	opener RangeOpener, path string,
+	offset, length int64,
+	streams int, chunkSize int64,
+	wrap func(io.Reader) io.Reader,
+) *rangeReader {
+	ctx, cancel := context.WithCancel(ctx)
+	ranges := splitRanges(offset, length, chunkSize)
+
+	r := &rangeReader{
+		ctx:     ctx,
+		cancel:  cancel,
+		results: make([]chan rangeChunk, len(ranges)),
+		slots:   make(chan struct{}, streams),
+	}
+	for i := range r.results {
+		r.results[i] = make(chan rangeChunk, 1)
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for i, rg := range ranges {
+			select {
+			case <-ctx.Done():
+				return
+			case r.slots <- struct{}{}:
+			}
+			r.wg.Add(1)
+			go func(out chan<- rangeChunk, rg [2]int64) {
+				defer r.wg.Done()
+				data, err := readRange(ctx, opener, path, rg[0], rg[1], wrap)
+				out <- rangeChunk{data: data, err: err}
+			}(r.results[i], rg)
+		}
+	}()
+	return r
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.next >= len(r.results) {
+			return 0, io.EOF
+		}
+		var c rangeChunk
+		select {
+		case c = <-r.results[r.next]:
+		case <-r.ctx.Done():
+			// 取り消されたあとは、読み始めなかった範囲が届くのを待っても来ない。
+			r.err = r.ctx.Err()
+			return 0, r.err
+		}
+		if c.err != nil {
+			r.err = c.err
+			r.cancel()
+			return 0, r.err
+		}
+		r.next++
+		r.cur = c.data
+		// 受け取った範囲はもう手元にあるので、次の範囲を読み始めてよい。
+		<-r.slots
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close は読みかけの範囲を取り消し、読み手が止まるのを待ちます。
+func (r *rangeReader) Close() error {
+	r.cancel()
+	r.wg.Wait()
+	return nil
+}
+
+// writeRangesAt は path の先頭から size バイトを streams 本に分けて読み、
+// 届いた範囲をそのまま w のその位置へ書きます。
+func writeRangesAt(
+	ctx context.Context,
+	opener RangeOpener, path string, size int64,
+	w io.WriterAt,
+	streams int, chunkSize int64,
+	wrap func(io.Reader) io.Reader,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ranges := make(chan [2]int64)
+	go func() {
+		defer close(ranges)
+		for _, rg := range splitRanges(0, size, chunkSize) {
+			select {
+			case <-ctx.Done():
+				return
+			case ranges <- rg:
+			}
+		}
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rg := range ranges {
+				if err := writeRangeAt(ctx, opener, path, rg[0], rg[1], w, wrap); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// splitRanges は offset から length バイトを chunkSize ごとの範囲に分けます。
+// 範囲は [開始位置, 長さ] で表します。
+func splitRanges(offset, length, chunkSize int64) [][2]int64 {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	var out [][2]int64
+	for off := offset; off < offset+length; off += chunkSize {
+		out = append(out, [2]int64{off, min(chunkSize, offset+length-off)})
+	}
+	return out
+}
+
+// readRange は1つの範囲を読み切ります。
+func readRange(
+	ctx context.Context,
+	opener RangeOpener, path string,
+	offset, length int64,
+	wrap func(io.Reader) io.Reader,
+) ([]byte, error) {
+	rc, err := opener.OpenRange(ctx, path, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	if wrap != nil {
+		r = wrap(r)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, rangeReadError(path, offset, length, err)
+	}
+	return data, nil
+}
+
+// writeRangeAt は1つの範囲を読み、w のその位置へ書きます。
+func writeRangeAt(
+	ctx context.Context,
+	opener RangeOpener, path string,
+	offset, length int64,
+	w io.WriterAt,
+	wrap func(io.Reader) io.Reader,
+) error {
+	rc, err := opener.OpenRange(ctx, path, offset, length)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	if wrap != nil {
+		r = wrap(r)
+	}
+	n, err := io.Copy(io.NewOffsetWriter(w, offset), io.LimitReader(r, length))
+	if err != nil {
+		return err
+	}
+	if n != length {
+		return rangeReadError(path, offset, length, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// rangeReadError は範囲を読み切れなかったことを表すエラーを作ります。
+//
+// 途中で切れたのは、読んでいる間にコピー元が短くなったか、接続が
+// 切れたかのどちらかです。どちらも、やり直せば済むことがあります。
+func rangeReadError(path string, offset, length int64, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("コピー元の %d バイト目から %d バイトを読み切れませんでした: %s: %w",
+			offset, length, path, io.ErrUnexpectedEOF)
+	}
+	return err
+}
@@ -44,3 +44,133 @@ type Purger interface {
 type SetModTimer interface {
 	SetModTime(ctx context.Context, path string, t time.Time) error
 }
+
+// Resumer は、書きかけのファイルの続きから書き込めるストレージです。
+//
+// 大きなファイルの転送が途中で止まっても、次の試行や次の実行で
+// 最初から送り直さずに済みます。書きかけは Put と同じ印（.hbgpart）の
+// 付いた決まった名前で置かれ、置き換えが済むまで本来の名前には現れません。
+type Resumer interface {
+	// Partial は path に対する書きかけのメタデータを返します。
+	// Size は書きかけに含まれるバイト数、ModTime は最後に書き込んだ時刻です。
+	// 書きかけが無ければ ErrNotFound を含むエラーを返します。
+	Partial(ctx context.Context, path string) (*FileInfo, error)
+
+	// PutResume は書きかけの offset バイト目から r の内容を書き足し、
+	// 書き終えたら path へ置き換えます。
+	//
+	//   - offset が 0 なら書きかけを作り直します。
+	//   - offset は Partial が返した大きさを渡してください。
+	//     書きかけの大きさと食い違う場合は ErrNotFound を含むエラーを返します。
+	//   - 失敗しても、取り消されても、書きかけは消しません。
+	//     次の試行で続きから書くためです。確かに書けたところまでで
+	//     切り詰めて残します。
+	//   - 戻り値の Size は、書きかけを含めたファイル全体の大きさです。
+	PutResume(ctx context.Context, path string, offset int64, r io.Reader, meta ObjectMeta) (*FileInfo, error)
+}
+
+// OffsetWriter は、ファイルの好きな位置へ書き込めるストレージです。
+//
+// 大きなファイルを範囲に分けて同時に読むとき、届いた範囲をそのまま
+// その位置へ書けます。先頭から順に並べ直すためにメモリへ溜めずに済みます。
+type OffsetWriter interface {
+	// OpenWriterAt は size バイトのファイルを書く口を開きます。
+	// 書いている間は path には現れず、Commit で置き換わります。
+	OpenWriterAt(ctx context.Context, path string, size int64) (PartWriter, error)
+}
+
+// PartWriter は OffsetWriter が開いた書き込み口です。
+//
+// WriteAt は複数のゴルーチンから同時に、重ならない範囲へ呼べます。
+type PartWriter interface {
+	io.WriterAt
+	// Commit は書き終えた内容を path へ置き換えます。
+	Commit(ctx context.Context, meta ObjectMeta) (*FileInfo, error)
+	// Abort は書いた内容を捨てます。Commit のあとに呼んでも何もしません。
+	Abort() error
+}
+
+// RecursiveLister は、ディレクトリの配下をまとめて一覧できるストレージです。
+//
+// クラウドストレージでは、ディレクトリ1つごとに一覧の往復がかかります。
+// 配下をまとめて返せるなら、ディレクトリの数だけの往復が数ページぶんで済みます。
+type RecursiveLister interface {
+	// ListRecursive は dir の配下のすべてを、深さを問わず1件ずつ fn に渡します。
+	//
+	//   - 渡す順番は決まっていません。親より先に子が来ることもあります。
+	//   - S3 のように、中身があることで存在するだけのディレクトリは
+	//     渡されないことがあります。ListTree が中身から補います。
+	//   - dir が無ければ ErrNotFound を含むエラーを返します。
+	ListRecursive(ctx context.Context, dir string, fn func(FileInfo) error) error
+}
+
+// Abouter は、置き場所の容量と空きを答えられるストレージです。
+//
+// 複数のストレージを束ねるとき（union）に、空きの多いところへ
+// 書くのに使います。
+type Abouter interface {
+	// About は path を含む置き場所（ボリュームや共有）の使用量を返します。
+	About(ctx context.Context, path string) (*Usage, error)
+}
+
+// Usage は置き場所の使用量です。分からない項目は SizeUnknown です。
+type Usage struct {
+	// Total は全体の大きさです。
+	Total int64
+	// Used は使っている量です。
+	Used int64
+	// Free は、このストレージの利用者がまだ書き込める量です。
+	Free int64
+}
+
+// Verifier は、置いてある内容が平文と同じかを確かめられるストレージです。
+//
+// 内容を変えて置くストレージ（crypt）では、置いてあるもののハッシュと
+// 平文のハッシュを比べても一致しません。自分の形に直して比べられるものが
+// 実装します。
+type Verifier interface {
+	// Verify は path に置いてある内容が plain と同じかを確かめます。
+	// 違えば、違うことを表すエラーを返します。
+	Verify(ctx context.Context, path string, plain io.Reader) error
+}
+
+// Permitter は、設定で一部の変更を禁じられたストレージです。
+//
+// 禁じられた変更はどのみち失敗しますが、中身を消して回る途中や、
+// 転送を始めたあとで失敗すると、どこまで進んだのかが分かりにくくなります。
+// 始める前にこれで確かめて、何もしないうちに止めます。
+type Permitter interface {
+	// Permit は op（"put", "mkdir", "remove", "move", "purge", "copy",
+	// "setmodtime"）が許されているかを返します。
+	// 許されていなければ ErrReadOnly を含むエラーを返します。
+	Permit(op string) error
+}
+
+// Capability は、ここに並ぶインターフェースの1つを表します。
+type Capability int
+
+// 能力の種類。
+const (
+	CapHash Capability = iota + 1
+	CapServerSideCopy
+	CapMove
+	CapRangeOpen
+	CapPurge
+	CapSetModTime
+	CapResume
+	CapOffsetWrite
+	CapListRecursive
+	CapAbout
+	CapVerify
+)
+
+// CapabilityReporter は、型としては実装しているインターフェースのうち、
+// 実際に使えるものを答えるストレージです。
+//
+// 他のストレージの上に重ねるストレージ（crypt など）は、下のストレージ
+// 次第で使えたり使えなかったりするメソッドを、型としてはすべて持つことに
+// なります。これを実装すると、ヘルパは型アサーションに加えて、ここで
+// 使えると答えたものだけを使います。
+type CapabilityReporter interface {
+	Supports(c Capability) bool
+}
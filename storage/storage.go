@@ -145,6 +145,9 @@ type Features struct {
 
 	// MaxFileSize は1ファイルの上限です。0 なら制限なしです。
 	MaxFileSize int64
+	// MaxNameLength はパスの1段ぶんの名前の上限（バイト数）です。
+	// 0 なら制限なしです。
+	MaxNameLength int
 	// IllegalChars はファイル名に使えない文字です。
 	IllegalChars string
 }
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash/crc32"
 
 	"github.com/mt3hr/hbg/storage"
 )
@@ -28,6 +29,25 @@ func knownHash(ht storage.HashType, content string) (string, error) {
 		block := sha256.Sum256([]byte(content))
 		overall := sha256.Sum256(block[:])
 		return hex.EncodeToString(overall[:]), nil
+	case storage.QuickXor:
+		// k バイト目の j ビット目を (11k+j) mod 160 ビット目へ XOR し、
+		// 長さをリトルエンディアンで末尾の 8 バイトへ XOR したもの
+		var sum [20]byte
+		for k, b := range []byte(content) {
+			for j := range 8 {
+				if b&(1<<j) != 0 {
+					bit := (k*11 + j) % 160
+					sum[bit/8] ^= 1 << (bit % 8)
+				}
+			}
+		}
+		for i := range 8 {
+			sum[12+i] ^= byte(uint64(len(content)) >> (8 * i))
+		}
+		return hex.EncodeToString(sum[:]), nil
+	case storage.CRC32C:
+		sum := crc32.Checksum([]byte(content), crc32.MakeTable(crc32.Castagnoli))
+		return fmt.Sprintf("%08x", sum), nil
 	}
 	return "", fmt.Errorf("参照値を用意していないハッシュ: %s", ht)
 }
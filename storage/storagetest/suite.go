@@ -16,7 +16,9 @@ import (
 	"fmt"
 	"io"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -71,6 +73,9 @@ func Run(t *testing.T, h Harness) {
 		{"Featuresとの整合", testFeaturesConsistency},
 		{"ハッシュ", testHash},
 		{"範囲読み出し", testRangeOpen},
+		{"書きかけからの再開", testResume},
+		{"位置を指定した書き込み", testWriteAt},
+		{"配下をまとめて一覧", testListRecursive},
 		{"移動", testMove},
 		{"まとめて削除", testPurge},
 		{"大きめのファイル", testLargerFile},
@@ -587,7 +592,7 @@ func testFeaturesConsistency(t *testing.T, h Harness) {
 
 	// ハッシュを申告しているなら、実際に取得できること
 	if len(f.Hashes) > 0 {
-		if _, ok := s.(storage.Hasher); !ok {
+		if !storage.Supports(s, storage.CapHash) {
 			// 一覧のついでに返す形でもよいので、その場合は実ファイルで確認する
 			p := path.Join(root, "hashcheck.txt")
 			put(t, ctx, s, p, "内容")
@@ -613,7 +618,7 @@ func testHash(t *testing.T, h Harness) {
 	ctx, s, root := setup(t, h)
 
 	hasher, ok := s.(storage.Hasher)
-	if !ok {
+	if !ok || !storage.Supports(s, storage.CapHash) {
 		t.Skip("Hasher を実装していないため飛ばします")
 	}
 
@@ -641,7 +646,7 @@ func testRangeOpen(t *testing.T, h Harness) {
 	ctx, s, root := setup(t, h)
 
 	opener, ok := s.(storage.RangeOpener)
-	if !ok {
+	if !ok || !storage.Supports(s, storage.CapRangeOpen) {
 		t.Skip("RangeOpener を実装していないため飛ばします")
 	}
 
@@ -676,6 +681,180 @@ func testRangeOpen(t *testing.T, h Harness) {
 	}
 }
 
+func testResume(t *testing.T, h Harness) {
+	ctx, s, root := setup(t, h)
+
+	resumer, ok := s.(storage.Resumer)
+	if !ok || !storage.Supports(s, storage.CapResume) {
+		t.Skip("Resumer を実装していないため飛ばします")
+	}
+
+	p := path.Join(root, "resume.bin")
+	if _, err := resumer.Partial(ctx, p); !storage.IsNotFound(err) {
+		t.Fatalf("書きかけが無いのに Partial = %v", err)
+	}
+
+	data := make([]byte, 256<<10)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	// 途中で取り消して、書きかけを残させる
+	putCtx, cancel := context.WithCancel(ctx)
+	r := &cancelingReader{data: data, cancel: cancel, after: 64 << 10}
+	if _, err := resumer.PutResume(putCtx, p, 0, r, storage.ObjectMeta{Size: int64(len(data))}); err == nil {
+		t.Fatal("取り消したのに PutResume が成功した")
+	}
+	if _, err := s.Stat(ctx, p); !storage.IsNotFound(err) {
+		t.Errorf("書き終えていないのに書き込み先にファイルがある: %v", err)
+	}
+
+	part, err := resumer.Partial(ctx, p)
+	if err != nil {
+		t.Fatalf("取り消したあとの Partial: %v", err)
+	}
+	if part.Size > int64(len(data)) {
+		t.Fatalf("書きかけが %d バイトあり、書いた量より多い", part.Size)
+	}
+
+	// 書きかけの大きさと食い違う位置からは書かせない
+	if _, err := resumer.PutResume(ctx, p, part.Size+1, bytes.NewReader(data[part.Size+1:]),
+		storage.ObjectMeta{Size: int64(len(data))}); !storage.IsNotFound(err) {
+		t.Errorf("食い違う位置からの PutResume = %v, want ErrNotFound", err)
+	}
+
+	info, err := resumer.PutResume(ctx, p, part.Size, bytes.NewReader(data[part.Size:]),
+		storage.ObjectMeta{Size: int64(len(data))})
+	if err != nil {
+		t.Fatalf("続きからの PutResume: %v", err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Errorf("Size = %d, want ファイル全体の %d", info.Size, len(data))
+	}
+	if got := read(t, ctx, s, p); got != string(data) {
+		t.Error("続きから書いた内容が元と違う")
+	}
+	if _, err := resumer.Partial(ctx, p); !storage.IsNotFound(err) {
+		t.Errorf("書き終えたのに書きかけが残っている: %v", err)
+	}
+}
+
+func testWriteAt(t *testing.T, h Harness) {
+	ctx, s, root := setup(t, h)
+
+	ow, ok := s.(storage.OffsetWriter)
+	if !ok || !storage.Supports(s, storage.CapOffsetWrite) {
+		t.Skip("OffsetWriter を実装していないため飛ばします")
+	}
+
+	data := make([]byte, 96<<10)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	p := path.Join(root, "writeat.bin")
+
+	// 捨てたものは残らない
+	pw, err := ow.OpenWriterAt(ctx, p, int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenWriterAt: %v", err)
+	}
+	if _, err := pw.WriteAt(data[:10], 0); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	if err := pw.Abort(); err != nil {
+		t.Fatalf("Abort: %v", err)
+	}
+	if _, err := s.Stat(ctx, p); !storage.IsNotFound(err) {
+		t.Errorf("捨てたのに書き込み先にファイルがある: %v", err)
+	}
+
+	// 後ろから順に、同時に書く
+	pw, err = ow.OpenWriterAt(ctx, p, int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenWriterAt: %v", err)
+	}
+	const chunk = 32 << 10
+	var wg sync.WaitGroup
+	for off := len(data) - chunk; off >= 0; off -= chunk {
+		wg.Add(1)
+		go func(off int) {
+			defer wg.Done()
+			if _, err := pw.WriteAt(data[off:off+chunk], int64(off)); err != nil {
+				t.Errorf("WriteAt(%d): %v", off, err)
+			}
+		}(off)
+	}
+	wg.Wait()
+
+	if _, err := s.Stat(ctx, p); !storage.IsNotFound(err) {
+		t.Errorf("置き換える前に書き込み先にファイルがある: %v", err)
+	}
+	info, err := pw.Commit(ctx, storage.ObjectMeta{Size: int64(len(data))})
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Errorf("Size = %d, want %d", info.Size, len(data))
+	}
+	if err := pw.Abort(); err != nil {
+		t.Errorf("置き換えたあとの Abort: %v", err)
+	}
+	if got := read(t, ctx, s, p); got != string(data) {
+		t.Error("書いた内容が元と違う")
+	}
+}
+
+func testListRecursive(t *testing.T, h Harness) {
+	ctx, s, root := setup(t, h)
+
+	if !storage.CanListRecursive(s) {
+		t.Skip("RecursiveLister を実装していないため飛ばします")
+	}
+
+	put(t, ctx, s, path.Join(root, "c.txt"), "c")
+	put(t, ctx, s, path.Join(root, "a", "1.txt"), "1")
+	put(t, ctx, s, path.Join(root, "a", "b", "2.txt"), "2")
+	dirs := []string{root, path.Join(root, "a"), path.Join(root, "a", "b")}
+	if s.Features().EmptyDirs {
+		empty := path.Join(root, "空")
+		if err := s.Mkdir(ctx, empty); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+		dirs = append(dirs, empty)
+	}
+
+	tree, err := storage.ListTree(ctx, s, root)
+	if err != nil {
+		t.Fatalf("ListTree: %v", err)
+	}
+
+	// どのディレクトリも、1つずつ一覧したときと同じ中身になる
+	for _, dir := range dirs {
+		entries, ok := tree.Dir(dir)
+		if !ok {
+			t.Errorf("%s が木に無い", dir)
+			continue
+		}
+		got := make([]string, 0, len(entries))
+		for _, e := range entries {
+			got = append(got, e.Name)
+		}
+		sort.Strings(got)
+		want := listNames(t, ctx, s, dir)
+		sort.Strings(want)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s の中身 = %v, want %v", dir, got, want)
+		}
+	}
+	if _, ok := tree.Dir(path.Join(root, "無い")); ok {
+		t.Error("無いディレクトリが木にある")
+	}
+
+	if _, err := storage.ListTree(ctx, s, path.Join(root, "無い")); !storage.IsNotFound(err) {
+		t.Errorf("無いディレクトリの ListTree = %v, ErrNotFound であるべき", err)
+	}
+}
+
 func testMove(t *testing.T, h Harness) {
 	ctx, s, root := setup(t, h)
 
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"path"
+	"strings"
+)
+
+// Tree はまとめて一覧した配下を、ディレクトリごとに引ける形で持ちます。
+//
+// 一覧し終えたあとは読むだけなので、複数のゴルーチンから同時に引けます。
+type Tree struct {
+	root string
+	// caseInsensitive が真なら、大文字小文字を区別せずに引きます。
+	// Dropbox は親ディレクトリの表記を子ごとに揃えて返すとは限らないためです。
+	caseInsensitive bool
+	// children はディレクトリごとの直下の一覧です。
+	// 空のディレクトリも、空の一覧として持ちます。
+	children map[string][]FileInfo
+	// dirs は一覧に入れたディレクトリです。同じものを2度入れないためです。
+	dirs map[string]struct{}
+	// osPath が真なら、パスを OS の規則のまま扱います。CleanPath を参照。
+	osPath bool
+}
+
+// NewTree は s の dir を根とする、まだ何も無い木を作ります。
+//
+// dir がまだ存在しないと分かっているときに、一覧する代わりに使えます。
+// 根も含めて、どのディレクトリも「無い」と答えます。
+func NewTree(s Storage, dir string) *Tree {
+	t := &Tree{
+		children: map[string][]FileInfo{},
+		dirs:     map[string]struct{}{},
+	}
+	if f := s.Features(); f != nil {
+		t.caseInsensitive = f.CaseInsensitive
+		t.osPath = f.OSPath
+	}
+	t.root = t.clean(dir)
+	return t
+}
+
+// Dir は dir の直下の一覧を返します。
+// dir が木に無ければ、偽を返します。
+func (t *Tree) Dir(dir string) ([]FileInfo, bool) {
+	entries, ok := t.children[t.key(t.clean(dir))]
+	return entries, ok
+}
+
+func (t *Tree) clean(p string) string {
+	if t.osPath {
+		return path.Clean(p)
+	}
+	return CleanPath(p)
+}
+
+func (t *Tree) key(p string) string {
+	if t.caseInsensitive {
+		return strings.ToLower(p)
+	}
+	return p
+}
+
+// within は p が根の配下（根を含まない）にあるかを返します。
+func (t *Tree) within(p string) bool {
+	if strings.HasSuffix(t.root, "/") {
+		return p != t.root && strings.HasPrefix(t.key(p), t.key(t.root))
+	}
+	return strings.HasPrefix(t.key(p), t.key(t.root)+"/")
+}
+
+// add は一覧で見つかった1件を入れます。
+//
+// 親ディレクトリがまだ無ければ、中身があることから補います。
+func (t *Tree) add(fi FileInfo) {
+	p := t.clean(fi.Path)
+	if !t.within(p) {
+		return
+	}
+
+	if fi.IsDir {
+		if _, seen := t.dirs[t.key(p)]; seen {
+			return
+		}
+		t.addDir(p)
+	}
+
+	// 子から先に来ることがあるので、親をたどって、まだ無いものを補う。
+	for {
+		parent := path.Dir(p)
+		k := t.key(parent)
+		t.children[k] = append(t.children[k], fi)
+		if parent == t.root {
+			return
+		}
+		if _, seen := t.dirs[k]; seen {
+			return
+		}
+		t.addDir(parent)
+		p = parent
+		fi = FileInfo{Path: parent, Name: path.Base(parent), IsDir: true, Size: SizeUnknown}
+	}
+}
+
+// addDir はディレクトリがあることを記録します。中身が無くても引けるようにします。
+func (t *Tree) addDir(dir string) {
+	k := t.key(dir)
+	t.dirs[k] = struct{}{}
+	if _, ok := t.children[k]; !ok {
+		t.children[k] = []FileInfo{}
+	}
+}
@@ -0,0 +1,221 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// 退避は、上書きや削除で失われるはずだったものを消す前に移しておく
+// 仕組みです。同期の向きを取り違えたり、コピー元を壊したまま同期したり
+// しても、退避先から取り戻せます。
+//
+//   - 退避先の中の位置は、転送先ディレクトリからの相対パスと同じにします。
+//     どこにあったものかが、そのまま分かるようにするためです。
+//
+//   - 同じストレージの中なら移動（storage.Move）で済ませます。
+//     内容を運ばないので、大きなファイルでもすぐ終わります。
+//     別のストレージへは、コピーしてから元を消します。
+//
+//   - 退避に失敗したものは、上書きも削除もしません。
+//     退避できないまま消すと、この仕組みを使う意味がなくなります。
+//
+//   - 書き込み中の残骸（.hbgpart）は退避しません。hbg 自身が作ったもので、
+//     取り戻したいものではないためです。
+
+// backupper は1回の転送での退避を受け持ちます。
+type backupper struct {
+	e *engine
+
+	// dstRoot は退避元の起点、つまり転送先ディレクトリです。
+	dstRoot string
+
+	// 作成済みの退避先ディレクトリ。同じディレクトリを何度も作らないため。
+	dirsMu   sync.Mutex
+	madeDirs map[string]struct{}
+}
+
+// newBackupper は退避を指定されていれば backupper を作ります。
+// 指定がなければ nil を返します。
+func newBackupper(e *engine) *backupper {
+	if e.opts.BackupStorage == nil {
+		return nil
+	}
+	return &backupper{
+		e:        e,
+		dstRoot:  path.Clean("/" + e.opts.DstDir),
+		madeDirs: map[string]struct{}{},
+	}
+}
+
+// checkBackupDir は、退避先が転送先と重なっていないかを確かめます。
+//
+// 重なっていると、同期の削除が退避したものを「コピー元にないもの」として
+// また退避し、退避先の中に退避先ができていきます。転送先の側を退避先の
+// 中に置いた場合も、同じことが起きます。
+func checkBackupDir(opts Options, srcRoots []storage.FileInfo) error {
+	if opts.BackupStorage == nil {
+		return nil
+	}
+	if !sameStorage(opts.BackupStorage, opts.Dst) {
+		return nil
+	}
+
+	backupDir := path.Clean("/" + opts.BackupDir)
+	for _, root := range srcRoots {
+		if !root.IsDir {
+			// 1ファイルだけの転送では、そのファイルしか触らない。
+			continue
+		}
+		dstRoot := path.Clean("/" + path.Join(opts.DstDir, root.Name))
+		if within(backupDir, dstRoot) || within(dstRoot, backupDir) {
+			return fmt.Errorf("退避先 %s:%s が転送先 %s:%s と重なっています。転送先の外を指定してください",
+				opts.BackupStorage.Type(), opts.BackupDir, opts.Dst.Type(), dstRoot)
+		}
+	}
+	return nil
+}
+
+// within は p が dir そのもの、またはその中にあるかを返します。
+func within(p, dir string) bool {
+	if p == dir || dir == "/" {
+		return true
+	}
+	return strings.HasPrefix(p, dir+"/")
+}
+
+// sameStorage は2つが同じストレージを指しているかを返します。
+func sameStorage(a, b storage.Storage) bool {
+	return a.Type() == b.Type() && a.Name() == b.Name()
+}
+
+// pathOf は、転送先の dstPath を退避する先のパスを返します。
+func (b *backupper) pathOf(dstPath string) string {
+	rel := strings.TrimPrefix(path.Clean("/"+dstPath), b.dstRoot)
+	rel = strings.TrimPrefix(rel, "/")
+	return path.Join(b.e.opts.BackupDir, withSuffix(rel, b.e.opts.BackupSuffix))
+}
+
+// withSuffix は名前の拡張子の前に suffix を入れます。
+//
+// 末尾に足すと拡張子が変わり、退避したものを開くときに
+// 関連付けが効かなくなるためです。
+func withSuffix(rel, suffix string) string {
+	if suffix == "" {
+		return rel
+	}
+	dir, name := path.Split(rel)
+	ext := path.Ext(name)
+	if ext == name {
+		// .bashrc のような、拡張子だけに見える名前
+		ext = ""
+	}
+	return dir + strings.TrimSuffix(name, ext) + suffix + ext
+}
+
+// beforeOverwrite は、上書きされる転送先のものを退避します。
+// 退避しない場合や、上書きにならない場合は何もしません。
+func (b *backupper) beforeOverwrite(ctx context.Context, t task, dstPath string) error {
+	if b == nil || !t.dstExists {
+		return nil
+	}
+	err := b.backup(ctx, dstPath, t.relPath)
+	if storage.IsNotFound(err) {
+		// 走査のあとで消えている。失うものがないので、そのまま書く。
+		return nil
+	}
+	return err
+}
+
+// backup は転送先の dstPath を退避先へ移します。
+//
+// rel は表示に使う相対パスです。
+func (b *backupper) backup(ctx context.Context, dstPath, rel string) error {
+	to := b.pathOf(dstPath)
+	opts := b.e.opts
+
+	if opts.DryRun {
+		b.e.reporter.Logf("退避（予定） %s -> %s:%s", rel, opts.BackupStorage.Type(), to)
+		return nil
+	}
+
+	err := doWithRetry(ctx, opts.Retry, func(ctx context.Context, _ int) error {
+		return b.moveOne(ctx, dstPath, to)
+	}, nil).err
+	if err != nil {
+		return fmt.Errorf("%s を %s:%s へ退避できませんでした: %w",
+			rel, opts.BackupStorage.Type(), to, err)
+	}
+
+	b.e.recordBackedUp()
+	b.e.reporter.Logf("退避 %s -> %s:%s", rel, opts.BackupStorage.Type(), to)
+	return nil
+}
+
+// moveOne は1回ぶんの退避を行います。
+func (b *backupper) moveOne(ctx context.Context, from, to string) error {
+	e := b.e
+	dst, bak := e.opts.Dst, e.opts.BackupStorage
+
+	if err := b.ensureParent(ctx, to); err != nil {
+		return err
+	}
+
+	if sameStorage(dst, bak) {
+		if err := e.limits.wait(ctx, dst); err != nil {
+			return err
+		}
+		// 束ねたストレージ（combine）では、メンバーをまたぐと移動できない。
+		// そのときは別のストレージと同じく運ぶ。
+		if err := storage.Move(ctx, dst, from, to); !errors.Is(err, storage.ErrUnsupported) {
+			return err
+		}
+	}
+
+	// 別のストレージへは運ぶしかない。運び終えてから元を消す。
+	if err := e.limits.wait(ctx, dst); err != nil {
+		return err
+	}
+	if _, err := storage.Copy(ctx, dst, from, bak, to, storage.CopyOptions{
+		Wrap: func(r io.Reader) io.Reader { return e.bw.wrap(ctx, r) },
+	}); err != nil {
+		return err
+	}
+	if err := e.limits.wait(ctx, dst); err != nil {
+		return err
+	}
+	return dst.Remove(ctx, from)
+}
+
+// ensureParent は退避先の親ディレクトリを用意します。
+func (b *backupper) ensureParent(ctx context.Context, p string) error {
+	bak := b.e.opts.BackupStorage
+	if f := bak.Features(); f != nil && f.ImplicitDirs {
+		return nil
+	}
+	dir := path.Dir(p)
+
+	b.dirsMu.Lock()
+	_, made := b.madeDirs[dir]
+	b.dirsMu.Unlock()
+	if made {
+		return nil
+	}
+
+	if err := b.e.limits.wait(ctx, bak); err != nil {
+		return err
+	}
+	if err := bak.Mkdir(ctx, dir); err != nil {
+		return err
+	}
+	b.dirsMu.Lock()
+	b.madeDirs[dir] = struct{}{}
+	b.dirsMu.Unlock()
+	return nil
+}
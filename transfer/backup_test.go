@@ -0,0 +1,200 @@
+package transfer_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/transfer"
+)
+
+// 上書きや削除で失われるはずのものが退避先に残ることを確かめます。
+func TestBackupKeepsReplacedAndDeleted(t *testing.T) {
+	src, dst := newPair(t)
+	putOld(t, dst, "/backup/data/かわる.txt", "古い")
+	put(t, dst, "/backup/data/よぶん/中身.txt", "消える")
+	put(t, src, "/data/かわる.txt", "新しい内容")
+
+	opts := baseOptions(src, dst)
+	opts.Delete = true
+	opts.BackupStorage = dst
+	opts.BackupDir = "/old"
+
+	result, err := transfer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	snap := dst.Snapshot()
+	want := map[string]string{
+		"/backup/data/かわる.txt": "新しい内容",
+		"/old/data/かわる.txt":    "古い",
+		"/old/data/よぶん/中身.txt": "消える",
+	}
+	for p, content := range want {
+		if got, ok := snap[p]; !ok || got != content {
+			t.Errorf("%s = %q (あり=%v), want %q", p, got, ok, content)
+		}
+	}
+	if _, ok := snap["/backup/data/よぶん/中身.txt"]; ok {
+		t.Error("コピー元にないものが転送先に残っている")
+	}
+	if result.BackedUp != 2 {
+		t.Errorf("退避した件数 = %d, want 2", result.BackedUp)
+	}
+}
+
+// 退避した名前の拡張子の前に印が入ることを確かめます。
+func TestBackupSuffixGoesBeforeExtension(t *testing.T) {
+	src, dst := newPair(t)
+	putOld(t, dst, "/backup/data/報告.docx", "古い")
+	putOld(t, dst, "/backup/data/.bashrc", "古い")
+	put(t, src, "/data/報告.docx", "新しい内容")
+	put(t, src, "/data/.bashrc", "新しい内容")
+
+	opts := baseOptions(src, dst)
+	opts.BackupStorage = dst
+	opts.BackupDir = "/old"
+	opts.BackupSuffix = "-20260101"
+
+	if _, err := transfer.Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	snap := dst.Snapshot()
+	for _, p := range []string{"/old/data/報告-20260101.docx", "/old/data/.bashrc-20260101"} {
+		if _, ok := snap[p]; !ok {
+			t.Errorf("%s がない: %v", p, keys(snap))
+		}
+	}
+}
+
+// 別のストレージへも退避できることを確かめます。
+func TestBackupToAnotherStorage(t *testing.T) {
+	src, dst := newPair(t)
+	bak := memory.New("bak")
+	put(t, dst, "/backup/data/よぶん.txt", "消える")
+	put(t, src, "/data/a.txt", "1")
+
+	opts := baseOptions(src, dst)
+	opts.Delete = true
+	opts.BackupStorage = bak
+	opts.BackupDir = "/old"
+
+	if _, err := transfer.Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if got := bak.Snapshot()["/old/data/よぶん.txt"]; got != "消える" {
+		t.Errorf("退避先の中身 = %q, want %q", got, "消える")
+	}
+	if _, ok := dst.Snapshot()["/backup/data/よぶん.txt"]; ok {
+		t.Error("退避したのに転送先に残っている")
+	}
+}
+
+// 退避できなかったものは、上書きも削除もしないことを確かめます。
+func TestBackupFailureKeepsOriginal(t *testing.T) {
+	src, dst := newPair(t)
+	bak := memory.New("bak")
+	putOld(t, dst, "/backup/data/かわる.txt", "古い")
+	put(t, dst, "/backup/data/よぶん.txt", "消える")
+	put(t, src, "/data/かわる.txt", "新しい内容")
+
+	bak.SetHooks(memory.Hooks{
+		BeforeOp: func(op, _ string) error {
+			if op == "put" {
+				return errors.New("書けません")
+			}
+			return nil
+		},
+	})
+
+	opts := baseOptions(src, dst)
+	opts.Delete = true
+	opts.DeleteOnPartial = true
+	opts.BackupStorage = bak
+	opts.BackupDir = "/old"
+
+	result, err := transfer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	snap := dst.Snapshot()
+	if got := snap["/backup/data/かわる.txt"]; got != "古い" {
+		t.Errorf("退避できなかったのに上書きされた: %q", got)
+	}
+	if _, ok := snap["/backup/data/よぶん.txt"]; !ok {
+		t.Error("退避できなかったのに消えている")
+	}
+	if result.Failed != 1 || result.DeleteFailed != 1 {
+		t.Errorf("失敗 = %d, 削除の失敗 = %d, want 1, 1", result.Failed, result.DeleteFailed)
+	}
+}
+
+// 転送先と重なる退避先を断ることを確かめます。
+func TestBackupRejectsOverlappingDir(t *testing.T) {
+	for _, dir := range []string{"/backup/data/old", "/backup/data", "/"} {
+		t.Run(dir, func(t *testing.T) {
+			src, dst := newPair(t)
+			put(t, src, "/data/a.txt", "1")
+
+			opts := baseOptions(src, dst)
+			opts.BackupStorage = dst
+			opts.BackupDir = dir
+
+			if _, err := transfer.Run(context.Background(), opts); err == nil {
+				t.Error("重なる退避先を受け付けた")
+			}
+			if len(dst.Snapshot()) != 0 {
+				t.Error("断ったのに書き込んでいる")
+			}
+		})
+	}
+}
+
+// 転送先の隣なら、同じストレージでも受け付けることを確かめます。
+func TestBackupAllowsSiblingDir(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, src, "/data/a.txt", "1")
+
+	opts := baseOptions(src, dst)
+	opts.BackupStorage = dst
+	opts.BackupDir = "/backup/data-old"
+
+	if _, err := transfer.Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+// 試しに動かしただけでは、何も退避しないことを確かめます。
+func TestBackupDryRunMovesNothing(t *testing.T) {
+	src, dst := newPair(t)
+	putOld(t, dst, "/backup/data/かわる.txt", "古い")
+	put(t, dst, "/backup/data/よぶん.txt", "消える")
+	put(t, src, "/data/かわる.txt", "新しい内容")
+	before := dst.Snapshot()
+
+	opts := baseOptions(src, dst)
+	opts.Delete = true
+	opts.DryRun = true
+	opts.BackupStorage = dst
+	opts.BackupDir = "/old"
+
+	if _, err := transfer.Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if after := dst.Snapshot(); len(after) != len(before) {
+		t.Errorf("試しに動かしただけで変わった: %v", keys(after))
+	}
+}
+
+func keys(m map[string]string) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
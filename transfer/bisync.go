@@ -0,0 +1,1224 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/mt3hr/hbg/progress"
+	"github.com/mt3hr/hbg/storage"
+)
+
+// 双方向同期は、2つのディレクトリのどちらで起きた変更も、もう片方へ
+// 伝えます。ノートPCと Dropbox の両方で同じフォルダを編集する使い方のためです。
+//
+// 変更は「前回の同期が終わった時点の一覧」と今の一覧の差で見つけます。
+// 今の一覧どうしを比べるだけでは、片側で消したのか、もう片側で
+// 新しく作ったのかが区別できないためです。
+//
+// 片側だけで変わったものは、その向きに伝えます。両側で変わったものは
+// 衝突として、ConflictPolicy に従って扱います。
+//
+// 同期での削除と同じく、迷う場面では消さない側に倒します。
+//
+//   - 片側で消され、もう片側で変えられたものは、変えた側を残して書き戻す。
+//   - 片側の中身が丸ごと無くなっていたら、何もせずに止める。
+//     外付けのディスクを挿し忘れただけで、もう片側が空になっては困る。
+//   - 失敗したものは前回の記録を残す。次の実行で同じ判断をやり直せるように。
+
+// ConflictPolicy は、両側で変わったファイルの扱いです。
+type ConflictPolicy string
+
+const (
+	// ConflictKeepBoth は両方を名前を変えて残します。
+	// どちらも失わないので、これを既定にします。
+	ConflictKeepBoth ConflictPolicy = "keep-both"
+	// ConflictNewer は更新時刻の新しいほうで古いほうを上書きします。
+	// 時刻で決着がつかない場合は両方を残します。
+	ConflictNewer ConflictPolicy = "newer"
+	// ConflictAbort は衝突があれば何もせずに止めます。
+	ConflictAbort ConflictPolicy = "abort"
+)
+
+// ParseConflictPolicy は文字列から衝突の扱いを求めます。
+func ParseConflictPolicy(s string) (ConflictPolicy, bool) {
+	switch ConflictPolicy(s) {
+	case ConflictKeepBoth, ConflictNewer, ConflictAbort:
+		return ConflictPolicy(s), true
+	}
+	return "", false
+}
+
+// ConflictPolicyNames は指定できる値を返します。
+func ConflictPolicyNames() []string {
+	return []string{string(ConflictKeepBoth), string(ConflictNewer), string(ConflictAbort)}
+}
+
+// ErrBisyncConflict は、ConflictAbort の指定で衝突が見つかったことを表します。
+var ErrBisyncConflict = errors.New("両側で変更されたファイルがあります")
+
+// ErrBisyncSideEmpty は、前回はあったものが片側から丸ごと無くなっていたことを表します。
+var ErrBisyncSideEmpty = errors.New("片側の中身がすべて無くなっています")
+
+// BisyncSide は双方向同期の片側です。
+type BisyncSide struct {
+	Storage storage.Storage
+	// Dir はこのディレクトリの中身どうしを合わせます。
+	// copy と違い、Dir の名前のディレクトリを向こうに作りはしません。
+	Dir string
+}
+
+// String は状態の照合に使う表記です。
+func (s BisyncSide) String() string {
+	return s.Storage.Type() + ":" + s.Storage.Name() + ":" + s.Dir
+}
+
+// BisyncOptions は双方向同期の設定です。
+type BisyncOptions struct {
+	// Path1 と Path2 は合わせる2つのディレクトリです。
+	Path1 BisyncSide
+	Path2 BisyncSide
+
+	// StateFile は前回の同期の記録を置くファイルです。
+	StateFile string
+	// Resync を真にすると、前回の記録を使わずに合わせ直します。
+	// 片側にしかないものは反対側へ写し、両側で違うものは衝突として扱います。
+	// 何も消しません。
+	Resync bool
+
+	// Workers は同時に転送するファイル数です。1未満なら1にします。
+	Workers int
+
+	// Compare は、両側にあるものが同じかどうかの判断に使います。
+	// Update と IgnoreExisting は使いません。
+	Compare ComparePolicy
+	// Conflict は両側で変わったファイルの扱いです。空なら ConflictKeepBoth。
+	Conflict ConflictPolicy
+	// Filter は対象の絞り込みです。nil ならすべて対象。
+	Filter *Filter
+
+	// Retry はファイル単位の再試行の設定です。
+	Retry RetryPolicy
+	// TPS は1秒あたりのAPI呼び出し回数の上限です。0 なら無制限。
+	TPS float64
+	// BandwidthLimit は1秒あたりの転送バイト数の上限です。0 なら無制限。
+	BandwidthLimit int64
+	// FastList を真にすると、両側の配下をまとめて一覧します。
+	// 詳しくは Options.FastList を参照してください。
+	FastList bool
+
+	// DryRun を真にすると、何をするかを示すだけで何も変えません。
+	// 記録も更新しません。
+	DryRun bool
+
+	// Reporter は進みぐあいの表示先です。nil なら何も表示しません。
+	Reporter progress.Reporter
+	// OnTransfer は1ファイルの転送が終わるたびに呼ばれます。
+	// toPath2 は、Path1 から Path2 への転送かどうかです。
+	OnTransfer func(ev TransferEvent, toPath2 bool)
+}
+
+// BisyncResult は双方向同期の結果です。
+type BisyncResult struct {
+	// FirstRun は前回の記録がなく、最初の同期として合わせたことを表します。
+	FirstRun bool
+	// Copied は転送したファイル数です。向きは問いません。
+	Copied int
+	Bytes  int64
+	// Deleted は、反対側で消されたので消した件数です。
+	Deleted int
+	// Conflicts は両側で変わっていたファイルの数です。
+	Conflicts int
+	// Failed は失敗した操作の数です。
+	Failed  int
+	Elapsed time.Duration
+
+	// Errors は表示用に保持する失敗の詳細です。
+	// MaxReportedErrors 件で打ち切られます。
+	Errors []error
+}
+
+// sideChange は、片側の1ファイルが前回からどう変わったかです。
+type sideChange int
+
+const (
+	// changeNone は前回と同じことを表します。
+	changeNone sideChange = iota
+	// changeAbsent は前回も今回も無いことを表します。
+	changeAbsent
+	changeAdded
+	changeModified
+	changeRemoved
+)
+
+// bisyncEntry は片側の1ファイルです。
+type bisyncEntry struct {
+	// rel はその側での起点からの相対パスです。
+	// 大文字小文字を区別しない側では、キーと表記が違うことがあります。
+	rel  string
+	info storage.FileInfo
+}
+
+// bisyncListing は片側の今の一覧です。
+type bisyncListing struct {
+	files map[string]bisyncEntry
+	// dirs はディレクトリのキーから、その側での表記を引きます。
+	dirs map[string]string
+	// filtered は、絞り込みで一覧から外したものを中に含むディレクトリです。
+	// まるごと消してよいかの判断に使います。
+	filtered map[string]struct{}
+}
+
+// bisyncOpKind は操作の種類です。
+type bisyncOpKind int
+
+const (
+	opCopy bisyncOpKind = iota
+	opRemove
+	opPurge
+	opRename
+)
+
+// bisyncOp は1件の操作です。
+type bisyncOp struct {
+	kind bisyncOpKind
+	// side は、コピーなら読む側、それ以外なら手を加える側です。
+	side int
+	// key と rel は対象です。
+	key string
+	rel string
+	// toKey と toRel は、コピーと改名の行き先です。
+	toKey string
+	toRel string
+	size  int64
+	// count は、ディレクトリごと消す場合の中のファイル数です。
+	count int
+	// origKey は、この操作がどのファイルの判断から生まれたかです。
+	// 失敗したときに前回の記録を残す単位になります。
+	origKey string
+	reason  string
+}
+
+// bisyncer は1回の双方向同期の状態です。
+type bisyncer struct {
+	opts     BisyncOptions
+	sides    [2]BisyncSide
+	reporter progress.Reporter
+	limits   *limiterSet
+	bw       *bandwidthLimiter
+
+	// cross は両側にあるものが同じかを判断します。
+	cross *Comparer
+	// change は前回からの変化を判断します。
+	change [2]*Comparer
+	// foldCase は、どちらかが大文字小文字を区別しないことを表します。
+	foldCase bool
+
+	dirsMu   sync.Mutex
+	madeDirs map[string]struct{}
+
+	mu     sync.Mutex
+	result BisyncResult
+	// failedKeys は、操作に失敗したファイルです。前回の記録を残します。
+	failedKeys map[string]struct{}
+}
+
+// RunBisync は双方向同期を実行します。
+//
+// 戻り値の error は、一覧の失敗や衝突による中止など、全体を止める種類の
+// ものです。個々のファイルの失敗は BisyncResult に集計されます。
+func RunBisync(ctx context.Context, opts BisyncOptions) (*BisyncResult, error) {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.Retry.MaxAttempts < 1 {
+		opts.Retry.MaxAttempts = 1
+	}
+	if opts.Reporter == nil {
+		opts.Reporter = progress.NewNop()
+	}
+	if len(opts.Compare.Fields) == 0 {
+		opts.Compare = DefaultComparePolicy()
+	}
+	if opts.Conflict == "" {
+		opts.Conflict = ConflictKeepBoth
+	}
+	if opts.StateFile == "" {
+		return nil, fmt.Errorf("同期の記録の置き場所が指定されていません")
+	}
+
+	// 両側を同じ重みで比べる。どちらかを優先する指定は衝突の扱いで行う。
+	policy := opts.Compare
+	policy.Update = false
+	policy.IgnoreExisting = false
+
+	p1, p2 := opts.Path1.Storage, opts.Path2.Storage
+	cross, err := NewComparer(policy, p1, p2)
+	if err != nil {
+		return nil, err
+	}
+	// どちらの向きにも書くので、逆向きでも比べられることを確かめておく。
+	if _, err := NewComparer(policy, p2, p1); err != nil {
+		return nil, err
+	}
+	// 両側に書き、消したものは消し返すので、どちらも変更できなければならない。
+	for _, s := range []storage.Storage{p1, p2} {
+		for _, op := range []string{"put", "remove"} {
+			if err := storage.Permit(s, op); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	started := time.Now()
+	b := &bisyncer{
+		opts:       opts,
+		sides:      [2]BisyncSide{opts.Path1, opts.Path2},
+		reporter:   opts.Reporter,
+		limits:     newLimiterSet(opts.TPS, nil),
+		bw:         newBandwidthLimiter(opts.BandwidthLimit),
+		cross:      cross,
+		change:     [2]*Comparer{NewChangeDetector(p1, policy.ModifyWindow), NewChangeDetector(p2, policy.ModifyWindow)},
+		foldCase:   caseInsensitive(p1) || caseInsensitive(p2),
+		madeDirs:   map[string]struct{}{},
+		failedKeys: map[string]struct{}{},
+	}
+
+	var prev *bisyncState
+	if !opts.Resync {
+		prev, err = loadBisyncState(opts.StateFile, opts.Path1.String(), opts.Path2.String())
+		if err != nil {
+			return nil, err
+		}
+	}
+	b.result.FirstRun = prev == nil
+
+	b.reporter.ScanStarted()
+	cur, err := b.listBoth(ctx)
+	if err != nil {
+		b.reporter.ScanDone(0, 0, 0)
+		return nil, err
+	}
+
+	if err := b.checkSidesPresent(prev, cur); err != nil {
+		b.reporter.ScanDone(0, 0, 0)
+		return nil, err
+	}
+
+	ops, conflicts := b.plan(ctx, prev, cur)
+	b.result.Conflicts = len(conflicts)
+
+	var files, bytes int64
+	for _, op := range ops {
+		if op.kind == opCopy {
+			files++
+			bytes += max(op.size, 0)
+		}
+	}
+	b.reporter.ScanDone(0, files, bytes)
+
+	if len(conflicts) > 0 && opts.Conflict == ConflictAbort {
+		for _, rel := range conflicts {
+			b.reporter.Logf("衝突: %s", rel)
+		}
+		b.result.Elapsed = time.Since(started)
+		return &b.result, fmt.Errorf("%w（%d件）。--conflict keep-both か newer を指定するか、片側を直してください",
+			ErrBisyncConflict, len(conflicts))
+	}
+
+	next := b.execute(ctx, ops, cur)
+
+	result := b.snapshotResult()
+	result.Elapsed = time.Since(started)
+	b.reporter.Done(progress.Summary{
+		Transferred: result.Copied,
+		Failed:      result.Failed,
+		Bytes:       result.Bytes,
+		Elapsed:     result.Elapsed,
+	})
+
+	if opts.DryRun {
+		return &result, ctx.Err()
+	}
+
+	// 失敗や中断があっても記録は残す。失敗したものは前回の記録のままに
+	// してあるので、次の実行が同じ判断をやり直す。
+	st := b.buildState(prev, next)
+	if err := saveBisyncState(opts.StateFile, st); err != nil {
+		return &result, err
+	}
+	return &result, ctx.Err()
+}
+
+// caseInsensitive は、大文字小文字を区別しないストレージかを返します。
+func caseInsensitive(s storage.Storage) bool {
+	f := s.Features()
+	return f != nil && f.CaseInsensitive
+}
+
+// key は照合に使う相対パスを返します。
+func (b *bisyncer) key(rel string) string {
+	if b.foldCase {
+		return strings.ToLower(rel)
+	}
+	return rel
+}
+
+// --- 一覧 ---
+
+// listBoth は両側を並行して一覧します。
+//
+// 一覧に1つでも失敗したら全体を止めます。読めなかったディレクトリの
+// 中身を「消された」と取り違えると、反対側から消してしまうためです。
+func (b *bisyncer) listBoth(ctx context.Context) ([2]*bisyncListing, error) {
+	var cur [2]*bisyncListing
+	g, gctx := errgroup.WithContext(ctx)
+	for i := range b.sides {
+		g.Go(func() error {
+			l := &bisyncListing{
+				files:    map[string]bisyncEntry{},
+				dirs:     map[string]string{},
+				filtered: map[string]struct{}{},
+			}
+			tree, err := b.listTree(gctx, i)
+			if err != nil {
+				return err
+			}
+			if err := b.listDir(gctx, i, b.sides[i].Dir, "", tree, l); err != nil {
+				return err
+			}
+			cur[i] = l
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return cur, err
+	}
+	return cur, nil
+}
+
+// listTree は、FastList のときに片側の配下をまとめて一覧します。
+// まとめて一覧しない、またはできないときは nil を返します。
+func (b *bisyncer) listTree(ctx context.Context, side int) (*storage.Tree, error) {
+	s, dir := b.sides[side].Storage, b.sides[side].Dir
+	if !b.opts.FastList || !storage.CanListRecursive(s) {
+		return nil, nil
+	}
+	if err := b.limits.wait(ctx, s); err != nil {
+		return nil, err
+	}
+	tree, err := storage.ListTree(ctx, s, dir)
+	if err != nil {
+		if storage.IsNotFound(err) {
+			// 起点がまだ無いだけ。listDir と同じく空として扱う。
+			return storage.NewTree(s, dir), nil
+		}
+		return nil, fmt.Errorf("%s:%s を一覧できませんでした: %w", s.Type(), dir, err)
+	}
+	return tree, nil
+}
+
+// listDir は片側のディレクトリをたどります。
+// tree があれば、一覧の代わりにそこから引きます。
+func (b *bisyncer) listDir(ctx context.Context, side int, dir, relDir string, tree *storage.Tree, l *bisyncListing) error {
+	s := b.sides[side].Storage
+	entries, err := b.entries(ctx, s, dir, tree)
+	if err != nil {
+		if relDir == "" && storage.IsNotFound(err) {
+			// 起点がまだ無いだけ。空として扱い、反対側から写す。
+			return nil
+		}
+		return fmt.Errorf("%s:%s を一覧できませんでした: %w", s.Type(), dir, err)
+	}
+
+	for _, entry := range entries {
+		rel := joinRel(relDir, entry.Name)
+		if entry.IsDir {
+			if !b.opts.Filter.MatchDir(rel) {
+				b.markFiltered(l, relDir)
+				continue
+			}
+			l.dirs[b.key(rel)] = rel
+			if err := b.listDir(ctx, side, entry.Path, rel, tree, l); err != nil {
+				return err
+			}
+			continue
+		}
+		// 書き込み中の一時ファイルは hbg 自身のもので、伝えるものではない。
+		if strings.HasSuffix(entry.Name, partSuffix) {
+			continue
+		}
+		if !b.opts.Filter.Match(rel, entry.Size) {
+			b.markFiltered(l, relDir)
+			continue
+		}
+		l.files[b.key(rel)] = bisyncEntry{rel: rel, info: entry}
+	}
+	return nil
+}
+
+// entries は dir の中身を返します。
+func (b *bisyncer) entries(ctx context.Context, s storage.Storage, dir string, tree *storage.Tree) ([]storage.FileInfo, error) {
+	if tree != nil {
+		if entries, ok := tree.Dir(dir); ok {
+			return entries, nil
+		}
+		// 木に無いのは、起点がまだ無いとき。
+		return nil, fmt.Errorf("%w: %s", storage.ErrNotFound, dir)
+	}
+	if err := b.limits.wait(ctx, s); err != nil {
+		return nil, err
+	}
+	return storage.ListAll(ctx, s, dir)
+}
+
+// markFiltered は、ディレクトリとその親に、外したものがあると印を付けます。
+func (b *bisyncer) markFiltered(l *bisyncListing, relDir string) {
+	for d := relDir; d != ""; d = parentRel(d) {
+		l.filtered[b.key(d)] = struct{}{}
+	}
+}
+
+// parentRel は相対パスの親を返します。起点の直下なら空です。
+func parentRel(rel string) string {
+	i := strings.LastIndex(rel, "/")
+	if i < 0 {
+		return ""
+	}
+	return rel[:i]
+}
+
+// checkSidesPresent は、片側が丸ごと無くなっていないかを確かめます。
+//
+// 外付けのディスクを挿し忘れた、ネットワークのドライブが外れていた、
+// といった場合、そのまま進めると「すべて消された」と判断して
+// 反対側を空にしてしまいます。
+func (b *bisyncer) checkSidesPresent(prev *bisyncState, cur [2]*bisyncListing) error {
+	if prev == nil {
+		return nil
+	}
+	for i, files := range [2]map[string]bisyncStateEntry{prev.Files1, prev.Files2} {
+		if len(files) > 0 && len(cur[i].files) == 0 {
+			return fmt.Errorf("%w: %s（前回は %d件ありました）。"+
+				"本当に空にしたのなら --resync を付けて合わせ直してください",
+				ErrBisyncSideEmpty, b.sides[i], len(files))
+		}
+	}
+	return nil
+}
+
+// --- 判断 ---
+
+// plan は、前回の記録と今の一覧から行うことを決めます。
+// 2つめの戻り値は衝突したファイルの相対パスです。
+func (b *bisyncer) plan(ctx context.Context, prev *bisyncState, cur [2]*bisyncListing) ([]bisyncOp, []string) {
+	var prevFiles [2]map[string]bisyncStateEntry
+	if prev != nil {
+		prevFiles = [2]map[string]bisyncStateEntry{prev.Files1, prev.Files2}
+	}
+
+	keys := map[string]struct{}{}
+	for i := range cur {
+		for k := range cur[i].files {
+			keys[k] = struct{}{}
+		}
+		for k := range prevFiles[i] {
+			keys[k] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var ops []bisyncOp
+	var conflicts []string
+	reserved := map[string]struct{}{}
+
+	for _, k := range sorted {
+		var st [2]sideChange
+		for i := range cur {
+			st[i] = b.changeOf(ctx, i, prev != nil, prevFiles[i], k, cur[i])
+		}
+
+		switch {
+		case changed(st[0]) && changed(st[1]):
+			e := [2]bisyncEntry{cur[0].files[k], cur[1].files[k]}
+			// 両側で同じように変えただけなら、衝突ではない。
+			if action, _, err := b.cross.Decide(ctx, e[0].info, &e[1].info); err == nil && action == ActionSkip {
+				continue
+			}
+			conflicts = append(conflicts, e[0].rel)
+			ops = append(ops, b.resolveConflict(k, e, cur, reserved)...)
+
+		case changed(st[0]):
+			ops = append(ops, b.copyOp(0, k, cur[0].files[k], cur, b.describe(0, st[0])))
+		case changed(st[1]):
+			ops = append(ops, b.copyOp(1, k, cur[1].files[k], cur, b.describe(1, st[1])))
+
+		case st[0] == changeRemoved && st[1] == changeNone:
+			ops = append(ops, b.removeOp(1, k, cur[1].files[k]))
+		case st[1] == changeRemoved && st[0] == changeNone:
+			ops = append(ops, b.removeOp(0, k, cur[0].files[k]))
+
+		// 片側の記録だけが欠けている。前回の同期が途中で失敗したときに起こる。
+		// 消されたとは言い切れないので、ある側から写し直す。
+		case st[0] == changeNone && st[1] == changeAbsent:
+			ops = append(ops, b.copyOp(0, k, cur[0].files[k], cur, "反対側にない"))
+		case st[1] == changeNone && st[0] == changeAbsent:
+			ops = append(ops, b.copyOp(1, k, cur[1].files[k], cur, "反対側にない"))
+		}
+	}
+
+	ops = b.collapseRemovals(ops, prevFiles, cur)
+	return ops, conflicts
+}
+
+// changed は、その側で中身が作られたか変えられたかを返します。
+func changed(c sideChange) bool {
+	return c == changeAdded || c == changeModified
+}
+
+// changeOf は、片側の1ファイルが前回からどう変わったかを返します。
+//
+// 前回の記録が無ければ、今あるものはすべて新しく現れたものとして扱います。
+func (b *bisyncer) changeOf(
+	ctx context.Context,
+	side int,
+	hasPrev bool,
+	prevFiles map[string]bisyncStateEntry,
+	key string,
+	cur *bisyncListing,
+) sideChange {
+	entry, now := cur.files[key]
+	if !hasPrev {
+		if now {
+			return changeAdded
+		}
+		return changeAbsent
+	}
+
+	before, was := prevFiles[key]
+	switch {
+	case !was && !now:
+		return changeAbsent
+	case !was:
+		return changeAdded
+	case !now:
+		return changeRemoved
+	}
+
+	prevInfo := storage.FileInfo{
+		Path:    entry.info.Path,
+		Name:    entry.info.Name,
+		Size:    before.Size,
+		ModTime: before.ModTime,
+	}
+	action, _, err := b.change[side].Decide(ctx, entry.info, &prevInfo)
+	if err != nil || action == ActionCopy {
+		return changeModified
+	}
+	return changeNone
+}
+
+// describe は変化を表示用の言葉にします。
+func (b *bisyncer) describe(side int, c sideChange) string {
+	switch c {
+	case changeAdded:
+		return fmt.Sprintf("%s で追加された", b.sides[side])
+	case changeModified:
+		return fmt.Sprintf("%s で変更された", b.sides[side])
+	}
+	return ""
+}
+
+// copyOp は、from 側のファイルを反対側へ写す操作を作ります。
+//
+// 反対側に大文字小文字だけ違う名前で残っている場合は、その名前に書きます。
+// 大文字小文字を区別する側に、同じファイルが2つできないようにするためです。
+func (b *bisyncer) copyOp(from int, key string, entry bisyncEntry, cur [2]*bisyncListing, reason string) bisyncOp {
+	toRel := entry.rel
+	if other, ok := cur[1-from].files[key]; ok {
+		toRel = other.rel
+	}
+	return bisyncOp{
+		kind:    opCopy,
+		side:    from,
+		key:     key,
+		rel:     entry.rel,
+		toKey:   key,
+		toRel:   toRel,
+		size:    entry.info.Size,
+		origKey: key,
+		reason:  reason,
+	}
+}
+
+// removeOp は、side 側のファイルを消す操作を作ります。
+func (b *bisyncer) removeOp(side int, key string, entry bisyncEntry) bisyncOp {
+	return bisyncOp{
+		kind:    opRemove,
+		side:    side,
+		key:     key,
+		rel:     entry.rel,
+		size:    entry.info.Size,
+		origKey: key,
+		reason:  fmt.Sprintf("%s で消された", b.sides[1-side]),
+	}
+}
+
+// resolveConflict は、両側で変わったファイルの扱いを決めます。
+func (b *bisyncer) resolveConflict(key string, e [2]bisyncEntry, cur [2]*bisyncListing, reserved map[string]struct{}) []bisyncOp {
+	switch b.opts.Conflict {
+	case ConflictAbort:
+		// 実行の前に止めるので、操作は作らない。
+		return nil
+
+	case ConflictNewer:
+		t0, t1 := e[0].info.ModTime, e[1].info.ModTime
+		if !t0.IsZero() && !t1.IsZero() {
+			diff := t0.Sub(t1)
+			switch {
+			case diff > b.cross.Window():
+				return []bisyncOp{b.copyOp(0, key, e[0], cur, "両側で変更された。新しいほうを使う")}
+			case diff < -b.cross.Window():
+				return []bisyncOp{b.copyOp(1, key, e[1], cur, "両側で変更された。新しいほうを使う")}
+			}
+		}
+		// 時刻で決着がつかない。どちらかを捨てる根拠がないので両方残す。
+	}
+
+	// 両側で名前を変え、互いに写し合う。元の名前は両側から無くなる。
+	//
+	// 片方だけ名前を変えて元の名前にもう片方を残すやり方もあるが、
+	// それだと元の名前の中身が両側で違ったまま「前回と同じ」になり、
+	// 次の実行から食い違いが見えなくなる。
+	ops := make([]bisyncOp, 0, 4)
+	for side := range e {
+		newRel := conflictRel(e[side].rel, side+1, func(rel string) bool {
+			k := b.key(rel)
+			if _, ok := reserved[k]; ok {
+				return true
+			}
+			_, ok0 := cur[0].files[k]
+			_, ok1 := cur[1].files[k]
+			return ok0 || ok1
+		})
+		newKey := b.key(newRel)
+		reserved[newKey] = struct{}{}
+
+		ops = append(ops,
+			bisyncOp{
+				kind: opRename, side: side,
+				key: key, rel: e[side].rel,
+				toKey: newKey, toRel: newRel,
+				size: e[side].info.Size, origKey: key,
+				reason: "両側で変更された",
+			},
+			bisyncOp{
+				kind: opCopy, side: side,
+				key: newKey, rel: newRel,
+				toKey: newKey, toRel: newRel,
+				size: e[side].info.Size, origKey: key,
+				reason: "両側で変更されたので両方残す",
+			})
+	}
+	return ops
+}
+
+// conflictRel は、衝突したファイルを残すための名前を返します。
+//
+// "報告.docx" なら "報告.conflict1.docx" のようにします。拡張子を
+// 最後に残すのは、名前を変えたあとも同じアプリで開けるようにするためです。
+func conflictRel(rel string, n int, taken func(string) bool) string {
+	dir := parentRel(rel)
+	name := path.Base(rel)
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s.conflict%d%s", stem, n, ext)
+		if i > 1 {
+			candidate = fmt.Sprintf("%s.conflict%d-%d%s", stem, n, i, ext)
+		}
+		candidate = joinRel(dir, candidate)
+		if !taken(candidate) {
+			return candidate
+		}
+	}
+}
+
+// collapseRemovals は、ディレクトリごと消されたものを1回の操作にまとめます。
+//
+// 1件ずつ消すと、中身の多いディレクトリでは要求の数がそのまま件数に
+// なります。反対側でディレクトリごと無くなっていて、こちら側の中身も
+// すべて消す対象なら、storage.PurgeAll でまとめて消します。
+//
+// 絞り込みで一覧から外したものを含むディレクトリはまとめません。
+// まとめて消すと、絞り込みで守ったはずのものまで巻き込むためです。
+func (b *bisyncer) collapseRemovals(ops []bisyncOp, prevFiles [2]map[string]bisyncStateEntry, cur [2]*bisyncListing) []bisyncOp {
+	for t := range cur {
+		s := 1 - t
+
+		removing := map[string]struct{}{}
+		for _, op := range ops {
+			if op.kind == opRemove && op.side == t {
+				removing[op.key] = struct{}{}
+			}
+		}
+		if len(removing) == 0 {
+			continue
+		}
+
+		// 残るもの、書き込まれるものの親は消せない。
+		keep := map[string]struct{}{}
+		for k := range cur[t].files {
+			if _, ok := removing[k]; !ok {
+				addParents(keep, k)
+			}
+		}
+		for _, op := range ops {
+			switch {
+			case op.kind == opCopy && op.side == s:
+				addParents(keep, op.toKey)
+			case op.kind == opRename && op.side == t:
+				addParents(keep, op.toKey)
+			}
+		}
+
+		// 反対側で、前回はあったのに今は無いディレクトリ。
+		prevDirs := map[string]struct{}{}
+		for k := range prevFiles[s] {
+			addParents(prevDirs, k)
+		}
+
+		var candidates []string
+		for d := range cur[t].dirs {
+			_, stillThere := cur[s].dirs[d]
+			_, wasThere := prevDirs[d]
+			_, kept := keep[d]
+			_, filtered := cur[t].filtered[d]
+			if !stillThere && wasThere && !kept && !filtered {
+				candidates = append(candidates, d)
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+
+		// 浅いものから選び、選んだものの中にあるものは選ばない。
+		sort.Slice(candidates, func(i, j int) bool {
+			if di, dj := depth(candidates[i]), depth(candidates[j]); di != dj {
+				return di < dj
+			}
+			return candidates[i] < candidates[j]
+		})
+		var purge []string
+		for _, d := range candidates {
+			if !underAny(d, purge) {
+				purge = append(purge, d)
+			}
+		}
+
+		counts := make([]int, len(purge))
+		kept := ops[:0]
+		for _, op := range ops {
+			if op.kind == opRemove && op.side == t {
+				if i := indexUnder(op.key, purge); i >= 0 {
+					counts[i]++
+					continue
+				}
+			}
+			kept = append(kept, op)
+		}
+		ops = kept
+		for i, d := range purge {
+			ops = append(ops, bisyncOp{
+				kind:    opPurge,
+				side:    t,
+				key:     d,
+				rel:     cur[t].dirs[d],
+				count:   counts[i],
+				origKey: d,
+				reason:  fmt.Sprintf("%s でディレクトリごと消された", b.sides[s]),
+			})
+		}
+	}
+	return ops
+}
+
+// addParents は、相対パスの親をすべて加えます。
+func addParents(set map[string]struct{}, rel string) {
+	for d := parentRel(rel); d != ""; d = parentRel(d) {
+		set[d] = struct{}{}
+	}
+}
+
+// underAny は、rel がいずれかのディレクトリの中にあるかを返します。
+func underAny(rel string, dirs []string) bool {
+	return indexUnder(rel, dirs) >= 0
+}
+
+// indexUnder は、rel を中に含むディレクトリの添字を返します。無ければ -1 です。
+func indexUnder(rel string, dirs []string) int {
+	for i, d := range dirs {
+		if rel == d || strings.HasPrefix(rel, d+"/") {
+			return i
+		}
+	}
+	return -1
+}
+
+// --- 実行 ---
+
+// execute は決めた操作を行い、終わったあとの両側の一覧を返します。
+//
+// 名前を変えてから写し、写してから消します。衝突したものの名前を
+// 変える前に写すと、変えたはずの名前の先が無いためです。
+// 消すのを最後にするのは、同期での削除と同じく、迷ったら消さない側に
+// 倒すためです。途中で止まっても、消していないぶんは次の実行で拾えます。
+func (b *bisyncer) execute(ctx context.Context, ops []bisyncOp, cur [2]*bisyncListing) [2]map[string]bisyncStateEntry {
+	var next [2]map[string]bisyncStateEntry
+	for i := range cur {
+		next[i] = make(map[string]bisyncStateEntry, len(cur[i].files))
+		for k, e := range cur[i].files {
+			next[i][k] = bisyncStateEntry{Size: e.info.Size, ModTime: e.info.ModTime}
+		}
+	}
+
+	if b.opts.DryRun {
+		for _, op := range ops {
+			b.reporter.Logf("%s（実行しない）", b.opText(op))
+		}
+		return next
+	}
+
+	var renames, copies, removes []bisyncOp
+	for _, op := range ops {
+		switch op.kind {
+		case opRename:
+			renames = append(renames, op)
+		case opCopy:
+			copies = append(copies, op)
+		default:
+			removes = append(removes, op)
+		}
+	}
+
+	// 名前の変更に失敗したものは、変えた名前からは写せない。
+	failedRenames := map[sideKey]struct{}{}
+	for _, op := range renames {
+		if ctx.Err() != nil {
+			b.markPending(op.origKey)
+			continue
+		}
+		info, err := b.rename(ctx, op)
+		if err != nil {
+			failedRenames[sideKey{op.side, op.toKey}] = struct{}{}
+			b.recordFailure(op.origKey, err)
+			continue
+		}
+		b.mu.Lock()
+		delete(next[op.side], op.key)
+		next[op.side][op.toKey] = info
+		b.mu.Unlock()
+	}
+
+	queue := make(chan bisyncOp)
+	var wg sync.WaitGroup
+	for range b.opts.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for op := range queue {
+				if ctx.Err() != nil {
+					b.markPending(op.origKey)
+					continue
+				}
+				if _, ok := failedRenames[sideKey{op.side, op.key}]; ok {
+					continue
+				}
+				info, err := b.copyFile(ctx, op)
+				if err != nil {
+					if ctx.Err() != nil {
+						b.markPending(op.origKey)
+					} else {
+						b.recordFailure(op.origKey, err)
+					}
+					continue
+				}
+				b.mu.Lock()
+				next[1-op.side][op.toKey] = info
+				b.result.Copied++
+				b.result.Bytes += max(info.Size, 0)
+				b.mu.Unlock()
+			}
+		}()
+	}
+	for _, op := range copies {
+		queue <- op
+	}
+	close(queue)
+	wg.Wait()
+
+	// 深いものから消す。
+	sort.SliceStable(removes, func(i, j int) bool {
+		return depth(removes[i].key) > depth(removes[j].key)
+	})
+	for _, op := range removes {
+		if ctx.Err() != nil {
+			b.markPending(op.origKey)
+			continue
+		}
+		if err := b.remove(ctx, op); err != nil {
+			b.recordFailure(op.origKey, err)
+			continue
+		}
+		b.mu.Lock()
+		if op.kind == opPurge {
+			for k := range next[op.side] {
+				if strings.HasPrefix(k, op.key+"/") {
+					delete(next[op.side], k)
+				}
+			}
+			b.result.Deleted += op.count
+		} else {
+			delete(next[op.side], op.key)
+			b.result.Deleted++
+		}
+		b.mu.Unlock()
+	}
+	return next
+}
+
+// sideKey は片側の1ファイルを指します。
+type sideKey struct {
+	side int
+	key  string
+}
+
+// opText は操作を表示用の1行にします。
+func (b *bisyncer) opText(op bisyncOp) string {
+	side := b.sides[op.side]
+	switch op.kind {
+	case opCopy:
+		return fmt.Sprintf("転送 %s:%s -> %s:%s（%s）", side, op.rel, b.sides[1-op.side], op.toRel, op.reason)
+	case opRename:
+		return fmt.Sprintf("改名 %s:%s -> %s（%s）", side, op.rel, op.toRel, op.reason)
+	case opPurge:
+		return fmt.Sprintf("削除 %s:%s/ の %d件（%s）", side, op.rel, op.count, op.reason)
+	default:
+		return fmt.Sprintf("削除 %s:%s（%s）", side, op.rel, op.reason)
+	}
+}
+
+// copyFile は1ファイルを反対側へ写します。
+func (b *bisyncer) copyFile(ctx context.Context, op bisyncOp) (bisyncStateEntry, error) {
+	from, to := b.sides[op.side], b.sides[1-op.side]
+	srcPath := path.Join(from.Dir, op.rel)
+	dstPath := path.Join(to.Dir, op.toRel)
+	started := time.Now()
+
+	tracker := b.reporter.StartFile(path.Base(op.rel), op.size)
+	defer tracker.Finish()
+
+	var written *storage.FileInfo
+	res := doWithRetry(ctx, b.opts.Retry,
+		func(ctx context.Context, _ int) error {
+			if err := b.ensureParent(ctx, 1-op.side, dstPath); err != nil {
+				return err
+			}
+			if err := b.limits.wait(ctx, from.Storage); err != nil {
+				return err
+			}
+			info, err := storage.Copy(ctx, from.Storage, srcPath, to.Storage, dstPath, storage.CopyOptions{
+				Wrap: func(r io.Reader) io.Reader {
+					return tracker.Wrap(b.bw.wrap(ctx, r))
+				},
+			})
+			written = info
+			return err
+		},
+		func(attempt int, wait time.Duration, err error) {
+			tracker.Reset()
+			b.reporter.Logf("%s ... 失敗 (%v) → %s待機 → 再試行 %d/%d",
+				op.rel, shortError(err), wait.Round(time.Second), attempt, b.opts.Retry.MaxAttempts)
+		})
+
+	err := res.err
+	if err == nil && (written == nil || written.ModTime.IsZero()) {
+		// 書いた結果に時刻が無ければ、次の実行で比べられるよう読み直す。
+		written, err = to.Storage.Stat(ctx, dstPath)
+	}
+	if err != nil {
+		tracker.Abort()
+		err = fmt.Errorf("%s:%s -> %s:%s: %w", from.Storage.Type(), srcPath, to.Storage.Type(), dstPath, err)
+		b.reporter.Logf("失敗: %v", err)
+	}
+
+	if b.opts.OnTransfer != nil {
+		b.opts.OnTransfer(TransferEvent{
+			SrcPath:  srcPath,
+			DstPath:  dstPath,
+			Bytes:    op.size,
+			Duration: time.Since(started),
+			Attempts: res.attempts,
+			Err:      err,
+		}, op.side == 0)
+	}
+	if err != nil {
+		return bisyncStateEntry{}, err
+	}
+	return bisyncStateEntry{Size: written.Size, ModTime: written.ModTime}, nil
+}
+
+// ensureParent は、書き込み先の親ディレクトリを用意します。
+func (b *bisyncer) ensureParent(ctx context.Context, side int, p string) error {
+	s := b.sides[side].Storage
+	if f := s.Features(); f != nil && f.ImplicitDirs {
+		return nil
+	}
+	dir := path.Dir(p)
+	key := fmt.Sprintf("%d:%s", side, dir)
+
+	b.dirsMu.Lock()
+	_, made := b.madeDirs[key]
+	b.dirsMu.Unlock()
+	if made {
+		return nil
+	}
+
+	if err := b.limits.wait(ctx, s); err != nil {
+		return err
+	}
+	if err := s.Mkdir(ctx, dir); err != nil {
+		return err
+	}
+	b.dirsMu.Lock()
+	b.madeDirs[key] = struct{}{}
+	b.dirsMu.Unlock()
+	return nil
+}
+
+// rename は衝突したファイルの名前を変え、変えたあとの記録を返します。
+func (b *bisyncer) rename(ctx context.Context, op bisyncOp) (bisyncStateEntry, error) {
+	side := b.sides[op.side]
+	src := path.Join(side.Dir, op.rel)
+	dst := path.Join(side.Dir, op.toRel)
+	b.reporter.Logf("%s", b.opText(op))
+
+	res := doWithRetry(ctx, b.opts.Retry, func(ctx context.Context, _ int) error {
+		if err := b.limits.wait(ctx, side.Storage); err != nil {
+			return err
+		}
+		return storage.Move(ctx, side.Storage, src, dst)
+	}, nil)
+	if res.err != nil {
+		return bisyncStateEntry{}, fmt.Errorf("%s:%s の名前を変えられませんでした: %w", side.Storage.Type(), src, res.err)
+	}
+
+	// 移動で時刻が変わるストレージもあるので、読み直して記録する。
+	info, err := side.Storage.Stat(ctx, dst)
+	if err != nil {
+		return bisyncStateEntry{}, err
+	}
+	return bisyncStateEntry{Size: info.Size, ModTime: info.ModTime}, nil
+}
+
+// remove は反対側で消されたものを消します。
+func (b *bisyncer) remove(ctx context.Context, op bisyncOp) error {
+	side := b.sides[op.side]
+	p := path.Join(side.Dir, op.rel)
+
+	err := doWithRetry(ctx, b.opts.Retry, func(ctx context.Context, _ int) error {
+		if err := b.limits.wait(ctx, side.Storage); err != nil {
+			return err
+		}
+		if op.kind == opPurge {
+			return storage.PurgeAll(ctx, side.Storage, p)
+		}
+		return side.Storage.Remove(ctx, p)
+	}, nil).err
+
+	if err != nil && !storage.IsNotFound(err) {
+		err = fmt.Errorf("%s:%s を消せませんでした: %w", side.Storage.Type(), p, err)
+		b.reporter.Logf("失敗: %v", err)
+		return err
+	}
+	b.reporter.Logf("%s", b.opText(op))
+	return nil
+}
+
+// markPending は、行わなかった操作の対象を控えます。前回の記録を残します。
+func (b *bisyncer) markPending(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failedKeys[key] = struct{}{}
+}
+
+// recordFailure は失敗を記録します。
+func (b *bisyncer) recordFailure(key string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failedKeys[key] = struct{}{}
+	b.result.Failed++
+	if len(b.result.Errors) < MaxReportedErrors {
+		b.result.Errors = append(b.result.Errors, err)
+	}
+}
+
+// snapshotResult は結果の写しを返します。
+func (b *bisyncer) snapshotResult() BisyncResult {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.result
+}
+
+// buildState は次の実行のための記録を作ります。
+//
+// 失敗したもの、行わなかったものは前回の記録に戻します。
+// 今の状態を記録すると、例えば消し損ねたものが「前回と同じ」になり、
+// 次の実行で消された側へ書き戻してしまいます。
+func (b *bisyncer) buildState(prev *bisyncState, next [2]map[string]bisyncStateEntry) *bisyncState {
+	for key := range b.failedKeys {
+		for i := range next {
+			// ディレクトリごとの操作なら、その中身すべてが対象になる。
+			for k := range next[i] {
+				if strings.HasPrefix(k, key+"/") {
+					delete(next[i], k)
+				}
+			}
+			delete(next[i], key)
+			if prev == nil {
+				continue
+			}
+			files := prev.Files1
+			if i == 1 {
+				files = prev.Files2
+			}
+			for k, e := range files {
+				if k == key || strings.HasPrefix(k, key+"/") {
+					next[i][k] = e
+				}
+			}
+		}
+	}
+
+	return &bisyncState{
+		Version: bisyncStateVersion,
+		Path1:   b.opts.Path1.String(),
+		Path2:   b.opts.Path2.String(),
+		SavedAt: time.Now(),
+		Files1:  next[0],
+		Files2:  next[1],
+	}
+}
@@ -0,0 +1,107 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// bisyncStateVersion は状態ファイルの形式の版です。
+// 形式を変えたら上げます。読めない版の状態は無いものとして扱い、
+// 最初の同期からやり直させます。
+const bisyncStateVersion = 1
+
+// bisyncState は、前回の双方向同期が終わった時点の両側の一覧です。
+//
+// 変化は「前回の一覧と今の一覧の差」で見つけます。今の一覧どうしを
+// 比べるだけでは、片側で消したのか、もう片側で新しく作ったのかが
+// 区別できないためです。
+type bisyncState struct {
+	Version int `json:"version"`
+	// Path1 と Path2 は、どの組み合わせの状態かを表します。
+	// 取り違えて別の組み合わせの状態を使わないよう、読むときに照合します。
+	Path1 string `json:"path1"`
+	Path2 string `json:"path2"`
+	// SavedAt は保存した時刻です。表示にだけ使います。
+	SavedAt time.Time `json:"saved_at"`
+
+	// Files1 と Files2 は、起点からの相対パスをキーにした一覧です。
+	Files1 map[string]bisyncStateEntry `json:"files1"`
+	Files2 map[string]bisyncStateEntry `json:"files2"`
+}
+
+// bisyncStateEntry は1ファイルぶんの記録です。
+type bisyncStateEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// loadBisyncState は状態を読みます。
+//
+// 無い場合、版が違う場合、別の組み合わせのものだった場合は nil を返します。
+// いずれも「前回は無かった」として最初の同期をやり直せば済むので、
+// エラーにはしません。読めない場合だけエラーにします。壊れた状態を
+// 無かったことにすると、消えたものを新しく現れたものと取り違えて
+// 反対側へ書き戻すことになるためです。
+func loadBisyncState(file, path1, path2 string) (*bisyncState, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("前回の同期の記録を読めませんでした %s: %w", file, err)
+	}
+
+	var st bisyncState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("前回の同期の記録が壊れています %s: %w", file, err)
+	}
+	if st.Version != bisyncStateVersion || st.Path1 != path1 || st.Path2 != path2 {
+		return nil, nil
+	}
+	if st.Files1 == nil {
+		st.Files1 = map[string]bisyncStateEntry{}
+	}
+	if st.Files2 == nil {
+		st.Files2 = map[string]bisyncStateEntry{}
+	}
+	return &st, nil
+}
+
+// saveBisyncState は状態を書きます。
+//
+// 一時ファイルに書いてから置き換えます。書いている途中で止まると
+// 半端な状態が残り、次の実行で読めなくなるためです。
+func saveBisyncState(file string, st *bisyncState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("同期の記録の置き場所を作れませんでした %s: %w", dir, err)
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("同期の記録を書けませんでした %s: %w", file, err)
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // 置き換えに成功していれば消すものはない
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("同期の記録を書けませんでした %s: %w", file, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("同期の記録を書けませんでした %s: %w", file, err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return fmt.Errorf("同期の記録を置き換えられませんでした %s: %w", file, err)
+	}
+	return nil
+}
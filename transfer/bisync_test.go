@@ -0,0 +1,304 @@
+package transfer_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/transfer"
+)
+
+// 双方向同期の判断表を、ここで固定します。
+// どちらの側で何が起きたら何をするかは、取り違えるとデータを失うので、
+// 組み合わせごとに1つずつ確かめます。
+
+func bisyncOptions(t *testing.T, s1, s2 *memory.Storage) transfer.BisyncOptions {
+	t.Helper()
+	return transfer.BisyncOptions{
+		Path1:     transfer.BisyncSide{Storage: s1, Dir: "/laptop"},
+		Path2:     transfer.BisyncSide{Storage: s2, Dir: "/cloud"},
+		StateFile: filepath.Join(t.TempDir(), "bisync.json"),
+		Workers:   2,
+		Compare:   transfer.DefaultComparePolicy(),
+		Retry:     transfer.RetryPolicy{MaxAttempts: 1},
+	}
+}
+
+func runBisync(t *testing.T, opts transfer.BisyncOptions) *transfer.BisyncResult {
+	t.Helper()
+	result, err := transfer.RunBisync(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("RunBisync: %v", err)
+	}
+	return result
+}
+
+// putAt は更新時刻を指定して置きます。
+// 前回と今回の変化を時刻で見分けるので、試験では時刻をはっきりずらす。
+func putAt(t *testing.T, s *memory.Storage, path, content string, at time.Time) {
+	t.Helper()
+	put(t, s, path, content)
+	if err := s.SetModTime(context.Background(), path, at); err != nil {
+		t.Fatalf("SetModTime: %v", err)
+	}
+}
+
+func TestBisyncFirstRunMergesBothSides(t *testing.T) {
+	s1, s2 := newPair(t)
+	past := time.Now().Add(-time.Hour)
+	putAt(t, s1, "/laptop/a.txt", "a", past)
+	putAt(t, s2, "/cloud/sub/b.txt", "b", past)
+
+	result := runBisync(t, bisyncOptions(t, s1, s2))
+
+	if !result.FirstRun || result.Copied != 2 {
+		t.Errorf("FirstRun=%v Copied=%d, want true と 2", result.FirstRun, result.Copied)
+	}
+	if got := s2.Snapshot()["/cloud/a.txt"]; got != "a" {
+		t.Errorf("cloud/a.txt = %q", got)
+	}
+	if got := s1.Snapshot()["/laptop/sub/b.txt"]; got != "b" {
+		t.Errorf("laptop/sub/b.txt = %q", got)
+	}
+}
+
+func TestBisyncPropagatesChangesAndDeletions(t *testing.T) {
+	s1, s2 := newPair(t)
+	past := time.Now().Add(-2 * time.Hour)
+	putAt(t, s1, "/laptop/edit.txt", "古い", past)
+	putAt(t, s1, "/laptop/gone.txt", "消す", past)
+	opts := bisyncOptions(t, s1, s2)
+	runBisync(t, opts)
+
+	// laptop で書き換え、cloud で消す。
+	putAt(t, s1, "/laptop/edit.txt", "新しい", time.Now().Add(-time.Hour))
+	if err := s2.Remove(context.Background(), "/cloud/gone.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	result := runBisync(t, opts)
+
+	if result.FirstRun {
+		t.Error("前回の記録が使われていない")
+	}
+	if got := s2.Snapshot()["/cloud/edit.txt"]; got != "新しい" {
+		t.Errorf("変更が伝わっていない: %q", got)
+	}
+	if _, ok := s1.Snapshot()["/laptop/gone.txt"]; ok {
+		t.Error("削除が伝わっていない")
+	}
+	if result.Deleted != 1 {
+		t.Errorf("Deleted=%d, want 1", result.Deleted)
+	}
+}
+
+// 何も変わっていなければ何もしないことを確かめます。
+func TestBisyncSecondRunIsNoop(t *testing.T) {
+	s1, s2 := newPair(t)
+	putAt(t, s1, "/laptop/a.txt", "a", time.Now().Add(-time.Hour))
+	opts := bisyncOptions(t, s1, s2)
+	runBisync(t, opts)
+
+	result := runBisync(t, opts)
+	if result.Copied != 0 || result.Deleted != 0 || result.Conflicts != 0 {
+		t.Errorf("Copied=%d Deleted=%d Conflicts=%d, want すべて 0",
+			result.Copied, result.Deleted, result.Conflicts)
+	}
+}
+
+// 片側で消され、もう片側で変えられたものは、変えた側を残すことを確かめます。
+func TestBisyncModifiedWinsOverDeleted(t *testing.T) {
+	s1, s2 := newPair(t)
+	putAt(t, s1, "/laptop/a.txt", "元", time.Now().Add(-2*time.Hour))
+	putAt(t, s1, "/laptop/keep.txt", "残す", time.Now().Add(-2*time.Hour))
+	opts := bisyncOptions(t, s1, s2)
+	runBisync(t, opts)
+
+	if err := s1.Remove(context.Background(), "/laptop/a.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	putAt(t, s2, "/cloud/a.txt", "直した", time.Now().Add(-time.Hour))
+
+	runBisync(t, opts)
+
+	if got := s1.Snapshot()["/laptop/a.txt"]; got != "直した" {
+		t.Errorf("変更した側が書き戻されていない: %q", got)
+	}
+	if got := s2.Snapshot()["/cloud/a.txt"]; got != "直した" {
+		t.Errorf("変更した側が消えている: %q", got)
+	}
+}
+
+func TestBisyncConflictKeepsBoth(t *testing.T) {
+	s1, s2 := newPair(t)
+	putAt(t, s1, "/laptop/報告.docx", "元", time.Now().Add(-3*time.Hour))
+	opts := bisyncOptions(t, s1, s2)
+	runBisync(t, opts)
+
+	putAt(t, s1, "/laptop/報告.docx", "ノートPCで直した", time.Now().Add(-2*time.Hour))
+	putAt(t, s2, "/cloud/報告.docx", "Dropboxで直した", time.Now().Add(-time.Hour))
+
+	result := runBisync(t, opts)
+
+	if result.Conflicts != 1 {
+		t.Errorf("Conflicts=%d, want 1", result.Conflicts)
+	}
+	for _, s := range []struct {
+		snap map[string]string
+		dir  string
+	}{{s1.Snapshot(), "/laptop"}, {s2.Snapshot(), "/cloud"}} {
+		if got := s.snap[s.dir+"/報告.conflict1.docx"]; got != "ノートPCで直した" {
+			t.Errorf("%s の conflict1 = %q", s.dir, got)
+		}
+		if got := s.snap[s.dir+"/報告.conflict2.docx"]; got != "Dropboxで直した" {
+			t.Errorf("%s の conflict2 = %q", s.dir, got)
+		}
+		if _, ok := s.snap[s.dir+"/報告.docx"]; ok {
+			t.Errorf("%s に元の名前が残っている", s.dir)
+		}
+	}
+
+	// 残した2つは、次の実行ではもう衝突ではない。
+	result = runBisync(t, opts)
+	if result.Conflicts != 0 || result.Copied != 0 {
+		t.Errorf("2回目: Conflicts=%d Copied=%d, want 0 と 0", result.Conflicts, result.Copied)
+	}
+}
+
+func TestBisyncConflictNewerWins(t *testing.T) {
+	s1, s2 := newPair(t)
+	putAt(t, s1, "/laptop/a.txt", "元", time.Now().Add(-3*time.Hour))
+	opts := bisyncOptions(t, s1, s2)
+	opts.Conflict = transfer.ConflictNewer
+	runBisync(t, opts)
+
+	putAt(t, s1, "/laptop/a.txt", "古いほう", time.Now().Add(-2*time.Hour))
+	putAt(t, s2, "/cloud/a.txt", "新しいほう", time.Now().Add(-time.Hour))
+
+	runBisync(t, opts)
+
+	if got := s1.Snapshot()["/laptop/a.txt"]; got != "新しいほう" {
+		t.Errorf("laptop/a.txt = %q", got)
+	}
+}
+
+// 衝突を止める指定なら、何も変えずに止まることを確かめます。
+func TestBisyncConflictAbortChangesNothing(t *testing.T) {
+	s1, s2 := newPair(t)
+	putAt(t, s1, "/laptop/a.txt", "元", time.Now().Add(-3*time.Hour))
+	opts := bisyncOptions(t, s1, s2)
+	opts.Conflict = transfer.ConflictAbort
+	runBisync(t, opts)
+
+	putAt(t, s1, "/laptop/a.txt", "こちら", time.Now().Add(-2*time.Hour))
+	putAt(t, s1, "/laptop/new.txt", "新規", time.Now().Add(-2*time.Hour))
+	putAt(t, s2, "/cloud/a.txt", "あちら", time.Now().Add(-time.Hour))
+
+	_, err := transfer.RunBisync(context.Background(), opts)
+	if !errors.Is(err, transfer.ErrBisyncConflict) {
+		t.Fatalf("err = %v, want ErrBisyncConflict", err)
+	}
+	if _, ok := s2.Snapshot()["/cloud/new.txt"]; ok {
+		t.Error("止めたはずなのに転送している")
+	}
+}
+
+// 片側が丸ごと空になっていたら、反対側を消さずに止まることを確かめます。
+//
+// 外付けのディスクを挿し忘れて実行した、という場面を想定しています。
+func TestBisyncRefusesWhenSideEmptied(t *testing.T) {
+	s1, s2 := newPair(t)
+	putAt(t, s1, "/laptop/a.txt", "a", time.Now().Add(-time.Hour))
+	putAt(t, s1, "/laptop/b.txt", "b", time.Now().Add(-time.Hour))
+	opts := bisyncOptions(t, s1, s2)
+	runBisync(t, opts)
+
+	if err := s1.Remove(context.Background(), "/laptop/a.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := s1.Remove(context.Background(), "/laptop/b.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	_, err := transfer.RunBisync(context.Background(), opts)
+	if !errors.Is(err, transfer.ErrBisyncSideEmpty) {
+		t.Fatalf("err = %v, want ErrBisyncSideEmpty", err)
+	}
+	if len(s2.Snapshot()) < 2 {
+		t.Error("反対側を消している")
+	}
+}
+
+// 消し損ねたものは、次の実行でもう一度消しに行くことを確かめます。
+//
+// 今の状態をそのまま記録すると、消し損ねたものが「前回と同じ」になり、
+// 消した側へ書き戻されてしまいます。
+func TestBisyncRetriesFailedDeletionNextRun(t *testing.T) {
+	s1, s2 := newPair(t)
+	putAt(t, s1, "/laptop/keep.txt", "残す", time.Now().Add(-time.Hour))
+	putAt(t, s1, "/laptop/gone.txt", "消す", time.Now().Add(-time.Hour))
+	opts := bisyncOptions(t, s1, s2)
+	runBisync(t, opts)
+
+	if err := s2.Remove(context.Background(), "/cloud/gone.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	s1.SetHooks(memory.Hooks{
+		BeforeOp: func(op, _ string) error {
+			if op == "remove" {
+				return errors.New("消せない")
+			}
+			return nil
+		},
+	})
+
+	result := runBisync(t, opts)
+	if result.Failed != 1 {
+		t.Fatalf("Failed=%d, want 1", result.Failed)
+	}
+
+	s1.SetHooks(memory.Hooks{})
+	runBisync(t, opts)
+
+	if _, ok := s1.Snapshot()["/laptop/gone.txt"]; ok {
+		t.Error("消し損ねたものが残っている")
+	}
+	if _, ok := s2.Snapshot()["/cloud/gone.txt"]; ok {
+		t.Error("消した側へ書き戻している")
+	}
+}
+
+// ディレクトリごと消されたものは、反対側でもまとめて消えることを確かめます。
+func TestBisyncPurgesRemovedDirectory(t *testing.T) {
+	s1, s2 := newPair(t)
+	past := time.Now().Add(-time.Hour)
+	putAt(t, s1, "/laptop/keep.txt", "残す", past)
+	putAt(t, s1, "/laptop/old/a.txt", "a", past)
+	putAt(t, s1, "/laptop/old/deep/b.txt", "b", past)
+	opts := bisyncOptions(t, s1, s2)
+	runBisync(t, opts)
+
+	if err := s2.Remove(context.Background(), "/cloud/old/deep/b.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	for _, p := range []string{"/cloud/old/deep", "/cloud/old/a.txt", "/cloud/old"} {
+		if err := s2.Remove(context.Background(), p); err != nil {
+			t.Fatalf("Remove(%s): %v", p, err)
+		}
+	}
+
+	result := runBisync(t, opts)
+
+	if result.Deleted != 2 {
+		t.Errorf("Deleted=%d, want 2", result.Deleted)
+	}
+	if _, ok := s1.Snapshot()["/laptop/old"]; ok {
+		t.Error("ディレクトリが残っている")
+	}
+	if got := s1.Snapshot()["/laptop/keep.txt"]; got != "残す" {
+		t.Errorf("関係のないものに触れている: %q", got)
+	}
+}
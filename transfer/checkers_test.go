@@ -0,0 +1,239 @@
+package transfer_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/transfer"
+)
+
+// putTree は、いくつかのディレクトリにファイルを置いたコピー元を作ります。
+// 先に一覧されるディレクトリほど一覧に時間がかかるようにして、
+// 並行して走査すると終わる順番が入れ替わるようにします。
+func putTree(t *testing.T) (*memory.Storage, *memory.Storage) {
+	t.Helper()
+	src, dst := newPair(t)
+	for i := range 5 {
+		for j := range 3 {
+			put(t, src, fmt.Sprintf("/data/d%d/f%d.txt", i, j), "x")
+			put(t, src, fmt.Sprintf("/data/d%d/奥/g%d.txt", i, j), "y")
+		}
+	}
+	put(t, src, "/data/top.txt", "t")
+	put(t, dst, "/backup/data/d2/f1.txt", "x")
+
+	src.SetHooks(memory.Hooks{
+		BeforeOp: func(op, p string) error {
+			if op == "list" && strings.HasPrefix(p, "/data/d") {
+				n := int(p[len("/data/d")] - '0')
+				time.Sleep(time.Duration(5-n) * 3 * time.Millisecond)
+			}
+			return nil
+		},
+	})
+	return src, dst
+}
+
+// 並行して走査しても、判断の知らせが1つずつ走査したときと同じ順に届くことを確かめます。
+func TestCheckersKeepDecisionOrder(t *testing.T) {
+	decisions := func(checkers int) []transfer.DecisionEvent {
+		src, dst := putTree(t)
+		var events []transfer.DecisionEvent
+		opts := baseOptions(src, dst)
+		opts.Checkers = checkers
+		opts.DryRun = true
+		opts.OnDecision = func(ev transfer.DecisionEvent) {
+			events = append(events, ev)
+		}
+		if _, err := transfer.Run(context.Background(), opts); err != nil {
+			t.Fatalf("Run (checkers=%d): %v", checkers, err)
+		}
+		return events
+	}
+
+	want := decisions(1)
+	if len(want) != 31 {
+		t.Fatalf("判断の数 = %d, want 31", len(want))
+	}
+	for range 3 {
+		if got := decisions(4); !slices.Equal(got, want) {
+			t.Fatalf("並行したときの順番が違う:\n got %v\nwant %v", got, want)
+		}
+	}
+}
+
+// 同時に一覧する数が checkers を超えず、それでいて並行していることを確かめます。
+func TestCheckersBoundConcurrentLists(t *testing.T) {
+	src, dst := newPair(t)
+	for i := range 8 {
+		put(t, src, fmt.Sprintf("/data/d%d/a.txt", i), "a")
+	}
+	var (
+		mu        sync.Mutex
+		cur, peak int
+	)
+	src.SetHooks(memory.Hooks{
+		BeforeOp: func(op, _ string) error {
+			if op != "list" {
+				return nil
+			}
+			mu.Lock()
+			cur++
+			peak = max(peak, cur)
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			cur--
+			mu.Unlock()
+			return nil
+		},
+	})
+
+	opts := baseOptions(src, dst)
+	opts.Checkers = 3
+	result, err := transfer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.Transferred != 8 || result.Failed != 0 {
+		t.Errorf("転送 = %d, 失敗 = %d, want 8, 0: %v", result.Transferred, result.Failed, result.Errors)
+	}
+	if peak < 2 || peak > 3 {
+		t.Errorf("同時に一覧した数 = %d, want 2〜3", peak)
+	}
+}
+
+// 並行して走査しても、済んだディレクトリだけが記録されることを確かめます。
+func TestCheckersJournalResume(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, src, "/data/済む/a.txt", "a")
+	put(t, src, "/data/済む/奥/b.txt", "b")
+	put(t, src, "/data/残る/c.txt", "c")
+	put(t, src, "/data/残る/奥/d.txt", "d")
+	file := filepath.Join(t.TempDir(), "journal.log")
+
+	// 1回目は「残る」の奥への書き込みを失敗させる。
+	var failing atomic.Bool
+	failing.Store(true)
+	dst.SetHooks(memory.Hooks{
+		BeforeOp: func(op, p string) error {
+			if op == "put" && failing.Load() && p == "/backup/data/残る/奥/d.txt" {
+				return fmt.Errorf("書けません")
+			}
+			return nil
+		},
+	})
+	opts := baseOptions(src, dst)
+	opts.Checkers = 4
+	opts.Journal = openJournal(t, file, "key", false)
+	first, err := transfer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("1回目: %v", err)
+	}
+	if first.Failed != 1 {
+		t.Fatalf("1回目の失敗 = %d, want 1", first.Failed)
+	}
+	opts.Journal.Close()
+
+	// 2回目は続きから。
+	failing.Store(false)
+	lists := countLists(src, "")
+	opts.Journal = openJournal(t, file, "key", true)
+	second, err := transfer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("2回目: %v", err)
+	}
+
+	got := lists()
+	for _, p := range []string{"/data/済む", "/data/済む/奥"} {
+		if got[p] != 0 {
+			t.Errorf("済んでいた %s を一覧し直した", p)
+		}
+	}
+	for _, p := range []string{"/data/残る", "/data/残る/奥"} {
+		if got[p] == 0 {
+			t.Errorf("済んでいない %s を一覧していない", p)
+		}
+	}
+	if second.Transferred != 1 || second.Failed != 0 {
+		t.Errorf("2回目の転送 = %d, 失敗 = %d, want 1, 0", second.Transferred, second.Failed)
+	}
+}
+
+// 先に一覧される子の走査が止まっていても、後ろの兄弟の判断の知らせを
+// 際限なく溜めず、上限で走査を待たせることを確かめます。
+func TestCheckersBoundPendingDecisions(t *testing.T) {
+	const (
+		siblings = 100
+		files    = 100
+		// 溜めるのは 4096 件まで。100 件ずつのディレクトリなら 40 個と、
+		// 途中で待っている1個まで。
+		maxListed = 4096/files + 1
+	)
+	src, dst := newPair(t)
+	put(t, src, "/data/a/遅い.txt", "a")
+	for i := range siblings {
+		for j := range files {
+			put(t, src, fmt.Sprintf("/data/b%03d/f%03d.txt", i, j), "b")
+		}
+	}
+
+	stalled := make(chan struct{})
+	release := make(chan struct{})
+	var listed atomic.Int64
+	src.SetHooks(memory.Hooks{
+		BeforeOp: func(op, p string) error {
+			if op != "list" {
+				return nil
+			}
+			switch {
+			case p == "/data/a":
+				close(stalled)
+				<-release
+			case strings.HasPrefix(p, "/data/b"):
+				listed.Add(1)
+			}
+			return nil
+		},
+	})
+
+	var decided atomic.Int64
+	opts := baseOptions(src, dst)
+	opts.Checkers = 2
+	opts.DryRun = true
+	opts.OnDecision = func(transfer.DecisionEvent) { decided.Add(1) }
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := transfer.Run(context.Background(), opts)
+		done <- err
+	}()
+
+	<-stalled
+	// 後ろの兄弟の走査が進まなくなるまで待つ。
+	last := int64(-1)
+	for listed.Load() != last && listed.Load() < siblings {
+		last = listed.Load()
+		time.Sleep(50 * time.Millisecond)
+	}
+	got := listed.Load()
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got > maxListed {
+		t.Errorf("止まった子の後ろで %d 個のディレクトリを一覧した、want %d 個まで", got, maxListed)
+	}
+	if n := decided.Load(); n != siblings*files+1 {
+		t.Errorf("判断の数 = %d, want %d", n, siblings*files+1)
+	}
+}
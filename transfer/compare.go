@@ -129,6 +129,27 @@ func NewComparer(policy ComparePolicy, src, dst storage.Storage) (*Comparer, err
 	return c, nil
 }
 
+// NewChangeDetector は、同じストレージの前回と今回の一覧を比べる判断器を作ります。
+// 双方向同期で、前回からどちら側で何が変わったかを見つけるのに使います。
+// Decide が ActionCopy を返せば、変わったということです。
+//
+// コピーの判断とは次の点が違います。
+//
+//   - 新旧の向きを問いません。前回より古い時刻に戻っていれば、
+//     それも変化です（バックアップから書き戻した場合など）。
+//   - 時刻を書き込めないストレージでも時刻で比べます。比べるのは
+//     そのストレージ自身が付けた時刻どうしなので、書き込めなくても意味があります。
+//   - ハッシュは使いません。前回の一覧に載っていたハッシュを取り直す
+//     手段はなく、取り直すと今の中身のハッシュが返ってきてしまうためです。
+func NewChangeDetector(s storage.Storage, window time.Duration) *Comparer {
+	return &Comparer{
+		policy: ComparePolicy{Fields: []CompareField{CompareSize, CompareModTime}},
+		src:    s,
+		dst:    s,
+		window: resolveModifyWindow(window, s, s),
+	}
+}
+
 // Window は実際に使われる許容幅を返します。
 func (c *Comparer) Window() time.Duration { return c.window }
 
@@ -2,8 +2,10 @@ package transfer
 
 import (
 	"context"
+	"path"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/mt3hr/hbg/storage"
 )
@@ -36,8 +38,23 @@ type extraneous struct {
 	// rel はコピー元の起点からの相対パスです。表示に使います。
 	rel string
 	// isDir はディレクトリかどうかです。
-	isDir bool
-	size  int64
+	isDir   bool
+	size    int64
+	modTime time.Time
+	// hashes は一覧のついでに得られたハッシュです。改名の照合に使います。
+	hashes map[storage.HashType]string
+}
+
+// info は照合に使うメタデータを組み立て直します。
+func (x extraneous) info() storage.FileInfo {
+	return storage.FileInfo{
+		Path:    x.path,
+		Name:    path.Base(x.path),
+		Size:    x.size,
+		ModTime: x.modTime,
+		IsDir:   x.isDir,
+		Hashes:  x.hashes,
+	}
 }
 
 // collectExtraneous は、コピー元にないものを控えます。
@@ -64,6 +81,9 @@ func (e *engine) collectExtraneous(
 				// 書き込み中のものは、転送の側が片付ける。
 				continue
 			}
+			if e.keepPart(entry, srcNames) {
+				continue
+			}
 			e.addExtraneous(entry, rel)
 			continue
 		}
@@ -85,7 +105,7 @@ func (e *engine) collectExtraneous(
 
 // collectDirContents はコピー元にないディレクトリの中を控えます。
 func (e *engine) collectDirContents(ctx context.Context, dir, relDir string) error {
-	entries, err := storage.ListAll(ctx, e.opts.Dst, dir)
+	entries, err := e.listDst(ctx, dir)
 	if err != nil {
 		if storage.IsNotFound(err) {
 			return nil
@@ -139,16 +159,87 @@ func (e *engine) stalePart(entry storage.FileInfo) bool {
 	return entry.ModTime.Before(e.startedAt)
 }
 
+// keepPart は、置き去りの書きかけを次の転送のために残すかを返します。
+//
+// 続きから送れる書きかけを消してしまうと、大きなファイルほど
+// 転送の失敗のたびに最初からやり直すことになります。
+// --delete-on-partial で失敗があっても削除を続ける場合がちょうどそれで、
+// 今回送れなかったファイルの書きかけを、次の実行が使えなくなります。
+//
+// 残すのは、書きかけの名前が指すファイルがまだコピー元にあるものだけです。
+// コピー元から消えたものの書きかけは、もう誰も続きを書きません。
+// 続きから送る使い方をしていないなら、残しても使われないので残しません。
+func (e *engine) keepPart(entry storage.FileInfo, srcNames map[string]struct{}) bool {
+	if e.opts.PartialMinSize <= 0 || !storage.CanResume(e.opts.Src, e.opts.Dst) {
+		return false
+	}
+	target, ok := partTarget(entry.Name)
+	if !ok {
+		return false
+	}
+	_, ok = srcNames[e.nameKey(target)]
+	return ok
+}
+
+// partTarget は、書きかけの名前からその書き込み先の名前を求めます。
+//
+// 続きから書けるのは ".名前.hbgpart" の形のものだけです。
+// 名前に乱数の混じった一時ファイルは、書いた本人にしか行き先が分かりません。
+func partTarget(name string) (string, bool) {
+	if !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, partSuffix) {
+		return "", false
+	}
+	target := strings.TrimSuffix(strings.TrimPrefix(name, "."), partSuffix)
+	if target == "" {
+		return "", false
+	}
+	return target, true
+}
+
+// trustedPart は、書きかけの続きから送ってよいかを返します。
+//
+// 書きかけの中身をコピー元と読み比べはしません。読み比べるには
+// 書きかけと同じ量をもう一度読むことになり、続きから送る意味がないためです。
+// 先頭のハッシュで比べることもしません。ストレージが答えられるのは
+// ファイル全体のハッシュだけで、書きかけと同じ長さの先頭のハッシュは、
+// やはりその範囲を読まないと求められません。
+// 代わりに、書きかけを書いてからコピー元が変わっていないことを、
+// 大きさと更新日時で確かめます。
+//
+// 今回の実行より前の書きかけ（stalePart が真のもの）も同じ基準で扱います。
+// 書いたのが前回の hbg か今回の再試行かで、中身の確からしさは変わりません。
+// 日時はコピー元と転送先の時計で測ったものを比べるので、比べるときと同じ
+// 許容幅（--modify-window）までのずれは、変わっていないものとみなします。
+// 変わっていたとしても、書き込み先が全体のハッシュを返せば、書き終えた
+// ところで ResumeCopy の検証で見つかります。
+func (e *engine) trustedPart(part, src storage.FileInfo) bool {
+	if part.IsDir {
+		return false
+	}
+	if src.Size == storage.SizeUnknown || part.Size > src.Size {
+		return false
+	}
+	// 日時が分からなければ、変わっていないことを確かめようがない。
+	if src.ModTime.IsZero() || part.ModTime.IsZero() {
+		return false
+	}
+	// 書きかけより後にコピー元が書き換わっていれば、
+	// 書きかけの中身はもう古いかもしれない。
+	return !src.ModTime.After(part.ModTime.Add(e.comparer.Window()))
+}
+
 // addExtraneous は1件を控えます。
 func (e *engine) addExtraneous(entry storage.FileInfo, rel string) {
 	e.extraMu.Lock()
 	defer e.extraMu.Unlock()
 
 	e.extra = append(e.extra, extraneous{
-		path:  entry.Path,
-		rel:   rel,
-		isDir: entry.IsDir,
-		size:  entry.Size,
+		path:    entry.Path,
+		rel:     rel,
+		isDir:   entry.IsDir,
+		size:    entry.Size,
+		modTime: entry.ModTime,
+		hashes:  entry.Hashes,
 	})
 }
 
@@ -229,6 +320,22 @@ func (e *engine) deleteOne(ctx context.Context, target extraneous) {
 		return
 	}
 
+	if e.backsUp(target) {
+		// 退避すれば転送先からは無くなるので、それで削除が済む。
+		// 退避できなければ消さない。
+		if err := e.backup.backup(ctx, target.path, target.rel); err != nil {
+			if storage.IsNotFound(err) {
+				e.recordDeleted()
+				return
+			}
+			e.recordDeleteFailure(err)
+			e.reporter.Logf("削除に失敗しました %s: %v", target.rel, err)
+			return
+		}
+		e.recordDeleted()
+		return
+	}
+
 	err := doWithRetry(ctx, e.opts.Retry, func(ctx context.Context, _ int) error {
 		if waitErr := e.limits.wait(ctx, e.opts.Dst); waitErr != nil {
 			return waitErr
@@ -251,6 +358,23 @@ func (e *engine) deleteOne(ctx context.Context, target extraneous) {
 	e.reporter.Logf("削除 %s", target.rel)
 }
 
+// backsUp は、消す前に退避するものかを返します。
+//
+// ディレクトリは退避しません。中身は1件ずつ先に退避されているので、
+// 残った空のディレクトリを消すだけで済みます。
+// 書き込み中の残骸も退避しません。利用者のデータではないためです。
+func (e *engine) backsUp(target extraneous) bool {
+	if e.backup == nil || target.isDir {
+		return false
+	}
+	return !isPartName(target.rel)
+}
+
+// isPartName は、書き込み中のファイルの名前かを返します。
+func isPartName(name string) bool {
+	return strings.HasSuffix(name, partSuffix)
+}
+
 // depth はパスの深さを返します。
 func depth(rel string) int {
 	if rel == "" {
@@ -6,7 +6,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mt3hr/hbg/backend"
 	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/storage"
 	"github.com/mt3hr/hbg/transfer"
 )
 
@@ -42,6 +44,33 @@ func TestSyncDeletesExtraneous(t *testing.T) {
 	}
 }
 
+// 削除を禁じた転送先には、何も送らないうちに断ることを確かめます。
+func TestSyncDeleteRefusedByPolicy(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, src, "/data/a.txt", "1")
+	put(t, dst, "/backup/data/よぶん.txt", "2")
+
+	opts := baseOptions(src, dst)
+	opts.Dst = backend.Restrict(dst, "dst", backend.Policy{NoDelete: true})
+	opts.Delete = true
+
+	if _, err := transfer.Run(context.Background(), opts); !errors.Is(err, storage.ErrReadOnly) {
+		t.Fatalf("Run = %v, want ErrReadOnly", err)
+	}
+	if got := dst.Snapshot(); len(got) != 1 {
+		t.Errorf("転送先が変わった: %v", got)
+	}
+
+	// --delete を付けなければ送れる。
+	opts.Delete = false
+	if _, err := transfer.Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if _, ok := dst.Snapshot()["/backup/data/a.txt"]; !ok {
+		t.Error("送られていない")
+	}
+}
+
 // --delete を付けなければ何も消えないことを確かめます。
 func TestSyncWithoutDeleteKeepsEverything(t *testing.T) {
 	src, dst := newPair(t)
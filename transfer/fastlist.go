@@ -0,0 +1,78 @@
+package transfer
+
+import (
+	"context"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// 配下をまとめて一覧する走査（Options.FastList）です。
+//
+// ふだんの走査は、ディレクトリに入るたびにコピー元とコピー先を一覧します。
+// ローカルなら気になりませんが、クラウドでは1回ごとに往復がかかり、
+// 数十万のディレクトリがあれば、それだけで何時間にもなります。
+//
+// まとめて一覧できるストレージなら、起点ごとに一度だけ配下を一覧し、
+// 走査の間はそこから引きます。走査の順番や判断は変わりません。
+// 一覧の取り方だけが変わります。
+
+// loadTrees は起点の配下を、コピー元とコピー先の両方でまとめて一覧します。
+func (e *engine) loadTrees(ctx context.Context, srcDir, dstDir string) {
+	e.srcTree = e.loadTree(ctx, e.opts.Src, srcDir, false)
+	e.dstTree = e.loadTree(ctx, e.opts.Dst, dstDir, true)
+}
+
+// loadTree は dir の配下をまとめて一覧します。
+//
+// できなければ nil を返し、その側はディレクトリごとの一覧に戻ります。
+// 遅くなるだけで、結果は変わらないためです。mayBeMissing が真なら、
+// dir がまだ無いことを、中身の無い木として扱います。
+func (e *engine) loadTree(ctx context.Context, s storage.Storage, dir string, mayBeMissing bool) *storage.Tree {
+	if !storage.CanListRecursive(s) {
+		return nil
+	}
+	if err := e.limits.wait(ctx, s); err != nil {
+		return nil
+	}
+
+	e.reporter.Logf("%s:%s の配下をまとめて一覧しています", s.Type(), dir)
+	tree, err := storage.ListTree(ctx, s, dir)
+	switch {
+	case err == nil:
+		return tree
+	case mayBeMissing && storage.IsNotFound(err):
+		return storage.NewTree(s, dir)
+	case ctx.Err() == nil:
+		e.reporter.Logf("警告: %s:%s の配下をまとめて一覧できなかったため、ディレクトリごとに一覧します: %v",
+			s.Type(), dir, err)
+	}
+	return nil
+}
+
+// listSrc はコピー元のディレクトリの中身を返します。
+// まとめて一覧してあれば、そこから引きます。
+func (e *engine) listSrc(ctx context.Context, dir string) ([]storage.FileInfo, error) {
+	if e.srcTree != nil {
+		if entries, ok := e.srcTree.Dir(dir); ok {
+			return entries, nil
+		}
+	}
+	if err := e.limits.wait(ctx, e.opts.Src); err != nil {
+		return nil, err
+	}
+	return storage.ListAll(ctx, e.opts.Src, dir)
+}
+
+// listDst はコピー先のディレクトリの中身を返します。
+// まとめて一覧してあれば、そこから引きます。
+func (e *engine) listDst(ctx context.Context, dir string) ([]storage.FileInfo, error) {
+	if e.dstTree != nil {
+		if entries, ok := e.dstTree.Dir(dir); ok {
+			return entries, nil
+		}
+	}
+	if err := e.limits.wait(ctx, e.opts.Dst); err != nil {
+		return nil, err
+	}
+	return storage.ListAll(ctx, e.opts.Dst, dir)
+}
@@ -0,0 +1,109 @@
+package transfer_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/transfer"
+)
+
+// まとめて一覧すると、ディレクトリごとの一覧をせずに、
+// ふだんと同じ結果になることを確かめます。
+func TestFastListSkipsPerDirListing(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, src, "/data/a.txt", "a")
+	put(t, src, "/data/sub/b.txt", "b")
+	put(t, src, "/data/sub/奥/c.txt", "c")
+	put(t, dst, "/backup/data/sub/b.txt", "b")
+	put(t, dst, "/backup/data/sub/消える.txt", "x")
+	put(t, dst, "/backup/data/無い/d.txt", "d")
+	srcLists := countLists(src, "")
+	dstLists := countLists(dst, "")
+
+	opts := baseOptions(src, dst)
+	opts.FastList = true
+	opts.Delete = true
+	result, err := transfer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if got := srcLists(); len(got) != 0 {
+		t.Errorf("コピー元をディレクトリごとに一覧した: %v", got)
+	}
+	if got := dstLists(); len(got) != 0 {
+		t.Errorf("コピー先をディレクトリごとに一覧した: %v", got)
+	}
+	// b.txt は同じなので送らない。
+	if result.Transferred != 2 || result.Failed != 0 {
+		t.Errorf("転送 = %d, 失敗 = %d, want 2, 0: %v", result.Transferred, result.Failed, result.Errors)
+	}
+	want := map[string]string{
+		"/backup/data/a.txt":       "a",
+		"/backup/data/sub/b.txt":   "b",
+		"/backup/data/sub/奥/c.txt": "c",
+	}
+	got := dst.Snapshot()
+	if len(keys(got)) != len(want) {
+		t.Errorf("コピー先 = %v, want %v", keys(got), want)
+	}
+	for p, content := range want {
+		if got[p] != content {
+			t.Errorf("%s = %q, want %q", p, got[p], content)
+		}
+	}
+}
+
+// まとめて一覧できなければ、ディレクトリごとの一覧に戻って続けることを確かめます。
+func TestFastListFallsBackOnError(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, src, "/data/a.txt", "a")
+	put(t, src, "/data/sub/b.txt", "b")
+	src.SetHooks(memory.Hooks{
+		BeforeOp: func(op, _ string) error {
+			if op == "list-recursive" {
+				return errors.New("一覧が大きすぎます")
+			}
+			return nil
+		},
+	})
+
+	opts := baseOptions(src, dst)
+	opts.FastList = true
+	result, err := transfer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.Transferred != 2 || result.Failed != 0 {
+		t.Errorf("転送 = %d, 失敗 = %d, want 2, 0: %v", result.Transferred, result.Failed, result.Errors)
+	}
+}
+
+// 双方向同期でも、まとめて一覧した結果から両側を比べることを確かめます。
+// 片側がまだ無くても、空として扱います。
+func TestBisyncFastList(t *testing.T) {
+	s1, s2 := newPair(t)
+	put(t, s1, "/laptop/a.txt", "a")
+	put(t, s1, "/laptop/sub/奥/b.txt", "b")
+	lists1 := countLists(s1, "")
+	lists2 := countLists(s2, "")
+
+	opts := bisyncOptions(t, s1, s2)
+	opts.FastList = true
+	result := runBisync(t, opts)
+
+	if result.Copied != 2 {
+		t.Errorf("Copied = %d, want 2", result.Copied)
+	}
+	if got := s2.Snapshot()["/cloud/sub/奥/b.txt"]; got != "b" {
+		t.Errorf("cloud/sub/奥/b.txt = %q", got)
+	}
+	if got := lists1(); len(got) != 0 {
+		t.Errorf("Path1 をディレクトリごとに一覧した: %v", got)
+	}
+	if got := lists2(); len(got) != 0 {
+		t.Errorf("Path2 をディレクトリごとに一覧した: %v", got)
+	}
+}
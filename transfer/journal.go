@@ -0,0 +1,349 @@
+package transfer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 途中経過の記録（ジャーナル）は、中断した転送を、済んだところを
+// 調べ直さずに続けるためのものです。
+//
+// 走査と転送は並行しているので、中断したあとで同じ転送をやり直すと、
+// ツリー全体をもう一度一覧して比べることになります。数百万件の
+// クラウド上のツリーでは、それだけで1時間以上の API 呼び出しになります。
+//
+//   - 実行中は、済んだファイルと、済んだディレクトリを1行ずつ書き足します。
+//     ディレクトリが済んだとは、中のファイルがすべて転送済みか転送不要で、
+//     中のディレクトリもすべて済んだということです。
+//
+//   - 書き足すだけなので、強制終了で最後の行が欠けても、それより前は読めます。
+//     欠けた行は読み飛ばします。
+//
+//   - 記録は「済んだ」ことしか表しません。記録にないものは、ふつうに
+//     一覧して比べます。記録を失っても、やり直しが遅くなるだけです。
+
+// journalVersion は記録の形式の版です。形式を変えたら上げます。
+const journalVersion = 1
+
+const (
+	journalDir  = "D"
+	journalFile = "F"
+)
+
+// Journal は転送の途中経過の記録です。
+//
+// 複数のワーカーから同時に使えます。
+type Journal struct {
+	path string
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	dirs    map[string]struct{}
+	files   map[string]struct{}
+	resumed bool
+	// err は最初の書き込みの失敗です。記録は補助なので、失敗しても
+	// 転送は止めず、以降の書き込みをやめるだけにします。
+	err error
+}
+
+// OpenJournal は記録を開きます。
+//
+// resume が真で、同じ key の記録が残っていれば、それを読み込んで続きを
+// 書き足します。そうでなければ空の記録から始めます。key は、どの転送の
+// 記録かを表す文字列です。違う転送の記録を取り違えて使わないよう照合します。
+func OpenJournal(file, key string, resume bool) (*Journal, error) {
+	j := &Journal{
+		path:  file,
+		dirs:  map[string]struct{}{},
+		files: map[string]struct{}{},
+	}
+
+	if resume {
+		ok, err := j.load(key)
+		if err != nil {
+			return nil, err
+		}
+		j.resumed = ok
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return nil, fmt.Errorf("途中経過の記録の置き場所を作れませんでした: %w", err)
+	}
+	// 読み込んだぶんは詰めて書き直す。済んだディレクトリの中のファイルは
+	// もう引かれないので、中断を重ねても記録が膨らみ続けないようにする。
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("途中経過の記録を開けませんでした: %w", err)
+	}
+	j.f = f
+	j.w = bufio.NewWriter(f)
+
+	fmt.Fprintf(j.w, "hbg-journal %d %s\n", journalVersion, strconv.Quote(key))
+	for d := range j.dirs {
+		j.writeLine(journalDir, d)
+	}
+	for p := range j.files {
+		if _, done := j.dirs[parentOf(p)]; done {
+			delete(j.files, p)
+			continue
+		}
+		j.writeLine(journalFile, p)
+	}
+	if err := j.w.Flush(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("途中経過の記録を書けませんでした: %w", err)
+	}
+	return j, nil
+}
+
+// load は残っている記録を読みます。同じ key のものが読めたら真を返します。
+func (j *Journal) load(key string) (bool, error) {
+	f, err := os.Open(j.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("途中経過の記録を読めませんでした: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	if !sc.Scan() {
+		return false, nil
+	}
+	if sc.Text() != fmt.Sprintf("hbg-journal %d %s", journalVersion, strconv.Quote(key)) {
+		// 別の転送のもの、または形式の違うもの。使わない。
+		return false, nil
+	}
+
+	for sc.Scan() {
+		kind, quoted, ok := strings.Cut(sc.Text(), " ")
+		if !ok {
+			continue
+		}
+		p, err := strconv.Unquote(quoted)
+		if err != nil {
+			// 書いている途中で止まった行。
+			continue
+		}
+		switch kind {
+		case journalDir:
+			j.dirs[p] = struct{}{}
+		case journalFile:
+			j.files[p] = struct{}{}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return false, fmt.Errorf("途中経過の記録を読めませんでした: %w", err)
+	}
+	return true, nil
+}
+
+// Resumed は、前回の記録を読み込んで続きから始めたかを返します。
+func (j *Journal) Resumed() bool {
+	return j.resumed
+}
+
+// Done は記録にある、済んだディレクトリとファイルの数を返します。
+func (j *Journal) Done() (dirs, files int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.dirs), len(j.files)
+}
+
+// Err は記録の書き込みに失敗していれば、その理由を返します。
+func (j *Journal) Err() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
+// Close は記録を閉じます。記録はそのまま残ります。
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	flushErr := j.w.Flush()
+	err := j.f.Close()
+	j.f = nil
+	if flushErr != nil {
+		return flushErr
+	}
+	return err
+}
+
+// Discard は記録を閉じて消します。
+// 最後まで済んだ転送には、続きから始める必要がないためです。
+func (j *Journal) Discard() error {
+	if err := j.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// dirDone はディレクトリが前回までに済んでいるかを返します。
+func (j *Journal) dirDone(dir string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, ok := j.dirs[dir]
+	return ok
+}
+
+// fileDone はファイルが前回までに済んでいるかを返します。
+// 済んだディレクトリの中のファイルも、済んだものとして扱います。
+// 開くときに詰めたので、その行は残っていません。
+func (j *Journal) fileDone(p string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.files[p]; ok {
+		return true
+	}
+	_, ok := j.dirs[parentOf(p)]
+	return ok
+}
+
+// markDir はディレクトリが済んだことを書き足します。
+func (j *Journal) markDir(dir string) {
+	j.mark(journalDir, dir)
+}
+
+// markFile はファイルが済んだことを書き足します。
+func (j *Journal) markFile(p string) {
+	j.mark(journalFile, p)
+}
+
+func (j *Journal) mark(kind, p string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// 同じ記録で続けて実行する（実行全体のやり直し）ときにも飛ばせるよう、
+	// 手元の一覧にも足しておく。
+	if kind == journalDir {
+		j.dirs[p] = struct{}{}
+	} else {
+		j.files[p] = struct{}{}
+	}
+
+	if j.f == nil || j.err != nil {
+		return
+	}
+	j.writeLine(kind, p)
+	// 1行ごとに書き出す。溜めておくと、強制終了で溜めたぶんを失う。
+	if err := j.w.Flush(); err != nil {
+		j.err = err
+	}
+}
+
+func (j *Journal) writeLine(kind, p string) {
+	j.w.WriteString(kind)
+	j.w.WriteByte(' ')
+	j.w.WriteString(strconv.Quote(p))
+	j.w.WriteByte('\n')
+}
+
+// parentOf は転送先のパスの親を返します。
+func parentOf(p string) string {
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		return ""
+	}
+	if i == 0 {
+		return "/"
+	}
+	return p[:i]
+}
+
+// dirProgress は、1つのディレクトリが済んだかどうかを数えます。
+//
+// 走査と転送が並行しているので、ディレクトリが済むのは、一覧を
+// 最後までたどり終え、送ったファイルがすべて届き、中のディレクトリも
+// すべて済んだときです。そのどれが最後になるかは決まっていません。
+type dirProgress struct {
+	dir    string
+	parent *dirProgress
+	// pending は済んでいないものの数です。一覧をたどっている間は、
+	// それ自体を1つと数えます。
+	pending int
+	// failed は中で失敗があったことを表します。失敗があれば済んだことにしません。
+	failed bool
+}
+
+// enterDir はディレクトリの走査を始めたことを記録します。
+// 記録を取らない場合は nil を返します。
+func (e *engine) enterDir(dir string, parent *dirProgress) *dirProgress {
+	if e.journal == nil {
+		return nil
+	}
+	e.progressMu.Lock()
+	defer e.progressMu.Unlock()
+	if parent != nil {
+		parent.pending++
+	}
+	return &dirProgress{dir: dir, parent: parent, pending: 1}
+}
+
+// addPending は、ディレクトリの中で済んでいないものが1つ増えたことを記録します。
+func (e *engine) addPending(d *dirProgress) {
+	if d == nil {
+		return
+	}
+	e.progressMu.Lock()
+	defer e.progressMu.Unlock()
+	d.pending++
+}
+
+// settle は、ディレクトリの中の1つが済んだことを記録します。
+// 一覧をたどり終えたときにも呼びます。
+func (e *engine) settle(d *dirProgress) {
+	if d == nil {
+		return
+	}
+	e.progressMu.Lock()
+	defer e.progressMu.Unlock()
+
+	// 済んだら親へ伝える。親もそれで済むかもしれない。
+	for d != nil {
+		d.pending--
+		if d.pending > 0 || d.failed {
+			return
+		}
+		e.journal.markDir(d.dir)
+		d = d.parent
+	}
+}
+
+// failDir は、ディレクトリの中で失敗があったことを記録します。
+// そのディレクトリも、それを含むディレクトリも、済んだことにはなりません。
+func (e *engine) failDir(d *dirProgress) {
+	if d == nil {
+		return
+	}
+	e.progressMu.Lock()
+	defer e.progressMu.Unlock()
+	for ; d != nil; d = d.parent {
+		d.failed = true
+	}
+}
@@ -0,0 +1,247 @@
+package transfer_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/transfer"
+)
+
+// countLists は一覧を取った場所を数えるようにします。
+// failPut に当たるパスへの書き込みは失敗させます。
+func countLists(s *memory.Storage, failPut string) func() map[string]int {
+	var mu sync.Mutex
+	lists := map[string]int{}
+	s.SetHooks(memory.Hooks{
+		BeforeOp: func(op, p string) error {
+			switch {
+			case op == "list":
+				mu.Lock()
+				lists[p]++
+				mu.Unlock()
+			case op == "put" && failPut != "" && strings.HasPrefix(p, failPut):
+				return errors.New("書けません")
+			}
+			return nil
+		},
+	})
+	return func() map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+		out := map[string]int{}
+		for k, v := range lists {
+			out[k] = v
+		}
+		return out
+	}
+}
+
+func openJournal(t *testing.T, file, key string, resume bool) *transfer.Journal {
+	t.Helper()
+	j, err := transfer.OpenJournal(file, key, resume)
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	t.Cleanup(func() { j.Close() })
+	return j
+}
+
+// 途中で失敗した転送を続けると、済んでいたディレクトリを一覧し直さないことを確かめます。
+func TestJournalResumeSkipsFinishedDirs(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, src, "/data/済む/a.txt", "a")
+	put(t, src, "/data/済む/奥/b.txt", "b")
+	put(t, src, "/data/残る/c.txt", "c")
+	put(t, src, "/data/残る/d.txt", "d")
+	file := filepath.Join(t.TempDir(), "journal.log")
+
+	// 1回目は「残る」への書き込みを失敗させる。
+	countLists(dst, "/backup/data/残る/c.txt")
+	opts := baseOptions(src, dst)
+	opts.Journal = openJournal(t, file, "key", false)
+	first, err := transfer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("1回目: %v", err)
+	}
+	if first.Failed != 1 {
+		t.Fatalf("1回目の失敗 = %d, want 1", first.Failed)
+	}
+	opts.Journal.Close()
+
+	// 2回目は続きから。
+	lists := countLists(src, "")
+	dst.SetHooks(memory.Hooks{})
+	opts.Journal = openJournal(t, file, "key", true)
+	if !opts.Journal.Resumed() {
+		t.Fatal("前回の記録を読み込んでいない")
+	}
+	second, err := transfer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("2回目: %v", err)
+	}
+
+	got := lists()
+	for _, p := range []string{"/data/済む", "/data/済む/奥"} {
+		if got[p] != 0 {
+			t.Errorf("済んでいた %s を一覧し直した", p)
+		}
+	}
+	if got["/data/残る"] == 0 {
+		t.Error("済んでいない /data/残る を一覧していない")
+	}
+	if second.Transferred != 1 || second.Failed != 0 {
+		t.Errorf("2回目の転送 = %d, 失敗 = %d, want 1, 0", second.Transferred, second.Failed)
+	}
+	if got := dst.Snapshot()["/backup/data/残る/c.txt"]; got != "c" {
+		t.Errorf("c.txt = %q, want %q", got, "c")
+	}
+}
+
+// 同期で消すときは、済んでいたディレクトリでもコピー元にないものを消すことを確かめます。
+//
+// 1回目は失敗があるので削除まで進みません。2回目で済んだディレクトリを
+// 一覧ごと飛ばすと、消すはずのものが残ったまま記録が捨てられていました。
+func TestJournalResumeWithDeleteRemovesExtraneous(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, src, "/data/ok/a.txt", "a")
+	put(t, src, "/data/bad/c.txt", "c")
+	put(t, dst, "/backup/data/ok/stale.txt", "古い")
+	file := filepath.Join(t.TempDir(), "journal.log")
+
+	countLists(dst, "/backup/data/bad/c.txt")
+	opts := baseOptions(src, dst)
+	opts.Delete = true
+	opts.Journal = openJournal(t, file, "key", false)
+	first, err := transfer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("1回目: %v", err)
+	}
+	if first.Failed != 1 || first.Deleted != 0 {
+		t.Fatalf("1回目 = 失敗 %d, 削除 %d, want 1, 0", first.Failed, first.Deleted)
+	}
+	opts.Journal.Close()
+
+	var (
+		mu   sync.Mutex
+		puts []string
+	)
+	dst.SetHooks(memory.Hooks{
+		BeforeOp: func(op, p string) error {
+			if op == "put" {
+				mu.Lock()
+				puts = append(puts, p)
+				mu.Unlock()
+			}
+			return nil
+		},
+	})
+	opts.Journal = openJournal(t, file, "key", true)
+	second, err := transfer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("2回目: %v", err)
+	}
+	if second.Failed != 0 || second.Deleted != 1 {
+		t.Errorf("2回目 = 失敗 %d, 削除 %d, want 0, 1", second.Failed, second.Deleted)
+	}
+	if _, ok := dst.Snapshot()["/backup/data/ok/stale.txt"]; ok {
+		t.Error("コピー元にない stale.txt が残っている")
+	}
+	// 済んでいた a.txt は送り直さない。
+	if len(puts) != 1 || puts[0] != "/backup/data/bad/c.txt" {
+		t.Errorf("2回目に書いたもの = %v, want c.txt だけ", puts)
+	}
+}
+
+// 最後まで済んだディレクトリが記録され、読み込み直すと中のファイルの行が
+// 詰められることを確かめます。
+func TestJournalCompactsFinishedDirs(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, src, "/data/a.txt", "a")
+	put(t, src, "/data/sub/b.txt", "b")
+	file := filepath.Join(t.TempDir(), "journal.log")
+
+	opts := baseOptions(src, dst)
+	opts.Journal = openJournal(t, file, "key", false)
+	if _, err := transfer.Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	// /backup/data と /backup/data/sub が済んでいる。
+	if dirs, _ := opts.Journal.Done(); dirs != 2 {
+		t.Errorf("済んだディレクトリ = %d, want 2", dirs)
+	}
+	opts.Journal.Close()
+
+	// 読み込み直すと、済んだディレクトリの中のファイルは詰められている。
+	j := openJournal(t, file, "key", true)
+	if dirs, files := j.Done(); dirs != 2 || files != 0 {
+		t.Errorf("読み込み直した記録 = %d ディレクトリ, %d ファイル, want 2, 0", dirs, files)
+	}
+}
+
+// 別の転送の記録や、続きからを指定しないときは、空の記録から始めることを確かめます。
+func TestJournalStartsFreshUnlessResumingSameKey(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, src, "/data/a.txt", "a")
+	file := filepath.Join(t.TempDir(), "journal.log")
+
+	opts := baseOptions(src, dst)
+	opts.Journal = openJournal(t, file, "key", false)
+	if _, err := transfer.Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	opts.Journal.Close()
+
+	for name, tc := range map[string]struct {
+		key    string
+		resume bool
+	}{
+		"別の転送":    {key: "other", resume: true},
+		"続きからでない": {key: "key", resume: false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			j := openJournal(t, file, tc.key, tc.resume)
+			if j.Resumed() {
+				t.Error("前回の記録を読み込んだ")
+			}
+			if dirs, files := j.Done(); dirs != 0 || files != 0 {
+				t.Errorf("記録 = %d ディレクトリ, %d ファイル, want 0, 0", dirs, files)
+			}
+			j.Close()
+		})
+	}
+}
+
+// 最後の行が書きかけで止まっていても、それより前は読めることを確かめます。
+func TestJournalToleratesTornLastLine(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "journal.log")
+	content := "hbg-journal 1 \"key\"\n" +
+		"D \"/backup/data/sub\"\n" +
+		"F \"/backup/data/a.txt\"\n" +
+		"F \"/backup/data/b.t"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	j := openJournal(t, file, "key", true)
+	if dirs, files := j.Done(); dirs != 1 || files != 1 {
+		t.Errorf("記録 = %d ディレクトリ, %d ファイル, want 1, 1", dirs, files)
+	}
+}
+
+// 捨てた記録はファイルごと消えることを確かめます。
+func TestJournalDiscardRemovesFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sub", "journal.log")
+	j := openJournal(t, file, "key", false)
+	if err := j.Discard(); err != nil {
+		t.Fatalf("Discard: %v", err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("記録が残っている: %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package transfer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/transfer"
+)
+
+// bigContent は範囲ごとに中身の違う、ある程度の大きさの内容を作ります。
+// 範囲の並びを取り違えたら気づけるようにするためです。
+func bigContent(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + i/251)
+	}
+	return string(b)
+}
+
+// countOpens は読み出しの回数を数えるようにします。
+// failAt 回目の読み出しは失敗させます（0 なら失敗させない）。
+func countOpens(s *memory.Storage, failAt int64) *atomic.Int64 {
+	var n atomic.Int64
+	s.SetHooks(memory.Hooks{
+		BeforeOp: func(op, _ string) error {
+			if op != "open" {
+				return nil
+			}
+			if n.Add(1) == failAt {
+				return errors.New("接続が切れました")
+			}
+			return nil
+		},
+	})
+	return &n
+}
+
+func multiStreamOptions(src, dst *memory.Storage) transfer.Options {
+	opts := baseOptions(src, dst)
+	opts.PartialMinSize = 0
+	opts.MultiStreamCutoff = 4 << 10
+	opts.MultiStreams = 3
+	opts.MultiStreamChunkSize = 1 << 10
+	return opts
+}
+
+// 大きなファイルを範囲に分けて読み、元どおりに組み立てることを確かめます。
+func TestMultiStreamCopy(t *testing.T) {
+	for name, verify := range map[string]transfer.VerifyMode{
+		// 検証しないなら、届いた範囲をその位置へ直接書く。
+		"位置を指定して書く": transfer.VerifyNever,
+		// 検証するなら、並べ直して Put へ流す。
+		"並べ直して流す": transfer.VerifyAlways,
+	} {
+		t.Run(name, func(t *testing.T) {
+			src, dst := newPair(t)
+			content := bigContent(10<<10 + 123)
+			put(t, src, "/data/大きい.bin", content)
+			opens := countOpens(src, 0)
+
+			opts := multiStreamOptions(src, dst)
+			opts.Verify = verify
+			result, err := transfer.Run(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if result.Transferred != 1 || result.Failed != 0 {
+				t.Fatalf("転送 = %d, 失敗 = %d, want 1, 0: %v", result.Transferred, result.Failed, result.Errors)
+			}
+			if dst.Snapshot()["/backup/data/大きい.bin"] != content {
+				t.Error("組み立てた内容が元と違う")
+			}
+			// 1KiB ごとに 11 の範囲
+			if n := opens.Load(); n != 11 {
+				t.Errorf("読み出し %d回, want 11", n)
+			}
+		})
+	}
+}
+
+// 分ける大きさに満たないファイルは、ふつうに1本で読むことを確かめます。
+func TestMultiStreamBelowCutoff(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, src, "/data/小さい.bin", bigContent(3<<10))
+	opens := countOpens(src, 0)
+
+	if _, err := transfer.Run(context.Background(), multiStreamOptions(src, dst)); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if n := opens.Load(); n != 1 {
+		t.Errorf("読み出し %d回, want 1", n)
+	}
+}
+
+// 1つの範囲でも読めなければ、そのファイルは失敗になり、
+// 書きかけの内容が転送先に現れないことを確かめます。
+func TestMultiStreamRangeFailure(t *testing.T) {
+	for name, verify := range map[string]transfer.VerifyMode{
+		"位置を指定して書く": transfer.VerifyNever,
+		"並べ直して流す":   transfer.VerifyAlways,
+	} {
+		t.Run(name, func(t *testing.T) {
+			src, dst := newPair(t)
+			put(t, src, "/data/大きい.bin", bigContent(10<<10))
+			countOpens(src, 5)
+
+			opts := multiStreamOptions(src, dst)
+			opts.Verify = verify
+			result, err := transfer.Run(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if result.Failed != 1 {
+				t.Errorf("失敗 = %d, want 1", result.Failed)
+			}
+			if _, ok := dst.Snapshot()["/backup/data/大きい.bin"]; ok {
+				t.Error("読めなかったのに転送先にファイルがある")
+			}
+		})
+	}
+}
+
+// 書きかけの続きも、範囲に分けて読んで書き足すことを確かめます。
+func TestMultiStreamResume(t *testing.T) {
+	src, dst := newPair(t)
+	content := bigContent(10<<10 + 5)
+	putOld(t, src, "/data/大きい.bin", content)
+	dst.SetPartial("/backup/data/大きい.bin", []byte(content[:4<<10]), time.Now().Add(-time.Minute))
+	opens := countOpens(src, 0)
+
+	opts := multiStreamOptions(src, dst)
+	opts.PartialMinSize = 1
+	opts.Verify = transfer.VerifyNever
+	if _, err := transfer.Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if dst.Snapshot()["/backup/data/大きい.bin"] != content {
+		t.Error("続きから書き足した内容が元と違う")
+	}
+	// 残りの 6KiB+5 バイトを 1KiB ごとに 7 の範囲
+	if n := opens.Load(); n != 7 {
+		t.Errorf("読み出し %d回, want 7", n)
+	}
+}
+
+// 並べ直して流している途中で取り消すと、まだ読み始めていない範囲を
+// 待ち続けずに、取り消しとして戻ることを確かめます。
+//
+// 以前は、取り消しで読み始めなくなった範囲を読み手が待ち続け、
+// 大きなファイルのコピー中に Ctrl-C を押しても hbg が終わりませんでした。
+func TestMultiStreamCancelWhileReordering(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, src, "/data/大きい.bin", bigContent(10<<10))
+	opens := countOpens(src, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dst.SetHooks(memory.Hooks{
+		PutReader: func(_ string, r io.Reader) io.Reader {
+			return &cancelingReader{r: r, opens: opens, cancel: cancel}
+		},
+	})
+
+	opts := multiStreamOptions(src, dst)
+	opts.MultiStreams = 4
+	// 検証するなら、並べ直して Put へ流す。
+	opts.Verify = transfer.VerifyAlways
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := transfer.Run(ctx, opts)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("err = %v, want context.Canceled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("取り消しても転送が終わらない")
+	}
+	if _, ok := dst.Snapshot()["/backup/data/大きい.bin"]; ok {
+		t.Error("取り消したのに転送先にファイルがある")
+	}
+}
+
+// cancelingReader は、最初の範囲が出そろったところで取り消し、
+// そのあとは取り消しを見ずに読み続ける書き込み先の読み手です。
+// 送信中の要求のように、取り消しを途中で確かめない書き込み先を表します。
+type cancelingReader struct {
+	r      io.Reader
+	opens  *atomic.Int64
+	cancel context.CancelFunc
+	buf    *bytes.Reader
+}
+
+func (c *cancelingReader) Read(p []byte) (int, error) {
+	if c.buf == nil {
+		// 同時に読む4本が読み出しを始めるまで待ってから取り消す。
+		for c.opens.Load() < 4 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(20 * time.Millisecond)
+		c.cancel()
+		// 範囲を配る側が、取り消しを見て止まるのを待つ。
+		time.Sleep(20 * time.Millisecond)
+		data, err := io.ReadAll(c.r)
+		if err != nil {
+			return 0, err
+		}
+		c.buf = bytes.NewReader(data)
+	}
+	return c.buf.Read(p)
+}
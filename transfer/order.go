@@ -0,0 +1,154 @@
+package transfer
+
+import "sync"
+
+// 判断の知らせ（DecisionEvent）の順番をそろえる仕組みです。
+//
+// ディレクトリを並行して走査すると、判断の出る順番が実行のたびに
+// 変わります。hbg check --json の出力を前回と見比べたり、ジョブの
+// ログを差分で追ったりするには、順番が決まっていないと困ります。
+//
+// そこで、1本で走査したときの順番（一覧の順に、ディレクトリは
+// その位置で中へ入る）に並べ直してから知らせます。
+//
+//   - ディレクトリごとに知らせの列（decisionLog）を持ちます。
+//     子ディレクトリは、一覧で出てきた位置に子の列として入ります。
+//   - 先頭から順に、出せるところまで出します。まだ走査の終わっていない
+//     子の列に行き当たったら、そこで待ちます。
+//   - 待っている間は、後ろの列の知らせが溜まります。前の子の走査が
+//     遅いと、その場で走査を続ける一覧係は後ろの兄弟をいくつでも
+//     たどれるので、溜まる数は checkers ではなく木の大きさで決まります。
+//     そこで溜まった数が maxPendingDecisions に達したら、すぐには出せない
+//     知らせを足そうとした一覧係を、出せるようになるまで待たせます。
+//     今出している列の知らせはその場で出るので、その列を走査している
+//     一覧係が待たされることはなく、待ち合わせで止まりもしません。
+
+// maxPendingDecisions は、並べ直すために溜めておく知らせの上限です。
+const maxPendingDecisions = 4096
+
+// decisionOrder は判断の知らせを並べ直して届けます。
+// nil なら並べ直さず、その場で届けます。
+type decisionOrder struct {
+	mu   sync.Mutex
+	emit func(DecisionEvent)
+	// stack は出している途中の列です。末尾が今出している列です。
+	stack []*decisionLog
+	// pending は溜めていて、まだ出していない知らせの数です。
+	pending int
+	// flushed は知らせを出したことを、待っている一覧係に伝えます。
+	flushed *sync.Cond
+}
+
+// decisionLog は1つのディレクトリの知らせの列です。
+type decisionLog struct {
+	items []decisionItem
+	// next は次に出す位置です。
+	next int
+	// done は、このディレクトリの走査が終わり、もう足されないことを表します。
+	done bool
+}
+
+// decisionItem は知らせ1件か、子ディレクトリの列です。
+type decisionItem struct {
+	ev    DecisionEvent
+	child *decisionLog
+}
+
+func newDecisionOrder(emit func(DecisionEvent)) *decisionOrder {
+	o := &decisionOrder{emit: emit}
+	o.flushed = sync.NewCond(&o.mu)
+	return o
+}
+
+// begin は転送の起点1つぶんの列を作ります。
+func (o *decisionOrder) begin() *decisionLog {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	root := &decisionLog{}
+	o.stack = []*decisionLog{root}
+	return root
+}
+
+// child は log の今の位置に、子ディレクトリの列を足します。
+func (o *decisionOrder) child(log *decisionLog) *decisionLog {
+	if o == nil || log == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	c := &decisionLog{}
+	log.items = append(log.items, decisionItem{child: c})
+	o.flushLocked()
+	return c
+}
+
+// add は log に知らせを足します。
+//
+// すぐには出せず、溜まった数も上限に達しているときは、前の列が
+// 出し終わるか溜まった数が減るまで待ちます。
+func (o *decisionOrder) add(log *decisionLog, ev DecisionEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for o.pending >= maxPendingDecisions && !o.current(log) {
+		o.flushed.Wait()
+	}
+	log.items = append(log.items, decisionItem{ev: ev})
+	o.pending++
+	o.flushLocked()
+}
+
+// current は、log が今出している列かを返します。
+// その列に足した知らせは、溜めずにその場で出ます。
+func (o *decisionOrder) current(log *decisionLog) bool {
+	return len(o.stack) > 0 && o.stack[len(o.stack)-1] == log
+}
+
+// finish は log のディレクトリの走査が終わったことを記録します。
+func (o *decisionOrder) finish(log *decisionLog) {
+	if o == nil || log == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	log.done = true
+	o.flushLocked()
+}
+
+// flushLocked は出せるところまで出します。
+func (o *decisionOrder) flushLocked() {
+	// 出したか、今出している列が変わったら、待っている一覧係を起こす。
+	defer o.flushed.Broadcast()
+	for len(o.stack) > 0 {
+		cur := o.stack[len(o.stack)-1]
+		if cur.next < len(cur.items) {
+			item := cur.items[cur.next]
+			cur.items[cur.next] = decisionItem{}
+			cur.next++
+			if item.child != nil {
+				o.stack = append(o.stack, item.child)
+			} else {
+				o.pending--
+				o.emit(item.ev)
+			}
+			continue
+		}
+		if !cur.done {
+			return
+		}
+		cur.items = nil
+		o.stack = o.stack[:len(o.stack)-1]
+	}
+}
+
+// notifyDecisionIn は、log の位置に判断の知らせを入れます。
+// 並べ直さない場合や log が nil の場合は、その場で知らせます。
+func (e *engine) notifyDecisionIn(log *decisionLog, ev DecisionEvent) {
+	if e.order == nil || log == nil {
+		e.notifyDecision(ev)
+		return
+	}
+	e.order.add(log, ev)
+}
@@ -99,6 +99,8 @@ func (r *Result) accumulate(other *Result, pass int) {
 	r.BytesSkipped += other.BytesSkipped
 	r.Elapsed += other.Elapsed
 	r.Deleted += other.Deleted
+	r.BackedUp += other.BackedUp
+	r.Renamed += other.Renamed
 	r.Aborted = other.Aborted
 
 	// 失敗の数と内容は最新のものに置き換える。
@@ -0,0 +1,255 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mt3hr/hbg/storage"
+)
+
+// 改名の検出は、コピー元で場所や名前を変えただけのものを、
+// 送り直さずに転送先の中での移動で済ませる仕組みです。
+// 写真の整理のようにフォルダを組み替えると、ふつうの同期では
+// 動かしたものをすべて送り直し、そのあとで古いほうを消すことになります。
+//
+//   - 転送先に無いもの（送るはずのもの）は、走査が終わるまで送らずに
+//     控えておきます。「コピー元にないもの」が出そろうのは走査の終わりで、
+//     それより前に送り始めると、対になる相手が見つかる前に送ってしまうためです。
+//     控えるぶんだけ、使用メモリは新しいものの件数に比例します。
+//
+//   - 対にするのは、大きさが同じで、中身のハッシュが同じものです。
+//     共通のハッシュがなければ、更新時刻が許容幅の内で同じものです。
+//     時刻で対にする場合、候補が2つ以上あれば取り違えを避けて対にしません。
+//
+//   - 移動に失敗したら、ふつうに送ります。移動元は削除の対象に戻します。
+
+// renameMatch は改名の対を見つける方法です。
+type renameMatch struct {
+	// hashType が空でなければ、ハッシュで対にします。
+	hashType storage.HashType
+	// byModTime が真なら、更新時刻で対にします。
+	byModTime bool
+}
+
+// resolveRenameMatch は改名の対を見つける方法を決めます。
+// 改名を検出しない場合や、検出できない組み合わせでは ok が偽になります。
+func resolveRenameMatch(opts Options) (renameMatch, bool) {
+	if !opts.TrackRenames || !opts.Delete {
+		return renameMatch{}, false
+	}
+	// 移動の手段がなければ、読み直して書き直すことになり、送るのと変わらない。
+	if !storage.CanMove(opts.Dst) {
+		return renameMatch{}, false
+	}
+	if ht, ok := commonHash(opts.Src, opts.Dst); ok {
+		return renameMatch{hashType: ht}, true
+	}
+	if modTimeUsable(opts.Dst) {
+		return renameMatch{byModTime: true}, true
+	}
+	return renameMatch{}, false
+}
+
+// heldTask は、改名の相手を探すために控えている転送の指示です。
+type heldTask struct {
+	t    task
+	info storage.FileInfo
+}
+
+// tracksRenames は改名を検出するかを返します。
+func (e *engine) tracksRenames() bool {
+	return e.renames != nil
+}
+
+// holdForRename は、送るはずのものを走査の終わりまで控えます。
+func (e *engine) holdForRename(t task, info storage.FileInfo) {
+	e.heldMu.Lock()
+	defer e.heldMu.Unlock()
+	e.held = append(e.held, heldTask{t: t, info: info})
+}
+
+// releaseHeld は、控えていたものを改名の相手と対にしてから送ります。
+//
+// 走査が終わってから呼びます。対になった相手は削除の対象から外します。
+func (e *engine) releaseHeld(ctx context.Context, tasks chan<- task) error {
+	e.heldMu.Lock()
+	held := e.held
+	e.held = nil
+	e.heldMu.Unlock()
+
+	if len(held) == 0 {
+		return nil
+	}
+
+	e.extraMu.Lock()
+	pool := e.extra
+	e.extraMu.Unlock()
+
+	// 大きさで引けるようにする。対になりうるのはファイルだけで、
+	// 書き込み中の残骸は相手にしない。
+	bySize := map[int64][]int{}
+	for i, x := range pool {
+		if x.isDir || x.size == storage.SizeUnknown || isPartName(x.rel) {
+			continue
+		}
+		bySize[x.size] = append(bySize[x.size], i)
+	}
+
+	used := map[int]bool{}
+	dstHashes := map[int]string{}
+	for i := range held {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		h := &held[i]
+		if h.info.Size == storage.SizeUnknown {
+			continue
+		}
+		idx := e.findRenameSource(ctx, h.info, pool, bySize[h.info.Size], used, dstHashes)
+		if idx < 0 {
+			continue
+		}
+		used[idx] = true
+		from := pool[idx]
+		h.t.renameFrom = &from
+	}
+
+	// 送る前に削除の対象から外す。移動に失敗したものはワーカーが戻す。
+	if len(used) > 0 {
+		e.extraMu.Lock()
+		rest := e.extra[:0:0]
+		for i, x := range e.extra {
+			if !used[i] {
+				rest = append(rest, x)
+			}
+		}
+		e.extra = rest
+		e.extraMu.Unlock()
+	}
+
+	for _, h := range held {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case tasks <- h.t:
+		}
+	}
+	return nil
+}
+
+// findRenameSource は、src の移動元になる転送先のものを探します。
+// 見つからなければ -1 を返します。
+func (e *engine) findRenameSource(
+	ctx context.Context,
+	src storage.FileInfo,
+	pool []extraneous,
+	candidates []int,
+	used map[int]bool,
+	dstHashes map[int]string,
+) int {
+	if e.renames.byModTime {
+		found := -1
+		for _, i := range candidates {
+			if used[i] || !sameModTime(src.ModTime, pool[i].modTime, e.comparer.Window()) {
+				continue
+			}
+			if found >= 0 {
+				// 同じ大きさと時刻のものが2つ以上ある。どちらか決められない。
+				return -1
+			}
+			found = i
+		}
+		return found
+	}
+
+	srcHash := ""
+	for _, i := range candidates {
+		if used[i] {
+			continue
+		}
+		if srcHash == "" {
+			h, err := e.hashOf(ctx, e.opts.Src, src)
+			if err != nil {
+				return -1
+			}
+			srcHash = h
+		}
+		dstHash, ok := dstHashes[i]
+		if !ok {
+			h, err := e.hashOf(ctx, e.opts.Dst, pool[i].info())
+			if err != nil {
+				// 取れなかったものは相手にしない。次に問い合わせ直すこともしない。
+				h = ""
+			}
+			dstHashes[i] = h
+			dstHash = h
+		}
+		if dstHash != "" && dstHash == srcHash {
+			return i
+		}
+	}
+	return -1
+}
+
+// hashOf は改名の照合に使うハッシュを求めます。
+func (e *engine) hashOf(ctx context.Context, s storage.Storage, info storage.FileInfo) (string, error) {
+	if err := e.limits.wait(ctx, s); err != nil {
+		return "", err
+	}
+	return storage.GetHash(ctx, s, &info, e.renames.hashType)
+}
+
+// sameModTime は2つの時刻が許容幅の内で同じかを返します。
+func sameModTime(a, b time.Time, window time.Duration) bool {
+	if a.IsZero() || b.IsZero() {
+		return false
+	}
+	d := a.Sub(b)
+	if d < 0 {
+		d = -d
+	}
+	return d <= window
+}
+
+// renameOne は、転送先の中での移動で転送を済ませます。
+//
+// 済ませられなければ偽を返します。呼び出し側はふつうに送ってください。
+func (e *engine) renameOne(ctx context.Context, t task, dstPath string) bool {
+	from := t.renameFrom
+
+	if e.opts.DryRun {
+		e.reporter.Logf("改名する（実行しない）: %s -> %s", from.rel, t.relPath)
+		e.reporter.Skipped(t.name, t.size)
+		e.recordRenamed()
+		return true
+	}
+
+	err := doWithRetry(ctx, e.opts.Retry, func(ctx context.Context, _ int) error {
+		if waitErr := e.limits.wait(ctx, e.opts.Dst); waitErr != nil {
+			return waitErr
+		}
+		return storage.Move(ctx, e.opts.Dst, from.path, dstPath)
+	}, nil).err
+
+	switch {
+	case err == nil:
+		// 運ばずに済んだので、転送不要だったものとして進みぐあいに入れる。
+		e.reporter.Skipped(t.name, t.size)
+		e.recordRenamed()
+		e.fileDone(t, dstPath)
+		e.reporter.Logf("改名 %s -> %s", from.rel, t.relPath)
+		return true
+
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return true
+
+	default:
+		e.reporter.Logf("%s: 改名できなかったため送ります: %v", t.relPath, shortError(err))
+		// 移動元は残っているので、もともとの扱いどおり削除の対象に戻す。
+		e.extraMu.Lock()
+		e.extra = append(e.extra, *from)
+		e.extraMu.Unlock()
+		return false
+	}
+}
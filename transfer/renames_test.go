@@ -0,0 +1,205 @@
+package transfer_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/storage"
+	"github.com/mt3hr/hbg/transfer"
+)
+
+// countPuts は書き込みの回数を数えるようにします。
+func countPuts(s *memory.Storage) *atomic.Int64 {
+	var n atomic.Int64
+	s.SetHooks(memory.Hooks{
+		BeforeOp: func(op, _ string) error {
+			if op == "put" {
+				n.Add(1)
+			}
+			return nil
+		},
+	})
+	return &n
+}
+
+func renameOptions(src, dst storage.Storage) transfer.Options {
+	opts := baseOptions(src, dst)
+	opts.Delete = true
+	opts.TrackRenames = true
+	return opts
+}
+
+// 場所を変えただけのものが、送り直されずに移動されることを確かめます。
+func TestTrackRenamesMovesInsteadOfCopy(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, dst, "/backup/data/2024/旅行.jpg", "写真の中身")
+	put(t, src, "/data/旅行/2024-京都.jpg", "写真の中身")
+	puts := countPuts(dst)
+
+	result, err := transfer.Run(context.Background(), renameOptions(src, dst))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	snap := dst.Snapshot()
+	if got := snap["/backup/data/旅行/2024-京都.jpg"]; got != "写真の中身" {
+		t.Errorf("新しい場所の中身 = %q", got)
+	}
+	if _, ok := snap["/backup/data/2024/旅行.jpg"]; ok {
+		t.Error("古い場所に残っている")
+	}
+	if n := puts.Load(); n != 0 {
+		t.Errorf("書き込み %d回, want 0（送り直している）", n)
+	}
+	if result.Renamed != 1 || result.Transferred != 0 {
+		t.Errorf("改名 = %d, 転送 = %d, want 1, 0", result.Renamed, result.Transferred)
+	}
+}
+
+// 大きさが同じでも中身が違えば、対にしないことを確かめます。
+func TestTrackRenamesNeedsSameContent(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, dst, "/backup/data/古い.txt", "aaaa")
+	put(t, src, "/data/新しい.txt", "bbbb")
+
+	result, err := transfer.Run(context.Background(), renameOptions(src, dst))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	snap := dst.Snapshot()
+	if got := snap["/backup/data/新しい.txt"]; got != "bbbb" {
+		t.Errorf("新しい.txt = %q, want %q", got, "bbbb")
+	}
+	if _, ok := snap["/backup/data/古い.txt"]; ok {
+		t.Error("コピー元にないものが残っている")
+	}
+	if result.Renamed != 0 {
+		t.Errorf("改名 = %d, want 0", result.Renamed)
+	}
+}
+
+// 削除しない同期では、改名を検出しないことを確かめます。
+// 移動すると、コピー元にないものを消さないという指定に反します。
+func TestTrackRenamesNeedsDelete(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, dst, "/backup/data/古い.txt", "同じ")
+	put(t, src, "/data/新しい.txt", "同じ")
+
+	opts := renameOptions(src, dst)
+	opts.Delete = false
+
+	if _, err := transfer.Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if _, ok := dst.Snapshot()["/backup/data/古い.txt"]; !ok {
+		t.Error("削除しない同期で古いものが動いた")
+	}
+}
+
+// 移動に失敗したら、送ってから古いものを消すことを確かめます。
+func TestTrackRenamesFallsBackToCopy(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, dst, "/backup/data/古い.txt", "同じ")
+	put(t, src, "/data/新しい.txt", "同じ")
+	dst.SetHooks(memory.Hooks{
+		BeforeOp: func(op, _ string) error {
+			if op == "move" {
+				return errors.New("移動できません")
+			}
+			return nil
+		},
+	})
+
+	result, err := transfer.Run(context.Background(), renameOptions(src, dst))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	snap := dst.Snapshot()
+	if got := snap["/backup/data/新しい.txt"]; got != "同じ" {
+		t.Errorf("新しい.txt = %q", got)
+	}
+	if _, ok := snap["/backup/data/古い.txt"]; ok {
+		t.Error("移動に失敗した古いものが削除されずに残っている")
+	}
+	if result.Renamed != 0 || result.Transferred != 1 {
+		t.Errorf("改名 = %d, 転送 = %d, want 0, 1", result.Renamed, result.Transferred)
+	}
+}
+
+// noHashMover はハッシュを扱えないストレージです。
+// noHashStorage と違い、移動はそのままできます。
+type noHashMover struct {
+	*memory.Storage
+}
+
+func (n *noHashMover) Features() *storage.Features {
+	f := *n.Storage.Features()
+	f.Hashes = nil
+	return &f
+}
+
+// ハッシュがなければ更新時刻で対にし、候補が2つ以上あれば対にしないことを確かめます。
+func TestTrackRenamesByModTime(t *testing.T) {
+	at := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	t.Run("ひとつに決まる", func(t *testing.T) {
+		src, dst := newPair(t)
+		putAt(t, dst, "/backup/data/古い.txt", "同じ", at)
+		putAt(t, src, "/data/新しい.txt", "同じ", at)
+
+		result, err := transfer.Run(context.Background(),
+			renameOptions(&noHashMover{src}, &noHashMover{dst}))
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+		if result.Renamed != 1 {
+			t.Errorf("改名 = %d, want 1", result.Renamed)
+		}
+	})
+
+	t.Run("決まらない", func(t *testing.T) {
+		src, dst := newPair(t)
+		putAt(t, dst, "/backup/data/古い1.txt", "同じ", at)
+		putAt(t, dst, "/backup/data/古い2.txt", "同じ", at)
+		putAt(t, src, "/data/新しい.txt", "同じ", at)
+
+		result, err := transfer.Run(context.Background(),
+			renameOptions(&noHashMover{src}, &noHashMover{dst}))
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+		if result.Renamed != 0 || result.Transferred != 1 {
+			t.Errorf("改名 = %d, 転送 = %d, want 0, 1", result.Renamed, result.Transferred)
+		}
+		if len(dst.Snapshot()) != 1 {
+			t.Errorf("転送先 = %v, want 新しい.txt だけ", keys(dst.Snapshot()))
+		}
+	})
+}
+
+// 試しに動かしただけでは、何も動かさないことを確かめます。
+func TestTrackRenamesDryRun(t *testing.T) {
+	src, dst := newPair(t)
+	put(t, dst, "/backup/data/古い.txt", "同じ")
+	put(t, src, "/data/新しい.txt", "同じ")
+
+	opts := renameOptions(src, dst)
+	opts.DryRun = true
+
+	result, err := transfer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if _, ok := dst.Snapshot()["/backup/data/古い.txt"]; !ok {
+		t.Error("試しに動かしただけで動いた")
+	}
+	if result.Renamed != 1 {
+		t.Errorf("改名（予定） = %d, want 1", result.Renamed)
+	}
+}
@@ -0,0 +1,308 @@
+package transfer_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mt3hr/hbg/backend/memory"
+	"github.com/mt3hr/hbg/storage"
+	"github.com/mt3hr/hbg/transfer"
+)
+
+// 大きなファイルの転送が途中で切れても、次は書きかけの続きから
+// 送ることを確かめます。
+//
+// 以前は書きかけを必ず消していたため、回線の細い先へ数GBのファイルを
+// 送ると、切れるたびに最初からやり直しになり、いつまでも終わりませんでした。
+
+// countingReader は読んだバイト数を数えます。
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// failingReader は limit バイト読んだところで失敗します。
+type failingReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.read >= f.limit {
+		return 0, errors.New("接続が切れた")
+	}
+	if rest := f.limit - f.read; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := f.r.Read(p)
+	f.read += int64(n)
+	return n, err
+}
+
+// putOld は、書きかけより前に書かれたファイルとしてコピー元に置きます。
+func putOld(t *testing.T, s *memory.Storage, path, content string) {
+	t.Helper()
+	put(t, s, path, content)
+	if err := s.SetModTime(context.Background(), path, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("SetModTime: %v", err)
+	}
+}
+
+func TestCopyResumesFromPartial(t *testing.T) {
+	src, dst := newPair(t)
+	content := strings.Repeat("0123456789", 100)
+	putOld(t, src, "/data/big.bin", content)
+
+	// 前回の実行が 600 バイト書いたところで止まったことにする。
+	dst.SetPartial("/backup/data/big.bin", []byte(content[:600]), time.Now().Add(-time.Minute))
+
+	var written atomic.Int64
+	dst.SetHooks(memory.Hooks{
+		PutReader: func(_ string, r io.Reader) io.Reader {
+			return &countingReader{r: r, n: &written}
+		},
+	})
+
+	opts := baseOptions(src, dst)
+	opts.PartialMinSize = 1
+
+	result, err := transfer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.Transferred != 1 || result.Failed != 0 {
+		t.Fatalf("Transferred=%d Failed=%d, want 1 と 0", result.Transferred, result.Failed)
+	}
+	if got := dst.Snapshot()["/backup/data/big.bin"]; got != content {
+		t.Errorf("中身が違う: 長さ %d", len(got))
+	}
+	if got := written.Load(); got != 400 {
+		t.Errorf("書いたのは %d バイト、want 残りの 400 バイト", got)
+	}
+	if parts := dst.Partials(); len(parts) != 0 {
+		t.Errorf("書きかけが残っている: %v", parts)
+	}
+}
+
+// 書きかけのあとでコピー元が書き換わったら、続きからは送らないことを確かめます。
+// 先頭が変わっていれば、続きを足しても別物になるためです。
+func TestCopyRestartsWhenSourceChangedAfterPartial(t *testing.T) {
+	src, dst := newPair(t)
+	content := strings.Repeat("abcdefghij", 100)
+	put(t, src, "/data/big.bin", content)
+
+	// 書きかけは古い中身で、コピー元より前に書かれている。
+	dst.SetPartial("/backup/data/big.bin", []byte(strings.Repeat("z", 600)), time.Now().Add(-time.Hour))
+
+	var written atomic.Int64
+	dst.SetHooks(memory.Hooks{
+		PutReader: func(_ string, r io.Reader) io.Reader {
+			return &countingReader{r: r, n: &written}
+		},
+	})
+
+	opts := baseOptions(src, dst)
+	opts.PartialMinSize = 1
+
+	if _, err := transfer.Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := dst.Snapshot()["/backup/data/big.bin"]; got != content {
+		t.Error("古い書きかけの上に続きを足している")
+	}
+	if got := written.Load(); got != int64(len(content)) {
+		t.Errorf("書いたのは %d バイト、want 最初からの %d バイト", got, len(content))
+	}
+}
+
+// 書きかけの時刻がコピー元より少し前でも、--modify-window の内なら
+// 時計のずれとみなして続きから送り、外なら最初から送ることを確かめます。
+func TestResumeToleratesClockSkewWithinModifyWindow(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		skew        time.Duration
+		wantWritten int64
+	}{
+		{"許容幅の内", 2 * time.Second, 400},
+		{"許容幅の外", 10 * time.Second, 1000},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := newPair(t)
+			content := strings.Repeat("0123456789", 100)
+			modTime := time.Now().Add(-time.Hour)
+			put(t, src, "/data/big.bin", content)
+			if err := src.SetModTime(context.Background(), "/data/big.bin", modTime); err != nil {
+				t.Fatalf("SetModTime: %v", err)
+			}
+			// 転送先の時計が遅れていて、書きかけの時刻がコピー元より前に見える。
+			dst.SetPartial("/backup/data/big.bin", []byte(content[:600]), modTime.Add(-tt.skew))
+
+			var written atomic.Int64
+			dst.SetHooks(memory.Hooks{
+				PutReader: func(_ string, r io.Reader) io.Reader {
+					return &countingReader{r: r, n: &written}
+				},
+			})
+
+			opts := baseOptions(src, dst)
+			opts.PartialMinSize = 1
+			opts.Compare.ModifyWindow = 5 * time.Second
+
+			if _, err := transfer.Run(context.Background(), opts); err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if got := dst.Snapshot()["/backup/data/big.bin"]; got != content {
+				t.Errorf("中身が違う: 長さ %d", len(got))
+			}
+			if got := written.Load(); got != tt.wantWritten {
+				t.Errorf("書いたのは %d バイト、want %d バイト", got, tt.wantWritten)
+			}
+		})
+	}
+}
+
+// 途中で切れた転送の書きかけが残り、次の実行がそれを使うことを確かめます。
+func TestInterruptedCopyLeavesPartialForNextRun(t *testing.T) {
+	src, dst := newPair(t)
+	content := strings.Repeat("0123456789", 100)
+	putOld(t, src, "/data/big.bin", content)
+
+	dst.SetHooks(memory.Hooks{
+		PutReader: func(_ string, r io.Reader) io.Reader {
+			return &failingReader{r: r, limit: 700}
+		},
+	})
+
+	opts := baseOptions(src, dst)
+	opts.PartialMinSize = 1
+
+	result, err := transfer.Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.Failed != 1 {
+		t.Fatalf("Failed=%d, want 1", result.Failed)
+	}
+	if parts := dst.Partials(); len(parts) != 1 {
+		t.Fatalf("書きかけ = %v, want 1件", parts)
+	}
+
+	var written atomic.Int64
+	dst.SetHooks(memory.Hooks{
+		PutReader: func(_ string, r io.Reader) io.Reader {
+			return &countingReader{r: r, n: &written}
+		},
+	})
+
+	if _, err := transfer.Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := dst.Snapshot()["/backup/data/big.bin"]; got != content {
+		t.Errorf("中身が違う: 長さ %d", len(got))
+	}
+	if got := written.Load(); got != 300 {
+		t.Errorf("2回目に書いたのは %d バイト、want 残りの 300 バイト", got)
+	}
+}
+
+// 小さなファイルは続きからの経路を通らないことを確かめます。
+func TestSmallFilesIgnorePartials(t *testing.T) {
+	src, dst := newPair(t)
+	putOld(t, src, "/data/a.txt", "0123456789")
+	dst.SetPartial("/backup/data/a.txt", []byte("01234"), time.Now())
+
+	opts := baseOptions(src, dst)
+	opts.PartialMinSize = 1 << 20
+
+	if _, err := transfer.Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := dst.Snapshot()["/backup/data/a.txt"]; got != "0123456789" {
+		t.Errorf("中身 = %q", got)
+	}
+	if parts := dst.Partials(); len(parts) != 1 {
+		t.Errorf("使っていない書きかけに触れている: %v", parts)
+	}
+}
+
+// hashReportingResumer は、続きから書いたあとに全体のハッシュを返すか
+// どうかを選べる書き込み先です。返さないものはローカルディスクの代わりです。
+type hashReportingResumer struct {
+	*memory.Storage
+	report bool
+}
+
+func (h hashReportingResumer) PutResume(ctx context.Context, p string, offset int64, r io.Reader, meta storage.ObjectMeta) (*storage.FileInfo, error) {
+	fi, err := h.Storage.PutResume(ctx, p, offset, r, meta)
+	if err != nil || !h.report {
+		return fi, err
+	}
+	sum, err := h.Storage.Hash(ctx, p, storage.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	out := *fi
+	out.Hashes = map[storage.HashType]string{storage.SHA256: sum}
+	return &out, nil
+}
+
+// ハッシュで検証するときでも、書きかけのぶんをコピー元から読み直さないことを
+// 確かめます。書き込み先がハッシュを返さなければ検証はできないので、
+// 読み直しても無駄になります。返すなら全体のハッシュで検証します。
+func TestResumeWithChecksumDoesNotRereadPartial(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		report    bool
+		wantOpens int64
+	}{
+		// 続きを読む1回だけ。
+		{"ハッシュを返さない", false, 1},
+		// 続きを読む1回と、コピー元に全体のハッシュを問い合わせる1回。
+		{"ハッシュを返す", true, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst := newPair(t)
+			content := strings.Repeat("0123456789", 100)
+			putOld(t, src, "/data/big.bin", content)
+			dst.SetPartial("/backup/data/big.bin", []byte(content[:600]), time.Now().Add(-time.Minute))
+
+			var opens atomic.Int64
+			src.SetHooks(memory.Hooks{BeforeOp: func(op, _ string) error {
+				if op == "open" {
+					opens.Add(1)
+				}
+				return nil
+			}})
+
+			opts := baseOptions(src, hashReportingResumer{dst, tt.report})
+			opts.PartialMinSize = 1
+			opts.Compare.Fields = []transfer.CompareField{transfer.CompareSize, transfer.CompareHash}
+
+			result, err := transfer.Run(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if result.Transferred != 1 || result.Failed != 0 {
+				t.Fatalf("Transferred=%d Failed=%d, want 1 と 0", result.Transferred, result.Failed)
+			}
+			if got := dst.Snapshot()["/backup/data/big.bin"]; got != content {
+				t.Errorf("中身が違う: 長さ %d", len(got))
+			}
+			if got := opens.Load(); got != tt.wantOpens {
+				t.Errorf("コピー元を %d 回読んだ、want %d 回", got, tt.wantOpens)
+			}
+		})
+	}
+}
@@ -34,6 +34,12 @@ type Options struct {
 
 	// Workers は同時に転送するファイル数です。1未満なら1にします。
 	Workers int
+	// Checkers は同時に一覧するディレクトリの数です。1未満なら1にします。
+	//
+	// 一覧の往復が遅いストレージでは、1つずつ一覧していると走査が
+	// 追いつかず、転送の手が空きます。増やしても、判断の知らせ
+	// （OnDecision）は1つずつ一覧したときと同じ順に届きます。
+	Checkers int
 
 	// Compare は転送の要否を判断する規則です。
 	Compare ComparePolicy
@@ -53,6 +59,35 @@ type Options struct {
 	// BandwidthLimit は1秒あたりの転送バイト数の上限です。0 なら無制限。
 	BandwidthLimit int64
 
+	// PartialMinSize 以上のファイルは、転送先に書きかけが残っていれば
+	// その続きから送ります。0 なら続きからは送りません。
+	//
+	// 小さなファイルを対象にしないのは、書きかけを確かめる問い合わせの
+	// ぶんだけ、かえって遅くなるためです。
+	PartialMinSize int64
+
+	// MultiStreamCutoff 以上のファイルは、コピー元から範囲に分けて
+	// MultiStreams 本で同時に読みます。1本の接続の速さで頭打ちに
+	// ならないようにするためです。0 なら分けません。
+	//
+	// 転送先が位置を指定して書けるストレージなら、届いた範囲をそのまま
+	// 書きます。そうでなければ並べ直して流すので、MultiStreams ×
+	// MultiStreamChunkSize ぶんのメモリを使います。
+	MultiStreamCutoff int64
+	// MultiStreams は同時に読む本数です。2未満なら分けません。
+	MultiStreams int
+	// MultiStreamChunkSize は1つの範囲の大きさです。0 なら既定値です。
+	MultiStreamChunkSize int64
+
+	// FastList を真にすると、コピー元とコピー先の配下を、走査の前に
+	// まとめて一覧します。ディレクトリの多いクラウド上のツリーでは、
+	// ディレクトリごとの一覧の往復がなくなるぶん、ずっと速く済みます。
+	//
+	// 引き換えに、ツリー全体の一覧をメモリに持ち、一覧し終えるまで
+	// 転送が始まりません。まとめて一覧できないストレージでは、
+	// これまでどおりディレクトリごとに一覧します。
+	FastList bool
+
 	// Delete を真にすると、コピー元にないものをコピー先から消します。
 	//
 	// 転送に1件でも失敗があれば削除は行いません。読めなかったものを
@@ -71,6 +106,34 @@ type Options struct {
 	// 中身の分からないディレクトリからは何も控えられないためです。
 	DeleteOnPartial bool
 
+	// TrackRenames を真にすると、コピー元で場所や名前を変えただけのものを、
+	// 送り直さずに転送先の中での移動で済ませます。Delete と併せて使います。
+	//
+	// 転送先が Mover でなければ何もしません。対にする方法は、共通の
+	// ハッシュがあればハッシュ、なければ更新時刻です。
+	TrackRenames bool
+
+	// Journal を渡すと、済んだファイルとディレクトリを書き足していきます。
+	// 前回の記録を読み込んだものなら、済んでいるディレクトリは一覧も
+	// 比較もせずに飛ばします。nil なら記録しません。DryRun では使いません。
+	//
+	// Delete のときは、済んでいるディレクトリも一覧だけはし直します。
+	// コピー元にないものを控えるには、一覧が要るためです。中のファイルは
+	// 比べ直しません。
+	Journal *Journal
+
+	// BackupStorage と BackupDir を指定すると、上書きや削除で失われる
+	// はずだったものを、消す前にそこへ移します。同期を取り違えても
+	// 取り戻せるようにするためです。
+	//
+	// 退避先の中の位置は、DstDir からの相対パスと同じです。
+	// 転送先と重なる場所は指定できません。
+	BackupStorage storage.Storage
+	BackupDir     string
+	// BackupSuffix は退避したファイルの名前に付ける印です。
+	// 拡張子の前に入ります。空なら名前を変えません。
+	BackupSuffix string
+
 	// DryRun を真にすると、実際には転送せず何が転送されるかだけを示します。
 	DryRun bool
 
@@ -86,6 +149,7 @@ type Options struct {
 
 	// OnDecision は転送の要否を判断するたびに呼ばれます。
 	// hbg check のように、判断だけを一覧したい場合に使います。
+	// 同時には呼ばれず、Checkers によらず同じ順に呼ばれます。
 	OnDecision func(DecisionEvent)
 }
 
@@ -150,6 +214,10 @@ type Result struct {
 	Deleted int
 	// DeleteFailed は削除に失敗した件数です。
 	DeleteFailed int
+	// BackedUp は上書きや削除の前に退避した件数です。
+	BackedUp int
+	// Renamed は送らずに転送先の中での移動で済ませた件数です。
+	Renamed int
 
 	// Errors は表示用に保持する失敗の詳細です。
 	// MaxReportedErrors 件で打ち切られます。
@@ -168,6 +236,15 @@ type task struct {
 	name    string
 	relPath string
 	size    int64
+	modTime time.Time
+	// dstExists は転送先に同じ名前のものがあるかどうかです。
+	// あれば上書きになるので、退避の対象になります。
+	dstExists bool
+	// renameFrom があれば、送らずにそこから移動して済ませます。
+	renameFrom *extraneous
+	// dir は、このファイルを含むディレクトリの途中経過です。
+	// 途中経過を記録しない場合は nil です。
+	dir *dirProgress
 }
 
 // engine は1回の転送の状態です。
@@ -177,8 +254,22 @@ type engine struct {
 	limits   *limiterSet
 	bw       *bandwidthLimiter
 	comparer *Comparer
+	// backup は退避の受け持ちです。退避しない場合は nil です。
+	backup *backupper
+	// renames は改名の対を見つける方法です。検出しない場合は nil です。
+	renames *renameMatch
+	// journal は途中経過の記録です。記録しない場合は nil です。
+	journal *Journal
 	// verifyHash は転送後の検証に使うハッシュです。使わない場合は空です。
 	verifyHash storage.HashType
+	// order は判断の知らせを並べ直します。並行して走査しない場合は nil です。
+	order *decisionOrder
+	// checkers は、走査中の起点で子ディレクトリの走査を任せる先です。
+	// 並行して走査しない場合は nil です。
+	checkers *errgroup.Group
+	// srcTree と dstTree は、走査中の起点の配下をまとめて一覧したものです。
+	// まとめて一覧しない場合や、できない場合は nil です。
+	srcTree, dstTree *storage.Tree
 
 	// startedAt はこの転送を始めた時刻です。
 	// 置き去りにされた書き込み中ファイルを見分けるのに使います。
@@ -188,6 +279,11 @@ type engine struct {
 	scanDirs  atomic.Int64
 	scanFiles atomic.Int64
 	scanBytes atomic.Int64
+	// resumedDirs は、前回までに済んでいたので飛ばしたディレクトリの数です。
+	resumedDirs atomic.Int64
+
+	// ディレクトリごとの途中経過を数えるときの排他。
+	progressMu sync.Mutex
 
 	// 結果
 	mu     sync.Mutex
@@ -202,6 +298,10 @@ type engine struct {
 	extraMu sync.Mutex
 	extra   []extraneous
 
+	// 改名の相手を探すために、走査の終わりまで控えている転送の指示。
+	heldMu sync.Mutex
+	held   []heldTask
+
 	// abort は中断を伝えます。
 	abort context.CancelFunc
 }
@@ -211,6 +311,9 @@ func Run(ctx context.Context, opts Options) (*Result, error) {
 	if opts.Workers < 1 {
 		opts.Workers = 1
 	}
+	if opts.Checkers < 1 {
+		opts.Checkers = 1
+	}
 	if opts.Retry.MaxAttempts < 1 {
 		opts.Retry.MaxAttempts = 1
 	}
@@ -229,6 +332,17 @@ func Run(ctx context.Context, opts Options) (*Result, error) {
 		return nil, err
 	}
 
+	// 設定で変更を禁じた転送先には、1件目を送る前に断る。
+	// 走査を終えてから1件ずつ失敗させても、何も得られない。
+	if err := storage.Permit(opts.Dst, "put"); err != nil {
+		return nil, err
+	}
+	if opts.Delete {
+		if err := storage.Permit(opts.Dst, "remove"); err != nil {
+			return nil, err
+		}
+	}
+
 	// 転送元が存在しなければ、ここで失敗させる。
 	// 以前は一致するものがなくても「0件成功」で正常終了しており、
 	// パスを打ち間違えてもスクリプトからは成功に見えていた。
@@ -241,6 +355,9 @@ func Run(ctx context.Context, opts Options) (*Result, error) {
 	if srcErr != nil {
 		return nil, srcErr
 	}
+	if err := checkBackupDir(opts, srcRoots); err != nil {
+		return nil, err
+	}
 
 	// 呼び出し側の ctx と、中断のために自分で作る ctx を分けておく。
 	// 「利用者が中断した」のか「失敗が多すぎて自分で止めた」のかを
@@ -262,6 +379,18 @@ func Run(ctx context.Context, opts Options) (*Result, error) {
 		startedAt: started,
 	}
 	e.verifyHash = resolveVerifyHash(opts, comparer)
+	e.backup = newBackupper(e)
+	if !opts.DryRun {
+		e.journal = opts.Journal
+	}
+	if opts.Checkers > 1 && opts.OnDecision != nil {
+		e.order = newDecisionOrder(opts.OnDecision)
+	}
+	if match, ok := resolveRenameMatch(opts); ok {
+		e.renames = &match
+	} else if opts.TrackRenames && opts.Delete {
+		e.reporter.Logf("%s では改名を検出できないため、ふつうに送ります", opts.Dst.Type())
+	}
 
 	e.reporter.ScanStarted()
 
@@ -281,7 +410,13 @@ func Run(ctx context.Context, opts Options) (*Result, error) {
 			e.reporter.ScanDone(e.scanDirs.Load(), e.scanFiles.Load(), e.scanBytes.Load())
 		}()
 		defer close(tasks)
-		return e.scan(gctx, srcRoots, tasks)
+		if err := e.scan(gctx, srcRoots, tasks); err != nil {
+			return err
+		}
+		if n := e.resumedDirs.Load(); n > 0 {
+			e.reporter.Logf("前回までに済んでいた %d ディレクトリを飛ばしました", n)
+		}
+		return e.releaseHeld(gctx, tasks)
 	})
 
 	for range opts.Workers {
@@ -389,6 +524,20 @@ func (e *engine) recordDeleted() {
 	e.result.Deleted++
 }
 
+// recordBackedUp は退避を記録します。
+func (e *engine) recordBackedUp() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.result.BackedUp++
+}
+
+// recordRenamed は改名で済ませたことを記録します。
+func (e *engine) recordRenamed() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.result.Renamed++
+}
+
 // recordDeleteFailure は削除の失敗を記録します。
 //
 // 転送の失敗とは分けて数えます。転送は成功したのに片付けだけ
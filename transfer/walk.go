@@ -7,6 +7,8 @@ import (
 	"path"
 	"strings"
 
+	"golang.org/x/sync/errgroup"
+
 	"github.com/mt3hr/hbg/storage"
 )
 
@@ -37,17 +39,58 @@ func (e *engine) scanRoot(ctx context.Context, srcInfo storage.FileInfo, tasks c
 	// hbg copy local:/a/photos dropbox:/backup なら
 	// dropbox:/backup/photos に入る。
 	dstDir := path.Join(e.opts.DstDir, srcInfo.Name)
-	return e.scanDir(ctx, srcInfo.Path, dstDir, "", tasks)
+	if e.opts.FastList {
+		e.loadTrees(ctx, srcInfo.Path, dstDir)
+		defer func() { e.srcTree, e.dstTree = nil, nil }()
+	}
+
+	if e.opts.Checkers <= 1 {
+		return e.scanDir(ctx, srcInfo.Path, dstDir, "", nil, nil, tasks)
+	}
+
+	// 子ディレクトリの走査を、空いている一覧係に任せる。
+	// この走査自身も1つと数えるので、任せられるのは Checkers-1 まで。
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(e.opts.Checkers - 1)
+	e.checkers = g
+	defer func() { e.checkers = nil }()
+
+	err := e.scanDir(gctx, srcInfo.Path, dstDir, "", nil, e.order.begin(), tasks)
+	if waitErr := g.Wait(); err == nil {
+		err = waitErr
+	}
+	return err
 }
 
 // scanDir はディレクトリを再帰的に走査します。
 //
 // relDir はコピー元の起点からの相対パスです。絞り込みに使います。
-func (e *engine) scanDir(ctx context.Context, srcDir, dstDir, relDir string, tasks chan<- task) error {
+// parent は親ディレクトリの途中経過です。
+// log はこのディレクトリの判断の知らせの列です。並べ直さない場合は nil です。
+func (e *engine) scanDir(
+	ctx context.Context,
+	srcDir, dstDir, relDir string,
+	parent *dirProgress,
+	log *decisionLog,
+	tasks chan<- task,
+) error {
+	defer e.order.finish(log)
+
 	if err := ctx.Err(); err != nil {
 		return err
 	}
 
+	if e.journal.dirDone(dstDir) && !e.opts.Delete {
+		// 前回までに済んでいる。一覧も比較もしない。
+		//
+		// 同期で消すときは、コピー元にないものを控えるために一覧は取る。
+		// 前回は失敗があって削除まで進んでいないかもしれないためだ。
+		// 中のファイルは済んでいるので、比べ直しはしない（fileDone）。
+		e.resumedDirs.Add(1)
+		return nil
+	}
+	dir := e.enterDir(dstDir, parent)
+
 	// 転送先のディレクトリを先に用意する。
 	//
 	// 中身が空でもここで作られるので、空のディレクトリも転送先に残る。
@@ -55,17 +98,16 @@ func (e *engine) scanDir(ctx context.Context, srcDir, dstDir, relDir string, tas
 	// 子を持たないディレクトリは作られず、しかも続く一覧が失敗していた。
 	dstEntries, err := e.ensureDir(ctx, dstDir)
 	if err != nil {
+		e.failDir(dir)
 		return e.recordScanFailure(ctx, e.opts.Dst, dstDir, err)
 	}
 
 	// 転送元を一覧する。
 	// 全件をここで持つのは1ディレクトリぶんだけなので、
-	// 件数が増えても使用メモリは膨らまない。
-	if limitErr := e.limits.wait(ctx, e.opts.Src); limitErr != nil {
-		return limitErr
-	}
-	entries, err := storage.ListAll(ctx, e.opts.Src, srcDir)
+	// 件数が増えても使用メモリは膨らまない（まとめて一覧した場合を除く）。
+	entries, err := e.listSrc(ctx, srcDir)
 	if err != nil {
+		e.failDir(dir)
 		return e.recordScanFailure(ctx, e.opts.Src, srcDir, err)
 	}
 
@@ -94,7 +136,7 @@ func (e *engine) scanDir(ctx context.Context, srcDir, dstDir, relDir string, tas
 				continue
 			}
 			child := path.Join(dstDir, entry.Name)
-			if err := e.scanDir(ctx, entry.Path, child, rel, tasks); err != nil {
+			if err := e.scanChild(ctx, entry.Path, child, rel, dir, log, tasks); err != nil {
 				return err
 			}
 			continue
@@ -110,13 +152,52 @@ func (e *engine) scanDir(ctx context.Context, srcDir, dstDir, relDir string, tas
 		}
 		e.reporter.ScanProgress(e.scanDirs.Load(), e.scanFiles.Load(), e.scanBytes.Load())
 
-		if err := e.considerFile(ctx, entry, dstDir, rel, dstByName, tasks); err != nil {
+		if err := e.considerFile(ctx, entry, dstDir, rel, dstByName, dir, log, tasks); err != nil {
 			return err
 		}
 	}
+
+	// 一覧をたどり終えた。送ったものがすべて届けば、このディレクトリは済む。
+	e.settle(dir)
 	return nil
 }
 
+// scanChild は子ディレクトリを走査します。
+//
+// 空いている一覧係があれば任せ、なければその場で走査します。
+// その場で走査するので、一覧係が足りなくても待ち合わせで止まりません。
+// 同時に持つ一覧は、一覧係の数と、その場でたどっている深さの分だけです。
+// 任せた子の走査が遅いと、その場でたどる後ろの兄弟の判断の知らせが
+// 溜まっていきます。溜まりすぎたら、前の子の知らせが出るまで待ちます
+// （decisionOrder.add）。
+func (e *engine) scanChild(
+	ctx context.Context,
+	srcDir, dstDir, relDir string,
+	dir *dirProgress,
+	log *decisionLog,
+	tasks chan<- task,
+) error {
+	childLog := e.order.child(log)
+	if e.checkers == nil {
+		return e.scanDir(ctx, srcDir, dstDir, relDir, dir, childLog, tasks)
+	}
+
+	// 任せた走査が始まる前に親の一覧が終わっても、親が済んだことに
+	// ならないよう、先に1つ数えておく。
+	e.addPending(dir)
+	run := func() error {
+		if err := e.scanDir(ctx, srcDir, dstDir, relDir, dir, childLog, tasks); err != nil {
+			return err
+		}
+		e.settle(dir)
+		return nil
+	}
+	if e.checkers.TryGo(run) {
+		return nil
+	}
+	return run()
+}
+
 // recordScanFailure は走査中の失敗を1件として数え、走査を続けます。
 //
 // 以前はここで error を返しており、読めないディレクトリが1つあるだけで
@@ -162,7 +243,7 @@ func (e *engine) scanFile(ctx context.Context, info storage.FileInfo, dstDir, re
 	}
 	e.reporter.ScanProgress(0, 1, e.scanBytes.Load())
 
-	return e.considerFile(ctx, info, dstDir, rel, e.indexByName(dstEntries), tasks)
+	return e.considerFile(ctx, info, dstDir, rel, e.indexByName(dstEntries), nil, nil, tasks)
 }
 
 // considerFile は1ファイルの転送要否を判断し、必要なら転送の指示を出します。
@@ -171,8 +252,23 @@ func (e *engine) considerFile(
 	srcInfo storage.FileInfo,
 	dstDir, rel string,
 	dstByName map[string]storage.FileInfo,
+	dir *dirProgress,
+	log *decisionLog,
 	tasks chan<- task,
 ) error {
+	if e.journal.fileDone(path.Join(dstDir, srcInfo.Name)) {
+		// 前回までに転送してある。比べ直さない。
+		e.notifyDecisionIn(log, DecisionEvent{
+			Path:   rel,
+			Size:   srcInfo.Size,
+			Action: ActionSkip,
+			Reason: "前回までに転送済み",
+		})
+		e.recordSkip(srcInfo.Size)
+		e.reporter.Skipped(srcInfo.Name, srcInfo.Size)
+		return nil
+	}
+
 	var dstInfo *storage.FileInfo
 	if found, ok := dstByName[e.nameKey(srcInfo.Name)]; ok {
 		dstInfo = &found
@@ -185,7 +281,7 @@ func (e *engine) considerFile(
 		action = ActionCopy
 	}
 
-	e.notifyDecision(DecisionEvent{
+	e.notifyDecisionIn(log, DecisionEvent{
 		Path:   rel,
 		Size:   srcInfo.Size,
 		Action: action,
@@ -198,16 +294,29 @@ func (e *engine) considerFile(
 		return nil
 	}
 
+	t := task{
+		srcPath:   srcInfo.Path,
+		dstDir:    dstDir,
+		name:      srcInfo.Name,
+		relPath:   rel,
+		size:      srcInfo.Size,
+		modTime:   srcInfo.ModTime,
+		dstExists: dstInfo != nil,
+		dir:       dir,
+	}
+	e.addPending(dir)
+
+	// 転送先に無いものは、改名しただけかもしれない。
+	// 走査が終わって相手が出そろうまで控えておく。
+	if dstInfo == nil && e.tracksRenames() {
+		e.holdForRename(t, srcInfo)
+		return nil
+	}
+
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
-	case tasks <- task{
-		srcPath: srcInfo.Path,
-		dstDir:  dstDir,
-		name:    srcInfo.Name,
-		relPath: rel,
-		size:    srcInfo.Size,
-	}:
+	case tasks <- t:
 	}
 	return nil
 }
@@ -234,6 +343,10 @@ func (e *engine) nameKey(name string) string {
 //
 // 同じディレクトリを何度も作らないよう、作成済みのものは覚えておきます。
 func (e *engine) ensureDir(ctx context.Context, dir string) ([]storage.FileInfo, error) {
+	if e.dstTree != nil {
+		return e.ensureDirInTree(ctx, dir)
+	}
+
 	if e.opts.DryRun {
 		// 実際には作らないので、中身は空として扱う。
 		entries, err := storage.ListAll(ctx, e.opts.Dst, dir)
@@ -257,17 +370,9 @@ func (e *engine) ensureDir(ctx context.Context, dir string) ([]storage.FileInfo,
 	if e.dirAlreadyMade(dir) {
 		return nil, err
 	}
-
-	mkErr := doWithRetry(ctx, e.opts.Retry, func(ctx context.Context, _ int) error {
-		if waitErr := e.limits.wait(ctx, e.opts.Dst); waitErr != nil {
-			return waitErr
-		}
-		return e.opts.Dst.Mkdir(ctx, dir)
-	}, nil).err
-	if mkErr != nil {
+	if mkErr := e.makeDir(ctx, dir); mkErr != nil {
 		return nil, mkErr
 	}
-	e.markDirMade(dir)
 
 	if limitErr := e.limits.wait(ctx, e.opts.Dst); limitErr != nil {
 		return nil, limitErr
@@ -279,6 +384,41 @@ func (e *engine) ensureDir(ctx context.Context, dir string) ([]storage.FileInfo,
 	return entries, nil
 }
 
+// ensureDirInTree は、まとめて一覧した転送先の木を引いて ensureDir を行います。
+//
+// 木に無いディレクトリは、まだ無いと分かっているので、一覧し直さずに作ります。
+// 作ったばかりのディレクトリの中身は空です。
+func (e *engine) ensureDirInTree(ctx context.Context, dir string) ([]storage.FileInfo, error) {
+	if entries, ok := e.dstTree.Dir(dir); ok {
+		if !e.opts.DryRun {
+			e.markDirMade(dir)
+		}
+		return entries, nil
+	}
+	if e.opts.DryRun || e.dirAlreadyMade(dir) {
+		return nil, nil
+	}
+	if err := e.makeDir(ctx, dir); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// makeDir は転送先にディレクトリを作り、作ったことを覚えておきます。
+func (e *engine) makeDir(ctx context.Context, dir string) error {
+	err := doWithRetry(ctx, e.opts.Retry, func(ctx context.Context, _ int) error {
+		if waitErr := e.limits.wait(ctx, e.opts.Dst); waitErr != nil {
+			return waitErr
+		}
+		return e.opts.Dst.Mkdir(ctx, dir)
+	}, nil).err
+	if err != nil {
+		return err
+	}
+	e.markDirMade(dir)
+	return nil
+}
+
 func (e *engine) markDirMade(dir string) {
 	e.dirsMu.Lock()
 	defer e.dirsMu.Unlock()
@@ -31,7 +31,12 @@ func (e *engine) transferOne(ctx context.Context, t task) {
 	dstPath := path.Join(t.dstDir, t.name)
 	started := time.Now()
 
+	if t.renameFrom != nil && e.renameOne(ctx, t, dstPath) {
+		return
+	}
+
 	if e.opts.DryRun {
+		_ = e.backup.beforeOverwrite(ctx, t, dstPath)
 		e.reporter.Logf("転送する（実行しない）: %s:%s -> %s:%s",
 			e.opts.Src.Type(), t.srcPath, e.opts.Dst.Type(), dstPath)
 
@@ -49,12 +54,31 @@ func (e *engine) transferOne(ctx context.Context, t task) {
 	tracker := e.reporter.StartFile(t.name, t.size)
 	defer tracker.Finish()
 
+	// 上書きになるものは、先に退避する。
+	// 退避できなければ上書きしない。退避を頼まれたのに古いものを
+	// 失ってしまっては、頼まれた意味がなくなるため。
+	if err := e.backup.beforeOverwrite(ctx, t, dstPath); err != nil {
+		tracker.Abort()
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			e.failDir(t.dir)
+			e.recordFailure(err)
+			e.reporter.Logf("失敗: %v", err)
+		}
+		e.notify(TransferEvent{
+			SrcPath:  t.srcPath,
+			DstPath:  dstPath,
+			Duration: time.Since(started),
+			Err:      err,
+		})
+		return
+	}
+
 	// 再試行のたびに最初から読み直す。
 	// 以前は転送元から受け取った読み取り口を一度しか使えず、
 	// そもそも書き込みの再試行ができなかった。
 	res := doWithRetry(ctx, e.opts.Retry,
 		func(ctx context.Context, _ int) error {
-			return e.copyOne(ctx, tracker, t.srcPath, dstPath)
+			return e.copyOne(ctx, tracker, t, dstPath)
 		},
 		func(attempt int, wait time.Duration, err error) {
 			// 進捗の表示も巻き戻す。
@@ -68,6 +92,7 @@ func (e *engine) transferOne(ctx context.Context, t task) {
 	switch {
 	case res.err == nil:
 		e.recordSuccess(t.size)
+		e.fileDone(t, dstPath)
 
 	case errors.Is(res.err, context.Canceled), errors.Is(res.err, context.DeadlineExceeded):
 		// 取り消しは失敗として数えない。利用者の意思なので。
@@ -75,6 +100,7 @@ func (e *engine) transferOne(ctx context.Context, t task) {
 
 	default:
 		tracker.Abort()
+		e.failDir(t.dir)
 		err := fmt.Errorf("%s:%s -> %s:%s: %w",
 			e.opts.Src.Type(), t.srcPath, e.opts.Dst.Type(), dstPath, res.err)
 		e.recordFailure(err)
@@ -92,12 +118,12 @@ func (e *engine) transferOne(ctx context.Context, t task) {
 }
 
 // copyOne は1回ぶんの転送を行います。
-func (e *engine) copyOne(ctx context.Context, tracker progress.FileTracker, srcPath, dstPath string) error {
+func (e *engine) copyOne(ctx context.Context, tracker progress.FileTracker, t task, dstPath string) error {
 	if err := e.limits.wait(ctx, e.opts.Src); err != nil {
 		return err
 	}
 
-	_, err := storage.Copy(ctx, e.opts.Src, srcPath, e.opts.Dst, dstPath, storage.CopyOptions{
+	opts := storage.CopyOptions{
 		VerifyHash: e.verifyHash,
 		Wrap: func(r io.Reader) io.Reader {
 			// 進捗の計測と帯域の制限を、読み取りの流れに割り込ませる。
@@ -108,10 +134,83 @@ func (e *engine) copyOne(ctx context.Context, tracker progress.FileTracker, srcP
 			// 実際より何倍も速くなってしまう。
 			return tracker.Wrap(e.bw.wrap(ctx, r))
 		},
-	})
+	}
+
+	if e.multiStream(t) {
+		opts.Streams = e.opts.MultiStreams
+		opts.ChunkSize = e.opts.MultiStreamChunkSize
+	}
+
+	srcInfo := storage.FileInfo{Path: t.srcPath, Name: t.name, Size: t.size, ModTime: t.modTime}
+	if e.resumable(t) {
+		offset := e.resumeOffset(ctx, srcInfo, dstPath)
+		if offset > 0 {
+			// 送らずに済むぶんは、片付いたものとして進みぐあいに入れる。
+			// 入れないと、残りの見積もりが実際より大きく出続ける。
+			tracker.Complete(offset)
+			e.reporter.Logf("%s: 書きかけの %s の続きから送ります", t.name, progress.HumanBytes(offset))
+		}
+		_, err := storage.ResumeCopy(ctx, e.opts.Src, srcInfo, e.opts.Dst, dstPath, offset, opts)
+		return err
+	}
+
+	if opts.Streams > 1 {
+		_, err := storage.MultiStreamCopy(ctx, e.opts.Src, srcInfo, e.opts.Dst, dstPath, opts)
+		return err
+	}
+
+	_, err := storage.Copy(ctx, e.opts.Src, t.srcPath, e.opts.Dst, dstPath, opts)
 	return err
 }
 
+// multiStream は、そのファイルをコピー元から範囲に分けて同時に読むかを返します。
+//
+// 続きから送る経路とは両立します。書きかけの続きも、範囲に分けて読んで
+// 並べ直してから書き足します。
+func (e *engine) multiStream(t task) bool {
+	if e.opts.MultiStreamCutoff <= 0 || e.opts.MultiStreams < 2 {
+		return false
+	}
+	if t.size == storage.SizeUnknown || t.size < e.opts.MultiStreamCutoff {
+		return false
+	}
+	return storage.CanMultiStream(e.opts.Src, e.opts.Dst)
+}
+
+// resumable は、そのファイルを書きかけの続きから送れる経路で運ぶかを返します。
+func (e *engine) resumable(t task) bool {
+	if e.opts.PartialMinSize <= 0 || t.size == storage.SizeUnknown || t.size < e.opts.PartialMinSize {
+		return false
+	}
+	return storage.CanResume(e.opts.Src, e.opts.Dst)
+}
+
+// resumeOffset は、書きかけの続きから送れる位置を返します。
+// 続きから送れなければ 0 です。
+//
+// 書きかけを確かめられなかった場合も 0 にします。最初から送り直せば
+// 済むことなので、それを理由に転送を失敗させはしません。
+func (e *engine) resumeOffset(ctx context.Context, srcInfo storage.FileInfo, dstPath string) int64 {
+	if err := e.limits.wait(ctx, e.opts.Dst); err != nil {
+		return 0
+	}
+	part, err := storage.PartialOf(ctx, e.opts.Dst, dstPath)
+	if err != nil || part.Size == 0 {
+		return 0
+	}
+	if !e.trustedPart(*part, srcInfo) {
+		e.reporter.Logf("%s: 書きかけはコピー元と合わないため、最初から送ります", srcInfo.Name)
+		return 0
+	}
+	return part.Size
+}
+
+// fileDone は1ファイルが済んだことを途中経過に記録します。
+func (e *engine) fileDone(t task, dstPath string) {
+	e.journal.markFile(dstPath)
+	e.settle(t.dir)
+}
+
 // notify は1ファイルの結果を呼び出し側へ伝えます。
 func (e *engine) notify(ev TransferEvent) {
 	if e.opts.OnTransfer != nil {